@@ -12,6 +12,8 @@ import (
 	"net"
 	"net/http"
 	"strings"
+	"sync"
+	"time"
 
 	crypto_acme "golang.org/x/crypto/acme"
 	"golang.org/x/crypto/acme/autocert"
@@ -28,6 +30,11 @@ import (
 var (
 	manager *autocert.Manager
 	l       = zlog.Module("acme")
+
+	// Certificates from .pem files in the -tls flag.
+	certsMu  sync.RWMutex
+	certs    []tls.Certificate
+	pemFiles []string
 )
 
 // cache is like autocert.DirCache, but ensures that certificates end with .pem.
@@ -69,10 +76,8 @@ func Setup(db zdb.DB, flag string) (*tls.Config, http.HandlerFunc, uint8) {
 		return nil, nil, 0
 	}
 
-	var (
-		listen uint8
-		certs  []tls.Certificate
-	)
+	var listen uint8
+	pemFiles = nil
 	for _, f := range s {
 		switch {
 		default:
@@ -84,23 +89,7 @@ func Setup(db zdb.DB, flag string) (*tls.Config, http.HandlerFunc, uint8) {
 		case f == "rdr":
 			listen += zhttp.ServeRedirect
 		case strings.HasSuffix(f, ".pem"):
-			cert, err := tls.LoadX509KeyPair(f, f)
-			if err != nil {
-				panic(err)
-			}
-			if len(cert.Certificate) == 0 {
-				panic(fmt.Sprintf("no certificates in %q", f))
-			}
-			if len(cert.Certificate) > 1 {
-				panic(fmt.Sprintf("multiple certificates in %q", f))
-			}
-
-			leaf, err := x509.ParseCertificate(cert.Certificate[0])
-			if err != nil {
-				panic(err)
-			}
-			cert.Leaf = leaf
-			certs = append(certs, cert)
+			pemFiles = append(pemFiles, f)
 		case strings.HasPrefix(f, "acme"):
 			dir := "acme-secrets"
 			if c := strings.Index(f, ":"); c > -1 {
@@ -131,15 +120,41 @@ func Setup(db zdb.DB, flag string) (*tls.Config, http.HandlerFunc, uint8) {
 		}
 	}
 
+	err := Reload()
+	if err != nil {
+		panic(err)
+	}
+
 	if manager == nil {
-		if len(certs) == 0 {
+		if len(pemFiles) == 0 {
 			panic("-tls: no acme and no certificates")
 		}
-		return &tls.Config{Certificates: certs}, nil, listen
+		return &tls.Config{GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if c := pemCertificate(hello.ServerName); c != nil {
+				return c, nil
+			}
+			// Same as crypto/tls: use the first certificate if nothing matches.
+			certsMu.RLock()
+			defer certsMu.RUnlock()
+			return &certs[0], nil
+		}}, nil, listen
+	}
+
+	getCert := manager.GetCertificate
+	dnsm = nil
+	if dnsProvider != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		dnsm, err = newDNSManager(ctx, manager)
+		if err != nil {
+			panic(err)
+		}
+		getCert = dnsm.GetCertificate
 	}
 
 	tlsc := manager.TLSConfig()
-	if len(certs) > 0 {
+	tlsc.GetCertificate = getCert
+	if len(pemFiles) > 0 {
 		// The standard GetCertificate() prefers ACME over the .pem files, but
 		// this isn't what we want for goatcounter.com since we have a
 		// DNS-verified *.goatcounter.com ACME certificate that we want to load
@@ -149,18 +164,60 @@ func Setup(db zdb.DB, flag string) (*tls.Config, http.HandlerFunc, uint8) {
 		// a bit tricky and not really something that needs to be part of
 		// GoatCounter.
 		tlsc.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
-			for _, c := range certs {
-				if c.Leaf.VerifyHostname(hello.ServerName) == nil {
-					return &c, nil
-				}
+			if c := pemCertificate(hello.ServerName); c != nil {
+				return c, nil
 			}
-			return manager.GetCertificate(hello)
+			return getCert(hello)
 		}
 	}
 
 	return tlsc, manager.HTTPHandler(nil).ServeHTTP, listen
 }
 
+// Reload the certificates from the .pem files in the -tls flag; the current
+// certificates are kept if there's an error.
+func Reload() error {
+	newCerts := make([]tls.Certificate, 0, len(pemFiles))
+	for _, f := range pemFiles {
+		cert, err := tls.LoadX509KeyPair(f, f)
+		if err != nil {
+			return errors.Errorf("acme.Reload: %w", err)
+		}
+		if len(cert.Certificate) == 0 {
+			return errors.Errorf("acme.Reload: no certificates in %q", f)
+		}
+		if len(cert.Certificate) > 1 {
+			return errors.Errorf("acme.Reload: multiple certificates in %q", f)
+		}
+
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return errors.Errorf("acme.Reload: %q: %w", f, err)
+		}
+		cert.Leaf = leaf
+		newCerts = append(newCerts, cert)
+	}
+
+	certsMu.Lock()
+	certs = newCerts
+	certsMu.Unlock()
+	return nil
+}
+
+// pemCertificate gets the certificate from the .pem files for the host, or nil
+// if there is none.
+func pemCertificate(host string) *tls.Certificate {
+	certsMu.RLock()
+	defer certsMu.RUnlock()
+	for i := range certs {
+		if certs[i].Leaf.VerifyHostname(host) == nil {
+			c := certs[i]
+			return &c
+		}
+	}
+	return nil
+}
+
 // Enabled reports if ACME is enabled.
 func Enabled() bool {
 	return manager != nil
@@ -171,7 +228,8 @@ func Make(domain string) error {
 	if manager == nil {
 		panic("acme.MakeCert: no manager, use Setup() first")
 	}
-	if !validForwarding(domain) {
+	// The DNS-01 challenge doesn't need the domain to point to us.
+	if dnsm == nil && !validForwarding(domain) {
 		return nil
 	}
 
@@ -190,7 +248,12 @@ func Make(domain string) error {
 		},
 	}
 
-	_, err := manager.GetCertificate(hello)
+	var err error
+	if dnsm != nil {
+		_, err = dnsm.GetCertificate(hello)
+	} else {
+		_, err = manager.GetCertificate(hello)
+	}
 	return errors.Wrap(err, "acme.Make")
 }
 
@@ -0,0 +1,453 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package acme
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	crypto_acme "golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/sync/singleflight"
+	"zgo.at/errors"
+	"zgo.at/zlog"
+)
+
+// DNSProvider creates the TXT records for the ACME DNS-01 challenge.
+type DNSProvider interface {
+	// Present creates a TXT record for fqdn with the value, and returns once
+	// the record is visible to the ACME server.
+	Present(ctx context.Context, fqdn, value string) error
+
+	// CleanUp removes the record created with Present.
+	CleanUp(ctx context.Context, fqdn, value string) error
+}
+
+var dnsProviders = map[string]func(arg string) (DNSProvider, error){
+	"exec": newExecProvider,
+}
+
+// RegisterDNSProvider registers a new DNS provider, which can be used with
+// "-acme-dns name:arg". The function is called with everything after the first
+// ":".
+func RegisterDNSProvider(name string, f func(arg string) (DNSProvider, error)) {
+	dnsProviders[name] = f
+}
+
+var (
+	dnsProvider DNSProvider
+	dnsWildcard []string
+	dnsm        *dnsManager
+)
+
+// SetDNS sets the DNS provider to use the DNS-01 challenge instead of HTTP-01
+// and TLS-ALPN-01, as "name:arg". Certificates for *.domain are created for
+// all the wildcard domains, instead of a certificate per subdomain.
+//
+// This must be called before Setup().
+func SetDNS(provider string, wildcard []string) error {
+	if provider == "" {
+		dnsProvider, dnsWildcard = nil, nil
+		return nil
+	}
+
+	name, arg := provider, ""
+	if i := strings.IndexByte(provider, ':'); i > -1 {
+		name, arg = provider[:i], provider[i+1:]
+	}
+	f, ok := dnsProviders[name]
+	if !ok {
+		return errors.Errorf("acme.SetDNS: unknown provider %q", name)
+	}
+	p, err := f(arg)
+	if err != nil {
+		return errors.Errorf("acme.SetDNS: %w", err)
+	}
+
+	dnsProvider = p
+	dnsWildcard = wildcard
+	return nil
+}
+
+// execProvider runs a program as "prog present|cleanup fqdn value".
+type execProvider struct{ prog string }
+
+func newExecProvider(arg string) (DNSProvider, error) {
+	if arg == "" {
+		return nil, errors.New(`exec: need a program, as "exec:/path/to/prog"`)
+	}
+	return execProvider{prog: arg}, nil
+}
+
+func (p execProvider) Present(ctx context.Context, fqdn, value string) error {
+	return p.run(ctx, "present", fqdn, value)
+}
+
+func (p execProvider) CleanUp(ctx context.Context, fqdn, value string) error {
+	return p.run(ctx, "cleanup", fqdn, value)
+}
+
+func (p execProvider) run(ctx context.Context, args ...string) error {
+	out, err := exec.CommandContext(ctx, p.prog, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %s: %w: %s", p.prog, args[0], err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// dnsManager gets certificates with the DNS-01 challenge; it's like
+// autocert.Manager, which doesn't support DNS-01.
+type dnsManager struct {
+	client     *crypto_acme.Client
+	cache      autocert.Cache
+	provider   DNSProvider
+	wildcard   []string
+	hostPolicy autocert.HostPolicy
+
+	mu       sync.RWMutex
+	certs    map[string]*tls.Certificate
+	renewing map[string]renewState
+	sf       singleflight.Group
+}
+
+// renewState tracks the renewal of a certificate, so that a handshake doesn't
+// start a new renewal while one is running, or right after one failed.
+type renewState struct {
+	running bool
+	fails   int
+	next    time.Time // Don't retry before this.
+}
+
+const (
+	renewBefore   = 30 * 24 * time.Hour // Renew certificates this long before they expire.
+	renewRetry    = time.Minute         // Wait this long after the first failure, doubled on every failure.
+	renewRetryMax = 24 * time.Hour
+)
+
+func newDNSManager(ctx context.Context, m *autocert.Manager) (*dnsManager, error) {
+	key, err := accountKey(ctx, m.Cache)
+	if err != nil {
+		return nil, errors.Errorf("acme: DNS-01 account key: %w", err)
+	}
+
+	c := &crypto_acme.Client{DirectoryURL: m.Client.DirectoryURL, Key: key}
+	_, err = c.Register(ctx, &crypto_acme.Account{}, crypto_acme.AcceptTOS)
+	if err != nil && err != crypto_acme.ErrAccountAlreadyExists {
+		return nil, errors.Errorf("acme: DNS-01 register: %w", err)
+	}
+
+	return &dnsManager{
+		client:     c,
+		cache:      m.Cache,
+		provider:   dnsProvider,
+		wildcard:   dnsWildcard,
+		hostPolicy: m.HostPolicy,
+		certs:      make(map[string]*tls.Certificate),
+		renewing:   make(map[string]renewState),
+	}, nil
+}
+
+// accountKey loads the account key from the cache, or creates a new one; this
+// uses the same key as autocert.
+func accountKey(ctx context.Context, c autocert.Cache) (crypto.Signer, error) {
+	const k = "acme_account+key"
+
+	data, err := c.Get(ctx, k)
+	if err == nil {
+		b, _ := pem.Decode(data)
+		if b == nil {
+			return nil, errors.Errorf("invalid %q in cache", k)
+		}
+		return x509.ParseECPrivateKey(b.Bytes)
+	}
+	if err != autocert.ErrCacheMiss {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return key, c.Put(ctx, k, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}))
+}
+
+// certName gets the name of the certificate for host: "*.example.com" if it's
+// a subdomain of one of the wildcard domains, or the host otherwise.
+func (m *dnsManager) certName(host string) string {
+	for _, w := range m.wildcard {
+		if strings.HasSuffix(host, "."+w) && !strings.Contains(strings.TrimSuffix(host, "."+w), ".") {
+			return "*." + w
+		}
+	}
+	return host
+}
+
+// cacheKey gets the cache key for the certificate name.
+func cacheKey(name string) string {
+	return strings.Replace(name, "*", "_", 1)
+}
+
+func (m *dnsManager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	host := strings.TrimSuffix(strings.ToLower(hello.ServerName), ".")
+	if host == "" {
+		return nil, errors.New("acme: missing server name")
+	}
+
+	name := m.certName(host)
+	m.mu.RLock()
+	cert, ok := m.certs[name]
+	m.mu.RUnlock()
+	if ok {
+		if time.Until(cert.Leaf.NotAfter) < renewBefore && m.startRenew(name) {
+			go func() {
+				defer zlog.Recover()
+				_, err := m.obtain(name)
+				if err != nil {
+					l.Errorf("renew %q: %s", name, err)
+				}
+				m.renewDone(name, err)
+			}()
+		}
+		return cert, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+	if !strings.HasPrefix(name, "*.") {
+		err := m.hostPolicy(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	cert, err := m.fromCache(ctx, name)
+	if err == nil {
+		return cert, nil
+	}
+	if err != autocert.ErrCacheMiss {
+		l.Errorf("cache %q: %s", name, err)
+	}
+	return m.obtain(name)
+}
+
+// startRenew reports if a renewal for name should be started, and marks it as
+// running if it should.
+func (m *dnsManager) startRenew(name string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s := m.renewing[name]
+	if s.running || time.Now().Before(s.next) {
+		return false
+	}
+	s.running = true
+	m.renewing[name] = s
+	return true
+}
+
+// renewDone records the result of a renewal started with startRenew.
+func (m *dnsManager) renewDone(name string, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err == nil {
+		delete(m.renewing, name)
+		return
+	}
+
+	s := m.renewing[name]
+	wait := renewRetryMax
+	if s.fails < 16 {
+		wait = renewRetry << s.fails
+		if wait > renewRetryMax {
+			wait = renewRetryMax
+		}
+	}
+	m.renewing[name] = renewState{fails: s.fails + 1, next: time.Now().Add(wait)}
+}
+
+// fromCache loads a certificate from the cache; expired certificates are
+// treated as a cache miss.
+func (m *dnsManager) fromCache(ctx context.Context, name string) (*tls.Certificate, error) {
+	data, err := m.cache.Get(ctx, cacheKey(name))
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		cert tls.Certificate
+		b    *pem.Block
+	)
+	for {
+		b, data = pem.Decode(data)
+		if b == nil {
+			break
+		}
+		switch b.Type {
+		case "EC PRIVATE KEY":
+			cert.PrivateKey, err = x509.ParseECPrivateKey(b.Bytes)
+		case "CERTIFICATE":
+			cert.Certificate = append(cert.Certificate, b.Bytes)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if cert.PrivateKey == nil || len(cert.Certificate) == 0 {
+		return nil, errors.Errorf("invalid certificate in cache for %q", name)
+	}
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	if time.Now().After(cert.Leaf.NotAfter) {
+		return nil, autocert.ErrCacheMiss
+	}
+
+	m.mu.Lock()
+	m.certs[name] = &cert
+	m.mu.Unlock()
+	return &cert, nil
+}
+
+// obtain a new certificate from the ACME server; concurrent calls for the same
+// name wait for the first one.
+func (m *dnsManager) obtain(name string) (*tls.Certificate, error) {
+	c, err, _ := m.sf.Do(name, func() (interface{}, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+		defer cancel()
+
+		cert, err := m.order(ctx, name)
+		if err != nil {
+			return nil, errors.Errorf("acme: DNS-01 for %q: %w", name, err)
+		}
+
+		m.mu.Lock()
+		m.certs[name] = cert
+		m.mu.Unlock()
+		return cert, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c.(*tls.Certificate), nil
+}
+
+func (m *dnsManager) order(ctx context.Context, name string) (*tls.Certificate, error) {
+	l.Printf("requesting certificate for %q with DNS-01", name)
+
+	order, err := m.client.AuthorizeOrder(ctx, crypto_acme.DomainIDs(name))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, u := range order.AuthzURLs {
+		err := m.authorize(ctx, u)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	order, err = m.client.WaitOrder(ctx, order.URI)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader,
+		&x509.CertificateRequest{DNSNames: []string{name}}, key)
+	if err != nil {
+		return nil, err
+	}
+	der, _, err := m.client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der[0])
+	if err != nil {
+		return nil, err
+	}
+
+	// Same format as autocert: the key followed by the certificate chain.
+	var buf bytes.Buffer
+	kder, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	pem.Encode(&buf, &pem.Block{Type: "EC PRIVATE KEY", Bytes: kder})
+	for _, d := range der {
+		pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: d})
+	}
+	err = m.cache.Put(ctx, cacheKey(name), buf.Bytes())
+	if err != nil {
+		l.Errorf("cache %q: %s", name, err)
+	}
+
+	return &tls.Certificate{Certificate: der, PrivateKey: key, Leaf: leaf}, nil
+}
+
+// authorize fulfils the DNS-01 challenge for an authorization.
+func (m *dnsManager) authorize(ctx context.Context, url string) error {
+	z, err := m.client.GetAuthorization(ctx, url)
+	if err != nil {
+		return err
+	}
+	if z.Status == crypto_acme.StatusValid {
+		return nil
+	}
+
+	var chal *crypto_acme.Challenge
+	for _, c := range z.Challenges {
+		if c.Type == "dns-01" {
+			chal = c
+			break
+		}
+	}
+	if chal == nil {
+		return errors.Errorf("no dns-01 challenge for %q", z.Identifier.Value)
+	}
+
+	value, err := m.client.DNS01ChallengeRecord(chal.Token)
+	if err != nil {
+		return err
+	}
+	fqdn := "_acme-challenge." + z.Identifier.Value
+	err = m.provider.Present(ctx, fqdn, value)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err := m.provider.CleanUp(context.Background(), fqdn, value)
+		if err != nil {
+			l.Error(err)
+		}
+	}()
+
+	_, err = m.client.Accept(ctx, chal)
+	if err != nil {
+		return err
+	}
+	_, err = m.client.WaitAuthorization(ctx, z.URI)
+	return err
+}
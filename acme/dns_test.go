@@ -0,0 +1,145 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package acme
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSetDNS(t *testing.T) {
+	defer SetDNS("", nil)
+
+	tests := []struct {
+		in, wantErr string
+	}{
+		{"", ""},
+		{"exec:/bin/true", ""},
+		{"exec", "need a program"},
+		{"exec:", "need a program"},
+		{"nope:x", `unknown provider "nope"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			err := SetDNS(tt.in, nil)
+			if tt.wantErr == "" && err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("wrong error\nwant: %s\ngot:  %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestCertName(t *testing.T) {
+	m := dnsManager{wildcard: []string{"example.com"}}
+
+	tests := []struct {
+		in, want string
+	}{
+		{"example.com", "example.com"},
+		{"a.example.com", "*.example.com"},
+		{"a.b.example.com", "a.b.example.com"},
+		{"xexample.com", "xexample.com"},
+		{"stats.other.org", "stats.other.org"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			have := m.certName(tt.in)
+			if have != tt.want {
+				t.Errorf("\nwant: %q\nhave: %q", tt.want, have)
+			}
+			if strings.Contains(cacheKey(have), "*") {
+				t.Errorf("cacheKey(%q) = %q", have, cacheKey(have))
+			}
+		})
+	}
+}
+
+func TestExecProvider(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goatcounter-acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	out := filepath.Join(dir, "out")
+	prog := filepath.Join(dir, "hook")
+	err = ioutil.WriteFile(prog, []byte("#!/bin/sh\necho \"$@\" >> "+out+"\n"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := newExecProvider(prog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err := p.Present(ctx, "_acme-challenge.example.com", "xyz"); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.CleanUp(ctx, "_acme-challenge.example.com", "xyz"); err != nil {
+		t.Fatal(err)
+	}
+
+	have, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "present _acme-challenge.example.com xyz\ncleanup _acme-challenge.example.com xyz\n"
+	if string(have) != want {
+		t.Errorf("\nwant: %q\nhave: %q", want, string(have))
+	}
+
+	p, _ = newExecProvider(filepath.Join(dir, "nonexistent"))
+	if err := p.Present(ctx, "x", "y"); err == nil {
+		t.Error("no error for nonexistent program")
+	}
+}
+
+func TestRenew(t *testing.T) {
+	m := dnsManager{renewing: make(map[string]renewState)}
+
+	if !m.startRenew("a.example.com") {
+		t.Fatal("not started")
+	}
+	if m.startRenew("a.example.com") {
+		t.Fatal("started while running")
+	}
+	if !m.startRenew("b.example.com") {
+		t.Fatal("other domain not started")
+	}
+
+	m.renewDone("a.example.com", errors.New("oops"))
+	if m.startRenew("a.example.com") {
+		t.Fatal("started right after a failure")
+	}
+	if s := m.renewing["a.example.com"]; s.fails != 1 || time.Until(s.next) > renewRetry {
+		t.Fatalf("wrong state: %#v", s)
+	}
+
+	m.renewing["a.example.com"] = renewState{fails: 1, next: time.Now().Add(-time.Second)}
+	if !m.startRenew("a.example.com") {
+		t.Fatal("not retried after the backoff")
+	}
+	m.renewDone("a.example.com", errors.New("oops"))
+	if s := m.renewing["a.example.com"]; s.fails != 2 || time.Until(s.next) < renewRetry {
+		t.Fatalf("backoff not increased: %#v", s)
+	}
+
+	m.renewDone("b.example.com", nil)
+	if _, ok := m.renewing["b.example.com"]; ok {
+		t.Fatal("state not removed after success")
+	}
+}
@@ -0,0 +1,350 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/goatcounter/cfg"
+	"zgo.at/zdb"
+	"zgo.at/zvalidate"
+)
+
+// AlertKinds are the valid values for AlertRule.Kind:
+//
+//	above     more than Threshold pageviews in the last Minutes.
+//	below     fewer than Threshold pageviews in the last Minutes.
+//	new-ref   a referrer that wasn't seen in the AlertNewRefPeriod before
+//	          sends at least Threshold pageviews in the last Minutes.
+//	anomaly   an unusual spike or drop in the daily pageviews was detected in
+//	          the last Minutes; the Threshold isn't used.
+var AlertKinds = []string{"above", "below", "new-ref", "anomaly"}
+
+// AlertDeliveries are the valid values for AlertRule.Deliver; the Target is an
+// email address for "email", and the URL to POST to for "slack" and "webhook".
+var AlertDeliveries = []string{"email", "slack", "webhook"}
+
+// AlertNewRefPeriod is how far back to look to decide if a referrer is new for
+// the "new-ref" alerts.
+const AlertNewRefPeriod = 7 * 24 * time.Hour
+
+// MaxAlertRules is the maximum number of alert rules for a site.
+const MaxAlertRules = 20
+
+// Addresses that Slack and webhook alerts can't be sent to, so they can't be
+// used to reach services on the server's network.
+var alertBlockedNets = func() []*net.IPNet {
+	var nets []*net.IPNet
+	for _, c := range []string{"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8",
+		"169.254.0.0/16", "172.16.0.0/12", "192.168.0.0/16", "::/128", "::1/128",
+		"fc00::/7", "fe80::/10"} {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}()
+
+// AlertAddrAllowed reports if Slack and webhook alerts can be sent to this IP
+// address; private, loopback, and link-local addresses are only allowed in
+// development.
+func AlertAddrAllowed(ip net.IP) bool {
+	if !cfg.Prod {
+		return true
+	}
+	if ip == nil {
+		return false
+	}
+	for _, n := range alertBlockedNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// AlertRule is a rule to send an alert when the traffic for a site matches a
+// condition; the rules are checked by cron every minute.
+type AlertRule struct {
+	ID     int64 `db:"alert_rule_id" json:"id"`
+	SiteID int64 `db:"site_id" json:"-"`
+
+	Kind      string `db:"kind" json:"kind"`
+	Threshold int    `db:"threshold" json:"threshold"`
+	Minutes   int    `db:"minutes" json:"minutes"`
+	Deliver   string `db:"deliver" json:"deliver"`
+	Target    string `db:"target" json:"target"`
+
+	// Don't send the alert again for this many minutes after it was sent.
+	Cooldown int        `db:"cooldown" json:"cooldown"`
+	FiredAt  *time.Time `db:"fired_at" json:"fired_at"`
+
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+}
+
+// Defaults sets fields to default values, unless they're already set.
+func (a *AlertRule) Defaults(ctx context.Context) {
+	a.SiteID = MustGetSite(ctx).ID
+	if a.CreatedAt.IsZero() {
+		a.CreatedAt = Now()
+	}
+	if a.Minutes == 0 {
+		a.Minutes = 60
+	}
+	if a.Cooldown == 0 {
+		a.Cooldown = 360
+	}
+	a.Target = strings.TrimSpace(a.Target)
+}
+
+// Validate the object.
+func (a *AlertRule) Validate(ctx context.Context) error {
+	v := zvalidate.New()
+	v.Required("site_id", a.SiteID)
+	v.Include("kind", a.Kind, AlertKinds)
+	if a.Threshold < 0 || ((a.Kind == "above" || a.Kind == "new-ref") && a.Threshold == 0) {
+		v.Append("threshold", "must be larger than 0")
+	}
+	v.Range("minutes", int64(a.Minutes), 5, 7*24*60)
+	v.Range("cooldown", int64(a.Cooldown), 5, 0)
+	v.Include("deliver", a.Deliver, AlertDeliveries)
+	v.Required("target", a.Target)
+	switch a.Deliver {
+	case "email":
+		v.Email("target", a.Target)
+	case "slack", "webhook":
+		v.URL("target", a.Target)
+		if !strings.HasPrefix(a.Target, "https://") && !strings.HasPrefix(a.Target, "http://") {
+			v.Append("target", "must be a http:// or https:// URL")
+		}
+		// The address is checked again when sending, as the hostname can
+		// resolve to anything.
+		if u, err := url.Parse(a.Target); err == nil {
+			host := strings.ToLower(u.Hostname())
+			ip := net.ParseIP(host)
+			if (ip != nil && !AlertAddrAllowed(ip)) ||
+				(cfg.Prod && (host == "localhost" || strings.HasSuffix(host, ".localhost"))) {
+				v.Append("target", "can’t send alerts to a private or loopback address")
+			}
+		}
+	}
+
+	if a.ID == 0 {
+		var n int
+		err := zdb.MustGet(ctx).GetContext(ctx, &n,
+			`/* AlertRule.Validate */ select count(*) from alert_rules where site_id=$1`, a.SiteID)
+		if err != nil {
+			return errors.Wrap(err, "AlertRule.Validate")
+		}
+		if n >= MaxAlertRules {
+			v.Append("target", fmt.Sprintf("a site can have at most %d alerts", MaxAlertRules))
+		}
+	}
+	return v.ErrorOrNil()
+}
+
+// Insert a new row.
+func (a *AlertRule) Insert(ctx context.Context) error {
+	if a.ID > 0 {
+		return errors.New("ID > 0")
+	}
+
+	a.Defaults(ctx)
+	err := a.Validate(ctx)
+	if err != nil {
+		return err
+	}
+
+	query := `insert into alert_rules (site_id, kind, threshold, minutes, deliver, target, cooldown, created_at)
+		values ($1, $2, $3, $4, $5, $6, $7, $8)`
+	args := []interface{}{a.SiteID, a.Kind, a.Threshold, a.Minutes, a.Deliver, a.Target,
+		a.Cooldown, a.CreatedAt.Format(zdb.Date)}
+
+	if cfg.PgSQL {
+		err := zdb.MustGet(ctx).GetContext(ctx, &a.ID, query+` returning alert_rule_id`, args...)
+		return errors.Wrap(err, "AlertRule.Insert")
+	}
+
+	res, err := zdb.MustGet(ctx).ExecContext(ctx, query, args...)
+	if err != nil {
+		return errors.Wrap(err, "AlertRule.Insert")
+	}
+	a.ID, err = res.LastInsertId()
+	return errors.Wrap(err, "AlertRule.Insert")
+}
+
+// ByID gets an alert rule of the current site by ID.
+func (a *AlertRule) ByID(ctx context.Context, id int64) error {
+	return errors.Wrapf(zdb.MustGet(ctx).GetContext(ctx, a,
+		`/* AlertRule.ByID */ select * from alert_rules where alert_rule_id=$1 and site_id=$2`,
+		id, MustGetSite(ctx).ID), "AlertRule.ByID %d", id)
+}
+
+// Delete the alert rule.
+func (a *AlertRule) Delete(ctx context.Context) error {
+	_, err := zdb.MustGet(ctx).ExecContext(ctx,
+		`/* AlertRule.Delete */ delete from alert_rules where alert_rule_id=$1 and site_id=$2`,
+		a.ID, MustGetSite(ctx).ID)
+	return errors.Wrapf(err, "AlertRule.Delete %d", a.ID)
+}
+
+// Cooling reports if the alert was sent less than Cooldown minutes before now.
+func (a AlertRule) Cooling(now time.Time) bool {
+	return a.FiredAt != nil && now.Before(a.FiredAt.Add(time.Duration(a.Cooldown)*time.Minute))
+}
+
+// Fired records that the alert was sent at now.
+func (a *AlertRule) Fired(ctx context.Context, now time.Time) error {
+	now = now.UTC().Truncate(time.Second)
+	_, err := zdb.MustGet(ctx).ExecContext(ctx,
+		`/* AlertRule.Fired */ update alert_rules set fired_at=$1 where alert_rule_id=$2`,
+		now.Format(zdb.Date), a.ID)
+	if err != nil {
+		return errors.Wrapf(err, "AlertRule.Fired %d", a.ID)
+	}
+	a.FiredAt = &now
+	return nil
+}
+
+// Describe the rule, e.g. "more than 100 pageviews in 60 minutes".
+func (a AlertRule) Describe() string {
+	switch a.Kind {
+	case "above":
+		return fmt.Sprintf("more than %d pageviews in %d minutes", a.Threshold, a.Minutes)
+	case "below":
+		return fmt.Sprintf("fewer than %d pageviews in %d minutes", a.Threshold, a.Minutes)
+	case "new-ref":
+		return fmt.Sprintf("a new referrer with at least %d pageviews in %d minutes", a.Threshold, a.Minutes)
+	case "anomaly":
+		return "unusual spikes or drops in the daily pageviews"
+	}
+	return a.Kind
+}
+
+// Alert is a rule that matched.
+type Alert struct {
+	Rule  AlertRule `json:"rule"`
+	Site  string    `json:"site"`
+	Since time.Time `json:"since"`
+
+	// Number of pageviews for "above" and "below", or the new referrers and
+	// their pageviews for "new-ref".
+	Pageviews int        `json:"pageviews"`
+	Refs      []AlertRef `json:"refs,omitempty"`
+
+	// Newly detected anomalies for "anomaly".
+	Anomalies Anomalies `json:"anomalies,omitempty"`
+}
+
+// AlertRef is a new referrer for the "new-ref" alerts.
+type AlertRef struct {
+	Ref       string `db:"ref" json:"ref"`
+	Pageviews int    `db:"count" json:"pageviews"`
+}
+
+// Message is the alert as a line of text.
+func (a Alert) Message() string {
+	if a.Rule.Kind == "anomaly" {
+		anom := make([]string, 0, len(a.Anomalies))
+		for _, aa := range a.Anomalies {
+			anom = append(anom, aa.Day+": "+strings.ToLower(aa.String()))
+		}
+		return fmt.Sprintf("%s: %s", a.Site, strings.Join(anom, "; "))
+	}
+	if a.Rule.Kind == "new-ref" {
+		refs := make([]string, 0, len(a.Refs))
+		for _, r := range a.Refs {
+			refs = append(refs, fmt.Sprintf("%s (%d)", r.Ref, r.Pageviews))
+		}
+		return fmt.Sprintf("%s: new referrers in the last %d minutes: %s",
+			a.Site, a.Rule.Minutes, strings.Join(refs, ", "))
+	}
+	return fmt.Sprintf("%s: %d pageviews in the last %d minutes; the alert is for %s",
+		a.Site, a.Pageviews, a.Rule.Minutes, a.Rule.Describe())
+}
+
+// Check the rule for the site in the context; this returns nil if the rule
+// doesn't match.
+func (a AlertRule) Check(ctx context.Context, now time.Time) (*Alert, error) {
+	var (
+		site  = MustGetSite(ctx)
+		since = now.Add(-time.Duration(a.Minutes) * time.Minute).UTC()
+		alert = Alert{Rule: a, Site: site.Display(), Since: since}
+		db    = zdb.MustGet(ctx)
+	)
+
+	if a.Kind == "anomaly" {
+		// Don't send the same anomalies again if the cooldown is shorter than
+		// the window.
+		if a.FiredAt != nil && a.FiredAt.After(since) {
+			since = a.FiredAt.Add(time.Second)
+		}
+		err := alert.Anomalies.ListSince(ctx, since)
+		if err != nil {
+			return nil, errors.Wrap(err, "AlertRule.Check")
+		}
+		if len(alert.Anomalies) == 0 {
+			return nil, nil
+		}
+		return &alert, nil
+	}
+
+	if a.Kind == "new-ref" {
+		err := db.SelectContext(ctx, &alert.Refs, `/* AlertRule.Check */
+			select ref, count(*) as count from hits
+			where site=$1 and bot=0 and event=0 and ref!='' and created_at>=$2 and
+				not exists (select 1 from hits h2 where h2.site=$1 and h2.ref=hits.ref and h2.created_at>=$3 and h2.created_at<$2)
+			group by ref
+			having count(*)>=$4
+			order by count desc, ref asc`,
+			site.ID, since.Format(zdb.Date), since.Add(-AlertNewRefPeriod).Format(zdb.Date), a.Threshold)
+		if err != nil {
+			return nil, errors.Wrap(err, "AlertRule.Check")
+		}
+		if len(alert.Refs) == 0 {
+			return nil, nil
+		}
+		for _, r := range alert.Refs {
+			alert.Pageviews += r.Pageviews
+		}
+		return &alert, nil
+	}
+
+	err := db.GetContext(ctx, &alert.Pageviews, `/* AlertRule.Check */
+		select count(*) from hits where site=$1 and bot=0 and event=0 and created_at>=$2`,
+		site.ID, since.Format(zdb.Date))
+	if err != nil {
+		return nil, errors.Wrap(err, "AlertRule.Check")
+	}
+	if (a.Kind == "above" && alert.Pageviews > a.Threshold) ||
+		(a.Kind == "below" && alert.Pageviews < a.Threshold) {
+		return &alert, nil
+	}
+	return nil, nil
+}
+
+type AlertRules []AlertRule
+
+// List all alert rules for the current site.
+func (a *AlertRules) List(ctx context.Context) error {
+	return errors.Wrap(zdb.MustGet(ctx).SelectContext(ctx, a,
+		`/* AlertRules.List */ select * from alert_rules where site_id=$1 order by alert_rule_id asc`,
+		MustGetSite(ctx).ID), "AlertRules.List")
+}
+
+// ListAll lists the alert rules for all sites.
+func (a *AlertRules) ListAll(ctx context.Context) error {
+	return errors.Wrap(zdb.MustGet(ctx).SelectContext(ctx, a,
+		`/* AlertRules.ListAll */ select * from alert_rules order by site_id asc, alert_rule_id asc`),
+		"AlertRules.ListAll")
+}
@@ -0,0 +1,137 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"zgo.at/goatcounter"
+	"zgo.at/goatcounter/cfg"
+	"zgo.at/goatcounter/gctest"
+)
+
+func TestAlertRuleValidate(t *testing.T) {
+	ctx, clean := gctest.DB(t)
+	defer clean()
+
+	tests := []struct {
+		rule    goatcounter.AlertRule
+		wantErr string
+	}{
+		{goatcounter.AlertRule{Kind: "above", Threshold: 10, Deliver: "email", Target: "a@example.com"}, ""},
+		{goatcounter.AlertRule{Kind: "below", Threshold: 0, Deliver: "slack", Target: "https://hooks.slack.com/x"}, ""},
+		{goatcounter.AlertRule{Kind: "above", Threshold: 0, Deliver: "email", Target: "a@example.com"}, "threshold"},
+		{goatcounter.AlertRule{Kind: "nope", Threshold: 1, Deliver: "email", Target: "a@example.com"}, "kind"},
+		{goatcounter.AlertRule{Kind: "above", Threshold: 1, Deliver: "webhook", Target: "ftp://x"}, "target"},
+		{goatcounter.AlertRule{Kind: "above", Threshold: 1, Deliver: "email", Target: "a@example.com", Minutes: 1}, "minutes"},
+		{goatcounter.AlertRule{Kind: "above", Threshold: 1, Deliver: "webhook", Target: "http://127.0.0.1:8080/x"}, "private or loopback"},
+		{goatcounter.AlertRule{Kind: "above", Threshold: 1, Deliver: "webhook", Target: "http://[::1]/x"}, "private or loopback"},
+		{goatcounter.AlertRule{Kind: "above", Threshold: 1, Deliver: "slack", Target: "http://192.168.1.1/x"}, "private or loopback"},
+		{goatcounter.AlertRule{Kind: "above", Threshold: 1, Deliver: "webhook", Target: "http://localhost/x"}, "private or loopback"},
+		{goatcounter.AlertRule{Kind: "above", Threshold: 1, Deliver: "webhook", Target: "https://93.184.216.34/x"}, ""},
+	}
+
+	defer func(p bool) { cfg.Prod = p }(cfg.Prod)
+	cfg.Prod = true
+
+	for _, tt := range tests {
+		t.Run("", func(t *testing.T) {
+			tt.rule.Defaults(ctx)
+			err := tt.rule.Validate(ctx)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("wrong error: %v; want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAlertRuleCheck(t *testing.T) {
+	ctx, clean := gctest.DB(t)
+	defer clean()
+
+	now := time.Date(2020, 6, 18, 12, 0, 0, 0, time.UTC)
+	gctest.StoreHits(ctx, t,
+		goatcounter.Hit{Path: "/a", Ref: "https://old.example.com", CreatedAt: now.Add(-48 * time.Hour)},
+		goatcounter.Hit{Path: "/a", Ref: "https://old.example.com", CreatedAt: now.Add(-10 * time.Minute)},
+		goatcounter.Hit{Path: "/a", Ref: "https://new.example.com", CreatedAt: now.Add(-10 * time.Minute)},
+		goatcounter.Hit{Path: "/b", Ref: "https://new.example.com", CreatedAt: now.Add(-6 * time.Minute)},
+		goatcounter.Hit{Path: "/b", CreatedAt: now.Add(-2 * time.Hour)})
+
+	tests := []struct {
+		rule goatcounter.AlertRule
+		want string
+	}{
+		{goatcounter.AlertRule{Kind: "above", Threshold: 2, Minutes: 60}, "3 pageviews in the last 60 minutes"},
+		{goatcounter.AlertRule{Kind: "above", Threshold: 3, Minutes: 60}, ""},
+		{goatcounter.AlertRule{Kind: "below", Threshold: 1, Minutes: 5}, "0 pageviews in the last 5 minutes"},
+		{goatcounter.AlertRule{Kind: "below", Threshold: 1, Minutes: 60}, ""},
+		{goatcounter.AlertRule{Kind: "new-ref", Threshold: 2, Minutes: 60}, "new.example.com (2)"},
+		{goatcounter.AlertRule{Kind: "new-ref", Threshold: 3, Minutes: 60}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.rule.Describe(), func(t *testing.T) {
+			alert, err := tt.rule.Check(ctx, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.want == "" {
+				if alert != nil {
+					t.Errorf("unexpected alert: %s", alert.Message())
+				}
+				return
+			}
+			if alert == nil {
+				t.Fatal("alert is nil")
+			}
+			if m := alert.Message(); !strings.Contains(m, tt.want) {
+				t.Errorf("\ngot:  %s\nwant: %s", m, tt.want)
+			}
+		})
+	}
+}
+
+func TestAlertRuleMax(t *testing.T) {
+	ctx, clean := gctest.DB(t)
+	defer clean()
+
+	for i := 0; i <= goatcounter.MaxAlertRules; i++ {
+		rule := goatcounter.AlertRule{Kind: "above", Threshold: 10, Deliver: "email",
+			Target: fmt.Sprintf("a%d@example.com", i)}
+		err := rule.Insert(ctx)
+		if i < goatcounter.MaxAlertRules && err != nil {
+			t.Fatal(err)
+		}
+		if i == goatcounter.MaxAlertRules && (err == nil || !strings.Contains(err.Error(), "at most")) {
+			t.Fatalf("wrong error: %v", err)
+		}
+	}
+}
+
+func TestAlertRuleCooling(t *testing.T) {
+	now := time.Date(2020, 6, 18, 12, 0, 0, 0, time.UTC)
+	fired := now.Add(-30 * time.Minute)
+
+	r := goatcounter.AlertRule{Cooldown: 60}
+	if r.Cooling(now) {
+		t.Error("cooling without FiredAt")
+	}
+	r.FiredAt = &fired
+	if !r.Cooling(now) {
+		t.Error("not cooling after 30 minutes")
+	}
+	if r.Cooling(now.Add(30 * time.Minute)) {
+		t.Error("cooling after 60 minutes")
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/goatcounter/cfg"
+	"zgo.at/zdb"
+	"zgo.at/zvalidate"
+)
+
+// Annotation is a note for a day, such as "v2 launch" or "HN front page",
+// which is displayed as a marker on the charts.
+type Annotation struct {
+	ID     int64 `db:"annotation_id" json:"id"`
+	SiteID int64 `db:"site_id" json:"-"`
+
+	// Day as YYYY-MM-DD, in the site's timezone.
+	Day  string `db:"day" json:"day"`
+	Text string `db:"text" json:"text"`
+
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+}
+
+// Defaults sets fields to default values, unless they're already set.
+func (a *Annotation) Defaults(ctx context.Context) {
+	a.SiteID = MustGetSite(ctx).ID
+	if a.CreatedAt.IsZero() {
+		a.CreatedAt = Now()
+	}
+	a.Day = strings.TrimSpace(a.Day)
+	a.Text = strings.TrimSpace(a.Text)
+}
+
+// Validate the object.
+func (a *Annotation) Validate(ctx context.Context) error {
+	v := zvalidate.New()
+	v.Required("site_id", a.SiteID)
+	v.Required("day", a.Day)
+	v.Date("day", a.Day, "2006-01-02")
+	v.Required("text", a.Text)
+	v.Len("text", a.Text, 0, 200)
+	return v.ErrorOrNil()
+}
+
+// Insert a new row.
+func (a *Annotation) Insert(ctx context.Context) error {
+	if a.ID > 0 {
+		return errors.New("ID > 0")
+	}
+
+	a.Defaults(ctx)
+	err := a.Validate(ctx)
+	if err != nil {
+		return err
+	}
+
+	query := `insert into annotations (site_id, day, text, created_at) values ($1, $2, $3, $4)`
+	args := []interface{}{a.SiteID, a.Day, a.Text, a.CreatedAt.Format(zdb.Date)}
+
+	if cfg.PgSQL {
+		err := zdb.MustGet(ctx).GetContext(ctx, &a.ID, query+` returning annotation_id`, args...)
+		return errors.Wrap(err, "Annotation.Insert")
+	}
+
+	res, err := zdb.MustGet(ctx).ExecContext(ctx, query, args...)
+	if err != nil {
+		return errors.Wrap(err, "Annotation.Insert")
+	}
+	a.ID, err = res.LastInsertId()
+	return errors.Wrap(err, "Annotation.Insert")
+}
+
+// ByID gets an annotation of the current site by ID.
+func (a *Annotation) ByID(ctx context.Context, id int64) error {
+	return errors.Wrapf(zdb.MustGet(ctx).GetContext(ctx, a,
+		`/* Annotation.ByID */ select * from annotations where annotation_id=$1 and site_id=$2`,
+		id, MustGetSite(ctx).ID), "Annotation.ByID %d", id)
+}
+
+// Delete the annotation.
+func (a *Annotation) Delete(ctx context.Context) error {
+	_, err := zdb.MustGet(ctx).ExecContext(ctx,
+		`/* Annotation.Delete */ delete from annotations where annotation_id=$1 and site_id=$2`,
+		a.ID, MustGetSite(ctx).ID)
+	return errors.Wrapf(err, "Annotation.Delete %d", a.ID)
+}
+
+type Annotations []Annotation
+
+// List all annotations for the current site.
+func (a *Annotations) List(ctx context.Context) error {
+	return errors.Wrap(zdb.MustGet(ctx).SelectContext(ctx, a,
+		`/* Annotations.List */ select * from annotations where site_id=$1 order by day desc, annotation_id asc`,
+		MustGetSite(ctx).ID), "Annotations.List")
+}
+
+// ListRange lists all annotations for the current site between start and end,
+// which are converted to days in the site's timezone.
+func (a *Annotations) ListRange(ctx context.Context, start, end time.Time) error {
+	site := MustGetSite(ctx)
+	loc := site.Settings.Timezone.Loc()
+	return errors.Wrap(zdb.MustGet(ctx).SelectContext(ctx, a,
+		`/* Annotations.ListRange */ select * from annotations
+		where site_id=$1 and day>=$2 and day<=$3 order by day asc, annotation_id asc`,
+		site.ID, start.In(loc).Format("2006-01-02"), end.In(loc).Format("2006-01-02")),
+		"Annotations.ListRange")
+}
+
+// ByDay gets the text of all annotations per day; multiple annotations on the
+// same day are joined with "; ".
+func (a Annotations) ByDay() map[string]string {
+	m := make(map[string]string, len(a))
+	for _, aa := range a {
+		if t, ok := m[aa.Day]; ok {
+			m[aa.Day] = t + "; " + aa.Text
+			continue
+		}
+		m[aa.Day] = aa.Text
+	}
+	return m
+}
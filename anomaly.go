@@ -0,0 +1,184 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/goatcounter/cfg"
+	"zgo.at/zdb"
+)
+
+const (
+	// AnomalyWeeks is the number of weeks of history used to model the normal
+	// traffic for a day; a day is compared to the same weekday in the previous
+	// weeks, so that the weekly pattern doesn't show up as anomalies.
+	AnomalyWeeks = 8
+
+	// AnomalyThreshold is how many standard deviations from the mean a day
+	// needs to be to be considered unusual.
+	AnomalyThreshold = 3.0
+
+	// Need at least this many weeks of history, and a change of at least this
+	// many pageviews, so that small and new sites don't get a lot of noise.
+	anomalyMinWeeks  = 4
+	anomalyMinChange = 20
+)
+
+// Anomaly is a day with an unusual number of pageviews.
+type Anomaly struct {
+	ID     int64 `db:"anomaly_id" json:"id"`
+	SiteID int64 `db:"site_id" json:"-"`
+
+	// Day as YYYY-MM-DD, in the site's timezone.
+	Day string `db:"day" json:"day"`
+
+	// "spike" or "drop".
+	Kind      string `db:"kind" json:"kind"`
+	Pageviews int    `db:"pageviews" json:"pageviews"`
+	Expected  int    `db:"expected" json:"expected"`
+
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+}
+
+// DetectAnomaly checks if the number of pageviews for the day is unusual
+// compared to the same weekday in the previous AnomalyWeeks weeks.
+//
+// The day should be the start of the day in the site's timezone; this returns
+// nil if the day is normal or if there isn't enough history.
+func DetectAnomaly(ctx context.Context, day time.Time) (*Anomaly, error) {
+	site := MustGetSite(ctx)
+	count := func(d time.Time) (int, error) {
+		n, _, err := GetTotalCount(ctx, d.UTC(), d.AddDate(0, 0, 1).Add(-time.Second).UTC(), "")
+		return n, err
+	}
+
+	n, err := count(day)
+	if err != nil {
+		return nil, errors.Wrap(err, "DetectAnomaly")
+	}
+
+	var hist []float64
+	for i := 1; i <= AnomalyWeeks; i++ {
+		d := day.AddDate(0, 0, -7*i)
+		if d.Before(site.CreatedAt) {
+			break
+		}
+		h, err := count(d)
+		if err != nil {
+			return nil, errors.Wrap(err, "DetectAnomaly")
+		}
+		hist = append(hist, float64(h))
+	}
+	if len(hist) < anomalyMinWeeks {
+		return nil, nil
+	}
+
+	var mean, variance float64
+	for _, h := range hist {
+		mean += h
+	}
+	mean /= float64(len(hist))
+	for _, h := range hist {
+		variance += (h - mean) * (h - mean)
+	}
+	// Pageviews are counts, so the deviation is at least what you'd expect
+	// from a Poisson distribution; otherwise a site with exactly the same
+	// traffic every week would flag every small change.
+	stddev := math.Max(math.Sqrt(variance/float64(len(hist))), math.Sqrt(mean))
+
+	diff := float64(n) - mean
+	if math.Abs(diff) < anomalyMinChange || math.Abs(diff) < AnomalyThreshold*stddev {
+		return nil, nil
+	}
+
+	a := Anomaly{
+		SiteID:    site.ID,
+		Day:       day.Format("2006-01-02"),
+		Kind:      "spike",
+		Pageviews: n,
+		Expected:  int(math.Round(mean)),
+	}
+	if diff < 0 {
+		a.Kind = "drop"
+	}
+	return &a, nil
+}
+
+// Insert a new row.
+func (a *Anomaly) Insert(ctx context.Context) error {
+	if a.ID > 0 {
+		return errors.New("ID > 0")
+	}
+	if a.CreatedAt.IsZero() {
+		a.CreatedAt = Now()
+	}
+
+	query := `insert into anomalies (site_id, day, kind, pageviews, expected, created_at) values ($1, $2, $3, $4, $5, $6)`
+	args := []interface{}{a.SiteID, a.Day, a.Kind, a.Pageviews, a.Expected, a.CreatedAt.Format(zdb.Date)}
+
+	if cfg.PgSQL {
+		err := zdb.MustGet(ctx).GetContext(ctx, &a.ID, query+` returning anomaly_id`, args...)
+		return errors.Wrap(err, "Anomaly.Insert")
+	}
+
+	res, err := zdb.MustGet(ctx).ExecContext(ctx, query, args...)
+	if err != nil {
+		return errors.Wrap(err, "Anomaly.Insert")
+	}
+	a.ID, err = res.LastInsertId()
+	return errors.Wrap(err, "Anomaly.Insert")
+}
+
+// ByDay gets the anomaly for the current site on the day.
+func (a *Anomaly) ByDay(ctx context.Context, day string) error {
+	return errors.Wrapf(zdb.MustGet(ctx).GetContext(ctx, a,
+		`/* Anomaly.ByDay */ select * from anomalies where site_id=$1 and day=$2`,
+		MustGetSite(ctx).ID, day), "Anomaly.ByDay %s", day)
+}
+
+// String describes the anomaly, e.g. "Unusual spike: 1234 pageviews (expected
+// about 300)".
+func (a Anomaly) String() string {
+	return fmt.Sprintf("Unusual %s: %d pageviews (expected about %d)", a.Kind, a.Pageviews, a.Expected)
+}
+
+type Anomalies []Anomaly
+
+// ListRange lists all anomalies for the current site between start and end,
+// which are converted to days in the site's timezone.
+func (a *Anomalies) ListRange(ctx context.Context, start, end time.Time) error {
+	site := MustGetSite(ctx)
+	loc := site.Settings.Timezone.Loc()
+	return errors.Wrap(zdb.MustGet(ctx).SelectContext(ctx, a,
+		`/* Anomalies.ListRange */ select * from anomalies
+		where site_id=$1 and day>=$2 and day<=$3 order by day asc`,
+		site.ID, start.In(loc).Format("2006-01-02"), end.In(loc).Format("2006-01-02")),
+		"Anomalies.ListRange")
+}
+
+// ListSince lists all anomalies for the current site that were detected since
+// the given time.
+func (a *Anomalies) ListSince(ctx context.Context, since time.Time) error {
+	return errors.Wrap(zdb.MustGet(ctx).SelectContext(ctx, a,
+		`/* Anomalies.ListSince */ select * from anomalies
+		where site_id=$1 and created_at>=$2 order by day asc`,
+		MustGetSite(ctx).ID, since.UTC().Format(zdb.Date)),
+		"Anomalies.ListSince")
+}
+
+// Annotations converts the anomalies to annotations, for displaying them on the
+// charts.
+func (a Anomalies) Annotations() Annotations {
+	ann := make(Annotations, 0, len(a))
+	for _, aa := range a {
+		ann = append(ann, Annotation{SiteID: aa.SiteID, Day: aa.Day, Text: aa.String(), CreatedAt: aa.CreatedAt})
+	}
+	return ann
+}
@@ -0,0 +1,87 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"zgo.at/goatcounter"
+	"zgo.at/goatcounter/gctest"
+)
+
+func TestDetectAnomaly(t *testing.T) {
+	day := time.Date(2020, 6, 17, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name  string
+		weeks int
+		hist  int
+		today int
+		want  string
+	}{
+		{"normal", 6, 10, 12, ""},
+		{"spike", 6, 10, 40, "spike 40 10"},
+		{"drop", 6, 40, 0, "drop 0 40"},
+		{"small change", 6, 2, 15, ""},
+		{"not enough history", 3, 10, 40, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, clean := gctest.DB(t)
+			defer clean()
+
+			goatcounter.MustGetSite(ctx).CreatedAt = day.AddDate(0, 0, -7*tt.weeks)
+
+			var hits []goatcounter.Hit
+			for w := 1; w <= tt.weeks; w++ {
+				for i := 0; i < tt.hist; i++ {
+					hits = append(hits, goatcounter.Hit{Path: "/a", CreatedAt: day.AddDate(0, 0, -7*w).Add(12 * time.Hour)})
+				}
+			}
+			for i := 0; i < tt.today; i++ {
+				hits = append(hits, goatcounter.Hit{Path: "/a", CreatedAt: day.Add(12 * time.Hour)})
+			}
+			gctest.StoreHits(ctx, t, hits...)
+
+			a, err := goatcounter.DetectAnomaly(ctx, day)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := ""
+			if a != nil {
+				got = fmt.Sprintf("%s %d %d", a.Kind, a.Pageviews, a.Expected)
+			}
+			if got != tt.want {
+				t.Errorf("\ngot:  %q\nwant: %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAnomaliesAnnotations(t *testing.T) {
+	ctx, clean := gctest.DB(t)
+	defer clean()
+
+	a := goatcounter.Anomaly{SiteID: goatcounter.MustGetSite(ctx).ID, Day: "2020-06-17",
+		Kind: "spike", Pageviews: 40, Expected: 10}
+	err := a.Insert(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var list goatcounter.Anomalies
+	err = list.ListRange(ctx, time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC), time.Date(2020, 6, 30, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := fmt.Sprintf("%v", list.Annotations().ByDay())
+	want := "map[2020-06-17:Unusual spike: 40 pageviews (expected about 10)]"
+	if got != want {
+		t.Errorf("\ngot:  %s\nwant: %s", got, want)
+	}
+}
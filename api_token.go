@@ -6,51 +6,32 @@ package goatcounter
 
 import (
 	"context"
-	"database/sql/driver"
-	"encoding/json"
-	"fmt"
 	"time"
 
 	"zgo.at/errors"
 	"zgo.at/goatcounter/cfg"
 	"zgo.at/zdb"
 	"zgo.at/zhttp"
-	"zgo.at/zstd/zjson"
 	"zgo.at/zvalidate"
 )
 
 type APIToken struct {
-	ID     int64 `db:"api_token_id" json:"-"`
-	SiteID int64 `db:"site_id" json:"-"`
-	UserID int64 `db:"user_id" json:"-"`
+	ID     int64  `db:"api_token_id" json:"-"`
+	SiteID int64  `db:"site_id" json:"-"`
+	UserID int64  `db:"user_id" json:"-"`
+	RoleID *int64 `db:"role_id" json:"role_id"`
 
-	Name        string              `db:"name" json:"name"`
-	Token       string              `db:"token" json:"-"`
-	Permissions APITokenPermissions `db:"permissions" json:"permissions"`
+	Name        string        `db:"name" json:"name"`
+	Token       string        `db:"token" json:"-"`
+	Permissions PermissionSet `db:"permissions" json:"permissions"`
 
 	CreatedAt time.Time `db:"created_at" json:"-"`
 }
 
-type APITokenPermissions struct {
-	Count  bool `db:"count" json:"count"`
-	Export bool `db:"export" json:"export"`
-}
-
-func (tp APITokenPermissions) String() string { return string(zjson.MustMarshal(tp)) }
-
-// Value implements the SQL Value function to determine what to store in the DB.
-func (tp APITokenPermissions) Value() (driver.Value, error) { return json.Marshal(tp) }
-
-// Scan converts the data returned from the DB into the struct.
-func (tp *APITokenPermissions) Scan(v interface{}) error {
-	switch vv := v.(type) {
-	case []byte:
-		return json.Unmarshal(vv, tp)
-	case string:
-		return json.Unmarshal([]byte(vv), tp)
-	default:
-		panic(fmt.Sprintf("unsupported type: %T", v))
-	}
+// Can reports if this token has all the permissions in need, either directly
+// or through its role.
+func (t APIToken) Can(ctx context.Context, need ...Permission) error {
+	return t.Permissions.check(ctx, t.RoleID, need...)
 }
 
 // Defaults sets fields to default values, unless they're already set.
@@ -66,6 +47,7 @@ func (t *APIToken) Validate(ctx context.Context) error {
 	v.Required("site_id", t.SiteID)
 	v.Required("user_id", t.SiteID)
 	v.Required("token", t.Token)
+	t.Permissions.validate(&v, "permissions")
 	return v.ErrorOrNil()
 }
 
@@ -82,9 +64,9 @@ func (t *APIToken) Insert(ctx context.Context) error {
 	}
 
 	query := `insert into api_tokens
-		(site_id, user_id, name, token, permissions, created_at)
-		values ($1, $2, $3, $4, $5, $6)`
-	args := []interface{}{t.SiteID, GetUser(ctx).ID, t.Name, t.Token, t.Permissions, t.CreatedAt.Format(zdb.Date)}
+		(site_id, user_id, role_id, name, token, permissions, created_at)
+		values ($1, $2, $3, $4, $5, $6, $7)`
+	args := []interface{}{t.SiteID, GetUser(ctx).ID, t.RoleID, t.Name, t.Token, t.Permissions, t.CreatedAt.Format(zdb.Date)}
 
 	if cfg.PgSQL {
 		err := zdb.MustGet(ctx).GetContext(ctx, &t.ID, query+` returning api_token_id`, args...)
@@ -25,6 +25,11 @@ var (
 	maxWait = 10 * time.Second
 )
 
+// SetMaxWait sets the maximum time Wait() waits for the goroutines to finish.
+func SetMaxWait(d time.Duration) {
+	maxWait = d
+}
+
 // Wait for all goroutines to finish for a maximum of maxWait.
 func Wait() error {
 	ctx, c := context.WithTimeout(context.Background(), maxWait)
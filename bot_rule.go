@@ -0,0 +1,117 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// MaxBotRules is the maximum number of bot rules per site.
+const MaxBotRules = 50
+
+// Hit.Bot values for bots detected by GoatCounter, rather than isbot; these are
+// outside the range of the values isbot uses.
+const (
+	BotSiteRule   = 200 // Matched one of the site's bot rules.
+	BotDatacenter = 201 // From the network of a cloud or hosting provider.
+)
+
+// Bot rule types.
+const (
+	BotRuleUA   = "ua"   // Regular expression matched against the User-Agent.
+	BotRulePath = "path" // Pattern matched against the path; "*" matches anything.
+)
+
+// BotRule marks pageviews as bot traffic if the User-Agent or path matches.
+type BotRule struct {
+	Type    string `json:"type"`
+	Pattern string `json:"pattern"`
+
+	re *regexp.Regexp
+}
+
+func (r BotRule) regexp() (*regexp.Regexp, error) {
+	switch r.Type {
+	case BotRuleUA:
+		return regexp.Compile(r.Pattern)
+	case BotRulePath:
+		return globRegexp(r.Pattern), nil
+	default:
+		return nil, fmt.Errorf("unknown type %q; must be %q or %q", r.Type, BotRuleUA, BotRulePath)
+	}
+}
+
+// BotRules is a list of rules to mark pageviews as bot traffic, in addition to
+// the automatic bot detection.
+//
+// It's stored and displayed as one rule per line in the form of "type
+// pattern", e.g. "ua HeadlessChrome" or "path /wp-login.php".
+//
+// The rules are applied when the pageview is recorded, and changing them
+// doesn't affect existing pageviews.
+type BotRules []BotRule
+
+func (b BotRules) String() string {
+	s := make([]string, 0, len(b))
+	for _, r := range b {
+		s = append(s, r.Type+" "+r.Pattern)
+	}
+	return strings.Join(s, "\n")
+}
+
+// MarshalText converts the data to a human readable representation.
+func (b BotRules) MarshalText() ([]byte, error) { return []byte(b.String()), nil }
+
+// UnmarshalText parses text in to the Go data structure.
+func (b *BotRules) UnmarshalText(v []byte) error {
+	*b = BotRules{}
+	for _, s := range strings.Split(string(v), "\n") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+
+		r := BotRule{Type: s}
+		if i := strings.IndexAny(s, " \t"); i > -1 {
+			r.Type, r.Pattern = s[:i], strings.TrimSpace(s[i+1:])
+		}
+		r.re, _ = r.regexp()
+		*b = append(*b, r)
+	}
+	return nil
+}
+
+// Match reports if the hit matches any of the rules; path rules are never
+// matched against events.
+func (b BotRules) Match(h Hit) bool {
+	for _, r := range b {
+		if r.Type == BotRulePath && h.Event {
+			continue
+		}
+
+		re := r.re
+		if re == nil {
+			var err error
+			re, err = r.regexp()
+			if err != nil {
+				continue
+			}
+		}
+
+		switch r.Type {
+		case BotRuleUA:
+			if re.MatchString(h.Browser) {
+				return true
+			}
+		case BotRulePath:
+			if re.MatchString(h.Path) {
+				return true
+			}
+		}
+	}
+	return false
+}
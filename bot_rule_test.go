@@ -0,0 +1,51 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter_test
+
+import (
+	"testing"
+
+	"zgo.at/goatcounter"
+)
+
+func TestBotRules(t *testing.T) {
+	var rules goatcounter.BotRules
+	err := rules.UnmarshalText([]byte("ua HeadlessChrome\n\n path   /wp-admin/*\nua ("))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := rules.String(); s != "ua HeadlessChrome\npath /wp-admin/*\nua (" {
+		t.Errorf("wrong String():\n%s", s)
+	}
+
+	tests := []struct {
+		h    goatcounter.Hit
+		want bool
+	}{
+		{goatcounter.Hit{Path: "/", Browser: "Mozilla/5.0 Firefox/79.0"}, false},
+		{goatcounter.Hit{Path: "/", Browser: "Mozilla/5.0 HeadlessChrome/84.0"}, true},
+		{goatcounter.Hit{Path: "/wp-admin/x.php", Browser: "Firefox"}, true},
+		{goatcounter.Hit{Path: "/wp-admin", Browser: "Firefox"}, false},
+		{goatcounter.Hit{Path: "/wp-admin/x.php", Browser: "Firefox", Event: true}, false},
+	}
+
+	// Should also work without the compiled patterns, e.g. when set from the
+	// API.
+	uncompiled := goatcounter.BotRules{
+		{Type: "ua", Pattern: "HeadlessChrome"},
+		{Type: "path", Pattern: "/wp-admin/*"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.h.Path+tt.h.Browser, func(t *testing.T) {
+			if got := rules.Match(tt.h); got != tt.want {
+				t.Errorf("got %t; want %t", got, tt.want)
+			}
+			if got := uncompiled.Match(tt.h); got != tt.want {
+				t.Errorf("uncompiled: got %t; want %t", got, tt.want)
+			}
+		})
+	}
+}
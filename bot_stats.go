@@ -0,0 +1,108 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"context"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/zdb"
+	"zgo.at/zvalidate"
+)
+
+// BotStats is a report of the pageviews from bots, which are stored but never
+// included in the regular statistics.
+type BotStats struct {
+	Total int
+
+	// Pageviews per day in the site's timezone, including days without any
+	// pageviews; Max is the highest number of pageviews on a single day.
+	Days []Stat
+	Max  int
+
+	// Most common User-Agent headers and paths.
+	UserAgents []BotStatsEntry
+	Paths      []BotStatsEntry
+}
+
+// BotStatsEntry is a single User-Agent or path in the BotStats.
+type BotStatsEntry struct {
+	Name  string `db:"name"`
+	Count int    `db:"count"`
+}
+
+// Get the bot pageviews between start and end; at most limit User-Agents and
+// paths are returned.
+//
+// The pageviews per day are read from the bot_stats table, which stores them
+// per day in the site's timezone like the other *_stats tables.
+func (b *BotStats) Get(ctx context.Context, start, end time.Time, limit int) error {
+	v := zvalidate.New()
+	v.Range("limit", int64(limit), 1, 100)
+	if v.HasErrors() {
+		return v
+	}
+
+	var (
+		db    = zdb.MustGet(ctx)
+		site  = MustGetSite(ctx)
+		s, e  = start.Format(zdb.Date), end.Format(zdb.Date)
+		loc   = site.Settings.Timezone.Loc()
+		first = start.In(loc)
+		last  = end.In(loc)
+		rows  []struct {
+			Day   string `db:"day"`
+			Count int    `db:"count"`
+		}
+	)
+	err := db.SelectContext(ctx, &rows, `/* BotStats.Get */
+		select cast(day as varchar) as day, count from bot_stats
+		where site=$1 and day>=$2 and day<=$3`,
+		site.ID, first.Format("2006-01-02"), last.Format("2006-01-02"))
+	if err != nil {
+		return errors.Wrap(err, "BotStats.Get days")
+	}
+
+	days := make(map[string]*Stat)
+	b.Total, b.Max, b.Days = 0, 0, []Stat{}
+	for d := time.Date(first.Year(), first.Month(), first.Day(), 0, 0, 0, 0, loc); !d.After(last); d = d.AddDate(0, 0, 1) {
+		b.Days = append(b.Days, Stat{Day: d.Format("2006-01-02")})
+	}
+	for i := range b.Days {
+		days[b.Days[i].Day] = &b.Days[i]
+	}
+	for _, r := range rows {
+		d, ok := days[r.Day]
+		if !ok {
+			continue
+		}
+		d.Daily += r.Count
+		b.Total += r.Count
+		if d.Daily > b.Max {
+			b.Max = d.Daily
+		}
+	}
+
+	b.UserAgents = []BotStatsEntry{}
+	err = db.SelectContext(ctx, &b.UserAgents, `/* BotStats.Get */
+		select browser as name, count(*) as count from hits
+		where site=$1 and bot>0 and created_at>=$2 and created_at<=$3
+		group by browser
+		order by count desc, name asc
+		limit $4`, site.ID, s, e, limit)
+	if err != nil {
+		return errors.Wrap(err, "BotStats.Get user agents")
+	}
+
+	b.Paths = []BotStatsEntry{}
+	err = db.SelectContext(ctx, &b.Paths, `/* BotStats.Get */
+		select path as name, count(*) as count from hits
+		where site=$1 and bot>0 and created_at>=$2 and created_at<=$3
+		group by path
+		order by count desc, name asc
+		limit $4`, site.ID, s, e, limit)
+	return errors.Wrap(err, "BotStats.Get paths")
+}
@@ -0,0 +1,44 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter_test
+
+import (
+	"testing"
+	"time"
+
+	"zgo.at/goatcounter"
+	"zgo.at/goatcounter/gctest"
+)
+
+func TestBotStats(t *testing.T) {
+	ctx, clean := gctest.DB(t)
+	defer clean()
+
+	now := time.Date(2020, 6, 18, 12, 0, 0, 0, time.UTC)
+	gctest.StoreHits(ctx, t,
+		goatcounter.Hit{Path: "/wp-login.php", Browser: "evil/1.0", Bot: 1, CreatedAt: now},
+		goatcounter.Hit{Path: "/wp-login.php", Browser: "evil/1.0", Bot: 1, CreatedAt: now.Add(-24 * time.Hour)},
+		goatcounter.Hit{Path: "/", Browser: "crawler/2.0", Bot: goatcounter.BotSiteRule, CreatedAt: now},
+		goatcounter.Hit{Path: "/", Browser: "Firefox/79.0", CreatedAt: now})
+
+	var b goatcounter.BotStats
+	err := b.Get(ctx, now.Add(-48*time.Hour), now.Add(time.Hour), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if b.Total != 3 || b.Max != 2 {
+		t.Errorf("Total=%d Max=%d", b.Total, b.Max)
+	}
+	if len(b.Days) != 3 || b.Days[0].Daily != 0 || b.Days[1].Daily != 1 || b.Days[2].Daily != 2 {
+		t.Errorf("wrong days: %+v", b.Days)
+	}
+	if len(b.UserAgents) != 2 || b.UserAgents[0] != (goatcounter.BotStatsEntry{Name: "evil/1.0", Count: 2}) {
+		t.Errorf("wrong user agents: %+v", b.UserAgents)
+	}
+	if len(b.Paths) != 2 || b.Paths[0] != (goatcounter.BotStatsEntry{Name: "/wp-login.php", Count: 2}) {
+		t.Errorf("wrong paths: %+v", b.Paths)
+	}
+}
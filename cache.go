@@ -0,0 +1,182 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"zgo.at/zdb"
+)
+
+// siteCacheTTL is how long sites are cached by ByHost(). Changes made by this
+// process clear the cache, but it may take this long for changes from other
+// processes to be seen.
+const siteCacheTTL = time.Minute
+
+type cachedSite struct {
+	site    Site
+	expires time.Time
+}
+
+var siteCache = struct {
+	hits, misses int64 // First for alignment on 32-bit systems.
+	sync.RWMutex
+	m map[string]cachedSite
+}{m: make(map[string]cachedSite)}
+
+func siteCacheGet(key string) (Site, bool) {
+	siteCache.RLock()
+	c, ok := siteCache.m[key]
+	siteCache.RUnlock()
+	if !ok || Now().After(c.expires) {
+		atomic.AddInt64(&siteCache.misses, 1)
+		return Site{}, false
+	}
+	atomic.AddInt64(&siteCache.hits, 1)
+	return c.site, true
+}
+
+func siteCacheSet(key string, s Site) {
+	siteCache.Lock()
+	defer siteCache.Unlock()
+	siteCache.m[key] = cachedSite{site: s, expires: Now().Add(siteCacheTTL)}
+}
+
+// ClearSiteCache clears the cache used by Site.ByHost(); this is done
+// automatically when a site is changed with the Site methods.
+func ClearSiteCache() {
+	siteCache.Lock()
+	defer siteCache.Unlock()
+	siteCache.m = make(map[string]cachedSite)
+}
+
+// pathCountTTL is how long the counts from GetPathCount() are cached; these are
+// requested by visitors of the site, so cache them for a while to not run a
+// query on every request.
+const pathCountTTL = 5 * time.Minute
+
+// pathCountMax is the maximum number of cached counts; the cache is cleared
+// once it's reached.
+const pathCountMax = 10000
+
+type cachedPathCount struct {
+	total, totalUnique int
+	expires            time.Time
+}
+
+type pathCountKey struct {
+	site int64
+	path string
+}
+
+var pathCountCache = struct {
+	sync.RWMutex
+	m map[pathCountKey]cachedPathCount
+}{m: make(map[pathCountKey]cachedPathCount)}
+
+func pathCountCacheGet(site int64, path string) (int, int, bool) {
+	pathCountCache.RLock()
+	c, ok := pathCountCache.m[pathCountKey{site, path}]
+	pathCountCache.RUnlock()
+	if !ok || Now().After(c.expires) {
+		return 0, 0, false
+	}
+	return c.total, c.totalUnique, true
+}
+
+func pathCountCacheSet(site int64, path string, total, totalUnique int) {
+	pathCountCache.Lock()
+	defer pathCountCache.Unlock()
+	if len(pathCountCache.m) >= pathCountMax {
+		pathCountCache.m = make(map[pathCountKey]cachedPathCount)
+	}
+	pathCountCache.m[pathCountKey{site, path}] = cachedPathCount{
+		total: total, totalUnique: totalUnique, expires: Now().Add(pathCountTTL)}
+}
+
+// ClearCaches clears all the in-process caches.
+func ClearCaches() {
+	ClearSiteCache()
+	liveHits.reset()
+	pathCountCache.Lock()
+	pathCountCache.m = make(map[pathCountKey]cachedPathCount)
+	pathCountCache.Unlock()
+	pathCache.Lock()
+	defer pathCache.Unlock()
+	pathCache.m = make(map[pathKey]Path)
+}
+
+// Prepared statements for the queries that are run for (almost) every
+// pageview, so that PostgreSQL doesn't need to parse and plan the same query
+// millions of times a day.
+var stmtCache = struct {
+	uses int64
+	sync.Mutex
+	db    *sqlx.DB
+	stmts map[string]*sqlx.Stmt
+}{stmts: make(map[string]*sqlx.Stmt)}
+
+// GetPrepared is like zdb.MustGet(ctx).GetContext(), except that it uses a
+// cached prepared statement. Queries in a transaction are run as normal, as
+// the statement can't be re-used once the transaction is done.
+func GetPrepared(ctx context.Context, dest interface{}, query string, args ...interface{}) error {
+	db, ok := zdb.MustGet(ctx).(*sqlx.DB)
+	if !ok {
+		return zdb.MustGet(ctx).GetContext(ctx, dest, query, args...)
+	}
+
+	stmtCache.Lock()
+	if stmtCache.db != db { // Different connection, e.g. in tests.
+		for _, s := range stmtCache.stmts {
+			s.Close()
+		}
+		stmtCache.db, stmtCache.stmts = db, make(map[string]*sqlx.Stmt)
+	}
+	stmt, ok := stmtCache.stmts[query]
+	if !ok {
+		var err error
+		stmt, err = db.PreparexContext(ctx, query)
+		if err != nil {
+			stmtCache.Unlock()
+			return err
+		}
+		stmtCache.stmts[query] = stmt
+	}
+	stmtCache.Unlock()
+
+	atomic.AddInt64(&stmtCache.uses, 1)
+	return stmt.GetContext(ctx, dest, args...)
+}
+
+// CacheStats are statistics for the in-process caches.
+type CacheStats struct {
+	SiteHits      int64 `json:"site_hits"`
+	SiteMisses    int64 `json:"site_misses"`
+	Sites         int   `json:"sites"`
+	Statements    int   `json:"statements"`
+	StatementUses int64 `json:"statement_uses"`
+}
+
+// GetCacheStats gets the current cache statistics.
+func GetCacheStats() CacheStats {
+	siteCache.RLock()
+	n := len(siteCache.m)
+	siteCache.RUnlock()
+	stmtCache.Lock()
+	s := len(stmtCache.stmts)
+	stmtCache.Unlock()
+
+	return CacheStats{
+		SiteHits:      atomic.LoadInt64(&siteCache.hits),
+		SiteMisses:    atomic.LoadInt64(&siteCache.misses),
+		Sites:         n,
+		Statements:    s,
+		StatementUses: atomic.LoadInt64(&stmtCache.uses),
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/zdb"
+)
+
+// CanonicalPaths are the settings to canonicalize paths when a pageview is
+// recorded, so that e.g. "/Page/?x=1" and "/page" are counted as the same
+// path. Events are never changed.
+type CanonicalPaths struct {
+	StripQuery bool `json:"strip_query"` // Remove the query string.
+	StripSlash bool `json:"strip_slash"` // Remove trailing slashes, except for "/".
+	Lowercase  bool `json:"lowercase"`   // Lowercase the path, but not the query.
+}
+
+// IsZero reports if none of the settings are enabled.
+func (c CanonicalPaths) IsZero() bool { return !c.StripQuery && !c.StripSlash && !c.Lowercase }
+
+// Apply the settings to the path.
+func (c CanonicalPaths) Apply(path string) string {
+	query := ""
+	if i := strings.IndexRune(path, '?'); i > -1 {
+		path, query = path[:i], path[i:]
+	}
+
+	if c.StripQuery {
+		query = ""
+	}
+	if c.StripSlash && len(path) > 1 {
+		path = strings.TrimRight(path, "/")
+		if path == "" {
+			path = "/"
+		}
+	}
+	if c.Lowercase {
+		path = strings.ToLower(path)
+	}
+	return path + query
+}
+
+// CanonicalizePaths applies the site's CanonicalPaths settings to the existing
+// pageviews between start and end, returning the number of changed pageviews.
+//
+// The stats tables aren't updated; use "goatcounter reindex" for that.
+func CanonicalizePaths(ctx context.Context, start, end time.Time) (int, error) {
+	site := MustGetSite(ctx)
+	c := site.Settings.CanonicalPaths
+	if c.IsZero() {
+		return 0, nil
+	}
+
+	var (
+		db     = zdb.MustGet(ctx)
+		s, e   = start.Format(zdb.Date), end.Format(zdb.Date)
+		paths  []string
+		change int
+	)
+	err := db.SelectContext(ctx, &paths, `/* CanonicalizePaths */
+		select distinct path from hits
+		where site=$1 and event=0 and created_at>=$2 and created_at<=$3`,
+		site.ID, s, e)
+	if err != nil {
+		return 0, errors.Wrap(err, "CanonicalizePaths")
+	}
+
+	for _, p := range paths {
+		cp := c.Apply(p)
+		if cp == p {
+			continue
+		}
+
+		r, err := db.ExecContext(ctx, `/* CanonicalizePaths */
+			update hits set path=$1
+			where site=$2 and path=$3 and event=0 and created_at>=$4 and created_at<=$5`,
+			cp, site.ID, p, s, e)
+		if err != nil {
+			return change, errors.Wrap(err, "CanonicalizePaths")
+		}
+		n, _ := r.RowsAffected()
+		change += int(n)
+	}
+	return change, nil
+}
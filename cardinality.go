@@ -0,0 +1,215 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/zdb"
+	"zgo.at/zlog"
+)
+
+// Cardinality limits: the maximum number of distinct values per site per day;
+// any new values over this are recorded as OtherValue. This prevents a single
+// buggy client generating unique URLs from exploding the stats tables.
+//
+// Set to 0 to disable.
+var (
+	MaxPathsPerDay      = 5000
+	MaxRefsPerDay       = 5000
+	MaxDimensionsPerDay = 1000 // Per dimension.
+)
+
+// OtherValue is recorded for values over the cardinality limits.
+const OtherValue = "(other)"
+
+// How many days to keep in memory; this is just to prevent needlessly
+// re-loading everything from the DB for hits that arrive slightly late.
+const cardinalityDays = 2
+
+type (
+	cardinality struct {
+		mu   sync.Mutex
+		days map[string]map[int64]*siteCardinality // day → siteID → values
+	}
+
+	siteCardinality struct {
+		paths  map[string]struct{}
+		refs   map[string]struct{}
+		dims   map[string]map[string]struct{}
+		warned map[string]struct{}
+	}
+)
+
+func (c *cardinality) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.days = make(map[string]map[int64]*siteCardinality)
+}
+
+// apply the cardinality limits to the hit, collapsing any values over the limit
+// in to OtherValue.
+//
+// This needs to run after Hit.Defaults(), as the values need to be normalized.
+func (c *cardinality) apply(ctx context.Context, h *Hit) error {
+	if MaxPathsPerDay == 0 && MaxRefsPerDay == 0 && MaxDimensionsPerDay == 0 {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	day := h.CreatedAt.Format("2006-01-02")
+	sc, err := c.get(ctx, h.Site, day)
+	if err != nil {
+		return err
+	}
+
+	l := zlog.Module("memstore").Fields(zlog.F{"site": h.Site, "day": day})
+	warn := func(kind string, limit int) {
+		if _, ok := sc.warned[kind]; ok {
+			return
+		}
+		sc.warned[kind] = struct{}{}
+		l.Printf("more than %d distinct %s values; recording new values as %q", limit, kind, OtherValue)
+	}
+
+	if !check(sc.paths, h.Path, MaxPathsPerDay) {
+		warn("path", MaxPathsPerDay)
+		h.Path, h.Title = OtherValue, ""
+	}
+	if h.Ref != "" && !check(sc.refs, h.Ref, MaxRefsPerDay) {
+		warn("ref", MaxRefsPerDay)
+		h.Ref, h.RefScheme = OtherValue, RefSchemeGenerated
+	}
+	for k, v := range h.Dimensions {
+		if sc.dims[k] == nil { // Dimension added after loading.
+			sc.dims[k] = make(map[string]struct{})
+		}
+		if !check(sc.dims[k], v, MaxDimensionsPerDay) {
+			warn("dimension "+k, MaxDimensionsPerDay)
+			h.Dimensions[k] = OtherValue
+		}
+	}
+	return nil
+}
+
+// check if the value is below the limit, adding it to the set if it is.
+func check(set map[string]struct{}, v string, limit int) bool {
+	if limit == 0 {
+		return true
+	}
+	if _, ok := set[v]; ok {
+		return true
+	}
+	if len(set) >= limit {
+		return false
+	}
+	set[v] = struct{}{}
+	return true
+}
+
+// get the values for this site and day, loading the existing values from the
+// database if required.
+func (c *cardinality) get(ctx context.Context, siteID int64, day string) (*siteCardinality, error) {
+	if c.days == nil {
+		c.days = make(map[string]map[int64]*siteCardinality)
+	}
+
+	sites, ok := c.days[day]
+	if !ok {
+		sites = make(map[int64]*siteCardinality)
+		c.days[day] = sites
+
+		if len(c.days) > cardinalityDays {
+			days := make([]string, 0, len(c.days))
+			for d := range c.days {
+				days = append(days, d)
+			}
+			sort.Strings(days)
+			for _, d := range days[:len(days)-cardinalityDays] {
+				delete(c.days, d)
+			}
+		}
+	}
+	if sc, ok := sites[siteID]; ok {
+		return sc, nil
+	}
+
+	start, err := time.Parse("2006-01-02", day)
+	if err != nil {
+		return nil, errors.Wrap(err, "cardinality.get")
+	}
+	var (
+		db    = zdb.MustGet(ctx)
+		end   = start.Add(24*time.Hour - time.Second).Format(zdb.Date)
+		begin = start.Format(zdb.Date)
+		sc    = &siteCardinality{
+			paths:  make(map[string]struct{}),
+			refs:   make(map[string]struct{}),
+			dims:   make(map[string]map[string]struct{}),
+			warned: make(map[string]struct{}),
+		}
+	)
+
+	load := func(set map[string]struct{}, query string) error {
+		var values []string
+		err := db.SelectContext(ctx, &values, query, siteID, begin, end)
+		if err != nil {
+			return errors.Wrap(err, "cardinality.get")
+		}
+		for _, v := range values {
+			set[v] = struct{}{}
+		}
+		return nil
+	}
+
+	err = load(sc.paths, `/* cardinality.get */
+		select distinct path from hit_counts where site=$1 and hour>=$2 and hour<=$3`)
+	if err != nil {
+		return nil, err
+	}
+	err = load(sc.refs, `/* cardinality.get */
+		select distinct ref from ref_counts where site=$1 and hour>=$2 and hour<=$3 and ref != ''`)
+	if err != nil {
+		return nil, err
+	}
+
+	var site Site
+	err = site.ByID(ctx, siteID)
+	if err != nil {
+		return nil, errors.Wrap(err, "cardinality.get")
+	}
+	if len(site.Settings.Dimensions) > 0 {
+		for _, d := range site.Settings.Dimensions {
+			sc.dims[d.Name] = make(map[string]struct{})
+		}
+
+		// Read all the dimensions here, as SQLite doesn't have the JSON
+		// functions.
+		var dims []HitDimensions
+		err = db.SelectContext(ctx, &dims, `/* cardinality.get */
+			select distinct dimensions from hits
+			where site=$1 and created_at>=$2 and created_at<=$3 and dimensions is not null`,
+			siteID, begin, end)
+		if err != nil {
+			return nil, errors.Wrap(err, "cardinality.get")
+		}
+		for _, hd := range dims {
+			for k, v := range hd {
+				if set, ok := sc.dims[k]; ok {
+					set[v] = struct{}{}
+				}
+			}
+		}
+	}
+
+	sites[siteID] = sc
+	return sc, nil
+}
@@ -0,0 +1,77 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Clock gets the current time.
+//
+// Everything that needs the current time – the Memstore, sessions, salt
+// rotation, cron tasks, and handlers – should use Now(), which uses the Clock
+// set with SetClock. This allows testing time-dependent features by setting a
+// FixedClock and moving it forward.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+// SystemClock is a Clock that uses the system time; this is the default.
+var SystemClock Clock = systemClock{}
+
+// FixedClock is a Clock that stays at the same time until it's changed.
+//
+// This is safe for concurrent use.
+type FixedClock struct {
+	mu sync.Mutex
+	t  time.Time
+}
+
+// NewFixedClock creates a new clock set to t.
+func NewFixedClock(t time.Time) *FixedClock { return &FixedClock{t: t} }
+
+// Now gets the clock's time.
+func (c *FixedClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
+}
+
+// Set the clock to t.
+func (c *FixedClock) Set(t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.t = t
+}
+
+// Advance the clock by d.
+func (c *FixedClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.t = c.t.Add(d)
+}
+
+type clockBox struct{ Clock }
+
+var clock atomic.Value
+
+func init() { clock.Store(clockBox{SystemClock}) }
+
+// SetClock sets the Clock used by Now, returning a function to restore the
+// previous one.
+func SetClock(c Clock) func() {
+	prev := clock.Load().(clockBox)
+	clock.Store(clockBox{c})
+	return func() { clock.Store(prev) }
+}
+
+// Now gets the current time in UTC from the Clock.
+func Now() time.Time { return clock.Load().(clockBox).Now().UTC() }
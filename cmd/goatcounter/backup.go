@@ -0,0 +1,196 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/goatcounter"
+	"zgo.at/goatcounter/cfg"
+	"zgo.at/zdb"
+	"zgo.at/zlog"
+)
+
+const usageBackup = `
+Create a backup of the database and the CSV exports as a single .tar.gz archive.
+
+This takes a consistent snapshot of the database and can be run while the server
+is running.
+
+For SQLite "VACUUM INTO" is used, which needs SQLite 3.27 or newer. The archive
+contains "goatcounter.sqlite3", which can be used as-is with -db.
+
+For PostgreSQL pg_dump is used, which must be in the PATH. The archive contains
+"goatcounter.pgdump" in the pg_dump "custom" format, which can be restored with
+pg_restore.
+
+The file set with -salt-key for the serve command isn't included; you will want
+to back that up as well if you use it.
+
+Flags:
+
+  -db          Database connection: "sqlite://<file>" or "postgres://<connect>"
+               See "goatcounter help database" for detailed documentation. Default:
+               sqlite://db/goatcounter.sqlite3?_busy_timeout=200&_journal_mode=wal&cache=shared
+
+  -debug       Modules to debug, comma-separated or 'all' for all modules.
+
+  -o           File to write the archive to. Default:
+               goatcounter-backup-<date>.tar.gz in the current directory.
+
+  -no-exports  Don't include the CSV exports.
+`
+
+func backup() (int, error) {
+	dbConnect := flagDB()
+	debug := flagDebug()
+	out := CommandLine.String("o", "", "")
+	noExports := CommandLine.Bool("no-exports", false, "")
+	err := parseFlags(os.Args[2:])
+	if err != nil {
+		return 1, err
+	}
+
+	zlog.Config.SetDebug(*debug)
+
+	if *out == "" {
+		*out = fmt.Sprintf("goatcounter-backup-%s.tar.gz", goatcounter.Now().Format("2006-01-02T15-04-05"))
+	}
+
+	db, err := connectDB(*dbConnect, nil, false)
+	if err != nil {
+		return 2, err
+	}
+	defer db.Close()
+	ctx := zdb.With(context.Background(), db)
+
+	tmp, err := ioutil.TempDir("", "goatcounter-backup")
+	if err != nil {
+		return 2, err
+	}
+	defer os.RemoveAll(tmp)
+
+	var files [][2]string // Path on disk, name in archive.
+	if cfg.PgSQL {
+		dump := filepath.Join(tmp, "goatcounter.pgdump")
+		err = backupPgSQL(*dbConnect, dump)
+		files = append(files, [2]string{dump, "goatcounter.pgdump"})
+	} else {
+		dump := filepath.Join(tmp, "goatcounter.sqlite3")
+		_, err = db.ExecContext(ctx, `vacuum into $1`, dump)
+		files = append(files, [2]string{dump, "goatcounter.sqlite3"})
+	}
+	if err != nil {
+		return 2, errors.Errorf("backup: %w", err)
+	}
+
+	if !*noExports {
+		var exports []string
+		err := db.SelectContext(ctx, &exports, `select path from exports where finished_at is not null`)
+		if err != nil {
+			return 2, errors.Errorf("backup: %w", err)
+		}
+		for _, e := range exports {
+			if _, err := os.Stat(e); err != nil { // Removed after a day.
+				continue
+			}
+			files = append(files, [2]string{e, "exports/" + filepath.Base(e)})
+		}
+	}
+
+	err = writeArchive(*out, files)
+	if err != nil {
+		os.Remove(*out)
+		return 2, errors.Errorf("backup: %w", err)
+	}
+
+	fmt.Fprintf(stdout, "Wrote backup to %q\n", *out)
+	return 0, nil
+}
+
+var reKeyValue = regexp.MustCompile(`^\w+=`)
+
+// backupPgSQL runs pg_dump for the -db connection string.
+func backupPgSQL(connect, file string) error {
+	// "postgresql://user=x dbname=y" or "postgresql://user@host/dbname";
+	// pg_dump accepts both, but not the prefix on the first.
+	for _, p := range []string{"postgresql://", "postgres://"} {
+		if c := strings.TrimPrefix(connect, p); c != connect && reKeyValue.MatchString(c) {
+			connect = c
+			break
+		}
+	}
+
+	cmd := exec.Command("pg_dump", "--format=custom", "--file="+file, "--dbname="+connect)
+	cmd.Stderr = stderr
+	err := cmd.Run()
+	if err != nil {
+		return fmt.Errorf("pg_dump: %w", err)
+	}
+	return nil
+}
+
+// writeArchive writes the files to a .tar.gz archive; it's only readable by the
+// current user as it contains the entire database.
+func writeArchive(out string, files [][2]string) error {
+	fp, err := os.OpenFile(out, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+
+	gz := gzip.NewWriter(fp)
+	tw := tar.NewWriter(gz)
+	for _, f := range files {
+		err := func() error {
+			src, err := os.Open(f[0])
+			if err != nil {
+				return err
+			}
+			defer src.Close()
+
+			st, err := src.Stat()
+			if err != nil {
+				return err
+			}
+			err = tw.WriteHeader(&tar.Header{
+				Name:    f[1],
+				Mode:    0600,
+				Size:    st.Size(),
+				ModTime: st.ModTime().Truncate(time.Second),
+			})
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(tw, src)
+			return err
+		}()
+		if err != nil {
+			return fmt.Errorf("%s: %w", f[0], err)
+		}
+	}
+
+	err = tw.Close()
+	if err != nil {
+		return err
+	}
+	err = gz.Close()
+	if err != nil {
+		return err
+	}
+	return fp.Close()
+}
@@ -0,0 +1,68 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"zgo.at/goatcounter/cfg"
+)
+
+func TestBackup(t *testing.T) {
+	if cfg.PgSQL {
+		t.Skip("needs pg_dump")
+	}
+
+	_, dbc, clean := tmpdb(t)
+	defer clean()
+
+	dir, err := ioutil.TempDir("", "goatcounter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	out := filepath.Join(dir, "backup.tar.gz")
+
+	o, code := run(t, "", []string{"backup", "-db", dbc, "-o", out})
+	if code != 0 {
+		t.Fatalf("code is %d: %s", code, strings.Join(o, "\n"))
+	}
+
+	fp, err := os.Open(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+	gz, err := gzip.NewReader(fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	tr := tar.NewReader(gz)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h.Size == 0 {
+			t.Errorf("%s is empty", h.Name)
+		}
+		names = append(names, h.Name)
+	}
+	if n := strings.Join(names, " "); n != "goatcounter.sqlite3" {
+		t.Errorf("wrong files: %s", n)
+	}
+}
@@ -0,0 +1,200 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"zgo.at/errors"
+	"zgo.at/goatcounter/acme"
+	"zgo.at/zlog"
+	"zgo.at/zstd/zstring"
+	"zgo.at/zvalidate"
+)
+
+// parseFlags parses the flags from args, and then sets flags that weren't given
+// from the environment variables. The environment variable is the flag name in
+// upper case with - replaced by _, and prefixed with GOATCOUNTER_; for example
+// GOATCOUNTER_DB for -db and GOATCOUNTER_PERSIST_INTERVAL for
+// -persist-interval.
+func parseFlags(args []string) error {
+	err := CommandLine.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	values := make(map[string]string)
+	CommandLine.VisitAll(func(f *flag.Flag) {
+		if v, ok := os.LookupEnv(envName(f.Name)); ok {
+			values[f.Name] = v
+		}
+	})
+	err = setFlags(values, "environment")
+	if err != nil {
+		return err
+	}
+
+	fixedFlags = make(map[string]struct{})
+	CommandLine.Visit(func(f *flag.Flag) { fixedFlags[f.Name] = struct{}{} })
+	return nil
+}
+
+func envName(name string) string {
+	return "GOATCOUNTER_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// flagConfig loads the flags from a TOML file; every key is a flag name without
+// the leading -, for example:
+//
+//	db     = "postgresql://dbname=goatcounter"
+//	listen = ":8080"
+//	tls    = ["acme", "tls", "rdr"]
+//	dev    = false
+//
+// Flags given on the command line or in the environment take precedence over the
+// file.
+func flagConfig(file string) error {
+	values, err := readConfig(file)
+	if err != nil {
+		return err
+	}
+	return setFlags(values, "-config "+file)
+}
+
+// Flags set on the command line or in the environment, which can't be changed
+// by reloading the config file.
+var fixedFlags map[string]struct{}
+
+// Flags that are applied on reload.
+var reloadableFlags = []string{"smtp", "geodb", "asndb", "ratelimit-count"}
+
+// reloadConfig reads the -config file again and applies the flags in
+// reloadableFlags that are in the file, or resets them to the default if they
+// were removed from the file. The .pem files from -tls are always reloaded.
+//
+// A warning is logged for any other changes, as they need a restart.
+func reloadConfig() error {
+	l := zlog.Module("reload")
+
+	values := make(map[string]string)
+	if f := CommandLine.Lookup("config"); f != nil && f.Value.String() != "" {
+		var err error
+		values, err = readConfig(f.Value.String())
+		if err != nil {
+			return err
+		}
+	}
+
+	newValues := make(map[string]string)
+	CommandLine.VisitAll(func(f *flag.Flag) {
+		if _, ok := fixedFlags[f.Name]; ok || f.Name == "config" {
+			return
+		}
+		v, ok := values[f.Name]
+		if !ok {
+			v = f.DefValue
+		}
+		if v == f.Value.String() {
+			return
+		}
+		if !zstring.Contains(reloadableFlags, f.Name) {
+			l.Printf("changing -%s requires a restart", f.Name)
+			return
+		}
+		newValues[f.Name] = v
+	})
+
+	get := func(k string) string {
+		if v, ok := newValues[k]; ok {
+			return v
+		}
+		return CommandLine.Lookup(k).Value.String()
+	}
+	ratelimit, err := strconv.Atoi(get("ratelimit-count"))
+	if err != nil {
+		return errors.Errorf("-config: ratelimit-count: %w", err)
+	}
+
+	v := zvalidate.New()
+	flagReloadable(&v, get("smtp"), get("geodb"), get("asndb"), ratelimit)
+	if v.HasErrors() {
+		return v
+	}
+	for k, val := range newValues {
+		CommandLine.Set(k, val)
+		l.Printf("set -%s to %q", k, val)
+	}
+
+	return acme.Reload()
+}
+
+// readConfig reads the flags from a TOML file.
+func readConfig(file string) (map[string]string, error) {
+	var conf map[string]interface{}
+	_, err := toml.DecodeFile(file, &conf)
+	if err != nil {
+		return nil, errors.Errorf("-config: %w", err)
+	}
+
+	values := make(map[string]string, len(conf))
+	for k, v := range conf {
+		switch vv := v.(type) {
+		case string:
+			values[k] = vv
+		case bool, int64, float64:
+			values[k] = fmt.Sprintf("%v", vv)
+		case []interface{}:
+			l := make([]string, 0, len(vv))
+			for _, e := range vv {
+				l = append(l, fmt.Sprintf("%v", e))
+			}
+			values[k] = strings.Join(l, ",")
+		default:
+			return nil, errors.Errorf("-config: %s: unsupported value %v (%[2]T)", k, v)
+		}
+	}
+	if _, ok := values["config"]; ok {
+		return nil, errors.New(`-config: can't set "config" in the file`)
+	}
+	return values, nil
+}
+
+// setFlags sets the flags from values, unless they were already set on the
+// command line.
+func setFlags(values map[string]string, source string) error {
+	set := make(map[string]struct{})
+	CommandLine.Visit(func(f *flag.Flag) { set[f.Name] = struct{}{} })
+
+	// Sort for consistent errors.
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		if CommandLine.Lookup(k) == nil {
+			return errors.Errorf("%s: unknown flag %q", source, k)
+		}
+		if _, ok := set[k]; ok {
+			continue
+		}
+
+		err := CommandLine.Set(k, values[k])
+		if err != nil {
+			if source == "environment" {
+				return errors.Errorf("%s: %s: %w", source, envName(k), err)
+			}
+			return errors.Errorf("%s: %s: %w", source, k, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,181 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFlagConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goatcounter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		conf, wantErr string
+		want          map[string]string
+	}{
+		{``, "", map[string]string{"db": "x", "listen": ":1", "tls": "", "dev": "false"}},
+		{
+			"db = 'sqlite://foo'\nlisten = ':2'\ntls = ['acme', 'rdr']\ndev = true\npersist-interval = '5s'\n",
+			"",
+			map[string]string{"db": "sqlite://foo", "listen": ":1", "tls": "acme,rdr", "dev": "true", "persist-interval": "5s"},
+		},
+		{"unknown = 1", `unknown flag "unknown"`, nil},
+		{"persist-interval = 'x'", `persist-interval: parse error`, nil},
+		{"[table]\ndb = 'x'", `unsupported value`, nil},
+		{"db = ", `-config`, nil},
+	}
+
+	for i, tt := range tests {
+		t.Run("", func(t *testing.T) {
+			CommandLine = flag.NewFlagSet("goatcounter", flag.ContinueOnError)
+			CommandLine.SetOutput(ioutil.Discard)
+			CommandLine.String("db", "x", "")
+			CommandLine.String("listen", "", "")
+			CommandLine.String("tls", "", "")
+			CommandLine.Bool("dev", false, "")
+			CommandLine.Duration("persist-interval", 10*time.Second, "")
+			err := CommandLine.Parse([]string{"-listen", ":1"})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			file := filepath.Join(dir, string(rune('a'+i))+".toml")
+			err = ioutil.WriteFile(file, []byte(tt.conf), 0600)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = flagConfig(file)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("wrong error\nwant: %s\ngot:  %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for k, v := range tt.want {
+				if got := CommandLine.Lookup(k).Value.String(); got != v {
+					t.Errorf("%s: got %q; want %q", k, got, v)
+				}
+			}
+		})
+	}
+}
+
+func TestParseFlags(t *testing.T) {
+	defer os.Unsetenv("GOATCOUNTER_DB")
+	defer os.Unsetenv("GOATCOUNTER_PERSIST_INTERVAL")
+	defer os.Unsetenv("GOATCOUNTER_LISTEN")
+	os.Setenv("GOATCOUNTER_DB", "sqlite://env")
+	os.Setenv("GOATCOUNTER_PERSIST_INTERVAL", "1m")
+	os.Setenv("GOATCOUNTER_LISTEN", ":2")
+
+	CommandLine = flag.NewFlagSet("goatcounter", flag.ContinueOnError)
+	CommandLine.SetOutput(ioutil.Discard)
+	CommandLine.String("db", "x", "")
+	CommandLine.String("listen", "", "")
+	CommandLine.Duration("persist-interval", 10*time.Second, "")
+	err := parseFlags([]string{"-listen", ":1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{"db": "sqlite://env", "listen": ":1", "persist-interval": "1m0s"}
+	for k, v := range want {
+		if got := CommandLine.Lookup(k).Value.String(); got != v {
+			t.Errorf("%s: got %q; want %q", k, got, v)
+		}
+	}
+
+	os.Setenv("GOATCOUNTER_PERSIST_INTERVAL", "x")
+	CommandLine = flag.NewFlagSet("goatcounter", flag.ContinueOnError)
+	CommandLine.SetOutput(ioutil.Discard)
+	CommandLine.Duration("persist-interval", 10*time.Second, "")
+	err = parseFlags(nil)
+	if err == nil || !strings.Contains(err.Error(), "GOATCOUNTER_PERSIST_INTERVAL") {
+		t.Errorf("wrong error: %v", err)
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goatcounter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "goatcounter.toml")
+
+	write := func(conf string) {
+		t.Helper()
+		err := ioutil.WriteFile(file, []byte(conf), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	check := func(want map[string]string) {
+		t.Helper()
+		for k, v := range want {
+			if got := CommandLine.Lookup(k).Value.String(); got != v {
+				t.Errorf("%s: got %q; want %q", k, got, v)
+			}
+		}
+	}
+
+	CommandLine = flag.NewFlagSet("goatcounter", flag.ContinueOnError)
+	CommandLine.SetOutput(ioutil.Discard)
+	CommandLine.String("config", "", "")
+	CommandLine.String("listen", "", "")
+	CommandLine.String("smtp", "writer", "")
+	CommandLine.String("geodb", "", "")
+	CommandLine.String("asndb", "", "")
+	CommandLine.Int("ratelimit-count", 4, "")
+	write("listen = ':1'\nratelimit-count = 10\n")
+	err = parseFlags([]string{"-config", file, "-smtp", "writer"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = flagConfig(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(map[string]string{"listen": ":1", "ratelimit-count": "10", "smtp": "writer"})
+
+	// listen needs a restart, and smtp was set on the commandline.
+	write("listen = ':2'\nratelimit-count = 20\nsmtp = 'smtp://localhost'\n")
+	err = reloadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(map[string]string{"listen": ":1", "ratelimit-count": "20", "smtp": "writer"})
+
+	// Invalid values don't change anything.
+	write("ratelimit-count = 0\n")
+	err = reloadConfig()
+	if err == nil {
+		t.Fatal("error is nil")
+	}
+	check(map[string]string{"ratelimit-count": "20"})
+
+	// Back to the default.
+	write("")
+	err = reloadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(map[string]string{"ratelimit-count": "4"})
+}
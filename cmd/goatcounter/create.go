@@ -40,7 +40,7 @@ Other flags:
   -parent      Parent site; either as ID or domain.
 
   -db          Database connection: "sqlite://<file>" or "postgres://<connect>"
-               See "goatcounter help db" for detailed documentation. Default:
+               See "goatcounter help database" for detailed documentation. Default:
                sqlite://db/goatcounter.sqlite3?_busy_timeout=200&_journal_mode=wal&cache=shared
 
   -createdb    Create the database if it doesn't exist yet; only for SQLite.
@@ -61,7 +61,7 @@ func create() (int, error) {
 	CommandLine.StringVar(&parent, "parent", "", "")
 	CommandLine.StringVar(&password, "password", "", "")
 	CommandLine.BoolVar(&createdb, "createdb", false, "")
-	err := CommandLine.Parse(os.Args[2:])
+	err := parseFlags(os.Args[2:])
 	if err != nil {
 		return 1, err
 	}
@@ -140,7 +140,7 @@ func create() (int, error) {
 			return err
 		}
 
-		u := goatcounter.User{Site: s.ID, Email: email, Password: []byte(password), EmailVerified: true}
+		u := goatcounter.User{Site: s.ID, Email: email, Password: []byte(password), EmailVerified: true, Owner: true}
 		err = u.Insert(ctx)
 		return err
 	})
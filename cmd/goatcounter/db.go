@@ -0,0 +1,295 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"zgo.at/errors"
+	"zgo.at/goatcounter/cfg"
+	"zgo.at/zdb"
+	"zgo.at/zlog"
+	"zgo.at/zstd/zstring"
+)
+
+const usageDB = `
+Database commands.
+
+Usage: goatcounter db [command] [flags]
+
+Commands:
+
+  maintain     Run routine maintenance and report the size of the tables.
+
+               For PostgreSQL this runs "vacuum analyze"; for SQLite this runs
+               "pragma integrity_check", "vacuum", and "analyze". The exit code
+               is 2 if the integrity check fails.
+
+               This can be run from cron while the server is running, but note
+               that a SQLite vacuum blocks all writes until it's done, which
+               may take a while for larger databases.
+
+Flags:
+
+  -db          Database connection: "sqlite://<file>" or "postgres://<connect>"
+               See "goatcounter help database" for detailed documentation. Default:
+               sqlite://db/goatcounter.sqlite3?_busy_timeout=200&_journal_mode=wal&cache=shared
+
+  -debug       Modules to debug, comma-separated or 'all' for all modules.
+
+Flags for maintain:
+
+  -no-vacuum   Only check the integrity (on SQLite) and report the sizes.
+
+  -quiet       Don't print anything unless there is an error.
+
+The size per site is estimated from the share of rows for the site in every
+table, as the tables aren't stored separately per site.
+`
+
+// Tables with a site column to estimate the size per site for.
+var siteTables = []string{"hits", "hit_counts", "ref_counts", "hit_stats",
+	"browser_stats", "system_stats", "location_stats", "region_stats",
+	"city_stats", "language_stats", "size_stats", "path_transitions",
+	"bot_stats", "hit_rollups"}
+
+func database() (int, error) {
+	if len(os.Args) == 2 {
+		return 1, errors.New("need a command")
+	}
+
+	sub := os.Args[2]
+	switch sub {
+	default:
+		return 1, errors.Errorf("unknown command for db: %q", sub)
+	case "maintain":
+		return dbMaintain()
+	}
+}
+
+type tableSize struct {
+	Name  string `db:"name"`
+	Rows  int64  `db:"rows"`
+	Size  int64  `db:"size"`
+	Index int64  `db:"indexes"`
+}
+
+func dbMaintain() (int, error) {
+	dbConnect := flagDB()
+	debug := flagDebug()
+	noVacuum := CommandLine.Bool("no-vacuum", false, "")
+	quiet := CommandLine.Bool("quiet", false, "")
+	err := parseFlags(os.Args[3:])
+	if err != nil {
+		return 1, err
+	}
+
+	zlog.Config.SetDebug(*debug)
+
+	db, err := connectDB(*dbConnect, nil, false)
+	if err != nil {
+		return 2, err
+	}
+	defer db.Close()
+	ctx := zdb.With(context.Background(), db)
+
+	if !cfg.PgSQL {
+		var res []string
+		err := db.SelectContext(ctx, &res, `pragma integrity_check`)
+		if err != nil {
+			return 2, errors.Errorf("db maintain: %w", err)
+		}
+		if len(res) != 1 || res[0] != "ok" {
+			return 2, errors.Errorf("db maintain: integrity check failed:\n\t%s", strings.Join(res, "\n\t"))
+		}
+	}
+
+	if !*noVacuum {
+		q := []string{`vacuum analyze`}
+		if !cfg.PgSQL {
+			q = []string{`vacuum`, `analyze`}
+		}
+		for _, qq := range q {
+			_, err := db.ExecContext(ctx, qq)
+			if err != nil {
+				return 2, errors.Errorf("db maintain: %s: %w", qq, err)
+			}
+		}
+	}
+
+	if *quiet {
+		return 0, nil
+	}
+
+	tables, err := tableSizes(ctx)
+	if err != nil {
+		return 2, errors.Errorf("db maintain: %w", err)
+	}
+	fmt.Fprintf(stdout, "%-20s %12s %10s %10s\n", "Table", "Rows", "Size", "Indexes")
+	var total int64
+	for _, t := range tables {
+		total += t.Size + t.Index
+		fmt.Fprintf(stdout, "%-20s %12d %10s %10s\n", t.Name, t.Rows, humanSize(t.Size), humanSize(t.Index))
+	}
+	fmt.Fprintf(stdout, "%-20s %12s %21s\n\n", "Total", "", humanSize(total))
+
+	sites, err := siteSizes(ctx, tables)
+	if err != nil {
+		return 2, errors.Errorf("db maintain: %w", err)
+	}
+	fmt.Fprintf(stdout, "%-8s %-20s %12s %10s\n", "Site", "Code", "Rows", "Size")
+	for _, s := range sites {
+		fmt.Fprintf(stdout, "%-8d %-20s %12d %10s\n", s.id, s.code, s.rows, humanSize(s.size))
+	}
+	return 0, nil
+}
+
+// tableSizes gets the size of all tables and their indexes, largest first.
+//
+// For SQLite this needs the dbstat virtual table; if SQLite isn't compiled
+// with it the sizes are 0.
+func tableSizes(ctx context.Context) ([]tableSize, error) {
+	db := zdb.MustGet(ctx)
+
+	var tables []tableSize
+	if cfg.PgSQL {
+		err := db.SelectContext(ctx, &tables, `
+			select
+				relname                  as name,
+				n_live_tup               as rows,
+				pg_relation_size(relid)  as size,
+				pg_indexes_size(relid)   as indexes
+			from pg_stat_user_tables
+			order by pg_total_relation_size(relid) desc`)
+		return tables, err
+	}
+
+	err := db.SelectContext(ctx, &tables,
+		`select name from sqlite_master where type='table' and name not like 'sqlite_%'`)
+	if err != nil {
+		return nil, err
+	}
+
+	var sizes []struct {
+		Name  string `db:"tbl_name"`
+		Type  string `db:"type"`
+		Bytes int64  `db:"bytes"`
+	}
+	err = db.SelectContext(ctx, &sizes, `
+		select m.tbl_name, m.type, sum(s.pgsize) as bytes
+		from dbstat s
+		join sqlite_master m on m.name=s.name
+		group by m.tbl_name, m.type`)
+	if err != nil && !strings.Contains(err.Error(), "no such table: dbstat") {
+		return nil, err
+	}
+
+	for i := range tables {
+		err := db.GetContext(ctx, &tables[i].Rows, `select count(*) from "`+tables[i].Name+`"`)
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range sizes {
+			if s.Name != tables[i].Name {
+				continue
+			}
+			if s.Type == "index" {
+				tables[i].Index += s.Bytes
+			} else {
+				tables[i].Size += s.Bytes
+			}
+		}
+	}
+	sort.Slice(tables, func(i, j int) bool {
+		if a, b := tables[i].Size+tables[i].Index, tables[j].Size+tables[j].Index; a != b {
+			return a > b
+		}
+		return tables[i].Rows > tables[j].Rows
+	})
+	return tables, nil
+}
+
+type siteSize struct {
+	id   int64
+	code string
+	rows int64
+	size int64
+}
+
+// siteSizes estimates the size for every site from the share of rows in every
+// table in siteTables, largest first.
+func siteSizes(ctx context.Context, tables []tableSize) ([]siteSize, error) {
+	db := zdb.MustGet(ctx)
+
+	var sites []struct {
+		ID   int64  `db:"id"`
+		Code string `db:"code"`
+	}
+	err := db.SelectContext(ctx, &sites, `select id, code from sites order by id`)
+	if err != nil {
+		return nil, err
+	}
+	bySite := make(map[int64]*siteSize, len(sites))
+	for _, s := range sites {
+		bySite[s.ID] = &siteSize{id: s.ID, code: s.Code}
+	}
+
+	for _, t := range tables {
+		if !zstring.Contains(siteTables, t.Name) {
+			continue
+		}
+
+		var rows []struct {
+			Site  int64 `db:"site"`
+			Count int64 `db:"count"`
+		}
+		err := db.SelectContext(ctx, &rows, `select site, count(*) as count from `+t.Name+` group by site`)
+		if err != nil {
+			return nil, err
+		}
+
+		var total int64
+		for _, r := range rows {
+			total += r.Count
+		}
+		for _, r := range rows {
+			s, ok := bySite[r.Site]
+			if !ok { // Deleted site.
+				continue
+			}
+			s.rows += r.Count
+			s.size += int64(float64(t.Size+t.Index) * float64(r.Count) / float64(total))
+		}
+	}
+
+	list := make([]siteSize, 0, len(bySite))
+	for _, s := range bySite {
+		list = append(list, *s)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].size != list[j].size {
+			return list[i].size > list[j].size
+		}
+		return list[i].rows > list[j].rows
+	})
+	return list, nil
+}
+
+func humanSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%c", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,59 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"zgo.at/goatcounter"
+	"zgo.at/goatcounter/gctest"
+)
+
+func TestDBMaintain(t *testing.T) {
+	ctx, dbc, clean := tmpdb(t)
+	defer clean()
+
+	ctx, site := gctest.Site(ctx, t, goatcounter.Site{})
+	gctest.StoreHits(ctx, t, goatcounter.Hit{Path: "/", Site: site.ID})
+
+	out, code := run(t, "", []string{"db", "maintain", "-db", dbc})
+	if code != 0 {
+		t.Fatalf("code is %d: %s", code, strings.Join(out, "\n"))
+	}
+	o := strings.Join(out, "\n")
+	if !strings.Contains(o, "hit_counts") || !strings.Contains(o, site.Code) {
+		t.Errorf("wrong output:\n%s", o)
+	}
+
+	out, code = run(t, "", []string{"db", "maintain", "-db", dbc, "-quiet", "-no-vacuum"})
+	if code != 0 || len(out) != 0 {
+		t.Fatalf("code is %d: %s", code, strings.Join(out, "\n"))
+	}
+
+	out, code = run(t, "", []string{"db", "nonexistent"})
+	if code != 1 {
+		t.Fatalf("code is %d: %s", code, strings.Join(out, "\n"))
+	}
+}
+
+func TestHumanSize(t *testing.T) {
+	tests := []struct {
+		in   int64
+		want string
+	}{
+		{0, "0B"},
+		{1023, "1023B"},
+		{1024, "1.0K"},
+		{1536, "1.5K"},
+		{5 * 1024 * 1024, "5.0M"},
+	}
+
+	for _, tt := range tests {
+		if got := humanSize(tt.in); got != tt.want {
+			t.Errorf("humanSize(%d) = %q; want %q", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDoctor(t *testing.T) {
+	_, dbc, clean := tmpdb(t)
+	defer clean()
+
+	t.Run("ok", func(t *testing.T) {
+		out, code := run(t, "", []string{"doctor",
+			"-listen", "localhost:31875",
+			"-tls", "none",
+			"-ephemeral-salt",
+			"-db", dbc})
+		if code != 0 {
+			t.Fatalf("code is %d: %s", code, strings.Join(out, "\n"))
+		}
+		o := strings.Join(out, "\n")
+		for _, want := range []string{"ok    database", "ok    migrations", "ok    geoip", "ok    listen"} {
+			if !strings.Contains(o, want) {
+				t.Errorf("%q not in output:\n%s", want, o)
+			}
+		}
+	})
+
+	t.Run("fail", func(t *testing.T) {
+		out, code := run(t, "", []string{"serve", "-check-config",
+			"-listen", "localhost:31875",
+			"-tls", "tls,nonexistent.pem",
+			"-ephemeral-salt",
+			"-db", dbc})
+		if code != 1 {
+			t.Fatalf("code is %d: %s", code, strings.Join(out, "\n"))
+		}
+		o := strings.Join(out, "\n")
+		if !strings.Contains(o, `FAIL  tls         cannot load "nonexistent.pem"`) {
+			t.Errorf("wrong output:\n%s", o)
+		}
+	})
+
+	t.Run("geodb", func(t *testing.T) {
+		out, code := run(t, "", []string{"doctor",
+			"-listen", "localhost:31875",
+			"-tls", "none",
+			"-ephemeral-salt",
+			"-geodb", "nonexistent.mmdb",
+			"-db", dbc})
+		if code != 1 {
+			t.Fatalf("code is %d: %s", code, strings.Join(out, "\n"))
+		}
+		o := strings.Join(out, "\n")
+		if !strings.Contains(o, `FAIL  geoip       cannot load "nonexistent.mmdb"`) {
+			t.Errorf("wrong output:\n%s", o)
+		}
+	})
+}
@@ -0,0 +1,148 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/goatcounter"
+	"zgo.at/zdb"
+	"zgo.at/zlog"
+	"zgo.at/zvalidate"
+)
+
+const usageErase = `
+Delete the pageviews of a visitor, for example to answer a GDPR erasure request.
+
+All pageviews matching all of the given conditions are deleted, and a report of
+what was deleted is written, which can be kept as a record of the request. The
+statistics aren't changed, as they can't be used to identify a visitor.
+
+The IP address of a visitor is never stored; use the /api/v0/erase API endpoint
+to find the session from the IP address and User-Agent while the server is
+running (this is only possible for a few hours after the last pageview).
+
+Flags:
+
+  -db          Database connection: "sqlite://<file>" or "postgres://<connect>"
+               See "goatcounter help database" for detailed documentation. Default:
+               sqlite://db/goatcounter.sqlite3?_busy_timeout=200&_journal_mode=wal&cache=shared
+
+  -debug       Modules to debug, comma-separated or 'all' for all modules.
+
+  -site        Site ID to delete the pageviews from. Required.
+
+  -session     Session IDs, as in the CSV export; comma-separated.
+
+  -start, -end Only delete pageviews in this period, as "year-month-day" or
+               "year-month-day hour:minute:second", in UTC. The end day is
+               included.
+
+  -report      Write the report to this file instead of stdout.
+
+  -dry-run     Print which pageviews would be deleted, without deleting them.
+`
+
+func erase() (int, error) {
+	dbConnect := flagDB()
+	debug := flagDebug()
+	session := CommandLine.String("session", "", "")
+	start := CommandLine.String("start", "", "")
+	end := CommandLine.String("end", "", "")
+	report := CommandLine.String("report", "", "")
+	dryRun := CommandLine.Bool("dry-run", false, "")
+	var siteID int64
+	CommandLine.Int64Var(&siteID, "site", 0, "")
+	err := parseFlags(os.Args[2:])
+	if err != nil {
+		return 1, err
+	}
+
+	v := zvalidate.New()
+	v.Required("-site", siteID)
+	var req goatcounter.Erasure
+	if *session != "" {
+		req.Sessions = strings.Split(*session, ",")
+	}
+	req.Start = eraseTime(&v, "-start", *start, false)
+	req.End = eraseTime(&v, "-end", *end, true)
+	if v.HasErrors() {
+		return 1, v
+	}
+
+	zlog.Config.SetDebug(*debug)
+
+	db, err := connectDB(*dbConnect, nil, false)
+	if err != nil {
+		return 2, err
+	}
+	defer db.Close()
+	ctx := zdb.With(context.Background(), db)
+
+	var site goatcounter.Site
+	err = site.ByID(ctx, siteID)
+	if err != nil {
+		return 1, err
+	}
+	ctx = goatcounter.WithSite(ctx, &site)
+
+	var rep *goatcounter.ErasureReport
+	if *dryRun {
+		// Roll back the transaction, so that nothing is deleted.
+		err = zdb.TX(ctx, func(ctx context.Context, tx zdb.DB) error {
+			var err error
+			rep, err = req.Erase(ctx)
+			if err != nil {
+				return err
+			}
+			return errDryRun
+		})
+		if errors.Is(err, errDryRun) {
+			err = nil
+		}
+	} else {
+		rep, err = req.Erase(ctx)
+	}
+	if err != nil {
+		return 1, err
+	}
+
+	text := rep.String()
+	if *dryRun {
+		text = "DRY RUN: nothing was deleted.\n\n" + text
+	}
+	if *report == "" {
+		fmt.Fprint(stdout, text)
+		return 0, nil
+	}
+	err = ioutil.WriteFile(*report, []byte(text), 0600)
+	if err != nil {
+		return 1, err
+	}
+	return 0, nil
+}
+
+var errDryRun = errors.New("dry run")
+
+func eraseTime(v *zvalidate.Validator, key, s string, endOfDay bool) *time.Time {
+	if s == "" {
+		return nil
+	}
+	if len(s) == 10 {
+		t := v.Date(key, s, "2006-01-02")
+		if endOfDay {
+			t = t.Add(24*time.Hour - time.Second)
+		}
+		return &t
+	}
+	t := v.Date(key, s, "2006-01-02 15:04:05")
+	return &t
+}
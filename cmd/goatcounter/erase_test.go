@@ -0,0 +1,38 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestErase(t *testing.T) {
+	_, dbc, clean := tmpdb(t)
+	defer clean()
+
+	out, code := run(t, "", []string{"create",
+		"-email", "foo@foo.foo",
+		"-domain", "stats.stats",
+		"-password", "password",
+		"-db", dbc})
+	if code != 0 {
+		t.Fatalf("code is %d: %s", code, strings.Join(out, "\n"))
+	}
+
+	out, code = run(t, "", []string{"erase", "-db", dbc, "-site", "1", "-start", "2020-06-01", "-dry-run"})
+	if code != 0 {
+		t.Fatalf("code is %d: %s", code, strings.Join(out, "\n"))
+	}
+	o := strings.Join(out, "\n")
+	if !strings.Contains(o, "DRY RUN") || !strings.Contains(o, "Pageviews:  0") {
+		t.Errorf("wrong output:\n%s", o)
+	}
+
+	out, code = run(t, "", []string{"erase", "-db", dbc, "-site", "1"})
+	if code != 1 {
+		t.Errorf("code is %d: %s", code, strings.Join(out, "\n"))
+	}
+}
@@ -31,9 +31,9 @@ func help() (int, error) {
 		fmt.Println()
 		for _, h := range []string{
 			"help", "version",
-			"migrate", "create", "serve",
-			"reindex", "monitor",
-			"db", "listen",
+			"migrate", "create", "serve", "doctor",
+			"reindex", "erase", "backup", "restore", "db", "monitor",
+			"database", "listen",
 		} {
 			head := fmt.Sprintf("─── Help for %q ", h)
 			fmt.Fprintf(stdout, "%s%s\n\n",
@@ -66,6 +66,10 @@ You can select a database engine by using "sqlite://[..]" for SQLite, or
 "postgresql://[..]" (or "postgres://[..]") for PostgreSQL.
 
 There are no plans to support other database engines such as MySQL/MariaDB.
+The queries and migrations are written for SQLite and PostgreSQL and rely on
+syntax such as "on conflict" which MySQL and MariaDB don't have, and every
+engine needs to be tested and maintained. SQLite needs no server at all, so
+it's probably the easiest choice if you don't want to run PostgreSQL.
 
 SQLite:
 
@@ -80,9 +84,22 @@ SQLite:
     See the go-sqlite3 documentation for a list of supported parameters:
     https://github.com/mattn/go-sqlite3/#connection-string
 
-    _journal_mode=wal is always added unless explicitly overridden. Generally
-    speaking using a Write-Ahead-Log is more suitable for GoatCounter than the
-    default DELETE journaling.
+    Some parameters are added if the connection string doesn't set them; you
+    can change them with these flags, or use 0 or an empty string to use the
+    SQLite default:
+
+        -sqlite-journal       Journal mode (_journal_mode). Default: wal
+        -sqlite-busy-timeout  How long to wait for a lock in milliseconds
+                              (_busy_timeout). Default: 5000
+        -sqlite-synchronous   Synchronous level (_synchronous). Default: normal
+        -sqlite-cache-size    Cache size (_cache_size); a negative number is in
+                              KiB, a positive number in pages. Default: -20000
+
+    Generally speaking using a Write-Ahead-Log is more suitable for GoatCounter
+    than the default DELETE journaling, and "normal" is safe with it. The busy
+    timeout prevents "database is locked" errors when several processes use the
+    database at the same time, such as running an import while the server is
+    running.
 
     The database is automatically created for the "serve" command, but you need
     to add -createdb to any other commands to create the database. This is to
@@ -111,6 +128,11 @@ PostgreSQL:
 
         alter database goatcounter set seq_page_cost=.5
 
+    On PostgreSQL 11 and newer the hits table is partitioned by month, and the
+    partitions are created automatically. If all sites have data retention
+    enabled then entire partitions older than the longest retention are
+    dropped, which is much faster than deleting the rows.
+
     The database isn't automatically created for PostgreSQL, you'll have to
     manually create it first:
 
@@ -139,6 +161,13 @@ listen and tls flags:
 
         -listen localhost:8081     Listen on localhost:8081
         -listen :8081              Listen on :8081 for all addresses
+        -listen unix:/run/gc.sock  Listen on the unix socket /run/gc.sock
+
+    A unix socket is useful if you use a proxy on the same machine (see "Proxy
+    Setup" below) and don't want to use a TCP port; the permissions are set
+    with -listen-mode (default 0660), so you can give the proxy access with
+    the socket's group. An existing socket is removed if nothing is listening
+    on it.
 
     The -tls flag controls the TLS setup, as well as redirecting port 80 the
     -listen port with a 301 status code. Because there are a few different
@@ -186,6 +215,24 @@ listen and tls flags:
         -tls tls,/etc/tls/stats.example.com.pem
             Don't use ACME, but use a certificate from a CA. No port 80 redirect.
 
+DNS-01 challenge:
+
+    If GoatCounter isn't reachable from the internet, or if you want a wildcard
+    certificate, then you can use the DNS-01 challenge with -acme-dns. Let's
+    Encrypt will verify a TXT record instead of connecting to GoatCounter, so
+    port 80 doesn't need to be open:
+
+        -tls tls,acme -acme-dns exec:/usr/local/bin/acme-dns-hook
+
+    The program is run as "acme-dns-hook present <fqdn> <value>" to create the
+    TXT record and "acme-dns-hook cleanup <fqdn> <value>" to remove it again;
+    the fqdn is "_acme-challenge.<domain>". It should only exit once the record
+    is visible to the outside world.
+
+    With -acme-dns-wildcard example.com a single "*.example.com" certificate is
+    created for all subdomains of example.com, instead of one certificate per
+    subdomain.
+
 Proxy Setup:
 
     If you want to serve GoatCounter behind a proxy (HAproxy, Varnish, Hitch,
@@ -194,7 +241,8 @@ Proxy Setup:
         goatcounter serve -listen localhost:8081 -tls none
 
     And then forward requests on port 80 and 443 for your domain to
-    localhost:8081. This assumes that the proxy will take care of the TLS
+    localhost:8081, or use -listen unix:/run/goatcounter.sock and forward to
+    the socket. This assumes that the proxy will take care of the TLS
     certificate story.
 
     You can still use GoatCounter's ACME if you want:
@@ -216,6 +264,26 @@ Proxy Setup:
     want to read "*" but "*.pem" (some proxies ignore invalid certificates, for
     others it's a fatal error).
 
+systemd socket activation:
+
+    GoatCounter can use sockets passed by systemd socket activation instead of
+    opening the -listen address itself. This lets it use ports 80 and 443
+    without running as root or needing CAP_NET_BIND_SERVICE.
+
+    The first socket is used for the server; if -tls has "rdr" then the second
+    socket is used to redirect to HTTPS. For example, in goatcounter.socket:
+
+        [Socket]
+        ListenStream=443
+        ListenStream=80
+
+    And in goatcounter.service:
+
+        [Service]
+        ExecStart=/usr/bin/goatcounter serve -tls tls,acme,rdr
+
+    The -listen flag is ignored if there are sockets from systemd.
+
 Using a non-standard port:
 
     If you make GoatCounter publicly accessibly on non-standard port (i.e. not
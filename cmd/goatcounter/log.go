@@ -0,0 +1,164 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"zgo.at/goatcounter/handlers"
+	"zgo.at/zlog"
+	"zgo.at/zstd/zstring"
+	"zgo.at/zvalidate"
+)
+
+// flagLogFormat sets the zlog output format from -log-format.
+//
+// This replaces all outputs, so must be called before anything else adds one.
+func flagLogFormat(format string, v *zvalidate.Validator) {
+	switch format {
+	case "", "text":
+	case "json":
+		zlog.Config.Outputs = []zlog.OutputFunc{logJSON}
+	default:
+		v.Append("-log-format", `must be "text" or "json"`)
+	}
+}
+
+type jsonLog struct {
+	Time    string                 `json:"time"`
+	Level   string                 `json:"level"`
+	Modules []string               `json:"modules,omitempty"`
+	Msg     string                 `json:"msg,omitempty"`
+	Error   string                 `json:"error,omitempty"`
+	Data    map[string]interface{} `json:"data,omitempty"`
+}
+
+var logJSONMu sync.Mutex
+
+// logJSON writes the log entry as one line of JSON; errors are written to
+// stderr, and everything else to stdout.
+func logJSON(l zlog.Log) {
+	j := jsonLog{
+		Time:    time.Now().UTC().Format(time.RFC3339Nano),
+		Level:   "info",
+		Modules: l.Modules,
+		Msg:     l.Msg,
+	}
+	switch l.Level {
+	case zlog.LevelErr:
+		j.Level = "error"
+	case zlog.LevelDbg:
+		j.Level = "debug"
+	}
+	if l.Err != nil {
+		j.Error = l.Err.Error()
+	}
+	if len(l.Data) > 0 {
+		j.Data = make(map[string]interface{}, len(l.Data))
+		for k, d := range l.Data {
+			// Make sure everything can be encoded; errors in particular
+			// encode as "{}".
+			switch dd := d.(type) {
+			case error:
+				d = dd.Error()
+			case fmt.Stringer:
+				d = dd.String()
+			default:
+				if _, err := json.Marshal(d); err != nil {
+					d = fmt.Sprintf("%v", d)
+				}
+			}
+			j.Data[k] = d
+		}
+	}
+
+	line, err := json.Marshal(j)
+	if err != nil { // Should never happen.
+		line = []byte(fmt.Sprintf(`{"level":"error","error":%q}`, err.Error()))
+	}
+
+	out := stdout
+	if l.Level == zlog.LevelErr {
+		out = stderr
+	}
+	logJSONMu.Lock()
+	defer logJSONMu.Unlock()
+	fmt.Fprintf(out, "%s\n", line)
+}
+
+var (
+	accessLog       *logFile
+	accessLogFormat string
+)
+
+// flagAccessLog opens the access log from -access-log; "-" is stdout.
+func flagAccessLog(file, format string, v *zvalidate.Validator) {
+	if !zstring.Contains(handlers.AccessLogFormats, format) {
+		v.Append("-access-log-format", fmt.Sprintf("must be one of %v", handlers.AccessLogFormats))
+	}
+	accessLog, accessLogFormat = nil, format
+	if file == "" {
+		return
+	}
+
+	l, err := openLogFile(file)
+	if err != nil {
+		v.Append("-access-log", err.Error())
+		return
+	}
+	accessLog = l
+}
+
+// withAccessLog wraps h to write to the access log, if there is one.
+func withAccessLog(h http.Handler) http.Handler {
+	if accessLog == nil {
+		return h
+	}
+	return handlers.AccessLog(accessLog, accessLogFormat, h)
+}
+
+// logFile is a log file that can be reopened after it's been rotated.
+type logFile struct {
+	mu   sync.Mutex
+	path string
+	fp   *os.File
+}
+
+func openLogFile(path string) (*logFile, error) {
+	f := &logFile{path: path}
+	return f, f.Reopen()
+}
+
+func (f *logFile) Write(b []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.fp.Write(b)
+}
+
+// Reopen the file; this does nothing for stdout.
+func (f *logFile) Reopen() error {
+	if f.path == "-" {
+		f.fp = stdout
+		return nil
+	}
+
+	fp, err := os.OpenFile(f.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.fp != nil {
+		f.fp.Close()
+	}
+	f.fp = fp
+	return nil
+}
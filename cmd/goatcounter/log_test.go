@@ -0,0 +1,61 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"zgo.at/zlog"
+)
+
+func TestLogJSON(t *testing.T) {
+	fp, err := ioutil.TempFile("", "goatcounter-log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(fp.Name())
+	defer fp.Close()
+	stdout, stderr = fp, fp
+	defer func() { stdout, stderr = os.Stdout, os.Stderr }()
+
+	logJSON(zlog.Log{
+		Level:   zlog.LevelErr,
+		Modules: []string{"cron"},
+		Msg:     "oh noes",
+		Err:     errors.New("err"),
+		Data:    zlog.F{"site": 1, "err": errors.New("x"), "ch": make(chan int)},
+	})
+
+	out, err := ioutil.ReadFile(fp.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var have map[string]interface{}
+	err = json.Unmarshal(out, &have)
+	if err != nil {
+		t.Fatalf("%s: %q", err, out)
+	}
+	delete(have, "time")
+
+	want := map[string]interface{}{
+		"level":   "error",
+		"modules": []interface{}{"cron"},
+		"msg":     "oh noes",
+		"error":   "err",
+		"data":    map[string]interface{}{"site": 1.0, "err": "x", "ch": have["data"].(map[string]interface{})["ch"]},
+	}
+	h, _ := json.Marshal(have)
+	w, _ := json.Marshal(want)
+	if string(h) != string(w) {
+		t.Errorf("\nwant: %s\nhave: %s", w, h)
+	}
+	if _, ok := have["data"].(map[string]interface{})["ch"].(string); !ok {
+		t.Errorf("channel not converted to string: %s", h)
+	}
+}
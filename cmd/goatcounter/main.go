@@ -7,8 +7,10 @@ package main
 import (
 	"flag"
 	"fmt"
+	"net/url"
 	"os"
 	"runtime"
+	"strconv"
 	"strings"
 
 	"github.com/jmoiron/sqlx"
@@ -39,9 +41,13 @@ var usage = map[string]string{
 	"migrate":  usageMigrate,
 	"saas":     usageSaas,
 	"reindex":  usageReindex,
+	"erase":    usageErase,
+	"backup":   usageBackup,
+	"restore":  usageRestore,
 	"monitor":  usageMonitor,
+	"doctor":   usageDoctor,
+	"db":       usageDB,
 	"database": helpDatabase,
-	"db":       helpDatabase,
 	"listen":   helpListen,
 
 	"version": `
@@ -63,16 +69,26 @@ Commands:
   migrate      Run database migrations.
   create       Create a new site and user.
   serve        Start HTTP server.
+  doctor       Check the configuration for the serve command.
 
 Advanced commands:
   reindex      Recreate the index tables (*_stats, *_count) from the hits.
+  erase        Delete the pageviews of a visitor.
+  backup       Create a backup of the database and exports.
+  restore      Restore a backup.
+  db           Database maintenance.
   monitor      Monitor for pageviews.
 
 Extra help topics:
-  db           Detailed documentation on the -db flag.
+  database     Detailed documentation on the -db flag.
   listen       Detailed documentation on -listen, -tls.
 
 See "help <topic>" for more details for the command.
+
+All flags can also be set as environment variables: the flag name in upper case
+with - replaced by _, and prefixed with GOATCOUNTER_. For example GOATCOUNTER_DB
+for -db, or GOATCOUNTER_PERSIST_INTERVAL for -persist-interval. Flags on the
+command line override environment variables.
 `
 
 var CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
@@ -111,8 +127,18 @@ func main() {
 		code, err = saas()
 	case "reindex":
 		code, err = reindex()
+	case "erase":
+		code, err = erase()
+	case "backup":
+		code, err = backup()
+	case "restore":
+		code, err = restore()
+	case "db":
+		code, err = database()
 	case "monitor":
 		code, err = monitor()
+	case "doctor":
+		code, err = doctor()
 	}
 	if err != nil {
 		// code=1, the user did something wrong and print usage as well
@@ -145,11 +171,92 @@ func printMsg(code int, usageText, msg string, args ...interface{}) {
 	}
 }
 
-func flagDB() *string    { return CommandLine.String("db", "sqlite://db/goatcounter.sqlite3", "") }
 func flagDebug() *string { return CommandLine.String("debug", "", "") }
 
+func flagDB() *string {
+	CommandLine.StringVar(&sqliteFlags.journal, "sqlite-journal", "wal", "")
+	CommandLine.IntVar(&sqliteFlags.busyTimeout, "sqlite-busy-timeout", 5000, "")
+	CommandLine.StringVar(&sqliteFlags.synchronous, "sqlite-synchronous", "normal", "")
+	CommandLine.IntVar(&sqliteFlags.cacheSize, "sqlite-cache-size", -20000, "")
+	return CommandLine.String("db", "sqlite://db/goatcounter.sqlite3", "")
+}
+
+// SQLite connection parameters, set with the -sqlite-* flags. These are only
+// added to the connection string if it doesn't set the parameter already; the
+// zero values mean the SQLite default is used.
+var sqliteFlags struct {
+	journal     string
+	busyTimeout int
+	synchronous string
+	cacheSize   int
+}
+
+// sqliteConnect adds the parameters from the -sqlite-* flags to the SQLite
+// connection string.
+func sqliteConnect(connect string) (string, error) {
+	path, query := connect, ""
+	if i := strings.IndexByte(connect, '?'); i > -1 {
+		path, query = connect[:i], connect[i+1:]
+	}
+	params, err := url.ParseQuery(query)
+	if err != nil {
+		return "", errors.Errorf("invalid SQLite connection string: %w", err)
+	}
+
+	has := func(keys ...string) bool {
+		for _, k := range keys {
+			if _, ok := params[k]; ok {
+				return true
+			}
+		}
+		return false
+	}
+
+	var add []string
+	if j := strings.ToLower(sqliteFlags.journal); j != "" && !has("_journal_mode", "_journal") {
+		switch j {
+		default:
+			return "", errors.Errorf("-sqlite-journal: invalid value %q", sqliteFlags.journal)
+		case "delete", "truncate", "persist", "memory", "wal", "off":
+		}
+		add = append(add, "_journal_mode="+j)
+	}
+	if sqliteFlags.busyTimeout > 0 && !has("_busy_timeout", "_timeout") {
+		add = append(add, "_busy_timeout="+strconv.Itoa(sqliteFlags.busyTimeout))
+	}
+	if s := strings.ToLower(sqliteFlags.synchronous); s != "" && !has("_synchronous", "_sync") {
+		switch s {
+		default:
+			return "", errors.Errorf("-sqlite-synchronous: invalid value %q", sqliteFlags.synchronous)
+		case "off", "normal", "full", "extra":
+		}
+		add = append(add, "_synchronous="+s)
+	}
+	if sqliteFlags.cacheSize != 0 && !has("_cache_size") {
+		add = append(add, "_cache_size="+strconv.Itoa(sqliteFlags.cacheSize))
+	}
+
+	if len(add) == 0 {
+		return connect, nil
+	}
+	if query != "" {
+		add = append([]string{query}, add...)
+	}
+	return path + "?" + strings.Join(add, "&"), nil
+}
+
 func connectDB(connect string, migrate []string, create bool) (*sqlx.DB, error) {
+	if strings.HasPrefix(connect, "mysql://") || strings.HasPrefix(connect, "mariadb://") {
+		return nil, errors.New(`MySQL and MariaDB are not supported; see "goatcounter help database"`)
+	}
 	cfg.PgSQL = strings.HasPrefix(connect, "postgresql://") || strings.HasPrefix(connect, "postgres://")
+	if !cfg.PgSQL {
+		var err error
+		connect, err = sqliteConnect(connect)
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	opts := zdb.ConnectOptions{
 		Connect: connect,
@@ -172,6 +279,23 @@ func connectDB(connect string, migrate []string, create bool) (*sqlx.DB, error)
 	return db, nil
 }
 
+// connectReplica connects to a read-only replica, which must use the same
+// database engine as the main connection.
+func connectReplica(connect string) (*sqlx.DB, error) {
+	pgsql := cfg.PgSQL
+	defer func() { cfg.PgSQL = pgsql }()
+
+	db, err := connectDB(connect, nil, false)
+	if err != nil {
+		return nil, errors.Errorf("-db-replica: %w", err)
+	}
+	if cfg.PgSQL != pgsql {
+		db.Close()
+		return nil, errors.New("-db-replica: must use the same database engine as -db")
+	}
+	return db, nil
+}
+
 func getVersion() string {
 	return fmt.Sprintf("version=%s; go=%s; GOOS=%s; GOARCH=%s; race=%t; cgo=%t",
 		version, runtime.Version(), runtime.GOOS, runtime.GOARCH,
@@ -35,6 +35,42 @@ func TestUsageTabs(t *testing.T) {
 	}
 }
 
+func TestSQLiteConnect(t *testing.T) {
+	old := sqliteFlags
+	defer func() { sqliteFlags = old }()
+	sqliteFlags.journal, sqliteFlags.busyTimeout = "wal", 5000
+	sqliteFlags.synchronous, sqliteFlags.cacheSize = "normal", 0
+
+	tests := []struct {
+		in, want string
+	}{
+		{"sqlite://db.sqlite3",
+			"sqlite://db.sqlite3?_journal_mode=wal&_busy_timeout=5000&_synchronous=normal"},
+		{"sqlite://db.sqlite3?cache=shared&_busy_timeout=200&_sync=off",
+			"sqlite://db.sqlite3?cache=shared&_busy_timeout=200&_sync=off&_journal_mode=wal"},
+		{"sqlite://db.sqlite3?_journal_mode=delete&_timeout=1&_synchronous=full",
+			"sqlite://db.sqlite3?_journal_mode=delete&_timeout=1&_synchronous=full"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			have, err := sqliteConnect(tt.in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if have != tt.want {
+				t.Errorf("\nhave: %s\nwant: %s", have, tt.want)
+			}
+		})
+	}
+
+	sqliteFlags.synchronous = "sometimes"
+	_, err := sqliteConnect("sqlite://db.sqlite3")
+	if err == nil || !strings.Contains(err.Error(), "-sqlite-synchronous") {
+		t.Errorf("wrong error: %v", err)
+	}
+}
+
 func tmpdb(t *testing.T) (context.Context, string, func()) {
 	t.Helper()
 
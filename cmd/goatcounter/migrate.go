@@ -5,12 +5,16 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"path/filepath"
+	"sort"
 	"strings"
 
 	"zgo.at/errors"
 	"zgo.at/goatcounter/cfg"
+	"zgo.at/goatcounter/db/migrate/gomig"
 	"zgo.at/goatcounter/pack"
 	"zgo.at/zdb"
 	"zgo.at/zlog"
@@ -23,7 +27,7 @@ Run database migrations and exit.
 Flags:
 
   -db          Database connection: "sqlite://<file>" or "postgres://<connect>"
-               See "goatcounter help db" for detailed documentation. Default:
+               See "goatcounter help database" for detailed documentation. Default:
                sqlite://db/goatcounter.sqlite3?_busy_timeout=200&_journal_mode=wal&cache=shared
 
   -createdb    Create the database if it doesn't exist yet; only for SQLite.
@@ -36,6 +40,14 @@ Positional arguments are names of database migrations, either as just the name
 Use "all" to run all migrations that haven't been run yet, or "show" to only
 display pending migrations.
 
+  -status      Show all migrations and if they've been run, without running
+               anything.
+
+  -dry-run     Print the SQL of the migrations given as positional arguments
+               instead of running them; use "all" to print all pending
+               migrations. Migrations written in Go can't be printed, and are
+               only listed.
+
 Note: you can also use -automigrate flag for the serve command to run migrations
 on startup.
 `
@@ -48,15 +60,33 @@ func migrate() (int, error) {
 	dbConnect := flagDB()
 	debug := flagDebug()
 
-	var createdb bool
+	var createdb, status, dryRun bool
 	CommandLine.BoolVar(&createdb, "createdb", false, "")
-	err := CommandLine.Parse(os.Args[2:])
+	CommandLine.BoolVar(&status, "status", false, "")
+	CommandLine.BoolVar(&dryRun, "dry-run", false, "")
+	err := parseFlags(os.Args[2:])
 	if err != nil {
 		return 1, err
 	}
 
 	zlog.Config.SetDebug(*debug)
 
+	if status || dryRun {
+		if dryRun && len(CommandLine.Args()) == 0 {
+			return 1, errors.New("-dry-run: need a migration or \"all\"")
+		}
+		db, err := connectDB(*dbConnect, nil, createdb)
+		if err != nil {
+			return 2, err
+		}
+		defer db.Close()
+
+		if status {
+			return migrateStatus(db)
+		}
+		return migrateDryRun(db, CommandLine.Args())
+	}
+
 	db, err := connectDB(*dbConnect, CommandLine.Args(), createdb)
 	if err != nil {
 		return 2, err
@@ -80,3 +110,96 @@ func migrate() (int, error) {
 
 	return 0, nil
 }
+
+type migration struct {
+	name string
+	ran  bool
+	sql  []byte // nil for Go migrations.
+}
+
+// listMigrations lists all SQL and Go migrations, sorted by name.
+func listMigrations(db zdb.DB) ([]migration, error) {
+	var (
+		files = map[bool]map[string][]byte{true: pack.MigrationsPgSQL, false: pack.MigrationsSQLite}[cfg.PgSQL]
+		dir   = map[bool]string{true: "db/migrate/pgsql", false: "db/migrate/sqlite"}[cfg.PgSQL]
+	)
+
+	var ran []string
+	err := db.SelectContext(context.Background(), &ran, `select name from version order by name asc`)
+	if err != nil {
+		return nil, errors.Errorf("listMigrations: %w", err)
+	}
+
+	var list []migration
+	for k, v := range files {
+		name := strings.TrimSuffix(strings.TrimPrefix(k, dir+"/"), ".sql")
+		list = append(list, migration{name: name, ran: zstring.Contains(ran, name), sql: v})
+	}
+	for _, name := range gomig.Names() {
+		list = append(list, migration{name: name, ran: zstring.Contains(ran, name)})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].name < list[j].name })
+	return list, nil
+}
+
+func migrateStatus(db zdb.DB) (int, error) {
+	list, err := listMigrations(db)
+	if err != nil {
+		return 2, err
+	}
+
+	var pending int
+	for _, m := range list {
+		st := "ran"
+		if !m.ran {
+			st = "pending"
+			pending++
+		}
+		if m.sql == nil {
+			st += " (Go)"
+		}
+		fmt.Fprintf(stdout, "%-40s %s\n", m.name, st)
+	}
+	fmt.Fprintf(stdout, "\n%d pending migrations\n", pending)
+	return 0, nil
+}
+
+func migrateDryRun(db zdb.DB, names []string) (int, error) {
+	list, err := listMigrations(db)
+	if err != nil {
+		return 2, err
+	}
+
+	for i := range names {
+		names[i] = strings.TrimSuffix(filepath.Base(names[i]), ".sql")
+	}
+
+	all := zstring.Contains(names, "all")
+	var found int
+	for _, m := range list {
+		if all && m.ran {
+			continue
+		}
+		if !all && !zstring.Contains(names, m.name) {
+			continue
+		}
+		found++
+
+		if m.sql == nil {
+			fmt.Fprintf(stdout, "-- %s: Go migration; see db/migrate/gomig\n\n", m.name)
+			continue
+		}
+		fmt.Fprintf(stdout, "-- %s\n%s\n", m.name, strings.TrimSpace(string(m.sql)))
+		if m.ran {
+			fmt.Fprintf(stdout, "-- Note: %s has already been run\n", m.name)
+		}
+		fmt.Fprintln(stdout, "")
+	}
+	if !all && found < len(names) {
+		return 1, errors.Errorf("-dry-run: unknown migration in %s", strings.Join(names, ", "))
+	}
+	if found == 0 {
+		fmt.Fprintln(stdout, "No pending migrations")
+	}
+	return 0, nil
+}
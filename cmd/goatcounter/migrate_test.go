@@ -20,3 +20,34 @@ func TestMigrate(t *testing.T) {
 	}
 	_ = ctx
 }
+
+func TestMigrateStatus(t *testing.T) {
+	_, dbc, clean := tmpdb(t)
+	defer clean()
+
+	out, code := run(t, "", []string{"migrate", "-db", dbc, "-status"})
+	if code != 0 {
+		t.Fatalf("code is %d: %s", code, strings.Join(out, "\n"))
+	}
+	o := strings.Join(out, "\n")
+	if !strings.Contains(o, "2020-08-03-1-shared-memstore") || !strings.HasSuffix(o, "0 pending migrations") {
+		t.Errorf("wrong output:\n%s", o)
+	}
+
+	out, code = run(t, "", []string{"migrate", "-db", dbc, "-dry-run", "2020-08-03-1-shared-memstore"})
+	if code != 0 {
+		t.Fatalf("code is %d: %s", code, strings.Join(out, "\n"))
+	}
+	o = strings.Join(out, "\n")
+	if !strings.Contains(o, "create table shared_hits") || !strings.Contains(o, "already been run") {
+		t.Errorf("wrong output:\n%s", o)
+	}
+
+	out, code = run(t, "", []string{"migrate", "-db", dbc, "-dry-run", "all"})
+	if code != 0 {
+		t.Fatalf("code is %d: %s", code, strings.Join(out, "\n"))
+	}
+	if o := strings.Join(out, "\n"); o != "No pending migrations" {
+		t.Errorf("wrong output:\n%s", o)
+	}
+}
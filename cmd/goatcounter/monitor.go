@@ -20,7 +20,7 @@ log if it's 0.
 Flags:
 
   -db          Database connection: "sqlite://<file>" or "postgres://<connect>"
-               See "goatcounter help db" for detailed documentation. Default:
+               See "goatcounter help database" for detailed documentation. Default:
                sqlite://db/goatcounter.sqlite3?_busy_timeout=200&_journal_mode=wal&cache=shared
 
   -debug       Modules to debug, comma-separated or 'all' for all modules.
@@ -41,7 +41,7 @@ func monitor() (int, error) {
 	period := CommandLine.Int("period", 120, "")
 	once := CommandLine.Bool("once", false, "")
 	site := CommandLine.Int("site", 0, "")
-	err := CommandLine.Parse(os.Args[2:])
+	err := parseFlags(os.Args[2:])
 	if err != nil {
 		return 2, err
 	}
@@ -0,0 +1,122 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+	"zgo.at/errors"
+	"zgo.at/goatcounter"
+	"zgo.at/goatcounter/cfg"
+	"zgo.at/zlog"
+	"zgo.at/zvalidate"
+)
+
+// stopTracing flushes the remaining spans; it's set by flagOtel().
+var stopTracing = func() {}
+
+// flagOtel sends OpenTelemetry traces to the OTLP/HTTP endpoint from -otel.
+func flagOtel(endpoint string, v *zvalidate.Validator) {
+	goatcounter.SetTracer(nil)
+	stopTracing = func() {}
+	if endpoint == "" {
+		return
+	}
+
+	tp, err := newTracerProvider(endpoint)
+	if err != nil {
+		v.Append("-otel", err.Error())
+		return
+	}
+
+	goatcounter.SetTracer(otelTracer{tp.Tracer("zgo.at/goatcounter")})
+	stopTracing = func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		err := tp.Shutdown(ctx)
+		if err != nil {
+			zlog.Module("otel").Error(err)
+		}
+	}
+}
+
+func newTracerProvider(endpoint string) (*sdktrace.TracerProvider, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, errors.Errorf("must be a http:// or https:// URL: %q", endpoint)
+	}
+
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(u.Host)}
+	if u.Scheme == "http" {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	if u.Path != "" && u.Path != "/" {
+		opts = append(opts, otlptracehttp.WithURLPath(u.Path))
+	}
+
+	// Doesn't connect yet, so no need for a timeout.
+	exp, err := otlptracehttp.New(context.Background(), opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL,
+			semconv.ServiceNameKey.String("goatcounter"),
+			semconv.ServiceVersionKey.String(cfg.Version),
+		)),
+	), nil
+}
+
+// otelTracer implements goatcounter.Tracer.
+type otelTracer struct{ t trace.Tracer }
+
+type otelSpan struct{ s trace.Span }
+
+func (t otelTracer) Start(ctx context.Context, name string) (context.Context, goatcounter.Span) {
+	ctx, s := t.t.Start(ctx, name)
+	return ctx, otelSpan{s}
+}
+
+func (s otelSpan) SetAttribute(key string, value interface{}) {
+	var kv attribute.KeyValue
+	switch v := value.(type) {
+	case string:
+		kv = attribute.String(key, v)
+	case int:
+		kv = attribute.Int(key, v)
+	case int64:
+		kv = attribute.Int64(key, v)
+	case bool:
+		kv = attribute.Bool(key, v)
+	case float64:
+		kv = attribute.Float64(key, v)
+	default:
+		kv = attribute.String(key, fmt.Sprintf("%v", v))
+	}
+	s.s.SetAttributes(kv)
+}
+
+func (s otelSpan) End(err error) {
+	if err != nil {
+		s.s.RecordError(err)
+		s.s.SetStatus(codes.Error, err.Error())
+	}
+	s.s.End()
+}
@@ -0,0 +1,70 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package main
+
+import (
+	"net/http"
+
+	"github.com/lucas-clemente/quic-go/http3"
+	"zgo.at/errors"
+	"zgo.at/zhttp"
+	"zgo.at/zlog"
+)
+
+// UDP address for the HTTP/3 listener, from -listen-quic.
+var listenQUIC string
+
+// serveQUIC starts a HTTP/3 server on -listen-quic, if it's set.
+//
+// The HTTP/3 server uses the same handler as srv, and srv.Handler is changed to
+// advertise it with the Alt-Svc header on /count; browsers will use HTTP/3 for
+// subsequent requests.
+func serveQUIC(listenTLS uint8, srv *http.Server) (func(), error) {
+	if listenQUIC == "" {
+		return func() {}, nil
+	}
+	if listenTLS&zhttp.ServeTLS == 0 || srv.TLSConfig == nil {
+		return nil, errors.New("-listen-quic: needs tls in -tls")
+	}
+
+	l := zlog.Module("quic")
+	h3 := &http3.Server{Server: &http.Server{
+		Addr:              listenQUIC,
+		Handler:           srv.Handler,
+		TLSConfig:         srv.TLSConfig,
+		ReadHeaderTimeout: srv.ReadHeaderTimeout,
+		ReadTimeout:       srv.ReadTimeout,
+		WriteTimeout:      srv.WriteTimeout,
+		IdleTimeout:       srv.IdleTimeout,
+	}}
+
+	next := srv.Handler
+	srv.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/count" {
+			err := h3.SetQuicHeaders(w.Header())
+			if err != nil {
+				l.Error(err)
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+
+	go func() {
+		defer zlog.Recover()
+		err := h3.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			l.Error(err)
+		}
+	}()
+
+	l.Printf("serving HTTP/3 on %q", listenQUIC)
+	return func() {
+		// http3.Server has no graceful shutdown yet.
+		err := h3.Close()
+		if err != nil {
+			l.Error(err)
+		}
+	}, nil
+}
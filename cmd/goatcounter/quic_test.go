@@ -0,0 +1,54 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"zgo.at/zhttp"
+)
+
+func TestServeQUIC(t *testing.T) {
+	defer func() { listenQUIC = "" }()
+
+	// Not enabled.
+	srv := &http.Server{Handler: http.NotFoundHandler()}
+	stop, err := serveQUIC(0, srv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop()
+
+	listenQUIC = "127.0.0.1:0"
+	_, err = serveQUIC(0, srv)
+	if err == nil || !strings.Contains(err.Error(), "needs tls") {
+		t.Fatalf("wrong error: %v", err)
+	}
+
+	srv.TLSConfig = &tls.Config{}
+	stop, err = serveQUIC(zhttp.ServeTLS, srv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+
+	for _, tt := range []struct {
+		path string
+		want bool
+	}{
+		{"/count", true},
+		{"/", false},
+	} {
+		rr := httptest.NewRecorder()
+		srv.Handler.ServeHTTP(rr, httptest.NewRequest("GET", tt.path, nil))
+		if have := rr.Header().Get("Alt-Svc") != ""; have != tt.want {
+			t.Errorf("%s: Alt-Svc: %q", tt.path, rr.Header().Get("Alt-Svc"))
+		}
+	}
+}
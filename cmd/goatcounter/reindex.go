@@ -11,7 +11,6 @@ import (
 	"strings"
 	"time"
 
-	"github.com/jmoiron/sqlx"
 	"zgo.at/goatcounter"
 	"zgo.at/goatcounter/cron"
 	"zgo.at/zdb"
@@ -44,7 +43,7 @@ Avoiding race conditions
 Flags:
 
   -db          Database connection: "sqlite://<file>" or "postgres://<connect>"
-               See "goatcounter help db" for detailed documentation. Default:
+               See "goatcounter help database" for detailed documentation. Default:
                sqlite://db/goatcounter.sqlite3?_busy_timeout=200&_journal_mode=wal&cache=shared
 
   -debug       Modules to debug, comma-separated or 'all' for all modules.
@@ -59,11 +58,24 @@ Flags:
                year-month-day in UTC. The default is yesterday.
 
   -table       Which tables to reindex: hit_stats, hit_counts, browser_stats,
-               system_stats, location_stats, ref_counts, size_stats, or all
-               (default).
+               system_stats, location_stats, region_stats, city_stats,
+               language_stats, ref_counts, size_stats, path_transitions,
+               bot_stats, or all (default). hit_stats, hit_counts, and
+               ref_counts are stored per hour in UTC; the other tables per day
+               in the site's timezone.
 
   -site        Only reindex this site ID. Default is to reindex all.
 
+  -first-visit Recompute the first_visit flag on the hits in the period before
+               reindexing, which is used for the unique visitor counts. This
+               is only needed after importing data that overlaps with existing
+               data.
+
+  -canonical   Apply the site's path canonicalization settings (remove query
+               strings, trailing slashes, lowercase) to the existing hits in
+               the period before reindexing. Use with -first-visit to correct
+               the unique visitor counts for paths that are now the same.
+
   -quiet       Don't print progress.
 `
 
@@ -75,9 +87,11 @@ func reindex() (int, error) {
 	table := CommandLine.String("table", "all", "")
 	pause := CommandLine.Int("pause", 0, "")
 	quiet := CommandLine.Bool("quiet", false, "")
+	firstVisit := CommandLine.Bool("first-visit", false, "")
+	canonical := CommandLine.Bool("canonical", false, "")
 	var site int64
 	CommandLine.Int64Var(&site, "site", 0, "")
-	err := CommandLine.Parse(os.Args[2:])
+	err := parseFlags(os.Args[2:])
 	if err != nil {
 		return 1, err
 	}
@@ -89,9 +103,7 @@ func reindex() (int, error) {
 	lastDay := v.Date("-to", *to, "2006-01-02")
 
 	for _, t := range tables {
-		v.Include("-table", t, []string{"hit_stats", "hit_counts",
-			"browser_stats", "system_stats", "location_stats",
-			"ref_counts", "size_stats", "all"})
+		v.Include("-table", t, cron.ReindexTables)
 	}
 	if v.HasErrors() {
 		return 1, v
@@ -127,7 +139,7 @@ func reindex() (int, error) {
 		}
 	}
 	if *to == "" {
-		lastDay = time.Now().UTC().Add(-24 * time.Hour)
+		lastDay = goatcounter.Now().Add(-24 * time.Hour)
 	}
 
 	var sites goatcounter.Sites
@@ -140,7 +152,7 @@ func reindex() (int, error) {
 		if site > 0 && s.ID != site {
 			continue
 		}
-		err := dosite(ctx, s, tables, *pause, firstDay, lastDay, *quiet)
+		err := dosite(ctx, s, tables, *pause, firstDay, lastDay, *quiet, *firstVisit, *canonical)
 		if err != nil {
 			return 1, err
 		}
@@ -152,105 +164,38 @@ func reindex() (int, error) {
 	return 0, nil
 }
 
-func dosite(ctx context.Context, site goatcounter.Site, tables []string, pause int, firstDay, lastDay time.Time, quiet bool) error {
-	db := zdb.MustGet(ctx).(*sqlx.DB)
+func dosite(ctx context.Context, site goatcounter.Site, tables []string, pause int, firstDay, lastDay time.Time, quiet, firstVisit, canonical bool) error {
 	siteID := site.ID
 
 	if firstDay.Before(site.CreatedAt) {
 		firstDay = site.CreatedAt
 	}
 
-	var allpaths []struct {
-		Site int64
-		Path string
-	}
-	err := db.SelectContext(ctx, &allpaths,
-		`select path from hits where site=$1 group by path`, siteID)
-	if err != nil {
-		return err
-	}
-
-	// Insert paths.
-	query := `select * from hits where site=$1 and created_at >= $2 and created_at <= $3`
-
-	var pauses time.Duration
-	if pause > 0 {
-		pauses = time.Duration(pause) * time.Second
-	}
-
-	now := goatcounter.Now()
-	now = time.Date(now.Year(), now.Month(), now.Day(), 23, 59, 59, 0, time.UTC)
-	day := firstDay
-	for {
-		var hits []goatcounter.Hit
-		err := db.SelectContext(ctx, &hits, query, siteID, dayStart(day), dayEnd(day))
+	if canonical {
+		n, err := goatcounter.CanonicalizePaths(goatcounter.WithSite(ctx, &site),
+			firstDay, time.Date(lastDay.Year(), lastDay.Month(), lastDay.Day(), 23, 59, 59, 0, time.UTC))
 		if err != nil {
 			return err
 		}
-
 		if !quiet {
-			fmt.Fprintf(stdout, "\r\x1b[0Ksite %d %s → %d", siteID, day.Format("2006-01-02"), len(hits))
+			fmt.Fprintf(stdout, "site %d: canonicalized the path on %d hits\n", siteID, n)
 		}
+	}
 
-		clearDay(db, tables, day.Format("2006-01-02"), siteID)
-
-		err = cron.ReindexStats(ctx, hits, tables)
+	if firstVisit {
+		n, err := goatcounter.FixFirstVisit(goatcounter.WithSite(ctx, &site), firstDay, lastDay)
 		if err != nil {
 			return err
 		}
-
-		day = day.Add(24 * time.Hour)
-		if day.After(now) || day.After(lastDay) {
-			break
-		}
-
-		if pauses > 0 {
-			time.Sleep(pauses)
+		if !quiet {
+			fmt.Fprintf(stdout, "site %d: corrected first_visit on %d hits\n", siteID, n)
 		}
 	}
 
-	return nil
-}
-
-func clearDay(db *sqlx.DB, tables []string, day string, siteID int64) {
-	ctx := context.Background()
-
-	where := fmt.Sprintf(" where site=%d and day='%s'", siteID, day)
-	for _, t := range tables {
-		switch t {
-		case "hit_stats":
-			db.MustExecContext(ctx, `delete from hit_stats`+where)
-		case "hit_counts":
-			db.MustExecContext(ctx, fmt.Sprintf(
-				`delete from hit_counts where site=%d and cast(hour as varchar) like '%s %%'`,
-				siteID, day))
-		case "browser_stats":
-			db.MustExecContext(ctx, `delete from browser_stats`+where)
-		case "system_stats":
-			db.MustExecContext(ctx, `delete from system_stats`+where)
-		case "location_stats":
-			db.MustExecContext(ctx, `delete from location_stats`+where)
-		case "ref_counts":
-			db.MustExecContext(ctx, fmt.Sprintf(
-				`delete from ref_counts where site=%d and cast(hour as varchar) like '%s %%'`,
-				siteID, day))
-		case "size_stats":
-			db.MustExecContext(ctx, `delete from size_stats`+where)
-		case "all":
-			db.MustExecContext(ctx, `delete from hit_stats`+where)
-			db.MustExecContext(ctx, `delete from browser_stats`+where)
-			db.MustExecContext(ctx, `delete from system_stats`+where)
-			db.MustExecContext(ctx, `delete from location_stats`+where)
-			db.MustExecContext(ctx, `delete from size_stats`+where)
-			db.MustExecContext(ctx, fmt.Sprintf(
-				`delete from hit_counts where site=%d and cast(hour as varchar) like '%s %%'`,
-				siteID, day))
-			db.MustExecContext(ctx, fmt.Sprintf(
-				`delete from ref_counts where site=%d and cast(hour as varchar) like '%s %%'`,
-				siteID, day))
-		}
-	}
+	return cron.Reindex(ctx, site, firstDay, lastDay, tables, time.Duration(pause)*time.Second,
+		func(day time.Time, n int) {
+			if !quiet {
+				fmt.Fprintf(stdout, "\r\x1b[0Ksite %d %s → %d", siteID, day.Format("2006-01-02"), n)
+			}
+		})
 }
-
-func dayStart(t time.Time) string { return t.Format("2006-01-02") + " 00:00:00" }
-func dayEnd(t time.Time) string   { return t.Format("2006-01-02") + " 23:59:59" }
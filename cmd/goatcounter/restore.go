@@ -0,0 +1,381 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"zgo.at/errors"
+	"zgo.at/goatcounter/cfg"
+	"zgo.at/goatcounter/db/migrate/gomig"
+	"zgo.at/goatcounter/pack"
+	"zgo.at/zdb"
+	"zgo.at/zlog"
+	"zgo.at/zstd/zstring"
+)
+
+const usageRestore = `
+Restore a backup created with "goatcounter backup".
+
+The archive is given as a positional argument. The backup must be of the same
+database engine as -db.
+
+This checks that the backup isn't from a newer version of GoatCounter, restores
+the database and the CSV exports, and runs any migrations that are needed for
+this version.
+
+For SQLite the database file set in -db must not exist, unless -force is used.
+
+For PostgreSQL pg_restore is used, which must be in the PATH. The database set
+in -db must exist and be empty, unless -force is used, in which case all
+existing tables in the backup are dropped first.
+
+The server must not be running while restoring.
+
+Flags:
+
+  -db          Database connection: "sqlite://<file>" or "postgres://<connect>"
+               See "goatcounter help database" for detailed documentation. Default:
+               sqlite://db/goatcounter.sqlite3?_busy_timeout=200&_journal_mode=wal&cache=shared
+
+  -debug       Modules to debug, comma-separated or 'all' for all modules.
+
+  -force       Overwrite the existing database.
+`
+
+func restore() (int, error) {
+	dbConnect := flagDB()
+	debug := flagDebug()
+	force := CommandLine.Bool("force", false, "")
+	err := parseFlags(os.Args[2:])
+	if err != nil {
+		return 1, err
+	}
+
+	zlog.Config.SetDebug(*debug)
+
+	if len(CommandLine.Args()) != 1 {
+		return 1, errors.New("need exactly one archive to restore")
+	}
+
+	tmp, err := ioutil.TempDir("", "goatcounter-restore")
+	if err != nil {
+		return 2, err
+	}
+	defer os.RemoveAll(tmp)
+
+	dump, exports, err := readArchive(CommandLine.Args()[0], tmp)
+	if err != nil {
+		return 1, errors.Errorf("restore: %w", err)
+	}
+
+	pgsql := strings.HasPrefix(*dbConnect, "postgresql://") || strings.HasPrefix(*dbConnect, "postgres://")
+	switch {
+	case dump == "":
+		return 1, errors.New("restore: no database in the archive")
+	case pgsql && filepath.Base(dump) != "goatcounter.pgdump":
+		return 1, errors.New("restore: archive has a SQLite database, but -db is PostgreSQL")
+	case !pgsql && filepath.Base(dump) != "goatcounter.sqlite3":
+		return 1, errors.New("restore: archive has a PostgreSQL database, but -db is SQLite")
+	}
+
+	if pgsql {
+		err = restorePgSQL(*dbConnect, dump, *force)
+	} else {
+		err = restoreSQLite(*dbConnect, dump, *force)
+	}
+	if err != nil {
+		return 2, errors.Errorf("restore: %w", err)
+	}
+
+	db, err := connectDB(*dbConnect, []string{"all"}, false)
+	if err != nil {
+		return 2, errors.Errorf("restore: database restored, but running migrations failed: %w", err)
+	}
+	defer db.Close()
+
+	if len(exports) > 0 {
+		err = restoreExports(zdb.With(context.Background(), db), exports)
+		if err != nil {
+			return 2, errors.Errorf("restore: %w", err)
+		}
+	}
+
+	fmt.Fprintf(stdout, "Restored %q\n", CommandLine.Args()[0])
+	return 0, nil
+}
+
+// readArchive extracts an archive written by backup to dir, returning the path
+// to the database dump and the CSV exports.
+func readArchive(file, dir string) (string, []string, error) {
+	fp, err := os.Open(file)
+	if err != nil {
+		return "", nil, err
+	}
+	defer fp.Close()
+
+	gz, err := gzip.NewReader(fp)
+	if err != nil {
+		return "", nil, fmt.Errorf("%s: %w", file, err)
+	}
+	defer gz.Close()
+
+	var (
+		dump    string
+		exports []string
+		tr      = tar.NewReader(gz)
+	)
+	err = os.Mkdir(filepath.Join(dir, "exports"), 0700)
+	if err != nil {
+		return "", nil, err
+	}
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", nil, fmt.Errorf("%s: %w", file, err)
+		}
+
+		// Only use the base name so nothing gets written outside of dir.
+		var dst string
+		switch {
+		case h.Name == "goatcounter.sqlite3" || h.Name == "goatcounter.pgdump":
+			dst = filepath.Join(dir, h.Name)
+			dump = dst
+		case strings.HasPrefix(h.Name, "exports/") && h.Typeflag == tar.TypeReg:
+			dst = filepath.Join(dir, "exports", filepath.Base(h.Name))
+			exports = append(exports, dst)
+		default:
+			zlog.Printf("restore: skipping unknown file %q in archive", h.Name)
+			continue
+		}
+
+		err = writeFile(dst, tr)
+		if err != nil {
+			return "", nil, err
+		}
+	}
+	return dump, exports, nil
+}
+
+func writeFile(dst string, r io.Reader) error {
+	fp, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(fp, r)
+	if err != nil {
+		fp.Close()
+		return err
+	}
+	return fp.Close()
+}
+
+// Migrations in the "insert into version" in the schema; the files for these
+// have been removed.
+var reSchemaVersion = regexp.MustCompile(`(?m)^\t\('([0-9]{4}-[0-9]{2}-[0-9]{2}-[^']+)'\)`)
+
+// checkMigrations checks that all migrations that were run on the backup are
+// known, which would mean that it was created with a newer version.
+func checkMigrations(ran []string) error {
+	var (
+		files  = map[bool]map[string][]byte{true: pack.MigrationsPgSQL, false: pack.MigrationsSQLite}[cfg.PgSQL]
+		schema = map[bool][]byte{true: pack.SchemaPgSQL, false: pack.SchemaSQLite}[cfg.PgSQL]
+		dir    = map[bool]string{true: "db/migrate/pgsql", false: "db/migrate/sqlite"}[cfg.PgSQL]
+		known  = gomig.Names()
+	)
+	for k := range files {
+		known = append(known, strings.TrimSuffix(strings.TrimPrefix(k, dir+"/"), ".sql"))
+	}
+	for _, m := range reSchemaVersion.FindAllSubmatch(schema, -1) {
+		known = append(known, string(m[1]))
+	}
+
+	if d := zstring.Difference(ran, known); len(d) > 0 {
+		return errors.Errorf(
+			"backup is from a newer version of GoatCounter (%s is %s); unknown migrations:\n\t%s",
+			os.Args[0], version, strings.Join(d, "\n\t"))
+	}
+	return nil
+}
+
+// restoreSQLite checks the database in the backup and copies it to the file in
+// the connection string.
+func restoreSQLite(connect, dump string, force bool) error {
+	file := strings.TrimPrefix(connect, "sqlite://")
+	if i := strings.IndexByte(file, '?'); i > -1 {
+		file = file[:i]
+	}
+	if _, err := os.Stat(file); err == nil && !force {
+		return errors.Errorf("%q already exists; use -force to overwrite it", file)
+	}
+
+	db, err := connectDB("sqlite://"+dump, nil, false)
+	if err != nil {
+		return err
+	}
+	var ran []string
+	err = db.SelectContext(context.Background(), &ran, `select name from version`)
+	db.Close()
+	if err != nil {
+		return fmt.Errorf("reading version from backup: %w", err)
+	}
+	if err := checkMigrations(ran); err != nil {
+		return err
+	}
+
+	// Don't leave the WAL or journal of the old database around.
+	for _, f := range []string{file + "-wal", file + "-shm", file + "-journal"} {
+		err := os.Remove(f)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	src, err := os.Open(dump)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	return writeFile(file, src)
+}
+
+// restorePgSQL checks the database in the backup and runs pg_restore.
+func restorePgSQL(connect, dump string, force bool) error {
+	dbname := connect
+	for _, p := range []string{"postgresql://", "postgres://"} {
+		if c := strings.TrimPrefix(connect, p); c != connect && reKeyValue.MatchString(c) {
+			dbname = c
+			break
+		}
+	}
+
+	// Get the data from the version table as a COPY statement.
+	out, err := exec.Command("pg_restore", "--data-only", "--table=version", "--file=-", dump).Output()
+	if err != nil {
+		return fmt.Errorf("pg_restore: %w", err)
+	}
+	var (
+		ran    []string
+		inCopy bool
+		scan   = bufio.NewScanner(bytes.NewReader(out))
+	)
+	for scan.Scan() {
+		l := scan.Text()
+		switch {
+		case strings.HasPrefix(l, "COPY "):
+			inCopy = true
+		case l == `\.`:
+			inCopy = false
+		case inCopy:
+			ran = append(ran, l)
+		}
+	}
+	cfg.PgSQL = true
+	if err := checkMigrations(ran); err != nil {
+		return err
+	}
+
+	if !force {
+		db, err := connectDB(connect, nil, false)
+		if err != nil {
+			return err
+		}
+		var n int
+		err = db.GetContext(context.Background(), &n,
+			`select count(*) from information_schema.tables where table_schema=current_schema()`)
+		db.Close()
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			return errors.New("the database isn't empty; use -force to overwrite it")
+		}
+	}
+
+	args := []string{"--no-owner", "--exit-on-error", "--dbname=" + dbname}
+	if force {
+		args = append(args, "--clean", "--if-exists")
+	}
+	cmd := exec.Command("pg_restore", append(args, dump)...)
+	cmd.Stderr = stderr
+	err = cmd.Run()
+	if err != nil {
+		return fmt.Errorf("pg_restore: %w", err)
+	}
+	return nil
+}
+
+// restoreExports copies the CSV exports to the export directory, for the
+// exports in the exports table.
+//
+// The paths in the exports table come from the archive, so only the file name
+// is used; the export is always written to the export directory and the path
+// in the table is updated to match.
+func restoreExports(ctx context.Context, files []string) error {
+	var (
+		db    = zdb.MustGet(ctx)
+		paths []string
+	)
+	err := db.SelectContext(ctx, &paths, `select path from exports`)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		var stored string
+		for _, p := range paths {
+			if filepath.Base(p) == filepath.Base(f) {
+				stored = p
+				break
+			}
+		}
+		if stored == "" {
+			zlog.Printf("restore: no export for %q in the database; skipping", filepath.Base(f))
+			continue
+		}
+
+		name := filepath.Base(stored)
+		if filepath.IsAbs(name) || strings.Contains(name, "..") || !strings.HasPrefix(name, "goatcounter-export-") {
+			zlog.Printf("restore: invalid export path %q in the database; skipping", stored)
+			continue
+		}
+		dst := filepath.Join(os.TempDir(), name)
+
+		err := func() error {
+			src, err := os.Open(f)
+			if err != nil {
+				return err
+			}
+			defer src.Close()
+			return writeFile(dst, src)
+		}()
+		if err != nil {
+			return fmt.Errorf("restoring export: %w", err)
+		}
+
+		if dst != stored {
+			_, err = db.ExecContext(ctx, `update exports set path=$1 where path=$2`, dst, stored)
+			if err != nil {
+				return fmt.Errorf("restoring export: %w", err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"zgo.at/goatcounter"
+	"zgo.at/goatcounter/cfg"
+	"zgo.at/goatcounter/gctest"
+)
+
+func TestRestore(t *testing.T) {
+	if cfg.PgSQL {
+		t.Skip("needs pg_dump")
+	}
+
+	ctx, dbc, clean := tmpdb(t)
+	defer clean()
+	gctest.Site(ctx, t, goatcounter.Site{})
+
+	dir, err := ioutil.TempDir("", "goatcounter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	archive := filepath.Join(dir, "backup.tar.gz")
+	o, code := run(t, "", []string{"backup", "-db", dbc, "-o", archive})
+	if code != 0 {
+		t.Fatalf("backup: code is %d: %s", code, strings.Join(o, "\n"))
+	}
+
+	restored := "sqlite://" + filepath.Join(dir, "restored.sqlite3")
+	o, code = run(t, "", []string{"restore", "-db", restored, archive})
+	if code != 0 {
+		t.Fatalf("restore: code is %d: %s", code, strings.Join(o, "\n"))
+	}
+
+	db, err := connectDB(restored, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	err = db.GetContext(context.Background(), &n, `select count(*) from sites`)
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n == 0 {
+		t.Error("no sites in restored database")
+	}
+
+	// Don't overwrite without -force.
+	o, code = run(t, "", []string{"restore", "-db", restored, archive})
+	if code != 2 || !strings.Contains(strings.Join(o, "\n"), "-force") {
+		t.Errorf("code is %d: %s", code, strings.Join(o, "\n"))
+	}
+	o, code = run(t, "", []string{"restore", "-db", restored, "-force", archive})
+	if code != 0 {
+		t.Errorf("code is %d: %s", code, strings.Join(o, "\n"))
+	}
+}
+
+func TestCheckMigrations(t *testing.T) {
+	err := checkMigrations([]string{"2020-08-04-1-partition-hits"})
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = checkMigrations([]string{"2020-08-04-1-partition-hits", "2099-01-01-1-future"})
+	if err == nil || !strings.Contains(err.Error(), "2099-01-01-1-future") {
+		t.Errorf("wrong error: %v", err)
+	}
+}
@@ -5,11 +5,17 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"os"
+	"os/signal"
 	"os/user"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/go-chi/chi"
@@ -23,6 +29,7 @@ import (
 	"zgo.at/goatcounter/cron"
 	"zgo.at/goatcounter/handlers"
 	"zgo.at/goatcounter/pack"
+	"zgo.at/goatcounter/statsd"
 	"zgo.at/zdb"
 	"zgo.at/zhttp"
 	"zgo.at/zlog"
@@ -51,17 +58,59 @@ This command is undocumented on purpose. Get in touch if you think you need this
 func flagServeAndSaas(v *zvalidate.Validator) (string, bool, bool, string, string, string, error) {
 	dbConnect := flagDB()
 	debug := flagDebug()
+	config := CommandLine.String("config", "", "")
 
 	var dev bool
 	CommandLine.BoolVar(&dev, "dev", false, "")
 	automigrate := CommandLine.Bool("automigrate", false, "")
 	listen := CommandLine.String("listen", ":443", "")
+	CommandLine.StringVar(&listenQUIC, "listen-quic", "", "")
+	listenModeFlag := CommandLine.String("listen-mode", "0660", "")
 	smtp := CommandLine.String("smtp", blackmail.ConnectWriter, "")
 	tls := CommandLine.String("tls", "", "")
 	errors := CommandLine.String("errors", "", "")
+	logFormat := CommandLine.String("log-format", "text", "")
+	accessLogFile := CommandLine.String("access-log", "", "")
+	accessLogFmt := CommandLine.String("access-log-format", "combined", "")
+	otel := CommandLine.String("otel", "", "")
+	statsdAddr := CommandLine.String("statsd", "", "")
+	statsdPrefix := CommandLine.String("statsd-prefix", "goatcounter.", "")
 	from := CommandLine.String("email-from", "", "")
-
-	err := CommandLine.Parse(os.Args[2:])
+	saltKey := CommandLine.String("salt-key", "db/salt-key", "")
+	ephemeralSalt := CommandLine.Bool("ephemeral-salt", false, "")
+	CommandLine.DurationVar(&goatcounter.SaltRotation, "salt-rotation", goatcounter.SaltRotation, "")
+	CommandLine.BoolVar(&cfg.AnonymizeIP, "anonymize-ip", false, "")
+	CommandLine.BoolVar(&cfg.StripUserAgent, "strip-user-agent", false, "")
+	sharedMemstore := CommandLine.Bool("shared-memstore", false, "")
+	persistInterval := CommandLine.Duration("persist-interval", cron.PersistInterval, "")
+	persistBatch := CommandLine.Int("persist-batch", 0, "")
+	spool := CommandLine.String("spool", "db/spool", "")
+	CommandLine.StringVar(&cron.RefspamURL, "refspam-url", "", "")
+	CommandLine.IntVar(&goatcounter.RollupThreshold, "rollup-threshold", goatcounter.RollupThreshold, "")
+	CommandLine.DurationVar(&shutdownTimeout, "shutdown-timeout", shutdownTimeout, "")
+	geodb := CommandLine.String("geodb", "", "")
+	CommandLine.StringVar(&cron.GeoDBKey, "geodb-key", "", "")
+	CommandLine.StringVar(&cron.GeoDBEdition, "geodb-edition", cron.GeoDBEdition, "")
+	asndb := CommandLine.String("asndb", "", "")
+	ratelimitCount := CommandLine.Int("ratelimit-count", 4, "")
+	acmeDNS := CommandLine.String("acme-dns", "", "")
+	acmeDNSWildcard := CommandLine.String("acme-dns-wildcard", "", "")
+	oidcIssuer := CommandLine.String("oidc-issuer", "", "")
+	oidcClientID := CommandLine.String("oidc-client-id", "", "")
+	oidcClientSecret := CommandLine.String("oidc-client-secret", "", "")
+	dashboardIPs := CommandLine.String("dashboard-ips", "", "")
+	trustedProxies := CommandLine.String("trusted-proxies", "127.0.0.0/8,::1,10.0.0.0/8,172.16.0.0/12,192.168.0.0/16,fc00::/7", "")
+	ldapURL := CommandLine.String("ldap", "", "")
+	ldapBindDN := CommandLine.String("ldap-bind-dn", "", "")
+	ldapBindPassword := CommandLine.String("ldap-bind-password", "", "")
+	ldapBaseDN := CommandLine.String("ldap-base-dn", "", "")
+	ldapFilter := CommandLine.String("ldap-filter", "(&(objectClass=person)(mail=%s))", "")
+	ldapRoles := CommandLine.String("ldap-roles", "", "")
+
+	err := parseFlags(os.Args[2:])
+	if err == nil && *config != "" {
+		err = flagConfig(*config)
+	}
 	zlog.Config.SetDebug(*debug)
 	cfg.Prod = !dev
 	zhttp.LogUnknownFields = dev
@@ -74,16 +123,117 @@ func flagServeAndSaas(v *zvalidate.Validator) (string, bool, bool, string, strin
 		zlog.Config.FmtTime = "Jan _2 15:04:05 "
 	}
 
+	flagLogFormat(*logFormat, v)
 	flagErrors(*errors, v)
+	flagAccessLog(*accessLogFile, *accessLogFmt, v)
+	flagOtel(*otel, v)
+	if *statsdAddr != "" {
+		statsd.Gauge("memstore.queue", func() int64 { return int64(goatcounter.Memstore.Len()) })
+		err := statsd.Setup(*statsdAddr, *statsdPrefix)
+		if err != nil {
+			v.Append("-statsd", err.Error())
+		}
+	}
+	flagSalt(*saltKey, *ephemeralSalt, v)
+	if *sharedMemstore {
+		if *ephemeralSalt {
+			v.Append("-shared-memstore", "can't be used with -ephemeral-salt")
+		}
+		goatcounter.Memstore.SetShared(true)
+	}
+	if goatcounter.SaltRotation < time.Hour || goatcounter.SaltRotation > 24*time.Hour {
+		v.Append("-salt-rotation", "must be between 1h and 24h")
+	}
 
-	if *smtp != blackmail.ConnectDirect && *smtp != blackmail.ConnectWriter {
-		v.URL("-smtp", *smtp)
+	if *persistInterval < time.Second {
+		v.Append("-persist-interval", "must be at least 1s")
+	}
+	cron.PersistInterval = *persistInterval
+	if *persistBatch < 0 {
+		v.Append("-persist-batch", "can't be negative")
+	}
+	goatcounter.Memstore.SetBatch(*persistBatch)
+	if cron.RefspamURL != "" {
+		v.URL("-refspam-url", cron.RefspamURL)
+	}
+	if cron.GeoDBKey != "" {
+		if *geodb == "" {
+			v.Append("-geodb-key", "needs -geodb to store the database")
+		}
+		v.Include("-geodb-edition", cron.GeoDBEdition, []string{"GeoLite2-Country", "GeoLite2-City"})
+		cron.GeoDBFile, cron.GeoDBLoad = *geodb, handlers.SetGeoDB
+	}
+	goatcounter.Memstore.SetSpool(*spool)
+	if shutdownTimeout < 0 {
+		v.Append("-shutdown-timeout", "can't be negative")
+	}
+	bgrun.SetMaxWait(shutdownTimeout)
+	if m, err := strconv.ParseUint(*listenModeFlag, 8, 32); err != nil || m > 0777 {
+		v.Append("-listen-mode", "must be an octal file mode such as 0660")
+	} else {
+		listenMode = os.FileMode(m)
+	}
+	var wildcard []string
+	if *acmeDNSWildcard != "" {
+		if *acmeDNS == "" {
+			v.Append("-acme-dns-wildcard", "needs -acme-dns")
+		}
+		wildcard = strings.Split(*acmeDNSWildcard, ",")
+	}
+	if err := acme.SetDNS(*acmeDNS, wildcard); err != nil {
+		v.Append("-acme-dns", err.Error())
+	}
+	if err := handlers.SetupOIDC(*oidcIssuer, *oidcClientID, *oidcClientSecret); err != nil {
+		v.Append("-oidc-issuer", err.Error())
+	}
+	if err := handlers.SetDashboardIPs(*dashboardIPs); err != nil {
+		v.Append("-dashboard-ips", err.Error())
 	}
-	blackmail.DefaultMailer = blackmail.NewMailer(*smtp)
+	if err := handlers.SetTrustedProxies(*trustedProxies); err != nil {
+		v.Append("-trusted-proxies", err.Error())
+	}
+	if err := handlers.SetupLDAP(*ldapURL, *ldapBindDN, *ldapBindPassword, *ldapBaseDN, *ldapFilter, *ldapRoles); err != nil {
+		v.Append("-ldap", err.Error())
+	}
+	flagReloadable(v, *smtp, *geodb, *asndb, *ratelimitCount)
 
 	return *dbConnect, dev, *automigrate, *listen, *tls, *from, err
 }
 
+// flagReloadable sets the flags that can be changed with SIGHUP; nothing is
+// changed if v has errors.
+func flagReloadable(v *zvalidate.Validator, smtp, geodb, asndb string, ratelimitCount int) {
+	if smtp != blackmail.ConnectDirect && smtp != blackmail.ConnectWriter {
+		v.URL("-smtp", smtp)
+	}
+	if ratelimitCount < 1 {
+		v.Append("-ratelimit-count", "must be at least 1")
+	}
+	if v.HasErrors() {
+		return
+	}
+
+	// The database is downloaded later if it doesn't exist yet; use the
+	// compiled-in one until then.
+	if cron.GeoDBKey != "" {
+		if _, err := os.Stat(geodb); os.IsNotExist(err) {
+			geodb = ""
+		}
+	}
+	err := handlers.SetGeoDB(geodb)
+	if err != nil {
+		v.Append("-geodb", err.Error())
+		return
+	}
+	err = handlers.SetASNDB(asndb)
+	if err != nil {
+		v.Append("-asndb", err.Error())
+		return
+	}
+	blackmail.DefaultMailer = blackmail.NewMailer(smtp)
+	handlers.SetCountRatelimit(ratelimitCount)
+}
+
 func setupReload() {
 	if _, err := os.Stat("./tpl"); os.IsNotExist(err) {
 		return
@@ -99,6 +249,63 @@ func setupReload() {
 	}()
 }
 
+// setupSignals makes SIGTERM shut down the server in the same way as SIGINT,
+// which is what zhttp.Serve waits for; SIGTERM is what systemd, Docker, and
+// Kubernetes send to stop a process. On either signal /readyz reports that the
+// server isn't ready anymore.
+//
+// SIGHUP reloads the configuration; see reloadConfig().
+func setupSignals() func() {
+	var (
+		c    = make(chan os.Signal, 1)
+		done = make(chan struct{})
+	)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	go func() {
+		defer zlog.Recover()
+		for {
+			select {
+			case <-done:
+				return
+			case s := <-c:
+				if s == syscall.SIGHUP {
+					if accessLog != nil {
+						err := accessLog.Reopen()
+						if err != nil {
+							zlog.Errorf("reopen access log: %s", err)
+						}
+					}
+					err := reloadConfig()
+					if err != nil {
+						zlog.Errorf("reload: %s", err)
+					} else {
+						zlog.Print("reloaded configuration")
+					}
+					continue
+				}
+
+				zlog.Printf("received %s; shutting down", s)
+				handlers.ShuttingDown()
+				if s != syscall.SIGTERM {
+					return
+				}
+				p, err := os.FindProcess(os.Getpid())
+				if err == nil {
+					err = p.Signal(os.Interrupt)
+				}
+				if err != nil {
+					zlog.Errorf("setupSignals: %s", err)
+				}
+				return
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(c)
+		close(done)
+	}
+}
+
 func setupCron(db zdb.DB) func() {
 	cron.RunBackground(db)
 	go func() {
@@ -116,6 +323,7 @@ func saas() (int, error) {
 	CommandLine.StringVar(&domain, "domain", "goatcounter.localhost:8081,static.goatcounter.localhost:8081", "")
 	CommandLine.StringVar(&stripe, "stripe", "", "")
 	CommandLine.StringVar(&plan, "plan", goatcounter.PlanPersonal, "")
+	dbReplica := CommandLine.String("db-replica", "", "")
 	dbConnect, dev, automigrate, listen, tls, from, err := flagServeAndSaas(&v)
 	if err != nil {
 		return 1, err
@@ -149,6 +357,16 @@ func saas() (int, error) {
 	}
 	defer db.Close()
 
+	var replica zdb.DB
+	if *dbReplica != "" {
+		r, err := connectReplica(*dbReplica)
+		if err != nil {
+			return 2, err
+		}
+		defer r.Close()
+		replica = r
+	}
+
 	zhttp.InitTpl(pack.Templates)
 	tlsc, acmeh, listenTLS := acme.Setup(db, tls)
 
@@ -159,9 +377,12 @@ func saas() (int, error) {
 
 	cronWait := setupCron(db)
 	defer func() {
+		// Sessions and remaining hits are stored after the final
+		// Persist() in cronWait().
+		defer goatcounter.Memstore.StoreSessions(db)
+		defer goatcounter.Memstore.StoreHits()
 		defer cronWait()
 		defer bgrun.WaitAndLog()
-		defer goatcounter.Memstore.StoreSessions(db)
 		zlog.Print("Waiting for background tasks to finish…")
 	}()
 
@@ -170,16 +391,19 @@ func saas() (int, error) {
 	hosts := map[string]http.Handler{
 		d:          zhttp.RedirectHost("//www." + cfg.Domain),
 		"www." + d: handlers.NewWebsite(db),
-		"*":        handlers.NewBackend(db, acmeh),
+		"*":        handlers.NewBackend(db, replica, acmeh),
 	}
 	if dev {
 		hosts[zhttp.RemovePort(cfg.DomainStatic)] = handlers.NewStatic(chi.NewRouter(), "./public", !dev)
 	}
 
+	defer statsd.Stop()
+	defer stopTracing()
+	defer setupSignals()()
 	zlog.Module("main").Debug(getVersion())
-	zhttp.Serve(listenTLS, &http.Server{
+	err = serveHTTP(listenTLS, &http.Server{
 		Addr:      listen,
-		Handler:   zhttp.HostRoute(hosts),
+		Handler:   withAccessLog(handlers.Health(db, zhttp.HostRoute(hosts))),
 		TLSConfig: tlsc,
 
 		// Set some reasonably high timeouts which should never be reached.
@@ -191,6 +415,9 @@ func saas() (int, error) {
 	}, func() {
 		zlog.Printf("serving %q on %q; dev=%t", cfg.Domain, listen, dev)
 	})
+	if err != nil {
+		return 2, err
+	}
 	return 0, nil
 }
 
@@ -209,6 +436,31 @@ func banner() {
 `)
 }
 
+func flagSalt(keyFile string, ephemeral bool, v *zvalidate.Validator) {
+	if ephemeral {
+		goatcounter.Memstore.SetEphemeralSalt()
+		return
+	}
+
+	key, err := ioutil.ReadFile(keyFile)
+	if os.IsNotExist(err) {
+		key = []byte(zhttp.Secret256())
+		err = os.MkdirAll(filepath.Dir(keyFile), 0700)
+		if err == nil {
+			err = ioutil.WriteFile(keyFile, key, 0600)
+		}
+	}
+	if err != nil {
+		v.Append("-salt-key", err.Error())
+		return
+	}
+	if len(bytes.TrimSpace(key)) == 0 {
+		v.Append("-salt-key", fmt.Sprintf("%q is empty", keyFile))
+		return
+	}
+	goatcounter.Memstore.SetSaltKey(bytes.TrimSpace(key))
+}
+
 func flagErrors(errors string, v *zvalidate.Validator) {
 	switch {
 	default:
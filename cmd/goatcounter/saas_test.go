@@ -25,6 +25,7 @@ func TestSaas(t *testing.T) {
 		"-listen", "localhost:31874",
 		"-tls", "none",
 		"-stripe", "sk_test_x:pk_test_x:whsec_x",
+		"-ephemeral-salt",
 		"-db", dbc})
 	if code != 0 {
 		t.Fatalf("code is %d: %s", code, strings.Join(out, "\n"))
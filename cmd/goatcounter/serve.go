@@ -17,6 +17,7 @@ import (
 	"zgo.at/goatcounter/cfg"
 	"zgo.at/goatcounter/handlers"
 	"zgo.at/goatcounter/pack"
+	"zgo.at/goatcounter/statsd"
 	"zgo.at/zdb"
 	"zgo.at/zhttp"
 	"zgo.at/zlog"
@@ -33,14 +34,36 @@ Static files and templates are compiled in the binary and aren't needed to run
 GoatCounter. But they're loaded from the filesystem if GoatCounter is started
 with -dev.
 
+On SIGHUP the .pem certificates from -tls and the -geodb and -asndb databases
+are reloaded, the -access-log file is reopened, and the -smtp, -geodb, -asndb,
+and -ratelimit-count values are read again from the -config file. Other changes need a restart.
+
 Flags:
 
+  -config      Load the flags from a TOML file. Every key is a flag name
+               without the leading -, for example:
+
+                 db     = "postgresql://dbname=goatcounter"
+                 listen = ":8080"
+                 tls    = ["acme", "tls", "rdr"]
+
+               Lists are joined with commas. Flags given on the command line or
+               as environment variables override the values in the file.
+
   -db          Database connection: "sqlite://<file>" or "postgres://<connect>"
-               See "goatcounter help db" for detailed documentation. Default:
+               See "goatcounter help database" for detailed documentation. Default:
                sqlite://db/goatcounter.sqlite3?_busy_timeout=200&_journal_mode=wal&cache=shared
 
   -listen      Address to listen on. Default: "*:443", or "localhost:8081" with
-               -dev. See "goatcounter help listen" for detailed documentation.
+               -dev. Use "unix:/path/to/socket" to listen on a unix socket.
+               See "goatcounter help listen" for detailed documentation.
+
+  -listen-mode Permissions for the -listen unix socket, in octal. Default: 0660
+
+  -listen-quic UDP address to serve HTTP/3 (QUIC) on, for example ":443". This
+               needs "tls" in -tls. Responses for /count get an Alt-Svc header
+               so that browsers send the next pageviews over HTTP/3, which has
+               less handshake latency on mobile connections. Default: not set.
 
   -tls         Serve over tls. This is a comma-separated list with any of:
 
@@ -53,6 +76,21 @@ Flags:
                Default: "acme,tls,rdr", or "none" when -dev is given.
                See "goatcounter help listen" for more detailed documentation.
 
+  -acme-dns    Use the ACME DNS-01 challenge instead of HTTP-01 and
+               TLS-ALPN-01, with the given DNS provider as "name:arg". This
+               doesn't need GoatCounter to be reachable from the internet.
+
+                 exec:/path/to/prog     Run "prog present <fqdn> <value>" to
+                                        create the TXT record, and "prog
+                                        cleanup <fqdn> <value>" to remove it.
+
+               Default: not set.
+
+  -acme-dns-wildcard
+               Comma-separated list of domains to get a wildcard certificate
+               for with -acme-dns; for example with "example.com" all
+               subdomains use a "*.example.com" certificate. Default: not set.
+
   -port        Port your site is publicly accessible on. Only needed if it's
                not 80 or 443.
 
@@ -80,11 +118,212 @@ Flags:
                                              use the same as the to_addr.
                Default: not set.
 
+  -log-format  Format for log messages: "text" or "json". With "json" every
+               message is written as one JSON object per line, with the keys
+               time, level, modules, msg, error, and data. Default: text
+
+  -access-log  Write an access log with every request to this file; use "-" for
+               stdout. The file is reopened on SIGHUP, for log rotation. IP
+               addresses are anonymized if -anonymize-ip or the site's setting
+               is set, and tokens in the query string such as access_token are
+               replaced with REDACTED. Default: not set.
+
+  -access-log-format
+               Format for -access-log: "common" or "combined" for the NCSA
+               Common or Combined Log Format, or "json" for one JSON object
+               per line. Default: combined
+
+  -otel        Send OpenTelemetry traces to this OTLP/HTTP endpoint, for
+               example "http://localhost:4318". This traces HTTP requests,
+               Memstore.Persist, the cron tasks, and the dashboard queries.
+               Default: not set.
+
+  -statsd      Send metrics to this StatsD server over UDP, as "host:port".
+               Counters and gauges are sent every 10 seconds:
+
+                 count.accepted    Pageviews accepted on /count
+                 count.bot         Pageviews from bots
+                 count.rejected    Invalid requests to /count
+                 count.ignored     Pageviews from the site's ignored IPs
+                 persist.hits      Pageviews written to the database
+                 persist.duration  Time to persist the pageviews (timer)
+                 memstore.queue    Pageviews waiting to be persisted (gauge)
+
+               Default: not set.
+
+  -statsd-prefix
+               Prefix for all StatsD metric names. Default: "goatcounter."
+
+  -oidc-issuer
+               Allow signing in to the dashboard with this OpenID Connect
+               provider, for example "https://accounts.google.com". The
+               provider's verified email address must match the site's user;
+               if a site has no user yet it's created on the first sign in.
+               The user's two-factor auth is still asked if enabled. Set the
+               redirect URL in the provider to https://[site]/user/oidc/callback
+               Default: not set.
+
+  -oidc-client-id, -oidc-client-secret
+               Client ID and secret for -oidc-issuer.
+
+  -dashboard-ips
+               Only allow access to the dashboard from these IP addresses or
+               CIDR ranges, as a comma-separated list; for example
+               "10.0.0.0/8,192.0.2.1". This applies to all sites, and sites can
+               restrict it further in their settings. The /count endpoint is
+               not affected. Default: not set.
+
+  -trusted-proxies
+               Use the X-Real-Ip or X-Forwarded-For header for the client's IP
+               address only if the connection is from one of these IP addresses
+               or CIDR ranges, as a comma-separated list. Anyone can set these
+               headers, so don't add addresses that aren't your own proxy; set
+               to "" if GoatCounter isn't behind a proxy. Default: loopback and
+               private addresses (127.0.0.0/8,::1,10.0.0.0/8,172.16.0.0/12,
+               192.168.0.0/16,fc00::/7).
+
+  -ldap        Verify dashboard logins with this LDAP or Active Directory
+               server instead of the password stored in GoatCounter, for
+               example "ldaps://ldap.example.com". ldap:// URLs use StartTLS,
+               and unencrypted connections aren't supported. The email address
+               from the directory must match the site's user; if a site has no
+               user yet it's created on the first sign in. MFA still applies if
+               it's enabled. Default: not set.
+
+  -ldap-bind-dn, -ldap-bind-password
+               Account to look up users with; the lookup is anonymous if this
+               isn't set.
+
+  -ldap-base-dn
+               Base DN to look up users in, for example
+               "ou=people,dc=example,dc=com". Required with -ldap.
+
+  -ldap-filter
+               Filter to find the user; %s is replaced with what was entered
+               in the email field. Use "(sAMAccountName=%s)" to sign in with an
+               Active Directory username.
+               Default: "(&(objectClass=person)(mail=%s))"
+
+  -ldap-roles  Map LDAP groups to roles as "group DN=role name", separated by
+               ";". The user must be a member of one of the groups, and gets
+               the role of the first group that matches; an empty role name
+               gives all permissions. The role is updated on every login,
+               except when it would remove the settings permission from the
+               last user who has it.
+               Default: not set, which allows all users found by -ldap-filter
+               and doesn't change their role.
+
+  -salt-key    File with the key to encrypt the session salts with; the salts
+               are stored in the database so that restarting doesn't start a
+               new session for every visitor. The file is created with a random
+               key if it doesn't exist. Default: db/salt-key
+
+  -db-replica  Read-only database connection for the dashboard, statistics API,
+               and exports, such as a PostgreSQL streaming replica. This needs
+               to use the same engine as -db. Everything else uses -db. The
+               statistics may lag behind a bit, depending on the replication.
+               Default: not set.
+
+  -ephemeral-salt
+               Never store the session salts; every restart will start new
+               sessions, which may inflate the visitor counts a bit.
+
+  -salt-rotation
+               How often to replace the session salt, between "1h" and "24h".
+               A shorter period makes it harder to link the pageviews of a
+               visitor, but visitors who return after this time are more likely
+               to be counted as a new visit. The time of the last rotation is
+               stored with the salts, so restarting doesn't reset it.
+               Default: 4h
+
+  -anonymize-ip
+               Remove the last part of visitors' IP addresses (/24 for IPv4,
+               /48 for IPv6) for all sites, before they're used to look up the
+               location or for the session hashes. The full address is only
+               used during the request, and isn't written to the -access-log.
+               Sites can also enable this in their settings.
+
+  -strip-user-agent
+               Only store the browser and system name and version for all
+               sites, instead of the full User-Agent header. Sites can also
+               enable this in their settings.
+
+  -shared-memstore
+               Keep the pageviews that haven't been persisted yet and the
+               sessions in the database instead of in memory, so that several
+               instances behind a load balancer can share them. All instances
+               need to use the same database and the same -salt-key. This is a
+               bit slower, so only use it if you run more than one instance.
+               The live view and /api/v0/stats/stream only show the pageviews
+               persisted by the instance that serves the request.
+
+  -persist-interval
+               How often to write the pageviews to the database, as a duration
+               such as "5s" or "1m". Pageviews that haven't been written yet
+               are lost if GoatCounter crashes, so a shorter interval loses
+               less data; a longer interval writes bigger batches, which is
+               more efficient on busy sites. Default: 10s
+
+  -persist-batch
+               Maximum number of pageviews to write in one batch; the rest are
+               written in the next interval. Default: 0 (no limit).
+
+  -spool       File to write the pageviews to if the database is unavailable;
+               they're written to the database once it's available again.
+               Use an empty string to keep them in memory, in which case they
+               are lost on restart. Default: db/spool
+
+  -refspam-url
+               URL to download a referrer spam list from once a day, with one
+               domain per line, which is used in addition to the list that's
+               included in GoatCounter. Pageviews with a referrer from these
+               domains or their subdomains aren't counted. For example:
+               https://raw.githubusercontent.com/matomo-org/referrer-spam-blacklist/master/spammers.txt
+               Default: not set, which only uses the included list.
+
+  -rollup-threshold
+               Keep the pageview counts summed per day and month for sites with
+               more than this many pageviews in the last 30 days, which makes
+               the dashboard faster for long date ranges. Use 0 to disable.
+               Default: 500000
+
+  -geodb       GeoIP2 or GeoLite2 Country, City, or Enterprise database to use
+               instead of the compiled-in one; this can also be a commercial or
+               self-built database in the same format. A City or Enterprise
+               database is needed for sites that enabled "Record regions and
+               cities". The file is loaded again on SIGHUP. Default: not set.
+
+  -geodb-key   MaxMind license key to download the GeoLite2 database to the
+               -geodb file, and update it every few days. The compiled-in
+               database is used until the first download. You can get a key
+               with a free MaxMind account. Default: not set.
+
+  -geodb-edition
+               GeoLite2 database to download with -geodb-key: GeoLite2-Country
+               or GeoLite2-City. Default: GeoLite2-Country.
+
+  -asndb       GeoLite2 ASN database, to find pageviews from the networks of
+               cloud and hosting providers for sites that enabled "Treat
+               datacenter traffic as bots". Default: not set.
+
+  -ratelimit-count
+               Number of pageviews per second a client can send. Default: 4
+
+  -shutdown-timeout
+               How long to wait for open connections and background tasks such
+               as sending emails to finish on shutdown. The pageviews in memory
+               are always written to the database (or the -spool file) after
+               this. Default: 10s
+
   -static      Serve static files from a different domain, such as a CDN or
                cookieless domain. Default: not set.
 
   -dev         Start in "dev mode".
 
+  -check-config
+               Check the configuration and exit instead of starting the server;
+               see "goatcounter help doctor".
+
   -debug       Modules to debug, comma-separated or 'all' for all modules.
 
 Environment:
@@ -99,6 +338,8 @@ func serve() (int, error) {
 
 	CommandLine.StringVar(&cfg.Port, "port", "", "")
 	CommandLine.StringVar(&cfg.DomainStatic, "static", "", "")
+	CommandLine.BoolVar(&checkOnly, "check-config", checkOnly, "")
+	dbReplica := CommandLine.String("db-replica", "", "")
 	dbConnect, dev, automigrate, listen, tls, from, err := flagServeAndSaas(&v)
 	if err != nil {
 		return 1, err
@@ -124,6 +365,10 @@ func serve() (int, error) {
 	}
 
 	flagFrom(from, &v)
+	if checkOnly {
+		return checkConfig(&v, dbConnect, listen, tls, CommandLine.Lookup("smtp").Value.String(),
+			CommandLine.Lookup("geodb").Value.String(), automigrate), nil
+	}
 	if v.HasErrors() {
 		return 1, v
 	}
@@ -139,6 +384,16 @@ func serve() (int, error) {
 	}
 	defer db.Close()
 
+	var replica zdb.DB
+	if *dbReplica != "" {
+		r, err := connectReplica(*dbReplica)
+		if err != nil {
+			return 2, err
+		}
+		defer r.Close()
+		replica = r
+	}
+
 	zhttp.InitTpl(pack.Templates)
 	tlsc, acmeh, listenTLS := acme.Setup(db, tls)
 
@@ -149,15 +404,18 @@ func serve() (int, error) {
 
 	cronWait := setupCron(db)
 	defer func() {
+		// Sessions and remaining hits are stored after the final
+		// Persist() in cronWait().
+		defer goatcounter.Memstore.StoreSessions(db)
+		defer goatcounter.Memstore.StoreHits()
 		defer cronWait()
 		defer bgrun.WaitAndLog()
-		defer goatcounter.Memstore.StoreSessions(db)
 		zlog.Print("Waiting for background tasks to finish…")
 	}()
 
 	// Set up HTTP handler and servers.
 	hosts := map[string]http.Handler{
-		"*": handlers.NewBackend(db, acmeh),
+		"*": handlers.NewBackend(db, replica, acmeh),
 	}
 	if cfg.DomainStatic != "" {
 		// May not be needed, but just in case the DomainStatic isn't an
@@ -170,10 +428,13 @@ func serve() (int, error) {
 		return 2, err
 	}
 
+	defer statsd.Stop()
+	defer stopTracing()
+	defer setupSignals()()
 	zlog.Module("main").Debug(getVersion())
-	zhttp.Serve(listenTLS, &http.Server{
+	err = serveHTTP(listenTLS, &http.Server{
 		Addr:      listen,
-		Handler:   zhttp.HostRoute(hosts),
+		Handler:   withAccessLog(handlers.Health(db, zhttp.HostRoute(hosts))),
 		TLSConfig: tlsc,
 
 		// Set some reasonably high timeouts which should never be reached.
@@ -191,6 +452,9 @@ func serve() (int, error) {
 			zlog.Errorf("No sites yet; create a new site with:\n    goatcounter create -domain [..] -email [..]")
 		}
 	})
+	if err != nil {
+		return 2, err
+	}
 	return 0, nil
 }
 
@@ -5,6 +5,9 @@
 package main
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"runtime"
 	"strings"
 	"testing"
@@ -20,12 +23,23 @@ func TestServe(t *testing.T) {
 	ctx, dbc, clean := tmpdb(t)
 	defer clean()
 
+	tmp, err := ioutil.TempDir("", "goatcounter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	keyFile := filepath.Join(tmp, "salt-key")
+
 	out, code := run(t, "serving", []string{"serve",
 		"-listen", "localhost:31874",
 		"-tls", "none",
+		"-salt-key", keyFile,
 		"-db", dbc})
 	if code != 0 {
 		t.Fatalf("code is %d: %s", code, strings.Join(out, "\n"))
 	}
+	if _, err := os.Stat(keyFile); err != nil {
+		t.Errorf("salt key not created: %s", err)
+	}
 	_ = ctx
 }
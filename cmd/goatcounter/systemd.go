@@ -0,0 +1,140 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/goatcounter/cfg"
+	"zgo.at/zhttp"
+	"zgo.at/zlog"
+)
+
+// shutdownTimeout is how long to wait for open connections to finish on
+// shutdown; set with -shutdown-timeout.
+var shutdownTimeout = 10 * time.Second
+
+// systemdListeners gets the sockets passed with systemd socket activation, or
+// nil if there are none.
+//
+// See sd_listen_fds(3); the sockets start at file descriptor 3.
+func systemdListeners() ([]net.Listener, error) {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, errors.Errorf("systemd: invalid LISTEN_FDS: %q", os.Getenv("LISTEN_FDS"))
+	}
+
+	// Don't pass them on to child processes.
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	ls := make([]net.Listener, 0, n)
+	for fd := 3; fd < 3+n; fd++ {
+		f := os.NewFile(uintptr(fd), "systemd-socket-"+strconv.Itoa(fd))
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, l := range ls {
+				l.Close()
+			}
+			return nil, errors.Errorf("systemd: socket %d: %w", fd, err)
+		}
+		ls = append(ls, l)
+	}
+	return ls, nil
+}
+
+// serveHTTP serves srv on the sockets passed with systemd socket activation, on
+// the unix socket if srv.Addr is "unix:/path", or with zhttp.Serve() on srv.Addr
+// otherwise. The HTTP/3 server from -listen-quic is started as well.
+//
+// The first socket is used for the server; if the -tls flag has "rdr" then the
+// second socket is used to redirect to HTTPS.
+func serveHTTP(listenTLS uint8, srv *http.Server, ready func()) error {
+	stopQUIC, err := serveQUIC(listenTLS, srv)
+	if err != nil {
+		return err
+	}
+	defer stopQUIC()
+
+	ls, err := systemdListeners()
+	if err != nil {
+		return err
+	}
+	if ls == nil && strings.HasPrefix(srv.Addr, "unix:") {
+		ul, err := listenUnix(strings.TrimPrefix(srv.Addr, "unix:"))
+		if err != nil {
+			return err
+		}
+		ls = []net.Listener{ul}
+	}
+	if ls == nil {
+		zhttp.Serve(listenTLS, srv, ready)
+		return nil
+	}
+
+	l := zlog.Module("listen")
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt)
+	defer signal.Stop(stop)
+
+	go func() {
+		defer zlog.Recover()
+		var err error
+		if listenTLS&zhttp.ServeTLS != 0 {
+			err = srv.ServeTLS(ls[0], "", "")
+		} else {
+			err = srv.Serve(ls[0])
+		}
+		if err != nil && err != http.ErrServerClosed {
+			l.Error(err)
+			stop <- os.Interrupt
+		}
+	}()
+
+	var rdr *http.Server
+	if listenTLS&zhttp.ServeRedirect != 0 {
+		if len(ls) < 2 {
+			l.Print(`no second socket for "rdr" in -tls; not redirecting to HTTPS`)
+		} else {
+			rdr = &http.Server{
+				ReadHeaderTimeout: 10 * time.Second,
+				Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					http.Redirect(w, r, "https://"+zhttp.RemovePort(r.Host)+cfg.Port+r.URL.RequestURI(), 301)
+				}),
+			}
+			go func() {
+				defer zlog.Recover()
+				err := rdr.Serve(ls[1])
+				if err != nil && err != http.ErrServerClosed {
+					l.Error(err)
+				}
+			}()
+		}
+	}
+
+	l.Printf("serving on %d sockets: %s", len(ls), ls[0].Addr())
+	ready()
+	<-stop
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if rdr != nil {
+		rdr.Shutdown(ctx)
+	}
+	return srv.Shutdown(ctx)
+}
@@ -0,0 +1,32 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestSystemdListeners(t *testing.T) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+
+	// Not for this process.
+	os.Setenv("LISTEN_PID", "1")
+	os.Setenv("LISTEN_FDS", "1")
+	ls, err := systemdListeners()
+	if err != nil || ls != nil {
+		t.Fatalf("ls=%v; err=%v", ls, err)
+	}
+
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	os.Setenv("LISTEN_FDS", "x")
+	_, err = systemdListeners()
+	if err == nil || !strings.Contains(err.Error(), "LISTEN_FDS") {
+		t.Fatalf("wrong error: %v", err)
+	}
+}
@@ -0,0 +1,12 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+//go:build !windows
+// +build !windows
+
+package main
+
+import "syscall"
+
+func umask(m int) int { return syscall.Umask(m) }
@@ -0,0 +1,8 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package main
+
+// Windows has no umask; unix sockets get the permissions of the directory.
+func umask(m int) int { return 0 }
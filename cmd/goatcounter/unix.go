@@ -0,0 +1,51 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package main
+
+import (
+	"net"
+	"os"
+
+	"zgo.at/errors"
+)
+
+// Permissions for the unix socket, from -listen-mode.
+var listenMode os.FileMode = 0660
+
+// listenUnix listens on the unix socket at path, removing any stale socket left
+// from a previous run first.
+func listenUnix(path string) (net.Listener, error) {
+	if path == "" {
+		return nil, errors.New("listenUnix: empty path")
+	}
+
+	st, err := os.Lstat(path)
+	switch {
+	case err == nil && st.Mode()&os.ModeSocket == 0:
+		return nil, errors.Errorf("listenUnix: %q exists and is not a socket", path)
+	case err == nil:
+		// Fails if another process is still listening on it.
+		if c, err := net.Dial("unix", path); err == nil {
+			c.Close()
+			return nil, errors.Errorf("listenUnix: %q is in use", path)
+		}
+		err = os.Remove(path)
+		if err != nil {
+			return nil, errors.Errorf("listenUnix: %w", err)
+		}
+	case !os.IsNotExist(err):
+		return nil, errors.Errorf("listenUnix: %w", err)
+	}
+
+	// Set the umask rather than using chmod after creating it, so the socket
+	// never has the default permissions.
+	old := umask(int(0777 &^ listenMode))
+	l, err := net.Listen("unix", path)
+	umask(old)
+	if err != nil {
+		return nil, errors.Errorf("listenUnix: %w", err)
+	}
+	return l, nil
+}
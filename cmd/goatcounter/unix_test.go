@@ -0,0 +1,52 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestListenUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goatcounter-unix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sock := filepath.Join(dir, "gc.sock")
+
+	l, err := listenUnix(sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, err := os.Stat(sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Mode().Perm() != 0660 {
+		t.Errorf("mode: %s", st.Mode())
+	}
+
+	// Still listening.
+	_, err = listenUnix(sock)
+	if err == nil || !strings.Contains(err.Error(), "in use") {
+		t.Fatalf("wrong error: %v", err)
+	}
+	l.Close()
+
+	// Not a socket.
+	file := filepath.Join(dir, "file")
+	err = ioutil.WriteFile(file, nil, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = listenUnix(file)
+	if err == nil || !strings.Contains(err.Error(), "not a socket") {
+		t.Fatalf("wrong error: %v", err)
+	}
+}
@@ -0,0 +1,37 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"math"
+	"time"
+)
+
+// ComparePeriods are the valid periods to compare with: the period right
+// before, or the same period a year earlier.
+var ComparePeriods = []string{"previous", "year"}
+
+// ComparePeriod gets the period to compare start and end with.
+func ComparePeriod(start, end time.Time, compare string) (time.Time, time.Time) {
+	if compare == "year" {
+		return start.AddDate(-1, 0, 0), end.AddDate(-1, 0, 0)
+	}
+
+	// The end is inclusive (usually 23:59:59), so add a second to get the
+	// length of the period.
+	d := end.Sub(start).Truncate(time.Second) + time.Second
+	return start.Add(-d), start.Add(-time.Second)
+}
+
+// Change gets the percentage change from prev to cur, rounded to one decimal.
+//
+// This is nil if prev is 0, as the change can't be calculated.
+func Change(cur, prev int) *float64 {
+	if prev == 0 {
+		return nil
+	}
+	c := math.Round(float64(cur-prev)/float64(prev)*1000) / 10
+	return &c
+}
@@ -0,0 +1,209 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+// Package counter allows using GoatCounter as a library, for recording and
+// querying pageviews without running the HTTP server.
+//
+// This is a separate package from goatcounter as it needs the stats updates
+// from the cron package, which imports goatcounter.
+//
+// Basic usage:
+//
+//	c, err := counter.Open(db, "myapp")
+//	if err != nil {
+//	    log.Fatal(err)
+//	}
+//	defer c.Close()
+//
+//	err = c.Count(goatcounter.Hit{Path: "/settings"})
+//
+// The database needs to have the GoatCounter schema and migrations applied,
+// e.g. by running "goatcounter migrate" or by using zdb.Connect() with the
+// schema and migrations from the pack package.
+package counter
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/goatcounter"
+	"zgo.at/goatcounter/cron"
+	"zgo.at/zdb"
+	"zgo.at/zlog"
+)
+
+// FlushInterval is how often the hits are written to the database in the
+// background; this is the same as the HTTP server.
+var FlushInterval = 10 * time.Second
+
+// Counter records pageviews for a single site.
+type Counter struct {
+	db   zdb.DB
+	ctx  context.Context
+	site goatcounter.Site
+
+	mu     sync.Mutex // Only one Flush() at a time.
+	stop   chan struct{}
+	done   chan struct{}
+	closed bool
+}
+
+// Stats for a time period.
+type Stats struct {
+	Total       int                  // Total number of pageviews.
+	TotalUnique int                  // Total number of unique visitors.
+	More        bool                 // There are more pages than in Pages.
+	Pages       goatcounter.HitStats // Top pages, up to the Limits.Page setting.
+}
+
+// Open a new counter for the site with the given code, creating the site if it
+// doesn't exist yet.
+//
+// Hits are written to the database every FlushInterval; use Flush() to write
+// them immediately. Close() must be called to write all pending hits and the
+// session state.
+//
+// Only one Counter per process is supported, as the in-memory session state is
+// shared.
+func Open(db zdb.DB, code string) (*Counter, error) {
+	ctx := zdb.With(context.Background(), db)
+
+	var site goatcounter.Site
+	err := site.ByCode(ctx, code)
+	if err != nil {
+		if !zdb.ErrNoRows(err) {
+			return nil, errors.Wrap(err, "counter.Open")
+		}
+
+		site = goatcounter.Site{Code: code, Plan: goatcounter.PlanBusinessPlus}
+		err = site.Insert(ctx)
+		if err != nil {
+			return nil, errors.Wrap(err, "counter.Open")
+		}
+	}
+
+	err = goatcounter.Memstore.Init(db)
+	if err != nil {
+		return nil, errors.Wrap(err, "counter.Open")
+	}
+
+	c := &Counter{
+		db:   db,
+		ctx:  goatcounter.WithSite(ctx, &site),
+		site: site,
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go c.run()
+	return c, nil
+}
+
+func (c *Counter) run() {
+	defer zlog.Recover()
+	defer close(c.done)
+
+	t := time.NewTicker(FlushInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-t.C:
+			err := c.Flush()
+			if err != nil {
+				zlog.Module("counter").Error(err)
+			}
+			goatcounter.Memstore.EvictSessions()
+			goatcounter.Memstore.RefreshSalt()
+		}
+	}
+}
+
+// Site gets the site this counter records for.
+func (c *Counter) Site() goatcounter.Site { return c.site }
+
+// Count a new pageview or event.
+//
+// The hit is stored in memory until the next Flush(). The Site is always set
+// to the counter's site, and CreatedAt is set to the current time if it's
+// zero.
+//
+// Unique visitors are tracked with the Browser and RemoteAddr fields, the same
+// as the HTTP server does. Set Session explicitly to use your own session
+// tracking.
+func (c *Counter) Count(hit goatcounter.Hit) error {
+	if hit.Path == "" {
+		return errors.New("counter.Count: Path is required")
+	}
+
+	hit.Site = c.site.ID
+	if hit.CreatedAt.IsZero() {
+		hit.CreatedAt = goatcounter.Now()
+	}
+
+	goatcounter.Memstore.Append(hit)
+	return nil
+}
+
+// Flush writes all pending hits to the database and updates the statistics.
+func (c *Counter) Flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	hits, err := goatcounter.Memstore.Persist(c.ctx)
+	if err != nil {
+		return errors.Wrap(err, "counter.Flush")
+	}
+
+	grouped := make(map[int64][]goatcounter.Hit)
+	for _, h := range hits {
+		if h.Bot > 0 {
+			continue
+		}
+		grouped[h.Site] = append(grouped[h.Site], h)
+	}
+	for siteID, hits := range grouped {
+		err := cron.UpdateStats(c.ctx, siteID, hits)
+		if err != nil {
+			return errors.Wrap(err, "counter.Flush")
+		}
+	}
+	return nil
+}
+
+// Stats gets the statistics for the given time period.
+//
+// The filter is matched case-insensitive on the path and title; use an empty
+// string to get all pages.
+func (c *Counter) Stats(start, end time.Time, filter string) (Stats, error) {
+	var s Stats
+	total, totalUnique, err := goatcounter.GetTotalCount(c.ctx, start, end, filter)
+	if err != nil {
+		return s, errors.Wrap(err, "counter.Stats")
+	}
+	s.Total, s.TotalUnique = total, totalUnique
+
+	_, _, s.More, err = s.Pages.List(c.ctx, start, end, filter, nil, true)
+	return s, errors.Wrap(err, "counter.Stats")
+}
+
+// Close writes all pending hits and the session state to the database, and
+// stops the background flushing.
+//
+// The Counter can't be used after this.
+func (c *Counter) Close() error {
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+
+	close(c.stop)
+	<-c.done
+
+	err := c.Flush()
+	goatcounter.Memstore.StoreSessions(c.db)
+	return err
+}
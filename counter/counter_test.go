@@ -0,0 +1,78 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package counter_test
+
+import (
+	"testing"
+	"time"
+
+	"zgo.at/goatcounter"
+	"zgo.at/goatcounter/counter"
+	"zgo.at/goatcounter/gctest"
+	"zgo.at/zdb"
+)
+
+func TestCounter(t *testing.T) {
+	ctx, clean := gctest.DB(t)
+	defer clean()
+
+	c, err := counter.Open(zdb.MustGet(ctx), "gctest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.Site().ID != 1 {
+		t.Fatalf("wrong site: %d", c.Site().ID)
+	}
+
+	now := time.Date(2020, 6, 18, 14, 42, 0, 0, time.UTC)
+	for _, h := range []goatcounter.Hit{
+		{Path: "/a", CreatedAt: now, Browser: "Firefox/68.0", RemoteAddr: "1.1.1.1"},
+		{Path: "/a", CreatedAt: now, Browser: "Firefox/68.0", RemoteAddr: "1.1.1.1"},
+		{Path: "/a", CreatedAt: now, Browser: "Firefox/68.0", RemoteAddr: "3.3.3.3"},
+		{Path: "/b", CreatedAt: now, Browser: "Firefox/68.0", RemoteAddr: "2.2.2.2"},
+	} {
+		err := c.Count(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = c.Count(goatcounter.Hit{})
+	if err == nil {
+		t.Fatal("no error for empty path")
+	}
+
+	err = c.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := c.Stats(now.Add(-time.Hour), now.Add(time.Hour), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Total != 4 || stats.TotalUnique != 3 {
+		t.Errorf("wrong totals: %d %d", stats.Total, stats.TotalUnique)
+	}
+	if len(stats.Pages) != 2 || stats.Pages[0].Path != "/a" {
+		t.Errorf("wrong pages: %v", stats.Pages)
+	}
+
+	err = c.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("new site", func(t *testing.T) {
+		c, err := counter.Open(zdb.MustGet(ctx), "newsite")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		if c.Site().ID == 0 || c.Site().Code != "newsite" {
+			t.Errorf("wrong site: %d %q", c.Site().ID, c.Site().Code)
+		}
+	})
+}
@@ -0,0 +1,157 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package cron
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+
+	"zgo.at/blackmail"
+	"zgo.at/errors"
+	"zgo.at/goatcounter"
+	"zgo.at/goatcounter/cfg"
+	"zgo.at/zdb"
+	"zgo.at/zlog"
+)
+
+var alertClient = http.Client{
+	Timeout: 10 * time.Second,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: 5 * time.Second,
+			// Check the address after the DNS lookup, for every connection
+			// (including redirects).
+			Control: func(network, address string, _ syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				if !goatcounter.AlertAddrAllowed(net.ParseIP(host)) {
+					return errors.Errorf("not sending alert to private address %s", host)
+				}
+				return nil
+			},
+		}).DialContext,
+		TLSHandshakeTimeout: 5 * time.Second,
+	},
+}
+
+// Alerts checks all alert rules and sends the alerts for the rules that match,
+// unless the alert was sent less than the rule's cooldown ago.
+func Alerts(ctx context.Context) error {
+	var rules goatcounter.AlertRules
+	err := rules.ListAll(ctx)
+	if err != nil {
+		return errors.Errorf("cron.Alerts: %w", err)
+	}
+
+	var (
+		l     = zlog.Module("cron")
+		now   = goatcounter.Now()
+		sites = make(map[int64]*goatcounter.Site)
+	)
+	for _, r := range rules {
+		r := r
+		if r.Cooling(now) {
+			continue
+		}
+
+		site, ok := sites[r.SiteID]
+		if !ok {
+			site = new(goatcounter.Site)
+			err := site.ByID(ctx, r.SiteID)
+			if zdb.ErrNoRows(err) { // Deleted site.
+				sites[r.SiteID] = nil
+				continue
+			}
+			if err != nil {
+				l.Field("alert", r.ID).Error(err)
+				continue
+			}
+			sites[r.SiteID] = site
+		}
+		if site == nil {
+			continue
+		}
+
+		sctx := goatcounter.WithSite(ctx, site)
+		alert, err := r.Check(sctx, now)
+		if err != nil {
+			l.Field("alert", r.ID).Error(err)
+			continue
+		}
+		if alert == nil {
+			continue
+		}
+
+		err = sendAlert(*alert)
+		if err != nil {
+			l.Field("alert", r.ID).Error(err)
+			continue
+		}
+		err = r.Fired(sctx, now)
+		if err != nil {
+			l.Field("alert", r.ID).Error(err)
+		}
+	}
+	return nil
+}
+
+// sendAlert sends the alert to the rule's target.
+func sendAlert(a goatcounter.Alert) error {
+	switch a.Rule.Deliver {
+	case "email":
+		err := blackmail.Send("GoatCounter alert for "+a.Site,
+			blackmail.From("GoatCounter", cfg.EmailFrom),
+			blackmail.To(a.Rule.Target),
+			blackmail.BodyText([]byte(a.Message()+"\n")))
+		if err != nil {
+			return errors.Errorf("sendAlert: %w", err)
+		}
+		return nil
+	case "slack":
+		return postAlert(a.Rule.Target, map[string]string{"text": a.Message()})
+	case "webhook":
+		return postAlert(a.Rule.Target, struct {
+			goatcounter.Alert
+			Message string `json:"message"`
+		}{a, a.Message()})
+	default:
+		return errors.Errorf("sendAlert: unknown delivery %q", a.Rule.Deliver)
+	}
+}
+
+// postAlert POSTs the alert as JSON.
+func postAlert(url string, body interface{}) error {
+	j, err := json.Marshal(body)
+	if err != nil {
+		return errors.Errorf("postAlert: %w", err)
+	}
+
+	req, err := http.NewRequest("POST", url, bytes.NewReader(j))
+	if err != nil {
+		return errors.Errorf("postAlert: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "GoatCounter/"+cfg.Version)
+
+	resp, err := alertClient.Do(req)
+	if err != nil {
+		return errors.Errorf("postAlert: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 500))
+		return errors.Errorf("postAlert: %s: %s: %s", url, resp.Status, b)
+	}
+	return nil
+}
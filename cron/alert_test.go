@@ -0,0 +1,121 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package cron_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"zgo.at/goatcounter"
+	"zgo.at/goatcounter/cfg"
+	. "zgo.at/goatcounter/cron"
+	"zgo.at/goatcounter/gctest"
+)
+
+func TestAlerts(t *testing.T) {
+	ctx, clean := gctest.DB(t)
+	defer clean()
+
+	now := time.Date(2020, 6, 18, 12, 0, 0, 0, time.UTC)
+	clock := goatcounter.NewFixedClock(now)
+	defer goatcounter.SetClock(clock)()
+
+	var got []map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var b map[string]interface{}
+		err := json.NewDecoder(r.Body).Decode(&b)
+		if err != nil {
+			t.Error(err)
+		}
+		got = append(got, b)
+	}))
+	defer srv.Close()
+
+	rule := goatcounter.AlertRule{Kind: "above", Threshold: 1, Minutes: 60, Cooldown: 60,
+		Deliver: "webhook", Target: srv.URL}
+	err := rule.Insert(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gctest.StoreHits(ctx, t,
+		goatcounter.Hit{Path: "/a", CreatedAt: now.Add(-10 * time.Minute)},
+		goatcounter.Hit{Path: "/b", CreatedAt: now.Add(-5 * time.Minute)})
+
+	// Send the alert, and not again during the cooldown.
+	for i := 0; i < 2; i++ {
+		err = Alerts(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		clock.Advance(30 * time.Minute)
+	}
+	if len(got) != 1 {
+		t.Fatalf("len(got) = %d: %v", len(got), got)
+	}
+	if got[0]["pageviews"] != 2.0 || got[0]["message"] == "" {
+		t.Errorf("wrong body: %v", got[0])
+	}
+
+	var r goatcounter.AlertRule
+	err = r.ByID(ctx, rule.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.FiredAt == nil || !r.FiredAt.Equal(now) {
+		t.Errorf("wrong FiredAt: %v", r.FiredAt)
+	}
+
+	// Send it again after the cooldown.
+	gctest.StoreHits(ctx, t, goatcounter.Hit{Path: "/c", CreatedAt: clock.Now().Add(-time.Minute)},
+		goatcounter.Hit{Path: "/c", CreatedAt: clock.Now().Add(-time.Minute)})
+	err = Alerts(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("len(got) = %d: %v", len(got), got)
+	}
+}
+
+func TestAlertsPrivate(t *testing.T) {
+	ctx, clean := gctest.DB(t)
+	defer clean()
+
+	now := time.Date(2020, 6, 18, 12, 0, 0, 0, time.UTC)
+	defer goatcounter.SetClock(goatcounter.NewFixedClock(now))()
+
+	called := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+	defer srv.Close()
+
+	rule := goatcounter.AlertRule{Kind: "above", Threshold: 1, Minutes: 60, Cooldown: 60,
+		Deliver: "webhook", Target: srv.URL}
+	err := rule.Insert(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gctest.StoreHits(ctx, t,
+		goatcounter.Hit{Path: "/a", CreatedAt: now.Add(-10 * time.Minute)},
+		goatcounter.Hit{Path: "/b", CreatedAt: now.Add(-5 * time.Minute)})
+
+	// The rule was added in development, but the address is checked again
+	// when sending.
+	defer func(p bool) { cfg.Prod = p }(cfg.Prod)
+	cfg.Prod = true
+
+	err = Alerts(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if called {
+		t.Error("sent alert to loopback address")
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package cron
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/goatcounter"
+	"zgo.at/zdb"
+	"zgo.at/zlog"
+)
+
+// anomalyChecked is the last day that was checked for every site, so every day
+// is checked only once.
+var anomalyChecked = struct {
+	sync.Mutex
+	days map[int64]string
+}{days: make(map[int64]string)}
+
+// anomalies checks the previous day of every site for unusual traffic; this
+// runs every hour, as the day ends at a different time for every timezone.
+func anomalies(ctx context.Context) error {
+	var sites goatcounter.Sites
+	err := sites.List(ctx)
+	if err != nil {
+		return errors.Errorf("cron.anomalies: %w", err)
+	}
+
+	anomalyChecked.Lock()
+	defer anomalyChecked.Unlock()
+
+	var (
+		l   = zlog.Module("cron")
+		now = goatcounter.Now()
+	)
+	for _, s := range sites {
+		s := s
+		loc := s.Settings.Timezone.Loc()
+		y, m, d := now.In(loc).Date()
+		day := time.Date(y, m, d-1, 0, 0, 0, 0, loc)
+		dayS := day.Format("2006-01-02")
+		if anomalyChecked.days[s.ID] == dayS {
+			continue
+		}
+
+		err := checkAnomaly(goatcounter.WithSite(ctx, &s), day)
+		if err != nil {
+			l.Field("site", s.ID).Error(err)
+			continue
+		}
+		anomalyChecked.days[s.ID] = dayS
+	}
+	return nil
+}
+
+func checkAnomaly(ctx context.Context, day time.Time) error {
+	var have goatcounter.Anomaly
+	err := have.ByDay(ctx, day.Format("2006-01-02"))
+	if err == nil {
+		return nil
+	}
+	if !zdb.ErrNoRows(err) {
+		return err
+	}
+
+	a, err := goatcounter.DetectAnomaly(ctx, day)
+	if err != nil || a == nil {
+		return err
+	}
+	return a.Insert(ctx)
+}
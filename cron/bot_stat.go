@@ -0,0 +1,65 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package cron
+
+import (
+	"context"
+
+	"zgo.at/errors"
+	"zgo.at/goatcounter"
+	"zgo.at/zdb"
+	"zgo.at/zdb/bulk"
+)
+
+// Bot stats are stored as a simple day with a count; unlike the other tables
+// this only has the pageviews from bots.
+//  site |    day     | count
+// ------+------------+-------
+//     1 | 2019-11-30 |    42
+//     1 | 2019-12-01 |     7
+func updateBotStats(ctx context.Context, hits []goatcounter.Hit) error {
+	return zdb.TX(ctx, func(ctx context.Context, tx zdb.DB) error {
+		grouped := map[string]int{}
+		for _, h := range hits {
+			if h.Bot == 0 {
+				continue
+			}
+
+			day := statDay(ctx, h.CreatedAt)
+			if _, ok := grouped[day]; !ok {
+				var err error
+				grouped[day], err = existingBotStats(ctx, tx, h.Site, day)
+				if err != nil {
+					return err
+				}
+			}
+			grouped[day] += 1
+		}
+
+		siteID := goatcounter.MustGetSite(ctx).ID
+		ins := bulk.NewInsert(ctx, "bot_stats", []string{"site", "day", "count"})
+		for day, count := range grouped {
+			ins.Values(siteID, day, count)
+		}
+		return ins.Finish()
+	})
+}
+
+func existingBotStats(txctx context.Context, tx zdb.DB, siteID int64, day string) (int, error) {
+	var c []int
+	err := tx.SelectContext(txctx, &c, `/* existingBotStats */
+		select count from bot_stats where site=$1 and day=$2 limit 1`,
+		siteID, day)
+	if err != nil {
+		return 0, errors.Wrap(err, "select")
+	}
+	if len(c) == 0 {
+		return 0, nil
+	}
+
+	_, err = tx.ExecContext(txctx, `delete from bot_stats where site=$1 and day=$2`,
+		siteID, day)
+	return c[0], errors.Wrap(err, "delete")
+}
@@ -32,7 +32,7 @@ func TestBrowserStats(t *testing.T) {
 	}
 
 	var stats goatcounter.Stats
-	err = stats.ListBrowsers(ctx, now, now, 10, 0)
+	err = stats.ListBrowsers(ctx, now, now, "", 10, 0)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -55,7 +55,7 @@ func TestBrowserStats(t *testing.T) {
 	}
 
 	stats = goatcounter.Stats{}
-	err = stats.ListBrowsers(ctx, now, now, 10, 0)
+	err = stats.ListBrowsers(ctx, now, now, "", 10, 0)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -68,7 +68,7 @@ func TestBrowserStats(t *testing.T) {
 
 	// List just Firefox.
 	stats = goatcounter.Stats{}
-	err = stats.ListBrowser(ctx, "Firefox", now, now)
+	err = stats.ListBrowser(ctx, "Firefox", now, now, "")
 	if err != nil {
 		t.Fatal(err)
 	}
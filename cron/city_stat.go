@@ -0,0 +1,95 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package cron
+
+import (
+	"context"
+
+	"zgo.at/errors"
+	"zgo.at/goatcounter"
+	"zgo.at/zdb"
+	"zgo.at/zdb/bulk"
+)
+
+// City stats are stored as day/location/region/city with a count; only hits
+// with a region or city are stored.
+//  site |    day     | location | region | city          | count
+// ------+------------+----------+--------+---------------+-------
+//     1 | 2019-11-30 | US       | US-CA  | San Francisco |     1
+//     1 | 2019-11-30 | US       | US-CA  | Los Angeles   |     2
+//     1 | 2019-11-30 | NL       | NL-NH  | Amsterdam     |     4
+func updateCityStats(ctx context.Context, hits []goatcounter.Hit) error {
+	return zdb.TX(ctx, func(ctx context.Context, tx zdb.DB) error {
+		// Group by day + location + region + city.
+		type gt struct {
+			count       int
+			countUnique int
+			day         string
+			location    string
+			region      string
+			city        string
+		}
+		grouped := map[string]gt{}
+		for _, h := range hits {
+			if h.Bot > 0 || (h.Region == "" && h.City == "") {
+				continue
+			}
+
+			day := statDay(ctx, h.CreatedAt)
+			k := day + h.Location + "\x00" + h.Region + "\x00" + h.City
+			v := grouped[k]
+			if v.count == 0 {
+				v.day = day
+				v.location, v.region, v.city = h.Location, h.Region, h.City
+				var err error
+				v.count, v.countUnique, err = existingCityStats(ctx, tx,
+					h.Site, day, v.location, v.region, v.city)
+				if err != nil {
+					return err
+				}
+			}
+
+			v.count += 1
+			if h.FirstVisit {
+				v.countUnique += 1
+			}
+			grouped[k] = v
+		}
+
+		siteID := goatcounter.MustGetSite(ctx).ID
+		ins := bulk.NewInsert(ctx, "city_stats", []string{"site", "day",
+			"location", "region", "city", "count", "count_unique"})
+		for _, v := range grouped {
+			ins.Values(siteID, v.day, v.location, v.region, v.city, v.count, v.countUnique)
+		}
+		return ins.Finish()
+	})
+}
+
+func existingCityStats(
+	txctx context.Context, tx zdb.DB, siteID int64,
+	day, location, region, city string,
+) (int, int, error) {
+
+	var c []struct {
+		Count       int `db:"count"`
+		CountUnique int `db:"count_unique"`
+	}
+	err := tx.SelectContext(txctx, &c, `/* existingCityStats */
+		select count, count_unique from city_stats
+		where site=$1 and day=$2 and location=$3 and region=$4 and city=$5 limit 1`,
+		siteID, day, location, region, city)
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "select")
+	}
+	if len(c) == 0 {
+		return 0, 0, nil
+	}
+
+	_, err = tx.ExecContext(txctx, `delete from city_stats where
+		site=$1 and day=$2 and location=$3 and region=$4 and city=$5`,
+		siteID, day, location, region, city)
+	return c[0].Count, c[0].CountUnique, errors.Wrap(err, "delete")
+}
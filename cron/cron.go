@@ -7,9 +7,15 @@ package cron
 
 import (
 	"context"
+	"reflect"
+	"runtime"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/jmoiron/sqlx"
+	"zgo.at/errors"
+	"zgo.at/goatcounter"
 	"zgo.at/zdb"
 	"zgo.at/zlog"
 	"zgo.at/zstd/zsync"
@@ -20,13 +26,39 @@ type task struct {
 	period time.Duration
 }
 
+// run the task in a new span.
+func (t task) run(ctx context.Context) error {
+	name := runtime.FuncForPC(reflect.ValueOf(t.fun).Pointer()).Name()
+	if i := strings.LastIndexByte(name, '/'); i > -1 {
+		name = name[i+1:]
+	}
+
+	ctx, span := goatcounter.StartSpan(ctx, name)
+	err := t.fun(ctx)
+	span.End(err)
+	return err
+}
+
+// PersistInterval is how often the pageviews in the Memstore are persisted to
+// the database. This must be set before RunBackground().
+var PersistInterval = 10 * time.Second
+
+// A period of 0 means PersistInterval.
 var tasks = []task{
-	{persistAndStat, 10 * time.Second},
+	{persistAndStat, 0},
 	{DataRetention, 1 * time.Hour},
 	{renewACME, 2 * time.Hour},
-	{vacuumDeleted, 12 * time.Hour},
+	{VacuumDeleted, 12 * time.Hour},
 	{oldExports, 1 * time.Hour},
 	{sessions, 1 * time.Minute},
+	{backfillPaths, 1 * time.Minute},
+	{EmailReports, 1 * time.Hour},
+	{hitPartitions, 24 * time.Hour},
+	{rollups, 1 * time.Hour},
+	{anomalies, 1 * time.Hour},
+	{Alerts, 1 * time.Minute},
+	{refspam, 1 * time.Hour},
+	{geoDB, 1 * time.Hour},
 }
 
 var (
@@ -39,7 +71,7 @@ func RunOnce(db zdb.DB) {
 	ctx := zdb.With(context.Background(), db)
 	l := zlog.Module("cron")
 	for _, t := range tasks {
-		err := t.fun(ctx)
+		err := t.run(ctx)
 		if err != nil {
 			l.Error(err)
 		}
@@ -52,6 +84,9 @@ func RunBackground(db zdb.DB) {
 	l := zlog.Module("cron")
 
 	for _, t := range tasks {
+		if t.period == 0 {
+			t.period = PersistInterval
+		}
 		go func(t task) {
 			defer zlog.Recover()
 
@@ -65,7 +100,7 @@ func RunBackground(db zdb.DB) {
 				func() {
 					wg.Add(1)
 					defer wg.Done()
-					err = t.fun(ctx)
+					err = t.run(ctx)
 				}()
 				if err != nil {
 					l.Error(err)
@@ -84,9 +119,55 @@ func Wait(db zdb.DB) {
 	wg.Wait()
 
 	for _, t := range tasks {
-		err := t.fun(ctx)
+		err := t.run(ctx)
 		if err != nil {
 			zlog.Module("cron").Error(err)
 		}
 	}
 }
+
+// txStmt is a query that's run for every group of hits in a transaction, such
+// as checking if there's already a row; it's prepared once so the database
+// doesn't need to parse it every time.
+type txStmt struct {
+	tx    zdb.DB
+	query string
+	stmt  *sqlx.Stmt
+}
+
+func prepare(ctx context.Context, tx zdb.DB, query string) (*txStmt, error) {
+	s := &txStmt{tx: tx, query: query}
+	p, ok := tx.(interface {
+		PreparexContext(context.Context, string) (*sqlx.Stmt, error)
+	})
+	if !ok {
+		return s, nil
+	}
+
+	var err error
+	s.stmt, err = p.PreparexContext(ctx, query)
+	return s, errors.Wrap(err, "prepare")
+}
+
+func (s *txStmt) row(ctx context.Context, args ...interface{}) *sqlx.Row {
+	if s.stmt == nil {
+		return s.tx.QueryRowxContext(ctx, s.query, args...)
+	}
+	return s.stmt.QueryRowxContext(ctx, args...)
+}
+
+func (s *txStmt) exec(ctx context.Context, args ...interface{}) error {
+	var err error
+	if s.stmt == nil {
+		_, err = s.tx.ExecContext(ctx, s.query, args...)
+	} else {
+		_, err = s.stmt.ExecContext(ctx, args...)
+	}
+	return err
+}
+
+func (s *txStmt) Close() {
+	if s.stmt != nil {
+		s.stmt.Close()
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package cron
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"zgo.at/blackmail"
+	"zgo.at/errors"
+	"zgo.at/goatcounter"
+	"zgo.at/goatcounter/cfg"
+	"zgo.at/guru"
+	"zgo.at/zdb"
+	"zgo.at/zlog"
+)
+
+// EmailReports sends the weekly and monthly email reports to all users who
+// enabled them and haven't received the report for the last period yet.
+func EmailReports(ctx context.Context) error {
+	var users goatcounter.Users
+	err := users.ListEmailReports(ctx)
+	if err != nil {
+		return errors.Errorf("cron.EmailReports: %w", err)
+	}
+
+	var (
+		l   = zlog.Module("cron")
+		now = goatcounter.Now()
+	)
+	for _, u := range users {
+		u := u
+		var site goatcounter.Site
+		err := site.ByID(ctx, u.Site)
+		if zdb.ErrNoRows(err) { // Deleted site.
+			continue
+		}
+		if err != nil {
+			l.Field("user", u.ID).Error(err)
+			continue
+		}
+
+		_, end := goatcounter.EmailReportPeriod(now, site.Settings.Timezone.Loc(),
+			u.EmailReports, site.Settings.SundayStartsWeek)
+		if u.EmailReportAt != nil && u.EmailReportAt.After(end) {
+			continue
+		}
+
+		err = sendEmailReports(goatcounter.WithUser(ctx, &u), u, now)
+		if err != nil {
+			l.Field("user", u.ID).Error(err)
+		}
+	}
+	return nil
+}
+
+// sendEmailReports sends a report for every site the user selected.
+//
+// The report is marked as sent even if sending it failed for some sites, as
+// it would otherwise be sent again for the other sites on the next run.
+func sendEmailReports(ctx context.Context, u goatcounter.User, now time.Time) error {
+	var sites goatcounter.Sites
+	err := sites.ListWithSubs(ctx, u.Site)
+	if err != nil {
+		return errors.Errorf("sendEmailReports: %w", err)
+	}
+
+	errs := errors.NewGroup(20)
+	for _, id := range u.ReportSites() {
+		for _, s := range sites {
+			if s.ID != id {
+				continue
+			}
+			s := s
+			sctx := goatcounter.WithSite(ctx, &s)
+
+			// The user's role may not allow reading the stats.
+			err := u.Can(sctx, goatcounter.PermStats)
+			if err != nil {
+				if guru.Code(err) != http.StatusForbidden {
+					errs.Append(err)
+				}
+				continue
+			}
+			errs.Append(sendEmailReport(sctx, u, now))
+		}
+	}
+
+	err = u.EmailReportSent(ctx, now)
+	if err != nil {
+		errs.Append(err)
+	}
+	if errs.Len() > 0 {
+		return errs
+	}
+	return nil
+}
+
+func sendEmailReport(ctx context.Context, u goatcounter.User, now time.Time) error {
+	r := goatcounter.EmailReport{User: u}
+	err := r.Get(ctx, u.EmailReports, now)
+	if err != nil {
+		return err
+	}
+
+	subject := fmt.Sprintf("Your %sly GoatCounter report", u.EmailReports)
+	if len(u.ReportSites()) > 1 {
+		subject += " for " + r.Site.Display()
+	}
+	err = blackmail.Send(subject,
+		blackmail.From("GoatCounter", cfg.EmailFrom),
+		blackmail.To(u.Email),
+		blackmail.BodyMustText(goatcounter.EmailTemplate("email_report.gotxt", r)))
+	if err != nil {
+		return errors.Errorf("sendEmailReport: %w", err)
+	}
+	return nil
+}
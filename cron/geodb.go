@@ -0,0 +1,213 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package cron
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/goatcounter"
+	"zgo.at/zlog"
+)
+
+// Automatic GeoLite2 database updates. The database is downloaded with the
+// MaxMind license key GeoDBKey to GeoDBFile, after which GeoDBLoad is called
+// to use it. Nothing is downloaded if GeoDBKey is empty.
+//
+// These must be set before RunBackground().
+var (
+	GeoDBKey     string
+	GeoDBEdition = "GeoLite2-Country"
+	GeoDBFile    string
+	GeoDBLoad    func(file string) error
+)
+
+// GeoDBInterval is how often to download the GeoLite2 database; MaxMind
+// updates it twice a week.
+const GeoDBInterval = 72 * time.Hour
+
+var (
+	geodbURL    = "https://download.maxmind.com/app/geoip_download"
+	geodbClient = http.Client{Timeout: 5 * time.Minute}
+)
+
+// geoDB downloads the GeoLite2 database if GeoDBFile doesn't exist or is older
+// than GeoDBInterval.
+func geoDB(ctx context.Context) error {
+	if GeoDBKey == "" || GeoDBFile == "" {
+		return nil
+	}
+
+	st, err := os.Stat(GeoDBFile)
+	if err == nil && goatcounter.Now().Sub(st.ModTime()) < GeoDBInterval {
+		return nil
+	}
+
+	sum, err := geoDBChecksum(ctx)
+	if err != nil {
+		return errors.Errorf("cron.geoDB: %w", err)
+	}
+
+	// Write the archive to a file first, as the checksum needs to be verified
+	// before using any of it.
+	archive := GeoDBFile + ".tar.gz"
+	defer os.Remove(archive)
+	err = geoDBDownload(ctx, archive, sum)
+	if err != nil {
+		return errors.Errorf("cron.geoDB: %w", err)
+	}
+	fp, err := os.Open(archive)
+	if err != nil {
+		return errors.Errorf("cron.geoDB: %w", err)
+	}
+	defer fp.Close()
+
+	// Write to a temporary file first so that GeoDBFile is never left half
+	// written, and only replace it if the new database can be loaded.
+	tmp := GeoDBFile + ".download"
+	err = extractMMDB(fp, tmp)
+	if err != nil {
+		os.Remove(tmp)
+		return errors.Errorf("cron.geoDB: %w", err)
+	}
+	if GeoDBLoad != nil {
+		err = GeoDBLoad(tmp)
+		if err != nil {
+			os.Remove(tmp)
+			return errors.Errorf("cron.geoDB: %w", err)
+		}
+	}
+	err = os.Rename(tmp, GeoDBFile)
+	if err != nil {
+		return errors.Errorf("cron.geoDB: %w", err)
+	}
+
+	zlog.Module("cron").Printf("updated %s database in %s", GeoDBEdition, GeoDBFile)
+	return nil
+}
+
+// geoDBGet requests the database with the given suffix ("tar.gz" or
+// "tar.gz.sha256").
+func geoDBGet(ctx context.Context, suffix string) (*http.Response, error) {
+	q := url.Values{"edition_id": {GeoDBEdition}, "license_key": {GeoDBKey}, "suffix": {suffix}}
+	req, err := http.NewRequestWithContext(ctx, "GET", geodbURL+"?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := geodbClient.Do(req)
+	if err != nil {
+		// Don't log the license key in the URL.
+		if uErr, ok := err.(*url.Error); ok {
+			err = uErr.Err
+		}
+		return nil, errors.Errorf("downloading %s %s: %w", GeoDBEdition, suffix, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, errors.Errorf("downloading %s %s: %s", GeoDBEdition, suffix, resp.Status)
+	}
+	return resp, nil
+}
+
+// geoDBChecksum gets the SHA-256 checksum of the archive; MaxMind serves this
+// in the sha256sum format ("checksum  filename").
+func geoDBChecksum(ctx context.Context) ([]byte, error) {
+	resp, err := geoDBGet(ctx, "tar.gz.sha256")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	if err != nil {
+		return nil, err
+	}
+	f := strings.Fields(string(b))
+	if len(f) == 0 {
+		return nil, errors.New("empty checksum file")
+	}
+	sum, err := hex.DecodeString(f[0])
+	if err != nil || len(sum) != sha256.Size {
+		return nil, errors.Errorf("invalid checksum %q", f[0])
+	}
+	return sum, nil
+}
+
+// geoDBDownload downloads the archive to file, and verifies it against the
+// checksum.
+func geoDBDownload(ctx context.Context, file string, sum []byte) error {
+	resp, err := geoDBGet(ctx, "tar.gz")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	fp, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(fp, h), io.LimitReader(resp.Body, 500<<20))
+	if err != nil {
+		fp.Close()
+		return err
+	}
+	err = fp.Close()
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(h.Sum(nil), sum) {
+		return errors.Errorf("checksum mismatch for %s: got %x; want %x", GeoDBEdition, h.Sum(nil), sum)
+	}
+	return nil
+}
+
+// extractMMDB writes the .mmdb file from the tar.gz archive MaxMind serves to
+// file.
+func extractMMDB(r io.Reader, file string) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return errors.New("no .mmdb file in archive")
+		}
+		if err != nil {
+			return err
+		}
+		if h.Typeflag != tar.TypeReg || !strings.HasSuffix(h.Name, ".mmdb") {
+			continue
+		}
+
+		fp, err := os.Create(file)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(fp, io.LimitReader(tr, 500<<20))
+		if err != nil {
+			fp.Close()
+			return err
+		}
+		return fp.Close()
+	}
+}
@@ -0,0 +1,109 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package cron
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func archive(files map[string]string) *bytes.Buffer {
+	b := new(bytes.Buffer)
+	gz := gzip.NewWriter(b)
+	tw := tar.NewWriter(gz)
+	for name, data := range files {
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), Typeflag: tar.TypeReg})
+		tw.Write([]byte(data))
+	}
+	tw.Close()
+	gz.Close()
+	return b
+}
+
+func TestExtractMMDB(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goatcounter-geodb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "geo.mmdb")
+	err = extractMMDB(archive(map[string]string{
+		"GeoLite2-Country_20200804/COPYRIGHT.txt":         "copyright",
+		"GeoLite2-Country_20200804/GeoLite2-Country.mmdb": "database",
+	}), file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "database" {
+		t.Errorf("wrong file: %q", got)
+	}
+
+	err = extractMMDB(archive(map[string]string{"README": "x"}), file)
+	if err == nil {
+		t.Error("no error for archive without .mmdb file")
+	}
+}
+
+func TestGeoDB(t *testing.T) {
+	data := archive(map[string]string{"GeoLite2-Country_20200804/GeoLite2-Country.mmdb": "database"}).Bytes()
+	sum := fmt.Sprintf("%x  GeoLite2-Country_20200804.tar.gz\n", sha256.Sum256(data))
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("suffix") == "tar.gz.sha256" {
+			w.Write([]byte(sum))
+			return
+		}
+		w.Write(data)
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "goatcounter-geodb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer func(u string) { geodbURL, GeoDBKey, GeoDBFile = u, "", "" }(geodbURL)
+	geodbURL, GeoDBKey, GeoDBFile = srv.URL, "key", filepath.Join(dir, "geo.mmdb")
+
+	err = geoDB(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadFile(GeoDBFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "database" {
+		t.Errorf("wrong file: %q", got)
+	}
+
+	// Wrong checksum: nothing is written.
+	os.Remove(GeoDBFile)
+	sum = strings.Repeat("0", 64) + "  GeoLite2-Country_20200804.tar.gz\n"
+	err = geoDB(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Fatalf("wrong error: %v", err)
+	}
+	if _, err := os.Stat(GeoDBFile); !os.IsNotExist(err) {
+		t.Errorf("database written with wrong checksum: %v", err)
+	}
+}
@@ -15,6 +15,14 @@ import (
 
 func updateHitCounts(ctx context.Context, hits []goatcounter.Hit) error {
 	return zdb.TX(ctx, func(ctx context.Context, tx zdb.DB) error {
+		existing, err := prepare(ctx, tx, `/* existingHitCounts */
+			select total, total_unique from hit_counts
+			where site=$1 and hour=$2 and path=$3 limit 1`)
+		if err != nil {
+			return errors.Wrap(err, "updateHitCounts")
+		}
+		defer existing.Close()
+
 		// Group by day + path.
 		type gt struct {
 			total       int
@@ -22,6 +30,7 @@ func updateHitCounts(ctx context.Context, hits []goatcounter.Hit) error {
 			hour        string
 			event       zdb.Bool
 			path        string
+			pathID      *int64
 			title       string
 		}
 		grouped := map[string]gt{}
@@ -36,9 +45,10 @@ func updateHitCounts(ctx context.Context, hits []goatcounter.Hit) error {
 			if v.total == 0 {
 				v.hour = hour
 				v.path = h.Path
+				v.pathID = h.PathID
 				v.event = h.Event
 				var err error
-				v.total, v.totalUnique, err = existingHitCounts(ctx, tx,
+				v.total, v.totalUnique, err = existingHitCounts(ctx, existing,
 					h.Site, hour, v.path)
 				if err != nil {
 					return err
@@ -56,23 +66,23 @@ func updateHitCounts(ctx context.Context, hits []goatcounter.Hit) error {
 			grouped[k] = v
 		}
 
+		// SQLite has "on conflict replace" on the unique constraint to do the
+		// same as the PostgreSQL upsert.
+		query := `insert into hit_counts
+			(site, path, title, event, hour, total, total_unique, path_id) values ($1, $2, $3, $4, $5, $6, $7, $8)`
+		if cfg.PgSQL {
+			query += ` on conflict on constraint "hit_counts#site#path#hour" do
+				update set total=$6, total_unique=$7, path_id=$8`
+		}
+		insert, err := prepare(ctx, tx, query)
+		if err != nil {
+			return errors.Wrap(err, "updateHitCounts")
+		}
+		defer insert.Close()
+
 		siteID := goatcounter.MustGetSite(ctx).ID
 		for _, v := range grouped {
-			var err error
-			if cfg.PgSQL {
-				_, err = zdb.MustGet(ctx).ExecContext(ctx, `insert into hit_counts
-				(site, path, title, event, hour, total, total_unique) values ($1, $2, $3, $4, $5, $6, $7)
-				on conflict on constraint "hit_counts#site#path#hour" do
-					update set total=$8, total_unique=$9`,
-					siteID, v.path, v.title, v.event, v.hour, v.total, v.totalUnique,
-					v.total, v.totalUnique)
-			} else {
-				// SQLite has "on conflict replace" on the unique constraint to
-				// do the same.
-				_, err = zdb.MustGet(ctx).ExecContext(ctx, `insert into hit_counts
-					(site, path, title, event, hour, total, total_unique) values ($1, $2, $3, $4, $5, $6, $7)`,
-					siteID, v.path, v.title, v.event, v.hour, v.total, v.totalUnique)
-			}
+			err := insert.exec(ctx, siteID, v.path, v.title, v.event, v.hour, v.total, v.totalUnique, v.pathID)
 			if err != nil {
 				return errors.Wrap(err, "updateHitCounts hit_counts")
 			}
@@ -82,15 +92,12 @@ func updateHitCounts(ctx context.Context, hits []goatcounter.Hit) error {
 }
 
 func existingHitCounts(
-	txctx context.Context, tx zdb.DB, siteID int64,
+	txctx context.Context, existing *txStmt, siteID int64,
 	hour, path string,
 ) (int, int, error) {
 
 	var t, tu int
-	row := tx.QueryRowxContext(txctx, `/* existingHitCounts */
-		select total, total_unique from hit_counts
-		where site=$1 and hour=$2 and path=$3 limit 1`,
-		siteID, hour, path)
+	row := existing.row(txctx, siteID, hour, path)
 	if err := row.Err(); err != nil {
 		if zdb.ErrNoRows(err) {
 			return 0, 0, nil
@@ -33,6 +33,7 @@ func updateHitStats(ctx context.Context, hits []goatcounter.Hit) error {
 			day         string
 			hour        string
 			path        string
+			pathID      *int64
 			title       string
 		}
 		grouped := map[string]gt{}
@@ -49,6 +50,7 @@ func updateHitStats(ctx context.Context, hits []goatcounter.Hit) error {
 				v.day = day
 				v.hour = dayHour
 				v.path = h.Path
+				v.pathID = h.PathID
 				var err error
 				v.count, v.countUnique, v.title, err = existingHitStats(ctx, tx,
 					h.Site, day, v.path)
@@ -71,11 +73,11 @@ func updateHitStats(ctx context.Context, hits []goatcounter.Hit) error {
 
 		siteID := goatcounter.MustGetSite(ctx).ID
 		ins := bulk.NewInsert(ctx, "hit_stats", []string{"site", "day", "path",
-			"title", "stats", "stats_unique"})
+			"title", "stats", "stats_unique", "path_id"})
 		for _, v := range grouped {
 			ins.Values(siteID, v.day, v.path, v.title,
 				zjson.MustMarshal(v.count),
-				zjson.MustMarshal(v.countUnique))
+				zjson.MustMarshal(v.countUnique), v.pathID)
 		}
 		return errors.Wrap(ins.Finish(), "updateHitStats hit_stats")
 	})
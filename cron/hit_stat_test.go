@@ -6,11 +6,13 @@ package cron_test
 
 import (
 	"fmt"
+	"sort"
 	"testing"
 	"time"
 
 	"zgo.at/goatcounter"
 	"zgo.at/goatcounter/gctest"
+	"zgo.at/zdb"
 	"zgo.at/zstd/zjson"
 )
 
@@ -42,15 +44,64 @@ func TestHitStats(t *testing.T) {
 		t.Fatalf("len(stats) is not 2: %d", len(stats))
 	}
 
-	want0 := `{"Count":2,"CountUnique":1,"Path":"/asd","Event":false,"Title":"aSd","RefScheme":null,"Max":2,"Stats":[{"Day":"2019-08-31","Hourly":[0,0,0,0,0,0,0,0,0,0,0,0,0,0,2,0,0,0,0,0,0,0,0,0],"HourlyUnique":[0,0,0,0,0,0,0,0,0,0,0,0,0,0,1,0,0,0,0,0,0,0,0,0],"Daily":2,"DailyUnique":1}]}`
+	want0 := `{"Count":2,"CountUnique":1,"Path":"/asd","Event":false,"Title":"aSd","RefScheme":null,"Max":2,"Stats":[{"Day":"2019-08-31","Hourly":[0,0,0,0,0,0,0,0,0,0,0,0,0,0,2,0,0,0,0,0,0,0,0,0],"HourlyUnique":[0,0,0,0,0,0,0,0,0,0,0,0,0,0,1,0,0,0,0,0,0,0,0,0],"Daily":2,"DailyUnique":1}],"Updating":false}`
 	got0 := string(zjson.MustMarshal(stats[0]))
 	if got0 != want0 {
 		t.Errorf("first wrong\ngot:  %s\nwant: %s", got0, want0)
 	}
 
-	want1 := `{"Count":1,"CountUnique":0,"Path":"/zxc","Event":false,"Title":"","RefScheme":null,"Max":1,"Stats":[{"Day":"2019-08-31","Hourly":[0,0,0,0,0,0,0,0,0,0,0,0,0,0,1,0,0,0,0,0,0,0,0,0],"HourlyUnique":[0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0],"Daily":1,"DailyUnique":0}]}`
+	want1 := `{"Count":1,"CountUnique":0,"Path":"/zxc","Event":false,"Title":"","RefScheme":null,"Max":1,"Stats":[{"Day":"2019-08-31","Hourly":[0,0,0,0,0,0,0,0,0,0,0,0,0,0,1,0,0,0,0,0,0,0,0,0],"HourlyUnique":[0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0],"Daily":1,"DailyUnique":0}],"Updating":false}`
 	got1 := string(zjson.MustMarshal(stats[1]))
 	if got1 != want1 {
 		t.Errorf("second wrong\ngot:  %s\nwant: %s", got1, want1)
 	}
 }
+
+func TestHitStatsPathGroups(t *testing.T) {
+	ctx, clean := gctest.DB(t)
+	defer clean()
+
+	var groups goatcounter.PathGroups
+	err := groups.UnmarshalText([]byte("/blog/* → /blog/\n/doc/*.html -> docs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, site := gctest.Site(ctx, t, goatcounter.Site{
+		Settings: goatcounter.SiteSettings{PathGroups: groups},
+	})
+	now := time.Date(2019, 8, 31, 14, 42, 0, 0, time.UTC)
+
+	gctest.StoreHits(ctx, t, []goatcounter.Hit{
+		{Site: site.ID, CreatedAt: now, Path: "/blog/a", Title: "A"},
+		{Site: site.ID, CreatedAt: now, Path: "/blog/2019/b"},
+		{Site: site.ID, CreatedAt: now, Path: "/blog"},
+		{Site: site.ID, CreatedAt: now, Path: "/doc/x.html"},
+		{Site: site.ID, CreatedAt: now, Path: "/doc/x.txt"},
+	}...)
+
+	var stats goatcounter.HitStats
+	_, _, _, err = stats.List(ctx, now.Add(-1*time.Hour), now.Add(1*time.Hour), "", nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, s := range stats {
+		got = append(got, fmt.Sprintf("%s %d %q", s.Path, s.Count, s.Title))
+	}
+	sort.Strings(got)
+	want := `[/blog 1 "" /blog/ 2 "" /doc/x.txt 1 "" docs 1 ""]`
+	if g := fmt.Sprintf("%s", got); g != want {
+		t.Errorf("\ngot:  %s\nwant: %s", g, want)
+	}
+
+	// The pageviews are stored as-is.
+	var paths []string
+	err = zdb.MustGet(ctx).SelectContext(ctx, &paths, `select path from hits order by id`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g := fmt.Sprintf("%s", paths); g != "[/blog/a /blog/2019/b /blog /doc/x.html /doc/x.txt]" {
+		t.Errorf("wrong paths: %s", g)
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package cron
+
+import (
+	"context"
+
+	"zgo.at/errors"
+	"zgo.at/goatcounter"
+	"zgo.at/zdb"
+	"zgo.at/zdb/bulk"
+)
+
+// Language stats are stored as a simple day/language with a count.
+//  site |    day     | language | count
+// ------+------------+----------+-------
+//     1 | 2019-11-30 | en       |     5
+//     1 | 2019-11-30 | de       |     2
+//     1 | 2019-11-30 |          |     1
+func updateLanguageStats(ctx context.Context, hits []goatcounter.Hit) error {
+	return zdb.TX(ctx, func(ctx context.Context, tx zdb.DB) error {
+		// Group by day + language.
+		type gt struct {
+			count       int
+			countUnique int
+			day         string
+			language    string
+		}
+		grouped := map[string]gt{}
+		for _, h := range hits {
+			if h.Bot > 0 {
+				continue
+			}
+
+			day := statDay(ctx, h.CreatedAt)
+			k := day + h.Language
+			v := grouped[k]
+			if v.count == 0 {
+				v.day = day
+				v.language = h.Language
+				var err error
+				v.count, v.countUnique, err = existingLanguageStats(ctx, tx,
+					h.Site, day, v.language)
+				if err != nil {
+					return err
+				}
+			}
+
+			v.count += 1
+			if h.FirstVisit {
+				v.countUnique += 1
+			}
+			grouped[k] = v
+		}
+
+		siteID := goatcounter.MustGetSite(ctx).ID
+		ins := bulk.NewInsert(ctx, "language_stats", []string{"site", "day",
+			"language", "count", "count_unique"})
+		for _, v := range grouped {
+			ins.Values(siteID, v.day, v.language, v.count, v.countUnique)
+		}
+		return ins.Finish()
+	})
+}
+
+func existingLanguageStats(
+	txctx context.Context, tx zdb.DB, siteID int64,
+	day, language string,
+) (int, int, error) {
+
+	var c []struct {
+		Count       int `db:"count"`
+		CountUnique int `db:"count_unique"`
+	}
+	err := tx.SelectContext(txctx, &c, `/* existingLanguageStats */
+		select count, count_unique from language_stats
+		where site=$1 and day=$2 and language=$3 limit 1`,
+		siteID, day, language)
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "select")
+	}
+	if len(c) == 0 {
+		return 0, 0, nil
+	}
+
+	_, err = tx.ExecContext(txctx, `delete from language_stats where
+		site=$1 and day=$2 and language=$3`,
+		siteID, day, language)
+	return c[0].Count, c[0].CountUnique, errors.Wrap(err, "delete")
+}
@@ -0,0 +1,63 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package cron_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"zgo.at/goatcounter"
+	. "zgo.at/goatcounter/cron"
+	"zgo.at/goatcounter/gctest"
+)
+
+func TestLanguageStats(t *testing.T) {
+	ctx, clean := gctest.DB(t)
+	defer clean()
+
+	site := goatcounter.MustGetSite(ctx)
+	now := time.Date(2019, 8, 31, 14, 42, 0, 0, time.UTC)
+
+	err := UpdateStats(ctx, site.ID, []goatcounter.Hit{
+		{Site: site.ID, CreatedAt: now, Language: "en", FirstVisit: true},
+		{Site: site.ID, CreatedAt: now, Language: "en"},
+		{Site: site.ID, CreatedAt: now, Language: "de", FirstVisit: true},
+		{Site: site.ID, CreatedAt: now},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var stats goatcounter.Stats
+	err = stats.ListLanguages(ctx, now, now, "", 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{false [{de 1 1 <nil>} {en 2 1 <nil>} { 1 0 <nil>}]}`
+	out := fmt.Sprintf("%v", stats)
+	if want != out {
+		t.Errorf("\nwant: %s\nout:  %s", want, out)
+	}
+
+	// Update existing.
+	err = UpdateStats(ctx, site.ID, []goatcounter.Hit{
+		{Site: site.ID, CreatedAt: now, Language: "en", FirstVisit: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats = goatcounter.Stats{}
+	err = stats.ListLanguages(ctx, now, now, "", 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = `{true [{en 3 2 <nil>}]}`
+	out = fmt.Sprintf("%v", stats)
+	if want != out {
+		t.Errorf("\nwant: %s\nout:  %s", want, out)
+	}
+}
@@ -34,7 +34,7 @@ func updateLocationStats(ctx context.Context, hits []goatcounter.Hit) error {
 				continue
 			}
 
-			day := h.CreatedAt.Format("2006-01-02")
+			day := statDay(ctx, h.CreatedAt)
 			k := day + h.Location
 			v := grouped[k]
 			if v.count == 0 {
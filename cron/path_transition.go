@@ -0,0 +1,126 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package cron
+
+import (
+	"context"
+	"sort"
+
+	"zgo.at/errors"
+	"zgo.at/goatcounter"
+	"zgo.at/zdb"
+	"zgo.at/zdb/bulk"
+	"zgo.at/zstd/zint"
+)
+
+// Path transitions are stored as a count of how often a session went from
+// prev_path to path per day; prev_path is empty for the first pageview in a
+// session:
+//
+//  site |    day     | prev_path | path   | count
+// ------+------------+-----------+--------+------
+//     1 | 2020-07-28 |           | /      |    10
+//     1 | 2020-07-28 | /         | /about |     3
+//     1 | 2020-07-28 | /about    | /      |     1
+func updatePathTransitions(ctx context.Context, hits []goatcounter.Hit) error {
+	return zdb.TX(ctx, func(ctx context.Context, tx zdb.DB) error {
+		hits = append([]goatcounter.Hit{}, hits...)
+		sort.SliceStable(hits, func(i, j int) bool { return hits[i].CreatedAt.Before(hits[j].CreatedAt) })
+
+		// Group by day + prev_path + path.
+		type gt struct {
+			count    int
+			day      string
+			prevPath string
+			path     string
+		}
+		grouped := map[string]gt{}
+		last := make(map[zint.Uint128]string)
+		for _, h := range hits {
+			if h.Bot > 0 || bool(h.Event) || h.Session.IsZero() {
+				continue
+			}
+
+			prev, ok := last[h.Session]
+			if !ok {
+				var err error
+				prev, err = previousPath(ctx, tx, h)
+				if err != nil {
+					return err
+				}
+			}
+			last[h.Session] = h.Path
+			if prev == h.Path { // Reload.
+				continue
+			}
+
+			day := statDay(ctx, h.CreatedAt)
+			k := day + "\x00" + prev + "\x00" + h.Path
+			v := grouped[k]
+			if v.count == 0 {
+				v.day = day
+				v.prevPath = prev
+				v.path = h.Path
+				var err error
+				v.count, err = existingPathTransitions(ctx, tx, h.Site, day, prev, h.Path)
+				if err != nil {
+					return err
+				}
+			}
+
+			v.count += 1
+			grouped[k] = v
+		}
+
+		siteID := goatcounter.MustGetSite(ctx).ID
+		ins := bulk.NewInsert(ctx, "path_transitions", []string{"site", "day",
+			"prev_path", "path", "count"})
+		for _, v := range grouped {
+			ins.Values(siteID, v.day, v.prevPath, v.path, v.count)
+		}
+		return ins.Finish()
+	})
+}
+
+// Get the path of the pageview before h in the same session, or "" if this is
+// the first one.
+func previousPath(txctx context.Context, tx zdb.DB, h goatcounter.Hit) (string, error) {
+	var p []string
+	err := tx.SelectContext(txctx, &p, `/* previousPath */
+		select path from hits
+		where site=$1 and session2=$2 and bot=0 and event=0 and created_at<$3
+		order by created_at desc limit 1`,
+		h.Site, h.Session, h.CreatedAt.Format(zdb.Date))
+	if err != nil {
+		return "", errors.Wrap(err, "previousPath")
+	}
+	if len(p) == 0 {
+		return "", nil
+	}
+	return p[0], nil
+}
+
+func existingPathTransitions(
+	txctx context.Context, tx zdb.DB, siteID int64,
+	day, prevPath, path string,
+) (int, error) {
+
+	var c []int
+	err := tx.SelectContext(txctx, &c, `/* existingPathTransitions */
+		select count from path_transitions
+		where site=$1 and day=$2 and prev_path=$3 and path=$4 limit 1`,
+		siteID, day, prevPath, path)
+	if err != nil {
+		return 0, errors.Wrap(err, "select")
+	}
+	if len(c) == 0 {
+		return 0, nil
+	}
+
+	_, err = tx.ExecContext(txctx, `delete from path_transitions where
+		site=$1 and day=$2 and prev_path=$3 and path=$4`,
+		siteID, day, prevPath, path)
+	return c[0], errors.Wrap(err, "delete")
+}
@@ -0,0 +1,61 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package cron_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"zgo.at/goatcounter"
+	. "zgo.at/goatcounter/cron"
+	"zgo.at/goatcounter/gctest"
+	"zgo.at/zstd/zint"
+)
+
+func TestPathTransitions(t *testing.T) {
+	ctx, clean := gctest.DB(t)
+	defer clean()
+
+	site := goatcounter.MustGetSite(ctx)
+	now := time.Date(2019, 8, 31, 14, 42, 0, 0, time.UTC)
+	s1, s2 := goatcounter.TestSession, zint.Uint128{H: 1, L: 2}
+
+	err := UpdateStats(ctx, site.ID, []goatcounter.Hit{
+		{Site: site.ID, Session: s1, CreatedAt: now, Path: "/"},
+		{Site: site.ID, Session: s2, CreatedAt: now, Path: "/"},
+		{Site: site.ID, Session: s1, CreatedAt: now.Add(1 * time.Minute), Path: "/a"},
+		{Site: site.ID, Session: s1, CreatedAt: now.Add(2 * time.Minute), Path: "/a"},
+		{Site: site.ID, Session: s2, CreatedAt: now.Add(2 * time.Minute), Path: "/a"},
+		{Site: site.ID, Session: s1, CreatedAt: now.Add(3 * time.Minute), Path: "/b"},
+		{Site: site.ID, Session: s1, CreatedAt: now.Add(4 * time.Minute), Path: "click", Event: true},
+		{Site: site.ID, CreatedAt: now, Path: "/no-session"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var flow goatcounter.PathFlow
+	err = flow.Get(ctx, "/a", now, now, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `/a [{/ 2}] [{/b 1}]`
+	out := fmt.Sprintf("%s %v %v", flow.Path, flow.Prev, flow.Next)
+	if want != out {
+		t.Errorf("\nwant: %s\nout:  %s", want, out)
+	}
+
+	err = flow.Get(ctx, "/", now, now, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = `/ [{ 2}] [{/a 2}]`
+	out = fmt.Sprintf("%s %v %v", flow.Path, flow.Prev, flow.Next)
+	if want != out {
+		t.Errorf("\nwant: %s\nout:  %s", want, out)
+	}
+}
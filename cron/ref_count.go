@@ -15,12 +15,21 @@ import (
 
 func updateRefCounts(ctx context.Context, hits []goatcounter.Hit) error {
 	return zdb.TX(ctx, func(ctx context.Context, tx zdb.DB) error {
+		existing, err := prepare(ctx, tx, `/* existingRefCounts */
+			select total, total_unique from ref_counts
+			where site=$1 and hour=$2 and path=$3 and ref=$4 limit 1`)
+		if err != nil {
+			return errors.Wrap(err, "updateRefCounts")
+		}
+		defer existing.Close()
+
 		// Group by day + path + ref.
 		type gt struct {
 			total       int
 			totalUnique int
 			hour        string
 			path        string
+			pathID      *int64
 			ref         string
 			refScheme   *string
 		}
@@ -36,10 +45,11 @@ func updateRefCounts(ctx context.Context, hits []goatcounter.Hit) error {
 			if v.total == 0 {
 				v.hour = hour
 				v.path = h.Path
+				v.pathID = h.PathID
 				v.ref = h.Ref
 				v.refScheme = h.RefScheme
 				var err error
-				v.total, v.totalUnique, err = existingRefCounts(ctx, tx,
+				v.total, v.totalUnique, err = existingRefCounts(ctx, existing,
 					h.Site, hour, v.path, v.ref)
 				if err != nil {
 					return err
@@ -53,23 +63,23 @@ func updateRefCounts(ctx context.Context, hits []goatcounter.Hit) error {
 			grouped[k] = v
 		}
 
+		// SQLite has "on conflict replace" on the unique constraint to do the
+		// same as the PostgreSQL upsert.
+		query := `insert into ref_counts
+			(site, path, ref, hour, total, total_unique, ref_scheme, path_id) values ($1, $2, $3, $4, $5, $6, $7, $8)`
+		if cfg.PgSQL {
+			query += ` on conflict on constraint "ref_counts#site#path#ref#hour" do
+				update set total=$5, total_unique=$6, path_id=$8`
+		}
+		insert, err := prepare(ctx, tx, query)
+		if err != nil {
+			return errors.Wrap(err, "updateRefCounts")
+		}
+		defer insert.Close()
+
 		siteID := goatcounter.MustGetSite(ctx).ID
 		for _, v := range grouped {
-			var err error
-			if cfg.PgSQL {
-				_, err = zdb.MustGet(ctx).ExecContext(ctx, `insert into ref_counts
-				(site, path, ref, hour, total, total_unique, ref_scheme) values ($1, $2, $3, $4, $5, $6, $7)
-				on conflict on constraint "ref_counts#site#path#ref#hour" do
-					update set total=$8, total_unique=$9`,
-					siteID, v.path, v.ref, v.hour, v.total, v.totalUnique, v.refScheme,
-					v.total, v.totalUnique)
-			} else {
-				// SQLite has "on conflict replace" on the unique constraint to
-				// do the same.
-				_, err = zdb.MustGet(ctx).ExecContext(ctx, `insert into ref_counts
-					(site, path, ref, hour, total, total_unique, ref_scheme) values ($1, $2, $3, $4, $5, $6, $7)`,
-					siteID, v.path, v.ref, v.hour, v.total, v.totalUnique, v.refScheme)
-			}
+			err := insert.exec(ctx, siteID, v.path, v.ref, v.hour, v.total, v.totalUnique, v.refScheme, v.pathID)
 			if err != nil {
 				return errors.Wrap(err, "updateRefCounts ref_counts")
 			}
@@ -79,15 +89,12 @@ func updateRefCounts(ctx context.Context, hits []goatcounter.Hit) error {
 }
 
 func existingRefCounts(
-	txctx context.Context, tx zdb.DB, siteID int64,
+	txctx context.Context, existing *txStmt, siteID int64,
 	hour, path, ref string,
 ) (int, int, error) {
 
 	var t, tu int
-	row := tx.QueryRowxContext(txctx, `/* existingRefCounts */
-		select total, total_unique from ref_counts
-		where site=$1 and hour=$2 and path=$3 and ref=$4 limit 1`,
-		siteID, hour, path, ref)
+	row := existing.row(txctx, siteID, hour, path, ref)
 	if err := row.Err(); err != nil {
 		if zdb.ErrNoRows(err) {
 			return 0, 0, nil
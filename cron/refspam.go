@@ -0,0 +1,59 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package cron
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/goatcounter"
+)
+
+// RefspamURL is the URL to download the referrer spam list from, with one
+// domain per line. It's not downloaded if this is empty, in which case only the
+// list that's compiled in is used. This must be set before RunBackground().
+var RefspamURL string
+
+// RefspamInterval is how often to download the referrer spam list.
+const RefspamInterval = 24 * time.Hour
+
+var refspamClient = http.Client{Timeout: 30 * time.Second}
+
+// refspam loads the referrer spam list from the database, and downloads a new
+// one if it's older than RefspamInterval.
+func refspam(ctx context.Context) error {
+	if RefspamURL == "" {
+		return nil
+	}
+
+	updated, err := goatcounter.LoadRefspam(ctx)
+	if err != nil {
+		return errors.Errorf("cron.refspam: %w", err)
+	}
+	if goatcounter.Now().Sub(updated) < RefspamInterval {
+		return nil
+	}
+
+	resp, err := refspamClient.Get(RefspamURL)
+	if err != nil {
+		return errors.Errorf("cron.refspam: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("cron.refspam: %s: %s", RefspamURL, resp.Status)
+	}
+
+	hosts, err := goatcounter.ParseRefspam(io.LimitReader(resp.Body, 10<<20))
+	if err != nil {
+		return errors.Errorf("cron.refspam: %w", err)
+	}
+	if len(hosts) == 0 {
+		return errors.Errorf("cron.refspam: %s: list is empty", RefspamURL)
+	}
+	return goatcounter.SetRefspam(ctx, hosts)
+}
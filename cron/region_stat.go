@@ -0,0 +1,94 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package cron
+
+import (
+	"context"
+
+	"zgo.at/errors"
+	"zgo.at/goatcounter"
+	"zgo.at/zdb"
+	"zgo.at/zdb/bulk"
+)
+
+// Region stats are stored as day/location/region with a count; only hits with
+// a region are stored.
+//  site |    day     | location | region | count
+// ------+------------+----------+--------+-------
+//     1 | 2019-11-30 | US       | US-CA  |     3
+//     1 | 2019-11-30 | US       | US-NY  |     1
+//     1 | 2019-11-30 | IN       | IN-MH  |     4
+func updateRegionStats(ctx context.Context, hits []goatcounter.Hit) error {
+	return zdb.TX(ctx, func(ctx context.Context, tx zdb.DB) error {
+		// Group by day + location + region.
+		type gt struct {
+			count       int
+			countUnique int
+			day         string
+			location    string
+			region      string
+		}
+		grouped := map[string]gt{}
+		for _, h := range hits {
+			if h.Bot > 0 || h.Region == "" {
+				continue
+			}
+
+			day := statDay(ctx, h.CreatedAt)
+			k := day + h.Location + "\x00" + h.Region
+			v := grouped[k]
+			if v.count == 0 {
+				v.day = day
+				v.location, v.region = h.Location, h.Region
+				var err error
+				v.count, v.countUnique, err = existingRegionStats(ctx, tx,
+					h.Site, day, v.location, v.region)
+				if err != nil {
+					return err
+				}
+			}
+
+			v.count += 1
+			if h.FirstVisit {
+				v.countUnique += 1
+			}
+			grouped[k] = v
+		}
+
+		siteID := goatcounter.MustGetSite(ctx).ID
+		ins := bulk.NewInsert(ctx, "region_stats", []string{"site", "day",
+			"location", "region", "count", "count_unique"})
+		for _, v := range grouped {
+			ins.Values(siteID, v.day, v.location, v.region, v.count, v.countUnique)
+		}
+		return ins.Finish()
+	})
+}
+
+func existingRegionStats(
+	txctx context.Context, tx zdb.DB, siteID int64,
+	day, location, region string,
+) (int, int, error) {
+
+	var c []struct {
+		Count       int `db:"count"`
+		CountUnique int `db:"count_unique"`
+	}
+	err := tx.SelectContext(txctx, &c, `/* existingRegionStats */
+		select count, count_unique from region_stats
+		where site=$1 and day=$2 and location=$3 and region=$4 limit 1`,
+		siteID, day, location, region)
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "select")
+	}
+	if len(c) == 0 {
+		return 0, 0, nil
+	}
+
+	_, err = tx.ExecContext(txctx, `delete from region_stats where
+		site=$1 and day=$2 and location=$3 and region=$4`,
+		siteID, day, location, region)
+	return c[0].Count, c[0].CountUnique, errors.Wrap(err, "delete")
+}
@@ -0,0 +1,64 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package cron_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"zgo.at/goatcounter"
+	. "zgo.at/goatcounter/cron"
+	"zgo.at/goatcounter/gctest"
+)
+
+func TestRegionStats(t *testing.T) {
+	ctx, clean := gctest.DB(t)
+	defer clean()
+
+	site := goatcounter.MustGetSite(ctx)
+	now := time.Date(2019, 8, 31, 14, 42, 0, 0, time.UTC)
+
+	err := UpdateStats(ctx, site.ID, []goatcounter.Hit{
+		{Site: site.ID, CreatedAt: now, Location: "IN", Region: "IN-MH", FirstVisit: true},
+		{Site: site.ID, CreatedAt: now, Location: "IN", Region: "IN-MH"},
+		{Site: site.ID, CreatedAt: now, Location: "IN", Region: "IN-KA", FirstVisit: true},
+		{Site: site.ID, CreatedAt: now, Location: "IN"}, // No region in GeoIP database.
+		{Site: site.ID, CreatedAt: now, Location: "IN", Region: "IN-DL", Bot: 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var stats goatcounter.Stats
+	err = stats.ListLocation(ctx, "India", now, now, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{false [{IN-KA 1 1 <nil>} {IN-MH 2 1 <nil>}]}`
+	out := fmt.Sprintf("%v", stats)
+	if want != out {
+		t.Errorf("\nwant: %s\nout:  %s", want, out)
+	}
+
+	// Update existing.
+	err = UpdateStats(ctx, site.ID, []goatcounter.Hit{
+		{Site: site.ID, CreatedAt: now, Location: "IN", Region: "IN-MH", FirstVisit: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats = goatcounter.Stats{}
+	err = stats.ListLocation(ctx, "India", now, now, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = `{false [{IN-MH 3 2 <nil>} {IN-KA 1 1 <nil>}]}`
+	out = fmt.Sprintf("%v", stats)
+	if want != out {
+		t.Errorf("\nwant: %s\nout:  %s", want, out)
+	}
+}
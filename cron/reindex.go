@@ -0,0 +1,247 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package cron
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/goatcounter"
+	"zgo.at/zdb"
+	"zgo.at/zstd/zstring"
+)
+
+// ReindexTables are all the tables Reindex() can recreate.
+var ReindexTables = []string{"hit_stats", "hit_counts", "browser_stats",
+	"system_stats", "location_stats", "region_stats", "city_stats", "language_stats",
+	"ref_counts", "size_stats", "path_transitions", "bot_stats", "all"}
+
+// hourlyTables store the statistics per hour in UTC; all other tables store
+// them per day in the site's timezone (see statDay()).
+var hourlyTables = []string{"hit_stats", "hit_counts", "ref_counts"}
+
+// DailyTables gets the tables from ReindexTables which store the statistics per
+// day in the site's timezone, and which need to be recreated if the timezone
+// changes.
+func DailyTables() []string {
+	var t []string
+	for _, tt := range ReindexTables {
+		if tt != "all" && !zstring.Contains(hourlyTables, tt) {
+			t = append(t, tt)
+		}
+	}
+	return t
+}
+
+// statDay gets the day of t in the site's timezone, for tables which store the
+// statistics per day.
+func statDay(ctx context.Context, t time.Time) string {
+	return t.In(goatcounter.MustGetSite(ctx).Settings.Timezone.Loc()).Format("2006-01-02")
+}
+
+// ErrReindexRunning is returned by Reindex() if it's already running for the
+// site.
+var ErrReindexRunning = errors.New("a reindex is already running for this site")
+
+// reindexing are the sites for which Reindex() is running.
+var reindexing = struct {
+	sync.Mutex
+	sites map[int64]struct{}
+}{sites: make(map[int64]struct{})}
+
+// ReindexRunning reports if Reindex() is running for the site.
+func ReindexRunning(siteID int64) bool {
+	reindexing.Lock()
+	defer reindexing.Unlock()
+	_, ok := reindexing.sites[siteID]
+	return ok
+}
+
+// Reindex recreates the statistics in the given tables for the site from the
+// hits between first and last (inclusive), one day at a time.
+//
+// It pauses for the given duration after every day, and calls progress (if not
+// nil) with the number of hits for every day. Tables with statistics per day in
+// the site's timezone are recreated separately from the tables with
+// statistics per hour in UTC, so progress may be called twice for the same day.
+//
+// Only one Reindex can run for a site at a time; ErrReindexRunning is returned
+// if it's already running. Days for which the hits were already removed (see
+// SiteSettings.DataRetention and Downsample) are left as they are.
+func Reindex(
+	ctx context.Context, site goatcounter.Site, first, last time.Time, tables []string,
+	pause time.Duration, progress func(day time.Time, hits int),
+) error {
+	reindexing.Lock()
+	if _, ok := reindexing.sites[site.ID]; ok {
+		reindexing.Unlock()
+		return ErrReindexRunning
+	}
+	reindexing.sites[site.ID] = struct{}{}
+	reindexing.Unlock()
+	defer func() {
+		reindexing.Lock()
+		delete(reindexing.sites, site.ID)
+		reindexing.Unlock()
+	}()
+
+	oldest, err := firstStored(ctx, site)
+	if err != nil {
+		return errors.Wrap(err, "cron.Reindex")
+	}
+	if oldest.IsZero() { // No hits.
+		return nil
+	}
+	if first.Before(oldest) {
+		first = oldest
+	}
+
+	if zstring.Contains(tables, "all") {
+		tables = append(append([]string{}, hourlyTables...), DailyTables()...)
+	}
+
+	var hourly, daily []string
+	for _, t := range tables {
+		if zstring.Contains(hourlyTables, t) {
+			hourly = append(hourly, t)
+		} else {
+			daily = append(daily, t)
+		}
+	}
+
+	err = reindexDays(ctx, site, first, last, hourly, time.UTC, pause, progress)
+	if err != nil {
+		return err
+	}
+	err = reindexDays(ctx, site, first, last, daily, site.Settings.Timezone.Loc(), pause, progress)
+	if err != nil {
+		return err
+	}
+
+	if zstring.Contains(tables, "hit_counts") {
+		err := goatcounter.InvalidateRollups(ctx, site.ID, first)
+		if err != nil {
+			return errors.Wrap(err, "cron.Reindex")
+		}
+	}
+	return nil
+}
+
+// firstStored gets the time from which all the hits for the site are still
+// stored, or a zero time if there are no hits.
+//
+// Recreating the statistics for days before this would remove them, as the hits
+// they were created from are gone.
+func firstStored(ctx context.Context, site goatcounter.Site) (time.Time, error) {
+	var oldest []time.Time
+	err := zdb.MustGet(ctx).SelectContext(ctx, &oldest,
+		`select created_at from hits where site=$1 order by created_at asc limit 1`, site.ID)
+	if err != nil || len(oldest) == 0 {
+		return time.Time{}, err
+	}
+
+	// Skip the first day, as the hits from the start of it may be gone.
+	if site.Settings.DataRetention > 0 || site.Settings.Downsample > 0 {
+		return oldest[0].In(site.Settings.Timezone.Loc()).AddDate(0, 0, 1), nil
+	}
+	// Start a day earlier, so that the day with the first hit is included in
+	// both UTC and the site's timezone.
+	return oldest[0].Add(-24 * time.Hour), nil
+}
+
+// Rebucket recreates the tables with statistics per day after the site's
+// timezone changed, so that they use the days in the new timezone.
+func Rebucket(ctx context.Context, site goatcounter.Site, pause time.Duration) error {
+	// Pageviews can be imported from before the site was created, so start at
+	// the first pageview.
+	return Reindex(ctx, site, time.Time{}, goatcounter.Now(), DailyTables(), pause, nil)
+}
+
+// reindexDays recreates the tables for every day between first and last in
+// loc.
+func reindexDays(
+	ctx context.Context, site goatcounter.Site, first, last time.Time, tables []string,
+	loc *time.Location, pause time.Duration, progress func(day time.Time, hits int),
+) error {
+	if len(tables) == 0 {
+		return nil
+	}
+	db := zdb.MustGet(ctx)
+
+	first = first.In(loc)
+	first = time.Date(first.Year(), first.Month(), first.Day(), 0, 0, 0, 0, loc)
+
+	now := goatcounter.Now().In(loc)
+	now = time.Date(now.Year(), now.Month(), now.Day(), 23, 59, 59, 0, loc)
+	for day := first; !day.After(now) && !day.After(last); day = day.AddDate(0, 0, 1) {
+		var hits []goatcounter.Hit
+		err := db.SelectContext(ctx, &hits,
+			`select * from hits where site=$1 and created_at >= $2 and created_at <= $3`,
+			site.ID, day.UTC().Format(zdb.Date), day.AddDate(0, 0, 1).Add(-time.Second).UTC().Format(zdb.Date))
+		if err != nil {
+			return errors.Wrap(err, "cron.Reindex")
+		}
+		if progress != nil {
+			progress(day, len(hits))
+		}
+
+		err = clearDay(ctx, tables, day.Format("2006-01-02"), site.ID)
+		if err != nil {
+			return errors.Wrap(err, "cron.Reindex")
+		}
+		err = ReindexStats(ctx, hits, tables)
+		if err != nil {
+			return err
+		}
+
+		if pause > 0 {
+			time.Sleep(pause)
+		}
+	}
+	return nil
+}
+
+// clearDay removes the statistics in the tables for this day.
+func clearDay(ctx context.Context, tables []string, day string, siteID int64) error {
+	var (
+		db    = zdb.MustGet(ctx)
+		where = fmt.Sprintf(" where site=%d and day='%s'", siteID, day)
+		hour  = fmt.Sprintf(" where site=%d and cast(hour as varchar) like '%s %%'", siteID, day)
+	)
+
+	var query []string
+	for _, t := range tables {
+		switch t {
+		case "hit_counts", "ref_counts":
+			query = append(query, `delete from `+t+hour)
+		case "all":
+			for _, tt := range ReindexTables {
+				switch tt {
+				case "all":
+				case "hit_counts", "ref_counts":
+					query = append(query, `delete from `+tt+hour)
+				default:
+					query = append(query, `delete from `+tt+where)
+				}
+			}
+		default:
+			if !zstring.Contains(ReindexTables, t) {
+				return errors.Errorf("clearDay: unknown table %q", t)
+			}
+			query = append(query, `delete from `+t+where)
+		}
+	}
+
+	for _, q := range query {
+		_, err := db.ExecContext(ctx, q)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package cron_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"zgo.at/goatcounter"
+	. "zgo.at/goatcounter/cron"
+	"zgo.at/goatcounter/gctest"
+	"zgo.at/tz"
+	"zgo.at/zdb"
+)
+
+func TestRebucket(t *testing.T) {
+	ctx, clean := gctest.DB(t)
+	defer clean()
+
+	defer gctest.SwapNow(t, "2020-06-19 12:00:00")()
+
+	ctx, site := gctest.Site(ctx, t, goatcounter.Site{
+		CreatedAt: time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC),
+		Settings:  goatcounter.SiteSettings{Timezone: tz.MustNew("", "UTC")},
+	})
+	gctest.StoreHits(ctx, t,
+		goatcounter.Hit{Site: site.ID, Path: "/a", Language: "en", FirstVisit: true,
+			CreatedAt: time.Date(2020, 6, 18, 10, 0, 0, 0, time.UTC)},
+		goatcounter.Hit{Site: site.ID, Path: "/a", Language: "de", FirstVisit: true,
+			CreatedAt: time.Date(2020, 6, 18, 20, 0, 0, 0, time.UTC)},
+	)
+
+	list := func() string {
+		var out []string
+		for _, d := range []int{18, 19} {
+			day := time.Date(2020, 6, d, 0, 0, 0, 0, time.UTC)
+			var stats goatcounter.Stats
+			err := stats.ListLanguages(ctx, day, day, "", 10, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out = append(out, fmt.Sprintf("%d: %v", d, stats.Stats))
+		}
+		return fmt.Sprintf("%s", out)
+	}
+
+	want := `[18: [{de 1 1 <nil>} {en 1 1 <nil>}] 19: []]`
+	if out := list(); out != want {
+		t.Errorf("before\nwant: %s\nout:  %s", want, out)
+	}
+
+	// 20:00 UTC is 05:00 the next day in Tokyo.
+	site.Settings.Timezone = tz.MustNew("", "Asia/Tokyo")
+	err := site.Update(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = Rebucket(ctx, site, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want = `[18: [{en 1 1 <nil>}] 19: [{de 1 1 <nil>}]]`
+	if out := list(); out != want {
+		t.Errorf("after\nwant: %s\nout:  %s", want, out)
+	}
+}
+
+func TestReindexOldest(t *testing.T) {
+	ctx, clean := gctest.DB(t)
+	defer clean()
+
+	defer gctest.SwapNow(t, "2020-06-19 12:00:00")()
+
+	ctx, site := gctest.Site(ctx, t, goatcounter.Site{
+		CreatedAt: time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC),
+		Settings:  goatcounter.SiteSettings{Timezone: tz.MustNew("", "UTC"), DataRetention: 31},
+	})
+	gctest.StoreHits(ctx, t, goatcounter.Hit{Site: site.ID, Path: "/a", Language: "en",
+		FirstVisit: true, CreatedAt: time.Date(2020, 6, 18, 10, 0, 0, 0, time.UTC)})
+
+	// The hits for this day were already removed.
+	_, err := zdb.MustGet(ctx).ExecContext(ctx, `insert into language_stats
+		(site, day, language, count, count_unique) values ($1, '2020-06-17', 'de', 1, 1)`, site.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = Reindex(ctx, site, site.CreatedAt, goatcounter.Now(), []string{"language_stats"}, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var stats goatcounter.Stats
+	day := time.Date(2020, 6, 17, 0, 0, 0, 0, time.UTC)
+	err = stats.ListLanguages(ctx, day, day, "", 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats.Stats) != 1 || stats.Stats[0].Name != "de" {
+		t.Errorf("stats for 2020-06-17 removed: %v", stats.Stats)
+	}
+}
@@ -40,7 +40,7 @@ func updateSizeStats(ctx context.Context, hits []goatcounter.Hit) error {
 				width = int(h.Size[0]) // TODO: apply scaling?
 			}
 
-			day := h.CreatedAt.Format("2006-01-02")
+			day := statDay(ctx, h.CreatedAt)
 			k := fmt.Sprintf("%s%d", day, width)
 			v := grouped[k]
 			if v.count == 0 {
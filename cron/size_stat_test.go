@@ -34,7 +34,7 @@ func TestSizeStats(t *testing.T) {
 	}
 
 	var stats goatcounter.Stats
-	err = stats.ListSizes(ctx, now, now)
+	err = stats.ListSizes(ctx, now, now, "")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -64,7 +64,7 @@ func TestSizeStats(t *testing.T) {
 	}
 
 	stats = goatcounter.Stats{}
-	err = stats.ListSizes(ctx, now, now)
+	err = stats.ListSizes(ctx, now, now, "")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -8,7 +8,6 @@ import (
 	"context"
 
 	"zgo.at/errors"
-	"zgo.at/gadget"
 	"zgo.at/goatcounter"
 	"zgo.at/zdb"
 	"zgo.at/zdb/bulk"
@@ -42,7 +41,7 @@ func updateSystemStats(ctx context.Context, hits []goatcounter.Hit) error {
 				continue
 			}
 
-			day := h.CreatedAt.Format("2006-01-02")
+			day := statDay(ctx, h.CreatedAt)
 			k := day + system + version
 			v := grouped[k]
 			if v.count == 0 {
@@ -101,6 +100,6 @@ func existingSystemStats(
 }
 
 func getSystem(uaHeader string) (string, string) {
-	ua := gadget.Parse(uaHeader)
-	return ua.OSName, ua.OSVersion
+	ua := goatcounter.ParseUserAgent(uaHeader)
+	return ua.System, ua.SystemVersion
 }
@@ -14,8 +14,10 @@ import (
 	"zgo.at/errors"
 	"zgo.at/goatcounter"
 	"zgo.at/goatcounter/acme"
+	"zgo.at/goatcounter/statsd"
 	"zgo.at/zdb"
 	"zgo.at/zlog"
+	"zgo.at/zstd/zsync"
 )
 
 func oldExports(ctx context.Context) error {
@@ -61,14 +63,40 @@ func DataRetention(ctx context.Context) error {
 		return err
 	}
 
+	// Drop the entire partition if it's past the retention of all sites.
+	keep := 0
 	for _, s := range sites {
-		if s.Settings.DataRetention <= 0 {
-			continue
+		k := s.Settings.DataRetention
+		if s.Settings.Downsample > 0 && (k <= 0 || s.Settings.Downsample < k) {
+			k = s.Settings.Downsample
 		}
-
-		err = s.DeleteOlderThan(ctx, s.Settings.DataRetention)
+		if k <= 0 {
+			keep = 0
+			break
+		}
+		if k > keep {
+			keep = k
+		}
+	}
+	if keep > 0 {
+		err := goatcounter.DropHitPartitions(ctx, keep)
 		if err != nil {
-			zlog.Module("cron").Field("site", s.ID).Error(err)
+			zlog.Module("cron").Error(err)
+		}
+	}
+
+	for _, s := range sites {
+		if s.Settings.Downsample > 0 {
+			err = s.DeleteHitsOlderThan(ctx, s.Settings.Downsample)
+			if err != nil {
+				zlog.Module("cron").Field("site", s.ID).Error(err)
+			}
+		}
+		if s.Settings.DataRetention > 0 {
+			err = s.DeleteOlderThan(ctx, s.Settings.DataRetention)
+			if err != nil {
+				zlog.Module("cron").Field("site", s.ID).Error(err)
+			}
 		}
 	}
 
@@ -78,17 +106,23 @@ func DataRetention(ctx context.Context) error {
 func persistAndStat(ctx context.Context) error {
 	l := zlog.Module("cron")
 
+	start := time.Now()
 	hits, err := goatcounter.Memstore.Persist(ctx)
 	if err != nil {
 		return err
 	}
+	statsd.Count("persist.hits", int64(len(hits)))
 	if len(hits) > 0 {
 		l = l.Since("memstore")
 	}
 
-	grouped := make(map[int64][]goatcounter.Hit)
+	var (
+		grouped = make(map[int64][]goatcounter.Hit)
+		bots    = make(map[int64][]goatcounter.Hit)
+	)
 	for _, h := range hits {
 		if h.Bot > 0 {
+			bots[h.Site] = append(bots[h.Site], h)
 			continue
 		}
 		grouped[h.Site] = append(grouped[h.Site], h)
@@ -103,9 +137,17 @@ func persistAndStat(ctx context.Context) error {
 		}
 	}
 
+	for siteID, hits := range bots {
+		err := UpdateBotStats(ctx, siteID, hits)
+		if err != nil {
+			l.Field("site", siteID).Error(err)
+		}
+	}
+
 	if len(hits) > 0 {
 		l.Since("stats").FieldsSince().Debugf("persisted %d hits", len(hits))
 	}
+	statsd.Timing("persist.duration", time.Since(start))
 	return err
 }
 
@@ -117,6 +159,11 @@ func UpdateStats(ctx context.Context, siteID int64, hits []goatcounter.Hit) erro
 	}
 	ctx = goatcounter.WithSite(ctx, &site)
 
+	hits = site.Settings.PathGroups.Apply(hits)
+	err = goatcounter.PathIDs(ctx, hits)
+	if err != nil {
+		return errors.Wrapf(err, "paths: site %d", siteID)
+	}
 	err = updateHitStats(ctx, hits)
 	if err != nil {
 		return errors.Wrapf(err, "hit_stat: site %d", siteID)
@@ -125,6 +172,10 @@ func UpdateStats(ctx context.Context, siteID int64, hits []goatcounter.Hit) erro
 	if err != nil {
 		return errors.Wrapf(err, "hit_count: site %d", siteID)
 	}
+	err = invalidateRollups(ctx, siteID, hits)
+	if err != nil {
+		return errors.Wrapf(err, "rollups: site %d", siteID)
+	}
 	err = updateBrowserStats(ctx, hits)
 	if err != nil {
 		return errors.Wrapf(err, "browser_stat: site %d", siteID)
@@ -137,6 +188,18 @@ func UpdateStats(ctx context.Context, siteID int64, hits []goatcounter.Hit) erro
 	if err != nil {
 		return errors.Wrapf(err, "location_stat: site %d", siteID)
 	}
+	err = updateRegionStats(ctx, hits)
+	if err != nil {
+		return errors.Wrapf(err, "region_stat: site %d", siteID)
+	}
+	err = updateCityStats(ctx, hits)
+	if err != nil {
+		return errors.Wrapf(err, "city_stat: site %d", siteID)
+	}
+	err = updateLanguageStats(ctx, hits)
+	if err != nil {
+		return errors.Wrapf(err, "language_stat: site %d", siteID)
+	}
 	err = updateRefCounts(ctx, hits)
 	if err != nil {
 		return errors.Wrapf(err, "ref_count: site %d", siteID)
@@ -145,6 +208,14 @@ func UpdateStats(ctx context.Context, siteID int64, hits []goatcounter.Hit) erro
 	if err != nil {
 		return errors.Wrapf(err, "size_stat: site %d", siteID)
 	}
+	err = updatePathTransitions(ctx, hits)
+	if err != nil {
+		return errors.Wrapf(err, "path_transition: site %d", siteID)
+	}
+	err = updateBotStats(ctx, hits)
+	if err != nil {
+		return errors.Wrapf(err, "bot_stat: site %d", siteID)
+	}
 
 	if !site.ReceivedData {
 		_, err = zdb.MustGet(ctx).ExecContext(ctx,
@@ -152,10 +223,23 @@ func UpdateStats(ctx context.Context, siteID int64, hits []goatcounter.Hit) erro
 		if err != nil {
 			return errors.Wrapf(err, "update received_data: site %d", siteID)
 		}
+		goatcounter.ClearSiteCache()
 	}
 	return nil
 }
 
+// UpdateBotStats updates the statistics for the pageviews from bots, which
+// aren't included in UpdateStats() when persisting.
+func UpdateBotStats(ctx context.Context, siteID int64, hits []goatcounter.Hit) error {
+	var site goatcounter.Site
+	err := site.ByID(ctx, siteID)
+	if err != nil {
+		return err
+	}
+	err = updateBotStats(goatcounter.WithSite(ctx, &site), hits)
+	return errors.Wrapf(err, "bot_stat: site %d", siteID)
+}
+
 func ReindexStats(ctx context.Context, hits []goatcounter.Hit, tables []string) error {
 	grouped := make(map[int64][]goatcounter.Hit)
 	for _, h := range hits {
@@ -173,10 +257,17 @@ func ReindexStats(ctx context.Context, hits []goatcounter.Hit, tables []string)
 		}
 		ctx = goatcounter.WithSite(ctx, &site)
 
+		// UpdateStats() already groups the paths.
+		raw := hits
+		hits := site.Settings.PathGroups.Apply(hits)
+		err = goatcounter.PathIDs(ctx, hits)
+		if err != nil {
+			return errors.Errorf("cron.ReindexStats: %w", err)
+		}
 		for _, t := range tables {
 			switch t {
 			case "all":
-				err = UpdateStats(ctx, siteID, hits)
+				err = UpdateStats(ctx, siteID, raw)
 			case "hit_stats":
 				err = updateHitStats(ctx, hits)
 			case "hit_counts":
@@ -187,10 +278,20 @@ func ReindexStats(ctx context.Context, hits []goatcounter.Hit, tables []string)
 				err = updateSystemStats(ctx, hits)
 			case "location_stats":
 				err = updateLocationStats(ctx, hits)
+			case "region_stats":
+				err = updateRegionStats(ctx, hits)
+			case "city_stats":
+				err = updateCityStats(ctx, hits)
+			case "language_stats":
+				err = updateLanguageStats(ctx, hits)
 			case "ref_counts":
 				err = updateRefCounts(ctx, hits)
 			case "size_stats":
 				err = updateSizeStats(ctx, hits)
+			case "path_transitions":
+				err = updatePathTransitions(ctx, hits)
+			case "bot_stats":
+				err = updateBotStats(ctx, hits)
 			}
 			if err != nil {
 				return err
@@ -237,28 +338,101 @@ func renewACME(ctx context.Context) error {
 	return nil
 }
 
-func vacuumDeleted(ctx context.Context) error {
+// VacuumDeleted permanently removes sites that were soft-deleted more than 7
+// days ago, along with all their data.
+func VacuumDeleted(ctx context.Context) error {
 	var sites goatcounter.Sites
 	err := sites.OldSoftDeleted(ctx)
 	if err != nil {
-		return errors.Errorf("vacuumDeleted: %w", err)
+		return errors.Errorf("VacuumDeleted: %w", err)
 	}
 
 	for _, s := range sites {
 		zlog.Module("vacuum").Printf("vacuum site %s/%d", s.Code, s.ID)
 
 		err := zdb.TX(ctx, func(ctx context.Context, db zdb.DB) error {
-			for _, t := range []string{"browser_stats", "system_stats", "hit_stats", "hits", "location_stats", "size_stats", "users"} {
+			for _, t := range []string{"segments", "annotations", "alert_rules", "anomalies", "api_tokens"} {
+				_, err := db.ExecContext(ctx, fmt.Sprintf(`delete from %s where site_id=$1`, t), s.ID)
+				if err != nil {
+					return errors.Errorf("%s: %w", t, err)
+				}
+			}
+			_, err := db.ExecContext(ctx, `delete from user_sessions where user_id in (select id from users where site=$1)`, s.ID)
+			if err != nil {
+				return errors.Errorf("user_sessions: %w", err)
+			}
+			for _, t := range []string{"browser_stats", "system_stats", "hit_stats", "hits", "hit_counts", "ref_counts", "location_stats", "region_stats", "city_stats", "language_stats", "size_stats", "path_transitions", "bot_stats", "hit_rollups", "users"} {
 				_, err := db.ExecContext(ctx, fmt.Sprintf(`delete from %s where site=%d`, t, s.ID))
 				if err != nil {
 					return errors.Errorf("%s: %w", t, err)
 				}
 			}
-			_, err := db.ExecContext(ctx, `delete from sites where id=$1`, s.ID)
+			// Roles are referenced by users and api_tokens.
+			for _, t := range []string{"roles", "paths"} {
+				_, err := db.ExecContext(ctx, fmt.Sprintf(`delete from %s where site_id=$1`, t), s.ID)
+				if err != nil {
+					return errors.Errorf("%s: %w", t, err)
+				}
+			}
+			_, err = db.ExecContext(ctx, `delete from sites where id=$1`, s.ID)
 			return err
 		})
 		if err != nil {
-			return errors.Errorf("vacuumDeleted: %w", err)
+			return errors.Errorf("VacuumDeleted: %w", err)
+		}
+	}
+	return nil
+}
+
+// pathsDone is set once there is nothing left for backfillPaths to do, so it
+// doesn't need to scan the tables every minute.
+var pathsDone = zsync.NewAtomicInt(0)
+
+func backfillPaths(ctx context.Context) error {
+	if pathsDone.Value() == 1 {
+		return nil
+	}
+	n, err := goatcounter.BackfillPaths(ctx, 1000)
+	if err != nil {
+		return errors.Errorf("backfillPaths: %w", err)
+	}
+	if n == 0 {
+		pathsDone.Set(1)
+	}
+	return nil
+}
+
+func hitPartitions(ctx context.Context) error {
+	return goatcounter.CreateHitPartitions(ctx, 2)
+}
+
+// invalidateRollups removes the rollups if there are hits for days that already
+// have a rollup, such as from an import.
+func invalidateRollups(ctx context.Context, siteID int64, hits []goatcounter.Hit) error {
+	today := goatcounter.Now().Truncate(24 * time.Hour)
+	first := today
+	for _, h := range hits {
+		if h.CreatedAt.Before(first) {
+			first = h.CreatedAt
+		}
+	}
+	if !first.Before(today) {
+		return nil
+	}
+	return goatcounter.InvalidateRollups(ctx, siteID, first)
+}
+
+func rollups(ctx context.Context) error {
+	sites, err := goatcounter.RollupSites(ctx)
+	if err != nil {
+		return err
+	}
+
+	l := zlog.Module("cron")
+	for _, id := range sites {
+		err := goatcounter.UpdateRollups(ctx, id)
+		if err != nil {
+			l.Error(err)
 		}
 	}
 	return nil
@@ -267,5 +441,6 @@ func vacuumDeleted(ctx context.Context) error {
 func sessions(ctx context.Context) error {
 	goatcounter.Memstore.EvictSessions()
 	goatcounter.Memstore.RefreshSalt()
+	goatcounter.Memstore.StoreSessions(zdb.MustGet(ctx))
 	return nil
 }
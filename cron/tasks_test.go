@@ -63,3 +63,103 @@ func TestDataRetention(t *testing.T) {
 		t.Errorf("\ngot:  %s\nwant: %s", out, want)
 	}
 }
+
+func TestDataRetentionDownsample(t *testing.T) {
+	ctx, clean := gctest.DB(t)
+	defer clean()
+
+	site := goatcounter.Site{Code: "bbbb", Plan: goatcounter.PlanPersonal,
+		Settings: goatcounter.SiteSettings{Downsample: 30}}
+	err := site.Insert(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx = goatcounter.WithSite(ctx, &site)
+
+	now := time.Now().UTC()
+	past := now.Add(-40 * 24 * time.Hour)
+	gctest.StoreHits(ctx, t, []goatcounter.Hit{
+		{Site: site.ID, CreatedAt: now, Path: "/a", FirstVisit: zdb.Bool(true)},
+		{Site: site.ID, CreatedAt: past, Path: "/a", FirstVisit: zdb.Bool(true)},
+	}...)
+
+	err = DataRetention(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var hits goatcounter.Hits
+	_, err = hits.List(ctx, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hits) != 1 {
+		t.Errorf("len(hits) is %d\n%v", len(hits), hits)
+	}
+
+	var stats goatcounter.HitStats
+	display, _, _, err := stats.List(ctx, past.Add(-1*24*time.Hour), now, "", nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if display != 2 {
+		t.Errorf("stats not kept: %d", display)
+	}
+}
+
+func TestVacuumDeleted(t *testing.T) {
+	ctx, clean := gctest.DB(t)
+	defer clean()
+
+	site := goatcounter.Site{Code: "bbbb", Plan: goatcounter.PlanPersonal}
+	err := site.Insert(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx = goatcounter.WithSite(ctx, &site)
+
+	user := goatcounter.User{Site: site.ID, Email: "test@example.com", Password: []byte("coconuts")}
+	err = user.Insert(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx = goatcounter.WithUser(ctx, &user)
+
+	role := goatcounter.Role{Name: "stats", Permissions: goatcounter.PermissionSet{goatcounter.PermStats}}
+	err = role.Insert(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := goatcounter.APIToken{Name: "test", RoleID: &role.ID}
+	err = token.Insert(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = zdb.MustGet(ctx).ExecContext(ctx, `update users set role_id=$1 where id=$2`, role.ID, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gctest.StoreHits(ctx, t, goatcounter.Hit{Site: site.ID, Path: "/a"})
+
+	_, err = zdb.MustGet(ctx).ExecContext(ctx, `update sites set state=$1, updated_at=$2 where id=$3`,
+		goatcounter.StateDeleted, time.Now().UTC().Add(-8*24*time.Hour).Format(zdb.Date), site.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = VacuumDeleted(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tbl := range []string{"sites where id", "users where site", "roles where site_id", "api_tokens where site_id"} {
+		var n int
+		err := zdb.MustGet(ctx).GetContext(ctx, &n, `select count(*) from `+tbl+`=$1`, site.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 0 {
+			t.Errorf("%s: %d rows left", tbl, n)
+		}
+	}
+}
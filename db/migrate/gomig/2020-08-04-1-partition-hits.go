@@ -0,0 +1,91 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package gomig
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/zdb"
+	"zgo.at/zlog"
+)
+
+// PartitionHits converts the hits table to a table partitioned by month on
+// PostgreSQL, so old pageviews can be removed by dropping the partition.
+//
+// This does nothing on SQLite, or on PostgreSQL older than 11.
+func PartitionHits(db zdb.DB) error {
+	if !zdb.PgSQL(db) {
+		return nil
+	}
+	ctx := context.Background()
+
+	var version int
+	err := db.GetContext(ctx, &version, `select current_setting('server_version_num')::int`)
+	if err != nil {
+		return err
+	}
+	if version < 110000 {
+		zlog.Printf("2020-08-04-1-partition-hits: not partitioning the hits table as this needs PostgreSQL 11 or newer")
+		return nil
+	}
+	zlog.Printf("2020-08-04-1-partition-hits: this may take a while, depending on the table size")
+
+	// Indexes are dropped with the old table, so get the definitions to create
+	// them on the new table.
+	var indexes []string
+	err = db.SelectContext(ctx, &indexes,
+		`select indexdef from pg_indexes where tablename='hits' and indexname != 'hits_pkey'`)
+	if err != nil {
+		return err
+	}
+	var seq string
+	err = db.GetContext(ctx, &seq, `select pg_get_serial_sequence('hits', 'id')`)
+	if err != nil {
+		return err
+	}
+	var first *time.Time
+	err = db.GetContext(ctx, &first, `select min(created_at) from hits`)
+	if err != nil {
+		return err
+	}
+
+	query := []string{
+		`alter table hits rename to hits_old`,
+		`create table hits (like hits_old including defaults including constraints) partition by range (created_at)`,
+		`alter table hits add primary key (id, created_at)`,
+		`create table hits_default partition of hits default`,
+	}
+
+	// Partitions for every month with data, and the next two months; cron
+	// creates new ones after that.
+	now := time.Now().UTC()
+	start := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	if first != nil && first.Before(start) {
+		start = time.Date(first.Year(), first.Month(), 1, 0, 0, 0, 0, time.UTC)
+	}
+	for m := start; m.Before(now.AddDate(0, 3, 0)); m = m.AddDate(0, 1, 0) {
+		query = append(query, fmt.Sprintf(
+			`create table "hits_%s" partition of hits for values from ('%s') to ('%s')`,
+			m.Format("2006_01"), m.Format("2006-01-02"), m.AddDate(0, 1, 0).Format("2006-01-02")))
+	}
+
+	query = append(query,
+		`insert into hits select * from hits_old`,
+		fmt.Sprintf(`alter sequence %s owned by none`, seq),
+		`drop table hits_old`,
+		fmt.Sprintf(`alter sequence %s owned by hits.id`, seq))
+	query = append(query, indexes...)
+
+	for _, q := range query {
+		_, err := db.ExecContext(ctx, q)
+		if err != nil {
+			return errors.Errorf("%s: %w", q, err)
+		}
+	}
+	return nil
+}
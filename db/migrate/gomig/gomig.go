@@ -6,6 +6,7 @@ package gomig
 
 import (
 	"context"
+	"sort"
 
 	"zgo.at/errors"
 	"zgo.at/zdb"
@@ -14,8 +15,19 @@ import (
 )
 
 var goMigrations = map[string]func(zdb.DB) error{
-	"2020-03-27-1-isbot":   IsBot,
-	"2020-07-22-1-memsess": MemSess,
+	"2020-03-27-1-isbot":          IsBot,
+	"2020-07-22-1-memsess":        MemSess,
+	"2020-08-04-1-partition-hits": PartitionHits,
+}
+
+// Names gets the names of all Go migrations, sorted by name.
+func Names() []string {
+	names := make([]string, 0, len(goMigrations))
+	for k := range goMigrations {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
 }
 
 func Run(db zdb.DB) error {
@@ -0,0 +1,5 @@
+begin;
+	alter table hits add column duration integer;
+
+	insert into version values('2020-07-25-1-duration');
+commit;
@@ -0,0 +1,17 @@
+begin;
+	create table roles (
+		role_id        serial         primary key,
+		site_id        integer        not null,
+		name           varchar        not null,
+		permissions    jsonb          not null,
+		created_at     timestamp      not null,
+
+		foreign key (site_id) references sites(id) on delete restrict on update restrict
+	);
+	create unique index "roles#site_id#name" on roles(site_id, name);
+
+	alter table api_tokens add column role_id integer null;
+	alter table users add column role_id integer null;
+
+	insert into version values('2020-07-27-1-roles');
+commit;
@@ -0,0 +1,16 @@
+begin;
+	create table path_transitions (
+		site           integer        not null                 check(site > 0),
+
+		day            date           not null,
+		prev_path      varchar        not null,
+		path           varchar        not null,
+		count          int            not null,
+
+		foreign key (site) references sites(id) on delete restrict on update restrict
+	);
+	create index "path_transitions#site#day#path" on path_transitions(site, day, path);
+	create index "path_transitions#site#day#prev_path" on path_transitions(site, day, prev_path);
+
+	insert into version values('2020-07-28-1-path-transitions');
+commit;
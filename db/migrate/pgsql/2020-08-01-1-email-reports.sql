@@ -0,0 +1,6 @@
+begin;
+	alter table users add column email_reports   varchar    not null default '';
+	alter table users add column email_report_at timestamp  null;
+
+	insert into version values('2020-08-01-1-email-reports');
+commit;
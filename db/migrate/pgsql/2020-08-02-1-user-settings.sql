@@ -0,0 +1,5 @@
+begin;
+	alter table users add column settings json not null default '{}';
+
+	insert into version values('2020-08-02-1-user-settings');
+commit;
@@ -0,0 +1,24 @@
+begin;
+	create table shared_hits (
+		id             serial         primary key,
+		site           integer        not null,
+		hit            varchar        not null,
+		created_at     timestamp      not null
+	);
+	create index "shared_hits#site#created_at" on shared_hits(site, created_at);
+
+	create table shared_sessions (
+		hash           bytea          primary key,
+		session        bytea          not null,
+		last_seen      timestamp      not null
+	);
+	create index "shared_sessions#last_seen" on shared_sessions(last_seen);
+
+	create table shared_session_paths (
+		session        bytea          not null,
+		path           varchar        not null
+	);
+	create unique index "shared_session_paths#session#path" on shared_session_paths(session, path);
+
+	insert into version values('2020-08-03-1-shared-memstore');
+commit;
@@ -0,0 +1,19 @@
+begin;
+	create table alert_rules (
+		alert_rule_id  serial         primary key,
+		site_id        integer        not null,
+		kind           varchar        not null                 check(kind in ('above', 'below', 'new-ref')),
+		threshold      integer        not null,
+		minutes        integer        not null,
+		deliver        varchar        not null                 check(deliver in ('email', 'slack', 'webhook')),
+		target         varchar        not null,
+		cooldown       integer        not null,
+		fired_at       timestamp      null,
+		created_at     timestamp      not null,
+
+		foreign key (site_id) references sites(id) on delete restrict on update restrict
+	);
+	create index "alert_rules#site_id" on alert_rules(site_id);
+
+	insert into version values('2020-08-06-1-alert-rules');
+commit;
@@ -0,0 +1,19 @@
+begin;
+	create table anomalies (
+		anomaly_id     serial         primary key,
+		site_id        integer        not null,
+		day            varchar        not null,
+		kind           varchar        not null                 check(kind in ('spike', 'drop')),
+		pageviews      integer        not null,
+		expected       integer        not null,
+		created_at     timestamp      not null,
+
+		foreign key (site_id) references sites(id) on delete restrict on update restrict
+	);
+	create unique index "anomalies#site_id#day" on anomalies(site_id, day);
+
+	alter table alert_rules drop constraint alert_rules_kind_check;
+	alter table alert_rules add constraint alert_rules_kind_check check(kind in ('above', 'below', 'new-ref', 'anomaly'));
+
+	insert into version values('2020-08-07-1-anomalies');
+commit;
@@ -0,0 +1,21 @@
+begin;
+	create table user_sessions (
+		user_session_id serial        primary key,
+		user_id        integer        not null,
+		token          varchar        not null,
+		ip             varchar        not null,
+		user_agent     varchar        not null,
+		created_at     timestamp      not null,
+		last_seen_at   timestamp      not null,
+
+		foreign key (user_id) references users(id) on delete restrict on update restrict
+	);
+	create unique index "user_sessions#token"   on user_sessions(token);
+	create        index "user_sessions#user_id" on user_sessions(user_id);
+
+	-- Keep existing logins working.
+	insert into user_sessions (user_id, token, ip, user_agent, created_at, last_seen_at)
+		select id, login_token, '', '', now(), now() from users where login_token is not null;
+
+	insert into version values('2020-08-08-1-user-sessions');
+commit;
@@ -0,0 +1,8 @@
+begin;
+	alter table users add column owner integer not null default 1;
+
+	-- Users with a role were never the owner.
+	update users set owner=0 where role_id is not null;
+
+	insert into version values('2020-08-12-1-user-owner');
+commit;
@@ -0,0 +1,6 @@
+begin;
+	-- For the "new-ref" alerts.
+	create index "hits#site#ref#created_at" on hits(site, ref, created_at);
+
+	insert into version values('2020-08-13-1-hits-ref-index');
+commit;
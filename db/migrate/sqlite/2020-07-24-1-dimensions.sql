@@ -0,0 +1,5 @@
+begin;
+	alter table hits add column dimensions varchar;
+
+	insert into version values('2020-07-24-1-dimensions');
+commit;
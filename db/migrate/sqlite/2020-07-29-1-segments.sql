@@ -0,0 +1,21 @@
+begin;
+	create table segments (
+		segment_id     integer        primary key autoincrement,
+		site_id        integer        not null,
+		user_id        integer        not null,
+		name           varchar        not null,
+		period         varchar        not null,
+		period_start   varchar,
+		period_end     varchar,
+		filter         varchar        not null,
+		daily          integer        not null,
+		compare        varchar        not null,
+		created_at     timestamp      not null    check(created_at = strftime('%Y-%m-%d %H:%M:%S', created_at)),
+
+		foreign key (site_id) references sites(id) on delete restrict on update restrict,
+		foreign key (user_id) references users(id) on delete restrict on update restrict
+	);
+	create unique index "segments#user_id#name" on segments(user_id, name);
+
+	insert into version values('2020-07-29-1-segments');
+commit;
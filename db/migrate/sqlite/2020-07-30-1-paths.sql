@@ -0,0 +1,20 @@
+begin;
+	create table paths (
+		path_id        integer        primary key autoincrement,
+		site_id        integer        not null,
+		path           varchar        not null,
+		title          varchar        not null default '',
+		event          integer        not null default 0,
+
+		foreign key (site_id) references sites(id) on delete restrict on update restrict
+	);
+	create unique index "paths#site_id#path" on paths(site_id, path);
+
+	-- Filled for existing rows in the background.
+	alter table hits       add column path_id integer null;
+	alter table hit_counts add column path_id integer null;
+	alter table hit_stats  add column path_id integer null;
+	alter table ref_counts add column path_id integer null;
+
+	insert into version values('2020-07-30-1-paths');
+commit;
@@ -0,0 +1,14 @@
+begin;
+	create table annotations (
+		annotation_id  integer        primary key autoincrement,
+		site_id        integer        not null,
+		day            varchar        not null,
+		text           varchar        not null,
+		created_at     timestamp      not null    check(created_at = strftime('%Y-%m-%d %H:%M:%S', created_at)),
+
+		foreign key (site_id) references sites(id) on delete restrict on update restrict
+	);
+	create index "annotations#site_id#day" on annotations(site_id, day);
+
+	insert into version values('2020-07-31-1-annotations');
+commit;
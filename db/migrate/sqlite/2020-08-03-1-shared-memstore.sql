@@ -0,0 +1,24 @@
+begin;
+	create table shared_hits (
+		id             integer        primary key autoincrement,
+		site           integer        not null,
+		hit            varchar        not null,
+		created_at     timestamp      not null    check(created_at = strftime('%Y-%m-%d %H:%M:%S', created_at))
+	);
+	create index "shared_hits#site#created_at" on shared_hits(site, created_at);
+
+	create table shared_sessions (
+		hash           blob           primary key,
+		session        blob           not null,
+		last_seen      timestamp      not null    check(last_seen = strftime('%Y-%m-%d %H:%M:%S', last_seen))
+	);
+	create index "shared_sessions#last_seen" on shared_sessions(last_seen);
+
+	create table shared_session_paths (
+		session        blob           not null,
+		path           varchar        not null
+	);
+	create unique index "shared_session_paths#session#path" on shared_session_paths(session, path);
+
+	insert into version values('2020-08-03-1-shared-memstore');
+commit;
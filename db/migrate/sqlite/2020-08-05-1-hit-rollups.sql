@@ -0,0 +1,17 @@
+begin;
+	create table hit_rollups (
+		site          int        not null check(site>0),
+		period        varchar    not null check(period in ('d', 'm', 'u')),
+		path          varchar    not null,
+		title         varchar    not null,
+		event         integer    not null default 0,
+		hour          timestamp  not null check(hour = strftime('%Y-%m-%d %H:%M:%S', hour)),
+		total         int        not null,
+		total_unique  int        not null,
+
+		constraint "hit_rollups#site#period#path#event#hour" unique(site, period, path, event, hour) on conflict replace
+	);
+	create index "hit_rollups#site#period#hour" on hit_rollups(site, period, hour);
+
+	insert into version values('2020-08-05-1-hit-rollups');
+commit;
@@ -0,0 +1,36 @@
+begin;
+	create table anomalies (
+		anomaly_id     integer        primary key autoincrement,
+		site_id        integer        not null,
+		day            varchar        not null,
+		kind           varchar        not null                 check(kind in ('spike', 'drop')),
+		pageviews      integer        not null,
+		expected       integer        not null,
+		created_at     timestamp      not null                 check(created_at = strftime('%Y-%m-%d %H:%M:%S', created_at)),
+
+		foreign key (site_id) references sites(id) on delete restrict on update restrict
+	);
+	create unique index "anomalies#site_id#day" on anomalies(site_id, day);
+
+	-- SQLite can't change a check constraint, so recreate the table.
+	create table alert_rules2 (
+		alert_rule_id  integer        primary key autoincrement,
+		site_id        integer        not null,
+		kind           varchar        not null                 check(kind in ('above', 'below', 'new-ref', 'anomaly')),
+		threshold      integer        not null,
+		minutes        integer        not null,
+		deliver        varchar        not null                 check(deliver in ('email', 'slack', 'webhook')),
+		target         varchar        not null,
+		cooldown       integer        not null,
+		fired_at       timestamp      null                     check(fired_at = strftime('%Y-%m-%d %H:%M:%S', fired_at)),
+		created_at     timestamp      not null                 check(created_at = strftime('%Y-%m-%d %H:%M:%S', created_at)),
+
+		foreign key (site_id) references sites(id) on delete restrict on update restrict
+	);
+	insert into alert_rules2 select * from alert_rules;
+	drop table alert_rules;
+	alter table alert_rules2 rename to alert_rules;
+	create index "alert_rules#site_id" on alert_rules(site_id);
+
+	insert into version values('2020-08-07-1-anomalies');
+commit;
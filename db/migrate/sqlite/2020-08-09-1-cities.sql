@@ -0,0 +1,20 @@
+begin;
+	alter table hits add column region varchar not null default '';
+	alter table hits add column city   varchar not null default '';
+
+	create table city_stats (
+		site           integer        not null                 check(site > 0),
+
+		day            date           not null                 check(day = strftime('%Y-%m-%d', day)),
+		location       varchar        not null,
+		region         varchar        not null,
+		city           varchar        not null,
+		count          int            not null,
+		count_unique   int            not null,
+
+		foreign key (site) references sites(id) on delete restrict on update restrict
+	);
+	create index "city_stats#site#day#location" on city_stats(site, day, location);
+
+	insert into version values('2020-08-09-1-cities');
+commit;
@@ -0,0 +1,21 @@
+begin;
+	create table region_stats (
+		site           integer        not null                 check(site > 0),
+
+		day            date           not null                 check(day = strftime('%Y-%m-%d', day)),
+		location       varchar        not null,
+		region         varchar        not null,
+		count          int            not null,
+		count_unique   int            not null,
+
+		foreign key (site) references sites(id) on delete restrict on update restrict
+	);
+	create index "region_stats#site#day#location" on region_stats(site, day, location);
+
+	insert into region_stats (site, day, location, region, count, count_unique)
+		select site, day, location, region, sum(count), sum(count_unique) from city_stats
+		where region != ''
+		group by site, day, location, region;
+
+	insert into version values('2020-08-10-1-region-stats');
+commit;
@@ -0,0 +1,17 @@
+begin;
+	alter table hits add column language varchar not null default '';
+
+	create table language_stats (
+		site           integer        not null                 check(site > 0),
+
+		day            date           not null                 check(day = strftime('%Y-%m-%d', day)),
+		language       varchar        not null,
+		count          int            not null,
+		count_unique   int            not null,
+
+		foreign key (site) references sites(id) on delete restrict on update restrict
+	);
+	create index "language_stats#site#day" on language_stats(site, day);
+
+	insert into version values('2020-08-11-1-languages');
+commit;
@@ -0,0 +1,19 @@
+begin;
+	create table bot_stats (
+		site           integer        not null                 check(site > 0),
+
+		day            date           not null                 check(day = strftime('%Y-%m-%d', day)),
+		count          int            not null,
+
+		foreign key (site) references sites(id) on delete restrict on update restrict
+	);
+	create index "bot_stats#site#day" on bot_stats(site, day);
+
+	-- Days are in UTC here; "goatcounter reindex -table bot_stats" uses the
+	-- site's timezone.
+	insert into bot_stats (site, day, count)
+		select site, date(created_at), count(*) from hits where bot>0
+		group by site, date(created_at);
+
+	insert into version values('2020-08-14-1-bot-stats');
+commit;
@@ -0,0 +1,125 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"time"
+
+	"zgo.at/errors"
+)
+
+// EmailReportPeriods are the valid values for User.EmailReports; an empty
+// string means no reports are sent.
+var EmailReportPeriods = []string{"week", "month"}
+
+// EmailReportSections are the sections that can be included in the email
+// reports.
+var EmailReportSections = []string{"totals", "pages", "refs"}
+
+// emailReportLimit is the number of pages and referrers in the report.
+const emailReportLimit = 5
+
+// EmailReport is a summary of the statistics for a week or month, which is
+// emailed to users who enabled it.
+type EmailReport struct {
+	Site   Site
+	User   User
+	Period string
+	Start  time.Time // In the site's timezone.
+	End    time.Time
+
+	Total           int
+	TotalUnique     int
+	PrevTotal       int
+	PrevTotalUnique int
+	Change          *float64
+	ChangeUnique    *float64
+
+	Pages HitStats
+	Refs  []StatT
+}
+
+// EmailReportPeriod gets the last full week or month before now in loc.
+//
+// Weeks start on Monday, or Sunday if SundayStartsWeek is set.
+func EmailReportPeriod(now time.Time, loc *time.Location, period string, sundayStartsWeek bool) (time.Time, time.Time) {
+	y, m, d := now.In(loc).Date()
+	if period == "month" {
+		start := time.Date(y, m, 1, 0, 0, 0, 0, loc).AddDate(0, -1, 0)
+		return start, start.AddDate(0, 1, 0).Add(-time.Second)
+	}
+
+	first := time.Monday
+	if sundayStartsWeek {
+		first = time.Sunday
+	}
+	today := time.Date(y, m, d, 0, 0, 0, 0, loc)
+	start := today.AddDate(0, 0, -(int(today.Weekday())-int(first)+7)%7-7)
+	return start, start.AddDate(0, 0, 7).Add(-time.Second)
+}
+
+// Get the report for the site in the context for the period ending before now.
+func (r *EmailReport) Get(ctx context.Context, period string, now time.Time) error {
+	site := MustGetSite(ctx)
+	r.Site, r.Period = *site, period
+	r.Start, r.End = EmailReportPeriod(now, site.Settings.Timezone.Loc(), period, site.Settings.SundayStartsWeek)
+	start, end := r.Start.UTC(), r.End.UTC()
+
+	var err error
+	if r.User.ReportsSection("totals") {
+		r.Total, r.TotalUnique, err = GetTotalCount(ctx, start, end, "")
+		if err != nil {
+			return errors.Wrap(err, "EmailReport.Get")
+		}
+
+		pstart, pend := ComparePeriod(start, end, "previous")
+		if period == "month" {
+			pstart, pend = r.Start.AddDate(0, -1, 0).UTC(), r.Start.Add(-time.Second).UTC()
+		}
+		r.PrevTotal, r.PrevTotalUnique, err = GetTotalCount(ctx, pstart, pend, "")
+		if err != nil {
+			return errors.Wrap(err, "EmailReport.Get")
+		}
+		r.Change, r.ChangeUnique = Change(r.Total, r.PrevTotal), Change(r.TotalUnique, r.PrevTotalUnique)
+	}
+
+	if r.User.ReportsSection("pages") {
+		_, _, _, err = r.Pages.List(ctx, start, end, "", nil, true)
+		if err != nil {
+			return errors.Wrap(err, "EmailReport.Get")
+		}
+		if len(r.Pages) > emailReportLimit {
+			r.Pages = r.Pages[:emailReportLimit]
+		}
+	}
+
+	if r.User.ReportsSection("refs") {
+		var refs Stats
+		err = refs.ListTopRefs(ctx, start, end, "", 0)
+		if err != nil {
+			return errors.Wrap(err, "EmailReport.Get")
+		}
+		r.Refs = refs.Stats
+		if len(r.Refs) > emailReportLimit {
+			r.Refs = r.Refs[:emailReportLimit]
+		}
+	}
+	return nil
+}
+
+// FormatChange formats the change as a percentage with a sign, or an empty
+// string if c is nil.
+//
+// This is a template.HTML as the templates are run with html/template, which
+// would otherwise escape the "+".
+func (r EmailReport) FormatChange(c *float64) template.HTML {
+	if c == nil {
+		return ""
+	}
+	return template.HTML(fmt.Sprintf("%+.1f%%", *c))
+}
@@ -0,0 +1,109 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"zgo.at/goatcounter"
+	"zgo.at/goatcounter/gctest"
+	"zgo.at/zhttp"
+)
+
+func TestEmailReportPeriod(t *testing.T) {
+	tests := []struct {
+		now                string
+		period             string
+		sunday             bool
+		wantStart, wantEnd string
+	}{
+		{"2020-06-24 12:00:00", "week", false, "2020-06-15 00:00:00", "2020-06-21 23:59:59"},
+		{"2020-06-22 00:00:00", "week", false, "2020-06-15 00:00:00", "2020-06-21 23:59:59"},
+		{"2020-06-21 23:00:00", "week", false, "2020-06-08 00:00:00", "2020-06-14 23:59:59"},
+		{"2020-06-24 12:00:00", "week", true, "2020-06-14 00:00:00", "2020-06-20 23:59:59"},
+		{"2020-06-24 12:00:00", "month", false, "2020-05-01 00:00:00", "2020-05-31 23:59:59"},
+		{"2020-01-01 00:00:00", "month", false, "2019-12-01 00:00:00", "2019-12-31 23:59:59"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.now+tt.period, func(t *testing.T) {
+			now, _ := time.Parse("2006-01-02 15:04:05", tt.now)
+			start, end := goatcounter.EmailReportPeriod(now, time.UTC, tt.period, tt.sunday)
+			got := start.Format("2006-01-02 15:04:05") + " " + end.Format("2006-01-02 15:04:05")
+			want := tt.wantStart + " " + tt.wantEnd
+			if got != want {
+				t.Errorf("\ngot:  %s\nwant: %s", got, want)
+			}
+		})
+	}
+}
+
+func TestEmailReport(t *testing.T) {
+	zhttp.InitTpl(nil)
+	ctx, clean := gctest.DB(t)
+	defer clean()
+
+	gctest.StoreHits(ctx, t,
+		goatcounter.Hit{Path: "/a", CreatedAt: time.Date(2020, 6, 9, 12, 0, 0, 0, time.UTC), FirstVisit: true},
+		goatcounter.Hit{Path: "/a", CreatedAt: time.Date(2020, 6, 16, 12, 0, 0, 0, time.UTC), FirstVisit: true},
+		goatcounter.Hit{Path: "/a", CreatedAt: time.Date(2020, 6, 17, 12, 0, 0, 0, time.UTC)},
+		goatcounter.Hit{Path: "/b", CreatedAt: time.Date(2020, 6, 18, 12, 0, 0, 0, time.UTC), FirstVisit: true})
+
+	var r goatcounter.EmailReport
+	err := r.Get(ctx, "week", time.Date(2020, 6, 24, 12, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Total != 3 || r.TotalUnique != 2 || r.PrevTotal != 1 || len(r.Pages) != 2 {
+		t.Errorf("wrong report: %d %d %d %d", r.Total, r.TotalUnique, r.PrevTotal, len(r.Pages))
+	}
+	if r.FormatChange(r.Change) != "+200.0%" {
+		t.Errorf("wrong change: %s", r.FormatChange(r.Change))
+	}
+
+	out, err := goatcounter.EmailTemplate("email_report.gotxt", r)()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"weekly", "Pageviews: 3 (+200.0%", "/b"} {
+		if !strings.Contains(string(out), want) {
+			t.Errorf("%q not in output:\n%s", want, out)
+		}
+	}
+}
+
+func TestEmailReportSections(t *testing.T) {
+	zhttp.InitTpl(nil)
+	ctx, clean := gctest.DB(t)
+	defer clean()
+
+	gctest.StoreHits(ctx, t,
+		goatcounter.Hit{Path: "/a", CreatedAt: time.Date(2020, 6, 16, 12, 0, 0, 0, time.UTC), FirstVisit: true})
+
+	r := goatcounter.EmailReport{User: goatcounter.User{
+		Settings: goatcounter.UserSettings{EmailReportSections: []string{"pages"}}}}
+	err := r.Get(ctx, "week", time.Date(2020, 6, 24, 12, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Total != 0 || len(r.Pages) != 1 || len(r.Refs) != 0 {
+		t.Errorf("wrong report: %d %d %d", r.Total, len(r.Pages), len(r.Refs))
+	}
+
+	out, err := goatcounter.EmailTemplate("email_report.gotxt", r)()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(out), "Top pages") {
+		t.Errorf("pages not in output:\n%s", out)
+	}
+	for _, notWant := range []string{"Pageviews:", "Top referrers"} {
+		if strings.Contains(string(out), notWant) {
+			t.Errorf("%q in output:\n%s", notWant, out)
+		}
+	}
+}
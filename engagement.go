@@ -0,0 +1,98 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/zdb"
+)
+
+// MaxPing is the maximum time on page in seconds we accept from an engagement
+// ping; anything longer is almost certainly a tab that was left open.
+const MaxPing = 6 * 3600
+
+// Engagement is the time on page for a path.
+type Engagement struct {
+	Path    string  `json:"path"`
+	Count   int     `json:"count"`   // Number of pageviews with a duration.
+	Average float64 `json:"average"` // In seconds.
+	Median  float64 `json:"median"`  // In seconds.
+}
+
+type Engagements []Engagement
+
+// List the average and median time on page for all paths with at least one
+// engagement ping in this period, ordered by the number of pageviews.
+func (e *Engagements) List(ctx context.Context, start, end time.Time, filter string, limit int) error {
+	site := MustGetSite(ctx)
+
+	filterQuery, filterArgs, err := filterSQL(ctx, filter, start, end, false)
+	if err != nil {
+		return errors.Wrap(err, "Engagements.List")
+	}
+	f, err := ParseFilter(filter)
+	if err != nil {
+		return errors.Wrap(err, "Engagements.List")
+	}
+	facetQuery, facetArgs, err := facetSQL(ctx, f, start, end)
+	if err != nil {
+		return errors.Wrap(err, "Engagements.List")
+	}
+
+	query := `/* Engagements.List */
+		select path, duration from hits
+		where
+			site=? and bot=0 and event=0 and duration is not null and
+			created_at>=? and created_at<=? ` + filterQuery + facetQuery + `
+		order by path, duration`
+	args := append(append([]interface{}{site.ID, start.Format(zdb.Date), end.Format(zdb.Date)},
+		filterArgs...), facetArgs...)
+
+	var rows []struct {
+		Path     string `db:"path"`
+		Duration int64  `db:"duration"`
+	}
+	db := zdb.MustGet(ctx)
+	err = db.SelectContext(ctx, &rows, db.Rebind(query), args...)
+	if err != nil {
+		return errors.Wrap(err, "Engagements.List")
+	}
+
+	// Rows are ordered by path and duration, so each path is a sorted run.
+	*e = Engagements{}
+	for i := 0; i < len(rows); {
+		j := i
+		var sum int64
+		for ; j < len(rows) && rows[j].Path == rows[i].Path; j++ {
+			sum += rows[j].Duration
+		}
+
+		run := rows[i:j]
+		n := len(run)
+		med := float64(run[n/2].Duration)
+		if n%2 == 0 {
+			med = float64(run[n/2-1].Duration+run[n/2].Duration) / 2
+		}
+		*e = append(*e, Engagement{
+			Path:    rows[i].Path,
+			Count:   n,
+			Average: float64(sum) / float64(n),
+			Median:  med,
+		})
+		i = j
+	}
+
+	ee := *e
+	// Stable, so paths with the same count stay sorted by name.
+	sort.SliceStable(ee, func(i, j int) bool { return ee[i].Count > ee[j].Count })
+	if limit > 0 && len(ee) > limit {
+		*e = ee[:limit]
+	}
+	return nil
+}
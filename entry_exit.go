@@ -0,0 +1,60 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"context"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/zdb"
+)
+
+// EntryExit is the number of sessions that started or ended on a path.
+type EntryExit struct {
+	Path  string `db:"path" json:"path"`
+	Count int    `db:"count" json:"count"`
+}
+
+type EntryExits []EntryExit
+
+// ListEntries lists the paths sessions started on.
+func (e *EntryExits) ListEntries(ctx context.Context, start, end time.Time, limit int) error {
+	*e = EntryExits{}
+	return errors.Wrap(zdb.MustGet(ctx).SelectContext(ctx, e, `/* EntryExits.ListEntries */
+		select path, sum(count) as count from path_transitions
+		where site=$1 and day>=$2 and day<=$3 and prev_path=''
+		group by path
+		order by count desc, path asc
+		limit $4`,
+		MustGetSite(ctx).ID, start.Format("2006-01-02"), end.Format("2006-01-02"), limit),
+		"EntryExits.ListEntries")
+}
+
+// ListExits lists the paths sessions ended on.
+//
+// This is the number of times people arrived on a path minus the number of
+// times they went to another page from there. The last pageviews of a session
+// are counted as an exit until the next pageview is recorded, so the numbers
+// for the current day are a bit higher than they will be.
+func (e *EntryExits) ListExits(ctx context.Context, start, end time.Time, limit int) error {
+	*e = EntryExits{}
+	return errors.Wrap(zdb.MustGet(ctx).SelectContext(ctx, e, `/* EntryExits.ListExits */
+		select path, sum(n) as count from (
+			select path, sum(count) as n from path_transitions
+			where site=$1 and day>=$2 and day<=$3
+			group by path
+			union all
+			select prev_path as path, -sum(count) as n from path_transitions
+			where site=$1 and day>=$2 and day<=$3 and prev_path!=''
+			group by prev_path
+		) x
+		group by path
+		having sum(n) > 0
+		order by count desc, path asc
+		limit $4`,
+		MustGetSite(ctx).ID, start.Format("2006-01-02"), end.Format("2006-01-02"), limit),
+		"EntryExits.ListExits")
+}
@@ -0,0 +1,276 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"zgo.at/errors"
+	"zgo.at/zdb"
+	"zgo.at/zstd/zint"
+	"zgo.at/zvalidate"
+)
+
+// Erasure selects the pageviews of a visitor to delete, for example to answer a
+// GDPR data-subject erasure request.
+//
+// All the conditions that are set must match; at least one needs to be set.
+type Erasure struct {
+	// Session IDs, as in the CSV export.
+	Sessions []string `json:"sessions"`
+
+	// IP address and User-Agent header of the visitor. The IP address isn't
+	// stored with the pageviews; it's only used with a salted hash to find the
+	// session, which is only possible until the salt is rotated (a few hours
+	// after the last pageview).
+	IP        string `json:"ip"`
+	UserAgent string `json:"user_agent"`
+
+	// Only delete pageviews in this period.
+	Start *time.Time `json:"start"`
+	End   *time.Time `json:"end"`
+}
+
+// ErasureReport describes what was deleted.
+type ErasureReport struct {
+	SiteID  int64   `json:"site_id"`
+	Site    string  `json:"site"`
+	Request Erasure `json:"request"`
+
+	// Sessions that were matched, including the one found for the IP address.
+	Sessions []string `json:"sessions"`
+
+	// Number of deleted pageviews and the time of the first and last one.
+	Pageviews int64      `json:"pageviews"`
+	First     *time.Time `json:"first"`
+	Last      *time.Time `json:"last"`
+
+	Notes     []string  `json:"notes"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Validate the object.
+func (e *Erasure) Validate() error {
+	v := zvalidate.New()
+	if len(e.Sessions) == 0 && e.IP == "" && e.Start == nil && e.End == nil {
+		v.Append("sessions", "need at least one of sessions, ip, start, or end")
+	}
+	for _, s := range e.Sessions {
+		if _, err := uuid.Parse(s); err != nil {
+			v.Append("sessions", fmt.Sprintf("%q: not a valid session ID", s))
+		}
+	}
+	if e.IP != "" {
+		v.IP("ip", e.IP)
+		v.Required("user_agent", e.UserAgent)
+	}
+	if e.Start != nil && e.End != nil && e.End.Before(*e.Start) {
+		v.Append("end", "before start")
+	}
+	return v.ErrorOrNil()
+}
+
+// Erase deletes the pageviews matching the conditions for the current site,
+// including the pageviews in the Memstore that haven't been persisted yet.
+//
+// Only the pageviews are deleted: the daily statistics (hit_stats,
+// browser_stats, ref_counts, etc.) and the hit_rollups aren't changed, as they
+// don't contain anything that can identify a visitor. Pageviews written to the
+// -spool file while the database was unavailable aren't deleted.
+func (e Erasure) Erase(ctx context.Context) (*ErasureReport, error) {
+	err := e.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	site := MustGetSite(ctx)
+	rep := ErasureReport{
+		SiteID:    site.ID,
+		Site:      site.Display(),
+		Request:   e,
+		Sessions:  []string{},
+		CreatedAt: Now(),
+	}
+
+	sessions := make([]zint.Uint128, 0, len(e.Sessions)+1)
+	for _, s := range e.Sessions {
+		u := uuid.MustParse(s)
+		id, err := zint.NewUint128(u[:])
+		if err != nil {
+			return nil, errors.Wrap(err, "Erasure.Erase")
+		}
+		sessions = append(sessions, id)
+		rep.Sessions = append(rep.Sessions, u.String())
+	}
+	var (
+		ip        = site.VisitorIP(e.IP)
+		ua        = CleanUserAgent(e.UserAgent)
+		noSession bool
+	)
+	if e.IP != "" {
+		id, ok := Memstore.existingSession(site.ID, ua, ip)
+		if ok {
+			sessions = append(sessions, id)
+			b, _ := id.Bytes()
+			var u uuid.UUID
+			copy(u[:], b)
+			rep.Sessions = append(rep.Sessions, u.String())
+		}
+		noSession = !ok
+	}
+
+	// Pageviews that haven't been persisted yet; these usually don't have a
+	// session yet, so also match on the IP address.
+	buffered, err := Memstore.erase(site.ID, func(h Hit) bool {
+		if (e.Start != nil && h.CreatedAt.Before(*e.Start)) || (e.End != nil && h.CreatedAt.After(*e.End)) {
+			return false
+		}
+		if e.IP != "" && (h.Browser != ua || h.RemoteAddr != ip) {
+			return false
+		}
+		if len(e.Sessions) == 0 {
+			return true
+		}
+		for _, s := range sessions {
+			if h.Session == s {
+				return true
+			}
+		}
+		return false
+	})
+	rep.Pageviews = int64(len(buffered))
+	for _, h := range buffered {
+		rep.addPeriod(h.CreatedAt)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "Erasure.Erase")
+	}
+
+	if noSession {
+		rep.Notes = append(rep.Notes, "No session found for the IP address and User-Agent; the IP "+
+			"address isn't stored with the pageviews, so the session can only be found for a few "+
+			"hours after the last pageview. Only pageviews that weren't stored yet were deleted.")
+		return &rep, nil
+	}
+
+	where := []string{"site=$1"}
+	args := []interface{}{site.ID}
+	if len(sessions) > 0 {
+		in := make([]string, 0, len(sessions))
+		for _, s := range sessions {
+			args = append(args, s)
+			in = append(in, fmt.Sprintf("$%d", len(args)))
+		}
+		where = append(where, "session2 in ("+strings.Join(in, ", ")+")")
+	}
+	if e.Start != nil {
+		args = append(args, e.Start.UTC().Format(zdb.Date))
+		where = append(where, fmt.Sprintf("created_at>=$%d", len(args)))
+	}
+	if e.End != nil {
+		args = append(args, e.End.UTC().Format(zdb.Date))
+		where = append(where, fmt.Sprintf("created_at<=$%d", len(args)))
+	}
+	w := strings.Join(where, " and ")
+
+	err = zdb.TX(ctx, func(ctx context.Context, tx zdb.DB) error {
+		var found struct {
+			Count int64   `db:"count"`
+			First *string `db:"first"`
+			Last  *string `db:"last"`
+		}
+		err := tx.GetContext(ctx, &found, `/* Erasure.Erase */
+			select count(*) as count, min(created_at) as first, max(created_at) as last from hits where `+w,
+			args...)
+		if err != nil {
+			return err
+		}
+		rep.Pageviews += found.Count
+		if f := parseErasureTime(found.First); f != nil {
+			rep.addPeriod(*f)
+		}
+		if l := parseErasureTime(found.Last); l != nil {
+			rep.addPeriod(*l)
+		}
+
+		_, err = tx.ExecContext(ctx, `/* Erasure.Erase */ delete from hits where `+w, args...)
+		return err
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "Erasure.Erase")
+	}
+
+	rep.Notes = append(rep.Notes, "The statistics (pageview counts per path, referrer, browser, "+
+		"and so forth, and the daily and monthly totals) were not changed, as they can't be "+
+		"used to identify a visitor.")
+	return &rep, nil
+}
+
+// addPeriod extends the period of the report to include t.
+func (r *ErasureReport) addPeriod(t time.Time) {
+	t = t.UTC()
+	if r.First == nil || t.Before(*r.First) {
+		r.First = &t
+	}
+	if r.Last == nil || t.After(*r.Last) {
+		r.Last = &t
+	}
+}
+
+func parseErasureTime(s *string) *time.Time {
+	if s == nil || len(*s) < 19 {
+		return nil
+	}
+	t, err := time.Parse("2006-01-02 15:04:05", (*s)[:19])
+	if err != nil {
+		t, err = time.Parse("2006-01-02T15:04:05", (*s)[:19])
+		if err != nil {
+			return nil
+		}
+	}
+	return &t
+}
+
+// String gets the report as text, for keeping a record of the request.
+func (r ErasureReport) String() string {
+	b := new(strings.Builder)
+	fmt.Fprintf(b, "GoatCounter erasure report\n\n")
+	fmt.Fprintf(b, "Date:        %s\n", r.CreatedAt.UTC().Format("2006-01-02 15:04:05 (UTC)"))
+	fmt.Fprintf(b, "Site:        %s (ID %d)\n\n", r.Site, r.SiteID)
+
+	fmt.Fprintf(b, "Request:\n")
+	if len(r.Request.Sessions) > 0 {
+		fmt.Fprintf(b, "  Sessions:   %s\n", strings.Join(r.Request.Sessions, ", "))
+	}
+	if r.Request.IP != "" {
+		fmt.Fprintf(b, "  IP:         %s\n", r.Request.IP)
+		fmt.Fprintf(b, "  User-Agent: %s\n", r.Request.UserAgent)
+	}
+	if r.Request.Start != nil {
+		fmt.Fprintf(b, "  Start:      %s\n", r.Request.Start.UTC().Format("2006-01-02 15:04:05 (UTC)"))
+	}
+	if r.Request.End != nil {
+		fmt.Fprintf(b, "  End:        %s\n", r.Request.End.UTC().Format("2006-01-02 15:04:05 (UTC)"))
+	}
+
+	fmt.Fprintf(b, "\nDeleted:\n")
+	if len(r.Sessions) > 0 {
+		fmt.Fprintf(b, "  Sessions:   %s\n", strings.Join(r.Sessions, ", "))
+	}
+	fmt.Fprintf(b, "  Pageviews:  %d\n", r.Pageviews)
+	if r.First != nil && r.Last != nil {
+		fmt.Fprintf(b, "  Period:     %s – %s\n",
+			r.First.Format("2006-01-02 15:04:05"), r.Last.Format("2006-01-02 15:04:05 (UTC)"))
+	}
+
+	for _, n := range r.Notes {
+		fmt.Fprintf(b, "\nNote: %s\n", n)
+	}
+	return b.String()
+}
@@ -0,0 +1,118 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"zgo.at/goatcounter"
+	"zgo.at/goatcounter/gctest"
+	"zgo.at/zstd/zint"
+)
+
+func TestErasure(t *testing.T) {
+	day := time.Date(2020, 6, 18, 12, 0, 0, 0, time.UTC)
+	s1, s2 := uuid.New(), uuid.New()
+	session := func(u uuid.UUID) zint.Uint128 {
+		i, err := zint.NewUint128(u[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return i
+	}
+
+	tests := []struct {
+		name    string
+		req     goatcounter.Erasure
+		want    int64
+		wantErr string
+	}{
+		{"nothing set", goatcounter.Erasure{}, 0, "need at least one of"},
+		{"invalid session", goatcounter.Erasure{Sessions: []string{"x"}}, 0, "not a valid session ID"},
+		{"session", goatcounter.Erasure{Sessions: []string{s1.String()}}, 3, ""},
+		{"both sessions", goatcounter.Erasure{Sessions: []string{s1.String(), s2.String()}}, 5, ""},
+		{"session and period", goatcounter.Erasure{Sessions: []string{s1.String()},
+			Start: &day, End: &day}, 2, ""},
+		{"period", goatcounter.Erasure{Start: &day}, 4, ""},
+		{"unknown ip", goatcounter.Erasure{IP: "192.0.2.1", UserAgent: "Mozilla"}, 0, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, clean := gctest.DB(t)
+			defer clean()
+
+			gctest.StoreHits(ctx, t,
+				goatcounter.Hit{Path: "/a", Session: session(s1), CreatedAt: day.Add(-24 * time.Hour)},
+				goatcounter.Hit{Path: "/a", Session: session(s1), CreatedAt: day},
+				goatcounter.Hit{Path: "/b", Session: session(s1), CreatedAt: day},
+				goatcounter.Hit{Path: "/a", Session: session(s2), CreatedAt: day},
+				goatcounter.Hit{Path: "/b", Session: session(s2), CreatedAt: day.Add(time.Hour)},
+			)
+
+			rep, err := tt.req.Erase(ctx)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("wrong error: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if rep.Pageviews != tt.want {
+				t.Errorf("deleted %d pageviews; want %d", rep.Pageviews, tt.want)
+			}
+
+			var hits goatcounter.Hits
+			_, err = hits.List(ctx, 0, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if int64(len(hits)) != 5-tt.want {
+				t.Errorf("%d pageviews left; want %d", len(hits), 5-tt.want)
+			}
+
+			if !strings.Contains(rep.String(), "GoatCounter erasure report") {
+				t.Errorf("wrong report:\n%s", rep)
+			}
+		})
+	}
+}
+
+func TestErasureBuffered(t *testing.T) {
+	ctx, clean := gctest.DB(t)
+	defer clean()
+
+	site := goatcounter.MustGetSite(ctx)
+	now := goatcounter.Now()
+	goatcounter.Memstore.Append(
+		goatcounter.Hit{Site: site.ID, Path: "/a", Browser: "Mozilla", RemoteAddr: site.VisitorIP("192.0.2.1"), CreatedAt: now},
+		goatcounter.Hit{Site: site.ID, Path: "/b", Browser: "Mozilla", RemoteAddr: site.VisitorIP("192.0.2.2"), CreatedAt: now},
+	)
+
+	rep, err := goatcounter.Erasure{IP: "192.0.2.1", UserAgent: "Mozilla"}.Erase(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Pageviews != 1 {
+		t.Errorf("deleted %d pageviews; want 1", rep.Pageviews)
+	}
+	if l := goatcounter.Memstore.Len(); l != 1 {
+		t.Errorf("%d buffered pageviews left; want 1", l)
+	}
+
+	hits, err := goatcounter.Memstore.Persist(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hits) != 1 || hits[0].Path != "/b" {
+		t.Errorf("wrong hits persisted: %v", hits)
+	}
+}
@@ -53,6 +53,9 @@ type Export struct {
 
 	// Any errors that may have occured.
 	Error *string `db:"error" json:"error,readonly"`
+
+	// Only export pageviews matching this filter; this isn't stored.
+	Filter PathFilter `db:"-" json:"-"`
 }
 
 func (e *Export) ByID(ctx context.Context, id int64) error {
@@ -121,7 +124,7 @@ func (e *Export) Run(ctx context.Context, fp *os.File, mailUser bool) {
 			hits Hits
 			last int64
 		)
-		last, exportErr = hits.List(ctx, 5000, *e.LastHitID)
+		last, exportErr = hits.List(zdb.With(ctx, Replica(ctx)), 5000, *e.LastHitID)
 		e.LastHitID = &last
 		if len(hits) == 0 {
 			break
@@ -130,9 +133,12 @@ func (e *Export) Run(ctx context.Context, fp *os.File, mailUser bool) {
 			break
 		}
 
-		*e.NumRows += len(hits)
-
 		for _, hit := range hits {
+			if !e.Filter.MatchHit(hit) {
+				continue
+			}
+			*e.NumRows++
+
 			s := ""
 			if hit.OldSession != nil {
 				s = strconv.FormatInt(*hit.OldSession, 10)
@@ -158,7 +164,7 @@ func (e *Export) Run(ctx context.Context, fp *os.File, mailUser bool) {
 
 			c.Write([]string{hit.Path, hit.Title, fmt.Sprintf("%t", hit.Event),
 				fmt.Sprintf("%d", hit.Bot), s, fmt.Sprintf("%t", hit.FirstVisit),
-				hit.Ref, rs, hit.Browser, zfloat.Join(hit.Size, ","),
+				hit.Ref, rs, ReadableUserAgent(hit.Browser), zfloat.Join(hit.Size, ","),
 				hit.Location, hit.CreatedAt.Format(time.RFC3339)})
 		}
 
@@ -312,7 +318,7 @@ func Import(ctx context.Context, fp io.Reader, replace, email bool) {
 			Path:     path,
 			Title:    title,
 			Ref:      ref,
-			Browser:  browser,
+			Browser:  CleanUserAgent(browser),
 			Location: location, // TODO: validate from list?
 		}
 
@@ -344,7 +350,8 @@ func Import(ctx context.Context, fp io.Reader, replace, email bool) {
 		// Map session IDs to new session IDs.
 		s, ok := sessions[session]
 		if !ok {
-			sessions[session] = Memstore.SessionID()
+			s = Memstore.SessionID()
+			sessions[session] = s
 		}
 		hit.Session = s
 
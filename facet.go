@@ -0,0 +1,369 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/goatcounter/cfg"
+	"zgo.at/zdb"
+	"zgo.at/zvalidate"
+)
+
+// FilterFacets are the facets that can be used in a PathFilter, as
+// "name=value" or "name!=value":
+//
+//   country   Two-letter ISO-3166-1 country code or the English name, e.g.
+//             "country=DE" or country=Germany.
+//   browser   Browser name without version, e.g. "browser=Firefox".
+//   system    Operating system name without version, e.g. "system=Linux".
+//   ref       Referrer as listed in "Top referrers"; use ref="" for pageviews
+//             without a referrer.
+//   language  Primary language tag from the Accept-Language header, e.g.
+//             "language=en".
+var FilterFacets = []string{"country", "browser", "system", "ref", "language"}
+
+// MaxFilterUserAgents is the number of different User-Agent headers a browser
+// or system facet can match in a period.
+const MaxFilterUserAgents = 5000
+
+type filterFacet struct {
+	name, value string
+	not         bool
+}
+
+func parseFacet(t string) (filterFacet, bool) {
+	for _, n := range FilterFacets {
+		ff := filterFacet{name: n}
+		switch {
+		case strings.HasPrefix(t, n+"!="):
+			ff.value, ff.not = t[len(n)+2:], true
+		case strings.HasPrefix(t, n+"="):
+			ff.value = t[len(n)+1:]
+		default:
+			continue
+		}
+		if n == "country" && len(ff.value) == 2 {
+			ff.value = strings.ToUpper(ff.value)
+		}
+		if n == "language" {
+			ff.value = strings.ToLower(ff.value)
+		}
+		return ff, true
+	}
+	return filterFacet{}, false
+}
+
+// Facets gets a filter string with just the facets of this filter.
+func (f PathFilter) Facets() string {
+	terms := make([]string, 0, len(f.facets))
+	for _, ff := range f.facets {
+		op := "="
+		if ff.not {
+			op = "!="
+		}
+		v := ff.value
+		if v == "" || strings.ContainsAny(v, " \t\n") {
+			v = `"` + v + `"`
+		}
+		terms = append(terms, ff.name+op+v)
+	}
+	return strings.Join(terms, " ")
+}
+
+func (ff filterFacet) match(h Hit) bool {
+	var m bool
+	switch ff.name {
+	case "country":
+		m = h.Location == ff.value
+	case "ref":
+		m = h.Ref == ff.value
+	case "language":
+		m = h.Language == ff.value
+	case "browser", "system":
+		m = strings.EqualFold(uaName(ff.name, h.Browser), ff.value)
+	}
+	return m != ff.not
+}
+
+// uaName gets the browser or system name from a User-Agent header.
+func uaName(facet, ua string) string {
+	u := ParseUserAgent(ua)
+	if facet == "system" {
+		return u.System
+	}
+	return u.Browser
+}
+
+// Resolve replaces country names in the facets with the country code.
+//
+// This is done automatically for the database queries, but needs to be called
+// before MatchHit().
+func (f *PathFilter) Resolve(ctx context.Context) error {
+	for i, ff := range f.facets {
+		if ff.name != "country" || len(ff.value) == 2 {
+			continue
+		}
+
+		var code string
+		err := zdb.MustGet(ctx).GetContext(ctx, &code,
+			`select alpha2 from iso_3166_1 where lower(name)=lower($1)`, ff.value)
+		if zdb.ErrNoRows(err) {
+			v := zvalidate.New()
+			v.Append("filter", fmt.Sprintf("unknown country: %q", ff.value))
+			return v
+		}
+		if err != nil {
+			return errors.Wrap(err, "PathFilter.Resolve")
+		}
+		f.facets[i].value = code
+	}
+	return nil
+}
+
+// facetSQL gets the where clause for the facets in the filter on the hits
+// table; like filterSQL() the clause starts with " and " and uses "?"
+// placeholders.
+//
+// The browser and system are only stored as the User-Agent header, so these
+// are matched in Go.
+func facetSQL(ctx context.Context, f PathFilter, start, end time.Time) (string, []interface{}, error) {
+	err := f.Resolve(ctx)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var (
+		query strings.Builder
+		args  []interface{}
+		uas   []string
+		load  bool
+	)
+	for _, ff := range f.facets {
+		op := " = "
+		if ff.not {
+			op = " != "
+		}
+
+		switch ff.name {
+		case "country":
+			query.WriteString(" and location" + op + "? ")
+			args = append(args, ff.value)
+		case "ref":
+			query.WriteString(" and ref" + op + "? ")
+			args = append(args, ff.value)
+		case "language":
+			query.WriteString(" and language" + op + "? ")
+			args = append(args, ff.value)
+		case "browser", "system":
+			if !load {
+				load = true
+				err := zdb.MustGet(ctx).SelectContext(ctx, &uas, `/* facetSQL */
+					select distinct browser from hits
+					where site=$1 and bot=0 and created_at>=$2 and created_at<=$3`,
+					MustGetSite(ctx).ID, start.Format(zdb.Date), end.Format(zdb.Date))
+				if err != nil {
+					return "", nil, errors.Wrap(err, "facetSQL")
+				}
+			}
+
+			var match []interface{}
+			for _, ua := range uas {
+				if strings.EqualFold(uaName(ff.name, ua), ff.value) {
+					match = append(match, ua)
+				}
+			}
+			if len(match) > MaxFilterUserAgents {
+				v := zvalidate.New()
+				v.Append("filter", fmt.Sprintf(
+					"%s matches more than %d User-Agent headers; use a shorter period", ff.name, MaxFilterUserAgents))
+				return "", nil, v
+			}
+
+			switch {
+			case len(match) == 0 && !ff.not:
+				query.WriteString(" and 1=0 ")
+			case len(match) > 0:
+				in := " in "
+				if ff.not {
+					in = " not in "
+				}
+				query.WriteString(" and browser" + in + "(?" + strings.Repeat(", ?", len(match)-1) + ") ")
+				args = append(args, match...)
+			}
+		}
+	}
+	return query.String(), args, nil
+}
+
+// countsTable gets the table to select the counts from: the table itself if
+// the filter has no facets, or a subquery on the hits table with the same
+// columns, where every pageview is a row with a count of 1.
+//
+// The table must be one of hit_counts, ref_counts, location_stats,
+// region_stats, city_stats, or language_stats. The arguments must be added
+// before any other arguments in the query.
+func countsTable(ctx context.Context, table, filter string, start, end time.Time) (string, []interface{}, error) {
+	f, err := ParseFilter(filter)
+	if err != nil || !f.HasFacets() {
+		return table, nil, err
+	}
+
+	where, whereArgs, err := facetSQL(ctx, f, start, end)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var (
+		cols         string
+		day, dayArgs = facetDay(ctx, start, end)
+	)
+	switch table {
+	case "hit_counts":
+		cols = `path, title, event, created_at as hour, 1 as total, coalesce(first_visit, 0) as total_unique`
+	case "ref_counts":
+		cols = `path, ref, ref_scheme, created_at as hour, 1 as total, coalesce(first_visit, 0) as total_unique`
+	case "location_stats":
+		cols = day + ` as day, location, 1 as count, coalesce(first_visit, 0) as count_unique`
+	case "region_stats":
+		cols = day + ` as day, location, region, 1 as count, coalesce(first_visit, 0) as count_unique`
+	case "city_stats":
+		cols = day + ` as day, location, region, city, 1 as count, coalesce(first_visit, 0) as count_unique`
+	case "language_stats":
+		cols = day + ` as day, language, 1 as count, coalesce(first_visit, 0) as count_unique`
+	default:
+		return "", nil, errors.Errorf("countsTable: invalid table %q", table)
+	}
+
+	if table == "hit_counts" || table == "ref_counts" {
+		dayArgs = nil
+	}
+	args := append(append(dayArgs, MustGetSite(ctx).ID, start.Format(zdb.Date), end.Format(zdb.Date)), whereArgs...)
+	return `(select site, ` + cols + ` from hits
+		where site=? and bot=0 and created_at>=? and created_at<=? ` + where + `) ` + table, args, nil
+}
+
+// facetDay gets the SQL expression for the day of a hit in the site's timezone,
+// like the day in the tables with statistics per day. This is always the site's
+// timezone, even if the user set their own (see Site.StatsTimezone()).
+//
+// SQLite doesn't know about timezones, so the offset is added with a case for
+// every change in the UTC offset between start and end.
+func facetDay(ctx context.Context, start, end time.Time) (string, []interface{}) {
+	loc := MustGetSite(ctx).StatsTimezone().Loc()
+	if cfg.PgSQL {
+		if loc == time.UTC {
+			return `created_at::date`, nil
+		}
+		return `(created_at at time zone 'UTC' at time zone ?)::date`, []interface{}{loc.String()}
+	}
+
+	var (
+		_, off = start.In(loc).Zone()
+		cases  []string
+	)
+	for t := start.Truncate(time.Second); t.Before(end); {
+		n := t.Add(24 * time.Hour)
+		if n.After(end) {
+			n = end
+		}
+		if _, o := n.In(loc).Zone(); o != off {
+			// Find the second it changed.
+			lo, hi := t, n
+			for hi.Sub(lo) > time.Second {
+				mid := lo.Add(hi.Sub(lo) / 2).Truncate(time.Second)
+				if _, o := mid.In(loc).Zone(); o == off {
+					lo = mid
+				} else {
+					hi = mid
+				}
+			}
+			cases = append(cases, fmt.Sprintf(`when created_at < '%s' then '%+d minutes'`,
+				hi.UTC().Format(zdb.Date), off/60))
+			off = o
+		}
+		t = n
+	}
+
+	if len(cases) > 0 {
+		return fmt.Sprintf(`date(created_at, case %s else '%+d minutes' end)`,
+			strings.Join(cases, " "), off/60), nil
+	}
+	if off == 0 {
+		return `date(created_at)`, nil
+	}
+	return fmt.Sprintf(`date(created_at, '%+d minutes')`, off/60), nil
+}
+
+// listFacet lists the pageviews matching the facets in filter grouped by
+// name(col), for stats derived from a value that can't be grouped in SQL, such
+// as the browser name from the User-Agent header. Rows for which name returns
+// "" are skipped.
+func listFacet(
+	ctx context.Context, filter string, start, end time.Time, col string, name func(string) string,
+) ([]StatT, error) {
+	f, err := ParseFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	where, whereArgs, err := facetSQL(ctx, f, start, end)
+	if err != nil {
+		return nil, err
+	}
+
+	var rows []StatT
+	db := zdb.MustGet(ctx)
+	err = db.SelectContext(ctx, &rows, db.Rebind(`/* listFacet */
+		select
+			`+col+` as name,
+			count(*) as count,
+			coalesce(sum(first_visit), 0) as count_unique
+		from hits
+		where site=? and bot=0 and created_at>=? and created_at<=? `+where+`
+		group by `+col),
+		append([]interface{}{MustGetSite(ctx).ID, start.Format(zdb.Date), end.Format(zdb.Date)}, whereArgs...)...)
+	if err != nil {
+		return nil, errors.Wrap(err, "listFacet")
+	}
+
+	grouped := make(map[string]StatT)
+	for _, r := range rows {
+		n := name(r.Name)
+		if n == "" {
+			continue
+		}
+		g := grouped[n]
+		g.Name = n
+		g.Count += r.Count
+		g.CountUnique += r.CountUnique
+		grouped[n] = g
+	}
+
+	stats := make([]StatT, 0, len(grouped))
+	for _, g := range grouped {
+		stats = append(stats, g)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].CountUnique == stats[j].CountUnique {
+			return stats[i].Name < stats[j].Name
+		}
+		return stats[i].CountUnique > stats[j].CountUnique
+	})
+	return stats, nil
+}
+
+// hasFacets reports if the filter has any facets.
+func hasFacets(filter string) (bool, error) {
+	f, err := ParseFilter(filter)
+	if err != nil {
+		return false, err
+	}
+	return f.HasFacets(), nil
+}
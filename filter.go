@@ -0,0 +1,288 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"zgo.at/errors"
+	"zgo.at/zdb"
+	"zgo.at/zvalidate"
+)
+
+// Limits for regular expression filters.
+const (
+	MaxFilterRegexp = 250  // Length of the expression.
+	MaxFilterPaths  = 1000 // Number of paths it can match.
+)
+
+// PathFilter filters the paths on the dashboard and in the API.
+//
+// A filter starting with "~" is a case-insensitive regular expression, such as
+// "~^/blog/[0-9]+$". Anything else matches if the path or title contains the
+// text, case-insensitive.
+//
+// Paths can be excluded by adding terms separated by whitespace: "-text"
+// excludes paths containing the text, "-~expr" excludes paths matching the
+// regular expression, and "path!=/path" excludes that exact path. Exclusions
+// only look at the path, never the title. For example "blog -/blog/feed
+// path!=/blog" matches "/blog/post" but not "/blog/feed.xml" or "/blog".
+//
+// Facets such as "country=DE" or "browser!=Firefox" filter the pageviews by
+// something other than the path; see FilterFacets. Unlike the path filter these
+// apply to the entire dashboard, and not just the list of paths. Use double
+// quotes for values with spaces: browser="Mobile Safari".
+//
+// Regular expressions use Go's RE2 syntax, which always runs in linear time.
+// Not all databases support regular expressions, so the paths are matched in Go
+// and can match at most MaxFilterPaths paths in a period.
+type PathFilter struct {
+	filterTerm
+	exclude []filterTerm
+	facets  []filterFacet
+}
+
+type filterTerm struct {
+	substr string
+	exact  string
+	re     *regexp.Regexp
+}
+
+// ParseFilter parses a filter string.
+func ParseFilter(filter string) (PathFilter, error) {
+	v := zvalidate.New()
+	term := func(t string) filterTerm {
+		if !strings.HasPrefix(t, "~") {
+			return filterTerm{substr: strings.ToLower(t)}
+		}
+
+		expr := t[1:]
+		v.Len("filter", expr, 1, MaxFilterRegexp)
+		re, err := regexp.Compile("(?i)" + expr)
+		if err != nil {
+			v.Append("filter", "invalid regular expression: "+err.Error())
+		}
+		return filterTerm{re: re}
+	}
+
+	var (
+		f       PathFilter
+		include []string
+	)
+	for _, t := range filterFields(filter) {
+		if ff, ok := parseFacet(t); ok {
+			if ff.value == "" && ff.name != "ref" {
+				v.Append("filter", ff.name+" needs a value")
+			}
+			f.facets = append(f.facets, ff)
+			continue
+		}
+
+		switch {
+		case strings.HasPrefix(t, "path!="):
+			if t == "path!=" {
+				v.Append("filter", "path!= needs a path")
+			}
+			f.exclude = append(f.exclude, filterTerm{exact: t[6:]})
+		case len(t) > 1 && t[0] == '-':
+			f.exclude = append(f.exclude, term(t[1:]))
+		default:
+			include = append(include, t)
+		}
+	}
+	f.filterTerm = term(strings.Join(include, " "))
+	if v.HasErrors() {
+		return PathFilter{}, v
+	}
+	return f, nil
+}
+
+// filterFields splits s on whitespace, keeping text in double quotes together.
+// The quotes are removed.
+func filterFields(s string) []string {
+	var (
+		fields    []string
+		b         strings.Builder
+		quote, in bool
+	)
+	for _, c := range s {
+		switch {
+		case c == '"':
+			quote, in = !quote, true
+		case !quote && unicode.IsSpace(c):
+			if in {
+				fields = append(fields, b.String())
+				b.Reset()
+				in = false
+			}
+		default:
+			b.WriteRune(c)
+			in = true
+		}
+	}
+	if in {
+		fields = append(fields, b.String())
+	}
+	return fields
+}
+
+// IsZero reports if this filter is empty, in which case it matches everything.
+func (f PathFilter) IsZero() bool { return !f.HasPath() && !f.HasFacets() }
+
+// HasPath reports if this filter filters on the path.
+func (f PathFilter) HasPath() bool { return !f.filterTerm.isZero() || len(f.exclude) > 0 }
+
+// HasFacets reports if this filter has any facets.
+func (f PathFilter) HasFacets() bool { return len(f.facets) > 0 }
+
+func (t filterTerm) isZero() bool { return t.re == nil && t.substr == "" && t.exact == "" }
+
+// MatchHit reports if the hit matches this filter, including the facets.
+func (f PathFilter) MatchHit(h Hit) bool {
+	for _, ff := range f.facets {
+		if !ff.match(h) {
+			return false
+		}
+	}
+	return f.Match(h.Path, h.Title)
+}
+
+// Match reports if the path or title match this filter; facets are ignored.
+func (f PathFilter) Match(path, title string) bool {
+	for _, e := range f.exclude {
+		if e.match(path, "") {
+			return false
+		}
+	}
+	return f.filterTerm.isZero() || f.filterTerm.match(path, title)
+}
+
+func (t filterTerm) match(path, title string) bool {
+	switch {
+	case t.re != nil:
+		return t.re.MatchString(path) || (title != "" && t.re.MatchString(title))
+	case t.exact != "":
+		return path == t.exact
+	default:
+		return strings.Contains(strings.ToLower(path), t.substr) ||
+			(title != "" && strings.Contains(strings.ToLower(title), t.substr))
+	}
+}
+
+// filterSQL gets the where clause for filter and the arguments for it; the
+// clause starts with " and " and uses "?" placeholders, so the query needs to
+// be rebound.
+//
+// Only the path is matched unless title is set. The facets aren't included;
+// use countsTable() or facetSQL() for that.
+func filterSQL(ctx context.Context, filter string, start, end time.Time, title bool) (string, []interface{}, error) {
+	f, err := ParseFilter(filter)
+	if err != nil || !f.HasPath() {
+		return "", nil, err
+	}
+
+	var (
+		query strings.Builder
+		args  []interface{}
+		rows  []filterRow
+		load  bool
+	)
+	// Paths for a regular expression; the rows are loaded only once.
+	paths := func(t filterTerm, title bool) ([]interface{}, error) {
+		if !load {
+			load = true
+			err := zdb.MustGet(ctx).SelectContext(ctx, &rows, `/* filterSQL */
+				select path, title from hit_counts
+				where site=$1 and hour>=$2 and hour<=$3
+				group by path, title`,
+				MustGetSite(ctx).ID, start.Format(zdb.Date), end.Format(zdb.Date))
+			if err != nil {
+				return nil, errors.Wrap(err, "filterSQL")
+			}
+		}
+		return matchPaths(rows, t.re, title)
+	}
+
+	switch t := f.filterTerm; {
+	case t.re != nil:
+		p, err := paths(t, title)
+		if err != nil {
+			return "", nil, err
+		}
+		if len(p) == 0 {
+			return ` and 1=0 `, nil, nil
+		}
+		query.WriteString(` and path in (?` + strings.Repeat(", ?", len(p)-1) + `) `)
+		args = append(args, p...)
+	case t.substr != "":
+		s := "%" + t.substr + "%"
+		if title {
+			query.WriteString(` and (lower(path) like ? or lower(title) like ?) `)
+			args = append(args, s, s)
+		} else {
+			query.WriteString(` and lower(path) like ? `)
+			args = append(args, s)
+		}
+	}
+
+	for _, t := range f.exclude {
+		switch {
+		case t.re != nil:
+			p, err := paths(t, false)
+			if err != nil {
+				return "", nil, err
+			}
+			if len(p) > 0 {
+				query.WriteString(` and path not in (?` + strings.Repeat(", ?", len(p)-1) + `) `)
+				args = append(args, p...)
+			}
+		case t.exact != "":
+			query.WriteString(` and path != ? `)
+			args = append(args, t.exact)
+		default:
+			query.WriteString(` and lower(path) not like ? `)
+			args = append(args, "%"+t.substr+"%")
+		}
+	}
+	return query.String(), args, nil
+}
+
+type filterRow struct {
+	Path  string `db:"path"`
+	Title string `db:"title"`
+}
+
+// matchPaths gets all distinct paths in rows that match re, sorted.
+func matchPaths(rows []filterRow, re *regexp.Regexp, title bool) ([]interface{}, error) {
+	match := make(map[string]struct{})
+	for _, r := range rows {
+		if re.MatchString(r.Path) || (title && re.MatchString(r.Title)) {
+			match[r.Path] = struct{}{}
+		}
+	}
+	if len(match) > MaxFilterPaths {
+		v := zvalidate.New()
+		v.Append("filter", fmt.Sprintf(
+			"regular expression matches more than %d paths; use a more specific expression", MaxFilterPaths))
+		return nil, v
+	}
+
+	paths := make([]string, 0, len(match))
+	for p := range match {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	args := make([]interface{}, 0, len(paths))
+	for _, p := range paths {
+		args = append(args, p)
+	}
+	return args, nil
+}
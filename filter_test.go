@@ -0,0 +1,226 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"zgo.at/goatcounter"
+	"zgo.at/goatcounter/gctest"
+	"zgo.at/tz"
+)
+
+func TestParseFilter(t *testing.T) {
+	tests := []struct {
+		in, path, title string
+		want            bool
+		wantErr         string
+	}{
+		{"", "/a", "", true, ""},
+		{"BLOG", "/blog/x", "", true, ""},
+		{"blog", "/x", "My Blog", true, ""},
+		{"blog", "/x", "", false, ""},
+		{`~^/blog/\d+$`, "/blog/42", "", true, ""},
+		{`~^/blog/\d+$`, "/blog/42/x", "", false, ""},
+		{`~^/BLOG`, "/blog/x", "", true, ""},
+		{`~^/blog/(`, "", "", false, "invalid regular expression"},
+		{`~`, "", "", false, "filter"},
+		{"~" + strings.Repeat("a", goatcounter.MaxFilterRegexp+1), "", "", false, "filter"},
+		{"-/admin", "/admin/x", "", false, ""},
+		{"-/admin", "/x", "", true, ""},
+		{"-admin", "/x", "Admin page", true, ""},
+		{"path!=/health", "/health", "", false, ""},
+		{"path!=/health", "/health/x", "", true, ""},
+		{"blog -/blog/feed path!=/blog", "/blog/post", "", true, ""},
+		{"blog -/blog/feed path!=/blog", "/blog/feed.xml", "", false, ""},
+		{"blog -/blog/feed path!=/blog", "/blog", "", false, ""},
+		{`~^/blog -~^/blog/\d+$`, "/blog/x", "", true, ""},
+		{`~^/blog -~^/blog/\d+$`, "/blog/42", "", false, ""},
+		{"-", "/a-b", "", true, ""},
+		{"path!=", "", "", false, "path!="},
+		{"-~(", "", "", false, "invalid regular expression"},
+		{"country=DE", "/a", "", true, ""},
+		{"blog country=DE", "/a", "", false, ""},
+		{`browser="Mobile Safari" blog`, "/blog", "", true, ""},
+		{"country=", "", "", false, "country needs a value"},
+		{`ref=""`, "/a", "", true, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			f, err := goatcounter.ParseFilter(tt.in)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("wrong error: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := f.Match(tt.path, tt.title); got != tt.want {
+				t.Errorf("Match(%q, %q) = %t", tt.path, tt.title, got)
+			}
+		})
+	}
+}
+
+func TestFilterRegexp(t *testing.T) {
+	ctx, clean := gctest.DB(t)
+	defer clean()
+
+	now := time.Date(2020, 6, 18, 12, 0, 0, 0, time.UTC)
+	gctest.StoreHits(ctx, t,
+		goatcounter.Hit{Path: "/blog/1", CreatedAt: now},
+		goatcounter.Hit{Path: "/blog/2", CreatedAt: now},
+		goatcounter.Hit{Path: "/blog/feed", CreatedAt: now},
+		goatcounter.Hit{Path: "/about", CreatedAt: now})
+
+	start, end := now.Add(-time.Hour), now.Add(time.Hour)
+	for filter, want := range map[string]int{
+		"":              4,
+		"blog":          3,
+		`~^/blog/\d+$`:  2,
+		`~^/nothing$`:   0,
+		`~^/(about|x)$`: 1,
+		"-/blog":        1,
+		"blog -feed":    2,
+		"path!=/about":  3,
+		`-~^/blog/\d+$`: 2,
+		`~^/blog -~\d`:  1,
+	} {
+		total, _, err := goatcounter.GetTotalCount(ctx, start, end, filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if total != want {
+			t.Errorf("%q: got %d; want %d", filter, total, want)
+		}
+	}
+}
+
+func TestFilterFacets(t *testing.T) {
+	ctx, clean := gctest.DB(t)
+	defer clean()
+
+	var (
+		now     = time.Date(2020, 6, 18, 12, 0, 0, 0, time.UTC)
+		firefox = "Mozilla/5.0 (X11; Linux x86_64; rv:72.0) Gecko/20100101 Firefox/72.0"
+		chrome  = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/83.0.4103.116 Safari/537.36"
+	)
+	gctest.StoreHits(ctx, t,
+		goatcounter.Hit{Path: "/a", CreatedAt: now, Location: "DE", Browser: firefox, Language: "de"},
+		goatcounter.Hit{Path: "/a", CreatedAt: now, Location: "DE", Browser: chrome, Language: "de"},
+		goatcounter.Hit{Path: "/b", CreatedAt: now, Location: "NL", Browser: firefox, Ref: "https://example.com"},
+		goatcounter.Hit{Path: "/b", CreatedAt: now, Location: "DE", Browser: firefox})
+
+	start, end := now.Add(-time.Hour), now.Add(time.Hour)
+	for filter, want := range map[string]int{
+		"":                           4,
+		"country=DE":                 3,
+		"country=de":                 3,
+		"country=Germany":            3,
+		"country!=DE":                1,
+		"browser=Firefox":            3,
+		"browser=firefox country=DE": 2,
+		"browser!=Firefox":           1,
+		"browser=Safari":             0,
+		"system=Linux":               3,
+		"ref=example.com":            1,
+		`ref=""`:                     3,
+		"/b country=DE":              1,
+		"language=de":                2,
+		"language=DE country=DE":     2,
+		"language!=de":               2,
+	} {
+		total, _, err := goatcounter.GetTotalCount(ctx, start, end, filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if total != want {
+			t.Errorf("%q: got %d; want %d", filter, total, want)
+		}
+	}
+
+	_, _, err := goatcounter.GetTotalCount(ctx, start, end, "country=Atlantis")
+	if err == nil || !strings.Contains(err.Error(), "unknown country") {
+		t.Errorf("wrong error: %v", err)
+	}
+
+	// The path part of the filter doesn't apply to the browsers.
+	var browsers goatcounter.Stats
+	err = browsers.ListBrowsers(ctx, start, end, "/b country=DE", 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, s := range browsers.Stats {
+		got = append(got, fmt.Sprintf("%s %d", s.Name, s.Count))
+	}
+	if g := strings.Join(got, ", "); g != "Chrome 1, Firefox 2" && g != "Firefox 2, Chrome 1" {
+		t.Errorf("wrong browsers: %s", g)
+	}
+
+	var hs goatcounter.HitStats
+	_, _, _, err = hs.List(ctx, start, end, "country=NL", nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hs) != 1 || hs[0].Path != "/b" || hs[0].Count != 1 {
+		t.Errorf("wrong stats: %v", hs)
+	}
+}
+
+func TestFilterFacetsDST(t *testing.T) {
+	ctx, clean := gctest.DB(t)
+	defer clean()
+
+	ctx, site := gctest.Site(ctx, t, goatcounter.Site{
+		Settings: goatcounter.SiteSettings{Timezone: tz.MustNew("", "Europe/Amsterdam")},
+	})
+
+	// 23:30 on Jan 15 (UTC+1) and 00:30 on Jun 16 (UTC+2).
+	gctest.StoreHits(ctx, t,
+		goatcounter.Hit{Site: site.ID, Path: "/a", Language: "de", CreatedAt: time.Date(2020, 1, 15, 22, 30, 0, 0, time.UTC)},
+		goatcounter.Hit{Site: site.ID, Path: "/a", Language: "de", CreatedAt: time.Date(2020, 6, 15, 22, 30, 0, 0, time.UTC)})
+
+	// The user's timezone doesn't change the day, as it doesn't for the
+	// language_stats table.
+	s := site.WithUserTimezone(tz.MustNew("", "Asia/Tokyo"))
+	ctx = goatcounter.WithSite(ctx, &s)
+
+	tests := []struct {
+		start, end string
+		want       int
+	}{
+		{"2020-01-15", "2020-01-15", 1},
+		{"2020-06-15", "2020-06-15", 0},
+		{"2020-06-15", "2020-06-16", 1},
+		{"2020-01-01", "2020-06-30", 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.start+" "+tt.end, func(t *testing.T) {
+			start, _ := time.Parse("2006-01-02", tt.start)
+			end, _ := time.Parse("2006-01-02", tt.end)
+
+			var stats goatcounter.Stats
+			err := stats.ListLanguages(ctx, start, end.Add(24*time.Hour-time.Second), "language=de", 10, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := 0
+			if len(stats.Stats) > 0 {
+				got = stats.Stats[0].Count
+			}
+			if got != tt.want {
+				t.Errorf("got %d; want %d", got, tt.want)
+			}
+		})
+	}
+}
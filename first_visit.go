@@ -0,0 +1,112 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"context"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"zgo.at/errors"
+	"zgo.at/zdb"
+	"zgo.at/zstd/zint"
+)
+
+// FixFirstVisit recomputes the first_visit flag for all hits in this period,
+// returning the number of hits that were changed.
+//
+// The first_visit flag should be set for the first hit of every path in a
+// session, but this is only correct if hits are recorded in order. Importing
+// historical data so that it overlaps with existing data (or merging sites)
+// can leave it wrong, and with that all the unique counts. The stats tables
+// aren't updated; use "goatcounter reindex" for that.
+//
+// Hits without a session (from before sessions were introduced) are left
+// alone.
+func FixFirstVisit(ctx context.Context, start, end time.Time) (int, error) {
+	var (
+		db      = zdb.MustGet(ctx)
+		siteID  = MustGetSite(ctx).ID
+		seen    = make(map[zint.Uint128]map[string]struct{})
+		seenAt  = make(map[zint.Uint128]time.Time)
+		changed int
+	)
+
+	start = time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, time.UTC)
+	// Start a day earlier so that sessions that started before the period are
+	// known; the changes for this day aren't written.
+	for day := start.Add(-24 * time.Hour); !day.After(end); day = day.Add(24 * time.Hour) {
+		var hits []struct {
+			ID         int64        `db:"id"`
+			Session    zint.Uint128 `db:"session2"`
+			Path       string       `db:"path"`
+			FirstVisit zdb.Bool     `db:"first_visit"`
+			CreatedAt  time.Time    `db:"created_at"`
+		}
+		err := db.SelectContext(ctx, &hits, `/* FixFirstVisit */
+			select id, session2, path, first_visit, created_at from hits
+			where site=$1 and session2 is not null and created_at>=$2 and created_at<=$3
+			order by created_at asc, id asc`,
+			siteID, day.Format(zdb.Date), day.Add(24*time.Hour-time.Second).Format(zdb.Date))
+		if err != nil {
+			return changed, errors.Wrap(err, "FixFirstVisit")
+		}
+
+		var set, unset []int64
+		for _, h := range hits {
+			if seen[h.Session] == nil {
+				seen[h.Session] = make(map[string]struct{})
+			}
+			_, ok := seen[h.Session][h.Path]
+			seen[h.Session][h.Path] = struct{}{}
+			seenAt[h.Session] = h.CreatedAt
+
+			switch {
+			case !ok && !bool(h.FirstVisit):
+				set = append(set, h.ID)
+			case ok && bool(h.FirstVisit):
+				unset = append(unset, h.ID)
+			}
+		}
+
+		if day.Before(start) {
+			continue
+		}
+
+		for _, u := range []struct {
+			v   int
+			ids []int64
+		}{{1, set}, {0, unset}} {
+			for len(u.ids) > 0 {
+				n := 500
+				if n > len(u.ids) {
+					n = len(u.ids)
+				}
+				query, args, err := sqlx.In(`/* FixFirstVisit */
+					update hits set first_visit=? where site=? and id in (?)`, u.v, siteID, u.ids[:n])
+				if err != nil {
+					return changed, errors.Wrap(err, "FixFirstVisit")
+				}
+				_, err = db.ExecContext(ctx, db.Rebind(query), args...)
+				if err != nil {
+					return changed, errors.Wrap(err, "FixFirstVisit")
+				}
+				changed += n
+				u.ids = u.ids[n:]
+			}
+		}
+
+		// Sessions don't last more than a few hours, so there's no need to
+		// keep track of them forever.
+		for s, t := range seenAt {
+			if t.Before(day.Add(-24 * time.Hour)) {
+				delete(seen, s)
+				delete(seenAt, s)
+			}
+		}
+	}
+
+	return changed, nil
+}
@@ -0,0 +1,57 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"zgo.at/goatcounter"
+	"zgo.at/goatcounter/gctest"
+	"zgo.at/zdb"
+	"zgo.at/zstd/zint"
+)
+
+func TestFixFirstVisit(t *testing.T) {
+	ctx, clean := gctest.DB(t)
+	defer clean()
+
+	s1, s2 := zint.Uint128{H: 1, L: 1}, zint.Uint128{H: 2, L: 2}
+	now := time.Date(2020, 6, 18, 23, 50, 0, 0, time.UTC)
+	gctest.StoreHits(ctx, t,
+		goatcounter.Hit{Path: "/a", Session: s1, CreatedAt: now, FirstVisit: false},
+		goatcounter.Hit{Path: "/a", Session: s1, CreatedAt: now.Add(time.Minute), FirstVisit: true},
+		goatcounter.Hit{Path: "/a", Session: s1, CreatedAt: now.Add(20 * time.Minute), FirstVisit: true},
+		goatcounter.Hit{Path: "/b", Session: s1, CreatedAt: now.Add(21 * time.Minute), FirstVisit: true},
+		goatcounter.Hit{Path: "/a", Session: s2, CreatedAt: now.Add(22 * time.Minute), FirstVisit: false})
+
+	// Only the second day; the first day should still be used to know about s1.
+	n, err := goatcounter.FixFirstVisit(ctx, now.Add(24*time.Hour), now.Add(24*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("changed %d hits; want 2", n)
+	}
+
+	var got []int
+	err = zdb.MustGet(ctx).SelectContext(ctx, &got, `select first_visit from hits order by id`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "[0 1 0 1 1]"
+	if fmt.Sprint(got) != want {
+		t.Errorf("\ngot:  %v\nwant: %s", got, want)
+	}
+
+	n, err = goatcounter.FixFirstVisit(ctx, now, now.Add(24*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("changed %d hits; want 2", n)
+	}
+}
@@ -94,6 +94,7 @@ func DB(t tester) (context.Context, func()) {
 
 	return ctx, func() {
 		goatcounter.Memstore.Reset()
+		goatcounter.ClearCaches()
 
 		// TODO: run after all tests are done.
 		// out, err := exec.Command("dropdb", dbname).CombinedOutput()
@@ -174,8 +175,10 @@ func setupDB(t tester) {
 
 func initData(ctx context.Context, t tester) context.Context {
 	{
+		// Don't use "test" for the code, as that's reserved and Site.Update()
+		// would fail.
 		_, err := db.ExecContext(ctx, `insert into sites
-			(code, plan, settings, created_at) values ('test', 'personal', '{}', $1)`,
+			(code, plan, settings, created_at) values ('gctest', 'personal', '{}', $1)`,
 			goatcounter.Now().Format(zdb.Date))
 		if err != nil {
 			t.Fatalf("create site: %s", err)
@@ -266,6 +269,7 @@ func Site(ctx context.Context, t *testing.T, site goatcounter.Site) (context.Con
 		user.Site = 1
 		user.Email = "test@example.com"
 		user.Password = []byte("coconuts")
+		user.Owner = true
 		err = user.Insert(ctx)
 	}
 	if err != nil {
@@ -282,8 +286,17 @@ func SwapNow(t *testing.T, date string) func() {
 		t.Fatal(err)
 	}
 
-	goatcounter.Now = func() time.Time { return d }
-	return func() {
-		goatcounter.Now = func() time.Time { return time.Now().UTC() }
+	return goatcounter.SetClock(goatcounter.NewFixedClock(d))
+}
+
+// Clock sets a goatcounter.FixedClock at date, which can be moved forward in
+// the test. The returned function restores the system clock.
+func Clock(t *testing.T, date string) (*goatcounter.FixedClock, func()) {
+	d, err := time.Parse("2006-01-02 15:04:05", date)
+	if err != nil {
+		t.Fatal(err)
 	}
+
+	c := goatcounter.NewFixedClock(d)
+	return c, goatcounter.SetClock(c)
 }
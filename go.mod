@@ -1,24 +1,37 @@
 module zgo.at/goatcounter
 
-go 1.13
+go 1.15
 
 require (
 	code.soquee.net/otp v0.0.1
+	github.com/BurntSushi/toml v0.3.1
 	github.com/PuerkitoBio/goquery v1.5.1
 	github.com/arp242/geoip2-golang v1.4.0
 	github.com/boombuler/barcode v1.0.0
+	github.com/coreos/go-oidc v2.2.1+incompatible
 	github.com/go-chi/chi v4.1.2+incompatible
-	github.com/google/uuid v1.1.1
+	github.com/go-ldap/ldap/v3 v3.2.3
+	github.com/google/uuid v1.1.2
 	github.com/jmoiron/sqlx v1.2.0
 	github.com/lib/pq v1.7.1
+	// quic-go v0.18 only builds with Go 1.14 and 1.15; update it together with
+	// the go directive.
+	github.com/lucas-clemente/quic-go v0.18.0
 	github.com/mattn/go-sqlite3 v1.14.0
 	github.com/monoculum/formam v0.0.0-20200527175922-6f3cce7a46cf
+	github.com/pquerna/cachecontrol v0.2.0 // indirect
 	github.com/teamwork/reload v1.3.2
 	github.com/zgoat/kommentaar v0.0.0-20200718094027-9fe5c6e0bb9a
+	go.opentelemetry.io/otel v1.0.0
+	go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp v1.0.0
+	go.opentelemetry.io/otel/sdk v1.0.0
+	go.opentelemetry.io/otel/trace v1.0.0
 	golang.org/x/crypto v0.0.0-20200709230013-948cd5f35899
-	golang.org/x/net v0.0.0-20200707034311-ab3426394381
+	golang.org/x/net v0.0.0-20200822124328-c89045814202
+	golang.org/x/oauth2 v0.0.0-20200107190931-bf48bf16ab8d
 	golang.org/x/sync v0.0.0-20200625203802-6e8e738ad208
 	golang.org/x/tools v0.0.0-20200721223218-6123e77877b2
+	gopkg.in/square/go-jose.v2 v2.6.0 // indirect
 	honnef.co/go/tools v0.0.1-2020.1.4
 	zgo.at/blackmail v0.0.0-20200703094839-f1e44ef1dbb8
 	zgo.at/errors v0.0.0-20200630143612-2b870b08fb1d
@@ -0,0 +1,172 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"zgo.at/goatcounter"
+	"zgo.at/goatcounter/cfg"
+	"zgo.at/zlog"
+)
+
+// AccessLogFormats are the supported formats for AccessLog().
+var AccessLogFormats = []string{"common", "combined", "json"}
+
+// AccessLog writes a line for every request to w, in the NCSA common or
+// combined log format, or as JSON.
+//
+// This is separate from the error logging in zlog; it's intended to debug
+// traffic without having to run a proxy in front of GoatCounter.
+func AccessLog(w io.Writer, format string, next http.Handler) http.Handler {
+	var mu sync.Mutex
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: rw}
+		inner := &accessLogRequest{r: r}
+		next.ServeHTTP(sw, r.WithContext(context.WithValue(r.Context(), keyAccessLog, inner)))
+		if sw.status == 0 {
+			sw.status = 200
+		}
+
+		line := accessLogLine(format, r, inner.r, sw.status, sw.size, start)
+		mu.Lock()
+		_, err := w.Write(line)
+		mu.Unlock()
+		if err != nil {
+			zlog.Module("access-log").Error(err)
+		}
+	})
+}
+
+// accessLogLine formats the line for r; inner is the request as seen by the
+// handler, which has the real IP address and the site.
+func accessLogLine(format string, r, inner *http.Request, status int, size int64, start time.Time) []byte {
+	host, _, err := net.SplitHostPort(inner.RemoteAddr)
+	if err != nil {
+		host = inner.RemoteAddr
+	}
+	if site := goatcounter.GetSite(inner.Context()); site != nil {
+		host = site.VisitorIP(host)
+	} else if cfg.AnonymizeIP {
+		host = goatcounter.AnonymizeIP(host)
+	}
+	uri := redactURI(r.RequestURI)
+
+	if format == "json" {
+		j, _ := json.Marshal(struct {
+			Time      string  `json:"time"`
+			Remote    string  `json:"remote"`
+			Host      string  `json:"host"`
+			Method    string  `json:"method"`
+			Path      string  `json:"path"`
+			Proto     string  `json:"proto"`
+			Status    int     `json:"status"`
+			Size      int64   `json:"size"`
+			Duration  float64 `json:"duration_ms"`
+			Referer   string  `json:"referer,omitempty"`
+			UserAgent string  `json:"user_agent,omitempty"`
+		}{
+			start.UTC().Format(time.RFC3339Nano), host, r.Host, r.Method,
+			uri, r.Proto, status, size,
+			float64(time.Since(start).Microseconds()) / 1000,
+			r.Referer(), r.UserAgent(),
+		})
+		return append(j, '\n')
+	}
+
+	sz := "-"
+	if size > 0 {
+		sz = strconv.FormatInt(size, 10)
+	}
+	line := fmt.Sprintf(`%s - - [%s] "%s %s %s" %d %s`,
+		host, start.Format("02/Jan/2006:15:04:05 -0700"), r.Method, uri, r.Proto,
+		status, sz)
+	if format == "combined" {
+		line += fmt.Sprintf(` %q %q`, r.Referer(), r.UserAgent())
+	}
+	return []byte(line + "\n")
+}
+
+// Query parameters that are replaced with "REDACTED" in the log; tokens for the
+// API and the OpenID Connect callback can be sent in the URL.
+var accessLogRedact = map[string]struct{}{
+	"access_token": {}, "token": {}, "key": {}, "secret": {}, "password": {},
+	"code": {}, "state": {}, "id_token": {},
+}
+
+func redactURI(uri string) string {
+	i := strings.IndexByte(uri, '?')
+	if i == -1 {
+		return uri
+	}
+
+	params := strings.Split(uri[i+1:], "&")
+	for j, p := range params {
+		raw := p
+		if e := strings.IndexByte(p, '='); e > -1 {
+			raw = p[:e]
+		}
+		k, err := url.QueryUnescape(raw)
+		if err != nil {
+			k = raw
+		}
+		if _, ok := accessLogRedact[strings.ToLower(k)]; ok {
+			params[j] = raw + "=REDACTED"
+		}
+	}
+	return uri[:i+1] + strings.Join(params, "&")
+}
+
+// accessLogRequest is set by addctx, as the site and the client's real IP
+// address are only known after the router's middleware ran.
+type accessLogRequest struct{ r *http.Request }
+
+// setAccessLogRequest records the request with the site in the context and the
+// real IP address, for the access log.
+func setAccessLogRequest(r *http.Request) {
+	if a, ok := r.Context().Value(keyAccessLog).(*accessLogRequest); ok {
+		a.r = r
+	}
+}
+
+// statusWriter records the status code and response size.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	size   int64
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = 200
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"zgo.at/goatcounter"
+)
+
+func TestAccessLog(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/count" {
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		w.Write([]byte("hello"))
+	})
+
+	tests := []struct {
+		format, path, want string
+	}{
+		{"common", "/count?p=/x", `^192\.0\.2\.1 - - \[.+?\] "GET /count\?p=/x HTTP/1\.1" 202 -\n$`},
+		{"common", "/", `^192\.0\.2\.1 - - \[.+?\] "GET / HTTP/1\.1" 200 5\n$`},
+		{"combined", "/", `^192\.0\.2\.1 - - \[.+?\] "GET / HTTP/1\.1" 200 5 "http://ref\.example\.com" "Test/1\.0"\n$`},
+		{"common", "/api/v0/stats/stream?x=1&access_token=abc&Code", `^192\.0\.2\.1 - - \[.+?\] "GET /api/v0/stats/stream\?x=1&access_token=REDACTED&Code=REDACTED HTTP/1\.1" 200 5\n$`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.format+tt.path, func(t *testing.T) {
+			buf := new(bytes.Buffer)
+			r := httptest.NewRequest("GET", tt.path, nil)
+			r.Header.Set("Referer", "http://ref.example.com")
+			r.Header.Set("User-Agent", "Test/1.0")
+			AccessLog(buf, tt.format, next).ServeHTTP(httptest.NewRecorder(), r)
+
+			if !regexp.MustCompile(tt.want).MatchString(buf.String()) {
+				t.Errorf("\nwant: %s\nhave: %q", tt.want, buf.String())
+			}
+		})
+	}
+
+	t.Run("json", func(t *testing.T) {
+		buf := new(bytes.Buffer)
+		r := httptest.NewRequest("GET", "/count?p=/x", nil)
+		AccessLog(buf, "json", next).ServeHTTP(httptest.NewRecorder(), r)
+
+		var have map[string]interface{}
+		err := json.Unmarshal(buf.Bytes(), &have)
+		if err != nil {
+			t.Fatalf("%s: %q", err, buf.String())
+		}
+		if have["status"] != 202.0 || have["path"] != "/count?p=/x" || have["remote"] != "192.0.2.1" {
+			t.Errorf("%q", buf.String())
+		}
+	})
+}
+
+func TestAccessLogSite(t *testing.T) {
+	// Set the site like addctx does.
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		setAccessLogRequest(r)
+		site := goatcounter.Site{Settings: goatcounter.SiteSettings{AnonymizeIP: true}}
+		*r = *r.WithContext(goatcounter.WithSite(r.Context(), &site))
+	})
+
+	buf := new(bytes.Buffer)
+	r := httptest.NewRequest("GET", "/", nil)
+	AccessLog(buf, "common", next).ServeHTTP(httptest.NewRecorder(), r)
+
+	want := `^192\.0\.2\.0 - - `
+	if !regexp.MustCompile(want).MatchString(buf.String()) {
+		t.Errorf("\nwant: %s\nhave: %q", want, buf.String())
+	}
+}
@@ -70,7 +70,7 @@ func (h admin) index(w http.ResponseWriter, r *http.Request) error {
 		return err
 	}
 	grouped := make(map[string]int) // day → count
-	cutoff := time.Now().Add(-120 * 24 * time.Hour)
+	cutoff := goatcounter.Now().Add(-120 * 24 * time.Hour)
 	for _, s := range sites {
 		if s.Parent != nil {
 			continue
@@ -5,20 +5,29 @@
 package handlers
 
 import (
+	"context"
+	"encoding/xml"
+	"fmt"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/go-chi/chi"
 	"github.com/go-chi/chi/middleware"
 	"zgo.at/errors"
 	"zgo.at/goatcounter"
 	"zgo.at/goatcounter/bgrun"
+	"zgo.at/goatcounter/cron"
 	"zgo.at/guru"
+	"zgo.at/tz"
 	"zgo.at/zdb"
 	"zgo.at/zhttp"
 	"zgo.at/zhttp/header"
+	"zgo.at/zlog"
+	"zgo.at/zstd/zjson"
 	"zgo.at/zvalidate"
 )
 
@@ -26,6 +35,7 @@ type api struct{}
 
 func (h api) mount(r chi.Router, db zdb.DB) {
 	a := r.With(
+		allowIPs,
 		middleware.AllowContentType("application/json"),
 		zhttp.Ratelimit(zhttp.RatelimitOptions{
 			Client: zhttp.RatelimitIP,
@@ -37,12 +47,45 @@ func (h api) mount(r chi.Router, db zdb.DB) {
 	a.Post("/api/v0/export", zhttp.Wrap(h.export))
 	a.Get("/api/v0/export/{id}", zhttp.Wrap(h.exportGet))
 	a.Get("/api/v0/export/{id}/download", zhttp.Wrap(h.exportDownload))
+	a.Get("/api/v0/stats/stream", zhttp.Wrap(h.statsStream))
+	{
+		ro := a.With(readOnly)
+		ro.Get("/api/v0/stats/live", zhttp.Wrap(h.statsLive))
+		ro.Get("/api/v0/stats/feed", zhttp.Wrap(h.statsFeed))
+		ro.Get("/api/v0/stats/retention", zhttp.Wrap(h.statsRetention))
+		ro.Get("/api/v0/stats/entries", zhttp.Wrap(h.statsEntries))
+		ro.Get("/api/v0/stats/exits", zhttp.Wrap(h.statsExits))
+		ro.Get("/api/v0/timeseries", zhttp.Wrap(h.timeseries))
+		ro.Get("/api/v0/grafana", zhttp.Wrap(h.grafanaTest))
+		ro.Post("/api/v0/grafana/search", zhttp.Wrap(h.grafanaSearch))
+		ro.Post("/api/v0/grafana/query", zhttp.Wrap(h.grafanaQuery))
+		ro.Post("/api/v0/grafana/annotations", zhttp.Wrap(h.grafanaAnnotations))
+	}
+	a.Get("/api/v0/annotations", zhttp.Wrap(h.annotationList))
+	a.Post("/api/v0/annotations", zhttp.Wrap(h.annotationAdd))
+	a.Delete("/api/v0/annotations/{id}", zhttp.Wrap(h.annotationDelete))
+	a.Get("/api/v0/settings", zhttp.Wrap(h.settingsGet))
+	a.Patch("/api/v0/settings", zhttp.Wrap(h.settingsUpdate))
+	a.Get("/api/v0/bot-rules", zhttp.Wrap(h.botRulesList))
+	a.Put("/api/v0/bot-rules", zhttp.Wrap(h.botRulesSet))
+	a.Get("/api/v0/users", zhttp.Wrap(h.userList))
+	a.Put("/api/v0/users/{id}/role", zhttp.Wrap(h.userRole))
+	a.Post("/api/v0/reindex", zhttp.Wrap(h.reindex))
+	a.Post("/api/v0/erase", zhttp.Wrap(h.erase))
+
+	a.Get("/api/v0/query", zhttp.Wrap(h.queryList))
+	a.With(readOnly, zhttp.Ratelimit(zhttp.RatelimitOptions{
+		Client:  func(r *http.Request) string { return r.Header.Get("Authorization") },
+		Store:   zhttp.NewRatelimitMemory(),
+		Limit:   zhttp.RatelimitLimit(100, 3600),
+		Message: "you can run only 100 queries per hour",
+	})).Post("/api/v0/query", zhttp.Wrap(h.query))
 
 	a.Get("/api/v0/test", zhttp.Wrap(h.test))
 	a.Post("/api/v0/test", zhttp.Wrap(h.test))
 }
 
-func (h api) auth(r *http.Request, perm goatcounter.APITokenPermissions) error {
+func (h api) auth(r *http.Request, perm ...goatcounter.Permission) error {
 	auth := r.Header.Get("Authorization")
 	if auth == "" {
 		return guru.New(http.StatusForbidden, "no Authorization header")
@@ -62,41 +105,43 @@ func (h api) auth(r *http.Request, perm goatcounter.APITokenPermissions) error {
 		return err
 	}
 
+	// Use the user who created the token, so that things like saved segments
+	// are the caller's, and the token can't do more than the user can.
 	var user goatcounter.User
-	err = user.BySite(r.Context(), token.SiteID)
+	if token.UserID > 0 {
+		err = user.ByID(r.Context(), token.UserID)
+	} else {
+		err = user.BySite(r.Context(), token.SiteID)
+	}
 	if err != nil {
 		return err
 	}
 
 	*r = *r.WithContext(goatcounter.WithUser(r.Context(), &user))
 
-	var need []string
-	if perm.Count && !token.Permissions.Count {
-		need = append(need, "count")
-	}
-	if perm.Export && !token.Permissions.Export {
-		need = append(need, "export")
-	}
-
-	if len(need) > 0 {
-		return guru.Errorf(http.StatusForbidden, "requires %s permissions", need)
+	err = user.Can(r.Context(), perm...)
+	if err != nil {
+		return err
 	}
-
-	return nil
+	return token.Can(r.Context(), perm...)
 }
 
 type apiExportRequest struct {
 	// Pagination cursor; only export hits with an ID greater than this.
 	StartFromHitID int64 `json:"start_from_hit_id"`
+
+	// Only export pageviews where the path or title matches this; start with
+	// ~ to use a regular expression.
+	Filter string `json:"filter"`
 }
 
 // For testing various generic properties about the API.
 func (h api) test(w http.ResponseWriter, r *http.Request) error {
 	var args struct {
-		Perm     goatcounter.APITokenPermissions `json:"perm"`
-		Status   int                             `json:"status"`
-		Panic    bool                            `json:"panic"`
-		Validate zvalidate.Validator             `json:"validate"`
+		Perm     goatcounter.PermissionSet `json:"perm"`
+		Status   int                       `json:"status"`
+		Panic    bool                      `json:"panic"`
+		Validate zvalidate.Validator       `json:"validate"`
 	}
 
 	_, err := zhttp.Decode(r, &args)
@@ -104,7 +149,7 @@ func (h api) test(w http.ResponseWriter, r *http.Request) error {
 		return err
 	}
 
-	err = h.auth(r, args.Perm)
+	err = h.auth(r, args.Perm...)
 	if err != nil {
 		return err
 	}
@@ -136,9 +181,7 @@ func (h api) test(w http.ResponseWriter, r *http.Request) error {
 // Request body: apiExportRequest
 // Response 202: zgo.at/goatcounter.Export
 func (h api) export(w http.ResponseWriter, r *http.Request) error {
-	err := h.auth(r, goatcounter.APITokenPermissions{
-		Export: true,
-	})
+	err := h.auth(r, goatcounter.PermExport)
 	if err != nil {
 		return err
 	}
@@ -148,8 +191,16 @@ func (h api) export(w http.ResponseWriter, r *http.Request) error {
 	if err != nil {
 		return err
 	}
+	filter, err := goatcounter.ParseFilter(req.Filter)
+	if err != nil {
+		return err
+	}
+	err = filter.Resolve(r.Context())
+	if err != nil {
+		return err
+	}
 
-	var export goatcounter.Export
+	export := goatcounter.Export{Filter: filter}
 	fp, err := export.Create(r.Context(), req.StartFromHitID)
 	if err != nil {
 		return err
@@ -167,9 +218,7 @@ func (h api) export(w http.ResponseWriter, r *http.Request) error {
 //
 // Response 200: zgo.at/goatcounter.Export
 func (h api) exportGet(w http.ResponseWriter, r *http.Request) error {
-	err := h.auth(r, goatcounter.APITokenPermissions{
-		Export: true,
-	})
+	err := h.auth(r, goatcounter.PermExport)
 	if err != nil {
 		return err
 	}
@@ -194,9 +243,7 @@ func (h api) exportGet(w http.ResponseWriter, r *http.Request) error {
 //
 // Response 200 (text/csv): {data}
 func (h api) exportDownload(w http.ResponseWriter, r *http.Request) error {
-	err := h.auth(r, goatcounter.APITokenPermissions{
-		Export: true,
-	})
+	err := h.auth(r, goatcounter.PermExport)
 	if err != nil {
 		return err
 	}
@@ -236,10 +283,842 @@ func (h api) exportDownload(w http.ResponseWriter, r *http.Request) error {
 	return zhttp.Stream(w, fp)
 }
 
-func (h api) count(w http.ResponseWriter, r *http.Request) error {
-	err := h.auth(r, goatcounter.APITokenPermissions{
-		Count: true,
+// GET /api/v0/stats/live stats
+// Get the visitors right now.
+//
+// The unique visitors and the top pages in the last 5 minutes.
+//
+// Response 200: zgo.at/goatcounter.LiveStats
+func (h api) statsLive(w http.ResponseWriter, r *http.Request) error {
+	err := h.auth(r, goatcounter.PermStats)
+	if err != nil {
+		return err
+	}
+
+	var live goatcounter.LiveStats
+	err = live.Get(r.Context(), 10)
+	if err != nil {
+		return err
+	}
+	return zhttp.JSON(w, live)
+}
+
+// segment gets the saved segment in the segment query parameter, or nil if
+// it's not set.
+func (h api) segment(r *http.Request) (*goatcounter.Segment, error) {
+	name := r.URL.Query().Get("segment")
+	if name == "" {
+		return nil, nil
+	}
+
+	var s goatcounter.Segment
+	err := s.ByName(r.Context(), name)
+	if err != nil {
+		if zdb.ErrNoRows(err) {
+			return nil, guru.Errorf(404, "no segment %q", name)
+		}
+		return nil, err
+	}
+	return &s, nil
+}
+
+// period gets the start and end query parameters as YYYY-MM-DD in the timezone
+// of the tz parameter; the default is the last 7 days, or the period of the
+// segment if it's not nil.
+func (h api) period(v *zvalidate.Validator, q url.Values, seg *goatcounter.Segment) (time.Time, time.Time) {
+	loc := h.timezone(v, q)
+	end := goatcounter.Now().In(loc)
+	start := end.Add(-7 * day)
+	if seg != nil {
+		start, end = seg.Range(goatcounter.Now(), loc)
+	}
+	if s := q.Get("start"); s != "" {
+		y, m, d := v.Date("start", s, "2006-01-02").Date()
+		start = time.Date(y, m, d, 0, 0, 0, 0, loc)
+	}
+	if e := q.Get("end"); e != "" {
+		y, m, d := v.Date("end", e, "2006-01-02").Date()
+		end = time.Date(y, m, d, 23, 59, 59, 0, loc)
+	}
+	return start, end
+}
+
+// timezone gets the timezone from the tz parameter as an IANA name such as
+// "Europe/Amsterdam", or UTC if it's not set.
+func (h api) timezone(v *zvalidate.Validator, q url.Values) *time.Location {
+	z := q.Get("tz")
+	if z == "" {
+		return time.UTC
+	}
+	zone, err := tz.New("", z)
+	if err != nil {
+		v.Append("tz", fmt.Sprintf("unknown timezone: %q", z))
+		return time.UTC
+	}
+	return zone.Loc()
+}
+
+// GET /api/v0/timeseries stats
+// Get a timeseries.
+//
+// Get the pageviews or visitors per hour, day, or month for the top paths,
+// referrers, or countries. All times are in UTC, unless tz is set.
+//
+// The countries are stored per day in the site's timezone, so for country the
+// default for tz is the site's timezone and other timezones can't be used.
+//
+// Query parameters:
+//
+//	metric        pageviews (default) or visitors.
+//	group         path (default), ref, or country.
+//	granularity   hour, day (default), or month; hour isn't supported for country.
+//	start, end    Period as YYYY-MM-DD; the default is the last 7 days.
+//	tz            Timezone for the period and buckets as an IANA name, e.g.
+//	              Europe/Amsterdam; the default is UTC, or the site's
+//	              timezone for country.
+//	limit         Number of groups, 1-100; the default is 10.
+//	compare       Also get the same groups for the previous period or the same
+//	              period last year: previous or year.
+//	filter        Only include paths matching this; only for the path group.
+//	              Start with ~ to use a regular expression.
+//	segment       Use the period, filter, and compare of this saved segment;
+//	              any of the above parameters take precedence.
+//
+// Response 200: zgo.at/goatcounter.Timeseries
+func (h api) timeseries(w http.ResponseWriter, r *http.Request) error {
+	err := h.auth(r, goatcounter.PermStats)
+	if err != nil {
+		return err
+	}
+
+	var (
+		q     = r.URL.Query()
+		v     = zvalidate.New()
+		limit = int64(10)
+	)
+	seg, err := h.segment(r)
+	if err != nil {
+		return err
+	}
+	if q.Get("group") == "country" && q.Get("tz") == "" {
+		q.Set("tz", goatcounter.MustGetSite(r.Context()).StatsTimezone().Loc().String())
+	}
+	start, end := h.period(&v, q, seg)
+	if l := q.Get("limit"); l != "" {
+		limit = v.Integer("limit", l)
+	}
+	if v.HasErrors() {
+		return v
+	}
+
+	get := func(k, def string) string {
+		if s := q.Get(k); s != "" {
+			return s
+		}
+		return def
+	}
+
+	var filter, compare string
+	if seg != nil {
+		filter, compare = seg.Filter, seg.Compare
+	}
+
+	ts := goatcounter.Timeseries{Filter: get("filter", filter), Location: start.Location()}
+	err = ts.Get(r.Context(), get("metric", "pageviews"), get("group", "path"),
+		get("granularity", "day"), start, end, int(limit))
+	if err != nil {
+		return err
+	}
+	if c := get("compare", compare); c != "" {
+		err = ts.CompareWith(r.Context(), c)
+		if err != nil {
+			return err
+		}
+	}
+	return zhttp.JSON(w, ts)
+}
+
+// GET /api/v0/annotations stats
+// List annotations.
+//
+// List all annotations for the site, newest first.
+//
+// Response 200: zgo.at/goatcounter.Annotations
+func (h api) annotationList(w http.ResponseWriter, r *http.Request) error {
+	err := h.auth(r, goatcounter.PermStats)
+	if err != nil {
+		return err
+	}
+
+	a := goatcounter.Annotations{}
+	err = a.List(r.Context())
+	if err != nil {
+		return err
+	}
+	return zhttp.JSON(w, a)
+}
+
+type apiAnnotationRequest struct {
+	// Day as YYYY-MM-DD, in the site's timezone.
+	Day string `json:"day"`
+
+	// Text to display; at most 200 characters.
+	Text string `json:"text"`
+}
+
+// POST /api/v0/annotations settings
+// Add an annotation.
+//
+// Request body: apiAnnotationRequest
+// Response 201: zgo.at/goatcounter.Annotation
+func (h api) annotationAdd(w http.ResponseWriter, r *http.Request) error {
+	err := h.auth(r, goatcounter.PermSettings)
+	if err != nil {
+		return err
+	}
+
+	var req apiAnnotationRequest
+	_, err = zhttp.Decode(r, &req)
+	if err != nil {
+		return err
+	}
+
+	a := goatcounter.Annotation{Day: req.Day, Text: req.Text}
+	err = a.Insert(r.Context())
+	if err != nil {
+		return err
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	return zhttp.JSON(w, a)
+}
+
+// DELETE /api/v0/annotations/{id} settings
+// Remove an annotation.
+//
+// Response 204: {empty}
+func (h api) annotationDelete(w http.ResponseWriter, r *http.Request) error {
+	err := h.auth(r, goatcounter.PermSettings)
+	if err != nil {
+		return err
+	}
+
+	v := zvalidate.New()
+	id := v.Integer("id", chi.URLParam(r, "id"))
+	if v.HasErrors() {
+		return v
+	}
+
+	var a goatcounter.Annotation
+	err = a.ByID(r.Context(), id)
+	if err != nil {
+		return err
+	}
+	err = a.Delete(r.Context())
+	if err != nil {
+		return err
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// GET /api/v0/settings settings
+// Get the site settings.
+//
+// Response 200: zgo.at/goatcounter.SiteSettings
+func (h api) settingsGet(w http.ResponseWriter, r *http.Request) error {
+	err := h.auth(r, goatcounter.PermSettings)
+	if err != nil {
+		return err
+	}
+	return zhttp.JSON(w, goatcounter.MustGetSite(r.Context()).Settings)
+}
+
+// PATCH /api/v0/settings settings
+// Change the site settings.
+//
+// Only the settings that are in the request are changed; for example
+// {"ignore_ips": ["192.0.2.0/24 # office"]} changes just the IP ignore list.
+//
+// Request body: zgo.at/goatcounter.SiteSettings
+// Response 200: zgo.at/goatcounter.SiteSettings
+func (h api) settingsUpdate(w http.ResponseWriter, r *http.Request) error {
+	err := h.auth(r, goatcounter.PermSettings)
+	if err != nil {
+		return err
+	}
+
+	site := *goatcounter.MustGetSite(r.Context())
+	oldTZ := site.Settings.Timezone.Loc().String()
+	_, err = zhttp.Decode(r, &site.Settings)
+	if err != nil {
+		return err
+	}
+	err = site.Update(r.Context())
+	if err != nil {
+		return err
+	}
+
+	rebucket(r.Context(), site, oldTZ)
+	return zhttp.JSON(w, site.Settings)
+}
+
+type apiBotRules struct {
+	// Rules to mark pageviews as bot traffic. The type is "ua" to match a
+	// regular expression against the User-Agent, or "path" to match a pattern
+	// against the path, where "*" matches anything.
+	Rules []goatcounter.BotRule `json:"rules"`
+}
+
+// GET /api/v0/bot-rules settings
+// List the bot rules.
+//
+// Response 200: apiBotRules
+func (h api) botRulesList(w http.ResponseWriter, r *http.Request) error {
+	err := h.auth(r, goatcounter.PermSettings)
+	if err != nil {
+		return err
+	}
+
+	rules := goatcounter.MustGetSite(r.Context()).Settings.BotRules
+	if rules == nil {
+		rules = goatcounter.BotRules{}
+	}
+	return zhttp.JSON(w, apiBotRules{Rules: rules})
+}
+
+// PUT /api/v0/bot-rules settings
+// Replace the bot rules.
+//
+// The rules only apply to new pageviews.
+//
+// Request body: apiBotRules
+// Response 200: apiBotRules
+func (h api) botRulesSet(w http.ResponseWriter, r *http.Request) error {
+	err := h.auth(r, goatcounter.PermSettings)
+	if err != nil {
+		return err
+	}
+
+	var req apiBotRules
+	_, err = zhttp.Decode(r, &req)
+	if err != nil {
+		return err
+	}
+
+	site := goatcounter.MustGetSite(r.Context())
+	site.Settings.BotRules = req.Rules
+	err = site.Update(r.Context())
+	if err != nil {
+		return err
+	}
+	return zhttp.JSON(w, apiBotRules{Rules: site.Settings.BotRules})
+}
+
+// GET /api/v0/users settings
+// List the users of the site.
+//
+// Response 200: []zgo.at/goatcounter.User
+func (h api) userList(w http.ResponseWriter, r *http.Request) error {
+	err := h.auth(r, goatcounter.PermSettings)
+	if err != nil {
+		return err
+	}
+
+	var users goatcounter.Users
+	err = users.List(r.Context())
+	if err != nil {
+		return err
+	}
+	return zhttp.JSON(w, users)
+}
+
+type apiUserRoleRequest struct {
+	// Make the user a site owner, who can do everything; only owners can add
+	// other owners.
+	Owner bool `json:"owner"`
+
+	// Role to give the user if they're not an owner; users without owner or
+	// a role can't do anything.
+	RoleID *int64 `json:"role_id"`
+}
+
+// PUT /api/v0/users/{id}/role settings
+// Set the role of a user.
+//
+// The role can't have more permissions than the token's user, and the last
+// user with the settings permission can't be changed to a role without it.
+//
+// Request body: apiUserRoleRequest
+// Response 200: zgo.at/goatcounter.User
+func (h api) userRole(w http.ResponseWriter, r *http.Request) error {
+	err := h.auth(r, goatcounter.PermSettings)
+	if err != nil {
+		return err
+	}
+
+	v := zvalidate.New()
+	id := v.Integer("id", chi.URLParam(r, "id"))
+	if v.HasErrors() {
+		return v
+	}
+
+	var req apiUserRoleRequest
+	_, err = zhttp.Decode(r, &req)
+	if err != nil {
+		return err
+	}
+
+	u, err := setUserRole(r.Context(), id, req.Owner, req.RoleID)
+	if err != nil {
+		return err
+	}
+	return zhttp.JSON(w, u)
+}
+
+type apiReindexRequest struct {
+	// Recalculate the statistics for this period as YYYY-MM-DD. This is in
+	// UTC for the hit_stats, hit_counts, and ref_counts tables, and in the
+	// site's timezone for the others. The end can't be later than yesterday.
+	Start string `json:"start"`
+	End   string `json:"end"`
+
+	// Tables to recalculate; the default is all. See "goatcounter help
+	// reindex" for a list of tables.
+	Tables []string `json:"tables"`
+}
+
+// POST /api/v0/reindex settings
+// Recalculate the statistics.
+//
+// This rebuilds the statistics for the period from the pageviews in the
+// background, for example after an import or after changing the path groups.
+// Only one reindex can run at a time for a site; a 409 is returned if it's
+// already running.
+//
+// Request body: apiReindexRequest
+// Response 202: apiReindexRequest
+func (h api) reindex(w http.ResponseWriter, r *http.Request) error {
+	err := h.auth(r, goatcounter.PermSettings)
+	if err != nil {
+		return err
+	}
+
+	var req apiReindexRequest
+	_, err = zhttp.Decode(r, &req)
+	if err != nil {
+		return err
+	}
+	if len(req.Tables) == 0 {
+		req.Tables = []string{"all"}
+	}
+
+	v := zvalidate.New()
+	v.Required("start", req.Start)
+	v.Required("end", req.End)
+	start := v.Date("start", req.Start, "2006-01-02")
+	end := v.Date("end", req.End, "2006-01-02")
+	for _, t := range req.Tables {
+		v.Include("tables", t, cron.ReindexTables)
+	}
+	if !end.IsZero() {
+		if !end.Before(goatcounter.Now().Truncate(24 * time.Hour)) {
+			v.Append("end", "can't be later than yesterday")
+		}
+		if end.Before(start) {
+			v.Append("end", "before start")
+		}
+	}
+	if v.HasErrors() {
+		return v
+	}
+
+	site := *goatcounter.MustGetSite(r.Context())
+	if cron.ReindexRunning(site.ID) {
+		return guru.New(http.StatusConflict, cron.ErrReindexRunning.Error())
+	}
+	ctx := goatcounter.NewContext(r.Context())
+	bgrun.Run(func() {
+		err := cron.Reindex(ctx, site, start, end, req.Tables, 0, nil)
+		if err != nil {
+			zlog.Field("site", site.ID).Error(err)
+		}
 	})
+
+	w.WriteHeader(http.StatusAccepted)
+	return zhttp.JSON(w, req)
+}
+
+// POST /api/v0/erase delete
+// Delete the pageviews of a visitor.
+//
+// This deletes all pageviews matching the sessions (as in the CSV export), the
+// IP address and User-Agent, or the period, for example to answer a GDPR
+// erasure request. All the conditions that are set must match. The IP address
+// isn't stored with the pageviews, so the session for it can only be found for
+// a few hours after the last pageview. Pageviews that haven't been stored yet
+// are also deleted.
+//
+// Only the pageviews are deleted; the statistics (daily counts per path,
+// referrer, browser, etc. and the totals) aren't changed. The IP address also
+// appears in the -access-log and the bot log; this doesn't remove it from
+// those.
+//
+// The response is a report of what was deleted, which can be kept as a record
+// of the request; add "Accept: text/plain" to get it as text.
+//
+// Request body: zgo.at/goatcounter.Erasure
+// Response 200: zgo.at/goatcounter.ErasureReport
+func (h api) erase(w http.ResponseWriter, r *http.Request) error {
+	err := h.auth(r, goatcounter.PermDelete)
+	if err != nil {
+		return err
+	}
+
+	var req goatcounter.Erasure
+	_, err = zhttp.Decode(r, &req)
+	if err != nil {
+		return err
+	}
+
+	report, err := req.Erase(r.Context())
+	if err != nil {
+		return err
+	}
+	zlog.Module("erase").Printf("site %d: deleted %d pageviews", report.SiteID, report.Pageviews)
+
+	if strings.Contains(r.Header.Get("Accept"), "text/plain") {
+		return zhttp.Text(w, report.String())
+	}
+	return zhttp.JSON(w, report)
+}
+
+// GET /api/v0/stats/retention stats
+// Get returning visitors.
+//
+// Get cohorts of visitors first seen on a day or week, and how many of them
+// returned in the subsequent days or weeks.
+//
+// Query parameters:
+//
+//	period        day (default) or week.
+//	start, end    Period as YYYY-MM-DD; the default is the last 7 days.
+//	tz            Timezone for the period and cohorts as an IANA name, e.g.
+//	              Europe/Amsterdam; the default is UTC.
+//	segment       Use the period of this saved segment if start and end aren't
+//	              set.
+//
+// Response 200: zgo.at/goatcounter.Retention
+func (h api) statsRetention(w http.ResponseWriter, r *http.Request) error {
+	err := h.auth(r, goatcounter.PermStats)
+	if err != nil {
+		return err
+	}
+
+	seg, err := h.segment(r)
+	if err != nil {
+		return err
+	}
+	v := zvalidate.New()
+	start, end := h.period(&v, r.URL.Query(), seg)
+	if v.HasErrors() {
+		return v
+	}
+
+	period := r.URL.Query().Get("period")
+	if period == "" {
+		period = "day"
+	}
+
+	var ret goatcounter.Retention
+	err = ret.Get(r.Context(), start, end, period)
+	if err != nil {
+		return err
+	}
+	return zhttp.JSON(w, ret)
+}
+
+// GET /api/v0/stats/entries stats
+// Get entry pages.
+//
+// Get the pages sessions started on.
+//
+// Query parameters:
+//
+//	start, end    Period as YYYY-MM-DD; the default is the last 7 days.
+//	tz            Timezone for the period as an IANA name, e.g.
+//	              Europe/Amsterdam; the default is UTC.
+//	limit         Number of pages, 1-100; the default is 10.
+//	segment       Use the period of this saved segment if start and end aren't
+//	              set.
+//
+// Response 200: zgo.at/goatcounter.EntryExits
+func (h api) statsEntries(w http.ResponseWriter, r *http.Request) error {
+	return h.entryExit(w, r, (*goatcounter.EntryExits).ListEntries)
+}
+
+// GET /api/v0/stats/exits stats
+// Get exit pages.
+//
+// Get the pages sessions ended on.
+//
+// Query parameters:
+//
+//	start, end    Period as YYYY-MM-DD; the default is the last 7 days.
+//	tz            Timezone for the period as an IANA name, e.g.
+//	              Europe/Amsterdam; the default is UTC.
+//	limit         Number of pages, 1-100; the default is 10.
+//	segment       Use the period of this saved segment if start and end aren't
+//	              set.
+//
+// Response 200: zgo.at/goatcounter.EntryExits
+func (h api) statsExits(w http.ResponseWriter, r *http.Request) error {
+	return h.entryExit(w, r, (*goatcounter.EntryExits).ListExits)
+}
+
+func (h api) entryExit(
+	w http.ResponseWriter, r *http.Request,
+	list func(*goatcounter.EntryExits, context.Context, time.Time, time.Time, int) error,
+) error {
+	err := h.auth(r, goatcounter.PermStats)
+	if err != nil {
+		return err
+	}
+
+	var (
+		q     = r.URL.Query()
+		v     = zvalidate.New()
+		limit = int64(10)
+	)
+	seg, err := h.segment(r)
+	if err != nil {
+		return err
+	}
+	start, end := h.period(&v, q, seg)
+	if l := q.Get("limit"); l != "" {
+		limit = v.Integer("limit", l)
+	}
+	v.Range("limit", limit, 1, 100)
+	if v.HasErrors() {
+		return v
+	}
+
+	var e goatcounter.EntryExits
+	err = list(&e, r.Context(), start, end, int(limit))
+	if err != nil {
+		return err
+	}
+	return zhttp.JSON(w, e)
+}
+
+// GET /api/v0/query stats
+// List queries.
+//
+// List all queries that can be run with POST /api/v0/query.
+//
+// Response 200: []zgo.at/goatcounter.QueryTemplate
+func (h api) queryList(w http.ResponseWriter, r *http.Request) error {
+	err := h.auth(r, goatcounter.PermStats)
+	if err != nil {
+		return err
+	}
+	return zhttp.JSON(w, goatcounter.ListQueryTemplates())
+}
+
+type apiQueryRequest struct {
+	Query  string                  `json:"query"`
+	Params goatcounter.QueryParams `json:"params"`
+}
+
+// POST /api/v0/query stats
+// Run a query.
+//
+// Run one of the pre-defined read-only queries from GET /api/v0/query. Queries
+// are limited to 3 seconds, and every token can run 100 queries per hour.
+//
+// Request body: apiQueryRequest
+// Response 200: zgo.at/goatcounter.QueryResult
+func (h api) query(w http.ResponseWriter, r *http.Request) error {
+	err := h.auth(r, goatcounter.PermStats)
+	if err != nil {
+		return err
+	}
+
+	var req apiQueryRequest
+	_, err = zhttp.Decode(r, &req)
+	if err != nil {
+		return err
+	}
+
+	var res goatcounter.QueryResult
+	err = res.Run(r.Context(), req.Query, req.Params)
+	if err != nil {
+		return err
+	}
+	return zhttp.JSON(w, res)
+}
+
+// How long to keep a stream open; this needs to be shorter than the server's
+// WriteTimeout. Clients are expected to reconnect (EventSource does this
+// automatically).
+var streamDuration = 55 * time.Second
+
+// GET /api/v0/stats/stream stats
+// Stream new pageviews.
+//
+// Stream all new pageviews and events as Server-Sent Events, as they're
+// processed. Every pageview is sent as a "hit" event with the JSON-encoded
+// hit as the data. The connection is closed after about a minute, and clients
+// should reconnect.
+//
+// The browser's EventSource can't set headers, so the token can also be sent
+// as the access_token query parameter.
+//
+// Response 200 (text/event-stream): {data}
+func (h api) statsStream(w http.ResponseWriter, r *http.Request) error {
+	if t := r.URL.Query().Get("access_token"); t != "" && r.Header.Get("Authorization") == "" {
+		r.Header.Set("Authorization", "Bearer "+t)
+	}
+	err := h.auth(r, goatcounter.PermStats)
+	if err != nil {
+		return err
+	}
+
+	flush, ok := w.(http.Flusher)
+	if !ok {
+		return errors.New("api.statsStream: ResponseWriter is not a http.Flusher")
+	}
+
+	hits, unsub := goatcounter.HitStream.Subscribe(goatcounter.MustGetSite(r.Context()).ID)
+	defer unsub()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // Don't buffer in nginx.
+	w.WriteHeader(200)
+	fmt.Fprint(w, "retry: 1000\n\n")
+	flush.Flush()
+
+	var (
+		done = time.After(streamDuration)
+		ping = time.NewTicker(15 * time.Second)
+	)
+	defer ping.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return nil
+		case <-done:
+			return nil
+		case <-ping.C:
+			fmt.Fprint(w, ": ping\n\n")
+		case hit := <-hits:
+			fmt.Fprintf(w, "event: hit\ndata: %s\n\n", zjson.MustMarshal(hit))
+		}
+		flush.Flush()
+	}
+}
+
+// feedWeeks is the number of weeks in the feed.
+const feedWeeks = 4
+
+type (
+	atomFeed struct {
+		XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+		Title   string      `xml:"title"`
+		ID      string      `xml:"id"`
+		Updated string      `xml:"updated"`
+		Author  atomAuthor  `xml:"author"`
+		Link    atomLink    `xml:"link"`
+		Entries []atomEntry `xml:"entry"`
+	}
+	atomAuthor struct {
+		Name string `xml:"name"`
+	}
+	atomLink struct {
+		Href string `xml:"href,attr"`
+	}
+	atomEntry struct {
+		Title   string      `xml:"title"`
+		ID      string      `xml:"id"`
+		Updated string      `xml:"updated"`
+		Link    atomLink    `xml:"link"`
+		Content atomContent `xml:"content"`
+	}
+	atomContent struct {
+		Type string `xml:"type,attr"`
+		Body string `xml:",chardata"`
+	}
+)
+
+// GET /api/v0/stats/feed stats
+// Atom feed of the top pages and referrers.
+//
+// An Atom feed with an entry for each of the last four full weeks, with the
+// number of visitors and pageviews and the top pages and referrers.
+//
+// Most feed readers can't set headers, so the token can also be sent as the
+// access_token query parameter.
+//
+// Response 200 (application/atom+xml): {data}
+func (h api) statsFeed(w http.ResponseWriter, r *http.Request) error {
+	if t := r.URL.Query().Get("access_token"); t != "" && r.Header.Get("Authorization") == "" {
+		r.Header.Set("Authorization", "Bearer "+t)
+	}
+	err := h.auth(r, goatcounter.PermStats)
+	if err != nil {
+		return err
+	}
+
+	var (
+		site = goatcounter.MustGetSite(r.Context())
+		now  = goatcounter.Now()
+		feed = atomFeed{
+			Title:   "GoatCounter statistics for " + site.Display(),
+			ID:      site.URL() + "/api/v0/stats/feed",
+			Updated: now.UTC().Format(time.RFC3339),
+			Author:  atomAuthor{Name: "GoatCounter"},
+			Link:    atomLink{Href: site.URL()},
+		}
+	)
+	for i := 0; i < feedWeeks; i++ {
+		var rep goatcounter.EmailReport
+		err := rep.Get(r.Context(), "week", now.AddDate(0, 0, -7*i))
+		if err != nil {
+			return err
+		}
+		content, err := zhttp.ExecuteTpl("_feed_report.gohtml", rep)
+		if err != nil {
+			return err
+		}
+
+		link := fmt.Sprintf("%s/?period-start=%s&period-end=%s", site.URL(),
+			rep.Start.Format("2006-01-02"), rep.End.Format("2006-01-02"))
+		feed.Entries = append(feed.Entries, atomEntry{
+			Title: fmt.Sprintf("Week of %s: %s visitors", rep.Start.Format("January 2, 2006"),
+				zhttp.Tnformat(rep.TotalUnique, site.Settings.NumberFormat)),
+			ID:      link,
+			Updated: rep.End.UTC().Format(time.RFC3339),
+			Link:    atomLink{Href: link},
+			Content: atomContent{Type: "html", Body: string(content)},
+		})
+	}
+
+	out, err := xml.MarshalIndent(feed, "", "\t")
+	if err != nil {
+		return errors.Wrap(err, "api.statsFeed")
+	}
+	w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+	return zhttp.Bytes(w, append([]byte(xml.Header), out...))
+}
+
+// TODO: this isn't routed yet, and there is no request type to decode. When
+// it's added decode the hits with json.Decoder.Token() instead of unmarshaling
+// the entire batch with reflection, and reuse the Hit structs with a
+// sync.Pool, as bulk imports spend most of their time decoding.
+func (h api) count(w http.ResponseWriter, r *http.Request) error {
+	err := h.auth(r, goatcounter.PermCount)
 	if err != nil {
 		return err
 	}
@@ -7,22 +7,27 @@ package handlers
 import (
 	"bytes"
 	"context"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
 	"zgo.at/goatcounter"
+	"zgo.at/goatcounter/bgrun"
 	"zgo.at/goatcounter/gctest"
+	"zgo.at/tz"
 	"zgo.at/zdb"
+	"zgo.at/zstd/zint"
 	"zgo.at/zstd/zjson"
 	"zgo.at/ztest"
 	"zgo.at/zvalidate"
 )
 
 func newAPITest(
-	t *testing.T, method, path string, body io.Reader, perm goatcounter.APITokenPermissions,
+	t *testing.T, method, path string, body io.Reader, perm goatcounter.PermissionSet,
 ) (
 	context.Context, func(), *http.Request, *httptest.ResponseRecorder,
 ) {
@@ -48,7 +53,7 @@ func newAPITest(
 func TestAPIBasics(t *testing.T) {
 	t.Run("error", func(t *testing.T) {
 		t.Run("no-auth", func(t *testing.T) {
-			ctx, clean, r, rr := newAPITest(t, "GET", "/api/v0/test", nil, goatcounter.APITokenPermissions{})
+			ctx, clean, r, rr := newAPITest(t, "GET", "/api/v0/test", nil, goatcounter.PermissionSet{})
 			defer clean()
 
 			delete(r.Header, "Authorization")
@@ -62,7 +67,7 @@ func TestAPIBasics(t *testing.T) {
 		})
 
 		t.Run("wrong-auth", func(t *testing.T) {
-			ctx, clean, r, rr := newAPITest(t, "GET", "/api/v0/test", nil, goatcounter.APITokenPermissions{})
+			ctx, clean, r, rr := newAPITest(t, "GET", "/api/v0/test", nil, goatcounter.PermissionSet{})
 			defer clean()
 
 			r.Header.Set("Authorization", r.Header.Get("Authorization")+"x")
@@ -77,9 +82,9 @@ func TestAPIBasics(t *testing.T) {
 
 		t.Run("no-perm", func(t *testing.T) {
 			body := bytes.NewReader(zjson.MustMarshal(map[string]interface{}{
-				"perm": goatcounter.APITokenPermissions{Export: true, Count: true},
+				"perm": goatcounter.PermissionSet{goatcounter.PermCount, goatcounter.PermExport},
 			}))
-			ctx, clean, r, rr := newAPITest(t, "POST", "/api/v0/test", body, goatcounter.APITokenPermissions{})
+			ctx, clean, r, rr := newAPITest(t, "POST", "/api/v0/test", body, goatcounter.PermissionSet{})
 			defer clean()
 
 			newBackend(zdb.MustGet(ctx)).ServeHTTP(rr, r)
@@ -92,7 +97,7 @@ func TestAPIBasics(t *testing.T) {
 		})
 
 		t.Run("404", func(t *testing.T) {
-			ctx, clean, r, rr := newAPITest(t, "POST", "/api/v0/doesnt-exist", nil, goatcounter.APITokenPermissions{})
+			ctx, clean, r, rr := newAPITest(t, "POST", "/api/v0/doesnt-exist", nil, goatcounter.PermissionSet{})
 			defer clean()
 
 			newBackend(zdb.MustGet(ctx)).ServeHTTP(rr, r)
@@ -107,7 +112,7 @@ func TestAPIBasics(t *testing.T) {
 		t.Run("500", func(t *testing.T) {
 			ctx, clean, r, rr := newAPITest(t, "POST", "/api/v0/test",
 				strings.NewReader(`{"status":500}`),
-				goatcounter.APITokenPermissions{})
+				goatcounter.PermissionSet{})
 			defer clean()
 
 			newBackend(zdb.MustGet(ctx)).ServeHTTP(rr, r)
@@ -122,7 +127,7 @@ func TestAPIBasics(t *testing.T) {
 		t.Run("panic", func(t *testing.T) {
 			ctx, clean, r, rr := newAPITest(t, "POST", "/api/v0/test",
 				strings.NewReader(`{"panic":true}`),
-				goatcounter.APITokenPermissions{})
+				goatcounter.PermissionSet{})
 			defer clean()
 
 			newBackend(zdb.MustGet(ctx)).ServeHTTP(rr, r)
@@ -135,7 +140,7 @@ func TestAPIBasics(t *testing.T) {
 		})
 
 		t.Run("ct", func(t *testing.T) {
-			ctx, clean, r, rr := newAPITest(t, "POST", "/api/v0/test", nil, goatcounter.APITokenPermissions{})
+			ctx, clean, r, rr := newAPITest(t, "POST", "/api/v0/test", nil, goatcounter.PermissionSet{})
 			defer clean()
 
 			r.Header.Set("Content-Type", "text/html")
@@ -158,7 +163,7 @@ func TestAPIBasics(t *testing.T) {
 				bytes.NewReader(zjson.MustMarshal(map[string]interface{}{
 					"validate": v,
 				})),
-				goatcounter.APITokenPermissions{})
+				goatcounter.PermissionSet{})
 			defer clean()
 
 			newBackend(zdb.MustGet(ctx)).ServeHTTP(rr, r)
@@ -172,7 +177,7 @@ func TestAPIBasics(t *testing.T) {
 	})
 
 	t.Run("no-perm", func(t *testing.T) {
-		ctx, clean, r, rr := newAPITest(t, "POST", "/api/v0/test", nil, goatcounter.APITokenPermissions{})
+		ctx, clean, r, rr := newAPITest(t, "POST", "/api/v0/test", nil, goatcounter.PermissionSet{})
 		defer clean()
 
 		newBackend(zdb.MustGet(ctx)).ServeHTTP(rr, r)
@@ -181,14 +186,648 @@ func TestAPIBasics(t *testing.T) {
 
 	t.Run("check-perm", func(t *testing.T) {
 		body := bytes.NewReader(zjson.MustMarshal(map[string]interface{}{
-			"perm": goatcounter.APITokenPermissions{Export: true, Count: true},
+			"perm": goatcounter.PermissionSet{goatcounter.PermCount, goatcounter.PermExport},
 		}))
-		ctx, clean, r, rr := newAPITest(t, "POST", "/api/v0/test", body, goatcounter.APITokenPermissions{
-			Export: true, Count: true,
-		})
+		ctx, clean, r, rr := newAPITest(t, "POST", "/api/v0/test", body,
+			goatcounter.PermissionSet{goatcounter.PermCount, goatcounter.PermExport})
 		defer clean()
 
 		newBackend(zdb.MustGet(ctx)).ServeHTTP(rr, r)
 		ztest.Code(t, rr, 200)
 	})
+
+	t.Run("role", func(t *testing.T) {
+		body := bytes.NewReader(zjson.MustMarshal(map[string]interface{}{
+			"perm": goatcounter.PermissionSet{goatcounter.PermCount, goatcounter.PermExport},
+		}))
+		ctx, clean, r, rr := newAPITest(t, "POST", "/api/v0/test", body,
+			goatcounter.PermissionSet{goatcounter.PermCount})
+		defer clean()
+
+		role := goatcounter.Role{Name: "export", Permissions: goatcounter.PermissionSet{goatcounter.PermExport}}
+		err := role.Insert(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = zdb.MustGet(ctx).ExecContext(ctx, `update api_tokens set role_id=$1`, role.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		newBackend(zdb.MustGet(ctx)).ServeHTTP(rr, r)
+		ztest.Code(t, rr, 200)
+	})
+}
+
+func TestAPIStatsLive(t *testing.T) {
+	ctx, clean, r, rr := newAPITest(t, "GET", "/api/v0/stats/live", nil, goatcounter.PermissionSet{goatcounter.PermStats})
+	defer clean()
+
+	now := goatcounter.Now()
+	gctest.StoreHits(ctx, t,
+		goatcounter.Hit{Path: "/a", CreatedAt: now},
+		goatcounter.Hit{Path: "/old", CreatedAt: now.Add(-time.Hour)})
+	// Not persisted yet.
+	goatcounter.Memstore.Append(goatcounter.Hit{Site: 1, Path: "/b", CreatedAt: now,
+		Browser: "Firefox/68.0", RemoteAddr: "1.1.1.1"})
+	defer goatcounter.Memstore.Persist(ctx)
+
+	newBackend(zdb.MustGet(ctx)).ServeHTTP(rr, r)
+	ztest.Code(t, rr, 200)
+
+	var live goatcounter.LiveStats
+	zjson.MustUnmarshal(rr.Body.Bytes(), &live)
+	if live.Visitors != 2 || live.Pageviews != 2 || len(live.Pages) != 2 ||
+		live.Pages[0].Path != "/a" || live.Pages[1].Path != "/b" {
+		t.Errorf("wrong: %s", rr.Body.String())
+	}
+}
+
+func TestAPIStatsStream(t *testing.T) {
+	ctx, clean, r, rr := newAPITest(t, "GET", "/api/v0/stats/stream", nil, goatcounter.PermissionSet{goatcounter.PermStats})
+	defer clean()
+
+	defer func(d time.Duration) { streamDuration = d }(streamDuration)
+	streamDuration = 500 * time.Millisecond
+
+	done := make(chan struct{})
+	go func() {
+		newBackend(zdb.MustGet(ctx)).ServeHTTP(rr, r)
+		close(done)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	gctest.StoreHits(ctx, t, goatcounter.Hit{Path: "/a", Browser: "Firefox/68.0", RemoteAddr: "1.1.1.1"})
+	<-done
+
+	ztest.Code(t, rr, 200)
+	body := rr.Body.String()
+	if !strings.Contains(body, "event: hit\ndata: {") || !strings.Contains(body, `"path":"/a"`) {
+		t.Errorf("wrong body:\n%s", body)
+	}
+	if strings.Contains(body, "Firefox") || strings.Contains(body, "1.1.1.1") {
+		t.Errorf("not sanitized:\n%s", body)
+	}
+}
+
+func TestAPIStatsFeed(t *testing.T) {
+	ctx, clean, r, rr := newAPITest(t, "GET", "/api/v0/stats/feed", nil, goatcounter.PermissionSet{goatcounter.PermStats})
+	defer clean()
+	defer goatcounter.SetClock(goatcounter.NewFixedClock(time.Date(2020, 6, 24, 12, 0, 0, 0, time.UTC)))()
+
+	gctest.StoreHits(ctx, t, goatcounter.Hit{Path: "/a", CreatedAt: time.Date(2020, 6, 16, 12, 0, 0, 0, time.UTC), FirstVisit: true})
+	newBackend(zdb.MustGet(ctx)).ServeHTTP(rr, r)
+
+	ztest.Code(t, rr, 200)
+	body := rr.Body.String()
+	for _, want := range []string{`<feed xmlns="http://www.w3.org/2005/Atom">`, "Week of June 15, 2020: 1 visitors", "&lt;li&gt;/a"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("%q not in body:\n%s", want, body)
+		}
+	}
+	if c := strings.Count(body, "<entry>"); c != feedWeeks {
+		t.Errorf("%d entries", c)
+	}
+}
+
+func TestAPITimeseries(t *testing.T) {
+	ctx, clean, r, rr := newAPITest(t, "GET",
+		"/api/v0/timeseries?start=2020-06-17&end=2020-06-18&limit=1", nil,
+		goatcounter.PermissionSet{goatcounter.PermStats})
+	defer clean()
+
+	gctest.StoreHits(ctx, t,
+		goatcounter.Hit{Path: "/a", CreatedAt: time.Date(2020, 6, 17, 12, 0, 0, 0, time.UTC)},
+		goatcounter.Hit{Path: "/a", CreatedAt: time.Date(2020, 6, 18, 12, 0, 0, 0, time.UTC)},
+		goatcounter.Hit{Path: "/a", CreatedAt: time.Date(2020, 6, 18, 13, 0, 0, 0, time.UTC)},
+		goatcounter.Hit{Path: "/b", CreatedAt: time.Date(2020, 6, 18, 12, 0, 0, 0, time.UTC)})
+
+	newBackend(zdb.MustGet(ctx)).ServeHTTP(rr, r)
+	ztest.Code(t, rr, 200)
+
+	var ts goatcounter.Timeseries
+	zjson.MustUnmarshal(rr.Body.Bytes(), &ts)
+	got := fmt.Sprintf("%v %v", ts.Buckets, ts.Series)
+	want := "[2020-06-17 2020-06-18] [{/a 3 [1 2] [] 0 <nil>}]"
+	if got != want {
+		t.Errorf("\ngot:  %s\nwant: %s", got, want)
+	}
+}
+
+func TestAPITimeseriesTimezone(t *testing.T) {
+	ctx, clean, r, rr := newAPITest(t, "GET",
+		"/api/v0/timeseries?start=2020-06-18&end=2020-06-19&tz=Asia/Tokyo", nil,
+		goatcounter.PermissionSet{goatcounter.PermStats})
+	defer clean()
+
+	gctest.StoreHits(ctx, t,
+		goatcounter.Hit{Path: "/a", CreatedAt: time.Date(2020, 6, 17, 14, 0, 0, 0, time.UTC)},
+		goatcounter.Hit{Path: "/a", CreatedAt: time.Date(2020, 6, 17, 23, 0, 0, 0, time.UTC)},
+		goatcounter.Hit{Path: "/a", CreatedAt: time.Date(2020, 6, 18, 12, 0, 0, 0, time.UTC)},
+		goatcounter.Hit{Path: "/a", CreatedAt: time.Date(2020, 6, 18, 16, 0, 0, 0, time.UTC)})
+
+	newBackend(zdb.MustGet(ctx)).ServeHTTP(rr, r)
+	ztest.Code(t, rr, 200)
+
+	var ts goatcounter.Timeseries
+	zjson.MustUnmarshal(rr.Body.Bytes(), &ts)
+	got := fmt.Sprintf("%v %v", ts.Buckets, ts.Series)
+	want := "[2020-06-18 2020-06-19] [{/a 3 [2 1] [] 0 <nil>}]"
+	if got != want {
+		t.Errorf("\ngot:  %s\nwant: %s", got, want)
+	}
+
+	t.Run("unknown", func(t *testing.T) {
+		r2, rr2 := newTest(ctx, "GET", "/api/v0/timeseries?tz=Nowhere/Special", nil)
+		r2.Header.Set("Authorization", r.Header.Get("Authorization"))
+		newBackend(zdb.MustGet(ctx)).ServeHTTP(rr2, r2)
+		ztest.Code(t, rr2, 400)
+	})
+}
+
+func TestAPITimeseriesCountry(t *testing.T) {
+	ctx, clean, r, rr := newAPITest(t, "GET",
+		"/api/v0/timeseries?start=2020-06-18&end=2020-06-19&group=country", nil,
+		goatcounter.PermissionSet{goatcounter.PermStats})
+	defer clean()
+
+	site := goatcounter.MustGetSite(ctx)
+	site.Settings.Timezone = tz.MustNew("", "Asia/Tokyo")
+	err := site.Update(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gctest.StoreHits(ctx, t,
+		goatcounter.Hit{Path: "/a", Location: "DE", CreatedAt: time.Date(2020, 6, 17, 14, 0, 0, 0, time.UTC)},
+		goatcounter.Hit{Path: "/a", Location: "DE", CreatedAt: time.Date(2020, 6, 17, 23, 0, 0, 0, time.UTC)},
+		goatcounter.Hit{Path: "/a", Location: "DE", CreatedAt: time.Date(2020, 6, 18, 12, 0, 0, 0, time.UTC)},
+		goatcounter.Hit{Path: "/a", Location: "DE", CreatedAt: time.Date(2020, 6, 18, 16, 0, 0, 0, time.UTC)})
+
+	newBackend(zdb.MustGet(ctx)).ServeHTTP(rr, r)
+	ztest.Code(t, rr, 200)
+
+	var ts goatcounter.Timeseries
+	zjson.MustUnmarshal(rr.Body.Bytes(), &ts)
+	got := fmt.Sprintf("%v %v", ts.Buckets, ts.Series)
+	want := "[2020-06-18 2020-06-19] [{DE 3 [2 1] [] 0 <nil>}]"
+	if got != want {
+		t.Errorf("\ngot:  %s\nwant: %s", got, want)
+	}
+
+	t.Run("other tz", func(t *testing.T) {
+		r2, rr2 := newTest(ctx, "GET", "/api/v0/timeseries?group=country&tz=UTC", nil)
+		r2.Header.Set("Authorization", r.Header.Get("Authorization"))
+		newBackend(zdb.MustGet(ctx)).ServeHTTP(rr2, r2)
+		ztest.Code(t, rr2, 400)
+	})
+}
+
+func TestAPITimeseriesSegment(t *testing.T) {
+	ctx, clean, r, rr := newAPITest(t, "GET", "/api/v0/timeseries?segment=Blog",
+		nil, goatcounter.PermissionSet{goatcounter.PermStats})
+	defer clean()
+
+	start, end := "2020-06-17", "2020-06-18"
+	seg := goatcounter.Segment{Name: "blog", PeriodStart: &start, PeriodEnd: &end,
+		Filter: "/blog", Compare: "previous"}
+	err := seg.Insert(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gctest.StoreHits(ctx, t,
+		goatcounter.Hit{Path: "/blog/a", CreatedAt: time.Date(2020, 6, 16, 12, 0, 0, 0, time.UTC)},
+		goatcounter.Hit{Path: "/blog/a", CreatedAt: time.Date(2020, 6, 17, 12, 0, 0, 0, time.UTC)},
+		goatcounter.Hit{Path: "/blog/a", CreatedAt: time.Date(2020, 6, 18, 12, 0, 0, 0, time.UTC)},
+		goatcounter.Hit{Path: "/other", CreatedAt: time.Date(2020, 6, 18, 13, 0, 0, 0, time.UTC)})
+
+	newBackend(zdb.MustGet(ctx)).ServeHTTP(rr, r)
+	ztest.Code(t, rr, 200)
+
+	var ts goatcounter.Timeseries
+	zjson.MustUnmarshal(rr.Body.Bytes(), &ts)
+	if ts.Compare == nil || len(ts.Series) != 1 {
+		t.Fatalf("wrong: %s", rr.Body.String())
+	}
+	got := fmt.Sprintf("%s %v %s %v %v", ts.Filter, ts.Buckets, ts.Series[0].Name,
+		ts.Series[0].Values, ts.Series[0].Previous)
+	want := "/blog [2020-06-17 2020-06-18] /blog/a [1 1] [0 1]"
+	if got != want {
+		t.Errorf("\ngot:  %s\nwant: %s", got, want)
+	}
+}
+
+func TestAPIAnnotations(t *testing.T) {
+	ctx, clean, r, rr := newAPITest(t, "POST", "/api/v0/annotations",
+		strings.NewReader(`{"day":"2020-06-18","text":"v2 launch"}`),
+		goatcounter.PermissionSet{goatcounter.PermSettings})
+	defer clean()
+
+	newBackend(zdb.MustGet(ctx)).ServeHTTP(rr, r)
+	ztest.Code(t, rr, 201)
+
+	var a goatcounter.Annotation
+	zjson.MustUnmarshal(rr.Body.Bytes(), &a)
+	if a.ID == 0 || a.Day != "2020-06-18" || a.Text != "v2 launch" {
+		t.Fatalf("wrong: %s", rr.Body.String())
+	}
+
+	var ts goatcounter.Timeseries
+	err := ts.Get(ctx, "pageviews", "path", "day",
+		time.Date(2020, 6, 17, 0, 0, 0, 0, time.UTC), time.Date(2020, 6, 18, 23, 59, 59, 0, time.UTC), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ts.Annotations) != 1 || ts.Annotations[0].Text != "v2 launch" {
+		t.Errorf("wrong annotations: %v", ts.Annotations)
+	}
+
+	err = ts.Get(ctx, "pageviews", "path", "day",
+		time.Date(2020, 6, 19, 0, 0, 0, 0, time.UTC), time.Date(2020, 6, 20, 23, 59, 59, 0, time.UTC), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ts.Annotations) != 0 {
+		t.Errorf("wrong annotations: %v", ts.Annotations)
+	}
+}
+
+func TestAPISettings(t *testing.T) {
+	ctx, clean, r, rr := newAPITest(t, "PATCH", "/api/v0/settings",
+		strings.NewReader(`{"ignore_ips":"192.0.2.0/24 # office"}`),
+		goatcounter.PermissionSet{goatcounter.PermSettings})
+	defer clean()
+
+	site := goatcounter.MustGetSite(ctx)
+	site.Settings.Campaigns = []string{"utm_source"}
+	err := site.Update(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newBackend(zdb.MustGet(ctx)).ServeHTTP(rr, r)
+	ztest.Code(t, rr, 200)
+
+	err = site.ByID(ctx, site.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := site.Settings.IgnoreIPs; len(s) != 1 || s[0] != "192.0.2.0/24 # office" {
+		t.Errorf("wrong ignore_ips: %q", s)
+	}
+	if len(site.Settings.Campaigns) == 0 {
+		t.Error("other settings were reset")
+	}
+
+	auth := r.Header.Get("Authorization")
+	r, rr = newTest(ctx, "PATCH", "/api/v0/settings", strings.NewReader(`{"ignore_ips":"x"}`))
+	r.Header.Set("Authorization", auth)
+	newBackend(zdb.MustGet(ctx)).ServeHTTP(rr, r)
+	ztest.Code(t, rr, 400)
+}
+
+func TestAPISettingsTimezone(t *testing.T) {
+	now := time.Date(2020, 6, 20, 14, 42, 0, 0, time.UTC)
+	defer goatcounter.SetClock(goatcounter.NewFixedClock(now))()
+
+	ctx, clean, r, rr := newAPITest(t, "PATCH", "/api/v0/settings",
+		strings.NewReader(`{"timezone":"JP.Asia/Tokyo"}`),
+		goatcounter.PermissionSet{goatcounter.PermSettings})
+	defer clean()
+
+	// 20:00 UTC is 05:00 the next day in Tokyo.
+	gctest.StoreHits(ctx, t, goatcounter.Hit{Path: "/a", Language: "en",
+		CreatedAt: time.Date(2020, 6, 18, 20, 0, 0, 0, time.UTC)})
+
+	newBackend(zdb.MustGet(ctx)).ServeHTTP(rr, r)
+	ztest.Code(t, rr, 200)
+	bgrun.Wait()
+
+	var day string
+	err := zdb.MustGet(ctx).GetContext(ctx, &day, `select cast(day as varchar) from language_stats`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(day, "2020-06-19") {
+		t.Errorf("day not changed: %s", day)
+	}
+}
+
+func TestAPIBotRules(t *testing.T) {
+	ctx, clean, r, rr := newAPITest(t, "PUT", "/api/v0/bot-rules",
+		strings.NewReader(`{"rules":[{"type":"ua","pattern":"HeadlessChrome"},{"type":"path","pattern":"/wp-admin/*"}]}`),
+		goatcounter.PermissionSet{goatcounter.PermSettings})
+	defer clean()
+
+	newBackend(zdb.MustGet(ctx)).ServeHTTP(rr, r)
+	ztest.Code(t, rr, 200)
+
+	var site goatcounter.Site
+	err := site.ByID(ctx, goatcounter.MustGetSite(ctx).ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := site.Settings.BotRules.String(); s != "ua HeadlessChrome\npath /wp-admin/*" {
+		t.Errorf("wrong rules:\n%s", s)
+	}
+
+	auth := r.Header.Get("Authorization")
+	r, rr = newTest(ctx, "GET", "/api/v0/bot-rules", nil)
+	r.Header.Set("Authorization", auth)
+	newBackend(zdb.MustGet(ctx)).ServeHTTP(rr, r)
+	ztest.Code(t, rr, 200)
+
+	want := `{"rules":[{"type":"ua","pattern":"HeadlessChrome"},{"type":"path","pattern":"/wp-admin/*"}]}`
+	if rr.Body.String() != want {
+		t.Errorf("\nwant: %s\ngot:  %s", want, rr.Body.String())
+	}
+}
+
+func TestAPIUserRole(t *testing.T) {
+	ctx, clean, r, rr := newAPITest(t, "GET", "/api/v0/users", nil,
+		goatcounter.PermissionSet{goatcounter.PermSettings})
+	defer clean()
+
+	newBackend(zdb.MustGet(ctx)).ServeHTTP(rr, r)
+	ztest.Code(t, rr, 200)
+	auth := r.Header.Get("Authorization")
+
+	role := goatcounter.Role{Name: "stats", Permissions: goatcounter.PermissionSet{goatcounter.PermStats}}
+	err := role.Insert(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := goatcounter.User{Email: "other@example.com", Password: []byte("coconuts")}
+	err = other.Insert(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx2, _ := gctest.Site(ctx, t, goatcounter.Site{})
+	otherRole := goatcounter.Role{Name: "other", Permissions: goatcounter.PermissionSet{goatcounter.PermStats}}
+	err = otherRole.Insert(ctx2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		user     int64
+		body     string
+		wantCode int
+	}{
+		{other.ID, fmt.Sprintf(`{"role_id":%d}`, role.ID), 200},
+		{other.ID, `{"owner":true}`, 200},
+		{other.ID, `{}`, 200},
+		{other.ID, fmt.Sprintf(`{"role_id":%d}`, otherRole.ID), 400},
+		{goatcounter.GetUser(ctx2).ID, fmt.Sprintf(`{"role_id":%d}`, role.ID), 404},
+		{goatcounter.GetUser(ctx).ID, `{}`, 400},
+	}
+
+	for _, tt := range tests {
+		t.Run("", func(t *testing.T) {
+			r, rr := newTest(ctx, "PUT", fmt.Sprintf("/api/v0/users/%d/role", tt.user), strings.NewReader(tt.body))
+			r.Header.Set("Authorization", auth)
+			newBackend(zdb.MustGet(ctx)).ServeHTTP(rr, r)
+			ztest.Code(t, rr, tt.wantCode)
+		})
+	}
+
+	var u goatcounter.User
+	err = u.ByID(ctx, other.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Owner || u.RoleID != nil {
+		t.Errorf("owner=%t role_id=%v", u.Owner, u.RoleID)
+	}
+	if u.Can(ctx, goatcounter.PermStats) == nil {
+		t.Error("user without role can read stats")
+	}
+}
+
+func TestAPIReindex(t *testing.T) {
+	now := time.Date(2020, 6, 20, 14, 42, 0, 0, time.UTC)
+	defer goatcounter.SetClock(goatcounter.NewFixedClock(now))()
+
+	ctx, clean, r, rr := newAPITest(t, "POST", "/api/v0/reindex",
+		strings.NewReader(`{"start":"2020-06-18","end":"2020-06-19","tables":["hit_stats"]}`),
+		goatcounter.PermissionSet{goatcounter.PermSettings})
+	defer clean()
+
+	db := zdb.MustGet(ctx)
+	_, err := db.ExecContext(ctx, `update sites set created_at='2020-01-01 00:00:00'`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	goatcounter.ClearCaches()
+
+	gctest.StoreHits(ctx, t, goatcounter.Hit{Path: "/a", CreatedAt: now.Add(-48 * time.Hour)})
+	_, err = db.ExecContext(ctx, `delete from hit_stats`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newBackend(db).ServeHTTP(rr, r)
+	ztest.Code(t, rr, 202)
+	bgrun.Wait()
+
+	var n int
+	err = db.GetContext(ctx, &n, `select count(*) from hit_stats`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("%d rows in hit_stats", n)
+	}
+
+	// Can't reindex today.
+	header := r.Header
+	r, rr = newTest(ctx, "POST", "/api/v0/reindex", strings.NewReader(`{"start":"2020-06-18","end":"2020-06-20"}`))
+	r.Header = header
+	newBackend(db).ServeHTTP(rr, r)
+	ztest.Code(t, rr, 400)
+}
+
+func TestAPITimeseriesCompare(t *testing.T) {
+	ctx, clean, r, rr := newAPITest(t, "GET",
+		"/api/v0/timeseries?start=2020-06-17&end=2020-06-18&limit=1&compare=previous", nil,
+		goatcounter.PermissionSet{goatcounter.PermStats})
+	defer clean()
+
+	gctest.StoreHits(ctx, t,
+		goatcounter.Hit{Path: "/a", CreatedAt: time.Date(2020, 6, 16, 12, 0, 0, 0, time.UTC)},
+		goatcounter.Hit{Path: "/a", CreatedAt: time.Date(2020, 6, 16, 13, 0, 0, 0, time.UTC)},
+		goatcounter.Hit{Path: "/a", CreatedAt: time.Date(2020, 6, 17, 12, 0, 0, 0, time.UTC)},
+		goatcounter.Hit{Path: "/a", CreatedAt: time.Date(2020, 6, 18, 12, 0, 0, 0, time.UTC)},
+		goatcounter.Hit{Path: "/a", CreatedAt: time.Date(2020, 6, 18, 13, 0, 0, 0, time.UTC)})
+
+	newBackend(zdb.MustGet(ctx)).ServeHTTP(rr, r)
+	ztest.Code(t, rr, 200)
+
+	var ts goatcounter.Timeseries
+	zjson.MustUnmarshal(rr.Body.Bytes(), &ts)
+	if ts.Compare == nil {
+		t.Fatal("ts.Compare is nil")
+	}
+	got := fmt.Sprintf("%v %v %v %v", ts.Compare.Buckets, ts.Series[0].Previous,
+		ts.Series[0].PreviousTotal, *ts.Series[0].Change)
+	want := "[2020-06-15 2020-06-16] [0 2] 2 50"
+	if got != want {
+		t.Errorf("\ngot:  %s\nwant: %s", got, want)
+	}
+}
+
+func TestAPIStatsRetention(t *testing.T) {
+	ctx, clean, r, rr := newAPITest(t, "GET",
+		"/api/v0/stats/retention?start=2020-06-17&end=2020-06-18", nil,
+		goatcounter.PermissionSet{goatcounter.PermStats})
+	defer clean()
+
+	s1, s2 := zint.Uint128{H: 1, L: 1}, zint.Uint128{H: 2, L: 2}
+	gctest.StoreHits(ctx, t,
+		goatcounter.Hit{Path: "/a", Session: s1, CreatedAt: time.Date(2020, 6, 17, 23, 50, 0, 0, time.UTC)},
+		goatcounter.Hit{Path: "/b", Session: s1, CreatedAt: time.Date(2020, 6, 18, 0, 10, 0, 0, time.UTC)},
+		goatcounter.Hit{Path: "/a", Session: s2, CreatedAt: time.Date(2020, 6, 18, 12, 0, 0, 0, time.UTC)})
+
+	newBackend(zdb.MustGet(ctx)).ServeHTTP(rr, r)
+	ztest.Code(t, rr, 200)
+
+	var ret goatcounter.Retention
+	zjson.MustUnmarshal(rr.Body.Bytes(), &ret)
+	got := string(zjson.MustMarshal(ret.Cohorts))
+	want := `[{"start":"2020-06-17T00:00:00Z","visitors":1,"returning":[1]},{"start":"2020-06-18T00:00:00Z","visitors":1,"returning":[]}]`
+	if got != want {
+		t.Errorf("\ngot:  %s\nwant: %s", got, want)
+	}
+}
+
+func TestAPIStatsEntryExit(t *testing.T) {
+	tests := []struct {
+		path, want string
+	}{
+		{"/api/v0/stats/entries", `[{"path":"/a","count":2}]`},
+		{"/api/v0/stats/exits", `[{"path":"/a","count":1},{"path":"/c","count":1}]`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			ctx, clean, r, rr := newAPITest(t, "GET", tt.path+"?start=2020-06-18&end=2020-06-18", nil,
+				goatcounter.PermissionSet{goatcounter.PermStats})
+			defer clean()
+
+			s1, s2 := zint.Uint128{H: 1, L: 1}, zint.Uint128{H: 2, L: 2}
+			now := time.Date(2020, 6, 18, 12, 0, 0, 0, time.UTC)
+			gctest.StoreHits(ctx, t,
+				goatcounter.Hit{Path: "/a", Session: s1, CreatedAt: now},
+				goatcounter.Hit{Path: "/b", Session: s1, CreatedAt: now.Add(time.Minute)},
+				goatcounter.Hit{Path: "/c", Session: s1, CreatedAt: now.Add(2 * time.Minute)},
+				goatcounter.Hit{Path: "/a", Session: s2, CreatedAt: now})
+
+			newBackend(zdb.MustGet(ctx)).ServeHTTP(rr, r)
+			ztest.Code(t, rr, 200)
+
+			if got := rr.Body.String(); got != tt.want {
+				t.Errorf("\ngot:  %s\nwant: %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAPIQuery(t *testing.T) {
+	tests := []struct {
+		body     string
+		wantCode int
+		want     string
+	}{
+		{`{"query":"paths","params":{"start":"2020-06-18","end":"2020-06-18"}}`, 200,
+			`[{"name":"/a","count":2,"count_unique":0},{"name":"/b","count":1,"count_unique":0}]`},
+		{`{"query":"paths","params":{"start":"2020-06-18","end":"2020-06-18","path":"/B*"}}`, 200,
+			`[{"name":"/b","count":1,"count_unique":0}]`},
+		{`{"query":"paths_daily","params":{"start":"2020-06-17","end":"2020-06-18"}}`, 200,
+			`[{"day":"2020-06-18","count":3,"count_unique":0}]`},
+		{`{"query":"browsers","params":{"start":"2020-06-18","end":"2020-06-18","path":"/a"}}`, 400,
+			`{"errors":{"path":["not supported for \"browsers\""]}}`},
+		{`{"query":"drop table hits","params":{"start":"2020-06-18","end":"2020-06-18"}}`, 400,
+			`{"error":"unknown query: \"drop table hits\""}`},
+	}
+
+	for _, tt := range tests {
+		t.Run("", func(t *testing.T) {
+			ctx, clean, r, rr := newAPITest(t, "POST", "/api/v0/query", strings.NewReader(tt.body),
+				goatcounter.PermissionSet{goatcounter.PermStats})
+			defer clean()
+
+			now := time.Date(2020, 6, 18, 12, 0, 0, 0, time.UTC)
+			gctest.StoreHits(ctx, t,
+				goatcounter.Hit{Path: "/a", CreatedAt: now},
+				goatcounter.Hit{Path: "/a", CreatedAt: now},
+				goatcounter.Hit{Path: "/b", CreatedAt: now})
+
+			newBackend(zdb.MustGet(ctx)).ServeHTTP(rr, r)
+			ztest.Code(t, rr, tt.wantCode)
+
+			got := rr.Body.String()
+			if tt.wantCode == 200 {
+				var res goatcounter.QueryResult
+				zjson.MustUnmarshal(rr.Body.Bytes(), &res)
+				got = string(zjson.MustMarshal(res.Rows))
+			}
+			if got != tt.want {
+				t.Errorf("\ngot:  %s\nwant: %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAPIGrafana(t *testing.T) {
+	ctx, clean, r, rr := newAPITest(t, "POST", "/api/v0/grafana/query",
+		strings.NewReader(`{
+			"range":      {"from": "2020-06-17T00:00:00Z", "to": "2020-06-18T23:59:59Z"},
+			"intervalMs": 86400000,
+			"targets":    [{"target": "pageviews"}, {"target": "pageviews by path"}]
+		}`),
+		goatcounter.PermissionSet{goatcounter.PermStats})
+	defer clean()
+
+	gctest.StoreHits(ctx, t,
+		goatcounter.Hit{Path: "/a", CreatedAt: time.Date(2020, 6, 17, 12, 0, 0, 0, time.UTC)},
+		goatcounter.Hit{Path: "/a", CreatedAt: time.Date(2020, 6, 18, 12, 0, 0, 0, time.UTC)},
+		goatcounter.Hit{Path: "/b", CreatedAt: time.Date(2020, 6, 18, 12, 0, 0, 0, time.UTC)})
+
+	newBackend(zdb.MustGet(ctx)).ServeHTTP(rr, r)
+	ztest.Code(t, rr, 200)
+
+	got := strings.TrimSpace(rr.Body.String())
+	want := `[{"target":"pageviews","datapoints":[[1,1592352000000],[2,1592438400000]]},` +
+		`{"target":"/a","datapoints":[[1,1592352000000],[1,1592438400000]]},` +
+		`{"target":"/b","datapoints":[[0,1592352000000],[1,1592438400000]]}]`
+	if got != want {
+		t.Errorf("\ngot:  %s\nwant: %s", got, want)
+	}
+}
+
+func TestAPIGrafanaAnnotations(t *testing.T) {
+	ctx, clean, r, rr := newAPITest(t, "POST", "/api/v0/grafana/annotations",
+		strings.NewReader(`{
+			"range":      {"from": "2020-06-17T00:00:00Z", "to": "2020-06-18T23:59:59Z"},
+			"annotation": {"name": "x"}
+		}`),
+		goatcounter.PermissionSet{goatcounter.PermStats})
+	defer clean()
+
+	a := goatcounter.Annotation{Day: "2020-06-18", Text: "v2 launch"}
+	err := a.Insert(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newBackend(zdb.MustGet(ctx)).ServeHTTP(rr, r)
+	ztest.Code(t, rr, 200)
+
+	got := strings.TrimSpace(rr.Body.String())
+	want := `[{"annotation":{"name":"x"},"time":1592438400000,"title":"v2 launch","text":"v2 launch"}]`
+	if got != want {
+		t.Errorf("\ngot:  %s\nwant: %s", got, want)
+	}
 }
@@ -0,0 +1,104 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package handlers
+
+import (
+	"net"
+	"sync"
+
+	"github.com/arp242/geoip2-golang"
+	"zgo.at/errors"
+)
+
+var (
+	asndbMu sync.RWMutex
+	asndb   *geoip2.Reader
+)
+
+// datacenterASNs are the autonomous systems of cloud and hosting providers;
+// real visitors rarely browse from these, but scrapers and headless browsers
+// often do.
+var datacenterASNs = map[uint]string{
+	7224:   "Amazon AWS",
+	8075:   "Microsoft Azure",
+	12876:  "Scaleway",
+	14061:  "DigitalOcean",
+	14618:  "Amazon AWS",
+	16276:  "OVH",
+	16509:  "Amazon AWS",
+	20473:  "Vultr",
+	24940:  "Hetzner",
+	31898:  "Oracle Cloud",
+	37963:  "Alibaba Cloud",
+	45102:  "Alibaba Cloud",
+	51167:  "Contabo",
+	60781:  "Leaseweb",
+	63949:  "Linode",
+	132203: "Tencent Cloud",
+	135377: "UCloud",
+	396982: "Google Cloud",
+}
+
+// SetASNDB loads the GeoLite2 ASN database from file, which is used to find
+// traffic from datacenters; this is disabled if file is "".
+func SetASNDB(file string) error {
+	var g *geoip2.Reader
+	if file != "" {
+		var err error
+		g, err = geoip2.Open(file)
+		if err != nil {
+			return errors.Errorf("SetASNDB: %w", err)
+		}
+	}
+
+	asndbMu.Lock()
+	old := asndb
+	asndb = g
+	asndbMu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+
+	asnCache.Lock()
+	asnCache.m = make(map[string]bool, geoCacheSize)
+	asnCache.Unlock()
+	return nil
+}
+
+// asnCache caches the datacenter lookups, like geoCache.
+var asnCache = struct {
+	sync.RWMutex
+	m map[string]bool
+}{m: make(map[string]bool, geoCacheSize)}
+
+// datacenter reports if the IP address is in the network of a cloud or hosting
+// provider. This is always false if there's no ASN database.
+func datacenter(ip string) bool {
+	asnCache.RLock()
+	dc, ok := asnCache.m[ip]
+	asnCache.RUnlock()
+	if ok {
+		return dc
+	}
+
+	asndbMu.RLock()
+	if asndb == nil {
+		asndbMu.RUnlock()
+		return false
+	}
+	asn, err := asndb.ASN(net.ParseIP(ip))
+	asndbMu.RUnlock()
+	if err == nil && asn != nil {
+		_, dc = datacenterASNs[asn.AutonomousSystemNumber]
+	}
+
+	asnCache.Lock()
+	if len(asnCache.m) >= geoCacheSize {
+		asnCache.m = make(map[string]bool, geoCacheSize)
+	}
+	asnCache.m[ip] = dc
+	asnCache.Unlock()
+	return dc
+}
@@ -0,0 +1,25 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package handlers
+
+import (
+	"testing"
+)
+
+func TestSetASNDB(t *testing.T) {
+	err := SetASNDB("/nonexistent/GeoLite2-ASN.mmdb")
+	if err == nil {
+		t.Fatal("error is nil")
+	}
+
+	err = SetASNDB("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Never a datacenter without a database.
+	if datacenter("52.95.110.1") {
+		t.Error("datacenter() is true without a database")
+	}
+}
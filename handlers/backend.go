@@ -8,7 +8,9 @@ import (
 	"compress/gzip"
 	"context"
 	"fmt"
+	"html"
 	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"net/url"
@@ -17,7 +19,9 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"github.com/arp242/geoip2-golang"
 	"github.com/go-chi/chi"
@@ -29,7 +33,9 @@ import (
 	"zgo.at/goatcounter/acme"
 	"zgo.at/goatcounter/bgrun"
 	"zgo.at/goatcounter/cfg"
+	"zgo.at/goatcounter/cron"
 	"zgo.at/goatcounter/pack"
+	"zgo.at/goatcounter/statsd"
 	"zgo.at/guru"
 	"zgo.at/isbot"
 	"zgo.at/tz"
@@ -47,15 +53,18 @@ type backend struct{}
 // DailyView forces the "view by day" if the number of selected days is larger than this.
 const DailyView = 90
 
-func (h backend) Mount(r chi.Router, db zdb.DB) {
+func (h backend) Mount(r chi.Router, db, replica zdb.DB) {
 	if !cfg.Prod {
 		r.Use(delay())
 	}
 
 	r.Use(
-		zhttp.RealIP,
+		traceRequests,
+		realIP,
+		reportOnce,
 		zhttp.Unpanic(cfg.Prod),
-		addctx(db, true),
+		addctx(db, replica, true),
+		reportPanics,
 		middleware.RedirectSlashes,
 		zhttp.NoStore,
 		zhttp.WrapWriter)
@@ -76,12 +85,17 @@ func (h backend) Mount(r chi.Router, db zdb.DB) {
 		rr.Post("/jserr", zhttp.HandlerJSErr())
 		rr.Post("/csp", zhttp.HandlerCSP())
 
-		// 4 pageviews/second should be more than enough.
+		// 4 pageviews/second should be more than enough; can be changed with
+		// SetCountRatelimit().
 		rateLimited := rr.With(zhttp.Ratelimit(zhttp.RatelimitOptions{
 			Client: func(r *http.Request) string {
 				// Add in the User-Agent to reduce the problem of multiple
 				// people in the same building hitting the limit.
-				return r.RemoteAddr + r.UserAgent()
+				ip := r.RemoteAddr
+				if site := goatcounter.GetSite(r.Context()); site != nil {
+					ip = site.VisitorIP(ip)
+				}
+				return ip + r.UserAgent()
 			},
 			Store: zhttp.NewRatelimitMemory(),
 			Limit: func(r *http.Request) (int, int64) {
@@ -94,9 +108,12 @@ func (h backend) Mount(r chi.Router, db zdb.DB) {
 				if r.RemoteAddr == "127.0.0.1" {
 					return 1 << 14, 1
 				}
-				return 4, 1
+				return int(atomic.LoadInt64(&countRatelimit)), 1
 			},
 		}))
+		rr.Get("/count.js", zhttp.Wrap(h.countJS))
+		rr.Get("/counter/*", zhttp.Wrap(h.counter))
+
 		countHandler := zhttp.Wrap(h.count)
 		rateLimited.Get("/count", countHandler)
 		rateLimited.Post("/count", countHandler) // to support navigator.sendBeacon (JS)
@@ -134,18 +151,19 @@ func (h backend) Mount(r chi.Router, db zdb.DB) {
 			// Too much noise: header.CSPReportURI:  {"/csp"},
 		})
 
-		a := r.With(zhttp.Headers(headers), keyAuth)
+		a := r.With(zhttp.Headers(headers), allowIPs, keyAuth)
 		if !cfg.Prod {
 			a = a.With(zhttp.Log(true, ""))
 		}
 
 		user{}.mount(a)
 		{
-			ap := a.With(loggedInOrPublic)
+			ap := a.With(loggedInOrPublic, canStatsOrPublic, readOnly, userTimezone)
 			ap.Get("/", zhttp.Wrap(h.dashboard))
 			ap.Get("/pages", zhttp.Wrap(h.pages))
 			ap.Get("/hchart-detail", zhttp.Wrap(h.hchartDetail))
 			ap.Get("/hchart-more", zhttp.Wrap(h.hchartMore))
+			ap.Get("/flow", zhttp.Wrap(h.flow))
 		}
 		{
 			af := a.With(loggedIn)
@@ -156,24 +174,164 @@ func (h backend) Mount(r chi.Router, db zdb.DB) {
 			af.Get("/settings", zhttp.Wrap(h.settings))
 			af.Get("/code", zhttp.Wrap(h.code))
 			af.Get("/ip", zhttp.Wrap(h.ip))
-			af.Post("/save-settings", zhttp.Wrap(h.saveSettings))
-			af.With(zhttp.Ratelimit(zhttp.RatelimitOptions{
+			af.With(can(goatcounter.PermStats), userTimezone).Get("/bots", zhttp.Wrap(h.bots))
+			af.Post("/segment", zhttp.Wrap(h.saveSegment))
+			af.Post("/segment/{id}/delete", zhttp.Wrap(h.deleteSegment))
+			af.With(can(goatcounter.PermSettings)).Post("/save-settings", zhttp.Wrap(h.saveSettings))
+			af.With(can(goatcounter.PermSettings)).Post("/annotation", zhttp.Wrap(h.addAnnotation))
+			af.With(can(goatcounter.PermSettings)).Post("/annotation/{id}/delete", zhttp.Wrap(h.deleteAnnotation))
+			af.With(can(goatcounter.PermSettings)).Post("/alert", zhttp.Wrap(h.addAlert))
+			af.With(can(goatcounter.PermSettings)).Post("/exclude-me", zhttp.Wrap(h.excludeMe))
+			af.With(can(goatcounter.PermSettings)).Post("/alert/{id}/delete", zhttp.Wrap(h.deleteAlert))
+			af.With(can(goatcounter.PermExport), zhttp.Ratelimit(zhttp.RatelimitOptions{
 				Client:  zhttp.RatelimitIP,
 				Store:   zhttp.NewRatelimitMemory(),
 				Limit:   zhttp.RatelimitLimit(1, 3600),
 				Message: "you can request only one export per hour",
 			})).Post("/export", zhttp.Wrap(h.startExport))
-			af.Get("/export/{id}", zhttp.Wrap(h.downloadExport))
-			af.Post("/import", zhttp.Wrap(h.importFile))
-			af.Post("/add", zhttp.Wrap(h.addSubsite))
-			af.Get("/remove/{id}", zhttp.Wrap(h.removeSubsiteConfirm))
-			af.Post("/remove/{id}", zhttp.Wrap(h.removeSubsite))
-			af.Get("/purge", zhttp.Wrap(h.purgeConfirm))
-			af.Post("/purge", zhttp.Wrap(h.purge))
-			af.Post("/delete", zhttp.Wrap(h.delete))
+			af.With(can(goatcounter.PermExport)).Get("/export/{id}", zhttp.Wrap(h.downloadExport))
+			af.With(can(goatcounter.PermSettings)).Post("/import", zhttp.Wrap(h.importFile))
+			{
+				as := af.With(can(goatcounter.PermSites))
+				as.Post("/add", zhttp.Wrap(h.addSubsite))
+				as.Get("/remove/{id}", zhttp.Wrap(h.removeSubsiteConfirm))
+				as.Post("/remove/{id}", zhttp.Wrap(h.removeSubsite))
+			}
+			{
+				ad := af.With(can(goatcounter.PermDelete))
+				ad.Get("/purge", zhttp.Wrap(h.purgeConfirm))
+				ad.Post("/purge", zhttp.Wrap(h.purge))
+				ad.Post("/delete", zhttp.Wrap(h.delete))
+			}
 			admin{}.mount(af)
 		}
 	}
+
+	{
+		// The widget is meant to be embedded in an iframe on other sites, so
+		// don't set X-Frame-Options.
+		headers := http.Header{"X-Content-Type-Options": []string{"nosniff"}}
+		header.SetCSP(headers, header.CSPArgs{
+			header.CSPDefaultSrc: {header.CSPSourceNone},
+			header.CSPStyleSrc:   {header.CSPSourceUnsafeInline},
+		})
+		r.With(zhttp.Headers(headers), keyAuth, canStatsOrPublic, readOnly).Get("/widget", zhttp.Wrap(h.widget))
+	}
+	{
+		// The opt-out page can be embedded in the privacy policy, so don't set
+		// X-Frame-Options here either.
+		headers := http.Header{"X-Content-Type-Options": []string{"nosniff"}}
+		header.SetCSP(headers, header.CSPArgs{
+			header.CSPDefaultSrc: {header.CSPSourceNone},
+			header.CSPStyleSrc:   {header.CSPSourceUnsafeInline},
+			header.CSPFormAction: {header.CSPSourceSelf},
+		})
+		oo := r.With(zhttp.Headers(headers))
+		oo.Get("/opt-out", zhttp.Wrap(h.optOut))
+		oo.Post("/opt-out", zhttp.Wrap(h.optOut))
+	}
+}
+
+// decodeHit sets the hit fields from the /count query string.
+//
+// This is done by hand rather than with formam since this is the hottest path
+// we have: it avoids the reflection and the url.Values map, and doesn't
+// allocate unless a value is escaped or there are size or dimension
+// parameters.
+func decodeHit(query string, hit *goatcounter.Hit) error {
+	for query != "" {
+		var kv string
+		if i := strings.IndexByte(query, '&'); i > -1 {
+			kv, query = query[:i], query[i+1:]
+		} else {
+			kv, query = query, ""
+		}
+		if kv == "" {
+			continue
+		}
+
+		k, v := kv, ""
+		if i := strings.IndexByte(kv, '='); i > -1 {
+			k, v = kv[:i], kv[i+1:]
+		}
+		k, err := url.QueryUnescape(k)
+		if err != nil {
+			return err
+		}
+		v, err = url.QueryUnescape(v)
+		if err != nil {
+			return err
+		}
+
+		switch k {
+		case "p":
+			hit.Path = v
+		case "t":
+			hit.Title = v
+		case "r":
+			hit.Ref = v
+		case "q":
+			hit.Query = v
+		case "rnd":
+			hit.Random = v
+		default:
+			if v == "" {
+				continue
+			}
+			err = decodeHitValue(k, v, hit)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func decodeHitValue(k, v string, hit *goatcounter.Hit) error {
+	switch k {
+	case "e":
+		e, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("e: not a boolean: %q", v)
+		}
+		hit.Event = zdb.Bool(e)
+	case "b":
+		b, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("b: not a number: %q", v)
+		}
+		hit.Bot = b
+	case "ping":
+		p, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return fmt.Errorf("ping: not a number: %q", v)
+		}
+		hit.Ping = p
+	case "s":
+		hit.Size = make(zdb.Floats, 0, 3)
+		for v != "" {
+			var f string
+			if i := strings.IndexByte(v, ','); i > -1 {
+				f, v = v[:i], v[i+1:]
+			} else {
+				f, v = v, ""
+			}
+			n, err := strconv.ParseFloat(strings.TrimSpace(f), 64)
+			if err != nil {
+				return fmt.Errorf("s: not a number: %q", f)
+			}
+			hit.Size = append(hit.Size, n)
+		}
+	default:
+		if !strings.HasPrefix(k, "d[") || !strings.HasSuffix(k, "]") || len(k) < 4 {
+			return fmt.Errorf("unknown parameter: %q", k)
+		}
+		if hit.Dimensions == nil {
+			hit.Dimensions = make(goatcounter.HitDimensions, 2)
+		}
+		hit.Dimensions[k[2:len(k)-1]] = v
+	}
+	return nil
 }
 
 // Use GIF because it's the smallest filesize (PNG is 116 bytes, vs 43 for GIF).
@@ -182,25 +340,140 @@ var gif = []byte{0x47, 0x49, 0x46, 0x38, 0x39, 0x61, 0x1, 0x0, 0x1, 0x0, 0x80,
 	0x1, 0x0, 0x2c, 0x0, 0x0, 0x0, 0x0, 0x1, 0x0, 0x1, 0x0, 0x0, 0x2, 0x2, 0x4c,
 	0x1, 0x0, 0x3b}
 
-var geodb = func() *geoip2.Reader {
-	g, err := geoip2.FromBytes(pack.GeoDB)
+// countRatelimit is the number of pageviews per second a client can send to
+// /count.
+var countRatelimit int64 = 4
+
+// SetCountRatelimit sets the number of pageviews per second a client can send
+// to /count.
+func SetCountRatelimit(n int) {
+	atomic.StoreInt64(&countRatelimit, int64(n))
+}
+
+var (
+	geodbMu   sync.RWMutex
+	geodbCity bool // Database has regions and cities.
+	geodb     = func() *geoip2.Reader {
+		g, err := geoip2.FromBytes(pack.GeoDB)
+		if err != nil {
+			panic(err)
+		}
+		return g
+	}()
+)
+
+// SetGeoDB loads the GeoIP database from file, or uses the compiled-in database
+// if file is "".
+//
+// This can be any GeoIP2 or GeoLite2 Country, City, or Enterprise database, or
+// a database in the same format. Regions and cities are looked up if it's a
+// City or Enterprise database.
+func SetGeoDB(file string) error {
+	var (
+		g   *geoip2.Reader
+		err error
+	)
+	if file == "" {
+		g, err = geoip2.FromBytes(pack.GeoDB)
+	} else {
+		g, err = geoip2.Open(file)
+	}
 	if err != nil {
-		panic(err)
+		return errors.Errorf("SetGeoDB: %w", err)
+	}
+
+	// Make sure the countries can be looked up, rather than finding out on
+	// every pageview; this fails if it's an ASN database, for example.
+	_, err = g.Country(net.ParseIP("127.0.0.1"))
+	if err != nil {
+		g.Close()
+		return errors.Errorf("SetGeoDB: %s: %w", file, err)
+	}
+
+	geodbMu.Lock()
+	old := geodb
+	geodb = g
+	geodbCity = GeoDBHasCities(g.Metadata().DatabaseType)
+	geodbMu.Unlock()
+	old.Close()
+
+	geoCache.Lock()
+	geoCache.m = make(map[string]geoLocation, geoCacheSize)
+	geoCache.Unlock()
+	return nil
+}
+
+// GeoDBHasCities reports if a GeoIP database of this type has the regions and
+// cities.
+func GeoDBHasCities(dbType string) bool {
+	return strings.Contains(dbType, "City") || strings.Contains(dbType, "Enterprise")
+}
+
+// geoHasRegions reports if the GeoIP database has regions and cities.
+func geoHasRegions() bool {
+	geodbMu.RLock()
+	defer geodbMu.RUnlock()
+	return geodbCity
+}
+
+// geoLocation is the location of an IP address; Region and City are only set
+// if the GeoIP database has them.
+type geoLocation struct {
+	Country string // ISO 3166-1 code, e.g. "US".
+	Region  string // ISO 3166-2 code, e.g. "US-CA".
+	City    string // English name, e.g. "San Francisco".
+}
+
+// geoCache caches the location lookups; decoding the GeoIP record is by far the
+// most expensive part of /count. It's cleared once it reaches geoCacheSize
+// entries.
+var geoCache = struct {
+	sync.RWMutex
+	m map[string]geoLocation
+}{m: make(map[string]geoLocation, geoCacheSize)}
+
+const geoCacheSize = 10000
+
+func geo(ip string) geoLocation {
+	geoCache.RLock()
+	c, ok := geoCache.m[ip]
+	geoCache.RUnlock()
+	if ok {
+		return c
+	}
+
+	geodbMu.RLock()
+	if geodbCity {
+		loc, err := geodb.City(net.ParseIP(ip))
+		if err == nil {
+			c.Country, c.City = loc.Country.IsoCode, loc.City.Names["en"]
+			if len(loc.Subdivisions) > 0 && loc.Subdivisions[0].IsoCode != "" && c.Country != "" {
+				c.Region = c.Country + "-" + loc.Subdivisions[0].IsoCode
+			}
+		}
+	} else {
+		loc, _ := geodb.Country(net.ParseIP(ip))
+		c.Country = loc.Country.IsoCode
 	}
-	return g
-}()
+	geodbMu.RUnlock()
 
-func geo(ip string) string {
-	loc, _ := geodb.Country(net.ParseIP(ip))
-	return loc.Country.IsoCode
+	geoCache.Lock()
+	if len(geoCache.m) >= geoCacheSize {
+		geoCache.m = make(map[string]geoLocation, geoCacheSize)
+	}
+	geoCache.m[ip] = c
+	geoCache.Unlock()
+	return c
 }
 
 func (h backend) status() func(w http.ResponseWriter, r *http.Request) error {
 	started := goatcounter.Now()
 	return func(w http.ResponseWriter, r *http.Request) error {
-		return zhttp.JSON(w, map[string]string{
+		return zhttp.JSON(w, map[string]interface{}{
 			"uptime":  goatcounter.Now().Sub(started).String(),
 			"version": cfg.Version,
+			"salt":    goatcounter.Memstore.SaltSchedule(),
+			"cache":   goatcounter.GetCacheStats(),
 		})
 	}
 }
@@ -223,48 +496,85 @@ func (h backend) count(w http.ResponseWriter, r *http.Request) error {
 	}
 
 	site := goatcounter.MustGetSite(r.Context())
-	for _, ip := range site.Settings.IgnoreIPs {
-		if ip == r.RemoteAddr {
-			w.Header().Add("X-Goatcounter", fmt.Sprintf("ignored because %q is in the IP ignore list", ip))
-			w.WriteHeader(http.StatusAccepted)
-			return zhttp.Bytes(w, gif)
-		}
+	if ip, ok := site.Settings.IgnoreIP(r.RemoteAddr); ok {
+		w.Header().Add("X-Goatcounter", fmt.Sprintf("ignored because %q is in the IP ignore list", ip))
+		w.WriteHeader(http.StatusAccepted)
+		statsd.Count("count.ignored", 1)
+		return zhttp.Bytes(w, gif)
+	}
+	if site.Settings.HonorDNT && (r.Header.Get("DNT") == "1" || r.Header.Get("Sec-GPC") == "1") {
+		w.Header().Add("X-Goatcounter", "ignored because of the DNT or Sec-GPC header")
+		w.WriteHeader(http.StatusAccepted)
+		statsd.Count("count.ignored", 1)
+		return zhttp.Bytes(w, gif)
+	}
+	if _, err := r.Cookie(optOutCookie); err == nil {
+		w.Header().Add("X-Goatcounter", "ignored because the visitor opted out")
+		w.WriteHeader(http.StatusAccepted)
+		statsd.Count("count.ignored", 1)
+		return zhttp.Bytes(w, gif)
 	}
 
+	// Don't use r.RemoteAddr after this, as it may not be anonymized.
+	ip := site.VisitorIP(r.RemoteAddr)
+	loc := geo(ip)
 	hit := goatcounter.Hit{
 		Site:       site.ID,
-		Browser:    r.UserAgent(),
-		Location:   geo(r.RemoteAddr),
+		Browser:    goatcounter.CleanUserAgent(r.UserAgent()),
+		Location:   loc.Country,
 		CreatedAt:  goatcounter.Now(),
-		RemoteAddr: r.RemoteAddr,
+		RemoteAddr: ip,
+	}
+	if site.Settings.Cities {
+		hit.Region, hit.City = loc.Region, loc.City
+	} else if _, ok := goatcounter.RegionCountries[loc.Country]; ok {
+		hit.Region = loc.Region
 	}
+	hit.Language = goatcounter.ParseLanguage(r.Header.Get("Accept-Language"))
 
-	err := formam.NewDecoder(&formam.DecoderOptions{TagName: "json"}).Decode(r.URL.Query(), &hit)
+	err := decodeHit(r.URL.RawQuery, &hit)
 	if err != nil {
 		w.Header().Add("X-Goatcounter", fmt.Sprintf("error decoding parameters: %s", err))
 		w.WriteHeader(400)
+		statsd.Count("count.rejected", 1)
 		return zhttp.Bytes(w, gif)
 	}
 	if hit.Bot > 0 && hit.Bot < 150 {
 		w.Header().Add("X-Goatcounter", fmt.Sprintf("wrong value: b=%d", hit.Bot))
 		w.WriteHeader(400)
+		statsd.Count("count.rejected", 1)
 		return zhttp.Bytes(w, gif)
 	}
 
 	if isbot.Is(bot) { // Prefer the backend detection.
 		hit.Bot = int(bot)
 	}
+	if hit.Bot == 0 && site.Settings.BotRules.Match(hit) {
+		hit.Bot = goatcounter.BotSiteRule
+	}
+	if hit.Bot == 0 && site.Settings.DatacenterBots && datacenter(ip) {
+		hit.Bot = goatcounter.BotDatacenter
+	}
 
-	if uint8(hit.Bot) >= isbot.BotJSPhanton {
+	// Only log the bots detected by isbot in JavaScript; the site's bot rules
+	// and datacenter detection would just fill the log with regular traffic.
+	if uint8(hit.Bot) >= isbot.BotJSPhanton && hit.Bot < goatcounter.BotSiteRule {
 		ctx := zdb.With(context.Background(), zdb.MustGet(r.Context()))
+		headers := r.Header
+		if ip != r.RemoteAddr {
+			headers = r.Header.Clone()
+			for _, h := range []string{"Forwarded", "X-Forwarded-For", "X-Real-Ip", "Cf-Connecting-Ip"} {
+				headers.Del(h)
+			}
+		}
 		bgrun.Run(func() {
 			bl := goatcounter.AdminBotlog{
 				Bot:       hit.Bot,
 				UserAgent: r.UserAgent(),
-				Headers:   r.Header,
+				Headers:   headers,
 				URL:       r.RequestURI,
 			}
-			err := bl.Insert(ctx, r.RemoteAddr)
+			err := bl.Insert(ctx, ip)
 			if err != nil {
 				zlog.Error(err)
 			}
@@ -275,13 +585,109 @@ func (h backend) count(w http.ResponseWriter, r *http.Request) error {
 	if err != nil {
 		w.Header().Add("X-Goatcounter", fmt.Sprintf("not valid: %s", err))
 		w.WriteHeader(400)
+		statsd.Count("count.rejected", 1)
 		return zhttp.Bytes(w, gif)
 	}
 
+	if hit.Bot > 0 {
+		statsd.Count("count.bot", 1)
+	} else {
+		statsd.Count("count.accepted", 1)
+	}
 	goatcounter.Memstore.Append(hit)
 	return zhttp.Bytes(w, gif)
 }
 
+// countJS serves count.js with the site's settings applied; values set in
+// window.goatcounter take precedence.
+func (h backend) countJS(w http.ResponseWriter, r *http.Request) error {
+	site := goatcounter.MustGetSite(r.Context())
+
+	script, ok := pack.Public["public/count.js"]
+	if !cfg.Prod || !ok {
+		var err error
+		script, err = ioutil.ReadFile("./public/count.js")
+		if err != nil {
+			return err
+		}
+	}
+
+	settings := zjson.MustMarshal(map[string]interface{}{
+		"spa": site.Settings.SPA,
+	})
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/javascript; charset=utf-8")
+	w.Header().Set("Cache-Control", "public,max-age=3600")
+	return zhttp.Bytes(w, append([]byte(fmt.Sprintf(
+		"(function() { window.goatcounter = window.goatcounter || {}; var s = %s; "+
+			"for (var k in s) if (window.goatcounter[k] === undefined) window.goatcounter[k] = s[k] })();\n",
+		settings)), script...))
+}
+
+// counterBadge is a shields.io-style badge; the widths are estimated from the
+// number of characters as there's no way to measure the text.
+const counterBadge = `<svg xmlns="http://www.w3.org/2000/svg" width="%[1]d" height="20" role="img" aria-label="%[3]s: %[4]s">` +
+	`<title>%[3]s: %[4]s</title>` +
+	`<rect width="%[2]d" height="20" fill="#555"/>` +
+	`<rect x="%[2]d" width="%[5]d" height="20" fill="#9a15a4"/>` +
+	`<g fill="#fff" text-anchor="middle" font-family="Verdana,Geneva,DejaVu Sans,sans-serif" font-size="11">` +
+	`<text x="%[6]d" y="14">%[3]s</text><text x="%[7]d" y="14">%[4]s</text></g></svg>`
+
+// counter renders a badge or JSON with the number of pageviews for a path, e.g.
+// /counter/blog/post.svg for "/blog/post", or /counter/%2F.json for "/".
+func (h backend) counter(w http.ResponseWriter, r *http.Request) error {
+	site := goatcounter.MustGetSite(r.Context())
+	// Public dashboards allow the counter, unless the pages are hidden. The
+	// counter is shown to visitors, so this doesn't depend on who is logged in.
+	if !site.Settings.AllowCounter && (!site.Settings.Public || site.Settings.PublicHidden("pages")) {
+		return guru.New(http.StatusForbidden, "the view counter isn't enabled for this site")
+	}
+
+	p, err := url.PathUnescape(chi.URLParam(r, "*"))
+	if err != nil {
+		return guru.New(http.StatusBadRequest, "invalid path")
+	}
+	ext := filepath.Ext(p)
+	if ext != ".svg" && ext != ".json" {
+		return guru.New(http.StatusNotFound, "the path should end with .svg or .json")
+	}
+	p = strings.TrimSuffix(p, ext)
+	if !strings.HasPrefix(p, "/") {
+		p = "/" + p
+	}
+
+	total, totalUnique, err := goatcounter.GetPathCount(r.Context(), p)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Cache-Control", "public,max-age=1800")
+	if ext == ".json" {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		return zhttp.JSON(w, map[string]interface{}{
+			"path":         p,
+			"count":        total,
+			"count_unique": totalUnique,
+		})
+	}
+
+	n := total
+	if r.URL.Query().Get("unique") != "" {
+		n = totalUnique
+	}
+	label := r.URL.Query().Get("label")
+	if label == "" {
+		label = "views"
+	}
+	count := zhttp.Tnformat(n, site.Settings.NumberFormat)
+	lw, cw := utf8.RuneCountInString(label)*7+10, utf8.RuneCountInString(count)*7+10
+
+	w.Header().Set("Content-Type", "image/svg+xml")
+	return zhttp.Bytes(w, []byte(fmt.Sprintf(counterBadge, lw+cw, lw,
+		html.EscapeString(label), html.EscapeString(count), cw, lw/2, lw+cw/2)))
+}
+
 func (h backend) pages(w http.ResponseWriter, r *http.Request) error {
 	site := goatcounter.MustGetSite(r.Context())
 
@@ -325,14 +731,26 @@ func (h backend) pages(w http.ResponseWriter, r *http.Request) error {
 			if totalErr != nil {
 				return
 			}
+			var annotations goatcounter.Annotations
+			totalErr = annotations.ListRange(r.Context(), start, end)
+			if totalErr != nil {
+				return
+			}
+			var anomalies goatcounter.Anomalies
+			totalErr = anomalies.ListRange(r.Context(), start, end)
+			if totalErr != nil {
+				return
+			}
+			annotations = append(annotations, anomalies.Annotations()...)
 
 			totalTpl, totalErr = zhttp.ExecuteTpl("_dashboard_totals_row.gohtml", struct {
-				Context context.Context
-				Site    *goatcounter.Site
-				Page    goatcounter.HitStat
-				Daily   bool
-				Max     int
-			}{r.Context(), site, totalPages, daily, maxTotals})
+				Context     context.Context
+				Site        *goatcounter.Site
+				Page        goatcounter.HitStat
+				Daily       bool
+				Max         int
+				Annotations goatcounter.Annotations
+			}{r.Context(), site, totalPages, daily, maxTotals, annotations})
 		}()
 
 		wg.Add(1)
@@ -352,11 +770,17 @@ func (h backend) pages(w http.ResponseWriter, r *http.Request) error {
 		}()
 	}
 
-	var pages goatcounter.HitStats
-	totalDisplay, totalUniqueDisplay, more, err := pages.List(
-		r.Context(), start, end, filter, strings.Split(exclude, ","), daily)
-	if err != nil {
-		return err
+	var (
+		pages                            goatcounter.HitStats
+		totalDisplay, totalUniqueDisplay int
+		more                             bool
+	)
+	if !publicHidden(r.Context(), "pages") {
+		totalDisplay, totalUniqueDisplay, more, err = pages.List(
+			r.Context(), start, end, filter, strings.Split(exclude, ","), daily)
+		if err != nil {
+			return err
+		}
 	}
 
 	tpl, err := zhttp.ExecuteTpl("_dashboard_pages_rows.gohtml", struct {
@@ -408,9 +832,24 @@ func (h backend) pages(w http.ResponseWriter, r *http.Request) error {
 	})
 }
 
+// hchartPanels maps the kind parameter for hchartDetail and hchartMore to the
+// panels that can be hidden on public dashboards.
+var hchartPanels = map[string]string{
+	"browser":   "browsers",
+	"system":    "systems",
+	"size":      "sizes",
+	"location":  "locations",
+	"region":    "locations",
+	"language":  "languages",
+	"ref":       "referrers",
+	"topref":    "referrers",
+	"dimension": "dimensions",
+}
+
 // TODO: don't hard-code limit to 10, and allow pagination here too.
 func (h backend) hchartDetail(w http.ResponseWriter, r *http.Request) error {
-	start, end, err := getPeriod(w, r, goatcounter.MustGetSite(r.Context()))
+	site := goatcounter.MustGetSite(r.Context())
+	start, end, err := getPeriod(w, r, site)
 	if err != nil {
 		return err
 	}
@@ -419,33 +858,52 @@ func (h backend) hchartDetail(w http.ResponseWriter, r *http.Request) error {
 	name := r.URL.Query().Get("name")
 	kind := r.URL.Query().Get("kind")
 	v.Required("name", name)
-	v.Include("kind", kind, []string{"browser", "system", "size", "topref"})
+	v.Include("kind", kind, []string{"browser", "system", "size", "topref", "location", "region"})
 	v.Required("kind", kind)
 	total := int(v.Integer("total", r.URL.Query().Get("total")))
 	if v.HasErrors() {
 		return v
 	}
+	if publicHidden(r.Context(), hchartPanels[kind]) {
+		return guru.New(http.StatusForbidden, "this panel is not public")
+	}
 
-	var detail goatcounter.Stats
+	var (
+		detail goatcounter.Stats
+		filter = r.URL.Query().Get("filter")
+	)
 	switch kind {
 	case "browser":
-		err = detail.ListBrowser(r.Context(), name, start, end)
+		err = detail.ListBrowser(r.Context(), name, start, end, filter)
 	case "system":
-		err = detail.ListSystem(r.Context(), name, start, end)
+		err = detail.ListSystem(r.Context(), name, start, end, filter)
 	case "size":
-		err = detail.ListSize(r.Context(), name, start, end)
+		err = detail.ListSize(r.Context(), name, start, end, filter)
 	case "topref":
 		if name == "(unknown)" {
 			name = ""
 		}
-		err = detail.ByRef(r.Context(), start, end, name)
+		err = detail.ByRef(r.Context(), start, end, filter, name)
+	case "location":
+		err = detail.ListLocation(r.Context(), name, start, end, filter)
+	case "region":
+		if name == "(unknown)" {
+			name = ""
+		}
+		err = detail.ListRegion(r.Context(), name, start, end, filter)
 	}
 	if err != nil {
 		return err
 	}
 
+	// Regions can be expanded to show the cities if the site records them.
+	cities := kind == "location" && site.Settings.Cities
+	chart := goatcounter.HorizontalChart(r.Context(), detail, total, 10, cities, false)
+	if cities {
+		chart = `<div data-detail="/hchart-detail?kind=region">` + chart + `</div>`
+	}
 	return zhttp.JSON(w, map[string]interface{}{
-		"html": string(goatcounter.HorizontalChart(r.Context(), detail, total, 10, false, false)),
+		"html": string(chart),
 	})
 }
 
@@ -459,7 +917,7 @@ func (h backend) hchartMore(w http.ResponseWriter, r *http.Request) error {
 
 	v := zvalidate.New()
 	kind := r.URL.Query().Get("kind")
-	v.Include("kind", kind, []string{"browser", "system", "location", "ref", "topref"})
+	v.Include("kind", kind, []string{"browser", "system", "location", "language", "ref", "topref", "dimension"})
 	v.Required("kind", kind)
 	total := int(v.Integer("total", r.URL.Query().Get("total")))
 	offset := int(v.Integer("offset", r.URL.Query().Get("offset")))
@@ -469,31 +927,46 @@ func (h backend) hchartMore(w http.ResponseWriter, r *http.Request) error {
 		showRefs = r.URL.Query().Get("showrefs")
 		v.Required("showrefs", "showRefs")
 	}
+	dim := ""
+	if kind == "dimension" {
+		dim = r.URL.Query().Get("name")
+		v.Required("name", dim)
+	}
 	if v.HasErrors() {
 		return v
 	}
+	if publicHidden(r.Context(), hchartPanels[kind]) {
+		return guru.New(http.StatusForbidden, "this panel is not public")
+	}
 
 	var (
 		page     goatcounter.Stats
+		filter   = r.URL.Query().Get("filter")
 		size     = 6
 		paginate = false
 		link     = true
 	)
 	switch kind {
 	case "browser":
-		err = page.ListBrowsers(r.Context(), start, end, 6, offset)
+		err = page.ListBrowsers(r.Context(), start, end, filter, 6, offset)
 	case "system":
-		err = page.ListSystems(r.Context(), start, end, 6, offset)
+		err = page.ListSystems(r.Context(), start, end, filter, 6, offset)
 	case "location":
-		err = page.ListLocations(r.Context(), start, end, 6, offset)
+		err = page.ListLocations(r.Context(), start, end, filter, 6, offset)
+		link = site.Settings.Cities || geoHasRegions()
+	case "language":
+		err = page.ListLanguages(r.Context(), start, end, filter, 6, offset)
 		link = false
 	case "ref":
-		err = page.ListRefsByPath(r.Context(), showRefs, start, end, offset)
+		err = page.ListRefsByPath(r.Context(), showRefs, start, end, filter, offset)
 		size = site.Settings.Limits.Ref
 		paginate = offset == 0
 		link = false
 	case "topref":
-		err = page.ListTopRefs(r.Context(), start, end, offset)
+		err = page.ListTopRefs(r.Context(), start, end, filter, offset)
+	case "dimension":
+		err = page.ListDimension(r.Context(), dim, start, end, filter, 6, offset)
+		link = false
 	}
 	if err != nil {
 		return err
@@ -505,6 +978,363 @@ func (h backend) hchartMore(w http.ResponseWriter, r *http.Request) error {
 	})
 }
 
+func (h backend) flow(w http.ResponseWriter, r *http.Request) error {
+	site := goatcounter.MustGetSite(r.Context())
+	if publicHidden(r.Context(), "pages") {
+		return guru.New(http.StatusForbidden, "this panel is not public")
+	}
+
+	start, end, err := getPeriod(w, r, site)
+	if err != nil {
+		zhttp.FlashError(w, err.Error())
+	}
+	if start.IsZero() || end.IsZero() {
+		y, m, d := goatcounter.Now().In(site.Settings.Timezone.Loc()).Date()
+		now := time.Date(y, m, d, 0, 0, 0, 0, site.Settings.Timezone.Loc())
+		start = now.Add(-7 * day).UTC()
+		end = time.Date(y, m, d, 23, 59, 59, 9, now.Location()).UTC().Round(time.Second)
+	}
+
+	var flow goatcounter.PathFlow
+	path := r.URL.Query().Get("path")
+	if path != "" {
+		err = flow.Get(r.Context(), path, start, end, 20)
+		if err != nil {
+			return err
+		}
+	}
+
+	return zhttp.Template(w, "backend_flow.gohtml", struct {
+		Globals
+		Flow        goatcounter.PathFlow
+		PeriodStart string
+		PeriodEnd   string
+	}{newGlobals(w, r), flow,
+		start.In(site.Settings.Timezone.Loc()).Format("2006-01-02"),
+		end.In(site.Settings.Timezone.Loc()).Format("2006-01-02")})
+}
+
+// bots renders the report of pageviews from bots.
+func (h backend) bots(w http.ResponseWriter, r *http.Request) error {
+	site := goatcounter.MustGetSite(r.Context())
+	start, end, err := getPeriod(w, r, site)
+	if err != nil {
+		zhttp.FlashError(w, err.Error())
+	}
+	if start.IsZero() || end.IsZero() {
+		y, m, d := goatcounter.Now().In(site.Settings.Timezone.Loc()).Date()
+		now := time.Date(y, m, d, 0, 0, 0, 0, site.Settings.Timezone.Loc())
+		start = now.Add(-30 * day).UTC()
+		end = time.Date(y, m, d, 23, 59, 59, 9, now.Location()).UTC().Round(time.Second)
+	}
+
+	var bots goatcounter.BotStats
+	err = bots.Get(r.Context(), start, end, 20)
+	if err != nil {
+		return err
+	}
+
+	return zhttp.Template(w, "backend_bots.gohtml", struct {
+		Globals
+		Bots        goatcounter.BotStats
+		PeriodStart string
+		PeriodEnd   string
+	}{newGlobals(w, r), bots,
+		start.In(site.Settings.Timezone.Loc()).Format("2006-01-02"),
+		end.In(site.Settings.Timezone.Loc()).Format("2006-01-02")})
+}
+
+// widget renders a small HTML page with the visitors and a sparkline of the
+// pageviews, for embedding in an iframe.
+func (h backend) widget(w http.ResponseWriter, r *http.Request) error {
+	site := goatcounter.MustGetSite(r.Context())
+	public := true
+	if u := goatcounter.GetUser(r.Context()); u != nil && u.ID > 0 {
+		public = false
+	} else if !site.Settings.Public {
+		return guru.New(http.StatusForbidden, "the statistics for this site aren't public")
+	}
+
+	var (
+		v     = zvalidate.New()
+		q     = r.URL.Query()
+		days  = int64(30)
+		theme = q.Get("theme")
+		color = q.Get("color")
+	)
+	if d := q.Get("days"); d != "" {
+		days = v.Integer("days", d)
+		v.Range("days", days, 1, 365)
+	}
+	if theme == "" {
+		theme = "light"
+	}
+	v.Include("theme", theme, []string{"light", "dark"})
+	if color != "" && ((len(color) != 3 && len(color) != 6) || strings.Trim(color, "0123456789abcdefABCDEF") != "") {
+		v.Append("color", "must be a hex colour such as 9a15a4")
+	}
+	if v.HasErrors() {
+		return v
+	}
+
+	loc := site.Settings.Timezone.Loc()
+	y, m, d := goatcounter.Now().In(loc).Date()
+	start := time.Date(y, m, d-int(days)+1, 0, 0, 0, 0, loc).UTC()
+	end := time.Date(y, m, d, 23, 59, 59, 0, loc).UTC()
+
+	total, totalUnique, err := goatcounter.GetTotalCount(r.Context(), start, end, "")
+	if err != nil {
+		return err
+	}
+	var totals goatcounter.HitStat
+	_, err = totals.Totals(r.Context(), start, end, "", true)
+	if err != nil {
+		return err
+	}
+
+	if public {
+		w.Header().Set("Cache-Control", "public,max-age=3600")
+		w.Header().Set("Vary", "Cookie")
+	}
+	return zhttp.Template(w, "widget.gohtml", struct {
+		Site        goatcounter.Site
+		Days        int64
+		Theme       string
+		Color       string
+		Total       int
+		TotalUnique int
+		Stats       []goatcounter.Stat
+	}{*site, days, theme, color, total, totalUnique, totals.Stats})
+}
+
+// optOutCookie is set on the count domain by the opt-out page; pageviews from
+// browsers that send it aren't counted.
+const optOutCookie = "gc_optout"
+
+// optOut renders a page where visitors can opt out of being counted, or opt in
+// again.
+func (h backend) optOut(w http.ResponseWriter, r *http.Request) error {
+	site := goatcounter.MustGetSite(r.Context())
+
+	if r.Method == http.MethodPost {
+		// Visitors aren't logged in so there's no CSRF token; reject requests
+		// from other sites so they can't change the opt-out.
+		if !sameOrigin(r) {
+			return guru.New(http.StatusForbidden, "cross-site request")
+		}
+		setOptOut(w, r.FormValue("opt-out") == "true")
+		return zhttp.SeeOther(w, "/opt-out")
+	}
+
+	_, err := r.Cookie(optOutCookie)
+	return zhttp.Template(w, "opt_out.gohtml", struct {
+		Site     goatcounter.Site
+		OptedOut bool
+	}{*site, err == nil})
+}
+
+// sameOrigin reports if the request was sent from a page on the same origin,
+// according to the Sec-Fetch-Site and Origin headers. Requests without either
+// header are allowed, as older browsers don't send them.
+func sameOrigin(r *http.Request) bool {
+	switch r.Header.Get("Sec-Fetch-Site") {
+	case "", "same-origin", "none":
+	default:
+		return false
+	}
+	if o := r.Header.Get("Origin"); o != "" {
+		u, err := url.Parse(o)
+		if err != nil || u.Host != r.Host {
+			return false
+		}
+	}
+	return true
+}
+
+// setOptOut sets or removes the optOutCookie.
+func setOptOut(w http.ResponseWriter, optOut bool) {
+	c := &http.Cookie{
+		Name:     optOutCookie,
+		Value:    "1",
+		Path:     "/",
+		MaxAge:   10 * 365 * 86400,
+		HttpOnly: true,
+		Secure:   zhttp.CookieSecure,
+		// The cookie needs to be sent with the /count requests from the site,
+		// which are cross-site; browsers only allow SameSite=None with Secure.
+		SameSite: http.SameSiteNoneMode,
+	}
+	if !zhttp.CookieSecure {
+		c.SameSite = http.SameSiteLaxMode
+	}
+	if !optOut {
+		c.Value, c.MaxAge = "", -1
+	}
+	http.SetCookie(w, c)
+}
+
+// excludeMe sets the optOutCookie for the current browser, so the site owner's
+// own visits aren't counted, and optionally adds their IP to the ignored IPs.
+func (h backend) excludeMe(w http.ResponseWriter, r *http.Request) error {
+	if r.FormValue("exclude") != "true" {
+		setOptOut(w, false)
+		zhttp.Flash(w, "Your visits from this browser will be counted again")
+		return zhttp.SeeOther(w, "/settings#exclude-me")
+	}
+
+	setOptOut(w, true)
+	if r.FormValue("ip") != "on" {
+		zhttp.Flash(w, "Your visits from this browser will no longer be counted")
+		return zhttp.SeeOther(w, "/settings#exclude-me")
+	}
+
+	site := goatcounter.MustGetSite(r.Context())
+	ip := r.RemoteAddr
+	if _, ok := site.Settings.IgnoreIP(ip); !ok {
+		site.Settings.IgnoreIPs = append(site.Settings.IgnoreIPs,
+			ip+" # added by "+goatcounter.GetUser(r.Context()).Email)
+		err := site.Update(r.Context())
+		if err != nil {
+			zhttp.FlashError(w, err.Error())
+			return zhttp.SeeOther(w, "/settings#exclude-me")
+		}
+	}
+	zhttp.Flash(w, "Your visits from this browser and from %s will no longer be counted", ip)
+	return zhttp.SeeOther(w, "/settings#exclude-me")
+}
+
+func (h backend) saveSegment(w http.ResponseWriter, r *http.Request) error {
+	args := struct {
+		Name        string `json:"name"`
+		Period      string `json:"period"`
+		PeriodStart string `json:"period-start"`
+		PeriodEnd   string `json:"period-end"`
+		Filter      string `json:"filter"`
+		Daily       string `json:"daily"`
+		Compare     string `json:"compare"`
+	}{}
+	_, err := zhttp.Decode(r, &args)
+	if err != nil {
+		return err
+	}
+
+	s := goatcounter.Segment{
+		Name:    args.Name,
+		Period:  args.Period,
+		Filter:  args.Filter,
+		Daily:   args.Daily == "on" || args.Daily == "true",
+		Compare: args.Compare,
+	}
+	if s.Period == "" {
+		s.PeriodStart, s.PeriodEnd = &args.PeriodStart, &args.PeriodEnd
+	}
+	err = s.Insert(r.Context())
+	if err != nil {
+		zhttp.FlashError(w, err.Error())
+		return zhttp.SeeOther(w, "/")
+	}
+
+	zhttp.Flash(w, "Saved view ‘%s’.", s.Name)
+	return zhttp.SeeOther(w, "/?segment="+url.QueryEscape(s.Name))
+}
+
+func (h backend) deleteSegment(w http.ResponseWriter, r *http.Request) error {
+	v := zvalidate.New()
+	id := v.Integer("id", chi.URLParam(r, "id"))
+	if v.HasErrors() {
+		return v
+	}
+
+	var s goatcounter.Segment
+	err := s.ByID(r.Context(), id)
+	if err != nil {
+		return err
+	}
+	err = s.Delete(r.Context())
+	if err != nil {
+		return err
+	}
+
+	zhttp.Flash(w, "Removed view ‘%s’.", s.Name)
+	return zhttp.SeeOther(w, "/")
+}
+
+func (h backend) addAnnotation(w http.ResponseWriter, r *http.Request) error {
+	var a goatcounter.Annotation
+	_, err := zhttp.Decode(r, &a)
+	if err != nil {
+		return err
+	}
+
+	err = a.Insert(r.Context())
+	if err != nil {
+		zhttp.FlashError(w, err.Error())
+		return zhttp.SeeOther(w, "/settings#tab-annotations")
+	}
+
+	zhttp.Flash(w, "Added annotation ‘%s’ on %s.", a.Text, a.Day)
+	return zhttp.SeeOther(w, "/settings#tab-annotations")
+}
+
+func (h backend) deleteAnnotation(w http.ResponseWriter, r *http.Request) error {
+	v := zvalidate.New()
+	id := v.Integer("id", chi.URLParam(r, "id"))
+	if v.HasErrors() {
+		return v
+	}
+
+	var a goatcounter.Annotation
+	err := a.ByID(r.Context(), id)
+	if err != nil {
+		return err
+	}
+	err = a.Delete(r.Context())
+	if err != nil {
+		return err
+	}
+
+	zhttp.Flash(w, "Removed annotation ‘%s’.", a.Text)
+	return zhttp.SeeOther(w, "/settings#tab-annotations")
+}
+
+func (h backend) addAlert(w http.ResponseWriter, r *http.Request) error {
+	var a goatcounter.AlertRule
+	_, err := zhttp.Decode(r, &a)
+	if err != nil {
+		return err
+	}
+
+	err = a.Insert(r.Context())
+	if err != nil {
+		zhttp.FlashError(w, err.Error())
+		return zhttp.SeeOther(w, "/settings#tab-alerts")
+	}
+
+	zhttp.Flash(w, "Added alert for %s.", a.Describe())
+	return zhttp.SeeOther(w, "/settings#tab-alerts")
+}
+
+func (h backend) deleteAlert(w http.ResponseWriter, r *http.Request) error {
+	v := zvalidate.New()
+	id := v.Integer("id", chi.URLParam(r, "id"))
+	if v.HasErrors() {
+		return v
+	}
+
+	var a goatcounter.AlertRule
+	err := a.ByID(r.Context(), id)
+	if err != nil {
+		return err
+	}
+	err = a.Delete(r.Context())
+	if err != nil {
+		return err
+	}
+
+	zhttp.Flash(w, "Removed alert for %s.", a.Describe())
+	return zhttp.SeeOther(w, "/settings#tab-alerts")
+}
+
 func (h backend) updates(w http.ResponseWriter, r *http.Request) error {
 	u := goatcounter.GetUser(r.Context())
 
@@ -550,6 +1380,45 @@ func (h backend) settingsTpl(w http.ResponseWriter, r *http.Request, verr *zvali
 		return err
 	}
 
+	var roles goatcounter.Roles
+	err = roles.List(r.Context())
+	if err != nil {
+		return err
+	}
+
+	var users goatcounter.Users
+	err = users.List(r.Context())
+	if err != nil {
+		return err
+	}
+
+	var annotations goatcounter.Annotations
+	err = annotations.List(r.Context())
+	if err != nil {
+		return err
+	}
+
+	var alerts goatcounter.AlertRules
+	err = alerts.List(r.Context())
+	if err != nil {
+		return err
+	}
+
+	var sessions goatcounter.UserSessions
+	err = sessions.List(r.Context(), goatcounter.GetUser(r.Context()).ID)
+	if err != nil {
+		return err
+	}
+
+	var reportSites goatcounter.Sites
+	err = reportSites.ListWithSubs(r.Context(), goatcounter.GetUser(r.Context()).Site)
+	if err != nil {
+		return err
+	}
+
+	_, err = r.Cookie(optOutCookie)
+	excluded := err == nil
+
 	del := map[string]interface{}{
 		"ContactMe": r.URL.Query().Get("contact_me") == "true",
 		"Reason":    r.URL.Query().Get("reason"),
@@ -557,13 +1426,24 @@ func (h backend) settingsTpl(w http.ResponseWriter, r *http.Request, verr *zvali
 
 	return zhttp.Template(w, "backend_settings.gohtml", struct {
 		Globals
-		SubSites  goatcounter.Sites
-		Validate  *zvalidate.Validator
-		Timezones []*tz.Zone
-		Delete    map[string]interface{}
-		Exports   goatcounter.Exports
-		APITokens goatcounter.APITokens
-	}{newGlobals(w, r), sites, verr, tz.Zones, del, exports, tokens})
+		SubSites     goatcounter.Sites
+		Validate     *zvalidate.Validator
+		Timezones    []*tz.Zone
+		Delete       map[string]interface{}
+		Exports      goatcounter.Exports
+		APITokens    goatcounter.APITokens
+		Roles        goatcounter.Roles
+		Users        goatcounter.Users
+		Permissions  []goatcounter.Permission
+		Annotations  goatcounter.Annotations
+		ReportSites  goatcounter.Sites
+		PublicPanels []string
+		Alerts       goatcounter.AlertRules
+		MaxAlerts    int
+		Sessions     goatcounter.UserSessions
+		ExcludedMe   bool
+	}{newGlobals(w, r), sites, verr, tz.Zones, del, exports, tokens, roles, users, goatcounter.Permissions,
+		annotations, reportSites, goatcounter.PublicPanels, alerts, goatcounter.MaxAlertRules, sessions, excluded})
 }
 
 func (h backend) code(w http.ResponseWriter, r *http.Request) error {
@@ -629,6 +1509,20 @@ func (h backend) saveSettings(w http.ResponseWriter, r *http.Request) error {
 	}
 
 	user.Email = args.User.Email
+	user.EmailReports = args.User.EmailReports
+	user.Settings.EmailReportSections = r.Form["email_report_sections"]
+	if user.EmailReports != "" && len(user.Settings.EmailReportSections) == 0 {
+		v.Append("user.settings.email_report_sections", "select at least one section")
+	}
+	user.Settings.EmailReportSites = nil
+	for _, s := range r.Form["email_report_sites"] {
+		id, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			v.Append("user.settings.email_report_sites", "must be a number")
+			continue
+		}
+		user.Settings.EmailReportSites = append(user.Settings.EmailReportSites, id)
+	}
 	err = user.Update(txctx, emailChanged)
 	if err != nil {
 		var vErr *zvalidate.Validator
@@ -639,7 +1533,13 @@ func (h backend) saveSettings(w http.ResponseWriter, r *http.Request) error {
 	}
 
 	site := goatcounter.MustGetSite(txctx)
+	oldTZ := site.Settings.Timezone.Loc().String()
 	site.Settings = args.Settings
+	site.Settings.PublicHide = r.Form["public_hide"]
+	if !site.Settings.AllowDashboard(r.RemoteAddr) {
+		v.Append("site.settings.dashboard_ips", fmt.Sprintf(
+			"your current IP address (%s) isn't in the list, and you would be locked out", r.RemoteAddr))
+	}
 	site.LinkDomain = args.LinkDomain
 	if args.Cname != "" && !site.PlanCustomDomain(txctx) {
 		return guru.New(http.StatusForbidden, "need a business plan to set custom domain")
@@ -677,6 +1577,8 @@ func (h backend) saveSettings(w http.ResponseWriter, r *http.Request) error {
 		sendEmailVerify(site, user)
 	}
 
+	rebucket(r.Context(), *site, oldTZ)
+
 	if makecert {
 		ctx := goatcounter.NewContext(r.Context())
 		bgrun.Run(func() {
@@ -697,6 +1599,62 @@ func (h backend) saveSettings(w http.ResponseWriter, r *http.Request) error {
 	return zhttp.SeeOther(w, "/settings")
 }
 
+// rebucketing are the sites for which rebucket() is running; the value is set
+// to true if the timezone changed again while it's running.
+var rebucketing = struct {
+	sync.Mutex
+	sites map[int64]bool
+}{sites: make(map[int64]bool)}
+
+// rebucket recreates the daily statistics in the background if the site's
+// timezone changed from oldTZ; they're stored per day in the site's timezone,
+// so this avoids a jump in the charts from the day it changed.
+//
+// Only one runs per site; if the timezone is changed again while it's running
+// it's run once more afterwards.
+func rebucket(ctx context.Context, site goatcounter.Site, oldTZ string) {
+	if site.Settings.Timezone.Loc().String() == oldTZ {
+		return
+	}
+
+	rebucketing.Lock()
+	defer rebucketing.Unlock()
+	if _, ok := rebucketing.sites[site.ID]; ok {
+		rebucketing.sites[site.ID] = true
+		return
+	}
+	rebucketing.sites[site.ID] = false
+
+	ctx = goatcounter.NewContext(ctx)
+	bgrun.Run(func() {
+		l := zlog.Field("site", site.ID)
+		for {
+			var s goatcounter.Site
+			err := s.ByID(ctx, site.ID)
+			if err == nil {
+				err = cron.Rebucket(goatcounter.WithSite(ctx, &s), s, 100*time.Millisecond)
+			}
+			if errors.Is(err, cron.ErrReindexRunning) {
+				time.Sleep(10 * time.Second)
+				continue
+			}
+			if err != nil {
+				l.Error(err)
+			}
+
+			rebucketing.Lock()
+			again := rebucketing.sites[site.ID]
+			if !again {
+				delete(rebucketing.sites, site.ID)
+				rebucketing.Unlock()
+				return
+			}
+			rebucketing.sites[site.ID] = false
+			rebucketing.Unlock()
+		}
+	})
+}
+
 func (h backend) importFile(w http.ResponseWriter, r *http.Request) error {
 	v := zvalidate.New()
 	replace := v.Boolean("replace", r.Form.Get("replace"))
@@ -7,6 +7,7 @@ package handlers
 import (
 	"context"
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
@@ -45,6 +46,12 @@ func TestBackendCount(t *testing.T) {
 	}{
 		{"no path", url.Values{}, nil, 400, goatcounter.Hit{}},
 		{"invalid size", url.Values{"p": {"/x"}, "s": {"xxx"}}, nil, 400, goatcounter.Hit{}},
+		{"invalid event", url.Values{"p": {"/x"}, "e": {"xxx"}}, nil, 400, goatcounter.Hit{}},
+		{"unknown parameter", url.Values{"p": {"/x"}, "x": {"y"}}, nil, 400, goatcounter.Hit{}},
+		{"escaped", url.Values{"p": {"/x y/€"}, "t": {"a&b=c"}}, nil, 200, goatcounter.Hit{
+			Path:  "/x y/€",
+			Title: "a&b=c",
+		}},
 
 		{"", url.Values{"p": {"/foo.html"}}, nil, 200, goatcounter.Hit{
 			Path: "/foo.html",
@@ -182,10 +189,159 @@ func TestBackendCount(t *testing.T) {
 	}
 }
 
+func TestBackendCountDNT(t *testing.T) {
+	tests := []struct {
+		name     string
+		honor    bool
+		header   string
+		wantCode int
+		wantHits int
+	}{
+		{"not enabled", false, "DNT", 200, 1},
+		{"no header", true, "", 200, 1},
+		{"dnt", true, "DNT", 202, 0},
+		{"gpc", true, "Sec-GPC", 202, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, clean := gctest.DB(t)
+			defer clean()
+
+			ctx, site := gctest.Site(ctx, t, goatcounter.Site{
+				Settings: goatcounter.SiteSettings{HonorDNT: tt.honor},
+			})
+
+			r, rr := newTest(ctx, "GET", "/count?p=/x", nil)
+			r.Host = site.Code + "." + cfg.Domain
+			if tt.header != "" {
+				r.Header.Set(tt.header, "1")
+			}
+			newBackend(zdb.MustGet(ctx)).ServeHTTP(rr, r)
+			ztest.Code(t, rr, tt.wantCode)
+
+			_, err := goatcounter.Memstore.Persist(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var hits goatcounter.Hits
+			_, err = hits.List(ctx, 0, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(hits) != tt.wantHits {
+				t.Errorf("len(hits) = %d; want %d", len(hits), tt.wantHits)
+			}
+		})
+	}
+}
+
+func TestBackendOptOut(t *testing.T) {
+	ctx, clean := gctest.DB(t)
+	defer clean()
+	ctx, site := gctest.Site(ctx, t, goatcounter.Site{})
+
+	var header http.Header
+	send := func(method, path string, body io.Reader, cookies []*http.Cookie) *httptest.ResponseRecorder {
+		r, rr := newTest(ctx, method, path, body)
+		r.Host = site.Code + "." + cfg.Domain
+		if body != nil {
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+		for k, v := range header {
+			r.Header[k] = v
+		}
+		for _, c := range cookies {
+			r.AddCookie(c)
+		}
+		newBackend(zdb.MustGet(ctx)).ServeHTTP(rr, r)
+		return rr
+	}
+
+	rr := send("GET", "/opt-out", nil, nil)
+	ztest.Code(t, rr, 200)
+	if !strings.Contains(rr.Body.String(), `value="true"`) {
+		t.Error("no opt-out button")
+	}
+
+	rr = send("POST", "/opt-out", strings.NewReader("opt-out=true"), nil)
+	ztest.Code(t, rr, 303)
+	cookies := rr.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != optOutCookie || cookies[0].Value != "1" {
+		t.Fatalf("wrong cookies: %v", cookies)
+	}
+
+	rr = send("GET", "/opt-out", nil, cookies)
+	ztest.Code(t, rr, 200)
+	if !strings.Contains(rr.Body.String(), `value="false"`) {
+		t.Error("no opt-in button")
+	}
+
+	rr = send("GET", "/count?p=/x", nil, cookies)
+	ztest.Code(t, rr, 202)
+
+	// Cross-site requests are rejected.
+	header = http.Header{"Sec-Fetch-Site": {"cross-site"}}
+	rr = send("POST", "/opt-out", strings.NewReader("opt-out=false"), cookies)
+	ztest.Code(t, rr, 403)
+	header = http.Header{"Origin": {"https://example.com"}}
+	rr = send("POST", "/opt-out", strings.NewReader("opt-out=false"), cookies)
+	ztest.Code(t, rr, 403)
+
+	header = http.Header{"Origin": {"http://" + site.Code + "." + cfg.Domain}, "Sec-Fetch-Site": {"same-origin"}}
+	rr = send("POST", "/opt-out", strings.NewReader("opt-out=false"), cookies)
+	ztest.Code(t, rr, 303)
+	if c := rr.Result().Cookies(); len(c) != 1 || c[0].MaxAge != -1 {
+		t.Fatalf("cookie not removed: %v", c)
+	}
+}
+
+func TestBackendExcludeMe(t *testing.T) {
+	ctx, clean := gctest.DB(t)
+	defer clean()
+	ctx, site := gctest.Site(ctx, t, goatcounter.Site{})
+
+	// The response also sets the flash cookie.
+	send := func(body string) *http.Cookie {
+		r, rr := newTest(ctx, "POST", "/exclude-me", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.RemoteAddr = "192.0.2.1"
+		login(t, r)
+		newBackend(zdb.MustGet(ctx)).ServeHTTP(rr, r)
+		ztest.Code(t, rr, 303)
+		for _, c := range rr.Result().Cookies() {
+			if c.Name == optOutCookie {
+				return c
+			}
+		}
+		return nil
+	}
+
+	if c := send("exclude=true&ip=on"); c == nil || c.Value != "1" {
+		t.Fatalf("wrong cookie: %v", c)
+	}
+
+	// Shouldn't add the IP twice.
+	send("exclude=true&ip=on")
+	err := site.ByID(ctx, site.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(site.Settings.IgnoreIPs) != 1 {
+		t.Fatalf("wrong IgnoreIPs: %v", site.Settings.IgnoreIPs)
+	}
+	if _, ok := site.Settings.IgnoreIP("192.0.2.1"); !ok {
+		t.Errorf("IP not ignored: %v", site.Settings.IgnoreIPs)
+	}
+
+	if c := send("exclude=false"); c == nil || c.MaxAge != -1 {
+		t.Fatalf("cookie not removed: %v", c)
+	}
+}
+
 func TestBackendCountSessions(t *testing.T) {
-	now := time.Date(2019, 6, 18, 14, 42, 0, 0, time.UTC)
-	goatcounter.Now = func() time.Time { return now }
-	defer func() { goatcounter.Now = func() time.Time { return time.Now().UTC() } }()
+	clock := goatcounter.NewFixedClock(time.Date(2019, 6, 18, 14, 42, 0, 0, time.UTC))
+	defer goatcounter.SetClock(clock)()
 
 	ctx, clean := gctest.DB(t)
 	defer clean()
@@ -274,7 +430,7 @@ func TestBackendCountSessions(t *testing.T) {
 	}
 
 	rotate := func(ctx context.Context) {
-		now = now.Add(12 * time.Hour)
+		clock.Advance(12 * time.Hour)
 		oldCur, _ := goatcounter.Memstore.GetSalt()
 
 		goatcounter.Memstore.RefreshSalt()
@@ -287,7 +443,7 @@ func TestBackendCountSessions(t *testing.T) {
 
 	// Ensure salts aren't cycled before they should.
 	beforeCur, beforePrev := goatcounter.Memstore.GetSalt()
-	now = now.Add(1 * time.Hour)
+	clock.Advance(1 * time.Hour)
 	goatcounter.Memstore.RefreshSalt()
 	afterCur, afterPrev := goatcounter.Memstore.GetSalt()
 
@@ -320,13 +476,24 @@ func TestBackendCountSessions(t *testing.T) {
 	want = []int{1, 1, 2, 3, 3, 1, 2, 1, 3}
 	checkSess(append(hits1, hits2...), want)
 
-	// Rotate again, should use new sessions from now on.
+	// Rotate again; the sessions were moved to the current salt on the last
+	// pageview, so should still use the same sessions.
 	rotate(ctx1)
 	send(ctx1, "test")
 	send(ctx2, "test")
 	hits1 = checkHits(ctx1, 7)
 	hits2 = checkHits(ctx2, 4)
-	want = []int{1, 1, 2, 3, 3, 1, 2, 1, 3, 4, 5}
+	want = []int{1, 1, 2, 3, 3, 1, 2, 1, 3, 1, 3}
+	checkSess(append(hits1, hits2...), want)
+
+	// Rotate twice without any pageviews, should use new sessions from now on.
+	rotate(ctx1)
+	rotate(ctx1)
+	send(ctx1, "test")
+	send(ctx2, "test")
+	hits1 = checkHits(ctx1, 8)
+	hits2 = checkHits(ctx2, 5)
+	want = []int{1, 1, 2, 3, 3, 1, 2, 1, 3, 1, 3, 4, 5}
 	checkSess(append(hits1, hits2...), want)
 }
 
@@ -390,6 +557,289 @@ func TestBackendTpl(t *testing.T) {
 	}
 }
 
+func TestBackendPublicHide(t *testing.T) {
+	setup := func(ctx context.Context, t *testing.T) {
+		site := goatcounter.MustGetSite(ctx)
+		site.Settings.Public = true
+		site.Settings.PublicHide = []string{"browsers"}
+		err := site.Update(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []handlerTest{
+		{
+			name:     "hidden",
+			setup:    setup,
+			router:   newBackend,
+			path:     "/hchart-more?kind=browser&total=1&offset=0",
+			wantCode: 403,
+		},
+		{
+			name:     "visible",
+			setup:    setup,
+			router:   newBackend,
+			path:     "/hchart-more?kind=system&total=1&offset=0",
+			wantCode: 200,
+		},
+		{
+			name:     "logged in",
+			setup:    setup,
+			router:   newBackend,
+			path:     "/hchart-more?kind=browser&total=1&offset=0",
+			auth:     true,
+			wantCode: 200,
+		},
+	}
+
+	for _, tt := range tests {
+		runTest(t, tt, nil)
+	}
+}
+
+func TestBackendDashboardIPs(t *testing.T) {
+	tests := []struct {
+		name     string
+		instance string
+		site     []string
+		path     string
+		wantCode int
+	}{
+		{"no list", "", nil, "/", 200},
+		{"site allowed", "", []string{"10.0.0.0/8", "192.0.2.0/24"}, "/", 200},
+		{"site not allowed", "", []string{"10.0.0.0/8"}, "/", 403},
+		{"site login page", "", []string{"10.0.0.0/8"}, "/user/new", 403},
+		{"site api", "", []string{"10.0.0.0/8"}, "/api/v0/settings", 403},
+		{"instance allowed", "192.0.2.1", nil, "/", 200},
+		{"instance not allowed", "10.0.0.0/8", []string{"192.0.2.1"}, "/", 403},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, clean := gctest.DB(t)
+			defer clean()
+
+			err := SetDashboardIPs(tt.instance)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer SetDashboardIPs("")
+
+			site := goatcounter.MustGetSite(ctx)
+			site.Settings.DashboardIPs = tt.site
+			err = site.Update(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r, rr := newTest(ctx, "GET", tt.path, nil)
+			r.RemoteAddr = "192.0.2.1"
+			login(t, r)
+			newBackend(zdb.MustGet(ctx)).ServeHTTP(rr, r)
+			ztest.Code(t, rr, tt.wantCode)
+		})
+	}
+}
+
+func TestRealIP(t *testing.T) {
+	tests := []struct {
+		remote, xrip, xff, want string
+	}{
+		{"192.0.2.1:42", "", "", "192.0.2.1"},
+		{"192.0.2.1:42", "198.51.100.1", "", "192.0.2.1"},
+		{"192.0.2.1:42", "", "198.51.100.1", "192.0.2.1"},
+		{"10.0.0.1:42", "198.51.100.1", "", "198.51.100.1"},
+		{"10.0.0.1:42", "", "198.51.100.1", "198.51.100.1"},
+		{"10.0.0.1:42", "", "203.0.113.1, 198.51.100.1", "198.51.100.1"},
+		{"10.0.0.1:42", "", "203.0.113.1, 198.51.100.1, 10.0.0.2", "198.51.100.1"},
+		{"[::1]:42", "", "2001:db8::1", "2001:db8::1"},
+	}
+
+	err := SetTrustedProxies("10.0.0.0/8,::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer SetTrustedProxies("")
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s %s %s", tt.remote, tt.xrip, tt.xff), func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.remote
+			if tt.xrip != "" {
+				r.Header.Set("X-Real-Ip", tt.xrip)
+			}
+			if tt.xff != "" {
+				r.Header.Set("X-Forwarded-For", tt.xff)
+			}
+
+			var got string
+			realIP(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = r.RemoteAddr
+			})).ServeHTTP(httptest.NewRecorder(), r)
+			if got != tt.want {
+				t.Errorf("got %q; want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// replicaDB counts the queries sent to the "replica".
+type replicaDB struct {
+	zdb.DB
+	n int
+}
+
+func (r *replicaDB) GetContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error {
+	r.n++
+	return r.DB.GetContext(ctx, dest, query, args...)
+}
+
+func (r *replicaDB) SelectContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error {
+	r.n++
+	return r.DB.SelectContext(ctx, dest, query, args...)
+}
+
+func TestBackendReplica(t *testing.T) {
+	replica := &replicaDB{}
+	router := func(db zdb.DB) chi.Router {
+		replica.DB, replica.n = db, 0
+		return NewBackend(db, replica, nil)
+	}
+
+	tests := []struct {
+		handlerTest
+		wantReplica bool
+	}{
+		{handlerTest{name: "dashboard", path: "/", auth: true, wantCode: 200}, true},
+		{handlerTest{name: "settings", path: "/settings", auth: true, wantCode: 200}, false},
+	}
+
+	for _, tt := range tests {
+		tt.router = router
+		runTest(t, tt.handlerTest, func(t *testing.T, rr *httptest.ResponseRecorder, r *http.Request) {
+			if got := replica.n > 0; got != tt.wantReplica {
+				t.Errorf("replica used: %t (%d queries)", got, replica.n)
+			}
+		})
+	}
+}
+
+func TestBackendWidget(t *testing.T) {
+	public := func(ctx context.Context, t *testing.T) {
+		site := goatcounter.MustGetSite(ctx)
+		site.Settings.Public = true
+		err := site.Update(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		gctest.StoreHits(ctx, t, goatcounter.Hit{Site: site.ID, Path: "/a", FirstVisit: true})
+	}
+
+	tests := []handlerTest{
+		{
+			name:     "public",
+			setup:    public,
+			router:   newBackend,
+			path:     "/widget?days=7&theme=dark",
+			wantCode: 200,
+			wantBody: `<svg class="sparkline"`,
+		},
+		{
+			name:     "private",
+			router:   newBackend,
+			path:     "/widget",
+			wantCode: 403,
+		},
+		{
+			name:     "logged in",
+			router:   newBackend,
+			path:     "/widget",
+			auth:     true,
+			wantCode: 200,
+			wantBody: "in the last 30 days",
+		},
+		{
+			name:     "invalid",
+			setup:    public,
+			router:   newBackend,
+			path:     "/widget?color=red",
+			wantCode: 400,
+		},
+	}
+
+	for _, tt := range tests {
+		runTest(t, tt, nil)
+	}
+}
+
+func TestBackendCounter(t *testing.T) {
+	enable := func(ctx context.Context, t *testing.T) {
+		site := goatcounter.MustGetSite(ctx)
+		site.Settings.AllowCounter = true
+		err := site.Update(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		gctest.StoreHits(ctx, t,
+			goatcounter.Hit{Site: site.ID, Path: "/a/b"},
+			goatcounter.Hit{Site: site.ID, Path: "/a/b"},
+			goatcounter.Hit{Site: site.ID, Path: "/"})
+	}
+
+	tests := []handlerTest{
+		{
+			name:     "path",
+			setup:    enable,
+			router:   newBackend,
+			path:     "/counter/a/b.svg",
+			wantCode: 200,
+			wantBody: `aria-label="views: 2"`,
+		},
+		{
+			name:     "root",
+			setup:    enable,
+			router:   newBackend,
+			path:     "/counter/%2F.svg?label=hits",
+			wantCode: 200,
+			wantBody: `aria-label="hits: 1"`,
+		},
+		{
+			name:     "json",
+			setup:    enable,
+			router:   newBackend,
+			path:     "/counter/a/b.json",
+			wantCode: 200,
+			wantBody: `"count":2`,
+		},
+		{
+			name:     "disabled",
+			router:   newBackend,
+			path:     "/counter/a/b.svg",
+			wantCode: 403,
+		},
+		{
+			name: "public with hidden pages",
+			setup: func(ctx context.Context, t *testing.T) {
+				site := goatcounter.MustGetSite(ctx)
+				site.Settings.Public = true
+				site.Settings.PublicHide = []string{"pages"}
+				err := site.Update(ctx)
+				if err != nil {
+					t.Fatal(err)
+				}
+			},
+			router:   newBackend,
+			path:     "/counter/a/b.svg",
+			wantCode: 403,
+		},
+	}
+
+	for _, tt := range tests {
+		runTest(t, tt, nil)
+	}
+}
+
 func TestBackendPurge(t *testing.T) {
 	tests := []handlerTest{
 		{
@@ -431,6 +881,55 @@ func TestBackendPurge(t *testing.T) {
 	}
 }
 
+func TestBackendBots(t *testing.T) {
+	ctx, clean := gctest.DB(t)
+	defer clean()
+
+	r, rr := newTest(ctx, "GET", "/bots", nil)
+	login(t, r)
+	newBackend(zdb.MustGet(ctx)).ServeHTTP(rr, r)
+	ztest.Code(t, rr, 200)
+
+	role := goatcounter.Role{Name: "export", Permissions: goatcounter.PermissionSet{goatcounter.PermExport}}
+	err := role.Insert(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = zdb.MustGet(ctx).ExecContext(ctx, `update users set owner=0, role_id=$1`, role.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, rr = newTest(ctx, "GET", "/bots", nil)
+	login(t, r)
+	newBackend(zdb.MustGet(ctx)).ServeHTTP(rr, r)
+	ztest.Code(t, rr, 403)
+}
+
+func TestBackendDashboardPerm(t *testing.T) {
+	ctx, clean := gctest.DB(t)
+	defer clean()
+
+	role := goatcounter.Role{Name: "export", Permissions: goatcounter.PermissionSet{goatcounter.PermExport}}
+	err := role.Insert(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = zdb.MustGet(ctx).ExecContext(ctx, `update users set owner=0, role_id=$1`, role.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{"/", "/pages", "/flow", "/widget"} {
+		t.Run(path, func(t *testing.T) {
+			r, rr := newTest(ctx, "GET", path, nil)
+			login(t, r)
+			newBackend(zdb.MustGet(ctx)).ServeHTTP(rr, r)
+			ztest.Code(t, rr, 403)
+		})
+	}
+}
+
 func TestBackendBarChart(t *testing.T) {
 	zlog.Config.Debug = []string{}
 
@@ -817,7 +1316,7 @@ func TestBackendBarChart(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.zone, func(t *testing.T) {
-			goatcounter.Now = func() time.Time { return tt.now.UTC() }
+			defer goatcounter.SetClock(goatcounter.NewFixedClock(tt.now))()
 			t.Run("hourly", func(t *testing.T) {
 				run(t, tt, "/?period-start=2019-06-17&period-end=2019-06-18", tt.wantHourly)
 			})
@@ -828,27 +1327,75 @@ func TestBackendBarChart(t *testing.T) {
 	}
 }
 
+// Run with:
+//
+//	go test -run=- -bench=Count -benchmem ./handlers
+//	go test -run=- -bench=Count -benchmem -tags=testpg ./handlers
+//
+// The hits/s metric is the sustained throughput of the handler; it doesn't
+// include persisting the hits to the database, which happens in the background.
 func BenchmarkCount(b *testing.B) {
 	ctx, clean := gctest.DB(b)
 	defer clean()
 
 	r, rr := newTest(ctx, "GET", "/count", nil)
-	r.URL.RawQuery = url.Values{
-		"p": {"/test.html"},
-		"t": {"Benchmark test for /count"},
-		"r": {"https://example.com/foo"},
-	}.Encode()
+	r.URL.RawQuery = benchQuery
 	r.Header.Set("User-Agent", "Mozilla/5.0 (X11; Linux x86_64; rv:72.0) Gecko/20100101 Firefox/72.0")
 	r.Header.Set("Referer", "https://example.com/foo")
 
 	handler := newBackend(zdb.MustGet(ctx)).ServeHTTP
 
+	b.ReportAllocs()
 	b.ResetTimer()
+	start := time.Now()
 	for i := 0; i < b.N; i++ {
 		handler(rr, r)
 	}
+	b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "hits/s")
 }
 
+func BenchmarkCountParallel(b *testing.B) {
+	ctx, clean := gctest.DB(b)
+	defer clean()
+
+	handler := newBackend(zdb.MustGet(ctx)).ServeHTTP
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	start := time.Now()
+	b.RunParallel(func(pb *testing.PB) {
+		r, rr := newTest(ctx, "GET", "/count", nil)
+		r.URL.RawQuery = benchQuery
+		r.Header.Set("User-Agent", "Mozilla/5.0 (X11; Linux x86_64; rv:72.0) Gecko/20100101 Firefox/72.0")
+		for pb.Next() {
+			handler(rr, r)
+		}
+	})
+	b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "hits/s")
+}
+
+func BenchmarkDecodeHit(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var hit goatcounter.Hit
+		err := decodeHit(benchQuery, &hit)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+var benchQuery = url.Values{
+	"p":   {"/test.html"},
+	"t":   {"Benchmark test for /count"},
+	"r":   {"https://example.com/foo"},
+	"e":   {"false"},
+	"s":   {"1920,1080,1"},
+	"b":   {"0"},
+	"q":   {""},
+	"rnd": {"0.123456"},
+}.Encode()
+
 func date(s string, tz *time.Location) time.Time {
 	d, err := time.ParseInLocation("2006-01-02 15:04", s, tz)
 	if err != nil {
@@ -858,5 +1405,5 @@ func date(s string, tz *time.Location) time.Time {
 }
 
 func newBackend(db zdb.DB) chi.Router {
-	return NewBackend(db, nil)
+	return NewBackend(db, nil, nil)
 }
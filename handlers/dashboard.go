@@ -6,15 +6,19 @@ package handlers
 
 import (
 	"context"
+	"fmt"
 	"html/template"
 	"net/http"
 	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	"zgo.at/errors"
 	"zgo.at/goatcounter"
 	"zgo.at/goatcounter/cfg"
+	"zgo.at/guru"
+	"zgo.at/zdb"
 	"zgo.at/zhttp"
 	"zgo.at/zlog"
 	"zgo.at/zstd/zstring"
@@ -40,8 +44,37 @@ func (ws *widgets) Append(w widget) {
 	ws.Unlock()
 }
 
+// widgetPanels maps the widgets to the panels that can be hidden on public
+// dashboards; see goatcounter.PublicPanels.
+var widgetPanels = map[string]string{
+	"pages":      "pages",
+	"max":        "pages",
+	"refs":       "referrers",
+	"toprefs":    "referrers",
+	"browsers":   "browsers",
+	"systems":    "systems",
+	"sizes":      "sizes",
+	"locations":  "locations",
+	"languages":  "languages",
+	"entries":    "entryexit",
+	"exits":      "entryexit",
+	"engagement": "engagement",
+	"retention":  "retention",
+	"live":       "live",
+}
+
+// publicHidden reports if the panel is hidden for the current request; this is
+// only the case for visitors of a public dashboard who aren't logged in.
+func publicHidden(ctx context.Context, panel string) bool {
+	if u := goatcounter.GetUser(ctx); u != nil && u.ID > 0 {
+		return false
+	}
+	return goatcounter.MustGetSite(ctx).Settings.PublicHidden(panel)
+}
+
 type dashboardData struct {
 	total, totalUnique, allTotalUnique int
+	prevTotal, prevTotalUnique         int
 
 	pages struct {
 		display, uniqueDisplay int
@@ -52,8 +85,9 @@ type dashboardData struct {
 	}
 
 	totalPages struct {
-		max   int
-		total goatcounter.HitStat
+		max         int
+		total       goatcounter.HitStat
+		annotations goatcounter.Annotations
 	}
 
 	topRefs  goatcounter.Stats
@@ -61,6 +95,14 @@ type dashboardData struct {
 	systems  goatcounter.Stats
 	sizeStat goatcounter.Stats
 	locStat  goatcounter.Stats
+	langStat goatcounter.Stats
+
+	dimensions []goatcounter.Stats
+	engagement goatcounter.Engagements
+	entries    goatcounter.EntryExits
+	exits      goatcounter.EntryExits
+	live       goatcounter.LiveStats
+	retention  goatcounter.Retention
 }
 
 func (h backend) dashboard(w http.ResponseWriter, r *http.Request) error {
@@ -73,6 +115,22 @@ func (h backend) dashboard(w http.ResponseWriter, r *http.Request) error {
 		w.Header().Set("Vary", "Cookie")
 	}
 
+	var segments goatcounter.Segments
+	if goatcounter.GetUser(r.Context()).ID > 0 {
+		err := segments.List(r.Context())
+		if err != nil {
+			return err
+		}
+	}
+	segment := r.URL.Query().Get("segment")
+	if segment != "" {
+		err := applySegment(r, site, segment)
+		if err != nil {
+			zhttp.FlashError(w, err.Error())
+			segment = ""
+		}
+	}
+
 	start, end, err := getPeriod(w, r, site)
 	if err != nil {
 		zhttp.FlashError(w, err.Error())
@@ -86,7 +144,16 @@ func (h backend) dashboard(w http.ResponseWriter, r *http.Request) error {
 
 	showRefs := r.URL.Query().Get("showrefs")
 	filter := r.URL.Query().Get("filter")
+	pathFilter, err := goatcounter.ParseFilter(filter)
+	if err != nil {
+		zhttp.FlashError(w, err.Error())
+		filter = ""
+	}
 	daily, forcedDaily := getDaily(r, start, end)
+	compare := r.URL.Query().Get("compare")
+	if !zstring.Contains(goatcounter.ComparePeriods, compare) {
+		compare = ""
+	}
 
 	subs, err := site.ListSubs(r.Context())
 	if err != nil {
@@ -103,17 +170,45 @@ func (h backend) dashboard(w http.ResponseWriter, r *http.Request) error {
 
 	wantWidgets := []string{
 		"totals", // We always need this.
-		"pages", "totalpages", "toprefs", "browsers", "systems", "sizes", "locations"}
+		"pages", "totalpages", "toprefs", "browsers", "systems", "sizes", "locations",
+		"languages", "entries", "exits", "engagement", "retention"}
 	if zstring.Contains(wantWidgets, "pages") {
 		wantWidgets = append(wantWidgets, "max")
 		if showRefs != "" {
 			wantWidgets = append(wantWidgets, "refs")
 		}
 	}
+	for _, d := range site.Settings.Dimensions {
+		wantWidgets = append(wantWidgets, "dimension-"+d.Name)
+	}
+	// Only makes sense if we're looking at the current period.
+	if !goatcounter.Now().After(end) {
+		wantWidgets = append(wantWidgets, "live")
+	}
 	if filter != "" {
 		// We need this when filtering as the bottom charts aren't filtered by path (yet).
 		wantWidgets = append(wantWidgets, "alltotals")
 	}
+	if compare != "" {
+		wantWidgets = append(wantWidgets, "compare")
+	}
+	if showRefs != "" && publicHidden(r.Context(), "referrers") {
+		showRefs = ""
+	}
+	{
+		show := wantWidgets[:0]
+		for _, w := range wantWidgets {
+			p, ok := widgetPanels[w]
+			if strings.HasPrefix(w, "dimension-") {
+				p, ok = "dimensions", true
+			}
+			if ok && publicHidden(r.Context(), p) {
+				continue
+			}
+			show = append(show, w)
+		}
+		wantWidgets = show
+	}
 
 	// Make the race detector stop complaining; I'm not sure why this is a
 	// problem, the logic here is:
@@ -144,7 +239,12 @@ func (h backend) dashboard(w http.ResponseWriter, r *http.Request) error {
 				return err
 			},
 			"alltotals": func() (err error) {
-				_, data.allTotalUnique, err = goatcounter.GetTotalCount(r.Context(), start, end, "")
+				_, data.allTotalUnique, err = goatcounter.GetTotalCount(r.Context(), start, end, pathFilter.Facets())
+				return err
+			},
+			"compare": func() (err error) {
+				cstart, cend := goatcounter.ComparePeriod(start, end, compare)
+				data.prevTotal, data.prevTotalUnique, err = goatcounter.GetTotalCount(r.Context(), cstart, cend, filter)
 				return err
 			},
 			"pages": func() (err error) {
@@ -158,14 +258,40 @@ func (h backend) dashboard(w http.ResponseWriter, r *http.Request) error {
 			},
 			"totalpages": func() (err error) {
 				data.totalPages.max, err = data.totalPages.total.Totals(r.Context(), start, end, filter, daily)
-				return err
+				if err != nil {
+					return err
+				}
+				return data.totalPages.annotations.ListRange(r.Context(), start, end)
 			},
-			"refs":      func() (err error) { return data.pages.refs.ListRefsByPath(r.Context(), showRefs, start, end, 0) },
-			"toprefs":   func() (err error) { return data.topRefs.ListTopRefs(r.Context(), start, end, 0) },
-			"browsers":  func() (err error) { return data.browsers.ListBrowsers(r.Context(), start, end, 6, 0) },
-			"systems":   func() (err error) { return data.systems.ListSystems(r.Context(), start, end, 6, 0) },
-			"sizes":     func() (err error) { return data.sizeStat.ListSizes(r.Context(), start, end) },
-			"locations": func() (err error) { return data.locStat.ListLocations(r.Context(), start, end, 6, 0) },
+			"refs": func() (err error) {
+				return data.pages.refs.ListRefsByPath(r.Context(), showRefs, start, end, filter, 0)
+			},
+			"toprefs":   func() (err error) { return data.topRefs.ListTopRefs(r.Context(), start, end, filter, 0) },
+			"browsers":  func() (err error) { return data.browsers.ListBrowsers(r.Context(), start, end, filter, 6, 0) },
+			"systems":   func() (err error) { return data.systems.ListSystems(r.Context(), start, end, filter, 6, 0) },
+			"sizes":     func() (err error) { return data.sizeStat.ListSizes(r.Context(), start, end, filter) },
+			"locations": func() (err error) { return data.locStat.ListLocations(r.Context(), start, end, filter, 6, 0) },
+			"languages": func() (err error) { return data.langStat.ListLanguages(r.Context(), start, end, filter, 6, 0) },
+			"live":      func() (err error) { return data.live.Get(r.Context(), 6) },
+			"retention": func() (err error) {
+				period := "day"
+				if end.Sub(start) > 31*day {
+					period = "week"
+				}
+				return data.retention.Get(r.Context(), start, end, period)
+			},
+			"engagement": func() (err error) {
+				return data.engagement.List(r.Context(), start, end, filter, 6)
+			},
+			"entries": func() (err error) { return data.entries.ListEntries(r.Context(), start, end, 6) },
+			"exits":   func() (err error) { return data.exits.ListExits(r.Context(), start, end, 6) },
+		}
+		data.dimensions = make([]goatcounter.Stats, len(site.Settings.Dimensions))
+		for i, d := range site.Settings.Dimensions {
+			i, d := i, d
+			widgetData["dimension-"+d.Name] = func() (err error) {
+				return data.dimensions[i].ListDimension(r.Context(), d.Name, start, end, filter, 6, 0)
+			}
 		}
 
 		var (
@@ -232,15 +358,23 @@ func (h backend) dashboard(w http.ResponseWriter, r *http.Request) error {
 			},
 			"totalpages": func() (string, string, interface{}) {
 				return "full-width", "_dashboard_totals.gohtml", struct {
-					Context         context.Context
-					Site            *goatcounter.Site
-					Page            goatcounter.HitStat
-					Daily           bool
-					Max             int
-					TotalHits       int
-					TotalUniqueHits int
+					Context             context.Context
+					Site                *goatcounter.Site
+					Page                goatcounter.HitStat
+					Daily               bool
+					Max                 int
+					TotalHits           int
+					TotalUniqueHits     int
+					PrevTotalHits       int
+					PrevTotalUniqueHits int
+					Change              string
+					ChangeUnique        string
+					Annotations         goatcounter.Annotations
 				}{r.Context(), site, data.totalPages.total, daily, data.totalPages.max,
-					data.total, data.totalUnique}
+					data.total, data.totalUnique, data.prevTotal, data.prevTotalUnique,
+					changeText(compare, data.total, data.prevTotal),
+					changeText(compare, data.totalUnique, data.prevTotalUnique),
+					data.totalPages.annotations}
 			},
 			"toprefs": func() (string, string, interface{}) {
 				return "hchart", "_dashboard_toprefs.gohtml", struct {
@@ -275,8 +409,69 @@ func (h backend) dashboard(w http.ResponseWriter, r *http.Request) error {
 					Context         context.Context
 					TotalUniqueHits int
 					Stats           goatcounter.Stats
-				}{r.Context(), data.allTotalUnique, data.locStat}
+					Regions         bool
+				}{r.Context(), data.allTotalUnique, data.locStat, site.Settings.Cities || geoHasRegions()}
 			},
+			"languages": func() (string, string, interface{}) {
+				return "hchart", "_dashboard_languages.gohtml", struct {
+					Context         context.Context
+					TotalUniqueHits int
+					Stats           goatcounter.Stats
+				}{r.Context(), data.allTotalUnique, data.langStat}
+			},
+		}
+		render["live"] = func() (string, string, interface{}) {
+			return "hchart", "_dashboard_live.gohtml", struct {
+				Context context.Context
+				Site    *goatcounter.Site
+				Live    goatcounter.LiveStats
+			}{r.Context(), site, data.live}
+		}
+
+		render["retention"] = func() (string, string, interface{}) {
+			return "full-width", "_dashboard_retention.gohtml", struct {
+				Context   context.Context
+				Site      *goatcounter.Site
+				Retention goatcounter.Retention
+			}{r.Context(), site, data.retention}
+		}
+
+		render["entries"] = func() (string, string, interface{}) {
+			return "hchart", "_dashboard_entryexit.gohtml", struct {
+				Context context.Context
+				Site    *goatcounter.Site
+				Title   string
+				List    goatcounter.EntryExits
+			}{r.Context(), site, "Entry pages", data.entries}
+		}
+		render["exits"] = func() (string, string, interface{}) {
+			return "hchart", "_dashboard_entryexit.gohtml", struct {
+				Context context.Context
+				Site    *goatcounter.Site
+				Title   string
+				List    goatcounter.EntryExits
+			}{r.Context(), site, "Exit pages", data.exits}
+		}
+
+		// Most sites don't send pings, so only display it if there's data.
+		if len(data.engagement) > 0 {
+			render["engagement"] = func() (string, string, interface{}) {
+				return "hchart", "_dashboard_engagement.gohtml", struct {
+					Context    context.Context
+					Engagement goatcounter.Engagements
+				}{r.Context(), data.engagement}
+			}
+		}
+		for i, d := range site.Settings.Dimensions {
+			i, d := i, d
+			render["dimension-"+d.Name] = func() (string, string, interface{}) {
+				return "hchart", "_dashboard_dimension.gohtml", struct {
+					Context         context.Context
+					TotalUniqueHits int
+					Name            string
+					Stats           goatcounter.Stats
+				}{r.Context(), data.allTotalUnique, d.Name, data.dimensions[i]}
+			}
 		}
 
 		var (
@@ -328,7 +523,13 @@ func (h backend) dashboard(w http.ResponseWriter, r *http.Request) error {
 		return err
 	}
 
+	// hl-period is only sent if one of the period buttons was used, in which
+	// case we can save it as a relative period.
 	hlPeriod := r.URL.Query().Get("hl-period")
+	var relPeriod string
+	if zstring.Contains(goatcounter.SegmentPeriods, hlPeriod) {
+		relPeriod = hlPeriod
+	}
 	if hlPeriod == "" {
 		hlPeriod = "week"
 	}
@@ -344,9 +545,61 @@ func (h backend) dashboard(w http.ResponseWriter, r *http.Request) error {
 		Filter         string
 		Daily          bool
 		ForcedDaily    bool
+		Compare        string
+		Segments       goatcounter.Segments
+		Segment        string
+		RelPeriod      string
 		Widgets        []widget
 	}{newGlobals(w, r),
 		cd, subs, showRefs, hlPeriod, start, end, filter, daily, forcedDaily,
-		widgets.w,
+		compare, segments, segment, relPeriod, widgets.w,
 	})
 }
+
+// applySegment sets the query parameters from the saved segment; parameters
+// that are already set take precedence.
+func applySegment(r *http.Request, site *goatcounter.Site, name string) error {
+	var s goatcounter.Segment
+	err := s.ByName(r.Context(), name)
+	if err != nil {
+		if zdb.ErrNoRows(err) {
+			return guru.Errorf(404, "no saved view %q", name)
+		}
+		return err
+	}
+
+	loc := site.Settings.Timezone.Loc()
+	start, end := s.Range(goatcounter.Now(), loc)
+	set := map[string]string{
+		"period-start": start.In(loc).Format("2006-01-02"),
+		"period-end":   end.In(loc).Format("2006-01-02"),
+		"hl-period":    s.Period,
+		"filter":       s.Filter,
+		"compare":      s.Compare,
+	}
+	if s.Daily {
+		set["daily"] = "on"
+	}
+
+	q := r.URL.Query()
+	for k, v := range set {
+		if v != "" && q.Get(k) == "" {
+			q.Set(k, v)
+		}
+	}
+	r.URL.RawQuery = q.Encode()
+	return nil
+}
+
+// Format the percentage change from prev to cur as "+12.3%", or an empty
+// string if there is nothing to compare with.
+func changeText(compare string, cur, prev int) string {
+	if compare == "" {
+		return ""
+	}
+	c := goatcounter.Change(cur, prev)
+	if c == nil {
+		return ""
+	}
+	return fmt.Sprintf("%+.1f%%", *c)
+}
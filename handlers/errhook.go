@@ -0,0 +1,111 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"zgo.at/zhttp"
+	"zgo.at/zlog"
+)
+
+// ErrorHook is called on panics and 5xx errors, for example to send them to an
+// external error reporting service.
+//
+// The request context has the site and user if they were loaded before the
+// error; use goatcounter.GetSite() and goatcounter.GetUser().
+type ErrorHook interface {
+	ReportError(r *http.Request, code int, err error)
+}
+
+// ErrorHookFunc is an ErrorHook for a function.
+type ErrorHookFunc func(r *http.Request, code int, err error)
+
+func (f ErrorHookFunc) ReportError(r *http.Request, code int, err error) { f(r, code, err) }
+
+var (
+	errorHooksMu sync.RWMutex
+	errorHooks   []ErrorHook
+)
+
+// RegisterErrorHook adds a hook to call on panics and 5xx errors.
+func RegisterErrorHook(h ErrorHook) {
+	errorHooksMu.Lock()
+	defer errorHooksMu.Unlock()
+	errorHooks = append(errorHooks, h)
+}
+
+type ctxkey int
+
+const (
+	keyReported ctxkey = iota
+	keyAccessLog
+)
+
+// reportError calls all the error hooks, unless it's already been reported for
+// this request.
+func reportError(r *http.Request, code int, err error) {
+	if rep, ok := r.Context().Value(keyReported).(*bool); ok {
+		if *rep {
+			return
+		}
+		*rep = true
+	}
+
+	errorHooksMu.RLock()
+	hooks := errorHooks
+	errorHooksMu.RUnlock()
+	for _, h := range hooks {
+		func() {
+			defer zlog.Recover()
+			h.ReportError(r, code, err)
+		}()
+	}
+}
+
+// reportOnce makes sure errors are only reported once per request; this needs to
+// be before zhttp.Unpanic(), which calls ErrPage for panics that reportPanics
+// already reported.
+func reportOnce(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), keyReported, new(bool))))
+	})
+}
+
+// reportPanics calls the error hooks on panics, and re-panics so that
+// zhttp.Unpanic() can deal with it as usual.
+//
+// This needs to be after addctx, so the hooks get the request context with the
+// site and user.
+func reportPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			rec := recover()
+			if rec == nil {
+				return
+			}
+			err, ok := rec.(error)
+			if !ok {
+				err = fmt.Errorf("panic: %v", rec)
+			}
+			reportError(r, 500, err)
+			panic(rec)
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+func init() {
+	errPage := zhttp.ErrPage
+	zhttp.ErrPage = func(w http.ResponseWriter, r *http.Request, code int, reported error) {
+		if code >= 500 && reported != nil {
+			reportError(r, code, reported)
+		}
+		errPage(w, r, code, reported)
+	}
+}
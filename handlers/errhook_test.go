@@ -0,0 +1,56 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"zgo.at/guru"
+	"zgo.at/zhttp"
+)
+
+func TestErrorHook(t *testing.T) {
+	var reported []int
+	RegisterErrorHook(ErrorHookFunc(func(r *http.Request, code int, err error) {
+		reported = append(reported, code)
+	}))
+	defer func() {
+		errorHooksMu.Lock()
+		errorHooks = nil
+		errorHooksMu.Unlock()
+	}()
+
+	tests := []struct {
+		name string
+		h    http.Handler
+		want []int
+	}{
+		{"ok", zhttp.Wrap(func(w http.ResponseWriter, r *http.Request) error {
+			return zhttp.String(w, "ok")
+		}), nil},
+		{"4xx", zhttp.Wrap(func(w http.ResponseWriter, r *http.Request) error {
+			return guru.New(400, "oops")
+		}), nil},
+		{"5xx", zhttp.Wrap(func(w http.ResponseWriter, r *http.Request) error {
+			return errors.New("oops")
+		}), []int{500}},
+		{"panic", zhttp.Unpanic(true)(reportPanics(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			panic("oh noes")
+		}))), []int{500}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reported = nil
+			reportOnce(tt.h).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+			if len(reported) != len(tt.want) || (len(reported) > 0 && reported[0] != tt.want[0]) {
+				t.Errorf("want: %v; have: %v", tt.want, reported)
+			}
+		})
+	}
+}
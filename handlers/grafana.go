@@ -0,0 +1,212 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package handlers
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"zgo.at/goatcounter"
+	"zgo.at/guru"
+	"zgo.at/zhttp"
+	"zgo.at/zstd/zstring"
+)
+
+// The Grafana JSON datasource endpoints; set the URL of the datasource to
+// https://[my-site]/api/v0/grafana and add the Authorization header with an API
+// token.
+//
+// The targets are "pageviews" or "visitors" for the totals, or "pageviews by
+// path", "visitors by country", etc. for the top 10 paths, referrers, or
+// countries.
+
+// grafanaTargets are all the targets for the search endpoint.
+var grafanaTargets = func() []string {
+	var t []string
+	for _, m := range goatcounter.TimeseriesMetrics {
+		t = append(t, m)
+		for _, g := range goatcounter.TimeseriesGroups {
+			t = append(t, m+" by "+g)
+		}
+	}
+	return t
+}()
+
+type grafanaRange struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+}
+
+type grafanaQueryRequest struct {
+	Range      grafanaRange `json:"range"`
+	IntervalMS int64        `json:"intervalMs"`
+	Targets    []struct {
+		Target string `json:"target"`
+		RefID  string `json:"refId"`
+	} `json:"targets"`
+}
+
+type grafanaSeries struct {
+	Target     string     `json:"target"`
+	Datapoints [][2]int64 `json:"datapoints"` // [value, unix time in ms]
+}
+
+type grafanaAnnotationRequest struct {
+	Range      grafanaRange           `json:"range"`
+	Annotation map[string]interface{} `json:"annotation"`
+}
+
+type grafanaAnnotation struct {
+	Annotation map[string]interface{} `json:"annotation"`
+	Time       int64                  `json:"time"`
+	Title      string                 `json:"title"`
+	Text       string                 `json:"text"`
+}
+
+// GET /api/v0/grafana stats
+// Test the Grafana datasource connection.
+//
+// Response 200: {empty}
+func (h api) grafanaTest(w http.ResponseWriter, r *http.Request) error {
+	err := h.auth(r, goatcounter.PermStats)
+	if err != nil {
+		return err
+	}
+	return zhttp.String(w, "ok")
+}
+
+// POST /api/v0/grafana/search stats
+// List the targets for the Grafana datasource.
+//
+// Response 200: []string
+func (h api) grafanaSearch(w http.ResponseWriter, r *http.Request) error {
+	err := h.auth(r, goatcounter.PermStats)
+	if err != nil {
+		return err
+	}
+	return zhttp.JSON(w, grafanaTargets)
+}
+
+// POST /api/v0/grafana/query stats
+// Get timeseries for the Grafana datasource.
+//
+// The granularity is based on the interval Grafana asks for, but it's never
+// smaller than an hour.
+//
+// Request body: grafanaQueryRequest
+// Response 200: []grafanaSeries
+func (h api) grafanaQuery(w http.ResponseWriter, r *http.Request) error {
+	err := h.auth(r, goatcounter.PermStats)
+	if err != nil {
+		return err
+	}
+
+	var req grafanaQueryRequest
+	_, err = zhttp.Decode(r, &req)
+	if err != nil {
+		return err
+	}
+
+	start, end := req.Range.From.UTC(), req.Range.To.UTC()
+	granularity := grafanaGranularity(start, end, time.Duration(req.IntervalMS)*time.Millisecond)
+
+	series := []grafanaSeries{}
+	for _, t := range req.Targets {
+		metric, group := t.Target, ""
+		if i := strings.Index(t.Target, " by "); i > -1 {
+			metric, group = t.Target[:i], t.Target[i+4:]
+		}
+		if !zstring.Contains(grafanaTargets, t.Target) {
+			return guru.Errorf(400, "unknown target %q; valid targets are: %s",
+				t.Target, strings.Join(grafanaTargets, ", "))
+		}
+
+		g := granularity
+		if group == "country" && g == "hour" {
+			g = "day"
+		}
+
+		var ts goatcounter.Timeseries
+		if group == "" {
+			err = ts.GetTotal(r.Context(), metric, g, start, end)
+		} else {
+			err = ts.Get(r.Context(), metric, group, g, start, end, 10)
+		}
+		if err != nil {
+			return err
+		}
+
+		f := map[string]string{"hour": "2006-01-02 15:00", "day": "2006-01-02", "month": "2006-01"}[g]
+		for _, s := range ts.Series {
+			gs := grafanaSeries{Target: s.Name, Datapoints: make([][2]int64, 0, len(s.Values))}
+			if group == "" {
+				gs.Target = metric
+			}
+			for i, v := range s.Values {
+				b, err := time.Parse(f, ts.Buckets[i])
+				if err != nil {
+					return err
+				}
+				gs.Datapoints = append(gs.Datapoints, [2]int64{int64(v), b.UnixNano() / 1e6})
+			}
+			series = append(series, gs)
+		}
+	}
+	return zhttp.JSON(w, series)
+}
+
+// grafanaGranularity gets the timeseries granularity for the interval, using a
+// larger one if there would be too many buckets.
+func grafanaGranularity(start, end time.Time, interval time.Duration) string {
+	switch {
+	case interval < 24*time.Hour && end.Sub(start) < goatcounter.MaxTimeseriesBuckets*time.Hour:
+		return "hour"
+	case interval < 28*24*time.Hour && end.Sub(start) < goatcounter.MaxTimeseriesBuckets*24*time.Hour:
+		return "day"
+	default:
+		return "month"
+	}
+}
+
+// POST /api/v0/grafana/annotations stats
+// Get annotations for the Grafana datasource.
+//
+// Request body: grafanaAnnotationRequest
+// Response 200: []grafanaAnnotation
+func (h api) grafanaAnnotations(w http.ResponseWriter, r *http.Request) error {
+	err := h.auth(r, goatcounter.PermStats)
+	if err != nil {
+		return err
+	}
+
+	var req grafanaAnnotationRequest
+	_, err = zhttp.Decode(r, &req)
+	if err != nil {
+		return err
+	}
+
+	var a goatcounter.Annotations
+	err = a.ListRange(r.Context(), req.Range.From, req.Range.To)
+	if err != nil {
+		return err
+	}
+
+	loc := goatcounter.MustGetSite(r.Context()).Settings.Timezone.Loc()
+	anns := make([]grafanaAnnotation, 0, len(a))
+	for _, aa := range a {
+		day, err := time.ParseInLocation("2006-01-02", aa.Day, loc)
+		if err != nil {
+			return err
+		}
+		anns = append(anns, grafanaAnnotation{
+			Annotation: req.Annotation,
+			Time:       day.UnixNano() / 1e6,
+			Title:      aa.Text,
+			Text:       aa.Text,
+		})
+	}
+	return zhttp.JSON(w, anns)
+}
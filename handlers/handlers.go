@@ -33,6 +33,7 @@ type Globals struct {
 	GoatcounterCom bool
 	Dev            bool
 	Port           string
+	OIDC           bool
 }
 
 func newGlobals(w http.ResponseWriter, r *http.Request) Globals {
@@ -49,6 +50,7 @@ func newGlobals(w http.ResponseWriter, r *http.Request) Globals {
 		GoatcounterCom: cfg.GoatcounterCom,
 		Dev:            !cfg.Prod,
 		Port:           cfg.Port,
+		OIDC:           oidcEnabled(),
 	}
 	if g.User == nil {
 		g.User = &goatcounter.User{}
@@ -86,9 +88,12 @@ func NewStatic(r chi.Router, dir string, prod bool) chi.Router {
 	return r
 }
 
-func NewBackend(db zdb.DB, acmeh http.HandlerFunc) chi.Router {
+// NewBackend creates a new router for the backend.
+//
+// Queries for the dashboard and statistics are sent to replica if it's not nil.
+func NewBackend(db, replica zdb.DB, acmeh http.HandlerFunc) chi.Router {
 	r := chi.NewRouter()
-	backend{}.Mount(r, db)
+	backend{}.Mount(r, db, replica)
 
 	if acmeh != nil {
 		r.Get("/.well-known/acme-challenge/{key}", acmeh)
@@ -0,0 +1,91 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"zgo.at/goatcounter"
+	"zgo.at/zdb"
+	"zgo.at/zlog"
+	"zgo.at/zstd/zsync"
+)
+
+// MaxBacklog is the number of pageviews in the memstore above which /readyz
+// reports the server as not ready, as it means that persisting to the database
+// isn't keeping up.
+var MaxBacklog = 100000
+
+var shuttingDown = zsync.NewAtomicInt(0)
+
+// ShuttingDown makes /readyz report that the server isn't ready, so that load
+// balancers stop sending new requests while it shuts down.
+func ShuttingDown() {
+	shuttingDown.Set(1)
+}
+
+// Health adds the unauthenticated /healthz and /readyz endpoints for load
+// balancers and the like. These are served for any host, as health checks
+// usually connect to the IP address.
+//
+// /healthz always returns 200 as long as the process is serving requests;
+// /readyz returns 503 if the database isn't reachable, there are more than
+// MaxBacklog pageviews waiting to be persisted, or the server is shutting down.
+func Health(db zdb.DB, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		switch r.URL.Path {
+		default:
+			next.ServeHTTP(w, r)
+		case "/healthz":
+			w.Header().Set("Cache-Control", "no-store")
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.Write([]byte("ok\n"))
+		case "/readyz":
+			w.Header().Set("Cache-Control", "no-store")
+			readyz(w, r, db)
+		}
+	})
+}
+
+func readyz(w http.ResponseWriter, r *http.Request, db zdb.DB) {
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+
+	var (
+		ready   = true
+		dbState = "ok"
+		backlog = goatcounter.Memstore.Len()
+	)
+	if _, err := db.ExecContext(ctx, `select 1`); err != nil {
+		// Don't show the error to unauthenticated callers.
+		zlog.Module("readyz").Error(err)
+		ready, dbState = false, "error"
+	}
+	if backlog > MaxBacklog {
+		ready = false
+	}
+	if shuttingDown.Value() == 1 {
+		ready, dbState = false, "shutting down"
+	}
+
+	j, _ := json.Marshal(map[string]interface{}{
+		"ready":   ready,
+		"db":      dbState,
+		"backlog": backlog,
+	})
+	w.Header().Set("Content-Type", "application/json")
+	if !ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	w.Write(j)
+}
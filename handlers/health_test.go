@@ -0,0 +1,72 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"zgo.at/goatcounter"
+	"zgo.at/goatcounter/gctest"
+	"zgo.at/zdb"
+	"zgo.at/ztest"
+)
+
+func TestHealth(t *testing.T) {
+	ctx, clean := gctest.DB(t)
+	defer clean()
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+	h := Health(zdb.MustGet(ctx), next)
+
+	do := func(path string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", path, nil)
+		r.Host = "10.0.0.1:8080"
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, r)
+		return rr
+	}
+
+	rr := do("/healthz")
+	ztest.Code(t, rr, 200)
+	if b := rr.Body.String(); b != "ok\n" {
+		t.Errorf("body: %q", b)
+	}
+
+	rr = do("/readyz")
+	ztest.Code(t, rr, 200)
+	if b := rr.Body.String(); !strings.Contains(b, `"ready":true`) {
+		t.Errorf("body: %q", b)
+	}
+
+	rr = do("/other")
+	ztest.Code(t, rr, http.StatusTeapot)
+
+	ShuttingDown()
+	rr = do("/readyz")
+	ztest.Code(t, rr, 503)
+	if b := rr.Body.String(); !strings.Contains(b, `"db":"shutting down"`) {
+		t.Errorf("body: %q", b)
+	}
+	shuttingDown.Set(0)
+
+	defer func(n int) { MaxBacklog = n }(MaxBacklog)
+	MaxBacklog = 1
+	ctx, site := gctest.Site(ctx, t, goatcounter.Site{})
+	goatcounter.Memstore.Append(
+		goatcounter.Hit{Site: site.ID, Path: "/a"},
+		goatcounter.Hit{Site: site.ID, Path: "/b"})
+	defer goatcounter.Memstore.Persist(ctx)
+
+	rr = do("/readyz")
+	ztest.Code(t, rr, 503)
+	if b := rr.Body.String(); !strings.Contains(b, `"ready":false`) || !strings.Contains(b, `"backlog":2`) {
+		t.Errorf("body: %q", b)
+	}
+}
@@ -52,7 +52,7 @@ func init() {
 	pack.Templates = nil
 	pack.Public = nil
 	zhttp.InitTpl(nil)
-	ztest.DefaultHost = "test.example.com"
+	ztest.DefaultHost = "gctest.example.com"
 	cfg.Domain = "example.com"
 	cfg.GoatcounterCom = true
 	if zstring.Contains(os.Args, "-test.v=true") {
@@ -154,6 +154,13 @@ func login(t *testing.T, r *http.Request) {
 		t.Fatal("u.LoginToken is nil? Should never happen!")
 	}
 
+	s := goatcounter.UserSession{UserID: u.ID}
+	err = s.Insert(r.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.Session = &s
+
 	// Set CSRF token.
 	// TODO: only works for form requests, which is okay as zhttp csrf checking
 	// only works for forms for now.
@@ -163,7 +170,7 @@ func login(t *testing.T, r *http.Request) {
 	}
 	r.Form.Set("csrf", *u.CSRFToken)
 
-	r.Header.Set("Cookie", "key="+*u.LoginToken)
+	r.Header.Set("Cookie", "key="+s.Token)
 }
 
 func newTest(ctx context.Context, method, path string, body io.Reader) (*http.Request, *httptest.ResponseRecorder) {
@@ -0,0 +1,241 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package handlers
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"zgo.at/errors"
+	"zgo.at/goatcounter"
+	"zgo.at/zdb"
+	"zgo.at/zhttp"
+	"zgo.at/zlog"
+)
+
+var ldapConf struct {
+	url          string
+	startTLS     bool
+	host         string
+	bindDN       string
+	bindPassword string
+	baseDN       string
+	filter       string
+	roles        []ldapRole
+}
+
+// ldapRole maps an LDAP group to a role; an empty role gives the user all
+// permissions.
+type ldapRole struct {
+	group string
+	role  string
+}
+
+// SetupLDAP allows signing in to the dashboard with an LDAP or Active Directory
+// server instead of the password stored in GoatCounter; an empty addr disables
+// it.
+//
+// The connection is always encrypted: ldap:// URLs use StartTLS, and ldaps://
+// URLs use TLS.
+//
+// The user is looked up with filter under baseDN, with %s replaced by what was
+// entered in the email field. The search is done with bindDN if it's set, or
+// anonymously otherwise.
+//
+// roles is a list of "group DN=role name" mappings separated by ";". If it's
+// set the user must be a member of one of the groups and gets the role of the
+// first group that matches; if it's not set the role isn't changed.
+func SetupLDAP(addr, bindDN, bindPassword, baseDN, filter, roles string) error {
+	ldapConf.url = ""
+	if addr == "" {
+		return nil
+	}
+
+	u, err := url.Parse(addr)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "ldap" && u.Scheme != "ldaps" {
+		return errors.New("must be a ldap:// or ldaps:// URL")
+	}
+	if baseDN == "" {
+		return errors.New("need a base DN")
+	}
+	if strings.Count(filter, "%s") != 1 {
+		return errors.New("filter must contain %s exactly once")
+	}
+	r, err := parseLDAPRoles(roles)
+	if err != nil {
+		return err
+	}
+
+	ldapConf.url = addr
+	ldapConf.startTLS, ldapConf.host = u.Scheme == "ldap", u.Hostname()
+	ldapConf.bindDN, ldapConf.bindPassword = bindDN, bindPassword
+	ldapConf.baseDN, ldapConf.filter = baseDN, filter
+	ldapConf.roles = r
+	return nil
+}
+
+func ldapEnabled() bool { return ldapConf.url != "" }
+
+func parseLDAPRoles(s string) ([]ldapRole, error) {
+	var roles []ldapRole
+	for _, m := range strings.Split(s, ";") {
+		m = strings.TrimSpace(m)
+		if m == "" {
+			continue
+		}
+		i := strings.LastIndexByte(m, '=')
+		if i == -1 {
+			return nil, fmt.Errorf("no role in %q; use \"group DN=role name\"", m)
+		}
+		g := strings.TrimSpace(m[:i])
+		if g == "" {
+			return nil, fmt.Errorf("no group in %q", m)
+		}
+		roles = append(roles, ldapRole{group: g, role: strings.TrimSpace(m[i+1:])})
+	}
+	return roles, nil
+}
+
+// matchLDAPRole gets the role for the first mapping that matches one of the
+// groups; ok is false if roles are configured and none match.
+func matchLDAPRole(roles []ldapRole, groups []string) (role string, ok bool) {
+	if len(roles) == 0 {
+		return "", true
+	}
+	for _, r := range roles {
+		for _, g := range groups {
+			if strings.EqualFold(r.group, g) {
+				return r.role, true
+			}
+		}
+	}
+	return "", false
+}
+
+var errLDAPCredentials = errors.New("invalid credentials")
+
+// ldapAuth verifies the login and password, and returns the email address and
+// groups of the user.
+func ldapAuth(login, password string) (string, []string, error) {
+	// An empty password is an "unauthenticated bind" which succeeds on many
+	// servers.
+	if login == "" || password == "" {
+		return "", nil, errLDAPCredentials
+	}
+
+	conn, err := ldap.DialURL(ldapConf.url)
+	if err != nil {
+		return "", nil, err
+	}
+	defer conn.Close()
+	conn.SetTimeout(10 * time.Second)
+
+	if ldapConf.startTLS {
+		err = conn.StartTLS(&tls.Config{ServerName: ldapConf.host})
+		if err != nil {
+			return "", nil, errors.Errorf("StartTLS: %w", err)
+		}
+	}
+
+	if ldapConf.bindDN != "" {
+		err = conn.Bind(ldapConf.bindDN, ldapConf.bindPassword)
+	} else {
+		err = conn.UnauthenticatedBind("")
+	}
+	if err != nil {
+		return "", nil, errors.Errorf("bind for search: %w", err)
+	}
+
+	res, err := conn.Search(ldap.NewSearchRequest(ldapConf.baseDN,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, 10, false,
+		fmt.Sprintf(ldapConf.filter, ldap.EscapeFilter(login)),
+		[]string{"mail", "memberOf"}, nil))
+	if err != nil {
+		return "", nil, errors.Errorf("search: %w", err)
+	}
+	if len(res.Entries) != 1 {
+		return "", nil, errLDAPCredentials
+	}
+	entry := res.Entries[0]
+
+	err = conn.Bind(entry.DN, password)
+	if err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return "", nil, errLDAPCredentials
+		}
+		return "", nil, err
+	}
+
+	return entry.GetAttributeValue("mail"), entry.GetAttributeValues("memberOf"), nil
+}
+
+func (h user) ldapLogin(w http.ResponseWriter, r *http.Request, site *goatcounter.Site, login, password string) error {
+	back := "/user/new?email=" + url.QueryEscape(login)
+
+	email, groups, err := ldapAuth(login, password)
+	if err != nil {
+		if errors.Is(err, errLDAPCredentials) {
+			zhttp.FlashError(w, "Wrong password for %q", login)
+		} else {
+			zhttp.FlashError(w, "Something went wrong :-( An error has been logged for investigation.")
+			zlog.Module("ldap").Error(err)
+		}
+		return zhttp.SeeOther(w, back)
+	}
+	if email == "" {
+		zhttp.FlashError(w, "The directory has no email address for %q.", login)
+		return zhttp.SeeOther(w, back)
+	}
+
+	roleName, ok := matchLDAPRole(ldapConf.roles, groups)
+	if !ok {
+		zhttp.FlashError(w, "%q doesn’t have access to this site.", login)
+		return zhttp.SeeOther(w, back)
+	}
+
+	user, err := externalUser(r.Context(), site, email)
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		zhttp.FlashError(w, "%q doesn’t have access to this site.", login)
+		return zhttp.SeeOther(w, back)
+	}
+
+	// Set the role from the directory on every login, so that changes to the
+	// groups are picked up. Roles set in GoatCounter are kept if there are no
+	// mappings.
+	if len(ldapConf.roles) > 0 {
+		var roleID *int64
+		if roleName != "" {
+			var role goatcounter.Role
+			err := role.ByName(r.Context(), roleName)
+			if err != nil {
+				if zdb.ErrNoRows(err) {
+					zhttp.FlashError(w, "The role %q doesn’t exist; ask the site owner to add it.", roleName)
+					return zhttp.SeeOther(w, back)
+				}
+				return err
+			}
+			roleID = &role.ID
+		}
+		err = user.UpdateRole(r.Context(), roleName == "", roleID)
+		if errors.Is(err, goatcounter.ErrLastSettingsUser) {
+			zlog.Module("ldap").Printf("not changing the role of %q: %s", email, err)
+		} else if err != nil {
+			return err
+		}
+	}
+
+	return h.finishLogin(w, r, site, user)
+}
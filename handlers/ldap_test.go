@@ -0,0 +1,72 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package handlers
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestSetupLDAP(t *testing.T) {
+	defer SetupLDAP("", "", "", "", "", "")
+
+	tests := []struct {
+		url, baseDN, filter, roles string
+		wantErr                    string
+	}{
+		{"", "", "", "", ""},
+		{"ldap://localhost", "dc=example", "(mail=%s)", "", ""},
+		{"ldaps://localhost", "dc=example", "(uid=%s)", "cn=admins,dc=example=; cn=viewers,dc=example=Viewer", ""},
+		{"http://localhost", "dc=example", "(mail=%s)", "", "must be a ldap:// or ldaps:// URL"},
+		{"ldap://localhost", "", "(mail=%s)", "", "need a base DN"},
+		{"ldap://localhost", "dc=example", "(mail=x)", "", "filter must contain %s exactly once"},
+		{"ldap://localhost", "dc=example", "(mail=%s)", "admins", `no role in "admins"`},
+		{"ldap://localhost", "dc=example", "(mail=%s)", "=Viewer", `no group in "=Viewer"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.url+tt.roles, func(t *testing.T) {
+			err := SetupLDAP(tt.url, "", "", tt.baseDN, tt.filter, tt.roles)
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("wrong error: %v", err)
+			}
+			if want := tt.url != "" && tt.wantErr == ""; ldapEnabled() != want {
+				t.Errorf("ldapEnabled() = %t", ldapEnabled())
+			}
+		})
+	}
+}
+
+func TestMatchLDAPRole(t *testing.T) {
+	roles, err := parseLDAPRoles("cn=admins,dc=example=;cn=viewers,dc=example=Viewer")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		roles  []ldapRole
+		groups []string
+		want   string
+	}{
+		{nil, nil, " true"},
+		{nil, []string{"cn=admins,dc=example"}, " true"},
+		{roles, nil, " false"},
+		{roles, []string{"cn=other,dc=example"}, " false"},
+		{roles, []string{"cn=viewers,dc=example"}, "Viewer true"},
+		{roles, []string{"CN=Viewers,DC=example"}, "Viewer true"},
+		{roles, []string{"cn=viewers,dc=example", "cn=admins,dc=example"}, " true"},
+	}
+
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("%d", i), func(t *testing.T) {
+			role, ok := matchLDAPRole(tt.roles, tt.groups)
+			got := fmt.Sprintf("%s %t", role, ok)
+			if got != tt.want {
+				t.Errorf("\ngot:  %q\nwant: %q", got, tt.want)
+			}
+		})
+	}
+}
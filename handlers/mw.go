@@ -6,11 +6,13 @@ package handlers
 
 import (
 	"context"
+	"net"
 	"net/http"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/go-chi/chi"
 	"zgo.at/errors"
 	"zgo.at/goatcounter"
 	"zgo.at/guru"
@@ -41,6 +43,16 @@ var (
 		return redirect(w, r)
 	})
 
+	// Logged in users need PermStats to view the statistics; anyone else can
+	// only get here if the site is public.
+	canStatsOrPublic = zhttp.Filter(func(w http.ResponseWriter, r *http.Request) error {
+		u := goatcounter.GetUser(r.Context())
+		if u == nil || u.ID == 0 {
+			return nil
+		}
+		return u.Can(r.Context(), goatcounter.PermStats)
+	})
+
 	noSubSites = zhttp.Filter(func(w http.ResponseWriter, r *http.Request) error {
 		if goatcounter.MustGetSite(r.Context()).Parent == nil ||
 			*goatcounter.MustGetSite(r.Context()).Parent == 0 {
@@ -57,6 +69,19 @@ var (
 		return guru.Errorf(404, "")
 	})
 
+	// Restrict the dashboard and API to the IP addresses from -dashboard-ips
+	// and the site's settings. This runs before keyAuth so that the login page
+	// isn't reachable either.
+	allowIPs = zhttp.Filter(func(w http.ResponseWriter, r *http.Request) error {
+		if len(dashboardIPs) > 0 && !goatcounter.MatchIPNet(r.RemoteAddr, dashboardIPs) {
+			return guru.New(403, "access to the dashboard isn't allowed from this IP address")
+		}
+		if !goatcounter.MustGetSite(r.Context()).Settings.AllowDashboard(r.RemoteAddr) {
+			return guru.New(403, "access to the dashboard isn't allowed from this IP address")
+		}
+		return nil
+	})
+
 	keyAuth = zhttp.Auth(func(ctx context.Context, key string) (zhttp.User, error) {
 		u := &goatcounter.User{}
 		err := u.ByTokenAndSite(ctx, key)
@@ -64,6 +89,85 @@ var (
 	})
 )
 
+var dashboardIPs []*net.IPNet
+
+// SetDashboardIPs restricts access to the dashboard and API of all sites to a
+// comma-separated list of IP addresses and CIDR ranges; an empty string allows
+// all addresses. The /count endpoint isn't affected.
+func SetDashboardIPs(list string) error {
+	nets, err := parseIPNets(list)
+	if err != nil {
+		return err
+	}
+	dashboardIPs = nets
+	return nil
+}
+
+var trustedProxies []*net.IPNet
+
+// SetTrustedProxies sets the comma-separated list of IP addresses and CIDR
+// ranges from which the X-Real-Ip and X-Forwarded-For headers are used; an
+// empty string ignores the headers from everyone.
+func SetTrustedProxies(list string) error {
+	nets, err := parseIPNets(list)
+	if err != nil {
+		return err
+	}
+	trustedProxies = nets
+	return nil
+}
+
+func parseIPNets(list string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range strings.Split(list, ",") {
+		if strings.TrimSpace(s) == "" {
+			continue
+		}
+		n, err := goatcounter.ParseIPNet(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// realIP sets the RemoteAddr to the client's address. The X-Real-Ip and
+// X-Forwarded-For headers can be set by anyone, so they're only used if the
+// connection is from one of the -trusted-proxies.
+//
+// For X-Forwarded-For this uses the last address that isn't a trusted proxy, as
+// the client can add anything it wants at the start.
+func realIP(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.RemoteAddr = zhttp.RemovePort(r.RemoteAddr)
+		if !goatcounter.MatchIPNet(r.RemoteAddr, trustedProxies) {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		if xrip := strings.TrimSpace(r.Header.Get("X-Real-Ip")); xrip != "" {
+			r.RemoteAddr = xrip
+		} else if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+			addrs := strings.Split(xff, ",")
+			for i := len(addrs) - 1; i >= 0; i-- {
+				r.RemoteAddr = strings.TrimSpace(addrs[i])
+				if !goatcounter.MatchIPNet(r.RemoteAddr, trustedProxies) {
+					break
+				}
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// Check if the logged in user has all the permissions.
+func can(perm ...goatcounter.Permission) func(http.Handler) http.Handler {
+	return zhttp.Filter(func(w http.ResponseWriter, r *http.Request) error {
+		return goatcounter.GetUser(r.Context()).Can(r.Context(), perm...)
+	})
+}
+
 // Allow debugging frontend timing issues by setting a "debug-delay" cookie.
 func delay() func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
@@ -78,13 +182,69 @@ func delay() func(http.Handler) http.Handler {
 	}
 }
 
-func addctx(db zdb.DB, loadSite bool) func(http.Handler) http.Handler {
+// traceRequests creates a span for every request, if tracing is enabled.
+func traceRequests(next http.Handler) http.Handler {
+	if !goatcounter.Tracing() {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, span := goatcounter.StartSpan(r.Context(), "HTTP "+r.Method)
+		*r = *r.WithContext(ctx)
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+
+		if sw.status == 0 {
+			sw.status = 200
+		}
+		span.SetAttribute("http.method", r.Method)
+		span.SetAttribute("http.target", r.URL.Path)
+		span.SetAttribute("http.status_code", sw.status)
+		if rctx := chi.RouteContext(r.Context()); rctx != nil {
+			span.SetAttribute("http.route", rctx.RoutePattern())
+		}
+		if site := goatcounter.GetSite(r.Context()); site != nil {
+			span.SetAttribute("goatcounter.site", site.ID)
+		}
+
+		var err error
+		if sw.status >= 500 {
+			err = errors.Errorf("HTTP %d", sw.status)
+		}
+		span.End(err)
+	})
+}
+
+// Send all queries to the read-only replica, if there is one. Only use this for
+// handlers that never write to the database.
+func readOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*r = *r.WithContext(zdb.With(r.Context(), goatcounter.Replica(r.Context())))
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Show the statistics in the user's timezone instead of the site's, if they set
+// one. This replaces the site in the context with a copy, so don't use this for
+// handlers that save the site.
+func userTimezone(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if u := goatcounter.GetUser(r.Context()); u != nil && u.Settings.Timezone != nil {
+			site := goatcounter.MustGetSite(r.Context()).WithUserTimezone(u.Settings.Timezone)
+			r = r.WithContext(goatcounter.WithSite(r.Context(), &site))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func addctx(db, replica zdb.DB, loadSite bool) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			setAccessLogRequest(r) // r is modified in-place below.
 			ctx := r.Context()
 
-			// Add timeout on non-admin pages.
-			if !strings.HasPrefix(r.URL.Path, "/admin") {
+			// Add timeout on non-admin pages; the stream is long-running by
+			// design.
+			if !strings.HasPrefix(r.URL.Path, "/admin") && r.URL.Path != "/api/v0/stats/stream" {
 				var cancel context.CancelFunc
 				ctx, cancel = context.WithTimeout(r.Context(), 5*time.Second)
 				defer func() {
@@ -97,6 +257,9 @@ func addctx(db zdb.DB, loadSite bool) func(http.Handler) http.Handler {
 
 			// Add database.
 			*r = *r.WithContext(zdb.With(ctx, db))
+			if replica != nil {
+				*r = *r.WithContext(goatcounter.WithReplica(r.Context(), replica))
+			}
 
 			// Load site from subdomain.
 			if loadSite {
@@ -0,0 +1,189 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-oidc"
+	"golang.org/x/oauth2"
+	"zgo.at/errors"
+	"zgo.at/goatcounter"
+	"zgo.at/guru"
+	"zgo.at/zdb"
+	"zgo.at/zhttp"
+)
+
+var oidcConf struct {
+	provider *oidc.Provider
+	verifier *oidc.IDTokenVerifier
+	clientID string
+	secret   string
+}
+
+// SetupOIDC allows signing in with an OpenID Connect provider; an empty issuer
+// disables it.
+//
+// This fetches the provider's configuration from the issuer URL.
+func SetupOIDC(issuer, clientID, secret string) error {
+	oidcConf.provider, oidcConf.verifier = nil, nil
+	if issuer == "" {
+		return nil
+	}
+	if clientID == "" || secret == "" {
+		return errors.New("need a client ID and secret")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	p, err := oidc.NewProvider(ctx, issuer)
+	if err != nil {
+		return err
+	}
+
+	oidcConf.provider = p
+	oidcConf.verifier = p.Verifier(&oidc.Config{ClientID: clientID})
+	oidcConf.clientID, oidcConf.secret = clientID, secret
+	return nil
+}
+
+func oidcEnabled() bool { return oidcConf.provider != nil }
+
+func oidcOAuth(site *goatcounter.Site) *oauth2.Config {
+	return &oauth2.Config{
+		ClientID:     oidcConf.clientID,
+		ClientSecret: oidcConf.secret,
+		Endpoint:     oidcConf.provider.Endpoint(),
+		RedirectURL:  site.URL() + "/user/oidc/callback",
+		Scopes:       []string{oidc.ScopeOpenID, "email"},
+	}
+}
+
+const oidcCookie = "oidc-state"
+
+func (h user) oidcLogin(w http.ResponseWriter, r *http.Request) error {
+	if !oidcEnabled() {
+		return guru.New(404, "OpenID Connect is not enabled")
+	}
+	if u := goatcounter.GetUser(r.Context()); u != nil && u.ID > 0 {
+		return zhttp.SeeOther(w, "/")
+	}
+
+	state, nonce := zhttp.Secret128(), zhttp.Secret128()
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcCookie,
+		Value:    state + "." + nonce,
+		Path:     "/user/oidc",
+		MaxAge:   600,
+		HttpOnly: true,
+		Secure:   zhttp.CookieSecure,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	site := goatcounter.MustGetSite(r.Context())
+	return zhttp.SeeOther(w, oidcOAuth(site).AuthCodeURL(state, oidc.Nonce(nonce)))
+}
+
+func (h user) oidcCallback(w http.ResponseWriter, r *http.Request) error {
+	if !oidcEnabled() {
+		return guru.New(404, "OpenID Connect is not enabled")
+	}
+
+	c, err := r.Cookie(oidcCookie)
+	if err != nil {
+		return guru.New(400, "no state cookie; try again")
+	}
+	http.SetCookie(w, &http.Cookie{Name: oidcCookie, Path: "/user/oidc", MaxAge: -1})
+
+	state, nonce := c.Value, ""
+	if i := strings.IndexByte(c.Value, '.'); i > -1 {
+		state, nonce = c.Value[:i], c.Value[i+1:]
+	}
+	if r.URL.Query().Get("state") != state {
+		return guru.New(400, "state doesn't match; try again")
+	}
+	if e := r.URL.Query().Get("error"); e != "" {
+		zhttp.FlashError(w, "Could not sign in: %s %s", e, r.URL.Query().Get("error_description"))
+		return zhttp.SeeOther(w, "/user/new")
+	}
+
+	site := goatcounter.MustGetSite(r.Context())
+	tok, err := oidcOAuth(site).Exchange(r.Context(), r.URL.Query().Get("code"))
+	if err != nil {
+		return guru.Errorf(400, "could not get the token: %s", err)
+	}
+	raw, ok := tok.Extra("id_token").(string)
+	if !ok {
+		return guru.New(400, "no id_token in the response")
+	}
+	idt, err := oidcConf.verifier.Verify(r.Context(), raw)
+	if err != nil {
+		return guru.Errorf(400, "invalid id_token: %s", err)
+	}
+	if idt.Nonce != nonce {
+		return guru.New(400, "nonce doesn't match; try again")
+	}
+
+	var claims struct {
+		Email         string `json:"email"`
+		EmailVerified *bool  `json:"email_verified"`
+	}
+	err = idt.Claims(&claims)
+	if err != nil {
+		return err
+	}
+	// Don't trust addresses that the provider didn't verify; anyone could
+	// otherwise create an account there with the site's email address.
+	if claims.Email == "" || claims.EmailVerified == nil || !*claims.EmailVerified {
+		zhttp.FlashError(w, "The provider didn’t send a verified email address.")
+		return zhttp.SeeOther(w, "/user/new")
+	}
+
+	user, err := externalUser(r.Context(), site, claims.Email)
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		zhttp.FlashError(w, "%q doesn’t have access to this site.", claims.Email)
+		return zhttp.SeeOther(w, "/user/new")
+	}
+
+	return h.finishLogin(w, r, site, user)
+}
+
+// externalUser gets the user for an email address verified by an external
+// provider (OpenID Connect or LDAP), or nil if the email doesn't match the
+// site's user. A new user is created if the site doesn't have one yet.
+func externalUser(ctx context.Context, site *goatcounter.Site, email string) (*goatcounter.User, error) {
+	var user goatcounter.User
+	err := user.BySite(ctx, site.IDOrParent())
+	if err == nil {
+		if !strings.EqualFold(user.Email, email) {
+			return nil, nil
+		}
+		return &user, nil
+	}
+	if !zdb.ErrNoRows(err) {
+		return nil, err
+	}
+
+	// The password is never used, but it's required; "forgot password" can
+	// be used to set one.
+	user = goatcounter.User{
+		Site:          site.IDOrParent(),
+		Email:         email,
+		EmailVerified: true,
+		Owner:         true,
+		Password:      []byte(zhttp.Secret128()),
+	}
+	err = user.Insert(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
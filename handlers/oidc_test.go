@@ -0,0 +1,113 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"zgo.at/goatcounter"
+	"zgo.at/goatcounter/gctest"
+	"zgo.at/zdb"
+	"zgo.at/ztest"
+)
+
+func TestOIDCLogin(t *testing.T) {
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{
+			"issuer":                 %[1]q,
+			"authorization_endpoint": "%[1]s/auth",
+			"token_endpoint":         "%[1]s/token",
+			"jwks_uri":               "%[1]s/keys"
+		}`, srv.URL)
+	}))
+	defer srv.Close()
+
+	ctx, clean := gctest.DB(t)
+	defer clean()
+
+	t.Run("disabled", func(t *testing.T) {
+		r, rr := newTest(ctx, "GET", "/user/oidc", nil)
+		newBackend(zdb.MustGet(ctx)).ServeHTTP(rr, r)
+		ztest.Code(t, rr, 404)
+	})
+
+	err := SetupOIDC(srv.URL, "client", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer SetupOIDC("", "", "")
+
+	r, rr := newTest(ctx, "GET", "/user/oidc", nil)
+	newBackend(zdb.MustGet(ctx)).ServeHTTP(rr, r)
+	ztest.Code(t, rr, 303)
+
+	loc, err := url.Parse(rr.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := loc.Query()
+	if loc.Path != "/auth" || q.Get("client_id") != "client" || q.Get("state") == "" || q.Get("nonce") == "" {
+		t.Errorf("wrong redirect: %s", loc)
+	}
+
+	var cookie *http.Cookie
+	for _, c := range rr.Result().Cookies() {
+		if c.Name == oidcCookie {
+			cookie = c
+		}
+	}
+	if cookie == nil || cookie.Value != q.Get("state")+"."+q.Get("nonce") {
+		t.Errorf("wrong cookie: %v", cookie)
+	}
+
+	// Wrong state.
+	r, rr = newTest(ctx, "GET", "/user/oidc/callback?state=x&code=y", nil)
+	r.AddCookie(cookie)
+	newBackend(zdb.MustGet(ctx)).ServeHTTP(rr, r)
+	ztest.Code(t, rr, 400)
+}
+
+func TestExternalUser(t *testing.T) {
+	ctx, clean := gctest.DB(t)
+	defer clean()
+
+	site := goatcounter.MustGetSite(ctx)
+	have := goatcounter.GetUser(ctx)
+
+	u, err := externalUser(ctx, site, "other@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u != nil {
+		t.Errorf("got user for wrong email: %v", u)
+	}
+
+	u, err = externalUser(ctx, site, have.Email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u == nil || u.ID != have.ID {
+		t.Errorf("wrong user: %v", u)
+	}
+
+	// Create user for a site without one.
+	s := goatcounter.Site{Code: "oidc", Plan: goatcounter.PlanPersonal}
+	err = s.Insert(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err = externalUser(goatcounter.WithSite(ctx, &s), &s, "new@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u == nil || u.ID == 0 || u.Site != s.ID || !u.EmailVerified {
+		t.Errorf("wrong user: %v", u)
+	}
+}
@@ -5,6 +5,7 @@
 package handlers
 
 import (
+	"context"
 	"crypto/sha1"
 	"errors"
 	"fmt"
@@ -24,6 +25,7 @@ import (
 	"zgo.at/goatcounter/bgrun"
 	"zgo.at/goatcounter/cfg"
 	"zgo.at/guru"
+	"zgo.at/tz"
 	"zgo.at/zdb"
 	"zgo.at/zhttp"
 	"zgo.at/zlog"
@@ -53,15 +55,25 @@ func (h user) mount(r chi.Router) {
 	rate.Get("/user/reset/{key}", zhttp.Wrap(h.reset))
 	rate.Get("/user/verify/{key}", zhttp.Wrap(h.verify))
 	rate.Post("/user/reset/{key}", zhttp.Wrap(h.doReset))
+	rate.Get("/user/oidc", zhttp.Wrap(h.oidcLogin))
+	rate.Get("/user/oidc/callback", zhttp.Wrap(h.oidcCallback))
 
 	auth := r.With(loggedIn)
 	auth.Post("/user/logout", zhttp.Wrap(h.logout))
 	auth.Post("/user/change-password", zhttp.Wrap(h.changePassword))
+	auth.Post("/user/timezone", zhttp.Wrap(h.timezone))
 	auth.Post("/user/disable-totp", zhttp.Wrap(h.disableTOTP))
 	auth.Post("/user/enable-totp", zhttp.Wrap(h.enableTOTP))
 	auth.Post("/user/resend-verify", zhttp.Wrap(h.resendVerify))
-	auth.Post("/user/api-token", zhttp.Wrap(h.newAPIToken))
-	auth.Post("/user/api-token/remove/{id}", zhttp.Wrap(h.deleteAPIToken))
+	auth.Post("/user/session/{id}/delete", zhttp.Wrap(h.deleteSession))
+	auth.Post("/user/session/delete-others", zhttp.Wrap(h.deleteOtherSessions))
+
+	perm := auth.With(can(goatcounter.PermSettings))
+	perm.Post("/user/api-token", zhttp.Wrap(h.newAPIToken))
+	perm.Post("/user/api-token/remove/{id}", zhttp.Wrap(h.deleteAPIToken))
+	perm.Post("/user/role", zhttp.Wrap(h.newRole))
+	perm.Post("/user/role/remove/{id}", zhttp.Wrap(h.deleteRole))
+	perm.Post("/user/role/assign/{id}", zhttp.Wrap(h.assignRole))
 }
 
 func (h user) new(w http.ResponseWriter, r *http.Request) error {
@@ -198,7 +210,10 @@ func (h user) totpLogin(w http.ResponseWriter, r *http.Request) error {
 		}{newGlobals(w, r), args.LoginMAC})
 	}
 
-	zhttp.SetCookie(w, *u.LoginToken, cookieDomain(site, r))
+	err = startSession(w, r, site, &u)
+	if err != nil {
+		return err
+	}
 	return zhttp.SeeOther(w, "/")
 }
 
@@ -210,17 +225,21 @@ func (h user) requestLogin(w http.ResponseWriter, r *http.Request) error {
 
 	site := goatcounter.MustGetSite(r.Context())
 
-	var user goatcounter.User
-	err := user.BySite(r.Context(), site.IDOrParent())
-	if err != nil {
-		return err
-	}
-
 	args := struct {
 		Email    string `json:"email"`
 		Password string `json:"password"`
 	}{}
-	_, err = zhttp.Decode(r, &args)
+	_, err := zhttp.Decode(r, &args)
+	if err != nil {
+		return err
+	}
+
+	if ldapEnabled() {
+		return h.ldapLogin(w, r, site, args.Email, args.Password)
+	}
+
+	var user goatcounter.User
+	err = user.BySite(r.Context(), site.IDOrParent())
 	if err != nil {
 		return err
 	}
@@ -248,19 +267,28 @@ func (h user) requestLogin(w http.ResponseWriter, r *http.Request) error {
 		return zhttp.SeeOther(w, "/user/new?email="+url.QueryEscape(args.Email))
 	}
 
-	err = user.Login(r.Context())
+	return h.finishLogin(w, r, site, &user)
+}
+
+// finishLogin logs in the user after the password was verified, asking for the
+// MFA token if it's enabled.
+func (h user) finishLogin(w http.ResponseWriter, r *http.Request, site *goatcounter.Site, u *goatcounter.User) error {
+	err := u.Login(r.Context())
 	if err != nil {
 		return err
 	}
 
-	if user.TOTPEnabled {
+	if u.TOTPEnabled {
 		return zhttp.Template(w, "totp.gohtml", struct {
 			Globals
 			LoginMAC string
-		}{newGlobals(w, r), xsrftoken.Generate(*user.LoginToken, strconv.FormatInt(user.ID, 10), actionTOTP)})
+		}{newGlobals(w, r), xsrftoken.Generate(*u.LoginToken, strconv.FormatInt(u.ID, 10), actionTOTP)})
 	}
 
-	zhttp.SetCookie(w, *user.LoginToken, cookieDomain(site, r))
+	err = startSession(w, r, site, u)
+	if err != nil {
+		return err
+	}
 	return zhttp.SeeOther(w, "/")
 }
 
@@ -418,6 +446,42 @@ func (h user) changePassword(w http.ResponseWriter, r *http.Request) error {
 	return zhttp.SeeOther(w, "/")
 }
 
+// timezone sets the user's timezone for the dashboard; this only affects the
+// user, so it doesn't need PermSettings.
+func (h user) timezone(w http.ResponseWriter, r *http.Request) error {
+	u := goatcounter.GetUser(r.Context())
+	var args struct {
+		Timezone string `json:"timezone"`
+	}
+	_, err := zhttp.Decode(r, &args)
+	if err != nil {
+		return err
+	}
+
+	u.Settings.Timezone = nil
+	if args.Timezone != "" {
+		u.Settings.Timezone = new(tz.Zone)
+		err := u.Settings.Timezone.UnmarshalText([]byte(args.Timezone))
+		if err != nil {
+			zhttp.FlashError(w, "Unknown timezone: %q", args.Timezone)
+			return zhttp.SeeOther(w, "/settings#tab-auth")
+		}
+	}
+
+	err = u.Update(r.Context(), false)
+	if err != nil {
+		var vErr *zvalidate.Validator
+		if errors.As(err, &vErr) {
+			zhttp.FlashError(w, fmt.Sprintf("%s", err))
+			return zhttp.SeeOther(w, "/settings#tab-auth")
+		}
+		return err
+	}
+
+	zhttp.Flash(w, "Timezone saved")
+	return zhttp.SeeOther(w, "/settings#tab-auth")
+}
+
 func (h user) resendVerify(w http.ResponseWriter, r *http.Request) error {
 	user := goatcounter.GetUser(r.Context())
 	if user.EmailVerified {
@@ -442,6 +506,29 @@ func (h user) newAPIToken(w http.ResponseWriter, r *http.Request) error {
 	if err != nil {
 		return err
 	}
+	token.Permissions = goatcounter.ParsePermissions(r.Form["perm"])
+
+	// Don't allow creating tokens with more permissions than the user has.
+	need := token.Permissions
+	if rid := r.Form.Get("role"); rid != "" {
+		v := zvalidate.New()
+		id := v.Integer("role", rid)
+		if v.HasErrors() {
+			return v
+		}
+
+		var role goatcounter.Role
+		err := role.ByID(r.Context(), id)
+		if err != nil {
+			return err
+		}
+		token.RoleID = &role.ID
+		need = need.Merge(role.Permissions)
+	}
+	err = user.Can(r.Context(), need...)
+	if err != nil {
+		return err
+	}
 
 	err = token.Insert(r.Context())
 	if err != nil {
@@ -474,6 +561,127 @@ func (h user) deleteAPIToken(w http.ResponseWriter, r *http.Request) error {
 	return zhttp.SeeOther(w, "/settings#tab-auth")
 }
 
+func (h user) newRole(w http.ResponseWriter, r *http.Request) error {
+	var role goatcounter.Role
+	_, err := zhttp.Decode(r, &role)
+	if err != nil {
+		return err
+	}
+	role.Permissions = goatcounter.ParsePermissions(r.Form["perm"])
+
+	err = goatcounter.GetUser(r.Context()).Can(r.Context(), role.Permissions...)
+	if err != nil {
+		return err
+	}
+
+	err = role.Insert(r.Context())
+	if err != nil {
+		return err
+	}
+
+	zhttp.Flash(w, "Role created")
+	return zhttp.SeeOther(w, "/settings#tab-auth")
+}
+
+func (h user) deleteRole(w http.ResponseWriter, r *http.Request) error {
+	v := zvalidate.New()
+	id := v.Integer("id", chi.URLParam(r, "id"))
+	if v.HasErrors() {
+		return v
+	}
+
+	var role goatcounter.Role
+	err := role.ByID(r.Context(), id)
+	if err != nil {
+		return err
+	}
+
+	err = role.Delete(r.Context())
+	if err != nil {
+		return err
+	}
+
+	zhttp.Flash(w, "Role removed")
+	return zhttp.SeeOther(w, "/settings#tab-auth")
+}
+
+func (h user) assignRole(w http.ResponseWriter, r *http.Request) error {
+	v := zvalidate.New()
+	id := v.Integer("id", chi.URLParam(r, "id"))
+	if v.HasErrors() {
+		return v
+	}
+
+	var args struct {
+		Role string `json:"role"`
+	}
+	_, err := zhttp.Decode(r, &args)
+	if err != nil {
+		return err
+	}
+
+	var roleID *int64
+	owner := args.Role == "owner"
+	if !owner && args.Role != "" {
+		rid := v.Integer("role", args.Role)
+		if v.HasErrors() {
+			return v
+		}
+		roleID = &rid
+	}
+
+	_, err = setUserRole(r.Context(), id, owner, roleID)
+	if err != nil {
+		if guru.Code(err) == http.StatusBadRequest {
+			zhttp.FlashError(w, err.Error())
+			return zhttp.SeeOther(w, "/settings#tab-auth")
+		}
+		return err
+	}
+
+	zhttp.Flash(w, "Role changed")
+	return zhttp.SeeOther(w, "/settings#tab-auth")
+}
+
+// setUserRole makes the user with this ID an owner or sets the role, after
+// checking that the user and role belong to the current site and that the
+// current user isn't giving out more permissions than they have.
+func setUserRole(ctx context.Context, userID int64, owner bool, roleID *int64) (*goatcounter.User, error) {
+	var u goatcounter.User
+	err := u.ByID(ctx, userID)
+	if err != nil && !zdb.ErrNoRows(err) {
+		return nil, err
+	}
+	if err != nil || u.Site != goatcounter.MustGetSite(ctx).IDOrParent() {
+		return nil, guru.Errorf(http.StatusNotFound, "no user with ID %d", userID)
+	}
+
+	cur := goatcounter.GetUser(ctx)
+	if owner && !bool(cur.Owner) {
+		return nil, guru.New(http.StatusForbidden, "only site owners can add other owners")
+	}
+	if roleID != nil {
+		var role goatcounter.Role
+		err := role.ByID(ctx, *roleID)
+		if err != nil {
+			if zdb.ErrNoRows(err) {
+				return nil, guru.Errorf(http.StatusBadRequest, "no role with ID %d", *roleID)
+			}
+			return nil, err
+		}
+		err = cur.Can(ctx, role.Permissions...)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = u.UpdateRole(ctx, owner, roleID)
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
 func sendEmailVerify(site *goatcounter.Site, user *goatcounter.User) {
 	bgrun.Run(func() {
 		err := blackmail.Send("Verify your email",
@@ -519,6 +727,51 @@ func (h user) verify(w http.ResponseWriter, r *http.Request) error {
 	return zhttp.SeeOther(w, "/")
 }
 
+// startSession creates a new session for the user and sets the cookie.
+func startSession(w http.ResponseWriter, r *http.Request, site *goatcounter.Site, u *goatcounter.User) error {
+	s := goatcounter.UserSession{UserID: u.ID, IP: r.RemoteAddr, UserAgent: r.UserAgent()}
+	err := s.Insert(goatcounter.WithSite(r.Context(), site))
+	if err != nil {
+		return err
+	}
+	u.Session = &s
+	zhttp.SetCookie(w, s.Token, cookieDomain(site, r))
+	return nil
+}
+
+func (h user) deleteSession(w http.ResponseWriter, r *http.Request) error {
+	v := zvalidate.New()
+	id := v.Integer("id", chi.URLParam(r, "id"))
+	if v.HasErrors() {
+		return v
+	}
+
+	s := goatcounter.UserSession{ID: id, UserID: goatcounter.GetUser(r.Context()).ID}
+	err := s.Delete(r.Context())
+	if err != nil {
+		return err
+	}
+
+	zhttp.Flash(w, "Session signed out")
+	return zhttp.SeeOther(w, "/settings#tab-auth")
+}
+
+func (h user) deleteOtherSessions(w http.ResponseWriter, r *http.Request) error {
+	u := goatcounter.GetUser(r.Context())
+	var keep int64
+	if u.Session != nil {
+		keep = u.Session.ID
+	}
+
+	err := goatcounter.UserSessions{}.DeleteOthers(r.Context(), u.ID, keep)
+	if err != nil {
+		return err
+	}
+
+	zhttp.Flash(w, "Signed out all other sessions")
+	return zhttp.SeeOther(w, "/settings#tab-auth")
+}
+
 // Make sure to use the currect cookie, since both "custom.example.com" and
 // "example.goatcounter.com" will work if you're using a custom domain.
 func cookieDomain(site *goatcounter.Site, r *http.Request) string {
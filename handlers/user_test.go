@@ -8,9 +8,13 @@ import (
 	"context"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 
 	"zgo.at/goatcounter"
+	"zgo.at/goatcounter/gctest"
+	"zgo.at/zdb"
+	"zgo.at/ztest"
 )
 
 func TestUserNew(t *testing.T) {
@@ -65,3 +69,34 @@ func TestUserLogout(t *testing.T) {
 		})
 	}
 }
+
+func TestUserTimezone(t *testing.T) {
+	ctx, clean := gctest.DB(t)
+	defer clean()
+
+	// Users without PermSettings can still set their own timezone.
+	role := goatcounter.Role{Name: "stats", Permissions: goatcounter.PermissionSet{goatcounter.PermStats}}
+	err := role.Insert(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = zdb.MustGet(ctx).ExecContext(ctx, `update users set owner=0, role_id=$1`, role.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, rr := newTest(ctx, "POST", "/user/timezone", strings.NewReader("timezone=JP.Asia/Tokyo"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	login(t, r)
+	newBackend(zdb.MustGet(ctx)).ServeHTTP(rr, r)
+	ztest.Code(t, rr, 303)
+
+	var u goatcounter.User
+	err = u.ByID(ctx, goatcounter.GetUser(ctx).ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Settings.Timezone == nil || u.Settings.Timezone.String() != "JP.Asia/Tokyo" {
+		t.Errorf("timezone not saved: %v", u.Settings.Timezone)
+	}
+}
@@ -34,10 +34,13 @@ type website struct{}
 
 func (h website) Mount(r *chi.Mux, db zdb.DB) {
 	r.Use(
-		zhttp.RealIP,
+		traceRequests,
+		realIP,
+		reportOnce,
 		zhttp.Unpanic(cfg.Prod),
 		middleware.RedirectSlashes,
-		addctx(db, false),
+		addctx(db, nil, false),
+		reportPanics,
 		zhttp.Headers(nil))
 	if !cfg.Prod {
 		zhttp.Log(true, "")
@@ -171,7 +174,7 @@ func (h website) doSignup(w http.ResponseWriter, r *http.Request) error {
 	}
 
 	site := goatcounter.Site{Code: args.Code, LinkDomain: args.LinkDomain, Plan: cfg.Plan}
-	user := goatcounter.User{Email: args.Email, Password: []byte(args.Password)}
+	user := goatcounter.User{Email: args.Email, Password: []byte(args.Password), Owner: true}
 
 	v := zvalidate.New()
 	if strings.TrimSpace(args.TuringTest) != "9" {
@@ -196,7 +199,7 @@ func (h website) doSignup(w http.ResponseWriter, r *http.Request) error {
 	defer tx.Rollback()
 
 	// Create site.
-	tz, err := tz.New(geo(r.RemoteAddr), args.Timezone)
+	tz, err := tz.New(geo(r.RemoteAddr).Country, args.Timezone)
 	if err != nil {
 		zlog.FieldsRequest(r).Fields(zlog.F{
 			"timezone": args.Timezone,
@@ -244,10 +247,11 @@ func (h website) doSignup(w http.ResponseWriter, r *http.Request) error {
 	}
 
 	err = user.Login(goatcounter.WithSite(r.Context(), &site))
+	if err == nil {
+		err = startSession(w, r, &site, &user)
+	}
 	if err != nil {
 		zlog.Errorf("login during account creation: %w", err)
-	} else {
-		zhttp.SetCookie(w, *user.LoginToken, cookieDomain(&site, r))
 	}
 
 	bgrun.Run(func() {
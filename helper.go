@@ -9,7 +9,6 @@ package goatcounter
 import (
 	"context"
 	"fmt"
-	"time"
 
 	"zgo.at/goatcounter/cfg"
 	"zgo.at/zdb"
@@ -26,9 +25,6 @@ const (
 
 var States = []string{StateActive, StateRequest, StateDeleted}
 
-// Now gets the current time in UTC; can be overwritten in tests.
-var Now = func() time.Time { return time.Now().UTC() }
-
 // WithSite adds the site to the context.
 func WithSite(ctx context.Context, s *Site) context.Context {
 	return context.WithValue(ctx, ctxkey.Site, s)
@@ -60,6 +56,25 @@ func GetUser(ctx context.Context) *User {
 	return u
 }
 
+type ctxKeyReplica struct{}
+
+// WithReplica adds a read-only database connection to the context, for queries
+// that only read data and can be sent to a replica.
+func WithReplica(ctx context.Context, db zdb.DB) context.Context {
+	return context.WithValue(ctx, ctxKeyReplica{}, db)
+}
+
+// Replica gets the read-only database connection, or the regular connection if
+// there isn't one.
+//
+// The queries are traced if tracing is enabled.
+func Replica(ctx context.Context) zdb.DB {
+	if db, ok := ctx.Value(ctxKeyReplica{}).(zdb.DB); ok {
+		return TraceDB(db)
+	}
+	return TraceDB(zdb.MustGet(ctx))
+}
+
 // NewContext creates a new context with the all the request values set.
 //
 // Useful for tests, or for "removing" the timeout on the request context so it
@@ -68,6 +83,9 @@ func NewContext(ctx context.Context) context.Context {
 	n := zdb.With(context.Background(), zdb.MustGet(ctx))
 	n = context.WithValue(n, ctxkey.User, GetUser(ctx))
 	n = context.WithValue(n, ctxkey.Site, GetSite(ctx))
+	if db, ok := ctx.Value(ctxKeyReplica{}).(zdb.DB); ok {
+		n = WithReplica(n, db)
+	}
 	return n
 }
 
@@ -7,13 +7,17 @@ package goatcounter
 import (
 	"bytes"
 	"context"
+	"database/sql/driver"
 	"fmt"
 	"net/url"
+	"strconv"
 	"strings"
 	"text/tabwriter"
 	"time"
 
 	"zgo.at/errors"
+	"zgo.at/goatcounter/cfg"
+	"zgo.at/json"
 	"zgo.at/zdb"
 	"zgo.at/zlog"
 	"zgo.at/zstd/zint"
@@ -22,6 +26,15 @@ import (
 
 func ptr(s string) *string { return &s }
 
+// RegionCountries are the countries for which the region (state, province) is
+// always recorded if the GeoIP database has it. These are all large countries
+// where a region is about as coarse as the country is for smaller countries.
+var RegionCountries = map[string]struct{}{
+	"AU": {}, "BR": {}, "CA": {}, "CN": {}, "DE": {}, "ES": {}, "FR": {},
+	"GB": {}, "ID": {}, "IN": {}, "IT": {}, "JP": {}, "MX": {}, "RU": {},
+	"US": {},
+}
+
 type Hit struct {
 	ID      int64        `db:"id" json:"-"`
 	Site    int64        `db:"site" json:"-"`
@@ -39,19 +52,86 @@ type Hit struct {
 	Query string     `db:"-" json:"q,omitempty"`
 	Bot   int        `db:"bot" json:"b,omitempty"`
 
+	// ID in the paths table; nil for old hits that haven't been backfilled
+	// yet.
+	PathID *int64 `db:"path_id" json:"-"`
+
+	Dimensions HitDimensions `db:"dimensions" json:"d,omitempty"`
+
+	// Time on page in seconds, from the engagement pings; nil if we never got
+	// a ping.
+	Duration *int64 `db:"duration" json:"-"`
+
 	RefScheme  *string   `db:"ref_scheme" json:"-"`
 	Browser    string    `db:"browser" json:"-"`
 	Location   string    `db:"location" json:"-"`
 	FirstVisit zdb.Bool  `db:"first_visit" json:"-"`
 	CreatedAt  time.Time `db:"created_at" json:"-"`
 
+	// ISO 3166-2 subdivision code (e.g. "US-CA") and city name; only set if
+	// the GeoIP database has them. The region is recorded for the countries in
+	// RegionCountries, or for all countries if the site records cities; the
+	// city only if the site records cities.
+	Region string `db:"region" json:"-"`
+	City   string `db:"city" json:"-"`
+
+	// Primary language tag from the Accept-Language header, e.g. "en".
+	Language string `db:"language" json:"-"`
+
 	RefURL *url.URL `db:"-" json:"-"`   // Parsed Ref
 	Random string   `db:"-" json:"rnd"` // Browser cache buster, as they don't always listen to Cache-Control
 
+	// Engagement ping: seconds since the pageview for Path was sent. This
+	// isn't a new pageview, but updates the Duration of the existing one.
+	Ping int64 `db:"-" json:"ping,omitempty"`
+
 	// Some values we need to pass from the HTTP handler to memstore
 	RemoteAddr string `db:"-" json:"-"`
 }
 
+// HitDimensions are the values for the site's custom dimensions, as name →
+// value.
+type HitDimensions map[string]string
+
+// Value implements the SQL Value function to determine what to store in the DB.
+func (d HitDimensions) Value() (driver.Value, error) {
+	if len(d) == 0 {
+		return nil, nil
+	}
+	return json.Marshal(d)
+}
+
+// Scan converts the data returned from the DB into the struct.
+func (d *HitDimensions) Scan(v interface{}) error {
+	switch vv := v.(type) {
+	case nil:
+		*d = nil
+		return nil
+	case []byte:
+		return json.Unmarshal(vv, d)
+	case string:
+		return json.Unmarshal([]byte(vv), d)
+	default:
+		panic(fmt.Sprintf("unsupported type: %T", v))
+	}
+}
+
+func (h *Hit) cleanDimensions(ctx context.Context) {
+	site := MustGetSite(ctx)
+	for k, v := range h.Dimensions {
+		d, ok := site.Settings.Dimensions.Get(k)
+		if !ok || d.Type != DimensionBool {
+			continue
+		}
+		switch strings.ToLower(strings.TrimSpace(v)) {
+		case "", "0", "f", "false", "n", "no", "off":
+			h.Dimensions[k] = "false"
+		default:
+			h.Dimensions[k] = "true"
+		}
+	}
+}
+
 func (h *Hit) cleanPath(ctx context.Context) {
 	if h.Event {
 		h.Path = strings.TrimLeft(h.Path, "/")
@@ -138,6 +218,9 @@ func (h Hit) String() string {
 	fmt.Fprintf(t, "Browser\t%q\n", h.Browser)
 	fmt.Fprintf(t, "Size\t%q\n", h.Size)
 	fmt.Fprintf(t, "Location\t%q\n", h.Location)
+	fmt.Fprintf(t, "Region\t%q\n", h.Region)
+	fmt.Fprintf(t, "City\t%q\n", h.City)
+	fmt.Fprintf(t, "Language\t%q\n", h.Language)
 	fmt.Fprintf(t, "Bot\t%d\n", h.Bot)
 	fmt.Fprintf(t, "CreatedAt\t%s\n", h.CreatedAt)
 	t.Flush()
@@ -149,11 +232,20 @@ func (h *Hit) Defaults(ctx context.Context) {
 	site := MustGetSite(ctx)
 	h.Site = site.ID
 
+	// The session is already set from the full User-Agent at this point.
+	if cfg.StripUserAgent || site.Settings.StripUserAgent {
+		h.Browser = StripUserAgent(h.Browser)
+	}
+
 	if h.CreatedAt.IsZero() {
 		h.CreatedAt = Now()
 	}
 
 	h.cleanPath(ctx)
+	if !h.Event {
+		h.Path = site.Settings.CanonicalPaths.Apply(h.Path)
+	}
+	h.cleanDimensions(ctx)
 
 	// Set campaign.
 	if !h.Event && h.Query != "" {
@@ -212,6 +304,23 @@ func (h *Hit) Validate(ctx context.Context) error {
 	v.Len("title", h.Title, 0, 1024)
 	v.Len("ref", h.Ref, 0, 2048)
 	v.Len("browser", h.Browser, 0, 512)
+	v.Range("ping", h.Ping, 0, MaxPing)
+
+	if site := GetSite(ctx); site != nil {
+		for k, val := range h.Dimensions {
+			d, ok := site.Settings.Dimensions.Get(k)
+			if !ok {
+				v.Append("dimensions", fmt.Sprintf("%q: unknown dimension", k))
+				continue
+			}
+			v.Len("dimensions", val, 0, 512)
+			if d.Type == DimensionNumber {
+				if _, err := strconv.ParseFloat(val, 64); err != nil {
+					v.Append("dimensions", fmt.Sprintf("%q: not a number: %q", k, val))
+				}
+			}
+		}
+	}
 
 	// Small margin as client's clocks may not be 100% accurate.
 	if h.CreatedAt.After(Now().Add(5 * time.Second)) {
@@ -274,6 +383,17 @@ func (h *Hits) Purge(ctx context.Context, path string, matchTitle bool) error {
 		if err != nil {
 			return errors.Wrap(err, "Hits.Purge ref_counts")
 		}
+		// Keep the "u" row, which records until when the rollups are current.
+		_, err = tx.ExecContext(ctx, fmt.Sprintf(query, "hit_rollups")+` and period != 'u'`, site, path)
+		if err != nil {
+			return errors.Wrap(err, "Hits.Purge hit_rollups")
+		}
+		_, err = tx.ExecContext(ctx, `/* Hits.Purge */
+			delete from path_transitions where site=$1 and (lower(path) like lower($2) or lower(prev_path) like lower($2))`,
+			site, path)
+		if err != nil {
+			return errors.Wrap(err, "Hits.Purge path_transitions")
+		}
 
 		// Delete all other stats as well if there's nothing left: not much use
 		// for it.
@@ -309,6 +429,10 @@ type HitStat struct {
 	RefScheme   *string  `db:"ref_scheme"`
 	Max         int
 	Stats       []Stat
+
+	// Updating is set if the statistics for the most recent hours were behind
+	// the pageviews, and were calculated from the pageviews instead.
+	Updating bool
 }
 
 type HitStats []HitStat
@@ -344,21 +468,27 @@ type Stats struct {
 }
 
 // ByRef lists all paths by reference.
-func (h *Stats) ByRef(ctx context.Context, start, end time.Time, ref string) error {
-	err := zdb.MustGet(ctx).SelectContext(ctx, &h.Stats, `/* Stats.ByRef */
+func (h *Stats) ByRef(ctx context.Context, start, end time.Time, filter, ref string) error {
+	table, args, err := countsTable(ctx, "ref_counts", filter, start, end)
+	if err != nil {
+		return errors.Wrap(err, "Stats.ByRef")
+	}
+
+	db := zdb.MustGet(ctx)
+	err = db.SelectContext(ctx, &h.Stats, db.Rebind(`/* Stats.ByRef */
 		select
 			path as name,
 			coalesce(sum(total), 0) as count,
 			coalesce(sum(total_unique), 0) as count_unique
-		from ref_counts where
-			site=$1 and
-			hour>=$2 and
-			hour<=$3 and
-			ref = $4
+		from `+table+` where
+			site=? and
+			hour>=? and
+			hour<=? and
+			ref = ?
 		group by path
 		order by count desc
-		limit 10`,
-		MustGetSite(ctx).ID, start.Format(zdb.Date), end.Format(zdb.Date), ref)
+		limit 10`),
+		append(args, MustGetSite(ctx).ID, start.Format(zdb.Date), end.Format(zdb.Date), ref)...)
 
 	return errors.Wrap(err, "Stats.ByRef")
 }
@@ -28,8 +28,13 @@ func (h *HitStats) List(
 	db := zdb.MustGet(ctx)
 	site := MustGetSite(ctx)
 
-	if filter != "" {
-		filter = "%" + strings.ToLower(filter) + "%"
+	filterQuery, filterArgs, err := filterSQL(ctx, filter, start, end, true)
+	if err != nil {
+		return 0, 0, false, errors.Wrap(err, "HitStats.List")
+	}
+	table, tableArgs, err := countsTable(ctx, "hit_counts", filter, start, end)
+	if err != nil {
+		return 0, 0, false, errors.Wrap(err, "HitStats.List")
 	}
 
 	// Select hits.
@@ -38,18 +43,24 @@ func (h *HitStats) List(
 		// Get one page more so we can detect if there are more pages after this.
 		limit := int(zint.NonZero(int64(site.Settings.Limits.Page), 10)) + 1
 
+		overview, overviewArgs := table, tableArgs
+		if table == "hit_counts" {
+			overview, overviewArgs, err = rollupTable(ctx, start, end)
+			if err != nil {
+				return 0, 0, false, errors.Wrap(err, "HitStats.List")
+			}
+		}
+
 		query := `/* HitStats.List: get overview */
-			select path, event from hit_counts
+			select path, event from ` + overview + `
 			where
 				site=? and
 				hour>=? and
 				hour<=? `
-		args := []interface{}{site.ID, start.Format(zdb.Date), end.Format(zdb.Date)}
+		args := append(overviewArgs, site.ID, start.Format(zdb.Date), end.Format(zdb.Date))
 
-		if filter != "" {
-			query += ` and (lower(path) like ? or lower(title) like ?) `
-			args = append(args, filter, filter)
-		}
+		query += filterQuery
+		args = append(args, filterArgs...)
 
 		// Quite a bit faster to not check path.
 		if len(exclude) > 0 {
@@ -79,28 +90,72 @@ func (h *HitStats) List(
 	}
 
 	// Add stats and title.
-	var st []struct {
+	type statRow struct {
 		Path        string    `db:"path"`
 		Title       string    `db:"title"`
 		Day         time.Time `db:"day"`
 		Stats       []byte    `db:"stats"`
 		StatsUnique []byte    `db:"stats_unique"`
 	}
-	{
+	var st []statRow
+	if table != "hit_counts" {
+		// hit_stats can't be filtered by facets, so construct the stats from
+		// the hits.
+		query := `/* HitStats.List: get stats from hits */
+			select path, title, hour, total, total_unique from ` + table + `
+			where
+				site=? and
+				hour>=? and
+				hour<=? ` + filterQuery + `
+			order by hour asc`
+		args := append(append(tableArgs[:len(tableArgs):len(tableArgs)],
+			site.ID, start.Format(zdb.Date), end.Format(zdb.Date)), filterArgs...)
+		var hours []struct {
+			Path        string    `db:"path"`
+			Title       string    `db:"title"`
+			Hour        time.Time `db:"hour"`
+			Total       int       `db:"total"`
+			TotalUnique int       `db:"total_unique"`
+		}
+		err := db.SelectContext(ctx, &hours, db.Rebind(query), args...)
+		if err != nil {
+			return 0, 0, false, errors.Wrap(err, "HitStats.List get hits")
+		}
+
+		type dayStat struct {
+			title          string
+			hourly, unique []int
+		}
+		days := make(map[string]*dayStat)
+		for _, h := range hours {
+			k := h.Path + "\x00" + h.Hour.Format("2006-01-02")
+			d, ok := days[k]
+			if !ok {
+				d = &dayStat{hourly: make([]int, 24), unique: make([]int, 24)}
+				days[k] = d
+			}
+			d.title = h.Title
+			d.hourly[h.Hour.Hour()] += h.Total
+			d.unique[h.Hour.Hour()] += h.TotalUnique
+		}
+		for k, d := range days {
+			i := strings.IndexByte(k, 0)
+			day, _ := time.Parse("2006-01-02", k[i+1:])
+			st = append(st, statRow{k[:i], d.title, day, zjson.MustMarshal(d.hourly), zjson.MustMarshal(d.unique)})
+		}
+		sort.Slice(st, func(i, j int) bool { return st[i].Day.Before(st[j].Day) })
+	} else {
 		query := `/* HitStats.List: get stats */
 			select path, title, day, stats, stats_unique
 			from hit_stats
 			where
-				site=$1 and
-				day >= $2 and
-				day <= $3 `
-		args := []interface{}{site.ID, start.Format("2006-01-02"), end.Format("2006-01-02")}
-		if filter != "" {
-			query += ` and (lower(path) like $4 or lower(title) like $4) `
-			args = append(args, filter)
-		}
-		query += ` order by day asc`
-		err := db.SelectContext(ctx, &st, query, args...)
+				site=? and
+				day >= ? and
+				day <= ? ` + filterQuery + `
+			order by day asc`
+		args := append([]interface{}{site.ID, start.Format("2006-01-02"), end.Format("2006-01-02")},
+			filterArgs...)
+		err := db.SelectContext(ctx, &st, db.Rebind(query), args...)
 		if err != nil {
 			return 0, 0, false, errors.Wrap(err, "HitStats.List get hit_stats")
 		}
@@ -150,28 +205,38 @@ func (h *HitStat) Totals(ctx context.Context, start, end time.Time, filter strin
 	db := zdb.MustGet(ctx)
 	site := MustGetSite(ctx)
 
-	query := `/* HitStat.Totals */
-		select hour, total, total_unique from hit_counts
-		where site=$1 and hour>=$2 and hour<=$3 `
-	args := []interface{}{site.ID, start.Format(zdb.Date), end.Format(zdb.Date)}
-	if filter != "" {
-		query += ` and (lower(path) like lower($4) or lower(title) like lower($4)) `
-		args = append(args, "%"+filter+"%")
+	filterQuery, filterArgs, err := filterSQL(ctx, filter, start, end, true)
+	if err != nil {
+		return 0, errors.Errorf("HitStat.Totals: %w", err)
 	}
-	query += ` order by hour asc`
-	var tc []struct {
-		Hour        time.Time `db:"hour"`
-		Total       int       `db:"total"`
-		TotalUnique int       `db:"total_unique"`
+	table, args, err := countsTable(ctx, "hit_counts", filter, start, end)
+	if err != nil {
+		return 0, errors.Errorf("HitStat.Totals: %w", err)
 	}
-	err := db.SelectContext(ctx, &tc, query, args...)
+
+	query := `/* HitStat.Totals */
+		select hour, total, total_unique from ` + table + `
+		where site=? and hour>=? and hour<=? ` + filterQuery + `
+		order by hour asc`
+	args = append(append(args, site.ID, start.Format(zdb.Date), end.Format(zdb.Date)), filterArgs...)
+	var tc []hourCount
+	err = db.SelectContext(ctx, &tc, db.Rebind(query), args...)
 	if err != nil {
 		return 0, errors.Errorf("HitStat.Totals: %w", err)
 	}
 
+	var updating bool
+	if filter == "" {
+		tc, updating, err = statsTail(ctx, tc, start, end)
+		if err != nil {
+			return 0, errors.Errorf("HitStat.Totals: %w", err)
+		}
+	}
+
 	totalst := HitStat{
-		Path:  PathTotals,
-		Title: "",
+		Path:     PathTotals,
+		Title:    "",
+		Updating: updating,
 	}
 	stats := make(map[string]Stat)
 	for _, t := range tc {
@@ -388,48 +453,80 @@ func addTotals(hh HitStats, daily bool, totalDisplay, totalUniqueDisplay *int) {
 }
 
 func GetTotalCount(ctx context.Context, start, end time.Time, filter string) (int, int, error) {
+	filterQuery, filterArgs, err := filterSQL(ctx, filter, start, end, true)
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "GetTotalCount")
+	}
+	table, args, err := countsTable(ctx, "hit_counts", filter, start, end)
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "GetTotalCount")
+	}
+
 	query := `/* GetTotalCount */
 		select
 			coalesce(sum(total), 0) as t,
 			coalesce(sum(total_unique), 0) as u
-		from hit_counts where
-			site=$1 and
-			hour>=$2 and
-			hour<=$3 `
-	args := []interface{}{MustGetSite(ctx).ID, start.Format(zdb.Date), end.Format(zdb.Date)}
-	if filter != "" {
-		query += ` and (lower(path) like $4 or lower(title) like $4) `
-		args = append(args, "%"+strings.ToLower(filter)+"%")
-	}
+		from ` + table + ` where
+			site=? and
+			hour>=? and
+			hour<=? ` + filterQuery
+	args = append(append(args, MustGetSite(ctx).ID, start.Format(zdb.Date), end.Format(zdb.Date)), filterArgs...)
 
 	var t struct{ T, U int }
-	err := zdb.MustGet(ctx).GetContext(ctx, &t, query, args...)
+	db := zdb.MustGet(ctx)
+	err = db.GetContext(ctx, &t, db.Rebind(query), args...)
 	return t.T, t.U, errors.Wrap(err, "GetTotalCount")
 }
 
+// GetPathCount gets the number of pageviews and visitors for the path, for all
+// time.
+//
+// The counts are cached for pathCountTTL.
+func GetPathCount(ctx context.Context, path string) (int, int, error) {
+	site := MustGetSite(ctx).ID
+	if t, u, ok := pathCountCacheGet(site, path); ok {
+		return t, u, nil
+	}
+
+	var t struct{ T, U int }
+	err := zdb.MustGet(ctx).GetContext(ctx, &t, `/* GetPathCount */
+		select
+			coalesce(sum(total), 0) as t,
+			coalesce(sum(total_unique), 0) as u
+		from hit_counts where site=$1 and path=$2`,
+		site, path)
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "GetPathCount")
+	}
+	pathCountCacheSet(site, path, t.T, t.U)
+	return t.T, t.U, nil
+}
+
 func GetMax(ctx context.Context, start, end time.Time, filter string, daily bool) (int, error) {
-	if filter != "" {
-		filter = "%" + filter + "%"
+	filterQuery, filterArgs, err := filterSQL(ctx, filter, start, end, true)
+	if err != nil {
+		return 0, errors.Wrap(err, "getMax")
+	}
+	table, tableArgs, err := countsTable(ctx, "hit_counts", filter, start, end)
+	if err != nil {
+		return 0, errors.Wrap(err, "getMax")
 	}
 
 	site := MustGetSite(ctx)
 	var (
 		max   int
 		query string
-		args  []interface{}
+		args  = append(tableArgs, site.ID, start.Format(zdb.Date), end.Format(zdb.Date))
 	)
 	if daily {
 		if cfg.PgSQL {
 			// PostgreSQL daily.
 			query = `/* getMax daily */
 					select coalesce(sum(total), 0) as t
-					from hit_counts
+					from ` + table + `
 					where site=? and hour>=? and hour<=? `
-			args = []interface{}{site.ID, start.Format(zdb.Date), end.Format(zdb.Date)}
-			if filter != "" {
-				query += ` and (lower(path) like ? or lower(title) like ?) `
-				args = append(args, filter, filter)
-			}
+			query += filterQuery
+			args = append(args, filterArgs...)
 			query += `group by path, substring(timezone(?, hour)::varchar, 0, 11)
 					order by t desc
 					limit 1`
@@ -438,32 +535,39 @@ func GetMax(ctx context.Context, start, end time.Time, filter string, daily bool
 			// SQLite daily
 			query = `
 					select coalesce(sum(total), 0) as t
-					from hit_counts
+					from ` + table + `
 					where site=? and hour>=? and hour<=? `
-			args = []interface{}{site.ID, start.Format(zdb.Date), end.Format(zdb.Date)}
-			if filter != "" {
-				query += ` and (lower(path) like ? or lower(title) like ?) `
-				args = append(args, filter, filter)
-			}
+			query += filterQuery
+			args = append(args, filterArgs...)
 			query += `group by path, substr(datetime(hour, ?), 0, 11)
 					order by t desc
 					limit 1`
 			args = append(args, site.Settings.Timezone.OffsetRFC3339())
 		}
+	} else if table != "hit_counts" {
+		// Hourly from the hits; these aren't grouped by hour yet.
+		hour := `strftime('%Y-%m-%d %H', hour)`
+		if cfg.PgSQL {
+			hour = `date_trunc('hour', hour)`
+		}
+		query = `/* getMax hourly from hits */
+				select coalesce(max(t), 0) from (
+					select sum(total) as t from ` + table + `
+					where site=? and hour>=? and hour<=? ` + filterQuery + `
+					group by path, ` + hour + `
+				) x`
+		args = append(args, filterArgs...)
 	} else {
 		/* Hourly */
 		query = `/* getMax hourly */
 				select coalesce(max(total), 0) from hit_counts
 				where site=? and hour>=? and hour<=? `
-		args = []interface{}{site.ID, start.Format(zdb.Date), end.Format(zdb.Date)}
-		if filter != "" {
-			query += ` and (lower(path) like ? or lower(title) like ?) `
-			args = append(args, filter, filter)
-		}
+		query += filterQuery
+		args = append(args, filterArgs...)
 	}
 
 	db := zdb.MustGet(ctx)
-	err := db.GetContext(ctx, &max, db.Rebind(query), args...)
+	err = db.GetContext(ctx, &max, db.Rebind(query), args...)
 	if err != nil && !zdb.ErrNoRows(err) {
 		return 0, errors.Wrap(err, "getMax")
 	}
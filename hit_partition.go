@@ -0,0 +1,97 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/goatcounter/cfg"
+	"zgo.at/zdb"
+	"zgo.at/zlog"
+)
+
+// The hits table is partitioned by month on PostgreSQL 11 and newer; see the
+// 2020-08-04-1-partition-hits migration.
+
+// hitPartition gets the name and range of the partition for the month t is in.
+func hitPartition(t time.Time) (name string, from, to time.Time) {
+	from = time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	return "hits_" + from.Format("2006_01"), from, from.AddDate(0, 1, 0)
+}
+
+// hitsPartitioned reports if the hits table is partitioned.
+func hitsPartitioned(ctx context.Context) (bool, error) {
+	if !cfg.PgSQL {
+		return false, nil
+	}
+	var p bool
+	err := zdb.MustGet(ctx).GetContext(ctx, &p,
+		`select exists(select 1 from pg_partitioned_table where partrelid='hits'::regclass)`)
+	return p, errors.Wrap(err, "hitsPartitioned")
+}
+
+// CreateHitPartitions creates the partitions for the current month and the
+// next months, if the hits table is partitioned.
+func CreateHitPartitions(ctx context.Context, months int) error {
+	p, err := hitsPartitioned(ctx)
+	if err != nil || !p {
+		return err
+	}
+
+	for i := 0; i <= months; i++ {
+		name, from, to := hitPartition(Now().AddDate(0, i, 0))
+		_, err := zdb.MustGet(ctx).ExecContext(ctx, fmt.Sprintf(
+			`create table if not exists "%s" partition of hits for values from ('%s') to ('%s')`,
+			name, from.Format("2006-01-02"), to.Format("2006-01-02")))
+		if err != nil {
+			return errors.Wrap(err, "CreateHitPartitions")
+		}
+	}
+	return nil
+}
+
+// DropHitPartitions drops the partitions of the hits table that only contain
+// pageviews older than the given number of days, if the hits table is
+// partitioned.
+//
+// This is much faster than deleting the rows, but removes the pageviews for all
+// sites, so days needs to be the longest data retention of all sites.
+func DropHitPartitions(ctx context.Context, days int) error {
+	p, err := hitsPartitioned(ctx)
+	if err != nil || !p {
+		return err
+	}
+
+	db := zdb.MustGet(ctx)
+	var names []string
+	err = db.SelectContext(ctx, &names, `/* DropHitPartitions */
+		select c.relname from pg_inherits i
+		join pg_class c on c.oid=i.inhrelid
+		where i.inhparent='hits'::regclass`)
+	if err != nil {
+		return errors.Wrap(err, "DropHitPartitions")
+	}
+
+	cutoff := Now().AddDate(0, 0, -days)
+	for _, n := range names {
+		t, err := time.Parse("hits_2006_01", n)
+		if err != nil { // Default partition.
+			continue
+		}
+		if _, _, to := hitPartition(t); to.After(cutoff) {
+			continue
+		}
+
+		_, err = db.ExecContext(ctx, fmt.Sprintf(`drop table "%s"`, n))
+		if err != nil {
+			return errors.Wrap(err, "DropHitPartitions")
+		}
+		zlog.Module("retention").Printf("dropped partition %q", n)
+	}
+	return nil
+}
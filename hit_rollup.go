@@ -0,0 +1,239 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"context"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/goatcounter/cfg"
+	"zgo.at/zdb"
+)
+
+// The hit_rollups table has the hit_counts summed per day ("d") and per month
+// ("m"), so that the overview for long date ranges doesn't need to go over
+// every hour. Any date range can be made from whole months and days, so there
+// is no need for a weekly rollup. There is one "u" row per site with the date
+// until which the rollups are complete.
+//
+// The rollups are only kept for sites with more than RollupThreshold pageviews,
+// and are updated by cron for every completed day.
+
+// RollupThreshold is the number of pageviews in the last 30 days above which
+// the rollups are kept for a site; 0 disables the rollups for all sites.
+var RollupThreshold = 500000
+
+// Only use the rollups for date ranges of at least this many days; it's not
+// worth the extra queries for shorter ranges.
+const rollupMinDays = 45
+
+func truncDay(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+func truncMonth(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+// rollupExpr gets the SQL expression to truncate the hour column to the
+// rollup's period.
+func rollupExpr(period string) string {
+	switch {
+	case period == "m" && cfg.PgSQL:
+		return `date_trunc('month', hour)`
+	case period == "m":
+		return `strftime('%Y-%m-01 00:00:00', hour)`
+	case cfg.PgSQL:
+		return `date_trunc('day', hour)`
+	default:
+		return `strftime('%Y-%m-%d 00:00:00', hour)`
+	}
+}
+
+// RollupSites gets the IDs of all sites that should have rollups.
+func RollupSites(ctx context.Context) ([]int64, error) {
+	if RollupThreshold <= 0 {
+		return nil, nil
+	}
+
+	var ids []int64
+	err := zdb.MustGet(ctx).SelectContext(ctx, &ids, `/* RollupSites */
+		select site from hit_counts
+		where hour >= $1
+		group by site
+		having sum(total) >= $2`,
+		Now().AddDate(0, 0, -30).Format(zdb.Date), RollupThreshold)
+	return ids, errors.Wrap(err, "RollupSites")
+}
+
+// UpdateRollups adds the rollups for all completed days and months since the
+// last update.
+func UpdateRollups(ctx context.Context, siteID int64) error {
+	err := zdb.TX(ctx, func(ctx context.Context, db zdb.DB) error {
+		var from time.Time
+		err := db.GetContext(ctx, &from, `select hour from hit_rollups where site=$1 and period='u'`, siteID)
+		if zdb.ErrNoRows(err) {
+			err = db.GetContext(ctx, &from, `select hour from hit_counts
+				where site=$1 order by hour asc limit 1`, siteID)
+			if zdb.ErrNoRows(err) {
+				return nil
+			}
+			from = truncDay(from)
+		}
+		if err != nil {
+			return err
+		}
+
+		until := truncDay(Now())
+		if !from.Before(until) {
+			return nil
+		}
+
+		_, err = db.ExecContext(ctx, `delete from hit_rollups where site=$1 and period='d' and hour>=$2`,
+			siteID, from.Format(zdb.Date))
+		if err != nil {
+			return err
+		}
+		_, err = db.ExecContext(ctx, `/* UpdateRollups */
+			insert into hit_rollups (site, period, path, title, event, hour, total, total_unique)
+			select site, 'd', path, max(title), event, `+rollupExpr("d")+`, sum(total), sum(total_unique)
+			from hit_counts
+			where site=$1 and hour>=$2 and hour<$3
+			group by site, path, event, `+rollupExpr("d"),
+			siteID, from.Format(zdb.Date), until.Format(zdb.Date))
+		if err != nil {
+			return err
+		}
+
+		mFrom, mUntil := truncMonth(from), truncMonth(until)
+		if mFrom.Before(mUntil) {
+			_, err = db.ExecContext(ctx, `delete from hit_rollups where site=$1 and period='m' and hour>=$2 and hour<$3`,
+				siteID, mFrom.Format(zdb.Date), mUntil.Format(zdb.Date))
+			if err != nil {
+				return err
+			}
+			_, err = db.ExecContext(ctx, `/* UpdateRollups */
+				insert into hit_rollups (site, period, path, title, event, hour, total, total_unique)
+				select site, 'm', path, max(title), event, `+rollupExpr("m")+`, sum(total), sum(total_unique)
+				from hit_rollups
+				where site=$1 and period='d' and hour>=$2 and hour<$3
+				group by site, path, event, `+rollupExpr("m"),
+				siteID, mFrom.Format(zdb.Date), mUntil.Format(zdb.Date))
+			if err != nil {
+				return err
+			}
+		}
+
+		_, err = db.ExecContext(ctx, `delete from hit_rollups where site=$1 and period='u'`, siteID)
+		if err != nil {
+			return err
+		}
+		_, err = db.ExecContext(ctx, `insert into hit_rollups (site, period, path, title, event, hour, total, total_unique)
+			values ($1, 'u', '', '', 0, $2, 0, 0)`, siteID, until.Format(zdb.Date))
+		return err
+	})
+	return errors.Wrapf(err, "UpdateRollups: site %d", siteID)
+}
+
+// InvalidateRollups removes the rollups from the day and month that t is in,
+// for when the hit_counts for past days changed. They're created again on the
+// next UpdateRollups().
+func InvalidateRollups(ctx context.Context, siteID int64, t time.Time) error {
+	err := zdb.TX(ctx, func(ctx context.Context, db zdb.DB) error {
+		_, err := db.ExecContext(ctx, `/* InvalidateRollups */
+			delete from hit_rollups where site=$1 and (
+				(period='d' and hour>=$2) or (period='m' and hour>=$3)
+			)`, siteID, truncDay(t).Format(zdb.Date), truncMonth(t).Format(zdb.Date))
+		if err != nil {
+			return err
+		}
+		_, err = db.ExecContext(ctx, `update hit_rollups set hour=$2 where site=$1 and period='u' and hour>$2`,
+			siteID, truncDay(t).Format(zdb.Date))
+		return err
+	})
+	return errors.Wrap(err, "InvalidateRollups")
+}
+
+// deleteRollupsOlderThan removes the rollups for the months before t and the
+// month t is in, as the hit_counts for that month are only partly removed.
+func deleteRollupsOlderThan(ctx context.Context, siteID int64, t time.Time) error {
+	_, err := zdb.MustGet(ctx).ExecContext(ctx, `delete from hit_rollups where site=$1 and period!='u' and hour<$2`,
+		siteID, truncMonth(t).AddDate(0, 1, 0).Format(zdb.Date))
+	return errors.Wrap(err, "deleteRollupsOlderThan")
+}
+
+// rollupTable gets the table to use instead of hit_counts for the overview of
+// pages for this date range; this uses the rollups for all whole days and
+// months in the date range, and the hit_counts for the rest.
+//
+// This returns "hit_counts" if there are no rollups for this date range.
+func rollupTable(ctx context.Context, start, end time.Time) (string, []interface{}, error) {
+	if end.Sub(start) < rollupMinDays*24*time.Hour {
+		return "hit_counts", nil, nil
+	}
+
+	var (
+		db           = zdb.MustGet(ctx)
+		siteID       = MustGetSite(ctx).ID
+		first, until time.Time
+	)
+	err := db.GetContext(ctx, &until, `select hour from hit_rollups where site=$1 and period='u'`, siteID)
+	if err == nil {
+		err = db.GetContext(ctx, &first, `select hour from hit_rollups
+			where site=$1 and period='d' order by hour asc limit 1`, siteID)
+	}
+	if zdb.ErrNoRows(err) {
+		return "hit_counts", nil, nil
+	}
+	if err != nil {
+		return "", nil, errors.Wrap(err, "rollupTable")
+	}
+
+	// Whole days in the date range that have a rollup.
+	dayFrom := truncDay(start)
+	if dayFrom.Before(start) {
+		dayFrom = dayFrom.Add(24 * time.Hour)
+	}
+	if dayFrom.Before(first) {
+		dayFrom = first
+	}
+	dayTo := truncDay(end.Add(time.Second))
+	if dayTo.After(until) {
+		dayTo = until
+	}
+	if dayTo.Sub(dayFrom) < rollupMinDays*24*time.Hour {
+		return "hit_counts", nil, nil
+	}
+
+	// Whole months in those days.
+	monthFrom := truncMonth(dayFrom)
+	if monthFrom.Before(dayFrom) {
+		monthFrom = monthFrom.AddDate(0, 1, 0)
+	}
+	monthTo := truncMonth(dayTo)
+	if monthTo.Before(monthFrom) {
+		monthTo = monthFrom
+	}
+
+	f := func(t time.Time) string { return t.Format(zdb.Date) }
+	return `(
+			select site, path, title, event, hour, total, total_unique from hit_rollups
+			where site=? and period='m' and hour>=? and hour<?
+		union all
+			select site, path, title, event, hour, total, total_unique from hit_rollups
+			where site=? and period='d' and ((hour>=? and hour<?) or (hour>=? and hour<?))
+		union all
+			select site, path, title, event, hour, total, total_unique from hit_counts
+			where site=? and (hour<? or hour>=?)
+		) hit_counts`,
+		[]interface{}{
+			siteID, f(monthFrom), f(monthTo),
+			siteID, f(dayFrom), f(monthFrom), f(monthTo), f(dayTo),
+			siteID, f(dayFrom), f(dayTo),
+		}, nil
+}
@@ -9,15 +9,30 @@ import (
 	"fmt"
 	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	"zgo.at/errors"
+	"zgo.at/goatcounter/cfg"
+	"zgo.at/guru"
 	"zgo.at/zdb"
 )
 
 // ListBrowsers lists all browser statistics for the given time period.
-func (h *Stats) ListBrowsers(ctx context.Context, start, end time.Time, limit, offset int) error {
-	err := zdb.MustGet(ctx).SelectContext(ctx, &h.Stats, `/* Stats.ListBrowsers */
+func (h *Stats) ListBrowsers(ctx context.Context, start, end time.Time, filter string, limit, offset int) error {
+	facets, err := hasFacets(filter)
+	if err != nil {
+		return errors.Wrap(err, "Stats.ListBrowsers")
+	}
+	if facets {
+		stats, err := listFacet(ctx, filter, start, end, "browser", func(ua string) string {
+			return uaName("browser", ua)
+		})
+		h.paginate(stats, limit, offset)
+		return errors.Wrap(err, "Stats.ListBrowsers")
+	}
+
+	err = zdb.MustGet(ctx).SelectContext(ctx, &h.Stats, `/* Stats.ListBrowsers */
 		select
 			browser as name,
 			sum(count) as count,
@@ -37,8 +52,23 @@ func (h *Stats) ListBrowsers(ctx context.Context, start, end time.Time, limit, o
 }
 
 // ListBrowser lists all the versions for one browser.
-func (h *Stats) ListBrowser(ctx context.Context, browser string, start, end time.Time) error {
-	err := zdb.MustGet(ctx).SelectContext(ctx, &h.Stats, `
+func (h *Stats) ListBrowser(ctx context.Context, browser string, start, end time.Time, filter string) error {
+	facets, err := hasFacets(filter)
+	if err != nil {
+		return errors.Wrap(err, "Stats.ListBrowser")
+	}
+	if facets {
+		h.Stats, err = listFacet(ctx, filter, start, end, "browser", func(ua string) string {
+			u := ParseUserAgent(ua)
+			if !strings.EqualFold(u.Browser, browser) {
+				return ""
+			}
+			return u.Browser + " " + u.BrowserVersion
+		})
+		return errors.Wrap(err, "Stats.ListBrowser")
+	}
+
+	err = zdb.MustGet(ctx).SelectContext(ctx, &h.Stats, `
 		select
 			browser || ' ' || version as name,
 			sum(count) as count,
@@ -52,8 +82,20 @@ func (h *Stats) ListBrowser(ctx context.Context, browser string, start, end time
 }
 
 // ListSystems lists OS statistics for the given time period.
-func (h *Stats) ListSystems(ctx context.Context, start, end time.Time, limit, offset int) error {
-	err := zdb.MustGet(ctx).SelectContext(ctx, &h.Stats, `/* Stats.ListSystem */
+func (h *Stats) ListSystems(ctx context.Context, start, end time.Time, filter string, limit, offset int) error {
+	facets, err := hasFacets(filter)
+	if err != nil {
+		return errors.Wrap(err, "Stats.ListSystems")
+	}
+	if facets {
+		stats, err := listFacet(ctx, filter, start, end, "browser", func(ua string) string {
+			return uaName("system", ua)
+		})
+		h.paginate(stats, limit, offset)
+		return errors.Wrap(err, "Stats.ListSystems")
+	}
+
+	err = zdb.MustGet(ctx).SelectContext(ctx, &h.Stats, `/* Stats.ListSystem */
 		select
 			system as name,
 			sum(count) as count,
@@ -73,8 +115,23 @@ func (h *Stats) ListSystems(ctx context.Context, start, end time.Time, limit, of
 }
 
 // ListSystem lists all the versions for one system.
-func (h *Stats) ListSystem(ctx context.Context, system string, start, end time.Time) error {
-	err := zdb.MustGet(ctx).SelectContext(ctx, &h.Stats, `
+func (h *Stats) ListSystem(ctx context.Context, system string, start, end time.Time, filter string) error {
+	facets, err := hasFacets(filter)
+	if err != nil {
+		return errors.Wrap(err, "Stats.ListSystem")
+	}
+	if facets {
+		h.Stats, err = listFacet(ctx, filter, start, end, "browser", func(ua string) string {
+			u := ParseUserAgent(ua)
+			if !strings.EqualFold(u.System, system) {
+				return ""
+			}
+			return u.System + " " + u.SystemVersion
+		})
+		return errors.Wrap(err, "Stats.ListSystem")
+	}
+
+	err = zdb.MustGet(ctx).SelectContext(ctx, &h.Stats, `
 		select
 			system || ' ' || version as name,
 			sum(count) as count,
@@ -97,17 +154,25 @@ const (
 )
 
 // ListSizes lists all device sizes.
-func (h *Stats) ListSizes(ctx context.Context, start, end time.Time) error {
-	err := zdb.MustGet(ctx).SelectContext(ctx, &h.Stats, `/* Stats.ListSizes */
-		select
-			width as name,
-			sum(count) as count,
-			sum(count_unique) as count_unique
-		from size_stats
-		where site=$1 and day >= $2 and day <= $3
-		group by width
-		order by count_unique desc, name asc
-	`, MustGetSite(ctx).ID, start.Format("2006-01-02"), end.Format("2006-01-02"))
+func (h *Stats) ListSizes(ctx context.Context, start, end time.Time, filter string) error {
+	facets, err := hasFacets(filter)
+	if err != nil {
+		return errors.Wrap(err, "Stats.ListSizes")
+	}
+	if facets {
+		h.Stats, err = listFacet(ctx, filter, start, end, "size", sizeWidth)
+	} else {
+		err = zdb.MustGet(ctx).SelectContext(ctx, &h.Stats, `/* Stats.ListSizes */
+			select
+				width as name,
+				sum(count) as count,
+				sum(count_unique) as count_unique
+			from size_stats
+			where site=$1 and day >= $2 and day <= $3
+			group by width
+			order by count_unique desc, name asc
+		`, MustGetSite(ctx).ID, start.Format("2006-01-02"), end.Format("2006-01-02"))
+	}
 	if err != nil {
 		return errors.Wrap(err, "Stats.ListSize")
 	}
@@ -124,25 +189,11 @@ func (h *Stats) ListSizes(ctx context.Context, start, end time.Time) error {
 
 	for i := range h.Stats {
 		x, _ := strconv.ParseInt(h.Stats[i].Name, 10, 16)
-		switch {
-		case x == 0:
-			ns[5].Count += h.Stats[i].Count
-			ns[5].CountUnique += h.Stats[i].CountUnique
-		case x <= 384:
-			ns[0].Count += h.Stats[i].Count
-			ns[0].CountUnique += h.Stats[i].CountUnique
-		case x <= 1024:
-			ns[1].Count += h.Stats[i].Count
-			ns[1].CountUnique += h.Stats[i].CountUnique
-		case x <= 1440:
-			ns[2].Count += h.Stats[i].Count
-			ns[2].CountUnique += h.Stats[i].CountUnique
-		case x <= 1920:
-			ns[3].Count += h.Stats[i].Count
-			ns[3].CountUnique += h.Stats[i].CountUnique
-		default:
-			ns[4].Count += h.Stats[i].Count
-			ns[4].CountUnique += h.Stats[i].CountUnique
+		for j := range ns {
+			if ns[j].Name == sizeGroup(x) {
+				ns[j].Count += h.Stats[i].Count
+				ns[j].CountUnique += h.Stats[i].CountUnique
+			}
 		}
 	}
 	h.Stats = ns
@@ -150,8 +201,36 @@ func (h *Stats) ListSizes(ctx context.Context, start, end time.Time) error {
 	return nil
 }
 
+// sizeGroup gets the group name for a screen width.
+func sizeGroup(x int64) string {
+	switch {
+	case x == 0:
+		return sizeUnknown
+	case x <= 384:
+		return sizePhones
+	case x <= 1024:
+		return sizeLargePhones
+	case x <= 1440:
+		return sizeTablets
+	case x <= 1920:
+		return sizeDesktop
+	default:
+		return sizeDesktopHD
+	}
+}
+
+// sizeWidth gets the width from the size column in the hits table, which is
+// stored as "width,height,scale".
+func sizeWidth(size string) string {
+	if i := strings.IndexByte(size, ','); i > -1 {
+		size = size[:i]
+	}
+	w, _ := strconv.ParseFloat(size, 64)
+	return strconv.Itoa(int(w))
+}
+
 // ListSize lists all sizes for one grouping.
-func (h *Stats) ListSize(ctx context.Context, name string, start, end time.Time) error {
+func (h *Stats) ListSize(ctx context.Context, name string, start, end time.Time, filter string) error {
 	var where string
 	switch name {
 	case sizePhones:
@@ -170,17 +249,32 @@ func (h *Stats) ListSize(ctx context.Context, name string, start, end time.Time)
 		return errors.Errorf("Stats.ListSizes: invalid value for name: %#v", name)
 	}
 
-	err := zdb.MustGet(ctx).SelectContext(ctx, &h.Stats, fmt.Sprintf(`/* Stats.ListSize */
-		select
-			width as name,
-			sum(count) as count,
-			sum(count_unique) as count_unique
-		from size_stats
-		where
-			site=$1 and day >= $2 and day <= $3 and
-			%s
-		group by width
-	`, where), MustGetSite(ctx).ID, start.Format("2006-01-02"), end.Format("2006-01-02"))
+	facets, err := hasFacets(filter)
+	if err != nil {
+		return errors.Wrap(err, "Stats.ListSize")
+	}
+	if facets {
+		h.Stats, err = listFacet(ctx, filter, start, end, "size", func(size string) string {
+			w := sizeWidth(size)
+			x, _ := strconv.ParseInt(w, 10, 16)
+			if sizeGroup(x) != name {
+				return ""
+			}
+			return w
+		})
+	} else {
+		err = zdb.MustGet(ctx).SelectContext(ctx, &h.Stats, fmt.Sprintf(`/* Stats.ListSize */
+			select
+				width as name,
+				sum(count) as count,
+				sum(count_unique) as count_unique
+			from size_stats
+			where
+				site=$1 and day >= $2 and day <= $3 and
+				%s
+			group by width
+		`, where), MustGetSite(ctx).ID, start.Format("2006-01-02"), end.Format("2006-01-02"))
+	}
 	if err != nil {
 		return errors.Wrap(err, "Stats.ListSize")
 	}
@@ -209,19 +303,25 @@ func (h *Stats) ListSize(ctx context.Context, name string, start, end time.Time)
 }
 
 // ListLocations lists all location statistics for the given time period.
-func (h *Stats) ListLocations(ctx context.Context, start, end time.Time, limit, offset int) error {
-	err := zdb.MustGet(ctx).SelectContext(ctx, &h.Stats, `/* Stats.ListLocations */
+func (h *Stats) ListLocations(ctx context.Context, start, end time.Time, filter string, limit, offset int) error {
+	table, args, err := countsTable(ctx, "location_stats", filter, start, end)
+	if err != nil {
+		return errors.Wrap(err, "Stats.ListLocations")
+	}
+
+	db := zdb.MustGet(ctx)
+	err = db.SelectContext(ctx, &h.Stats, db.Rebind(`/* Stats.ListLocations */
 		select
 			iso_3166_1.name as name,
 			sum(count) as count,
 			sum(count_unique) as count_unique
-		from location_stats
+		from `+table+`
 		join iso_3166_1 on iso_3166_1.alpha2=location
-		where site=$1 and day >= $2 and day <= $3
+		where site=? and day >= ? and day <= ?
 		group by location, iso_3166_1.name
 		order by count_unique desc, name asc
-		limit $4 offset $5
-	`, MustGetSite(ctx).ID, start.Format("2006-01-02"), end.Format("2006-01-02"), limit+1, offset)
+		limit ? offset ?
+	`), append(args, MustGetSite(ctx).ID, start.Format("2006-01-02"), end.Format("2006-01-02"), limit+1, offset)...)
 
 	if len(h.Stats) > limit {
 		h.More = true
@@ -229,3 +329,178 @@ func (h *Stats) ListLocations(ctx context.Context, start, end time.Time, limit,
 	}
 	return errors.Wrap(err, "Stats.ListLocations")
 }
+
+// ListLocation lists the regions for one country, by the country name as
+// returned by ListLocations().
+//
+// Pageviews without a region aren't included; see Hit.Region.
+func (h *Stats) ListLocation(ctx context.Context, country string, start, end time.Time, filter string) error {
+	table, args, err := countsTable(ctx, "region_stats", filter, start, end)
+	if err != nil {
+		return errors.Wrap(err, "Stats.ListLocation")
+	}
+
+	db := zdb.MustGet(ctx)
+	err = db.SelectContext(ctx, &h.Stats, db.Rebind(`/* Stats.ListLocation */
+		select
+			region as name,
+			sum(count) as count,
+			sum(count_unique) as count_unique
+		from `+table+`
+		join iso_3166_1 on iso_3166_1.alpha2=location
+		where site=? and day >= ? and day <= ? and iso_3166_1.name=? and region != ''
+		group by region
+		order by count_unique desc, name asc
+	`), append(args, MustGetSite(ctx).ID, start.Format("2006-01-02"), end.Format("2006-01-02"), country)...)
+	return errors.Wrap(err, "Stats.ListLocation")
+}
+
+// ListRegion lists the cities for one ISO 3166-2 region, as returned by
+// ListLocation().
+func (h *Stats) ListRegion(ctx context.Context, region string, start, end time.Time, filter string) error {
+	table, args, err := countsTable(ctx, "city_stats", filter, start, end)
+	if err != nil {
+		return errors.Wrap(err, "Stats.ListRegion")
+	}
+
+	db := zdb.MustGet(ctx)
+	err = db.SelectContext(ctx, &h.Stats, db.Rebind(`/* Stats.ListRegion */
+		select
+			city as name,
+			sum(count) as count,
+			sum(count_unique) as count_unique
+		from `+table+`
+		where site=? and day >= ? and day <= ? and region=? and
+			(region != '' or city != '')
+		group by city
+		order by count_unique desc, name asc
+	`), append(args, MustGetSite(ctx).ID, start.Format("2006-01-02"), end.Format("2006-01-02"), region)...)
+	return errors.Wrap(err, "Stats.ListRegion")
+}
+
+// ListLanguages lists all language statistics for the given time period.
+func (h *Stats) ListLanguages(ctx context.Context, start, end time.Time, filter string, limit, offset int) error {
+	table, args, err := countsTable(ctx, "language_stats", filter, start, end)
+	if err != nil {
+		return errors.Wrap(err, "Stats.ListLanguages")
+	}
+
+	db := zdb.MustGet(ctx)
+	err = db.SelectContext(ctx, &h.Stats, db.Rebind(`/* Stats.ListLanguages */
+		select
+			language as name,
+			sum(count) as count,
+			sum(count_unique) as count_unique
+		from `+table+`
+		where site=? and day >= ? and day <= ?
+		group by language
+		order by count_unique desc, name asc
+		limit ? offset ?
+	`), append(args, MustGetSite(ctx).ID, start.Format("2006-01-02"), end.Format("2006-01-02"), limit+1, offset)...)
+
+	if len(h.Stats) > limit {
+		h.More = true
+		h.Stats = h.Stats[:len(h.Stats)-1]
+	}
+	return errors.Wrap(err, "Stats.ListLanguages")
+}
+
+// ListDimension lists the statistics for a custom dimension for the given time
+// period.
+//
+// This is aggregated from the hits table on demand, rather than stored in a
+// separate stats table.
+func (h *Stats) ListDimension(
+	ctx context.Context, name string, start, end time.Time, filter string, limit, offset int,
+) error {
+	site := MustGetSite(ctx)
+	if _, ok := site.Settings.Dimensions.Get(name); !ok || !validDimension(name) {
+		return guru.Errorf(400, "unknown dimension: %q", name)
+	}
+
+	f, err := ParseFilter(filter)
+	if err != nil {
+		return errors.Wrap(err, "Stats.ListDimension")
+	}
+	where, whereArgs, err := facetSQL(ctx, f, start, end)
+	if err != nil {
+		return errors.Wrap(err, "Stats.ListDimension")
+	}
+
+	var (
+		db   = zdb.MustGet(ctx)
+		args = append([]interface{}{site.ID, start.Format(zdb.Date), end.Format(zdb.Date)}, whereArgs...)
+	)
+
+	// SQLite isn't built with the JSON1 extension, so group the values here.
+	if !cfg.PgSQL {
+		var rows []struct {
+			Dimensions HitDimensions `db:"dimensions"`
+			FirstVisit zdb.Bool      `db:"first_visit"`
+		}
+		err = db.SelectContext(ctx, &rows, db.Rebind(`/* Stats.ListDimension */
+			select dimensions, first_visit from hits
+			where site=? and bot=0 and created_at>=? and created_at<=? `+where), args...)
+		if err != nil {
+			return errors.Wrap(err, "Stats.ListDimension")
+		}
+
+		grouped := make(map[string]*StatT)
+		for _, r := range rows {
+			v := r.Dimensions[name]
+			st, ok := grouped[v]
+			if !ok {
+				st = &StatT{Name: v}
+				grouped[v] = st
+			}
+			st.Count++
+			if r.FirstVisit {
+				st.CountUnique++
+			}
+		}
+
+		stats := make([]StatT, 0, len(grouped))
+		for _, st := range grouped {
+			stats = append(stats, *st)
+		}
+		sort.Slice(stats, func(i, j int) bool {
+			if stats[i].CountUnique != stats[j].CountUnique {
+				return stats[i].CountUnique > stats[j].CountUnique
+			}
+			return stats[i].Name < stats[j].Name
+		})
+		h.paginate(stats, limit, offset)
+		return nil
+	}
+
+	err = db.SelectContext(ctx, &h.Stats, db.Rebind(`/* Stats.ListDimension */
+		select
+			coalesce(dimensions::json->>'`+name+`', '') as name,
+			count(*) as count,
+			coalesce(sum(first_visit), 0) as count_unique
+		from hits
+		where site=? and bot=0 and created_at>=? and created_at<=? `+where+`
+		group by name
+		order by count_unique desc, name asc
+		limit ? offset ?
+	`), append(args, limit+1, offset)...)
+
+	if len(h.Stats) > limit {
+		h.More = true
+		h.Stats = h.Stats[:len(h.Stats)-1]
+	}
+	return errors.Wrap(err, "Stats.ListDimension")
+}
+
+// paginate sets Stats to limit stats from offset, and More if there are more.
+func (h *Stats) paginate(stats []StatT, limit, offset int) {
+	if offset > len(stats) {
+		offset = len(stats)
+	}
+	stats = stats[offset:]
+	if len(stats) > limit {
+		h.More = true
+		stats = stats[:limit]
+	}
+	h.Stats = stats
+}
@@ -14,6 +14,7 @@ import (
 
 	"zgo.at/goatcounter"
 	"zgo.at/goatcounter/gctest"
+	"zgo.at/zdb"
 	"zgo.at/ztest"
 )
 
@@ -291,9 +292,215 @@ func TestHitDefaultsPath(t *testing.T) {
 	}
 }
 
+func TestHitCanonicalPaths(t *testing.T) {
+	all := goatcounter.CanonicalPaths{StripQuery: true, StripSlash: true, Lowercase: true}
+	tests := []struct {
+		set   goatcounter.CanonicalPaths
+		event bool
+		in    string
+		want  string
+	}{
+		{goatcounter.CanonicalPaths{}, false, "/Page/?a=B", "/Page/?a=B"},
+		{goatcounter.CanonicalPaths{StripQuery: true}, false, "/Page/?a=B", "/Page"}, // Defaults() always trims it.
+		{goatcounter.CanonicalPaths{StripSlash: true}, false, "/Page/?a=B", "/Page?a=B"},
+		{goatcounter.CanonicalPaths{Lowercase: true}, false, "/Page/?a=B", "/page/?a=B"},
+		{all, false, "/Page//?a=B", "/page"},
+		{all, false, "/?a=b", "/"},
+		{all, true, "Click/", "Click/"},
+	}
+
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("%d", i), func(t *testing.T) {
+			site := goatcounter.Site{ID: 1}
+			site.Settings.CanonicalPaths = tt.set
+			ctx := goatcounter.WithSite(context.Background(), &site)
+
+			h := goatcounter.Hit{Path: tt.in, Event: zdb.Bool(tt.event)}
+			h.Defaults(ctx)
+			if h.Path != tt.want {
+				t.Errorf("\nout:  %q\nwant: %q", h.Path, tt.want)
+			}
+		})
+	}
+}
+
 func PSP(s *string) string {
 	if s == nil {
 		return "<nil>"
 	}
 	return *s
 }
+
+func TestHitDimensions(t *testing.T) {
+	ctx, clean := gctest.DB(t)
+	defer clean()
+
+	ctx, site := gctest.Site(ctx, t, goatcounter.Site{})
+	err := site.Settings.Dimensions.UnmarshalText([]byte("Tenant, logged_in:bool"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := site.Settings.Dimensions.String(); got != "tenant:string, logged_in:bool" {
+		t.Fatalf("wrong dimensions: %q", got)
+	}
+	err = site.Update(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx = goatcounter.WithSite(ctx, &site)
+
+	now := time.Date(2019, 8, 31, 14, 42, 0, 0, time.UTC)
+	gctest.StoreHits(ctx, t, []goatcounter.Hit{
+		{Site: site.ID, CreatedAt: now, Path: "/a", FirstVisit: true, Dimensions: goatcounter.HitDimensions{"tenant": "x", "logged_in": "1"}},
+		{Site: site.ID, CreatedAt: now, Path: "/b", Dimensions: goatcounter.HitDimensions{"tenant": "x", "logged_in": "no"}},
+		{Site: site.ID, CreatedAt: now, Path: "/c", FirstVisit: true, Dimensions: goatcounter.HitDimensions{"tenant": "y"}},
+		{Site: site.ID, CreatedAt: now, Path: "/d"},
+	}...)
+
+	tests := []struct {
+		name, want string
+	}{
+		{"tenant", "x 2 1; y 1 1;  1 0; "},
+		{"logged_in", " 2 1; true 1 1; false 1 0; "},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stats goatcounter.Stats
+			err := stats.ListDimension(ctx, tt.name, now.Add(-time.Hour), now.Add(time.Hour), "", 10, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got string
+			for _, s := range stats.Stats {
+				got += fmt.Sprintf("%s %d %d; ", s.Name, s.Count, s.CountUnique)
+			}
+			if got != tt.want {
+				t.Errorf("\ngot:  %q\nwant: %q", got, tt.want)
+			}
+		})
+	}
+
+	var stats goatcounter.Stats
+	err = stats.ListDimension(ctx, "unknown", now, now, "", 10, 0)
+	if err == nil {
+		t.Error("no error for unknown dimension")
+	}
+
+	h := goatcounter.Hit{Site: site.ID, Path: "/x", CreatedAt: now,
+		Dimensions: goatcounter.HitDimensions{"nope": "x"}}
+	h.Defaults(ctx)
+	err = h.Validate(ctx)
+	if err == nil {
+		t.Error("no error for unknown dimension in hit")
+	}
+}
+
+func TestHitStatTotalsBehind(t *testing.T) {
+	ctx, clean := gctest.DB(t)
+	defer clean()
+
+	now := time.Date(2020, 6, 18, 14, 42, 0, 0, time.UTC)
+	defer goatcounter.SetClock(goatcounter.NewFixedClock(now))()
+
+	gctest.StoreHits(ctx, t, goatcounter.Hit{Path: "/a", CreatedAt: now.Add(-2 * time.Hour)})
+	gctest.StoreHits(ctx, t, goatcounter.Hit{Path: "/a", CreatedAt: now})
+
+	start, end := now.Add(-24*time.Hour), now.Add(time.Hour)
+	var hs goatcounter.HitStat
+	_, err := hs.Totals(ctx, start, end, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hs.Count != 2 || hs.Updating {
+		t.Fatalf("count: %d; updating: %t", hs.Count, hs.Updating)
+	}
+
+	// Persist without updating the stats.
+	goatcounter.Memstore.Append(
+		goatcounter.Hit{Site: 1, Path: "/b", CreatedAt: now, Session: goatcounter.TestSession},
+		goatcounter.Hit{Site: 1, Path: "/b", CreatedAt: now, Session: goatcounter.TestSession})
+	_, err = goatcounter.Memstore.Persist(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hs = goatcounter.HitStat{}
+	_, err = hs.Totals(ctx, start, end, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hs.Count != 4 || !hs.Updating {
+		t.Errorf("count: %d; updating: %t", hs.Count, hs.Updating)
+	}
+
+	// Not for filters.
+	hs = goatcounter.HitStat{}
+	_, err = hs.Totals(ctx, start, end, "/", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hs.Count != 2 || hs.Updating {
+		t.Errorf("filter: count: %d; updating: %t", hs.Count, hs.Updating)
+	}
+}
+
+func TestHitStatsListRollups(t *testing.T) {
+	ctx, clean := gctest.DB(t)
+	defer clean()
+
+	now := time.Date(2020, 6, 18, 14, 42, 0, 0, time.UTC)
+	defer goatcounter.SetClock(goatcounter.NewFixedClock(now))()
+
+	gctest.StoreHits(ctx, t, []goatcounter.Hit{
+		{Path: "/a", CreatedAt: time.Date(2020, 3, 10, 12, 0, 0, 0, time.UTC), FirstVisit: true},
+		{Path: "/a", CreatedAt: time.Date(2020, 3, 10, 14, 0, 0, 0, time.UTC), FirstVisit: true},
+		{Path: "/a", CreatedAt: time.Date(2020, 3, 10, 16, 0, 0, 0, time.UTC), FirstVisit: true},
+		{Path: "/b", CreatedAt: time.Date(2020, 4, 15, 12, 0, 0, 0, time.UTC), FirstVisit: true},
+		{Path: "/b", CreatedAt: now, FirstVisit: true},
+	}...)
+
+	err := goatcounter.UpdateRollups(ctx, goatcounter.MustGetSite(ctx).ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	err = zdb.MustGet(ctx).SelectContext(ctx, &got, `select period || ' ' || path || ' ' || total
+		from hit_rollups where period != 'u' order by period, hour, path`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "d /a 3|d /b 1|m /a 3|m /b 1"
+	if g := strings.Join(got, "|"); g != want {
+		t.Errorf("\ngot:  %s\nwant: %s", g, want)
+	}
+
+	list := func() string {
+		var stats goatcounter.HitStats
+		_, _, _, err := stats.List(ctx, time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC), now, "", nil, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var paths []string
+		for _, s := range stats {
+			paths = append(paths, s.Path)
+		}
+		return strings.Join(paths, " ")
+	}
+
+	// Only get the first page, which is selected with the rollups.
+	goatcounter.MustGetSite(ctx).Settings.Limits.Page = 1
+	if l := list(); l != "/a" {
+		t.Errorf("wrong page: %s", l)
+	}
+
+	// Make sure the rollups are used to select the page.
+	_, err = zdb.MustGet(ctx).ExecContext(ctx, `update hit_rollups set total_unique=10 where path='/b'`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l := list(); l != "/b" {
+		t.Errorf("wrong page: %s", l)
+	}
+}
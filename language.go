@@ -0,0 +1,57 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"strconv"
+	"strings"
+)
+
+// ParseLanguage gets the preferred language from an Accept-Language header as
+// the lower-case primary language tag, e.g. "en" for "en-US,en;q=0.9,de;q=0.8".
+//
+// It returns "" if there is no valid language.
+func ParseLanguage(accept string) string {
+	var (
+		best  string
+		bestQ = 0.0
+	)
+	for _, l := range strings.Split(accept, ",") {
+		l = strings.TrimSpace(l)
+		q := 1.0
+		if i := strings.IndexByte(l, ';'); i > -1 {
+			p := strings.TrimSpace(l[i+1:])
+			l = strings.TrimSpace(l[:i])
+			if strings.HasPrefix(p, "q=") {
+				var err error
+				q, err = strconv.ParseFloat(p[2:], 64)
+				if err != nil {
+					continue
+				}
+			}
+		}
+		if i := strings.IndexAny(l, "-_"); i > -1 {
+			l = l[:i]
+		}
+		if q > bestQ && validLanguage(l) {
+			best, bestQ = strings.ToLower(l), q
+		}
+	}
+	return best
+}
+
+// validLanguage reports if l is a two or three letter language code; this
+// also excludes "*".
+func validLanguage(l string) bool {
+	if len(l) < 2 || len(l) > 3 {
+		return false
+	}
+	for _, c := range l {
+		if !(c >= 'a' && c <= 'z') && !(c >= 'A' && c <= 'Z') {
+			return false
+		}
+	}
+	return true
+}
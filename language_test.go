@@ -0,0 +1,41 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter_test
+
+import (
+	"testing"
+
+	"zgo.at/goatcounter"
+)
+
+func TestParseLanguage(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"", ""},
+		{"*", ""},
+		{"en", "en"},
+		{"en-US", "en"},
+		{"EN_gb", "en"},
+		{"en-US,en;q=0.9,de;q=0.8", "en"},
+		{"de;q=0.5, nl", "nl"},
+		{"*, fr;q=0.8", "fr"},
+		{"fr;q=0", ""},
+		{"fr;q=x, es", "es"},
+		{"zh-Hant-TW", "zh"},
+		{"fil-PH", "fil"},
+		{"x-klingon, de", "de"},
+		{"english", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			out := goatcounter.ParseLanguage(tt.in)
+			if out != tt.want {
+				t.Errorf("\nout:  %q\nwant: %q", out, tt.want)
+			}
+		})
+	}
+}
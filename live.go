@@ -0,0 +1,200 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/zdb"
+	"zgo.at/zstd/zint"
+)
+
+// LivePeriod is the period for LiveStats.
+const LivePeriod = 5 * time.Minute
+
+// LiveStats are the visitors "right now": the unique sessions and pageviews in
+// the last LivePeriod.
+type LiveStats struct {
+	Since     time.Time  `json:"since"`
+	Visitors  int        `json:"visitors"`
+	Pageviews int        `json:"pageviews"`
+	Pages     []LivePage `json:"pages"`
+}
+
+// LivePage is the number of unique sessions for a path.
+type LivePage struct {
+	Path     string `json:"path"`
+	Visitors int    `json:"visitors"`
+}
+
+// Get the live stats.
+//
+// This is calculated from the pageviews kept in memory by liveWindow and the
+// hits in the Memstore that haven't been persisted yet, rather than the stats
+// tables as those are only updated every few minutes.
+func (l *LiveStats) Get(ctx context.Context, limit int) error {
+	site := MustGetSite(ctx)
+	l.Since = Now().Add(-LivePeriod).UTC()
+
+	hits, err := liveHits.get(ctx, site.ID, l.Since)
+	if err != nil {
+		return errors.Wrap(err, "LiveStats.Get")
+	}
+
+	var (
+		sessions = make(map[string]struct{})
+		paths    = make(map[string]map[string]struct{})
+		add      = func(path, session string) {
+			l.Pageviews++
+			sessions[session] = struct{}{}
+			if paths[path] == nil {
+				paths[path] = make(map[string]struct{})
+			}
+			paths[path][session] = struct{}{}
+		}
+	)
+	for _, h := range hits {
+		add(h.Path, h.Session.Format(16))
+	}
+	for _, h := range Memstore.recent(ctx, site.ID, l.Since) {
+		add(h.Path, h.Session.Format(16))
+	}
+
+	l.Visitors = len(sessions)
+	l.Pages = make([]LivePage, 0, len(paths))
+	for p, s := range paths {
+		l.Pages = append(l.Pages, LivePage{Path: p, Visitors: len(s)})
+	}
+	sort.Slice(l.Pages, func(i, j int) bool {
+		if l.Pages[i].Visitors == l.Pages[j].Visitors {
+			return l.Pages[i].Path < l.Pages[j].Path
+		}
+		return l.Pages[i].Visitors > l.Pages[j].Visitors
+	})
+	if limit > 0 && len(l.Pages) > limit {
+		l.Pages = l.Pages[:limit]
+	}
+	return nil
+}
+
+type liveHit struct {
+	Path      string       `db:"path"`
+	Session   zint.Uint128 `db:"session2"`
+	CreatedAt time.Time    `db:"created_at"`
+}
+
+// liveWindow keeps the pageviews of the last LivePeriod for every site in
+// memory, so that the live stats don't need to query the hits table every
+// time. New pageviews are added by Memstore.Persist(), and the pageviews for a
+// site are loaded from the hits table the first time they're requested.
+//
+// This only sees the pageviews persisted by this process.
+type liveWindow struct {
+	mu     sync.Mutex
+	hits   map[int64][]liveHit
+	loaded map[int64]struct{}
+}
+
+var liveHits = liveWindow{hits: make(map[int64][]liveHit), loaded: make(map[int64]struct{})}
+
+func (w *liveWindow) reset() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.hits, w.loaded = make(map[int64][]liveHit), make(map[int64]struct{})
+}
+
+// add a persisted pageview; this is ignored for sites that weren't loaded yet,
+// and for pageviews that are already too old.
+func (w *liveWindow) add(h Hit) {
+	since := Now().Add(-LivePeriod)
+	if h.Bot > 0 || bool(h.Event) || h.CreatedAt.Before(since) {
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, ok := w.loaded[h.Site]; !ok {
+		return
+	}
+	w.hits[h.Site] = append(w.prune(h.Site, since),
+		liveHit{Path: h.Path, Session: h.Session, CreatedAt: h.CreatedAt})
+}
+
+// prune removes everything before since; must hold the lock.
+func (w *liveWindow) prune(siteID int64, since time.Time) []liveHit {
+	hits := w.hits[siteID]
+	if len(hits) == 0 || !hits[0].CreatedAt.Before(since) {
+		return hits
+	}
+
+	keep := hits[:0]
+	for _, h := range hits {
+		if !h.CreatedAt.Before(since) {
+			keep = append(keep, h)
+		}
+	}
+	w.hits[siteID] = keep
+	return keep
+}
+
+// get a copy of all pageviews for the site since the given time, loading them
+// from the hits table if this is the first time.
+func (w *liveWindow) get(ctx context.Context, siteID int64, since time.Time) ([]liveHit, error) {
+	w.mu.Lock()
+	_, ok := w.loaded[siteID]
+	if !ok {
+		// Set before loading, so nothing persisted in the meanwhile is lost.
+		w.loaded[siteID] = struct{}{}
+	}
+	w.mu.Unlock()
+
+	if !ok {
+		var hits []liveHit
+		err := zdb.MustGet(ctx).SelectContext(ctx, &hits, `/* liveWindow.get */
+			select path, session2, created_at from hits
+			where site=$1 and bot=0 and event=0 and created_at>=$2`,
+			siteID, Now().Add(-LivePeriod).UTC().Format(zdb.Date))
+		if err != nil {
+			w.mu.Lock()
+			delete(w.loaded, siteID)
+			w.mu.Unlock()
+			return nil, err
+		}
+
+		w.mu.Lock()
+		type key struct {
+			path    string
+			session zint.Uint128
+			at      int64
+		}
+		have := make(map[key]struct{}, len(w.hits[siteID]))
+		for _, h := range w.hits[siteID] {
+			have[key{h.Path, h.Session, h.CreatedAt.Unix()}] = struct{}{}
+		}
+		for _, h := range hits {
+			if _, ok := have[key{h.Path, h.Session, h.CreatedAt.Unix()}]; !ok {
+				w.hits[siteID] = append(w.hits[siteID], h)
+			}
+		}
+		sort.Slice(w.hits[siteID], func(i, j int) bool {
+			return w.hits[siteID][i].CreatedAt.Before(w.hits[siteID][j].CreatedAt)
+		})
+		w.mu.Unlock()
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var cp []liveHit
+	for _, h := range w.prune(siteID, since) {
+		if !h.CreatedAt.Before(since) {
+			cp = append(cp, h)
+		}
+	}
+	return cp, nil
+}
@@ -7,14 +7,19 @@ package goatcounter
 import (
 	"context"
 	"crypto/sha256"
+	"database/sql"
 	"encoding/json"
 	"fmt"
 	"net/url"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/lib/pq"
+	"zgo.at/errors"
+	"zgo.at/goatcounter/cfg"
 	"zgo.at/zdb"
 	"zgo.at/zdb/bulk"
 	"zgo.at/zhttp"
@@ -40,12 +45,41 @@ type ms struct {
 	curSalt       []byte
 	prevSalt      []byte
 	saltRotated   time.Time
+	saltKey       []byte
+	saltDB        zdb.DB
+	ephemeralSalt bool
+
+	shared    bool
+	sharedDB  zdb.DB
+	sharedLen int64 // Approximate number of rows in shared_hits; use atomic.
+
+	batch int
+
+	spoolMu   sync.Mutex
+	spoolPath string
+
+	card cardinality
 
 	testHook bool
 }
 
 var Memstore ms
 
+// Session salt rotation schedule.
+//
+// SaltRotation can be set with the -salt-rotation flag: a shorter period makes
+// it harder to link pageviews of the same visitor, but visitors who are
+// inactive for longer than this will be counted as a new visit.
+//
+// Sessions matched with the previous salt are moved to the current salt, so
+// visitors keep their session across rotations as long as the previous salt is
+// accepted. Sessions are evicted after 4 hours of inactivity, so there is no
+// point in accepting the previous salt for longer than that.
+var (
+	SaltRotation    = 4 * time.Hour // Rotate salts this often.
+	SaltGracePeriod = 4 * time.Hour // Accept the previous salt for this long after rotating.
+)
+
 type storedSession struct {
 	Sessions    map[string]zint.Uint128              `json:"sessions"`
 	Hashes      map[zint.Uint128]string              `json:"hashes"`
@@ -67,6 +101,8 @@ func (m *ms) Reset() {
 	m.curSalt = []byte(zhttp.Secret256())
 	m.prevSalt = []byte(zhttp.Secret256())
 	m.saltRotated = Now()
+	m.card.reset()
+	liveHits.reset()
 	TestSeqSession = zint.Uint128{H: TestSession.H, L: TestSession.L + 1}
 }
 
@@ -85,6 +121,39 @@ func (m *ms) Init(db zdb.DB) error {
 	m.sessionMu.Lock()
 	defer m.sessionMu.Unlock()
 
+	err := m.loadSessions(db)
+	if err != nil {
+		return err
+	}
+
+	m.sharedDB = nil
+	if m.shared {
+		if m.saltKey == nil {
+			return fmt.Errorf("Memstore.Init: a shared memstore needs a salt key")
+		}
+		m.sharedDB = db
+
+		// Start with the hits left by other instances or before a restart;
+		// after this it's kept as a counter.
+		var n int64
+		err := db.GetContext(context.Background(), &n, `select count(*) from shared_hits`)
+		if err != nil {
+			return fmt.Errorf("Memstore.Init: %w", err)
+		}
+		atomic.StoreInt64(&m.sharedLen, n)
+	}
+
+	if m.saltKey != nil {
+		m.saltDB = db
+		err := m.loadSalt(db)
+		if err != nil {
+			return fmt.Errorf("Memstore.Init: %w", err)
+		}
+	}
+	return nil
+}
+
+func (m *ms) loadSessions(db zdb.DB) error {
 	var s []byte
 	err := db.GetContext(context.Background(), &s,
 		`select value from store where key='session'`)
@@ -113,14 +182,16 @@ func (m *ms) Init(db zdb.DB) error {
 	if stored.Seen != nil {
 		m.sessionSeen = stored.Seen
 	}
-	if len(stored.CurSalt) > 0 {
-		m.curSalt = stored.CurSalt
-	}
-	if len(stored.PrevSalt) > 0 {
-		m.prevSalt = stored.PrevSalt
-	}
-	if !stored.SaltRotated.IsZero() {
-		m.saltRotated = stored.SaltRotated
+	if !m.ephemeralSalt {
+		if len(stored.CurSalt) > 0 {
+			m.curSalt = stored.CurSalt
+		}
+		if len(stored.PrevSalt) > 0 {
+			m.prevSalt = stored.PrevSalt
+		}
+		if !stored.SaltRotated.IsZero() {
+			m.saltRotated = stored.SaltRotated
+		}
 	}
 
 	_, err = db.ExecContext(context.Background(), `delete from store where key='session'`)
@@ -131,32 +202,57 @@ func (m *ms) Init(db zdb.DB) error {
 	return nil
 }
 
+// StoreSessions stores the sessions in the database, so they're not lost on
+// restarts or crashes. This is called on shutdown and periodically.
 func (m *ms) StoreSessions(db zdb.DB) {
+	if m.shared { // Already in the DB.
+		return
+	}
+
 	m.sessionMu.Lock()
 	defer m.sessionMu.Unlock()
 
-	d, err := json.Marshal(storedSession{
-		Sessions:    m.sessions,
-		Paths:       m.sessionPaths,
-		Seen:        m.sessionSeen,
-		Hashes:      m.sessionHashes,
-		CurSalt:     m.curSalt,
-		PrevSalt:    m.prevSalt,
-		SaltRotated: m.saltRotated,
-	})
+	stored := storedSession{
+		Sessions: m.sessions,
+		Paths:    m.sessionPaths,
+		Seen:     m.sessionSeen,
+		Hashes:   m.sessionHashes,
+	}
+	// Salts are stored encrypted with persistSalt() if there's a key.
+	if m.saltKey == nil && !m.ephemeralSalt {
+		stored.CurSalt, stored.PrevSalt, stored.SaltRotated = m.curSalt, m.prevSalt, m.saltRotated
+	}
+
+	d, err := json.Marshal(stored)
 	if err != nil {
 		zlog.Error(err)
 		return
 	}
 
-	_, err = db.ExecContext(context.Background(),
-		`insert into store (key, value) values ('session', $1)`, d)
+	// This is also called periodically, so replace the existing value.
+	err = zdb.TX(zdb.With(context.Background(), db), func(ctx context.Context, db zdb.DB) error {
+		_, err := db.ExecContext(ctx, `delete from store where key='session'`)
+		if err != nil {
+			return err
+		}
+		_, err = db.ExecContext(ctx, `insert into store (key, value) values ('session', $1)`, d)
+		return err
+	})
 	if err != nil {
 		zlog.Error(err)
 	}
 }
 
 func (m *ms) Append(hits ...Hit) {
+	if m.sharedDB != nil {
+		err := m.appendShared(hits)
+		if err == nil {
+			return
+		}
+		// Keep them in memory, rather than losing them.
+		zlog.Module("memstore").Error(err)
+	}
+
 	m.hitMu.Lock()
 	m.hits = append(m.hits, hits...)
 	m.hitMu.Unlock()
@@ -166,32 +262,192 @@ func (m *ms) Len() int {
 	m.hitMu.Lock()
 	l := len(m.hits)
 	m.hitMu.Unlock()
+	if m.sharedDB != nil {
+		l += m.lenShared()
+	}
 	return l
 }
 
+// recent gets copies of the pageviews for this site that haven't been persisted
+// yet, with the path cleaned and the session set.
+//
+// Sessions are normally assigned in Persist(); this doesn't create any new
+// sessions but uses the session hash as a stand-in.
+func (m *ms) recent(ctx context.Context, siteID int64, since time.Time) []Hit {
+	m.hitMu.RLock()
+	var hits []Hit
+	for _, h := range m.hits {
+		if h.Site == siteID && h.Ping == 0 && !bool(h.Event) && h.Bot == 0 && !h.CreatedAt.Before(since) {
+			hits = append(hits, h)
+		}
+	}
+	m.hitMu.RUnlock()
+	if m.sharedDB != nil {
+		for _, h := range m.recentShared(siteID, since) {
+			if h.Ping == 0 && !h.Event && h.Bot == 0 {
+				hits = append(hits, h)
+			}
+		}
+	}
+
+	for i := range hits {
+		// Resolve the session before Defaults(), as that may strip the
+		// User-Agent it's hashed from.
+		if hits[i].Session.IsZero() {
+			id, ok := m.existingSession(siteID, hits[i].Browser, hits[i].RemoteAddr)
+			if !ok {
+				m.sessionMu.RLock()
+				hash := sessionHash(m.curSalt, siteID, hits[i].Browser, hits[i].RemoteAddr)
+				m.sessionMu.RUnlock()
+				id, _ = zint.NewUint128([]byte(hash)[:16])
+			}
+			hits[i].Session = id
+		}
+		hits[i].Defaults(ctx)
+	}
+	return hits
+}
+
+// erase removes the hits for this site that haven't been persisted yet and for
+// which match returns true, and returns the removed hits.
+//
+// The session is looked up for hits that don't have one yet, but isn't
+// created.
+func (m *ms) erase(siteID int64, match func(h Hit) bool) ([]Hit, error) {
+	withSession := func(h Hit) Hit {
+		if h.Session.IsZero() {
+			h.Session, _ = m.existingSession(siteID, h.Browser, h.RemoteAddr)
+		}
+		return h
+	}
+
+	// Don't hold hitMu while looking up the sessions; anything that's appended
+	// in the meantime is added after the kept hits.
+	m.hitMu.Lock()
+	hits := m.hits
+	m.hits = nil
+	m.hitMu.Unlock()
+
+	var (
+		keep   = make([]Hit, 0, len(hits))
+		erased []Hit
+	)
+	for _, h := range hits {
+		if h.Site == siteID && match(withSession(h)) {
+			erased = append(erased, h)
+			continue
+		}
+		keep = append(keep, h)
+	}
+	m.hitMu.Lock()
+	m.hits = append(keep, m.hits...)
+	m.hitMu.Unlock()
+
+	if m.sharedDB != nil {
+		e, err := m.eraseShared(siteID, func(h Hit) bool { return match(withSession(h)) })
+		if err != nil {
+			return erased, err
+		}
+		erased = append(erased, e...)
+	}
+	return erased, nil
+}
+
+// SetBatch sets the maximum number of hits to persist in one Persist() call;
+// any remaining hits are kept for the next call. 0 means there is no limit.
+//
+// This must be called before Init().
+func (m *ms) SetBatch(n int) {
+	m.batch = n
+}
+
 func (m *ms) Persist(ctx context.Context) ([]Hit, error) {
-	if m.Len() == 0 {
-		return nil, nil
+	ctx, span := StartSpan(ctx, "Memstore.Persist")
+	hits, err := m.persist(ctx)
+	span.SetAttribute("hits", len(hits))
+	span.End(err)
+	return hits, err
+}
+
+func (m *ms) persist(ctx context.Context) ([]Hit, error) {
+	if m.spoolPath != "" {
+		// Write everything to the spool file if the database is down, rather
+		// than keep it in memory where it's lost if we're stopped.
+		if err := dbAvailable(ctx); err != nil {
+			m.hitMu.Lock()
+			hits := m.hits
+			m.hits = []Hit{}
+			m.hitMu.Unlock()
+			if err := m.spool(hits); err != nil {
+				m.hitMu.Lock()
+				m.hits = append(hits, m.hits...)
+				m.hitMu.Unlock()
+				zlog.Module("memstore").Error(err)
+			}
+			return nil, fmt.Errorf("Memstore.Persist: %w", err)
+		}
+
+		spooled, err := m.unspool()
+		if err != nil {
+			zlog.Module("memstore").Error(err)
+		}
+		if len(spooled) > 0 {
+			m.hitMu.Lock()
+			m.hits = append(spooled, m.hits...)
+			m.hitMu.Unlock()
+		}
+	}
+
+	if m.sharedDB != nil {
+		for i := 0; i < sharedMaxBatches; i++ {
+			shared, err := m.takeShared()
+			if err != nil {
+				return nil, err
+			}
+			m.hitMu.Lock()
+			m.hits = append(m.hits, shared...)
+			full := m.batch > 0 && len(m.hits) >= m.batch
+			m.hitMu.Unlock()
+			if len(shared) < sharedBatch || full {
+				break
+			}
+		}
 	}
 
 	m.hitMu.Lock()
-	hits := make([]Hit, len(m.hits))
-	copy(hits, m.hits)
+	if len(m.hits) == 0 {
+		m.hitMu.Unlock()
+		return nil, nil
+	}
+	take := m.hits
 	m.hits = []Hit{}
+	if m.batch > 0 && len(take) > m.batch {
+		take, m.hits = take[:m.batch], append(m.hits, take[m.batch:]...)
+	}
+	hits := make([]Hit, 0, len(take))
+	var pings []Hit
+	for _, h := range take {
+		if h.Ping > 0 {
+			pings = append(pings, h)
+			continue
+		}
+		hits = append(hits, h)
+	}
 	m.hitMu.Unlock()
 
 	sites := make(map[int64]*Site)
 
 	l := zlog.Module("memstore")
 
-	ins := bulk.NewInsert(ctx, "hits", []string{"site", "path", "ref",
-		"ref_scheme", "browser", "size", "location", "created_at", "bot",
-		"title", "event", "session2", "first_visit"})
+	var (
+		valid = make([]int, 0, len(hits))
+		retry []int
+	)
 	for i, h := range hits {
 		// Ignore spammers.
 		h.RefURL, _ = url.Parse(h.Ref)
 		if h.RefURL != nil {
-			if _, ok := refspam[h.RefURL.Host]; ok {
+			if IsRefspam(h.RefURL.Host) {
 				l.Debugf("refspam ignored: %q", h.RefURL.Host)
 				continue
 			}
@@ -209,6 +465,11 @@ func (m *ms) Persist(ctx context.Context) ([]Hit, error) {
 		}
 		ctx = WithSite(ctx, site)
 
+		if h.RefURL != nil && site.Settings.IgnoreRef(h.RefURL.Host) {
+			l.Debugf("ignored referrer for site %d: %q", site.ID, h.RefURL.Host)
+			continue
+		}
+
 		if h.Session.IsZero() {
 			h.Session, h.FirstVisit = m.session(ctx, site.ID, h.Path, h.Browser, h.RemoteAddr)
 		}
@@ -221,17 +482,206 @@ func (m *ms) Persist(ctx context.Context) ([]Hit, error) {
 			continue
 		}
 
+		err = m.card.apply(ctx, &h)
+		if err != nil {
+			l.Field("hit", h).Error(err)
+		}
+
 		// Some values are sanitized in Hit.Defaults(), make sure this is
 		// reflected in the hits object too, which matters for the hit_stats
 		// generation later.
 		hits[i] = h
 
-		ins.Values(h.Site, h.Path, h.Ref, h.RefScheme, h.Browser, h.Size,
-			h.Location, h.CreatedAt.Format(zdb.Date), h.Bot, h.Title, h.Event,
-			h.Session, h.FirstVisit)
+		p := Path{Site: h.Site, Path: h.Path, Title: h.Title, Event: h.Event}
+		err = p.GetOrInsert(ctx)
+		if err != nil {
+			// Try again on the next run, rather than losing the pageview.
+			l.Field("hit", h).Error(err)
+			retry = append(retry, i)
+			continue
+		}
+		hits[i].PathID = &p.ID
+		valid = append(valid, i)
+	}
+
+	ins := make([]Hit, 0, len(valid))
+	for _, i := range valid {
+		ins = append(ins, hits[i])
+	}
+	err := insertHits(ctx, ins)
+	if err != nil {
+		if m.spoolPath != "" {
+			if err := m.spool(take); err != nil {
+				zlog.Module("memstore").Error(err)
+			}
+		}
+		return hits, err
+	}
+	for _, i := range valid {
+		HitStream.publish(hits[i])
+		liveHits.add(hits[i])
+	}
+
+	if len(retry) > 0 {
+		r := make([]Hit, 0, len(retry))
+		for _, i := range retry {
+			r = append(r, hits[i])
+		}
+		m.hitMu.Lock()
+		m.hits = append(r, m.hits...)
+		m.hitMu.Unlock()
+
+		// Don't return them, as the statistics would be updated twice.
+		keep := make([]Hit, 0, len(hits)-len(retry))
+		for i, h := range hits {
+			if len(retry) > 0 && retry[0] == i {
+				retry = retry[1:]
+				continue
+			}
+			keep = append(keep, h)
+		}
+		hits = keep
+	}
+
+	// Pings are after the hits, as the pageview they're for may be in this
+	// batch. An error here shouldn't prevent the stats for the hits from being
+	// updated, so just log it.
+	err = m.persistPings(ctx, sites, pings)
+	if err != nil {
+		l.Error(err)
+	}
+	return hits, nil
+}
+
+var hitColumns = []string{"site", "path", "ref", "ref_scheme", "browser",
+	"size", "location", "created_at", "bot", "title", "event", "session2",
+	"first_visit", "dimensions", "path_id", "region", "city", "language"}
+
+// insertHits inserts the hits with COPY on PostgreSQL, and with multi-row
+// inserts on SQLite.
+func insertHits(ctx context.Context, hits []Hit) error {
+	if len(hits) == 0 {
+		return nil
+	}
+	if !cfg.PgSQL {
+		ins := bulk.NewInsert(ctx, "hits", hitColumns)
+		for _, h := range hits {
+			ins.Values(h.Site, h.Path, h.Ref, h.RefScheme, h.Browser, h.Size,
+				h.Location, h.CreatedAt.Format(zdb.Date), h.Bot, h.Title, h.Event,
+				h.Session, h.FirstVisit, h.Dimensions, h.PathID, h.Region, h.City,
+				h.Language)
+		}
+		return ins.Finish()
+	}
+
+	err := zdb.TX(ctx, func(ctx context.Context, db zdb.DB) error {
+		tx, ok := db.(interface {
+			PrepareContext(context.Context, string) (*sql.Stmt, error)
+		})
+		if !ok {
+			return fmt.Errorf("can't prepare statement on %T", db)
+		}
+		stmt, err := tx.PrepareContext(ctx, pq.CopyIn("hits", hitColumns...))
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+
+		for _, h := range hits {
+			// COPY sends []byte as bytea, so send the dimensions as a string
+			// as it's a varchar column.
+			var dims *string
+			if len(h.Dimensions) > 0 {
+				j, err := json.Marshal(h.Dimensions)
+				if err != nil {
+					return err
+				}
+				d := string(j)
+				dims = &d
+			}
+
+			_, err = stmt.ExecContext(ctx, h.Site, h.Path, h.Ref, h.RefScheme,
+				h.Browser, h.Size, h.Location, h.CreatedAt.Format(zdb.Date), h.Bot,
+				h.Title, h.Event, h.Session, h.FirstVisit, dims, h.PathID, h.Region,
+				h.City, h.Language)
+			if err != nil {
+				return err
+			}
+		}
+
+		// Flush the buffered rows.
+		_, err = stmt.ExecContext(ctx)
+		return err
+	})
+	return errors.Wrap(err, "insertHits")
+}
+
+// persistPings sets the duration for the pageviews the engagement pings are
+// for: the most recent pageview of the path in the same session.
+func (m *ms) persistPings(ctx context.Context, sites map[int64]*Site, pings []Hit) error {
+	if len(pings) == 0 {
+		return nil
+	}
+
+	type (
+		key struct {
+			site    int64
+			session zint.Uint128
+			path    string
+		}
+		val struct {
+			dur int64
+			at  time.Time
+		}
+	)
+
+	// Pings are sent periodically, so only the last (longest) one matters.
+	l := zlog.Module("memstore")
+	durs := make(map[key]val)
+	for _, p := range pings {
+		site, ok := sites[p.Site]
+		if !ok {
+			site = new(Site)
+			err := site.ByID(ctx, p.Site)
+			if err != nil {
+				l.Field("ping", p).Error(err)
+				continue
+			}
+			sites[p.Site] = site
+		}
+
+		if p.Session.IsZero() {
+			p.Session, ok = m.existingSession(site.ID, p.Browser, p.RemoteAddr)
+			if !ok { // Session expired, or never had a pageview.
+				continue
+			}
+		}
+		p.Defaults(WithSite(ctx, site))
+
+		k := key{site.ID, p.Session, p.Path}
+		if p.Ping > durs[k].dur {
+			durs[k] = val{p.Ping, p.CreatedAt}
+		}
 	}
 
-	return hits, ins.Finish()
+	db := zdb.MustGet(ctx)
+	for k, v := range durs {
+		// The pageview should be about v.dur seconds before the ping; allow
+		// some leeway as the browser timers aren't exact.
+		since := v.at.Add(-time.Duration(v.dur)*time.Second - 10*time.Minute)
+		_, err := db.ExecContext(ctx, `/* Memstore.persistPings */
+			update hits set duration=$1 where id=(
+				select id from hits
+				where site=$2 and session2=$3 and path=$4 and event=0 and created_at>=$5
+				order by created_at desc
+				limit 1
+			) and (duration is null or duration<$1)`,
+			v.dur, k.site, k.session, k.path, since.Format(zdb.Date))
+		if err != nil {
+			return fmt.Errorf("Memstore.persistPings: %w", err)
+		}
+	}
+	return nil
 }
 
 func (m *ms) GetSalt() (cur []byte, prev []byte) {
@@ -244,18 +694,75 @@ func (m *ms) RefreshSalt() {
 	m.sessionMu.Lock()
 	defer m.sessionMu.Unlock()
 
-	if m.saltRotated.Add(4 * time.Hour).After(Now()) {
+	if m.saltRotated.Add(SaltRotation).After(Now()) {
 		return
 	}
 
+	// Another instance may have rotated it already.
+	if m.shared && m.saltDB != nil {
+		err := m.loadSalt(m.saltDB)
+		if err != nil {
+			zlog.Module("memstore").Error(err)
+		}
+		if m.saltRotated.Add(SaltRotation).After(Now()) {
+			return
+		}
+	}
+
 	m.prevSalt = m.curSalt[:]
 	m.curSalt = []byte(zhttp.Secret256())
+	m.saltRotated = Now()
+
+	if m.saltDB != nil {
+		err := m.persistSalt(m.saltDB)
+		if err != nil {
+			zlog.Module("memstore").Error(err)
+		}
+	}
+}
+
+// inSaltGrace reports if the previous salt is still accepted; sessionMu must be
+// held.
+func (m *ms) inSaltGrace() bool {
+	return m.saltRotated.Add(SaltGracePeriod).After(Now())
+}
+
+// SaltSchedule is the current state of the session salt rotation.
+type SaltSchedule struct {
+	Rotated      time.Time `json:"rotated"`
+	NextRotation time.Time `json:"next_rotation"`
+	GraceUntil   time.Time `json:"grace_until"`
+	Sessions     int       `json:"sessions"`
+}
+
+// SaltSchedule gets the salt rotation schedule and number of active sessions.
+func (m *ms) SaltSchedule() SaltSchedule {
+	m.sessionMu.RLock()
+	s := SaltSchedule{
+		Rotated:      m.saltRotated,
+		NextRotation: m.saltRotated.Add(SaltRotation),
+		GraceUntil:   m.saltRotated.Add(SaltGracePeriod),
+		Sessions:     len(m.sessions),
+	}
+	m.sessionMu.RUnlock()
+	if m.sharedDB != nil {
+		s.Sessions = m.countShared()
+	}
+	return s
 }
 
 // For 10k sessions this takes about 5ms on my laptop; that's a small enough
 // delay to not overly worry about (there are rarely more than a few hundred
 // sessions at a time).
 func (m *ms) EvictSessions() {
+	if m.sharedDB != nil {
+		err := m.evictShared(Now().Add(-4 * time.Hour))
+		if err != nil {
+			zlog.Module("memstore").Error(err)
+		}
+		return
+	}
+
 	m.sessionMu.Lock()
 	defer m.sessionMu.Unlock()
 
@@ -294,22 +801,54 @@ func (m *ms) SessionID() zint.Uint128 {
 	return i
 }
 
-func (m *ms) session(ctx context.Context, siteID int64, path, ua, remoteAddr string) (zint.Uint128, zdb.Bool) {
+func sessionHash(salt []byte, siteID int64, ua, remoteAddr string) string {
 	h := sha256.New()
-	h.Write(append(append(append(m.curSalt, ua...), remoteAddr...), strconv.FormatInt(siteID, 10)...))
-	hash := string(h.Sum(nil))
+	h.Write(append(append(append(salt, ua...), remoteAddr...), strconv.FormatInt(siteID, 10)...))
+	return string(h.Sum(nil))
+}
+
+// existingSession gets the session ID, without creating a new session if there
+// isn't one.
+func (m *ms) existingSession(siteID int64, ua, remoteAddr string) (zint.Uint128, bool) {
+	if m.sharedDB != nil {
+		return m.existingSessionShared(siteID, ua, remoteAddr)
+	}
+
+	m.sessionMu.Lock()
+	defer m.sessionMu.Unlock()
+
+	id, ok := m.sessions[sessionHash(m.curSalt, siteID, ua, remoteAddr)]
+	if !ok && m.inSaltGrace() {
+		id, ok = m.sessions[sessionHash(m.prevSalt, siteID, ua, remoteAddr)]
+	}
+	return id, ok
+}
+
+func (m *ms) session(ctx context.Context, siteID int64, path, ua, remoteAddr string) (zint.Uint128, zdb.Bool) {
+	if m.sharedDB != nil {
+		id, first, err := m.sessionShared(siteID, path, ua, remoteAddr)
+		if err == nil {
+			return id, first
+		}
+		// Count it as a new visitor, rather than losing the pageview.
+		zlog.Module("memstore").Error(err)
+		return m.SessionID(), true
+	}
 
 	m.sessionMu.Lock()
 	defer m.sessionMu.Unlock()
 
+	hash := sessionHash(m.curSalt, siteID, ua, remoteAddr)
 	id, ok := m.sessions[hash]
-	if !ok { // Try previous hash
-		h := sha256.New()
-		h.Write(append(append(append(m.prevSalt, ua...), remoteAddr...), strconv.FormatInt(siteID, 10)...))
-		prevHash := string(h.Sum(nil))
+	if !ok && m.inSaltGrace() { // Try previous hash
+		prevHash := sessionHash(m.prevSalt, siteID, ua, remoteAddr)
 		id, ok = m.sessions[prevHash]
 		if ok {
-			hash = prevHash
+			// Move to the current salt, so that it's still found after the
+			// next rotation.
+			delete(m.sessions, prevHash)
+			m.sessions[hash] = id
+			m.sessionHashes[id] = hash
 		}
 	}
 
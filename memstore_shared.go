@@ -0,0 +1,405 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"zgo.at/zdb"
+	"zgo.at/zlog"
+	"zgo.at/zstd/zint"
+)
+
+// How many queued hits to take from the database at a time, and the maximum
+// number of batches to persist in one Persist() call.
+const (
+	sharedBatch      = 500
+	sharedMaxBatches = 100
+)
+
+// queuedHit is a Hit as stored in the shared_hits table; most fields aren't in
+// the JSON representation of Hit, so we can't use that.
+type queuedHit struct {
+	Site       int64         `json:"site"`
+	SessionH   uint64        `json:"session_h,omitempty"`
+	SessionL   uint64        `json:"session_l,omitempty"`
+	Path       string        `json:"path"`
+	Title      string        `json:"title,omitempty"`
+	Ref        string        `json:"ref,omitempty"`
+	RefScheme  *string       `json:"ref_scheme,omitempty"`
+	Event      zdb.Bool      `json:"event,omitempty"`
+	Size       zdb.Floats    `json:"size,omitempty"`
+	Query      string        `json:"query,omitempty"`
+	Bot        int           `json:"bot,omitempty"`
+	Dimensions HitDimensions `json:"dimensions,omitempty"`
+	Browser    string        `json:"browser,omitempty"`
+	Location   string        `json:"location,omitempty"`
+	Region     string        `json:"region,omitempty"`
+	City       string        `json:"city,omitempty"`
+	Language   string        `json:"language,omitempty"`
+	FirstVisit zdb.Bool      `json:"first_visit,omitempty"`
+	CreatedAt  time.Time     `json:"created_at"`
+	Ping       int64         `json:"ping,omitempty"`
+	RemoteAddr string        `json:"remote_addr,omitempty"`
+}
+
+func (q queuedHit) hit() Hit {
+	return Hit{
+		Site:       q.Site,
+		Session:    zint.Uint128{H: q.SessionH, L: q.SessionL},
+		Path:       q.Path,
+		Title:      q.Title,
+		Ref:        q.Ref,
+		RefScheme:  q.RefScheme,
+		Event:      q.Event,
+		Size:       q.Size,
+		Query:      q.Query,
+		Bot:        q.Bot,
+		Dimensions: q.Dimensions,
+		Browser:    q.Browser,
+		Location:   q.Location,
+		Region:     q.Region,
+		City:       q.City,
+		Language:   q.Language,
+		FirstVisit: q.FirstVisit,
+		CreatedAt:  q.CreatedAt,
+		Ping:       q.Ping,
+		RemoteAddr: q.RemoteAddr,
+	}
+}
+
+func newQueuedHit(h Hit) queuedHit {
+	return queuedHit{
+		Site:       h.Site,
+		SessionH:   h.Session.H,
+		SessionL:   h.Session.L,
+		Path:       h.Path,
+		Title:      h.Title,
+		Ref:        h.Ref,
+		RefScheme:  h.RefScheme,
+		Event:      h.Event,
+		Size:       h.Size,
+		Query:      h.Query,
+		Bot:        h.Bot,
+		Dimensions: h.Dimensions,
+		Browser:    h.Browser,
+		Location:   h.Location,
+		Region:     h.Region,
+		City:       h.City,
+		Language:   h.Language,
+		FirstVisit: h.FirstVisit,
+		CreatedAt:  h.CreatedAt,
+		Ping:       h.Ping,
+		RemoteAddr: h.RemoteAddr,
+	}
+}
+
+// SetShared makes the Memstore keep the hits that haven't been persisted yet
+// and the sessions in the database instead of in memory, so that several
+// GoatCounter instances behind a load balancer can share them.
+//
+// The session salts are shared through the database as well, so all instances
+// need to use the same key with SetSaltKey().
+//
+// The live view and the /api/v0/stats/stream endpoint only see the pageviews
+// persisted by the same instance, so with a load balancer they need to be
+// routed to one instance (or use a sticky session) to see everything.
+//
+// This must be called before Init().
+func (m *ms) SetShared(shared bool) {
+	m.shared = shared
+}
+
+// appendShared adds the hits to the shared_hits table.
+func (m *ms) appendShared(hits []Hit) error {
+	err := zdb.TX(zdb.With(context.Background(), m.sharedDB), func(ctx context.Context, db zdb.DB) error {
+		for _, h := range hits {
+			d, err := json.Marshal(newQueuedHit(h))
+			if err != nil {
+				return err
+			}
+			_, err = db.ExecContext(ctx, `insert into shared_hits (site, hit, created_at) values ($1, $2, $3)`,
+				h.Site, string(d), h.CreatedAt.Format(zdb.Date))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err == nil {
+		atomic.AddInt64(&m.sharedLen, int64(len(hits)))
+	}
+	return err
+}
+
+// takeShared removes up to sharedBatch hits from the shared_hits table.
+//
+// On PostgreSQL rows locked by other instances are skipped, so every hit is
+// persisted by only one instance.
+func (m *ms) takeShared() ([]Hit, error) {
+	var (
+		hits []Hit
+		n    int
+	)
+	err := zdb.TX(zdb.With(context.Background(), m.sharedDB), func(ctx context.Context, db zdb.DB) error {
+		var rows []struct {
+			ID  int64  `db:"id"`
+			Hit string `db:"hit"`
+		}
+		lock := ""
+		if zdb.PgSQL(db) {
+			lock = "for update skip locked"
+		}
+		err := db.SelectContext(ctx, &rows, fmt.Sprintf(`/* Memstore.takeShared */
+			select id, hit from shared_hits order by id limit %d %s`, sharedBatch, lock))
+		n = len(rows)
+		if err != nil || len(rows) == 0 {
+			return err
+		}
+
+		ids := make([]int64, 0, len(rows))
+		hits = make([]Hit, 0, len(rows))
+		for _, r := range rows {
+			ids = append(ids, r.ID)
+
+			var q queuedHit
+			err := json.Unmarshal([]byte(r.Hit), &q)
+			if err != nil {
+				zlog.Module("memstore").Field("hit", r.Hit).Error(err)
+				continue
+			}
+			hits = append(hits, q.hit())
+		}
+
+		query, args, err := sqlx.In(`delete from shared_hits where id in (?)`, ids)
+		if err != nil {
+			return err
+		}
+		_, err = db.ExecContext(ctx, db.Rebind(query), args...)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Memstore.takeShared: %w", err)
+	}
+	if n < sharedBatch {
+		// Nothing left that isn't being persisted by another instance.
+		atomic.StoreInt64(&m.sharedLen, 0)
+	} else {
+		atomic.AddInt64(&m.sharedLen, -int64(n))
+	}
+	return hits, nil
+}
+
+// lenShared gets the approximate number of hits in the shared_hits table.
+//
+// This is kept as a counter rather than running a count(*) query, as it's
+// called for every health check and statsd flush: it counts the hits this
+// instance added minus the ones it removed, and is reset when Persist() empties
+// the table. Hits added by other instances aren't counted until then.
+func (m *ms) lenShared() int {
+	n := atomic.LoadInt64(&m.sharedLen)
+	if n < 0 {
+		return 0
+	}
+	return int(n)
+}
+
+// recentShared gets the hits for this site from the shared_hits table.
+func (m *ms) recentShared(siteID int64, since time.Time) []Hit {
+	var rows []string
+	err := m.sharedDB.SelectContext(context.Background(), &rows, `/* Memstore.recentShared */
+		select hit from shared_hits where site=$1 and created_at>=$2 order by id`,
+		siteID, since.Format(zdb.Date))
+	if err != nil {
+		zlog.Module("memstore").Error(err)
+		return nil
+	}
+
+	hits := make([]Hit, 0, len(rows))
+	for _, r := range rows {
+		var q queuedHit
+		err := json.Unmarshal([]byte(r), &q)
+		if err != nil {
+			continue
+		}
+		hits = append(hits, q.hit())
+	}
+	return hits
+}
+
+// eraseShared removes the hits for this site from the shared_hits table for
+// which match returns true.
+//
+// This doesn't use a transaction, as match may need to look up the session.
+// Hits that another instance is persisting at the same time may not be
+// removed.
+func (m *ms) eraseShared(siteID int64, match func(h Hit) bool) ([]Hit, error) {
+	ctx := context.Background()
+	var rows []struct {
+		ID  int64  `db:"id"`
+		Hit string `db:"hit"`
+	}
+	err := m.sharedDB.SelectContext(ctx, &rows, `/* Memstore.eraseShared */
+		select id, hit from shared_hits where site=$1 order by id`, siteID)
+	if err != nil {
+		return nil, fmt.Errorf("Memstore.eraseShared: %w", err)
+	}
+
+	var (
+		ids    []int64
+		erased []Hit
+	)
+	for _, r := range rows {
+		var q queuedHit
+		err := json.Unmarshal([]byte(r.Hit), &q)
+		if err != nil {
+			continue
+		}
+		if h := q.hit(); match(h) {
+			ids = append(ids, r.ID)
+			erased = append(erased, h)
+		}
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	query, args, err := sqlx.In(`delete from shared_hits where id in (?)`, ids)
+	if err != nil {
+		return nil, fmt.Errorf("Memstore.eraseShared: %w", err)
+	}
+	_, err = m.sharedDB.ExecContext(ctx, m.sharedDB.Rebind(query), args...)
+	if err != nil {
+		return nil, fmt.Errorf("Memstore.eraseShared: %w", err)
+	}
+	atomic.AddInt64(&m.sharedLen, -int64(len(ids)))
+	return erased, nil
+}
+
+// sharedHashes gets the session hash for the current salt, and for the previous
+// salt if it's still accepted (nil otherwise).
+//
+// This only holds sessionMu to read the salts, so that it's not held while
+// waiting on the database.
+func (m *ms) sharedHashes(siteID int64, ua, remoteAddr string) ([]byte, []byte) {
+	m.sessionMu.RLock()
+	defer m.sessionMu.RUnlock()
+	cur := []byte(sessionHash(m.curSalt, siteID, ua, remoteAddr))
+	if !m.inSaltGrace() {
+		return cur, nil
+	}
+	return cur, []byte(sessionHash(m.prevSalt, siteID, ua, remoteAddr))
+}
+
+// existingSessionShared is like existingSession(), but for the shared_sessions
+// table.
+func (m *ms) existingSessionShared(siteID int64, ua, remoteAddr string) (zint.Uint128, bool) {
+	var (
+		ctx       = context.Background()
+		id        zint.Uint128
+		cur, prev = m.sharedHashes(siteID, ua, remoteAddr)
+		hashes    = [][]byte{cur}
+	)
+	if prev != nil {
+		hashes = append(hashes, prev)
+	}
+	for _, h := range hashes {
+		err := m.sharedDB.GetContext(ctx, &id, `select session from shared_sessions where hash=$1`, h)
+		if err == nil {
+			return id, true
+		}
+		if !zdb.ErrNoRows(err) {
+			zlog.Module("memstore").Error(err)
+			break
+		}
+	}
+	return id, false
+}
+
+// sessionShared is like session(), but for the shared_sessions table.
+func (m *ms) sessionShared(siteID int64, path, ua, remoteAddr string) (zint.Uint128, zdb.Bool, error) {
+	var (
+		id             zint.Uint128
+		first          bool
+		hash, prevHash = m.sharedHashes(siteID, ua, remoteAddr)
+		now            = Now().Format(zdb.Date)
+	)
+	err := zdb.TX(zdb.With(context.Background(), m.sharedDB), func(ctx context.Context, db zdb.DB) error {
+		err := db.GetContext(ctx, &id, `select session from shared_sessions where hash=$1`, hash)
+		if zdb.ErrNoRows(err) && prevHash != nil { // Try previous hash
+			err = db.GetContext(ctx, &id, `select session from shared_sessions where hash=$1`, prevHash)
+			if err == nil {
+				// Move to the current salt, so that it's still found after the
+				// next rotation.
+				_, err = db.ExecContext(ctx, `update shared_sessions set hash=$1 where hash=$2`, hash, prevHash)
+			}
+		}
+		if zdb.ErrNoRows(err) { // New session
+			_, err = db.ExecContext(ctx, `/* Memstore.sessionShared */
+				insert into shared_sessions (hash, session, last_seen) values ($1, $2, $3)
+				on conflict (hash) do nothing`, hash, m.SessionID(), now)
+			if err == nil {
+				// Another instance may have created it in the meantime, so
+				// always get it from the DB.
+				err = db.GetContext(ctx, &id, `select session from shared_sessions where hash=$1`, hash)
+			}
+		}
+		if err != nil {
+			return err
+		}
+
+		_, err = db.ExecContext(ctx, `update shared_sessions set last_seen=$1 where hash=$2`, now, hash)
+		if err != nil {
+			return err
+		}
+		res, err := db.ExecContext(ctx, `/* Memstore.sessionShared */
+			insert into shared_session_paths (session, path) values ($1, $2)
+			on conflict (session, path) do nothing`, id, path)
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		first = n > 0
+		return err
+	})
+	if err != nil {
+		return id, false, fmt.Errorf("Memstore.sessionShared: %w", err)
+	}
+	return id, zdb.Bool(first), nil
+}
+
+// evictShared removes sessions last seen before ev from the shared_sessions
+// table.
+func (m *ms) evictShared(ev time.Time) error {
+	return zdb.TX(zdb.With(context.Background(), m.sharedDB), func(ctx context.Context, db zdb.DB) error {
+		_, err := db.ExecContext(ctx, `/* Memstore.evictShared */
+			delete from shared_session_paths where session in (
+				select session from shared_sessions where last_seen<$1
+			)`, ev.Format(zdb.Date))
+		if err != nil {
+			return fmt.Errorf("Memstore.evictShared: %w", err)
+		}
+		_, err = db.ExecContext(ctx, `delete from shared_sessions where last_seen<$1`, ev.Format(zdb.Date))
+		if err != nil {
+			return fmt.Errorf("Memstore.evictShared: %w", err)
+		}
+		return nil
+	})
+}
+
+// countShared gets the number of sessions in the shared_sessions table.
+func (m *ms) countShared() int {
+	var n int
+	err := m.sharedDB.GetContext(context.Background(), &n, `select count(*) from shared_sessions`)
+	if err != nil {
+		zlog.Module("memstore").Error(err)
+	}
+	return n
+}
@@ -0,0 +1,136 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"zgo.at/zdb"
+	"zgo.at/zlog"
+)
+
+// SetSpool sets the file to write the hits to if they can't be persisted
+// because the database is unavailable; they're read back and persisted once the
+// database is available again.
+//
+// This must be called before Init().
+func (m *ms) SetSpool(path string) {
+	m.spoolPath = path
+}
+
+// StoreHits writes the hits that haven't been persisted yet to the spool file,
+// so they're persisted after a restart. This does nothing if there is no spool
+// file.
+func (m *ms) StoreHits() {
+	if m.spoolPath == "" {
+		return
+	}
+
+	m.hitMu.Lock()
+	hits := m.hits
+	m.hits = []Hit{}
+	m.hitMu.Unlock()
+
+	err := m.spool(hits)
+	if err != nil {
+		zlog.Module("memstore").Error(err)
+		m.hitMu.Lock()
+		m.hits = append(hits, m.hits...)
+		m.hitMu.Unlock()
+	}
+}
+
+// dbAvailable checks if we can run queries against the database.
+func dbAvailable(ctx context.Context) error {
+	_, err := zdb.MustGet(ctx).ExecContext(ctx, `select 1`)
+	return err
+}
+
+// spool appends the hits to the spool file.
+func (m *ms) spool(hits []Hit) error {
+	if len(hits) == 0 {
+		return nil
+	}
+
+	m.spoolMu.Lock()
+	defer m.spoolMu.Unlock()
+
+	fp, err := os.OpenFile(m.spoolPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("Memstore.spool: %w", err)
+	}
+
+	w := bufio.NewWriter(fp)
+	enc := json.NewEncoder(w)
+	for _, h := range hits {
+		err := enc.Encode(newQueuedHit(h))
+		if err != nil {
+			fp.Close()
+			return fmt.Errorf("Memstore.spool: %w", err)
+		}
+	}
+	err = w.Flush()
+	if err != nil {
+		fp.Close()
+		return fmt.Errorf("Memstore.spool: %w", err)
+	}
+	err = fp.Close()
+	if err != nil {
+		return fmt.Errorf("Memstore.spool: %w", err)
+	}
+
+	zlog.Module("memstore").Printf("wrote %d hits to %q", len(hits), m.spoolPath)
+	return nil
+}
+
+// unspool reads all hits from the spool file and removes it.
+func (m *ms) unspool() ([]Hit, error) {
+	m.spoolMu.Lock()
+	defer m.spoolMu.Unlock()
+
+	fp, err := os.Open(m.spoolPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Memstore.unspool: %w", err)
+	}
+
+	var (
+		hits []Hit
+		l    = zlog.Module("memstore")
+		scan = bufio.NewScanner(fp)
+	)
+	scan.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scan.Scan() {
+		var q queuedHit
+		err := json.Unmarshal(scan.Bytes(), &q)
+		if err != nil {
+			// Most likely a partial write if we crashed, so no point in
+			// stopping here.
+			l.Field("hit", scan.Text()).Error(err)
+			continue
+		}
+		hits = append(hits, q.hit())
+	}
+	err = scan.Err()
+	fp.Close()
+	if err != nil {
+		return nil, fmt.Errorf("Memstore.unspool: %w", err)
+	}
+
+	err = os.Remove(m.spoolPath)
+	if err != nil {
+		return nil, fmt.Errorf("Memstore.unspool: %w", err)
+	}
+	if len(hits) > 0 {
+		l.Printf("read %d hits from %q", len(hits), m.spoolPath)
+	}
+	return hits, nil
+}
@@ -6,9 +6,16 @@ package goatcounter_test
 
 import (
 	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/jmoiron/sqlx"
 	. "zgo.at/goatcounter"
+	"zgo.at/goatcounter/cfg"
 	"zgo.at/goatcounter/gctest"
 	"zgo.at/zdb"
 )
@@ -36,6 +43,276 @@ func TestMemstore(t *testing.T) {
 	}
 }
 
+func TestMemstoreBatch(t *testing.T) {
+	ctx, clean := gctest.DB(t)
+	defer clean()
+
+	Memstore.SetBatch(30)
+	defer Memstore.SetBatch(0)
+
+	for i := 0; i < 50; i++ {
+		Memstore.Append(gen(ctx))
+	}
+
+	for _, want := range []int{30, 20, 0} {
+		hits, err := Memstore.Persist(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(hits) != want {
+			t.Errorf("wrong count; wanted %d but got %d", want, len(hits))
+		}
+	}
+}
+
+func TestMemstoreSpool(t *testing.T) {
+	ctx, clean := gctest.DB(t)
+	defer clean()
+
+	tmp, err := ioutil.TempDir("", "goatcounter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	Memstore.SetSpool(filepath.Join(tmp, "spool"))
+	defer Memstore.SetSpool("")
+
+	// Closed database to simulate an outage.
+	down, err := sqlx.Open(map[bool]string{true: "postgres", false: "sqlite3"}[cfg.PgSQL], "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down.Close()
+
+	for i := 0; i < 20; i++ {
+		Memstore.Append(gen(ctx))
+	}
+	_, err = Memstore.Persist(zdb.With(ctx, down))
+	if err == nil {
+		t.Fatal("no error")
+	}
+	if l := Memstore.Len(); l != 0 {
+		t.Errorf("Len() = %d", l)
+	}
+	if _, err := os.Stat(filepath.Join(tmp, "spool")); err != nil {
+		t.Fatal(err)
+	}
+
+	hits, err := Memstore.Persist(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hits) != 20 {
+		t.Errorf("wrong count; wanted 20 but got %d", len(hits))
+	}
+	if _, err := os.Stat(filepath.Join(tmp, "spool")); !os.IsNotExist(err) {
+		t.Errorf("spool not removed: %v", err)
+	}
+}
+
+func TestMemstoreStoreHits(t *testing.T) {
+	ctx, clean := gctest.DB(t)
+	defer clean()
+
+	tmp, err := ioutil.TempDir("", "goatcounter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	Memstore.SetSpool(filepath.Join(tmp, "spool"))
+	defer Memstore.SetSpool("")
+
+	for i := 0; i < 5; i++ {
+		Memstore.Append(gen(ctx))
+	}
+	Memstore.StoreHits()
+	Memstore.StoreSessions(zdb.MustGet(ctx))
+	Memstore.StoreSessions(zdb.MustGet(ctx)) // Replaces the existing value.
+
+	// Restart.
+	err = Memstore.Init(zdb.MustGet(ctx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hits, err := Memstore.Persist(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hits) != 5 {
+		t.Errorf("wrong count; wanted 5 but got %d", len(hits))
+	}
+
+	var n int
+	err = zdb.MustGet(ctx).GetContext(ctx, &n, `select count(*) from store where key='session'`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Errorf("sessions not loaded: %d rows in store", n)
+	}
+}
+
+func TestMemstoreCardinality(t *testing.T) {
+	ctx, clean := gctest.DB(t)
+	defer clean()
+
+	defer func(p, r int) { MaxPathsPerDay, MaxRefsPerDay = p, r }(MaxPathsPerDay, MaxRefsPerDay)
+	MaxPathsPerDay, MaxRefsPerDay = 2, 1
+
+	site := MustGetSite(ctx)
+	now := time.Date(2020, 6, 18, 14, 42, 0, 0, time.UTC)
+	Memstore.Append(
+		Hit{Site: site.ID, Session: TestSession, CreatedAt: now, Path: "/a", Ref: "https://a.com"},
+		Hit{Site: site.ID, Session: TestSession, CreatedAt: now, Path: "/b", Ref: "https://b.com"},
+		Hit{Site: site.ID, Session: TestSession, CreatedAt: now, Path: "/a", Ref: "https://a.com"},
+		Hit{Site: site.ID, Session: TestSession, CreatedAt: now, Path: "/c"},
+		Hit{Site: site.ID, Session: TestSession, CreatedAt: now.Add(24 * time.Hour), Path: "/c"},
+	)
+
+	hits, err := Memstore.Persist(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got string
+	for _, h := range hits {
+		got += h.Path + " " + h.Ref + "\n"
+	}
+	want := "/a a.com\n/b (other)\n/a a.com\n(other) \n/c \n"
+	if got != want {
+		t.Errorf("\ngot:  %q\nwant: %q", got, want)
+	}
+}
+
+func TestMemstorePing(t *testing.T) {
+	ctx, clean := gctest.DB(t)
+	defer clean()
+
+	site := MustGetSite(ctx)
+	now := time.Date(2020, 6, 18, 14, 42, 0, 0, time.UTC)
+	h := Hit{Site: site.ID, CreatedAt: now, Path: "/a", Browser: "x", RemoteAddr: "1.1.1.1"}
+	p := func(s int64) Hit {
+		pp := h
+		pp.CreatedAt, pp.Ping = now.Add(time.Duration(s)*time.Second), s
+		return pp
+	}
+
+	Memstore.Append(h, p(10))
+	hits, err := Memstore.Persist(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hits) != 1 {
+		t.Fatalf("pings should not be returned as hits: %d", len(hits))
+	}
+
+	// Lower value is ignored; pings for unknown sessions are ignored.
+	other := p(60)
+	other.RemoteAddr = "2.2.2.2"
+	Memstore.Append(p(30), p(20), other)
+	_, err = Memstore.Persist(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []*int64
+	err = zdb.MustGet(ctx).SelectContext(ctx, &got, `select duration from hits`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0] == nil || *got[0] != 30 {
+		t.Errorf("wrong duration: %v", got)
+	}
+
+	var e Engagements
+	err = e.List(ctx, now.Add(-time.Hour), now.Add(time.Hour), "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(e) != 1 || e[0].Path != "/a" || e[0].Average != 30 || e[0].Median != 30 {
+		t.Errorf("wrong engagement: %#v", e)
+	}
+}
+
+func TestMemstoreStripUserAgent(t *testing.T) {
+	ctx, clean := gctest.DB(t)
+	defer clean()
+
+	site := MustGetSite(ctx)
+	site.Settings.StripUserAgent = true
+	err := site.Update(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := Now()
+	h := Hit{Site: site.ID, CreatedAt: now, Path: "/a", RemoteAddr: "1.1.1.1",
+		Browser: "Mozilla/5.0 (X11; Linux x86_64; rv:79.0) Gecko/20100101 Firefox/79.0"}
+	Memstore.Append(h)
+	_, err = Memstore.Persist(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Not yet persisted pageviews should be in the same session.
+	Memstore.Append(h)
+	var live LiveStats
+	err = live.Get(ctx, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if live.Visitors != 1 {
+		t.Errorf("visitors: %d", live.Visitors)
+	}
+
+	ping := h
+	ping.Ping, ping.CreatedAt = 10, now.Add(10*time.Second)
+	Memstore.Append(ping)
+	_, err = Memstore.Persist(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []*int64
+	err = zdb.MustGet(ctx).SelectContext(ctx, &got,
+		`select duration from hits where duration is not null`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || *got[0] != 10 {
+		t.Errorf("wrong duration: %v", got)
+	}
+}
+
+func TestMemstorePingError(t *testing.T) {
+	ctx, clean := gctest.DB(t)
+	defer clean()
+
+	// Make the duration update fail; the pageview stats should still be
+	// updated.
+	_, err := zdb.MustGet(ctx).ExecContext(ctx,
+		`alter table hits rename column duration to duration_x`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2020, 6, 18, 14, 42, 0, 0, time.UTC)
+	gctest.StoreHits(ctx, t,
+		Hit{CreatedAt: now, Path: "/a"},
+		Hit{CreatedAt: now.Add(10 * time.Second), Path: "/a", Ping: 10})
+
+	var got int
+	err = zdb.MustGet(ctx).GetContext(ctx, &got, `select count(*) from hit_counts`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != 1 {
+		t.Errorf("hit_counts: %d", got)
+	}
+}
+
 func gen(ctx context.Context) Hit {
 	s := MustGetSite(ctx)
 	return Hit{
@@ -79,3 +356,230 @@ func TestNextUUID(t *testing.T) {
 		}
 	}()
 }
+
+func TestMemstoreClock(t *testing.T) {
+	clock, restore := gctest.Clock(t, "2020-06-18 14:42:00")
+	defer restore()
+	ctx, clean := gctest.DB(t)
+	defer clean()
+
+	site := MustGetSite(ctx)
+	hit := func() Hit {
+		Memstore.Append(Hit{Site: site.ID, Path: "/a", Browser: "Firefox/68.0", RemoteAddr: "1.1.1.1"})
+		hits, err := Memstore.Persist(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return hits[0]
+	}
+
+	first := hit()
+	if !first.CreatedAt.Equal(clock.Now()) {
+		t.Errorf("CreatedAt is %s", first.CreatedAt)
+	}
+
+	// Salt is rotated only every 4 hours.
+	cur, _ := Memstore.GetSalt()
+	Memstore.RefreshSalt()
+	if c, _ := Memstore.GetSalt(); string(c) != string(cur) {
+		t.Error("rotated salt too soon")
+	}
+
+	clock.Advance(4*time.Hour + time.Second)
+	Memstore.RefreshSalt()
+	c, prev := Memstore.GetSalt()
+	if string(c) == string(cur) || string(prev) != string(cur) {
+		t.Error("salt not rotated")
+	}
+	Memstore.RefreshSalt()
+	if c2, _ := Memstore.GetSalt(); string(c2) != string(c) {
+		t.Error("rotated salt twice")
+	}
+
+	// Sessions are evicted after 4 hours.
+	Memstore.EvictSessions()
+	if h := hit(); h.Session == first.Session {
+		t.Error("session not evicted")
+	}
+}
+
+func TestMemstoreSaltRotation(t *testing.T) {
+	clock, restore := gctest.Clock(t, "2020-06-18 14:42:00")
+	defer restore()
+	_, clean := gctest.DB(t)
+	defer clean()
+
+	defer func(r time.Duration) { SaltRotation = r }(SaltRotation)
+	SaltRotation = time.Hour
+
+	cur, _ := Memstore.GetSalt()
+	clock.Advance(59 * time.Minute)
+	Memstore.RefreshSalt()
+	if c, _ := Memstore.GetSalt(); string(c) != string(cur) {
+		t.Error("rotated salt too soon")
+	}
+
+	clock.Advance(2 * time.Minute)
+	Memstore.RefreshSalt()
+	if c, prev := Memstore.GetSalt(); string(c) == string(cur) || string(prev) != string(cur) {
+		t.Error("salt not rotated")
+	}
+	if s := Memstore.SaltSchedule(); !s.NextRotation.Equal(s.Rotated.Add(time.Hour)) {
+		t.Errorf("wrong next rotation: %s", s.NextRotation)
+	}
+}
+
+func TestMemstoreSaltKey(t *testing.T) {
+	ctx, clean := gctest.DB(t)
+	defer clean()
+	db := zdb.MustGet(ctx)
+
+	Memstore.SetSaltKey([]byte("secret"))
+	defer Memstore.SetSaltKey(nil)
+	err := Memstore.Init(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cur, prev := Memstore.GetSalt()
+
+	var stored string
+	err = db.GetContext(ctx, &stored, `select value from store where key='salt'`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(stored, string(cur)) {
+		t.Error("salt not encrypted")
+	}
+
+	// Restart, without a clean shutdown.
+	err = Memstore.Init(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c, p := Memstore.GetSalt(); string(c) != string(cur) || string(p) != string(prev) {
+		t.Error("salts not restored")
+	}
+
+	// Different key starts over.
+	Memstore.SetSaltKey([]byte("other"))
+	err = Memstore.Init(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c, _ := Memstore.GetSalt(); string(c) == string(cur) {
+		t.Error("salts restored with wrong key")
+	}
+
+	// Ephemeral salts are never stored.
+	Memstore.SetEphemeralSalt()
+	cur, _ = Memstore.GetSalt()
+	Memstore.StoreSessions(db)
+	err = Memstore.Init(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c, _ := Memstore.GetSalt(); string(c) == string(cur) {
+		t.Error("ephemeral salts restored")
+	}
+}
+
+func TestMemstoreShared(t *testing.T) {
+	ctx, clean := gctest.DB(t)
+	defer clean()
+	db := zdb.MustGet(ctx)
+
+	Memstore.SetSaltKey([]byte("secret"))
+	Memstore.SetShared(true)
+	defer func() {
+		Memstore.SetShared(false)
+		Memstore.SetSaltKey(nil)
+	}()
+	err := Memstore.Init(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	site := MustGetSite(ctx)
+	count := func(tbl string) int {
+		var n int
+		err := db.GetContext(ctx, &n, `select count(*) from `+tbl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	hit := Hit{Site: site.ID, Path: "/a", Browser: "Firefox/68.0", RemoteAddr: "1.1.1.1", CreatedAt: Now()}
+
+	Memstore.Append(hit, hit)
+	if n := count("shared_hits"); n != 2 {
+		t.Fatalf("shared_hits: %d", n)
+	}
+
+	// Persisted by another instance, or after a restart.
+	err = Memstore.Init(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if Memstore.Len() != 2 {
+		t.Fatalf("Len(): %d", Memstore.Len())
+	}
+	hits, err := Memstore.Persist(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hits) != 2 || hits[0].Session != hits[1].Session || !hits[0].FirstVisit || hits[1].FirstVisit {
+		t.Fatalf("wrong hits: %#v", hits)
+	}
+	if n := count("shared_hits"); n != 0 {
+		t.Errorf("shared_hits: %d", n)
+	}
+
+	// Session is kept.
+	err = Memstore.Init(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	Memstore.Append(hit)
+	hits2, err := Memstore.Persist(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hits2) != 1 || hits2[0].Session != hits[0].Session || hits2[0].FirstVisit {
+		t.Errorf("session not shared: %#v", hits2)
+	}
+	if n := count("shared_sessions"); n != 1 {
+		t.Errorf("shared_sessions: %d", n)
+	}
+}
+
+func TestLiveStatsWindow(t *testing.T) {
+	ctx, clean := gctest.DB(t)
+	defer clean()
+
+	now := Now()
+	gctest.StoreHits(ctx, t, Hit{Path: "/a", CreatedAt: now})
+
+	var live LiveStats
+	err := live.Get(ctx, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if live.Pageviews != 1 {
+		t.Fatalf("pageviews: %d", live.Pageviews)
+	}
+
+	// Added to the window after it's loaded.
+	gctest.StoreHits(ctx, t,
+		Hit{Path: "/b", CreatedAt: now},
+		Hit{Path: "/event", Event: true, CreatedAt: now},
+		Hit{Path: "/old", CreatedAt: now.Add(-time.Hour)})
+
+	live = LiveStats{}
+	err = live.Get(ctx, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if live.Pageviews != 2 || len(live.Pages) != 2 || live.Pages[0].Path != "/a" || live.Pages[1].Path != "/b" {
+		t.Errorf("wrong: %#v", live)
+	}
+}
@@ -657,6 +657,326 @@ commit;
 
 	insert into version values('2020-07-03-1-plan-amount');
 commit;
+`),
+	"db/migrate/pgsql/2020-07-24-1-dimensions.sql": []byte(`begin;
+	alter table hits add column dimensions varchar;
+
+	insert into version values('2020-07-24-1-dimensions');
+commit;
+`),
+	"db/migrate/pgsql/2020-07-25-1-duration.sql": []byte(`begin;
+	alter table hits add column duration integer;
+
+	insert into version values('2020-07-25-1-duration');
+commit;
+`),
+	"db/migrate/pgsql/2020-07-27-1-roles.sql": []byte(`begin;
+	create table roles (
+		role_id        serial         primary key,
+		site_id        integer        not null,
+		name           varchar        not null,
+		permissions    jsonb          not null,
+		created_at     timestamp      not null,
+
+		foreign key (site_id) references sites(id) on delete restrict on update restrict
+	);
+	create unique index "roles#site_id#name" on roles(site_id, name);
+
+	alter table api_tokens add column role_id integer null;
+	alter table users add column role_id integer null;
+
+	insert into version values('2020-07-27-1-roles');
+commit;
+`),
+	"db/migrate/pgsql/2020-07-28-1-path-transitions.sql": []byte(`begin;
+	create table path_transitions (
+		site           integer        not null                 check(site > 0),
+
+		day            date           not null,
+		prev_path      varchar        not null,
+		path           varchar        not null,
+		count          int            not null,
+
+		foreign key (site) references sites(id) on delete restrict on update restrict
+	);
+	create index "path_transitions#site#day#path" on path_transitions(site, day, path);
+	create index "path_transitions#site#day#prev_path" on path_transitions(site, day, prev_path);
+
+	insert into version values('2020-07-28-1-path-transitions');
+commit;
+`),
+	"db/migrate/pgsql/2020-07-29-1-segments.sql": []byte(`begin;
+	create table segments (
+		segment_id     serial         primary key,
+		site_id        integer        not null,
+		user_id        integer        not null,
+		name           varchar        not null,
+		period         varchar        not null,
+		period_start   varchar,
+		period_end     varchar,
+		filter         varchar        not null,
+		daily          integer        not null,
+		compare        varchar        not null,
+		created_at     timestamp      not null,
+
+		foreign key (site_id) references sites(id) on delete restrict on update restrict,
+		foreign key (user_id) references users(id) on delete restrict on update restrict
+	);
+	create unique index "segments#user_id#name" on segments(user_id, name);
+
+	insert into version values('2020-07-29-1-segments');
+commit;
+`),
+	"db/migrate/pgsql/2020-07-30-1-paths.sql": []byte(`begin;
+	create table paths (
+		path_id        serial         primary key,
+		site_id        integer        not null,
+		path           varchar        not null,
+		title          varchar        not null default '',
+		event          integer        not null default 0,
+
+		foreign key (site_id) references sites(id) on delete restrict on update restrict
+	);
+	create unique index "paths#site_id#path" on paths(site_id, path);
+
+	-- Filled for existing rows in the background.
+	alter table hits       add column path_id integer null;
+	alter table hit_counts add column path_id integer null;
+	alter table hit_stats  add column path_id integer null;
+	alter table ref_counts add column path_id integer null;
+
+	insert into version values('2020-07-30-1-paths');
+commit;
+`),
+	"db/migrate/pgsql/2020-07-31-1-annotations.sql": []byte(`begin;
+	create table annotations (
+		annotation_id  serial         primary key,
+		site_id        integer        not null,
+		day            varchar        not null,
+		text           varchar        not null,
+		created_at     timestamp      not null,
+
+		foreign key (site_id) references sites(id) on delete restrict on update restrict
+	);
+	create index "annotations#site_id#day" on annotations(site_id, day);
+
+	insert into version values('2020-07-31-1-annotations');
+commit;
+`),
+	"db/migrate/pgsql/2020-08-01-1-email-reports.sql": []byte(`begin;
+	alter table users add column email_reports   varchar    not null default '';
+	alter table users add column email_report_at timestamp  null;
+
+	insert into version values('2020-08-01-1-email-reports');
+commit;
+`),
+	"db/migrate/pgsql/2020-08-02-1-user-settings.sql": []byte(`begin;
+	alter table users add column settings json not null default '{}';
+
+	insert into version values('2020-08-02-1-user-settings');
+commit;
+`),
+	"db/migrate/pgsql/2020-08-03-1-shared-memstore.sql": []byte(`begin;
+	create table shared_hits (
+		id             serial         primary key,
+		site           integer        not null,
+		hit            varchar        not null,
+		created_at     timestamp      not null
+	);
+	create index "shared_hits#site#created_at" on shared_hits(site, created_at);
+
+	create table shared_sessions (
+		hash           bytea          primary key,
+		session        bytea          not null,
+		last_seen      timestamp      not null
+	);
+	create index "shared_sessions#last_seen" on shared_sessions(last_seen);
+
+	create table shared_session_paths (
+		session        bytea          not null,
+		path           varchar        not null
+	);
+	create unique index "shared_session_paths#session#path" on shared_session_paths(session, path);
+
+	insert into version values('2020-08-03-1-shared-memstore');
+commit;
+`),
+	"db/migrate/pgsql/2020-08-05-1-hit-rollups.sql": []byte(`begin;
+	create table hit_rollups (
+		site          int        not null check(site>0),
+		period        varchar    not null check(period in ('d', 'm', 'u')),
+		path          varchar    not null,
+		title         varchar    not null,
+		event         integer    not null default 0,
+		hour          timestamp  not null,
+		total         int        not null,
+		total_unique  int        not null,
+
+		constraint "hit_rollups#site#period#path#event#hour" unique(site, period, path, event, hour)
+	);
+	create index "hit_rollups#site#period#hour" on hit_rollups(site, period, hour);
+
+	insert into version values('2020-08-05-1-hit-rollups');
+commit;
+`),
+	"db/migrate/pgsql/2020-08-06-1-alert-rules.sql": []byte(`begin;
+	create table alert_rules (
+		alert_rule_id  serial         primary key,
+		site_id        integer        not null,
+		kind           varchar        not null                 check(kind in ('above', 'below', 'new-ref')),
+		threshold      integer        not null,
+		minutes        integer        not null,
+		deliver        varchar        not null                 check(deliver in ('email', 'slack', 'webhook')),
+		target         varchar        not null,
+		cooldown       integer        not null,
+		fired_at       timestamp      null,
+		created_at     timestamp      not null,
+
+		foreign key (site_id) references sites(id) on delete restrict on update restrict
+	);
+	create index "alert_rules#site_id" on alert_rules(site_id);
+
+	insert into version values('2020-08-06-1-alert-rules');
+commit;
+`),
+	"db/migrate/pgsql/2020-08-07-1-anomalies.sql": []byte(`begin;
+	create table anomalies (
+		anomaly_id     serial         primary key,
+		site_id        integer        not null,
+		day            varchar        not null,
+		kind           varchar        not null                 check(kind in ('spike', 'drop')),
+		pageviews      integer        not null,
+		expected       integer        not null,
+		created_at     timestamp      not null,
+
+		foreign key (site_id) references sites(id) on delete restrict on update restrict
+	);
+	create unique index "anomalies#site_id#day" on anomalies(site_id, day);
+
+	alter table alert_rules drop constraint alert_rules_kind_check;
+	alter table alert_rules add constraint alert_rules_kind_check check(kind in ('above', 'below', 'new-ref', 'anomaly'));
+
+	insert into version values('2020-08-07-1-anomalies');
+commit;
+`),
+	"db/migrate/pgsql/2020-08-08-1-user-sessions.sql": []byte(`begin;
+	create table user_sessions (
+		user_session_id serial        primary key,
+		user_id        integer        not null,
+		token          varchar        not null,
+		ip             varchar        not null,
+		user_agent     varchar        not null,
+		created_at     timestamp      not null,
+		last_seen_at   timestamp      not null,
+
+		foreign key (user_id) references users(id) on delete restrict on update restrict
+	);
+	create unique index "user_sessions#token"   on user_sessions(token);
+	create        index "user_sessions#user_id" on user_sessions(user_id);
+
+	-- Keep existing logins working.
+	insert into user_sessions (user_id, token, ip, user_agent, created_at, last_seen_at)
+		select id, login_token, '', '', now(), now() from users where login_token is not null;
+
+	insert into version values('2020-08-08-1-user-sessions');
+commit;
+`),
+	"db/migrate/pgsql/2020-08-09-1-cities.sql": []byte(`begin;
+	alter table hits add column region varchar not null default '';
+	alter table hits add column city   varchar not null default '';
+
+	create table city_stats (
+		site           integer        not null                 check(site > 0),
+
+		day            date           not null,
+		location       varchar        not null,
+		region         varchar        not null,
+		city           varchar        not null,
+		count          int            not null,
+		count_unique   int            not null,
+
+		foreign key (site) references sites(id) on delete restrict on update restrict
+	);
+	create index "city_stats#site#day#location" on city_stats(site, day, location);
+
+	insert into version values('2020-08-09-1-cities');
+commit;
+`),
+	"db/migrate/pgsql/2020-08-10-1-region-stats.sql": []byte(`begin;
+	create table region_stats (
+		site           integer        not null                 check(site > 0),
+
+		day            date           not null,
+		location       varchar        not null,
+		region         varchar        not null,
+		count          int            not null,
+		count_unique   int            not null,
+
+		foreign key (site) references sites(id) on delete restrict on update restrict
+	);
+	create index "region_stats#site#day#location" on region_stats(site, day, location);
+
+	insert into region_stats (site, day, location, region, count, count_unique)
+		select site, day, location, region, sum(count), sum(count_unique) from city_stats
+		where region != ''
+		group by site, day, location, region;
+
+	insert into version values('2020-08-10-1-region-stats');
+commit;
+`),
+	"db/migrate/pgsql/2020-08-11-1-languages.sql": []byte(`begin;
+	alter table hits add column language varchar not null default '';
+
+	create table language_stats (
+		site           integer        not null                 check(site > 0),
+
+		day            date           not null,
+		language       varchar        not null,
+		count          int            not null,
+		count_unique   int            not null,
+
+		foreign key (site) references sites(id) on delete restrict on update restrict
+	);
+	create index "language_stats#site#day" on language_stats(site, day);
+
+	insert into version values('2020-08-11-1-languages');
+commit;
+`),
+	"db/migrate/pgsql/2020-08-12-1-user-owner.sql": []byte(`begin;
+	alter table users add column owner integer not null default 1;
+
+	-- Users with a role were never the owner.
+	update users set owner=0 where role_id is not null;
+
+	insert into version values('2020-08-12-1-user-owner');
+commit;
+`),
+	"db/migrate/pgsql/2020-08-13-1-hits-ref-index.sql": []byte(`begin;
+	-- For the "new-ref" alerts.
+	create index "hits#site#ref#created_at" on hits(site, ref, created_at);
+
+	insert into version values('2020-08-13-1-hits-ref-index');
+commit;
+`),
+	"db/migrate/pgsql/2020-08-14-1-bot-stats.sql": []byte(`begin;
+	create table bot_stats (
+		site           integer        not null                 check(site > 0),
+
+		day            date           not null,
+		count          int            not null,
+
+		foreign key (site) references sites(id) on delete restrict on update restrict
+	);
+	create index "bot_stats#site#day" on bot_stats(site, day);
+
+	-- Days are in UTC here; "goatcounter reindex -table bot_stats" uses the
+	-- site's timezone.
+	insert into bot_stats (site, day, count)
+		select site, cast(created_at as date), count(*) from hits where bot>0
+		group by site, cast(created_at as date);
+
+	insert into version values('2020-08-14-1-bot-stats');
+commit;
 `),
 }
 
@@ -1496,6 +1816,343 @@ commit;
 
 	insert into version values('2020-07-03-1-plan-amount');
 commit;
+`),
+	"db/migrate/sqlite/2020-07-24-1-dimensions.sql": []byte(`begin;
+	alter table hits add column dimensions varchar;
+
+	insert into version values('2020-07-24-1-dimensions');
+commit;
+`),
+	"db/migrate/sqlite/2020-07-25-1-duration.sql": []byte(`begin;
+	alter table hits add column duration integer;
+
+	insert into version values('2020-07-25-1-duration');
+commit;
+`),
+	"db/migrate/sqlite/2020-07-27-1-roles.sql": []byte(`begin;
+	create table roles (
+		role_id        integer        primary key autoincrement,
+		site_id        integer        not null,
+		name           varchar        not null,
+		permissions    jsonb          not null,
+		created_at     timestamp      not null    check(created_at = strftime('%Y-%m-%d %H:%M:%S', created_at)),
+
+		foreign key (site_id) references sites(id) on delete restrict on update restrict
+	);
+	create unique index "roles#site_id#name" on roles(site_id, name);
+
+	alter table api_tokens add column role_id integer null;
+	alter table users add column role_id integer null;
+
+	insert into version values('2020-07-27-1-roles');
+commit;
+`),
+	"db/migrate/sqlite/2020-07-28-1-path-transitions.sql": []byte(`begin;
+	create table path_transitions (
+		site           integer        not null                 check(site > 0),
+
+		day            date           not null                 check(day = strftime('%Y-%m-%d', day)),
+		prev_path      varchar        not null,
+		path           varchar        not null,
+		count          int            not null,
+
+		foreign key (site) references sites(id) on delete restrict on update restrict
+	);
+	create index "path_transitions#site#day#path" on path_transitions(site, day, path);
+	create index "path_transitions#site#day#prev_path" on path_transitions(site, day, prev_path);
+
+	insert into version values('2020-07-28-1-path-transitions');
+commit;
+`),
+	"db/migrate/sqlite/2020-07-29-1-segments.sql": []byte(`begin;
+	create table segments (
+		segment_id     integer        primary key autoincrement,
+		site_id        integer        not null,
+		user_id        integer        not null,
+		name           varchar        not null,
+		period         varchar        not null,
+		period_start   varchar,
+		period_end     varchar,
+		filter         varchar        not null,
+		daily          integer        not null,
+		compare        varchar        not null,
+		created_at     timestamp      not null    check(created_at = strftime('%Y-%m-%d %H:%M:%S', created_at)),
+
+		foreign key (site_id) references sites(id) on delete restrict on update restrict,
+		foreign key (user_id) references users(id) on delete restrict on update restrict
+	);
+	create unique index "segments#user_id#name" on segments(user_id, name);
+
+	insert into version values('2020-07-29-1-segments');
+commit;
+`),
+	"db/migrate/sqlite/2020-07-30-1-paths.sql": []byte(`begin;
+	create table paths (
+		path_id        integer        primary key autoincrement,
+		site_id        integer        not null,
+		path           varchar        not null,
+		title          varchar        not null default '',
+		event          integer        not null default 0,
+
+		foreign key (site_id) references sites(id) on delete restrict on update restrict
+	);
+	create unique index "paths#site_id#path" on paths(site_id, path);
+
+	-- Filled for existing rows in the background.
+	alter table hits       add column path_id integer null;
+	alter table hit_counts add column path_id integer null;
+	alter table hit_stats  add column path_id integer null;
+	alter table ref_counts add column path_id integer null;
+
+	insert into version values('2020-07-30-1-paths');
+commit;
+`),
+	"db/migrate/sqlite/2020-07-31-1-annotations.sql": []byte(`begin;
+	create table annotations (
+		annotation_id  integer        primary key autoincrement,
+		site_id        integer        not null,
+		day            varchar        not null,
+		text           varchar        not null,
+		created_at     timestamp      not null    check(created_at = strftime('%Y-%m-%d %H:%M:%S', created_at)),
+
+		foreign key (site_id) references sites(id) on delete restrict on update restrict
+	);
+	create index "annotations#site_id#day" on annotations(site_id, day);
+
+	insert into version values('2020-07-31-1-annotations');
+commit;
+`),
+	"db/migrate/sqlite/2020-08-01-1-email-reports.sql": []byte(`begin;
+	alter table users add column email_reports   varchar    not null default '';
+	alter table users add column email_report_at timestamp  null;
+
+	insert into version values('2020-08-01-1-email-reports');
+commit;
+`),
+	"db/migrate/sqlite/2020-08-02-1-user-settings.sql": []byte(`begin;
+	alter table users add column settings varchar not null default '{}';
+
+	insert into version values('2020-08-02-1-user-settings');
+commit;
+`),
+	"db/migrate/sqlite/2020-08-03-1-shared-memstore.sql": []byte(`begin;
+	create table shared_hits (
+		id             integer        primary key autoincrement,
+		site           integer        not null,
+		hit            varchar        not null,
+		created_at     timestamp      not null    check(created_at = strftime('%Y-%m-%d %H:%M:%S', created_at))
+	);
+	create index "shared_hits#site#created_at" on shared_hits(site, created_at);
+
+	create table shared_sessions (
+		hash           blob           primary key,
+		session        blob           not null,
+		last_seen      timestamp      not null    check(last_seen = strftime('%Y-%m-%d %H:%M:%S', last_seen))
+	);
+	create index "shared_sessions#last_seen" on shared_sessions(last_seen);
+
+	create table shared_session_paths (
+		session        blob           not null,
+		path           varchar        not null
+	);
+	create unique index "shared_session_paths#session#path" on shared_session_paths(session, path);
+
+	insert into version values('2020-08-03-1-shared-memstore');
+commit;
+`),
+	"db/migrate/sqlite/2020-08-05-1-hit-rollups.sql": []byte(`begin;
+	create table hit_rollups (
+		site          int        not null check(site>0),
+		period        varchar    not null check(period in ('d', 'm', 'u')),
+		path          varchar    not null,
+		title         varchar    not null,
+		event         integer    not null default 0,
+		hour          timestamp  not null check(hour = strftime('%Y-%m-%d %H:%M:%S', hour)),
+		total         int        not null,
+		total_unique  int        not null,
+
+		constraint "hit_rollups#site#period#path#event#hour" unique(site, period, path, event, hour) on conflict replace
+	);
+	create index "hit_rollups#site#period#hour" on hit_rollups(site, period, hour);
+
+	insert into version values('2020-08-05-1-hit-rollups');
+commit;
+`),
+	"db/migrate/sqlite/2020-08-06-1-alert-rules.sql": []byte(`begin;
+	create table alert_rules (
+		alert_rule_id  integer        primary key autoincrement,
+		site_id        integer        not null,
+		kind           varchar        not null                 check(kind in ('above', 'below', 'new-ref')),
+		threshold      integer        not null,
+		minutes        integer        not null,
+		deliver        varchar        not null                 check(deliver in ('email', 'slack', 'webhook')),
+		target         varchar        not null,
+		cooldown       integer        not null,
+		fired_at       timestamp      null                     check(fired_at = strftime('%Y-%m-%d %H:%M:%S', fired_at)),
+		created_at     timestamp      not null                 check(created_at = strftime('%Y-%m-%d %H:%M:%S', created_at)),
+
+		foreign key (site_id) references sites(id) on delete restrict on update restrict
+	);
+	create index "alert_rules#site_id" on alert_rules(site_id);
+
+	insert into version values('2020-08-06-1-alert-rules');
+commit;
+`),
+	"db/migrate/sqlite/2020-08-07-1-anomalies.sql": []byte(`begin;
+	create table anomalies (
+		anomaly_id     integer        primary key autoincrement,
+		site_id        integer        not null,
+		day            varchar        not null,
+		kind           varchar        not null                 check(kind in ('spike', 'drop')),
+		pageviews      integer        not null,
+		expected       integer        not null,
+		created_at     timestamp      not null                 check(created_at = strftime('%Y-%m-%d %H:%M:%S', created_at)),
+
+		foreign key (site_id) references sites(id) on delete restrict on update restrict
+	);
+	create unique index "anomalies#site_id#day" on anomalies(site_id, day);
+
+	-- SQLite can't change a check constraint, so recreate the table.
+	create table alert_rules2 (
+		alert_rule_id  integer        primary key autoincrement,
+		site_id        integer        not null,
+		kind           varchar        not null                 check(kind in ('above', 'below', 'new-ref', 'anomaly')),
+		threshold      integer        not null,
+		minutes        integer        not null,
+		deliver        varchar        not null                 check(deliver in ('email', 'slack', 'webhook')),
+		target         varchar        not null,
+		cooldown       integer        not null,
+		fired_at       timestamp      null                     check(fired_at = strftime('%Y-%m-%d %H:%M:%S', fired_at)),
+		created_at     timestamp      not null                 check(created_at = strftime('%Y-%m-%d %H:%M:%S', created_at)),
+
+		foreign key (site_id) references sites(id) on delete restrict on update restrict
+	);
+	insert into alert_rules2 select * from alert_rules;
+	drop table alert_rules;
+	alter table alert_rules2 rename to alert_rules;
+	create index "alert_rules#site_id" on alert_rules(site_id);
+
+	insert into version values('2020-08-07-1-anomalies');
+commit;
+`),
+	"db/migrate/sqlite/2020-08-08-1-user-sessions.sql": []byte(`begin;
+	create table user_sessions (
+		user_session_id integer       primary key autoincrement,
+		user_id        integer        not null,
+		token          varchar        not null,
+		ip             varchar        not null,
+		user_agent     varchar        not null,
+		created_at     timestamp      not null                 check(created_at = strftime('%Y-%m-%d %H:%M:%S', created_at)),
+		last_seen_at   timestamp      not null                 check(last_seen_at = strftime('%Y-%m-%d %H:%M:%S', last_seen_at)),
+
+		foreign key (user_id) references users(id) on delete restrict on update restrict
+	);
+	create unique index "user_sessions#token"   on user_sessions(token);
+	create        index "user_sessions#user_id" on user_sessions(user_id);
+
+	-- Keep existing logins working.
+	insert into user_sessions (user_id, token, ip, user_agent, created_at, last_seen_at)
+		select id, login_token, '', '', datetime(), datetime() from users where login_token is not null;
+
+	insert into version values('2020-08-08-1-user-sessions');
+commit;
+`),
+	"db/migrate/sqlite/2020-08-09-1-cities.sql": []byte(`begin;
+	alter table hits add column region varchar not null default '';
+	alter table hits add column city   varchar not null default '';
+
+	create table city_stats (
+		site           integer        not null                 check(site > 0),
+
+		day            date           not null                 check(day = strftime('%Y-%m-%d', day)),
+		location       varchar        not null,
+		region         varchar        not null,
+		city           varchar        not null,
+		count          int            not null,
+		count_unique   int            not null,
+
+		foreign key (site) references sites(id) on delete restrict on update restrict
+	);
+	create index "city_stats#site#day#location" on city_stats(site, day, location);
+
+	insert into version values('2020-08-09-1-cities');
+commit;
+`),
+	"db/migrate/sqlite/2020-08-10-1-region-stats.sql": []byte(`begin;
+	create table region_stats (
+		site           integer        not null                 check(site > 0),
+
+		day            date           not null                 check(day = strftime('%Y-%m-%d', day)),
+		location       varchar        not null,
+		region         varchar        not null,
+		count          int            not null,
+		count_unique   int            not null,
+
+		foreign key (site) references sites(id) on delete restrict on update restrict
+	);
+	create index "region_stats#site#day#location" on region_stats(site, day, location);
+
+	insert into region_stats (site, day, location, region, count, count_unique)
+		select site, day, location, region, sum(count), sum(count_unique) from city_stats
+		where region != ''
+		group by site, day, location, region;
+
+	insert into version values('2020-08-10-1-region-stats');
+commit;
+`),
+	"db/migrate/sqlite/2020-08-11-1-languages.sql": []byte(`begin;
+	alter table hits add column language varchar not null default '';
+
+	create table language_stats (
+		site           integer        not null                 check(site > 0),
+
+		day            date           not null                 check(day = strftime('%Y-%m-%d', day)),
+		language       varchar        not null,
+		count          int            not null,
+		count_unique   int            not null,
+
+		foreign key (site) references sites(id) on delete restrict on update restrict
+	);
+	create index "language_stats#site#day" on language_stats(site, day);
+
+	insert into version values('2020-08-11-1-languages');
+commit;
+`),
+	"db/migrate/sqlite/2020-08-12-1-user-owner.sql": []byte(`begin;
+	alter table users add column owner integer not null default 1;
+
+	-- Users with a role were never the owner.
+	update users set owner=0 where role_id is not null;
+
+	insert into version values('2020-08-12-1-user-owner');
+commit;
+`),
+	"db/migrate/sqlite/2020-08-13-1-hits-ref-index.sql": []byte(`begin;
+	-- For the "new-ref" alerts.
+	create index "hits#site#ref#created_at" on hits(site, ref, created_at);
+
+	insert into version values('2020-08-13-1-hits-ref-index');
+commit;
+`),
+	"db/migrate/sqlite/2020-08-14-1-bot-stats.sql": []byte(`begin;
+	create table bot_stats (
+		site           integer        not null                 check(site > 0),
+
+		day            date           not null                 check(day = strftime('%Y-%m-%d', day)),
+		count          int            not null,
+
+		foreign key (site) references sites(id) on delete restrict on update restrict
+	);
+	create index "bot_stats#site#day" on bot_stats(site, day);
+
+	-- Days are in UTC here; "goatcounter reindex -table bot_stats" uses the
+	-- site's timezone.
+	insert into bot_stats (site, day, count)
+		select site, date(created_at), count(*) from hits where bot>0
+		group by site, date(created_at);
+
+	insert into version values('2020-08-14-1-bot-stats');
+commit;
 `),
 }
 
@@ -2033,6 +2690,13 @@ h1 a:after, h2 a:after, h3 a:after, h4 a:after, h5 a:after, h6 a:after {
 		if (rcb) data.r = rcb(data.r)
 		if (tcb) data.t = tcb(data.t)
 		if (pcb) data.p = pcb(data.p)
+
+		// Custom dimensions are sent as d[name]=value.
+		var dim = (vars.dimensions === undefined ? goatcounter.dimensions : vars.dimensions)
+		if (dim)
+			for (var k in dim)
+				if (dim[k] !== null && dim[k] !== undefined)
+					data['d[' + k + ']'] = String(dim[k])
 		return data
 	}
 
@@ -2072,6 +2736,61 @@ h1 a:after, h2 a:after, h3 a:after, h4 a:after, h5 a:after, h6 a:after {
 		return (goatcounter.endpoint || window.counter)  // counter is for compat; don't use.
 	}
 
+	// Engagement pings, to estimate the time on page; enabled with
+	// goatcounter.ping. Only the time the page is visible is counted, and the
+	// value sent is the total number of seconds so far.
+	var ping = {path: null, visible: 0, since: null, sent: 0, timer: null, bound: false}
+
+	var ping_seconds = function() {
+		return Math.round((ping.visible + (ping.since === null ? 0 : Date.now() - ping.since)) / 1000)
+	}
+
+	var send_ping = function(beacon) {
+		var secs = ping_seconds()
+		if (ping.path === null || secs <= ping.sent || secs > 6 * 3600)  // Server rejects >6h.
+			return
+		ping.sent = secs
+
+		var endpoint = get_endpoint()
+		if (!endpoint)
+			return
+		var url = endpoint + urlencode({p: ping.path, ping: secs, rnd: Math.random().toString(36).substr(2, 5)})
+		if (beacon && navigator.sendBeacon)
+			navigator.sendBeacon(url)
+		else
+			(new Image()).src = url
+	}
+
+	var start_ping = function(path) {
+		send_ping(true)  // Previous page in SPAs.
+
+		clearTimeout(ping.timer)
+		ping.path    = path
+		ping.visible = 0
+		ping.sent    = 0
+		ping.since   = document.visibilityState === 'hidden' ? null : Date.now()
+
+		// Ping after 10s, 30s, and then every minute.
+		var n = 0, next = function() {
+			ping.timer = setTimeout(function() { send_ping(false); next() }, [10, 20][n++] * 1000 || 60000)
+		}
+		next()
+
+		if (ping.bound)
+			return
+		ping.bound = true
+		document.addEventListener('visibilitychange', function() {
+			if (document.visibilityState === 'hidden') {
+				ping.visible = ping_seconds() * 1000
+				ping.since   = null
+				send_ping(true)
+			}
+			else if (ping.since === null)
+				ping.since = Date.now()
+		}, false)
+		window.addEventListener('pagehide', function() { send_ping(true) }, false)
+	}
+
 	// Filter some requests that we (probably) don't want to count.
 	goatcounter.filter = function() {
 		if ('visibilityState' in document && (document.visibilityState === 'prerender' || document.visibilityState === 'hidden'))
@@ -2081,7 +2800,7 @@ h1 a:after, h2 a:after, h3 a:after, h4 a:after, h5 a:after, h6 a:after {
 		if (!goatcounter.allow_local && location.hostname.match(/(localhost$|^127\.|^10\.|^172\.(1[6-9]|2[0-9]|3[0-1])\.|^192\.168\.)/))
 			return 'local'
 		if (localStorage && localStorage.getItem('skipgc') === 't')
-			return 'disabled with #toggle-goatcounter'
+			return 'disabled with #toggle-goatcounter or goatcounter.opt_out()'
 		return false
 	}
 
@@ -2128,6 +2847,12 @@ h1 a:after, h2 a:after, h3 a:after, h4 a:after, h5 a:after, h6 a:after {
 		setTimeout(rm, 3000)  // In case the onload isn't triggered.
 		img.addEventListener('load', rm, false)
 		document.body.appendChild(img)
+
+		if (goatcounter.ping) {
+			var data = get_data(vars || {})
+			if (!data.e && data.p !== null)
+				start_ping(data.p)
+		}
 	}
 
 	// Get a query parameter.
@@ -2164,6 +2889,52 @@ h1 a:after, h2 a:after, h3 a:after, h4 a:after, h5 a:after, h6 a:after {
 		})
 	}
 
+	// Count navigations in single-page apps: history.pushState(),
+	// history.replaceState(), the back button, and changes to location.hash.
+	window.goatcounter.bind_spa = function() {
+		if (goatcounter.spa_bound)
+			return
+		goatcounter.spa_bound = true
+
+		var last = location.href
+		var nav = function(hash) {
+			if (location.href === last)
+				return
+			last = location.href
+
+			// The referrer is the same for the entire page load, so don't send
+			// it again.
+			var vars = {referrer: ''}
+			if (hash)
+				vars.path = (location.pathname + location.search + location.hash) || '/'
+			goatcounter.count(vars)
+		}
+
+		if (window.history && history.pushState) {
+			var wrap = function(name) {
+				var orig = history[name]
+				history[name] = function() {
+					var r = orig.apply(this, arguments)
+					nav(false)
+					return r
+				}
+			}
+			wrap('pushState')
+			wrap('replaceState')
+			window.addEventListener('popstate', function() { nav(false) }, false)
+		}
+		window.addEventListener('hashchange', function() { nav(true) }, false)
+	}
+
+	// Stop counting pageviews from this browser, or start again if out is
+	// false; this is stored in localStorage for the site's domain.
+	window.goatcounter.opt_out = function(out) {
+		if (out === false)
+			localStorage.removeItem('skipgc')
+		else
+			localStorage.setItem('skipgc', 't')
+	}
+
 	// Make it easy to skip your own views.
 	if (location.hash === '#toggle-goatcounter')
 		if (localStorage.getItem('skipgc') === 't') {
@@ -2180,6 +2951,8 @@ h1 a:after, h2 a:after, h3 a:after, h4 a:after, h5 a:after, h6 a:after {
 			goatcounter.count()
 			if (!goatcounter.no_events)
 				goatcounter.bind_events()
+			if (goatcounter.spa)
+				goatcounter.bind_spa()
 		}
 
 		if (document.body === null)
@@ -11866,7 +12639,7 @@ http://nicolasgallagher.com/micro-clearfix-hack/
 		;[report_errors, period_select, load_refs, tooltip, paginate_paths,
 			hchart_detail, settings_tabs, billing_subscribe, setup_datepicker,
 			filter_paths, add_ip, fill_tz, draw_chart, bind_scale, tsort,
-			copy_pre, ref_pages,
+			copy_pre, ref_pages, hchart_facets,
 		].forEach(function(f) { f.call() })
 	});
 
@@ -12149,6 +12922,11 @@ http://nicolasgallagher.com/micro-clearfix-hack/
 
 	// Highlight a filter pattern in the path and title.
 	var highlight_filter = function(s) {
+		// Exclusions and facets never match anything that's listed.
+		s = s.split(/\s+/).filter(function(t) {
+			return !(t.length > 1 && t[0] === '-') && t.indexOf('path!=') !== 0 &&
+				!t.match(/^(country|browser|system|ref)!?=/)
+		}).join(' ')
 		if (s === '')
 			return;
 		$('.pages-list .count-list-pages > tbody.pages').find('.rlink, .page-title:not(.no-title)').each(function(_, elem) {
@@ -12255,6 +13033,7 @@ http://nicolasgallagher.com/micro-clearfix-hack/
 					data:    append_period({total: get_total(), offset: rows.find('>div').length}),
 					success: function(data) {
 						rows.append($(data.html).find('>div'))
+						add_facet_links(chart)
 						if (!data.more)
 							btn.css('display', 'none')
 						done()
@@ -12267,9 +13046,11 @@ http://nicolasgallagher.com/micro-clearfix-hack/
 		$('.hchart').on('click', '.load-detail', function(e) {
 			e.preventDefault()
 
+			// Details can have details of their own, such as the cities
+			// for a region.
 			var btn   = $(this),
 				row   = btn.closest('div[data-name]'),
-				chart = btn.closest('.hchart'),
+				chart = btn.closest('[data-detail]'),
 				url   = chart.attr('data-detail'),
 				name  = row.attr('data-name')
 			if (!url || !name)
@@ -12293,6 +13074,42 @@ http://nicolasgallagher.com/micro-clearfix-hack/
 		})
 	}
 
+	// Filter the entire dashboard on a browser, location, etc. by adding it to
+	// the filter.
+	var hchart_facets = function() {
+		$('.hchart[data-facet]').each(function(_, chart) { add_facet_links($(chart)) })
+
+		$('.hcharts').on('click', '.filter-facet a', function(e) {
+			e.preventDefault()
+
+			var facet = $(this).closest('.hchart').attr('data-facet'),
+				name  = $(this).closest('div[data-name]').attr('data-name'),
+				input = $('#filter-paths')
+			if (name === '(unknown)')
+				name = ''
+			if (name === '' || name.match(/\s/))
+				name = '"' + name + '"'
+
+			input.val($.trim(input.val() + ' ' + facet + '=' + name))
+			$('#dash-form').trigger('submit')
+		})
+	}
+
+	// Add a link to filter on every row of a horizontal chart.
+	var add_facet_links = function(chart) {
+		var facet = chart.attr('data-facet')
+		if (!facet)
+			return
+		chart.children('.rows').children('div[data-name]').each(function(_, row) {
+			row = $(row)
+			if (row.find('.filter-facet').length)
+				return
+			if (row.attr('data-name') === '(unknown)' && facet !== 'ref')
+				return
+			row.find('.col-name').append(' <sup class="filter-facet"><a href="#" title="Show only pageviews with this">filter</a></sup>')
+		})
+	}
+
 	// Set up the tabbed navigation in the settings.
 	var settings_tabs = function() {
 		var nav = $('.tab-nav');
@@ -12340,6 +13157,9 @@ http://nicolasgallagher.com/micro-clearfix-hack/
 		$('#dash-main input[type="checkbox"]').on('click', function(e) {
 			$(this).closest('form').trigger('submit')
 		})
+		$('#dash-main select').on('change', function(e) {
+			$(this).closest('form').trigger('submit')
+		})
 
 		$('#dash-select-period').on('click', 'button', function(e) {
 			e.preventDefault();
@@ -12480,7 +13300,7 @@ http://nicolasgallagher.com/micro-clearfix-hack/
 
 		// Translucent hover effect; need a new div because the height isn't 100%
 		var add_cursor = function(t) {
-			if (t.closest('.chart-bar').length === 0 || t.is('#cursor') || t.closest('.chart-left, .chart-right').length > 0)
+			if (t.closest('.chart-bar').length === 0 || t.is('#cursor, .annotation') || t.closest('.chart-left, .chart-right').length > 0)
 				return
 
 			$('#cursor').remove()
@@ -12655,6 +13475,8 @@ http://nicolasgallagher.com/micro-clearfix-hack/
 		data = data || {}
 		data['period-start'] = $('#period-start').val()
 		data['period-end']   = $('#period-end').val()
+		if (data.filter === undefined && $('#filter-paths').val())
+			data.filter = $('#filter-paths').val()
 		return data
 	}
 
@@ -13049,6 +13871,8 @@ tr.target .chart-left { display: block; }
 .chart-bar > .f        { background-color: #eee; }
 .chart-bar > .half     { border-top: 1px solid #ddd; position: absolute; top: 50%; left: 0; right: 0; }
 .chart-bar > #cursor   { position: absolute; top: 0; bottom: 0; background: rgba(0, 0, 0, .2); }
+.chart-bar > .annotation { position: absolute; top: 0; bottom: 0; width: 3px; margin-left: -1px; background: #f0a500; z-index: 1; }
+.totals .updating      { color: #999; font-style: italic; }
 
 
 /*** Horizontal charts
@@ -13072,12 +13896,15 @@ tr.target .chart-left { display: block; }
 .hchart .load-more   { display: inline-block; margin-left: .2em; margin-top: .2em; }
 .hchart .load-detail { display: block; color: #252525; }
 .hchart .detail      { padding-left: 3em; padding-right: 5em; border-bottom: 1px solid #bbb; }
+.hchart .filter-facet { position: absolute; top: 0; right: .3em; z-index: 2; display: none; }
+.hchart .rows >div:hover >.col-name >.filter-facet { display: inline; }
 .load-detail:hover      { text-decoration: none; background-color: #eee; }
 .load-detail:hover .bar { background-color: #ebb7ef; }
 
 /*** Dashboard form (filter, time period select, etc.)
  ******************************************************/
 #dash-saved-views { text-align: right; margin-right: .3em; }
+#dash-saved-views form { display: inline; }
 #dash-move        { display: flex; justify-content: space-between; padding: .2em; }
 #dash-form        { display: block; padding-bottom: .4em; }
 #dash-form span   { margin-left: 0; } /* Reset from hello-css */
@@ -14481,6 +15308,7 @@ var Templates = map[string][]byte{
 </form>
 
 <p><a href="/user/forgot">Forgot password?</a></p>
+{{if .OIDC}}<p><a href="/user/oidc">Sign in with single sign-on</a></p>{{end}}
 `),
 	"tpl/_backend_sitecode.gohtml": []byte(`{{/*************************************************************************
  * This file was generated from tpl/_backend_sitecode.markdown. DO NOT EDIT.
@@ -14531,6 +15359,7 @@ var Templates = map[string][]byte{
       <li><a href="#filter" id="markdown-toc-filter"><code>filter()</code></a>        <ul>
           <li><a href="#bindevents" id="markdown-toc-bindevents"><code>bind_events()</code></a></li>
           <li><a href="#getqueryname" id="markdown-toc-getqueryname"><code>get_query(name)</code></a></li>
+          <li><a href="#optoutout" id="markdown-toc-optoutout"><code>opt_out(out)</code></a></li>
         </ul>
       </li>
     </ul>
@@ -14542,6 +15371,7 @@ var Templates = map[string][]byte{
       <li><a href="#multiple-domains" id="markdown-toc-multiple-domains">Multiple domains</a></li>
       <li><a href="#ignore-query-parameters-in-path" id="markdown-toc-ignore-query-parameters-in-path">Ignore query parameters in path</a></li>
       <li><a href="#spa" id="markdown-toc-spa">SPA</a></li>
+      <li><a href="#engagement" id="markdown-toc-engagement">Engagement</a></li>
       <li><a href="#using-navigatorsendbeacon" id="markdown-toc-using-navigatorsendbeacon">Using navigator.sendBeacon</a></li>
       <li><a href="#custom-events" id="markdown-toc-custom-events">Custom events</a></li>
       <li><a href="#consent-notice" id="markdown-toc-consent-notice">Consent notice</a></li>
@@ -14552,8 +15382,11 @@ var Templates = map[string][]byte{
       <li><a href="#tracking-from-backend-middleware" id="markdown-toc-tracking-from-backend-middleware">Tracking from backend middleware</a></li>
       <li><a href="#location-of-countjs-and-loading-it-locally" id="markdown-toc-location-of-countjs-and-loading-it-locally">Location of count.js and loading it locally</a></li>
       <li><a href="#setting-the-endpoint-in-javascript" id="markdown-toc-setting-the-endpoint-in-javascript">Setting the endpoint in JavaScript</a></li>
+      <li><a href="#embedding-the-statistics" id="markdown-toc-embedding-the-statistics">Embedding the statistics</a></li>
+      <li><a href="#view-counter-badge" id="markdown-toc-view-counter-badge">View counter badge</a></li>
     </ul>
   </li>
+  <li><a href="#privacy-policy" id="markdown-toc-privacy-policy">Privacy policy</a></li>
 </ul>
 
 <h2 id="events">Events <a href="#events"></a></h2>
@@ -14626,6 +15459,14 @@ are supported:</p>
       <td style="text-align: left"><code>endpoint</code></td>
       <td style="text-align: left">Customize the endpoint for sending pageviews to; see <a href="#setting-the-endpoint-in-javascript">Setting the endpoint in JavaScript </a>.</td>
     </tr>
+    <tr>
+      <td style="text-align: left"><code>spa</code></td>
+      <td style="text-align: left">Count navigation in single-page apps (<code>history.pushState()</code>, <code>history.replaceState()</code>, and changes to <code>location.hash</code>). This is set from the site settings if you load the script from <code>{{.Site.URL}}/count.js</code>.</td>
+    </tr>
+    <tr>
+      <td style="text-align: left"><code>ping</code></td>
+      <td style="text-align: left">Send a “ping” while the page is visible, to estimate the time spent on the page; see <a href="#engagement">Engagement</a>.</td>
+    </tr>
   </tbody>
 </table>
 
@@ -14662,6 +15503,10 @@ is <code>null</code>.</p>
       <td style="text-align: left"><code>event</code></td>
       <td style="text-align: left">Treat the <code>path</code> as an event, rather than a URL. Boolean.</td>
     </tr>
+    <tr>
+      <td style="text-align: left"><code>dimensions</code></td>
+      <td style="text-align: left">Values for the custom dimensions configured in the settings, as an object; e.g. <code>{tenant: 'acme', logged_in: true}</code>.</td>
+    </tr>
   </tbody>
 </table>
 
@@ -14740,6 +15585,11 @@ most people. This is just if you want to get the campaign on only some pages, or
 want to do some more advanced filtering (such as only including your own
 campaigns).</p>
 
+<h4 id="optoutout"><code>opt_out(out)</code> <a href="#optoutout"></a></h4>
+<p>Stop sending pageviews from this browser, or start again if <code>out</code> is <code>false</code>.
+This is stored in <code>localStorage</code>, so it’s remembered for your domain. See
+<a href="#privacy-policy">Privacy policy</a>.</p>
+
 <h2 id="examples">Examples <a href="#examples"></a></h2>
 
 <h3 id="load-only-on-production">Load only on production <a href="#load-only-on-production"></a></h3>
@@ -14865,6 +15715,20 @@ for navigation then you probably <em>don’t</em> want to do this.</p>
 {{template "code" .}}
 </code></pre>
 
+<h3 id="engagement">Engagement <a href="#engagement"></a></h3>
+<p>Set <code>ping</code> to estimate how long people spend on a page:</p>
+
+<pre><code>&lt;script&gt;
+    window.goatcounter = {ping: true}
+&lt;/script&gt;
+{{template "code" .}}
+</code></pre>
+
+<p>This sends a small request after 10 and 30 seconds, every minute after that,
+and when the page is hidden or closed. Only the time the page is visible is
+counted. The average and median time on page is displayed in the “Engagement”
+section of the dashboard.</p>
+
 <h3 id="using-navigatorsendbeacon">Using navigator.sendBeacon <a href="#using-navigatorsendbeacon"></a></h3>
 
 <p>You can use <a href="https://developer.mozilla.org/en-US/docs/Web/API/Navigator/sendBeacon"><code>navigator.sendBeacon()</code></a> with GoatCounter, for example to
@@ -15061,6 +15925,80 @@ want to modify that in JavaScript; you can use <code>goatcounter.endpoint</code>
 
 <p>Note that <code>data-goatcounter</code> will always override any <code>goatcounter.endpoint</code>.</p>
 
+<h3 id="embedding-the-statistics">Embedding the statistics <a href="#embedding-the-statistics"></a></h3>
+<p>You can embed a small widget with the number of visitors and pageviews and a
+chart of the last 30 days on your site with an iframe:</p>
+
+<pre><code>&lt;iframe src="{{.Site.URL}}/widget"
+    style="border: none; width: 20em; height: 6em"&gt;&lt;/iframe&gt;
+</code></pre>
+
+<p>This only works if the statistics are public (see the settings). The widget can
+be changed with query parameters:</p>
+
+<ul>
+  <li><code>days</code> – number of days to show, up to 365 (default: 30).</li>
+  <li><code>theme</code> – <code>light</code> or <code>dark</code> (default: <code>light</code>).</li>
+  <li><code>color</code> – colour of the chart as a hex value, e.g. <code>9a15a4</code>.</li>
+</ul>
+
+<h3 id="view-counter-badge">View counter badge <a href="#view-counter-badge"></a></h3>
+<p>A badge with the number of pageviews for a path can be displayed with an image;
+for example for a project’s README:</p>
+
+<pre><code>&lt;img src="{{.Site.URL}}/counter/path/to/page.svg"&gt;
+</code></pre>
+
+<p>Use <code>%2F</code> for <code>/</code>; e.g. <code>{{.Site.URL}}/counter/%2F.svg</code> for the front page.
+This needs to be enabled in the settings, unless the statistics are public. Add
+<code>?label=text</code> to change the label, or <code>?unique=1</code> to display the number of
+visitors instead of pageviews.</p>
+
+<p>Use <code>.json</code> instead of <code>.svg</code> to get the counts as JSON, for example to display
+them next to every article on a static site:</p>
+
+<pre><code>fetch('{{.Site.URL}}/counter/' + encodeURIComponent(location.pathname) + '.json')
+    .then((r) =&gt; r.json())
+    .then((d) =&gt; console.log(d.count, d.count_unique))
+</code></pre>
+
+<p>The counts are cached for a few minutes.</p>
+
+<h2 id="privacy-policy">Privacy policy <a href="#privacy-policy"></a></h2>
+<p>You can use this text in your privacy policy; it’s generated from the current
+settings, so update it when you change them:</p>
+
+<blockquote id="privacy-text">
+<p>This site uses <a href="https://www.goatcounter.com">GoatCounter</a> to
+count visits. For every pageview the URL, title, referrer, browser, screen
+size, language, and {{if .Site.Settings.Cities}}city{{else}}country (and region for
+large countries){{end}} are recorded. The IP address isn’t stored with the
+pageviews; {{if .Site.Settings.AnonymizeIP}}the last part is removed before{{else}}it’s
+only{{end}} used to look up the {{if .Site.Settings.Cities}}location{{else}}country{{end}}
+and, with a hash that changes at least once a day, to group pageviews in to
+visits. It’s kept for a few seconds until the pageview is processed, and may be
+kept {{if .Site.Settings.AnonymizeIP}}with the last part removed {{end}}in the
+server logs for a limited time to investigate abuse and errors.
+{{- if .Site.Settings.HonorDNT}} Nothing is recorded if your browser sends the
+Do Not Track or Global Privacy Control signal.{{end}}
+{{- if .Site.Settings.DataRetention}} Individual pageviews are deleted after
+{{.Site.Settings.DataRetention}} days; only the totals are kept.{{end}}
+You can <a href="{{.Site.URL}}/opt-out">opt out</a> of being counted.</p>
+</blockquote>
+
+<p>Visitors can opt out on <code>{{.Site.URL}}/opt-out</code>, which you can link to or embed
+with an iframe:</p>
+
+<pre><code>&lt;iframe src="{{.Site.URL}}/opt-out"
+    style="border: none; width: 100%; height: 8em"&gt;&lt;/iframe&gt;
+</code></pre>
+
+<p>This sets a cookie on the GoatCounter domain, which some browsers block for
+embedded pages and requests from other sites. You can also add a button on your
+own site which calls <code>goatcounter.opt_out()</code> (or <code>goatcounter.opt_out(false)</code> to
+opt in again); this stores the choice in <code>localStorage</code> for your domain, and
+count.js won’t send any pageviews from then on.</p>
+
 {{end}} {{/* if eq .Path "/settings" */}}
 `),
 	"tpl/_backend_top.gohtml": []byte(`<!DOCTYPE html>
@@ -15185,15 +16123,67 @@ want to modify that in JavaScript; you can use <code>goatcounter.endpoint</code>
 	</div>
 </footer>
 `),
-	"tpl/_dashboard_browsers.gohtml": []byte(`<div class="hchart" data-detail="/hchart-detail?kind=browser" data-more="/hchart-more?kind=browser">
+	"tpl/_dashboard_browsers.gohtml": []byte(`<div class="hchart" data-facet="browser" data-detail="/hchart-detail?kind=browser" data-more="/hchart-more?kind=browser">
 	<h2>Browsers</h2>
 	{{horizontal_chart .Context .Stats .TotalUniqueHits 6 true true}}
 </div>
 `),
-	"tpl/_dashboard_locations.gohtml": []byte(`<div class="hchart" data-more="/hchart-more?kind=location">
-	<h2>Locations</h2>
+	"tpl/_dashboard_dimension.gohtml": []byte(`<div class="hchart" data-more="/hchart-more?kind=dimension&amp;name={{.Name}}">
+	<h2>{{.Name}}</h2>
 	{{horizontal_chart .Context .Stats .TotalUniqueHits 6 false true}}
 </div>
+`),
+	"tpl/_dashboard_engagement.gohtml": []byte(`<div class="hchart">
+	<h2>Engagement</h2>
+	<div class="rows">
+		{{range $e := .Engagement}}
+			<div data-name="{{$e.Path}}" title="{{$e.Count}} pageviews">
+				<span class="col-name">{{$e.Path}}</span>
+				<span class="col-count" title="Average">{{seconds $e.Average}}</span>
+				<span class="col-count" title="Median">{{seconds $e.Median}}</span>
+			</div>
+		{{end}}
+	</div>
+</div>
+`),
+	"tpl/_dashboard_entryexit.gohtml": []byte(`<div class="hchart">
+	<h2>{{.Title}}</h2>
+	<div class="rows">
+		{{range $e := .List}}
+			<div data-name="{{$e.Path}}">
+				<span class="col-name">{{$e.Path}}</span>
+				<span class="col-count">{{nformat $e.Count $.Site}}</span>
+			</div>
+		{{else}}
+			<em>Nothing to display</em>
+		{{end}}
+	</div>
+</div>
+`),
+	"tpl/_dashboard_languages.gohtml": []byte(`<div class="hchart" data-facet="language" data-more="/hchart-more?kind=language">
+	<h2>Languages</h2>
+	{{horizontal_chart .Context .Stats .TotalUniqueHits 6 false true}}
+</div>
+`),
+	"tpl/_dashboard_live.gohtml": []byte(`<div class="hchart">
+	<h2>Right now</h2>
+	<p><strong>{{nformat .Live.Visitors $.Site}}</strong> visitors in the last 5 minutes</p>
+	{{if .Live.Pages}}
+		<div class="rows">
+			{{range $p := .Live.Pages}}
+				<div data-name="{{$p.Path}}">
+					<span class="col-name">{{$p.Path}}</span>
+					<span class="col-count">{{nformat $p.Visitors $.Site}}</span>
+				</div>
+			{{end}}
+		</div>
+	{{end}}
+</div>
+`),
+	"tpl/_dashboard_locations.gohtml": []byte(`<div class="hchart" data-facet="country"{{if .Regions}} data-detail="/hchart-detail?kind=location"{{end}} data-more="/hchart-more?kind=location">
+	<h2>Locations</h2>
+	{{horizontal_chart .Context .Stats .TotalUniqueHits 6 .Regions true}}
+</div>
 `),
 	"tpl/_dashboard_pages.gohtml": []byte(`<div class="pages-list {{if .Daily}}pages-list-daily{{end}}">
 	<h2 class="full-width">Pages <small>
@@ -15221,6 +16211,9 @@ want to modify that in JavaScript; you can use <code>goatcounter.endpoint</code>
 			{{if and $.Site.LinkDomain (not $h.Event)}}
 				<br><small class="go"><a target="_blank" rel="noopener" href="https://{{$.Site.LinkDomain}}{{$h.Path}}">Go to {{$.Site.LinkDomain}}{{$h.Path}}</a></small>
 			{{end}}
+			{{if not $h.Event}}
+				<br><small class="go"><a href="/flow?path={{$h.Path}}&amp;period-start={{tformat $.Site $.PeriodStart ""}}&amp;period-end={{tformat $.Site $.PeriodEnd ""}}">Page flow</a></small>
+			{{end}}
 		</td>
 		<td>
 			<div class="show-mobile">
@@ -15230,6 +16223,9 @@ want to modify that in JavaScript; you can use <code>goatcounter.endpoint</code>
 				{{if and $.Site.LinkDomain (not $h.Event)}}
 					<br><small class="go"><a target="_blank" rel="noopener" href="https://{{$.Site.LinkDomain}}{{$h.Path}}">Go to {{$.Site.LinkDomain}}{{$h.Path}}</a></small>
 				{{end}}
+				{{if not $h.Event}}
+					<br><small class="go"><a href="/flow?path={{$h.Path}}&amp;period-start={{tformat $.Site $.PeriodStart ""}}&amp;period-end={{tformat $.Site $.PeriodEnd ""}}">Page flow</a></small>
+				{{end}}
 			</div>
 			<div class="chart chart-bar" data-max="{{$h.Max}}">
 				<span class="chart-left"><a href="#" class="rescale" title="Scale Y axis to max">↕️&#xfe0e;</a></span>
@@ -15247,27 +16243,50 @@ want to modify that in JavaScript; you can use <code>goatcounter.endpoint</code>
 {{else}}
 	<tr><td colspan="3"><em>Nothing to display</em></td></tr>
 {{- end}}
+`),
+	"tpl/_dashboard_retention.gohtml": []byte(`<div class="retention">
+	<h2>Returning visitors</h2>
+	{{if .Retention.Cohorts}}
+		<table class="auto">
+			<thead><tr>
+				<th>{{if eq .Retention.Period "week"}}Week{{else}}Day{{end}}</th>
+				<th>Visitors</th>
+				{{range $i, $c := .Retention.Cohorts}}{{if $i}}<th>+{{$i}}</th>{{end}}{{end}}
+			</tr></thead>
+			<tbody>
+				{{range $c := .Retention.Cohorts}}<tr>
+					<td>{{$c.Start.Format "2006-01-02"}}</td>
+					<td>{{nformat $c.Visitors $.Site}}</td>
+					{{range $n := $c.Returning}}<td>{{nformat $n $.Site}}</td>{{end}}
+				</tr>{{end}}
+			</tbody>
+		</table>
+	{{else}}
+		<em>Nothing to display</em>
+	{{end}}
+</div>
 `),
 	"tpl/_dashboard_sizes.gohtml": []byte(`<div class="hchart" data-detail="/hchart-detail?kind=size">
 	<h2>Screen size</h2>
 	{{horizontal_chart .Context .Stats .TotalUniqueHits 6 true true}}
 </div>
 `),
-	"tpl/_dashboard_systems.gohtml": []byte(`<div class="hchart" data-detail="/hchart-detail?kind=system" data-more="/hchart-more?kind=system">
+	"tpl/_dashboard_systems.gohtml": []byte(`<div class="hchart" data-facet="system" data-detail="/hchart-detail?kind=system" data-more="/hchart-more?kind=system">
 	<h2>Systems</h2>
 	{{horizontal_chart .Context .Stats .TotalUniqueHits 6 true true}}
 </div>
 `),
-	"tpl/_dashboard_toprefs.gohtml": []byte(`<div class="hchart" data-detail="/hchart-detail?kind=topref" data-more="/hchart-more?kind=topref">
+	"tpl/_dashboard_toprefs.gohtml": []byte(`<div class="hchart" data-facet="ref" data-detail="/hchart-detail?kind=topref" data-more="/hchart-more?kind=topref">
 	<h2>Top referrers</h2>
 	{{horizontal_chart .Context .Stats .TotalUniqueHits 6 true true}}
 </div>
 `),
 	"tpl/_dashboard_totals.gohtml": []byte(`<div class="totals">
 	<h2 class="full-width">Totals <small>
-		<span class="total-unique-display">{{nformat .TotalUniqueHits $.Site}}</span> visits;
-		<span class='total-display'>{{nformat .TotalHits $.Site}}</span> pageviews
-	</small></h2>
+		<span class="total-unique-display">{{nformat .TotalUniqueHits $.Site}}</span> visits{{if .ChangeUnique}} <span class="change" title="Compared to {{nformat .PrevTotalUniqueHits $.Site}} visits">({{.ChangeUnique}})</span>{{end}};
+		<span class='total-display'>{{nformat .TotalHits $.Site}}</span> pageviews{{if .Change}} <span class="change" title="Compared to {{nformat .PrevTotalHits $.Site}} pageviews">({{.Change}})</span>{{end}}
+	</small>{{if .Page.Updating}}
+	<small class="updating" title="The statistics for the last hours are still being updated; the pageviews for these hours are shown instead">updating…</small>{{end}}</h2>
 	<table class="count-list">{{template "_dashboard_totals_row.gohtml" .}}</table>
 </div>
 
@@ -15280,7 +16299,7 @@ want to modify that in JavaScript; you can use <code>goatcounter.endpoint</code>
 			*/}}
 			<span class="chart-right"><small class="scale" title="Y-axis scale">{{nformat .Max $.Site}}</small></span>
 			<span class="half"></span>
-			{{bar_chart .Context .Page.Stats .Max .Daily}}
+			{{bar_chart .Context .Page.Stats .Max .Daily .Annotations}}
 		</div>
 	</td>
 </tr></tbody>
@@ -15298,6 +16317,22 @@ Martin
 <link rel="mask-icon" href="{{.Static}}/favicon/safari-pinned-tab.svg" color="#9a15a4">
 <meta name="msapplication-TileColor" content="#9f00a7">
 <meta name="theme-color" content="#ffffff">
+`),
+	"tpl/_feed_report.gohtml": []byte(`<p><strong>{{nformat .TotalUnique .Site}}</strong> visitors{{with .FormatChange .ChangeUnique}} ({{.}}){{end}} and
+<strong>{{nformat .Total .Site}}</strong> pageviews{{with .FormatChange .Change}} ({{.}}){{end}}
+from {{.Start.Format "January 2"}} to {{.End.Format "January 2, 2006"}}.</p>
+
+<h3>Top pages</h3>
+<ol>
+	{{range .Pages}}<li>{{.Path}} – {{nformat .CountUnique $.Site}}</li>
+	{{else}}<li>Nothing to display</li>{{end}}
+</ol>
+
+<h3>Top referrers</h3>
+<ol>
+	{{range .Refs}}<li>{{.Name}} – {{nformat .CountUnique $.Site}}</li>
+	{{else}}<li>Nothing to display</li>{{end}}
+</ol>
 `),
 	"tpl/_pricing.gohtml": []byte(`{{if .Site}}<fieldset id="home-pricing" class="plan"><span>{{else}}<div id="home-pricing">{{end}}
 	{{if .Site}}
@@ -15782,6 +16817,12 @@ send ample notification of this to everyone who has generated an API key.</p>
 send the API key in the <code>Authorization</code> header as <code>Authorization: bearer
 [token]</code>.</p>
 
+<p>Every endpoint requires a permission; the token has the permissions selected
+when creating it, plus the permissions of its role (if any). A role is a named
+set of permissions which can be managed in the same settings tab. A request
+without the correct permissions returns a 403 error listing the missing
+permissions.</p>
+
 <p>You will need to use <code>Content-Type: application/json</code>; all requests return JSON
 unless noted otherwise.</p>
 
@@ -15856,7 +16897,235 @@ start=$(curl "$api/export/$id" | jq .last_hit_id)
 id=$(curl -X POST --data "{\"start_from_hit_id\":$start}" "$api/export" | jq .id)
 </code></pre>
 
+<h3 id="filtering-paths">Filtering paths <a href="#filtering-paths"></a></h3>
+
+<p>The <code>filter</code> parameter for the export (in the request body) and timeseries
+endpoints works the same as the filter on the dashboard: it matches if the path
+or title contains the text, case-insensitive. Start the filter with <code>~</code> to use a
+regular expression instead:</p>
+
+<pre><code>$ curl -X POST --data '{"filter": "~^/blog/[0-9]+$"}' "$api/export"
+</code></pre>
+
+<p>Regular expressions use the <a href="https://github.com/google/re2/wiki/Syntax">RE2 syntax</a>, can be at most 250 characters
+long, and can match at most 1,000 paths in the selected period.</p>
+
+<p>Paths can be excluded by adding terms separated by spaces: <code>-text</code> excludes
+paths containing the text, <code>-~regexp</code> excludes paths matching the regular
+expression, and <code>path!=/path</code> excludes that exact path. Exclusions only look at
+the path, and not the title:</p>
+
+<pre><code>$ curl "$api/timeseries?filter=blog+-/blog/feed+path!=/blog"
+</code></pre>
+
+<p>Pageviews can also be filtered by country, browser, system, referrer, or
+language with <code>country=DE</code>, <code>browser=Firefox</code>, <code>system=Linux</code>,
+<code>ref=example.com</code>, or <code>language=en</code>; use <code>!=</code> to exclude them instead. Countries can be a code or English name, and values
+with spaces need double quotes: <code>browser="Mobile Safari"</code>. Unlike the other
+terms these filter all the statistics, and not just the paths:</p>
+
+<pre><code>$ curl "$api/timeseries?group=ref&amp;filter=country=DE+browser!=Chrome"
+</code></pre>
+
+<h3 id="visitors-right-now">Visitors right now <a href="#visitors-right-now"></a></h3>
+
+<p>The unique visitors and top pages in the last five minutes; this requires a
+token with the “Read statistics” permission:</p>
+
+<pre><code>$ curl "$api/stats/live"
+{"since":"2020-07-26T14:37:00Z","visitors":4,"pageviews":7,"pages":[{"path":"/","visitors":3}, {"path":"/about","visitors":1}]}
+</code></pre>
+
+<h3 id="stream-pageviews">Stream pageviews <a href="#stream-pageviews"></a></h3>
+
+<p>New pageviews are streamed as <a href="https://developer.mozilla.org/en-US/docs/Web/API/Server-sent_events">Server-Sent Events</a> from <code>/stats/stream</code>;
+this also requires the “Read statistics” permission. The connection is closed
+after about a minute, and clients should reconnect. For example in JavaScript:</p>
+
+<pre><code>var es = new EventSource('https://[my code].goatcounter.com/api/v0/stats/stream?access_token=' + token)
+es.addEventListener('hit', function(e) {
+    var hit = JSON.parse(e.data)
+    console.log(hit.path, hit.ref, hit.location)
+})
+</code></pre>
+
+<p>The browser’s <code>EventSource</code> can’t set headers, which is why the token is sent
+as <code>access_token</code>; you can also use the <code>Authorization</code> header.</p>
+
+<h3 id="feed">Feed <a href="#feed"></a></h3>
+
+<p>An <a href="https://en.wikipedia.org/wiki/Atom_(Web_standard)">Atom</a> feed of the last four weeks is available from <code>/stats/feed</code>;
+every entry has the number of visitors and pageviews and the top pages and
+referrers for that week. This requires the “Read statistics” permission; most
+feed readers can’t set headers, so add the token as <code>access_token</code>:</p>
+
+<pre><code>https://[my code].goatcounter.com/api/v0/stats/feed?access_token=[token]
+</code></pre>
+
+<p>Every site has its own feed, so use a token for every site you want to follow.</p>
+
+<h3 id="timeseries">Timeseries <a href="#timeseries"></a></h3>
+
+<p>Get the pageviews per day for the top 5 paths in June:</p>
+
+<pre><code>$ curl "$api/timeseries?metric=pageviews&amp;group=path&amp;granularity=day&amp;start=2020-06-01&amp;end=2020-06-30&amp;limit=5"
+{"metric":"pageviews","group":"path","granularity":"day", [..]
+ "buckets":["2020-06-01","2020-06-02", [..]],
+ "series":[{"name":"/","total":4012,"values":[120,131, [..]]}, [..]]}
+</code></pre>
+
+<p>The <code>metric</code> can be <code>pageviews</code> or <code>visitors</code>, <code>group</code> can be <code>path</code>, <code>ref</code>, or
+<code>country</code>, and <code>granularity</code> can be <code>hour</code>, <code>day</code>, or <code>month</code>. All times are in
+UTC; use <code>tz</code> with a timezone name to get the days and buckets in that timezone
+(this isn’t supported for <code>country</code>):</p>
+
+<pre><code>$ curl "$api/timeseries?start=2020-06-01&amp;end=2020-06-30&amp;tz=America/New_York"
+</code></pre>
+
+<p>The <code>tz</code> parameter also works for <code>/stats/entries</code>, <code>/stats/exits</code>, and
+<code>/stats/retention</code>.</p>
+
+<p>Add <code>compare=previous</code> or <code>compare=year</code> to also get the values for the same
+groups in the previous period or the same period last year, and the percentage
+change of the total:</p>
+
+<pre><code>$ curl "$api/timeseries?start=2020-06-01&amp;end=2020-06-30&amp;limit=5&amp;compare=year"
+{[..] "compare":{"period":"year","start":"2019-06-01T00:00:00Z", [..]
+            "buckets":["2019-06-01","2019-06-02", [..]]},
+ "series":[{"name":"/","total":4012,"values":[120,131, [..]],
+            "previous":[98,102, [..]],"previous_total":3391,"change":18.3}, [..]]}
+</code></pre>
+
+<p>The <code>change</code> is omitted if there were no pageviews in the previous period.</p>
+
+<h3 id="saved-views">Saved views <a href="#saved-views"></a></h3>
+
+<p>Views saved on the dashboard can be used with <code>segment=name</code>; this uses the
+period, path filter, and comparison of the saved view for your user:</p>
+
+<pre><code>$ curl "$api/timeseries?segment=blog-traffic"
+</code></pre>
+
+<p>Any parameters you add take precedence over the saved view. The
+<code>/stats/entries</code>, <code>/stats/exits</code>, and <code>/stats/retention</code> endpoints use the
+period of the saved view.</p>
+
+<h3 id="annotations">Annotations <a href="#annotations"></a></h3>
+
+<p>Annotations are notes for a day, such as “v2 launch” or “HN front page”, which
+are displayed as a marker on the dashboard charts. Adding and removing them
+requires the “Change settings” permission:</p>
+
+<pre><code>$ curl -X POST --data '{"day":"2020-06-17","text":"v2 launch"}' "$api/annotations"
+{"id":1,"day":"2020-06-17","text":"v2 launch","created_at":"2020-06-18T10:21:13Z"}
+
+$ curl -X DELETE "$api/annotations/1"
+</code></pre>
+
+<p>The day is in the site’s timezone. <code>GET /annotations</code> lists all annotations, and
+the annotations in the period are also included in the timeseries as
+<code>annotations</code>.</p>
+
+<h3 id="recalculating-statistics">Recalculating statistics <a href="#recalculating-statistics"></a></h3>
+
+<p>The statistics are calculated from the pageviews when they’re recorded; to
+recalculate them for a period, for example after an import or after changing
+the path groups, use <code>POST /reindex</code> with the “Change settings” permission:</p>
+
+<pre><code>$ curl -X POST --data '{"start":"2020-06-01","end":"2020-06-30"}' "$api/reindex"
+{"start":"2020-06-01","end":"2020-06-30","tables":["all"]}
+</code></pre>
+
+<p>This runs in the background. The dates are in UTC and the end can’t be later
+than yesterday. <code>tables</code> is optional; see <code>goatcounter help reindex</code> for the
+list of tables. The <code>goatcounter reindex</code> command does the same from the
+command line.</p>
+
+<h3 id="returning-visitors">Returning visitors <a href="#returning-visitors"></a></h3>
+
+<p>Get cohorts of visitors first seen on a day (or week, with <code>period=week</code>), and
+how many of them returned in the following days:</p>
+
+<pre><code>$ curl "$api/stats/retention?period=day&amp;start=2020-06-17&amp;end=2020-06-18"
+{"period":"day","cohorts":[
+    {"start":"2020-06-17T00:00:00Z","visitors":42,"returning":[3]},
+    {"start":"2020-06-18T00:00:00Z","visitors":51,"returning":[]}]}
+</code></pre>
+
+<p>Sessions are only kept for a few hours, so returning visitors are mostly people
+who were on the site around midnight.</p>
+
+<h3 id="entry-and-exit-pages">Entry and exit pages <a href="#entry-and-exit-pages"></a></h3>
+
+<p>Get the pages sessions started and ended on:</p>
+
+<pre><code>$ curl "$api/stats/entries?start=2020-06-01&amp;end=2020-06-30&amp;limit=5"
+[{"path":"/","count":4012},{"path":"/blog/post","count":1223}, [..]]
+
+$ curl "$api/stats/exits?start=2020-06-01&amp;end=2020-06-30&amp;limit=5"
+[{"path":"/blog/post","count":1180},{"path":"/","count":873}, [..]]
+</code></pre>
+
+<h3 id="queries">Queries <a href="#queries"></a></h3>
+
+<p>There are a number of pre-defined read-only queries for answering questions
+that aren’t covered by the other endpoints; <code>GET /query</code> lists all of them. To
+run one:</p>
+
+<pre><code>$ curl -X POST --data '{"query": "refs", "params": {"start": "2020-06-01", "end": "2020-06-30", "path": "/blog/*"}}' "$api/query"
+{"query":"refs","params":{..},"rows":[{"name":"news.ycombinator.com","count":1223,"count_unique":1057}, [..]]}
+</code></pre>
+
+<p>Queries are limited to 3 seconds and every token can run 100 queries per hour.</p>
+
 {{template "_bottom.gohtml" .}}
+`),
+	"tpl/backend_bots.gohtml": []byte(`{{template "_backend_top.gohtml" .}}
+
+<h1>Bot traffic</h1>
+<p>Pageviews from bots are stored, but are never included in the statistics on
+	the dashboard. This includes bots detected automatically, matched with the
+	<a href="/settings#setting">bot rules</a>, and datacenter traffic if that’s
+	enabled.</p>
+
+<form method="get" action="/bots">
+	<label for="period-start">From</label>
+	<input type="date" id="period-start" name="period-start" value="{{.PeriodStart}}">
+	<label for="period-end">to</label>
+	<input type="date" id="period-end" name="period-end" value="{{.PeriodEnd}}">
+	<button type="submit">Show</button>
+</form>
+
+<h2>{{nformat .Bots.Total $.Site}} pageviews</h2>
+<div class="chart chart-bar">{{bar_chart $.Context .Bots.Days .Bots.Max true}}</div>
+
+<div class="flow">
+	<table class="auto table-left">
+		<thead><tr><th>User-Agent</th><th>Count</th></tr></thead>
+		<tbody>
+			{{range $e := .Bots.UserAgents}}<tr>
+				<td>{{if $e.Name}}{{$e.Name}}{{else}}<em>(none)</em>{{end}}</td>
+				<td>{{nformat $e.Count $.Site}}</td>
+			</tr>{{else}}
+				<tr><td colspan="2"><em>Nothing to display</em></td></tr>
+			{{end}}
+		</tbody>
+	</table>
+
+	<table class="auto table-left">
+		<thead><tr><th>Path</th><th>Count</th></tr></thead>
+		<tbody>
+			{{range $e := .Bots.Paths}}<tr>
+				<td>{{$e.Name}}</td>
+				<td>{{nformat $e.Count $.Site}}</td>
+			</tr>{{else}}
+				<tr><td colspan="2"><em>Nothing to display</em></td></tr>
+			{{end}}
+		</tbody>
+	</table>
+</div>
+
+{{template "_backend_bottom.gohtml" .}}
 `),
 	"tpl/backend_code.gohtml": []byte(`{{template "_backend_top.gohtml" .}}
 
@@ -15869,6 +17138,50 @@ id=$(curl -X POST --data "{\"start_from_hit_id\":$start}" "$api/export" | jq .id
 	{{template "_backend_sitecode.gohtml" .}}
 </article>
 
+{{template "_backend_bottom.gohtml" .}}
+`),
+	"tpl/backend_flow.gohtml": []byte(`{{template "_backend_top.gohtml" .}}
+
+<h1>Page flow</h1>
+<p>The most common pages visitors came from and went to in the same session.</p>
+
+<form method="get" action="/flow">
+	<input type="hidden" name="period-start" value="{{.PeriodStart}}">
+	<input type="hidden" name="period-end" value="{{.PeriodEnd}}">
+	<label for="path">Path</label>
+	<input type="text" id="path" name="path" value="{{.Flow.Path}}" placeholder="/path">
+	<button type="submit">Show</button>
+	<small>{{.PeriodStart}} – {{.PeriodEnd}}</small>
+</form>
+
+{{if .Flow.Path}}
+	<div class="flow">
+		<table class="auto table-left">
+			<thead><tr><th>Previous page</th><th>Count</th></tr></thead>
+			<tbody>
+				{{range $e := .Flow.Prev}}<tr>
+					<td>{{if $e.Path}}<a href="/flow?path={{$e.Path}}&amp;period-start={{$.PeriodStart}}&amp;period-end={{$.PeriodEnd}}">{{$e.Path}}</a>{{else}}<em>(entered site)</em>{{end}}</td>
+					<td>{{nformat $e.Count $.Site}}</td>
+				</tr>{{else}}
+					<tr><td colspan="2"><em>Nothing to display</em></td></tr>
+				{{end}}
+			</tbody>
+		</table>
+
+		<table class="auto table-left">
+			<thead><tr><th>Next page</th><th>Count</th></tr></thead>
+			<tbody>
+				{{range $e := .Flow.Next}}<tr>
+					<td><a href="/flow?path={{$e.Path}}&amp;period-start={{$.PeriodStart}}&amp;period-end={{$.PeriodEnd}}">{{$e.Path}}</a></td>
+					<td>{{nformat $e.Count $.Site}}</td>
+				</tr>{{else}}
+					<tr><td colspan="2"><em>Nothing to display</em></td></tr>
+				{{end}}
+			</tbody>
+		</table>
+	</div>
+{{end}}
+
 {{template "_backend_bottom.gohtml" .}}
 `),
 	"tpl/backend_purge.gohtml": []byte(`{{template "_backend_top.gohtml" .}}
@@ -15982,6 +17295,29 @@ id=$(curl -X POST --data "{\"start_from_hit_id\":$start}" "$api/export" | jq .id
 				{{validate "user.email" .Validate}}
 				<span>You will need to re-verify the new address.</span>
 
+				<label for="user.email_reports">Email reports</label>
+				<select name="user.email_reports" id="user.email_reports">
+					<option {{option_value .User.EmailReports ""}}>Don’t send reports</option>
+					<option {{option_value .User.EmailReports "week"}}>Weekly</option>
+					<option {{option_value .User.EmailReports "month"}}>Monthly</option>
+				</select>
+				{{validate "user.email_reports" .Validate}}
+				<span>Get a summary of the pageviews, visitors, and top pages and referrers by email.</span>
+
+				<label>Include in reports</label>
+				<label><input type="checkbox" name="email_report_sections" value="totals" {{if .User.ReportsSection "totals"}}checked{{end}}> Visitors and pageviews</label><br>
+				<label><input type="checkbox" name="email_report_sections" value="pages" {{if .User.ReportsSection "pages"}}checked{{end}}> Top pages</label><br>
+				<label><input type="checkbox" name="email_report_sections" value="refs" {{if .User.ReportsSection "refs"}}checked{{end}}> Top referrers</label>
+				{{validate "user.settings.email_report_sections" .Validate}}
+				{{if gt (len .ReportSites) 1}}
+					<label>Sites to report on</label>
+					{{range $s := .ReportSites}}
+						<label><input type="checkbox" name="email_report_sites" value="{{$s.ID}}" {{if $.User.ReportsSite $s.ID}}checked{{end}}> {{$s.Display}}</label><br>
+					{{end}}
+					{{validate "user.settings.email_report_sites" .Validate}}
+					<span>A separate email is sent for every site.</span>
+				{{end}}
+
 				<label for="limits_page">Page size</label>
 				<input type="number" min="1" max="25" name="settings.limits.page" id="limits_page" value="{{.Site.Settings.Limits.Page}}">
 				{{validate "site.settings.limits.page" .Validate}}
@@ -16027,7 +17363,9 @@ id=$(curl -X POST --data "{\"start_from_hit_id\":$start}" "$api/export" | jq .id
 					{{end}}
 				</select>
 				{{validate "site.settings.timezone" .Validate}}
-				<span><a href="#_" id="set-local-tz">Set from browser</a></span>
+				<span><a href="#_" id="set-local-tz">Set from browser</a>.
+					Changing this recreates the daily statistics in the background,
+					which may take a while for larger sites.</span>
 			</fieldset>
 
 			<fieldset>
@@ -16037,21 +17375,95 @@ id=$(curl -X POST --data "{\"start_from_hit_id\":$start}" "$api/export" | jq .id
 					Make statistics publicly viewable</label>
 				<span>Anyone can view the statistics without logging in.</span>
 
+				<label>Hide on the public dashboard</label>
+				{{range $p := .PublicPanels}}
+					<label><input type="checkbox" name="public_hide" value="{{$p}}" {{if $.Site.Settings.PublicHidden $p}}checked{{end}}> {{$p}}</label><br>
+				{{end}}
+				{{validate "site.settings.public_hide" .Validate}}
+				<span>These panels are only visible when logged in; hide all of them to show only the totals.</span>
+
+				<label>{{checkbox .Site.Settings.AllowCounter "settings.allow_counter"}}
+					Allow adding a view counter badge</label>
+				<span>Show the number of pageviews for a page with an image from
+					<code>{{.Site.URL}}/counter/[path].svg</code>; this is always
+					allowed if the statistics are public and the pages aren’t
+					hidden.</span>
+
 				<label for="data_retention">Data retention in days</label>
 				<input type="number" name="settings.data_retention" id="limits_page" value="{{.Site.Settings.DataRetention}}">
 				{{validate "site.settings.data_retention" .Validate}}
 				<span class="help">Pageviews and all associated data will be permanently removed after this many days. Set to <code>0</code> to never delete.</span>
 
+				<label for="downsample">Remove pageviews after days</label>
+				<input type="number" name="settings.downsample" id="downsample" value="{{.Site.Settings.Downsample}}">
+				{{validate "site.settings.downsample" .Validate}}
+				<span class="help">Remove the individual pageviews after this many
+					days, but keep the statistics, which take much less space. The
+					time on page, entry and exit pages, returning visitors, and
+					exports need the pageviews, and won’t show anything for older
+					periods. Set to <code>0</code> to keep them.</span>
+
+				<label>{{checkbox .Site.Settings.AnonymizeIP "settings.anonymize_ip"}}
+					Anonymize IP addresses</label>
+				<span class="help">Remove the last part of the IP address
+					(<code>/24</code> for IPv4 and <code>/48</code> for IPv6)
+					before it’s used to look up the location or to group
+					pageviews in to visits. This may merge some visits from
+					people on the same network.</span>
+
+				<label>{{checkbox .Site.Settings.StripUserAgent "settings.strip_user_agent"}}
+					Don’t store the User-Agent</label>
+				<span class="help">Only store the browser and system name and
+					version, instead of the full <code>User-Agent</code> header.
+					The exports will also contain only this. Already stored
+					pageviews aren’t changed.</span>
+
+				<label>{{checkbox .Site.Settings.Cities "settings.cities"}}
+					Record regions and cities</label>
+				<span class="help">Record the region (state, province) and
+					city of visitors in addition to the country, which can be
+					seen by clicking on a country in “Locations”. This is more
+					precise and thus less private, so it’s off by default. This
+					needs a GeoIP database with cities, which is set with the
+					<code>-geodb</code> flag; the included database only has
+					countries. The region is always recorded for some large
+					countries such as the US, India, and Germany, where it’s
+					about as precise as the country is elsewhere.</span>
+
+				<label>{{checkbox .Site.Settings.HonorDNT "settings.honor_dnt"}}
+					Honor Do Not Track</label>
+				<span class="help">Don’t count pageviews from browsers that send
+					the <code>DNT: 1</code> (Do Not Track) or <code>Sec-GPC: 1</code>
+					(Global Privacy Control) header.</span>
+
 				<label>Ignore IPs</label>
 				<input type="text" name="settings.ignore_ips" value="{{.Site.Settings.IgnoreIPs}}">
 				{{validate "site.settings.ignore_ips" .Validate}}
-				<span>Never count requests coming from these IP addresses.
-					Comma-separated. Only supports exact matches.
+				<span>Never count requests coming from these IP addresses or
+					CIDR ranges, comma-separated. Add a comment after a
+					<code>#</code>; e.g. <code>192.0.2.0/24 # office,
+					2001:db8::1 # home</code>.
 					<a href="#_" id="add-ip">Add your current IP</a>.
 					{{if .Site.LinkDomain}}<br>
 					Alternatively, <a href="http://{{.Site.LinkDomain}}#toggle-goatcounter">disable for this browser</a> (click again to enable).{{end}}
 				</span>
 
+				<label>Ignore referrers</label>
+				<input type="text" name="settings.ignore_refs" value="{{.Site.Settings.IgnoreRefs}}">
+				{{validate "site.settings.ignore_refs" .Validate}}
+				<span>Never count pageviews with a referrer from these domains
+					or their subdomains, comma-separated; e.g.
+					<code>spam.example.com, example.net</code>. Well-known
+					referrer spam is already ignored.</span>
+
+				<label>Dashboard IPs</label>
+				<input type="text" name="settings.dashboard_ips" value="{{.Site.Settings.DashboardIPs}}">
+				{{validate "site.settings.dashboard_ips" .Validate}}
+				<span>Only allow access to the dashboard and API from these IP
+					addresses or CIDR ranges, such as <code>192.0.2.0/24</code>.
+					Comma-separated; leave empty to allow all. Pageviews are
+					still counted from everywhere.</span>
+
 				<label>Campaign parameters</label>
 				<input type="text" name="settings.campaigns" value="{{.Site.Settings.Campaigns}}">
 				{{validate "site.settings.campaigns" .Validate}}
@@ -16062,6 +17474,72 @@ id=$(curl -X POST --data "{\"start_from_hit_id\":$start}" "$api/export" | jq .id
 					Comma-separated; first match takes precedence.*/}}
 				</span>
 
+				<label>{{checkbox .Site.Settings.SPA "settings.spa"}}
+					Track single-page app navigation</label>
+				<span>Automatically count navigation with
+					<code>history.pushState()</code> and changes to the URL
+					hash. This only works if you load the script from
+					<code>{{.Site.URL}}/count.js</code> (or set
+					<code>spa: true</code> in <code>window.goatcounter</code>).</span>
+
+				<label>Custom dimensions</label>
+				<input type="text" name="settings.dimensions" value="{{.Site.Settings.Dimensions}}">
+				{{validate "site.settings.dimensions" .Validate}}
+				<span>
+					Additional values to record with every pageview, as a
+					comma-separated list of <code>name:type</code>; e.g.
+					<code>tenant:string, logged_in:bool</code>. Supported types
+					are <code>string</code>, <code>bool</code>, and
+					<code>number</code>; up to 3 dimensions can be added. Send
+					the values with the <code>dimensions</code> parameter in
+					count.js.
+				</span>
+
+				<label>{{checkbox .Site.Settings.CanonicalPaths.StripQuery "settings.canonical_paths.strip_query"}}
+					Remove query strings from paths</label>
+				<label>{{checkbox .Site.Settings.CanonicalPaths.StripSlash "settings.canonical_paths.strip_slash"}}
+					Remove trailing slashes from paths</label>
+				<label>{{checkbox .Site.Settings.CanonicalPaths.Lowercase "settings.canonical_paths.lowercase"}}
+					Lowercase paths</label>
+				<span>Count <code>/Page/?x=1</code> and <code>/page</code> as
+					the same path. This only applies to new pageviews; use
+					<code>goatcounter reindex -canonical</code> to change
+					existing pageviews.</span>
+
+				<label>Group paths</label>
+				<textarea name="settings.path_groups" rows="4">{{.Site.Settings.PathGroups}}</textarea>
+				{{validate "site.settings.path_groups" .Validate}}
+				<span>
+					Show paths as one entry in the statistics, one rule per line
+					as <code>pattern → name</code>; e.g. <code>/blog/* →
+					/blog/</code>. A <code>*</code> matches anything and the
+					first matching rule is used. The pageviews are still stored
+					with the full path, and changes only apply to new pageviews.
+				</span>
+
+				<label>{{checkbox .Site.Settings.DatacenterBots "settings.datacenter_bots"}}
+					Treat datacenter traffic as bots</label>
+				<span class="help">Record pageviews from the networks of cloud
+					and hosting providers such as AWS, Google Cloud, and
+					DigitalOcean as bot traffic; most of it is from scrapers
+					and headless browsers. This needs an ASN database, which is
+					set with the <code>-asndb</code> flag.</span>
+
+				<label>Bot rules</label>
+				<textarea name="settings.bot_rules" rows="4">{{.Site.Settings.BotRules}}</textarea>
+				{{validate "site.settings.bot_rules" .Validate}}
+				<span>
+					Record pageviews as bot traffic, one rule per line:
+					<code>ua regexp</code> matches a regular expression against
+					the <code>User-Agent</code> and <code>path pattern</code>
+					matches the path, where <code>*</code> matches anything;
+					e.g. <code>ua HeadlessChrome</code> or <code>path
+					/wp-admin/*</code>. This is in addition to the automatic bot
+					detection, and only applies to new pageviews. This can also
+					be changed with <code>/api/v0/bot-rules</code>.
+					<a href="/bots">See the bot traffic</a>.
+				</span>
+
 			</fieldset>
 
 			<div class="flex-break"></div>
@@ -16114,6 +17592,121 @@ id=$(curl -X POST --data "{\"start_from_hit_id\":$start}" "$api/export" | jq .id
 	</div>
 {{end}}
 
+<div>
+	<h2 id="exclude-me">Exclude my own visits</h2>
+	<p>Stop counting your own pageviews from this browser, so you don’t inflate
+		your own numbers. This sets a cookie for {{.Site.Display}}, so you’ll
+		need to do this again if you delete your cookies or use a different
+		browser or device.</p>
+
+	<form method="post" action="/exclude-me" class="vertical">
+		<input type="hidden" name="csrf" value="{{.User.CSRFToken}}">
+		{{if .ExcludedMe}}
+			<p>Your visits from this browser are currently <strong>not</strong> counted.</p>
+			<input type="hidden" name="exclude" value="false">
+			<button type="submit">Count my visits again</button>
+		{{else}}
+			<input type="hidden" name="exclude" value="true">
+			<label><input type="checkbox" name="ip"> Also ignore my current IP address</label>
+			<span class="help">Adds your current IP address to “Ignore IPs”
+				above; this also excludes other browsers and devices on the same
+				network, but most home connections get a new IP address every
+				now and then.</span>
+			<button type="submit">Exclude my own visits</button>
+		{{end}}
+	</form>
+</div>
+
+<div>
+	<h2 id="annotations">Annotations</h2>
+	<p>Annotations are displayed as a marker on the totals chart on the
+		dashboard, for example for a release or when you were on the front page
+		of a popular website. They can also be managed with the
+		<a href="https://www.goatcounter.com/api">API</a>.</p>
+
+	<table class="auto table-left">
+		<thead><tr><th>Day</th><th>Text</th><th></th></tr></thead>
+		<tbody>
+			{{range $a := .Annotations}}<tr>
+				<td>{{$a.Day}}</td>
+				<td>{{$a.Text}}</td>
+				<td>
+					<form method="post" action="/annotation/{{$a.ID}}/delete">
+						<input type="hidden" name="csrf" value="{{$.User.CSRFToken}}">
+						<button class="link">delete</button>
+					</form>
+				</td>
+			</tr>{{end}}
+
+			<tr>
+				<form method="post" action="/annotation">
+					<input type="hidden" name="csrf" value="{{$.User.CSRFToken}}">
+					<td><input type="date" name="day" placeholder="YYYY-MM-DD" required></td>
+					<td><input type="text" name="text" placeholder="Text" maxlength="200" required></td>
+					<td><button type="submit">Add new</button></td>
+				</form>
+			</tr>
+		</tbody>
+	</table>
+</div>
+
+<div>
+	<h2 id="alerts">Alerts</h2>
+	<p>Send an alert by email, to a Slack incoming webhook, or as a JSON POST
+		request to a webhook when the number of pageviews is above or below a
+		threshold, when a referrer that wasn’t seen in the last week sends a lot
+		of pageviews, or when the daily pageviews are unusually high or low
+		compared to the same weekday in the previous weeks. The rules are
+		checked every minute, and an alert isn’t sent again until the cooldown
+		has passed. A site can have at most {{.MaxAlerts}} alerts, and webhooks
+		can’t be sent to private or loopback addresses.</p>
+
+	<table class="auto table-left">
+		<thead><tr><th>Alert when</th><th>Send to</th><th>Cooldown</th><th>Last sent</th><th></th></tr></thead>
+		<tbody>
+			{{range $a := .Alerts}}<tr>
+				<td>{{$a.Describe}}</td>
+				<td>{{$a.Deliver}}: {{$a.Target}}</td>
+				<td>{{$a.Cooldown}} minutes</td>
+				<td>{{if $a.FiredAt}}{{$a.FiredAt.Format "2006-01-02 15:04"}} UTC{{else}}never{{end}}</td>
+				<td>
+					<form method="post" action="/alert/{{$a.ID}}/delete">
+						<input type="hidden" name="csrf" value="{{$.User.CSRFToken}}">
+						<button class="link">delete</button>
+					</form>
+				</td>
+			</tr>{{end}}
+
+			<tr>
+				<form method="post" action="/alert">
+					<input type="hidden" name="csrf" value="{{$.User.CSRFToken}}">
+					<td>
+						<select name="kind">
+							<option value="above">More than</option>
+							<option value="below">Fewer than</option>
+							<option value="new-ref">New referrer with at least</option>
+							<option value="anomaly">Unusual spike or drop (ignores the number)</option>
+						</select>
+						<input type="number" name="threshold" min="0" value="100" required> pageviews in
+						<input type="number" name="minutes" min="5" value="60" required> minutes
+					</td>
+					<td>
+						<select name="deliver">
+							<option value="email">Email</option>
+							<option value="slack">Slack</option>
+							<option value="webhook">Webhook</option>
+						</select>
+						<input type="text" name="target" placeholder="Email address or URL" required>
+					</td>
+					<td><input type="number" name="cooldown" min="5" value="360" required> minutes</td>
+					<td></td>
+					<td><button type="submit">Add new</button></td>
+				</form>
+			</tr>
+		</tbody>
+	</table>
+</div>
+
 <div>
 	<h2 id="purge">Purge</h2>
 	<p>Remove all instances of a page.</p>
@@ -16247,6 +17840,27 @@ id=$(curl -X POST --data "{\"start_from_hit_id\":$start}" "$api/export" | jq .id
 			</fieldset>
 		</form>
 
+		<form method="post" action="/user/timezone" class="vertical">
+			<input type="hidden" name="csrf" value="{{.User.CSRFToken}}">
+
+			<fieldset>
+				<legend>Your timezone</legend>
+
+				{{$utz := ""}}{{if .User.Settings.Timezone}}{{$utz = .User.Settings.Timezone.String}}{{end}}
+				<label for="user_timezone">Timezone</label>
+				<select name="timezone" id="user_timezone">
+					<option {{option_value $utz ""}}>Same as the site</option>
+					<option {{option_value $utz ".UTC"}}>UTC</option>
+					{{range $tz := .Timezones}}<option {{option_value $utz $tz.String}}>{{$tz.Display}}</option>
+					{{end}}
+				</select>
+				<span>Show the dashboard in this timezone instead of the site’s
+					timezone; this only affects you.</span>
+
+				<button>Save timezone</button>
+			</fieldset>
+		</form>
+
 		{{if .User.TOTPEnabled}}
 			<form method="post" action="/user/disable-totp" class="vertical">
 				<input type="hidden" name="csrf" value="{{.User.CSRFToken}}">
@@ -16284,6 +17898,41 @@ id=$(curl -X POST --data "{\"start_from_hit_id\":$start}" "$api/export" | jq .id
 	</div>
 	<br>
 
+		<fieldset>
+			<legend>Sessions</legend>
+
+			<p>All the places where you’re currently signed in.</p>
+			<table class="auto table-left">
+				<thead><tr><th>Signed in</th><th>Last seen</th><th>IP</th><th>Browser</th><th></th></tr></thead>
+
+				<tbody>
+					{{range $s := .Sessions}}<tr>
+						<td>{{$s.CreatedAt.UTC.Format "2006-01-02 15:04 (UTC)"}}</td>
+						<td>{{$s.LastSeenAt.UTC.Format "2006-01-02 15:04 (UTC)"}}</td>
+						<td>{{if $s.IP}}{{$s.IP}}{{else}}(unknown){{end}}</td>
+						<td>{{if $s.UserAgent}}{{$s.UserAgent}}{{else}}(unknown){{end}}</td>
+						<td>
+							{{if and $.User.Session (eq $s.ID $.User.Session.ID)}}
+								(this session)
+							{{else}}
+								<form method="post" action="/user/session/{{$s.ID}}/delete">
+									<input type="hidden" name="csrf" value="{{$.User.CSRFToken}}">
+									<button class="link">sign out</button>
+								</form>
+							{{end}}
+						</td>
+					</tr>{{end}}
+				</tbody>
+			</table>
+
+			{{if gt (len .Sessions) 1}}
+				<form method="post" action="/user/session/delete-others">
+					<input type="hidden" name="csrf" value="{{.User.CSRFToken}}">
+					<button type="submit">Sign out all other sessions</button>
+				</form>
+			{{end}}
+		</fieldset>
+
 		<fieldset>
 			<legend>API tokens</legend>
 
@@ -16295,8 +17944,8 @@ id=$(curl -X POST --data "{\"start_from_hit_id\":$start}" "$api/export" | jq .id
 					{{range $t := .APITokens}}<tr>
 						<td>{{$t.Name}}</td>
 						<td>
-							{{if $t.Permissions.Count}}Record pageviews{{end}}
-							{{if $t.Permissions.Export}}Export{{end}}
+							{{range $p := $t.Permissions}}{{$p.Label}}<br>{{end}}
+							{{if $t.RoleID}}Role: {{$.Roles.Name $t.RoleID}}{{end}}
 						</td>
 						<td>{{$t.Token}}</td>
 						<td>{{$t.CreatedAt.UTC.Format "2006-01-02 (UTC)"}}</td>
@@ -16323,14 +17972,101 @@ id=$(curl -X POST --data "{\"start_from_hit_id\":$start}" "$api/export" | jq .id
 									<input type="checkbox" name="permissions.count">Record pageviews</label><br>
 								*/}}
 								<label title="Export data with /api/v0/export">
-									<input type="checkbox" name="permissions.export">Export</label>
+									<input type="checkbox" name="perm" value="export">Export</label><br>
+								<label title="Read statistics with /api/v0/stats">
+									<input type="checkbox" name="perm" value="stats">Read statistics</label><br>
+								<label title="Add and remove annotations with /api/v0/annotations">
+									<input type="checkbox" name="perm" value="settings">Change settings</label>
+								{{if .Roles}}<br>
+								<label>Role
+									<select name="role">
+										<option value="">(none)</option>
+										{{range $r := .Roles}}<option value="{{$r.ID}}">{{$r.Name}}</option>{{end}}
+									</select></label>
+								{{end}}
+							</td>
+							<td><button type="submit">Add new</button></td>
+						</form>
+					</tr>
+				</tbody>
+			</table>
+		</fieldset>
+
+		<fieldset>
+			<legend>Roles</legend>
+
+			<p>A role is a named set of permissions which can be assigned to API
+			tokens and users; the token gets all the permissions of the role in
+			addition to its own. Deleting a role removes its permissions from all
+			tokens and users with that role.</p>
+
+			<table class="auto table-left">
+				<thead><tr><th>Name</th><th>Permissions</th><th>Created at</th><th></th></tr></thead>
+
+				<tbody>
+					{{range $r := .Roles}}<tr>
+						<td>{{$r.Name}}</td>
+						<td>{{range $p := $r.Permissions}}{{$p.Label}}<br>{{end}}</td>
+						<td>{{$r.CreatedAt.UTC.Format "2006-01-02 (UTC)"}}</td>
+
+						<td>
+							<form method="post" action="/user/role/remove/{{$r.ID}}">
+								<input type="hidden" name="csrf" value="{{$.User.CSRFToken}}">
+
+								<button class="link">delete</button>
+							</form>
+						</td>
+					</tr>{{end}}
+
+					<tr>
+						<form method="post" action="/user/role">
+							<input type="hidden" name="csrf" value="{{$.User.CSRFToken}}">
+
+							<td>
+								<input type="text" name="name" placeholder="Name">
 							</td>
+							<td>
+								{{range $p := .Permissions}}
+								<label><input type="checkbox" name="perm" value="{{$p}}">{{$p.Label}}</label><br>
+								{{end}}
+							</td>
+							<td></td>
 							<td><button type="submit">Add new</button></td>
 						</form>
 					</tr>
 				</tbody>
 			</table>
 		</fieldset>
+
+		<fieldset>
+			<legend>Users</legend>
+
+			<p>Site owners can do everything; other users only have the
+			permissions of their role.</p>
+
+			<table class="auto table-left">
+				<thead><tr><th>Email</th><th>Role</th><th></th></tr></thead>
+
+				<tbody>
+					{{range $u := .Users}}<tr>
+						<form method="post" action="/user/role/assign/{{$u.ID}}">
+							<input type="hidden" name="csrf" value="{{$.User.CSRFToken}}">
+
+							<td>{{$u.Email}}</td>
+							<td>
+								{{$role := $.Roles.Name $u.RoleID}}
+								<select name="role">
+									<option value="owner"{{if $u.Owner}} selected{{end}}>Site owner</option>
+									<option value=""{{if and (not $u.Owner) (not $role)}} selected{{end}}>(no permissions)</option>
+									{{range $r := $.Roles}}<option value="{{$r.ID}}"{{if and (not $u.Owner) (eq $role $r.Name)}} selected{{end}}>{{$r.Name}}</option>{{end}}
+								</select>
+							</td>
+							<td><button type="submit">Change</button></td>
+						</form>
+					</tr>{{end}}
+				</tbody>
+			</table>
+		</fieldset>
 	</form>
 </div>
 
@@ -16575,18 +18311,41 @@ processed by Stripe (you will need a Credit Card).</p>
 	{{end}}
 {{end}} {{/* .User.ID */}}
 
+{{if .User.ID}}
+<div id="dash-saved-views">
+	{{if .Segments}}
+		Saved views:
+		{{range $i, $s := .Segments}}{{if $i}} · {{end}}{{if eq $s.Name $.Segment}}<strong>{{$s.Name}}</strong>
+			<form method="post" action="/segment/{{$s.ID}}/delete">
+				<input type="hidden" name="csrf" value="{{$.User.CSRFToken}}">
+				<button class="link" title="Remove this saved view">×</button>
+			</form>{{else}}<a href="/?segment={{$s.Name}}">{{$s.Name}}</a>{{end}}{{end}}
+		|
+	{{end}}
+	<form method="post" action="/segment">
+		<input type="hidden" name="csrf" value="{{.User.CSRFToken}}">
+		{{if .RelPeriod}}
+			<input type="hidden" name="period" value="{{.RelPeriod}}">
+		{{else}}
+			<input type="hidden" name="period-start" value="{{tformat .Site .PeriodStart ""}}">
+			<input type="hidden" name="period-end" value="{{tformat .Site .PeriodEnd ""}}">
+		{{end}}
+		<input type="hidden" name="filter" value="{{.Filter}}">
+		{{if .Daily}}<input type="hidden" name="daily" value="on">{{end}}
+		<input type="hidden" name="compare" value="{{.Compare}}">
+		<input type="text" name="name" placeholder="Name" required pattern="[a-zA-Z0-9_-]+"
+			title="Letters, numbers, '-', and '_'">
+		<button class="link">Save current view</button>
+	</form>
+</div>
+{{end}}
+
 <form id="dash-form">
 	{{/* The first button gets used on the enter key, AFAICT there is no way to change that. */}}
 	<button type="submit" tabindex="-1" class="hide-btn" aria-label="Submit"></button>
 	{{if .ShowRefs}}<input type="hidden" name="showrefs" value="{{.ShowRefs}}">{{end}}
 	<input type="hidden" id="hl-period" name="hl-period" disabled>
 
-	{{/*
-	<div id="dash-saved-views">
-		Saved views: <a href="#">404</a> · <a href="#">blog</a>
-		| <a href="#">Save current view</a>
-	</div>
-	*/}}
 	<div id="dash-main">
 		<div>
 			<span>
@@ -16616,7 +18375,7 @@ processed by Stripe (you will need a Credit Card).</p>
 			<div class="filter-wrap">
 				<input
 					type="text" autocomplete="off" name="filter" value="{{.Filter}}" id="filter-paths"
-					placeholder="Filter paths" title="Filter the list of paths; matched case-insensitive on path and title"
+					placeholder="Filter paths" title="Filter the list of paths; matched case-insensitive on path and title. Start with ~ to use a regular expression, e.g. ~^/blog/[0-9]+$. Exclude paths with -text, -~regexp, or path!=/exact/path. Filter the entire dashboard with country=DE, browser=Firefox, system=Linux, ref=example.com, or language=en"
 					{{if .Filter}}class="value"{{end}}>
 			</div>
 			{{if .ForcedDaily}}
@@ -16624,6 +18383,11 @@ processed by Stripe (you will need a Credit Card).</p>
 			{{else}}
 				<label><input type="checkbox" name="daily" id="daily" {{if .Daily}}checked{{end}}> View by day</label>
 			{{end}}
+			<label>Compare to <select name="compare" id="compare">
+				<option value="">nothing</option>
+				<option value="previous" {{if eq .Compare "previous"}}selected{{end}}>previous period</option>
+				<option value="year" {{if eq .Compare "year"}}selected{{end}}>same period last year</option>
+			</select></label>
 		</div>
 	</div>
 	<div id="dash-move">
@@ -16740,6 +18504,29 @@ Someone (hopefully you) requested to reset the password on your GoatCounter acco
 You can do this here:
 {{.Site.URL}}/user/reset/{{.User.LoginRequest}}
 
+{{template "_email_bottom.gotxt" .}}
+`),
+	"tpl/email_report.gotxt": []byte(`Hi there,
+
+Your {{.Period}}ly GoatCounter report for {{.Site.URL}}, from {{.Start.Format "January 2"}} to {{.End.Format "January 2, 2006"}}:
+{{if .User.ReportsSection "totals"}}
+Visitors:  {{nformat .TotalUnique .Site}}{{with .FormatChange .ChangeUnique}} ({{.}} compared to the previous {{$.Period}}){{end}}
+Pageviews: {{nformat .Total .Site}}{{with .FormatChange .Change}} ({{.}} compared to the previous {{$.Period}}){{end}}
+{{end}}{{if .User.ReportsSection "pages"}}
+Top pages:
+{{range .Pages}}  {{nformat .CountUnique $.Site}}  {{.Path}}
+{{else}}  Nothing to display
+{{end}}{{end}}{{if .User.ReportsSection "refs"}}
+Top referrers:
+{{range .Refs}}  {{nformat .CountUnique $.Site}}  {{.Name}}
+{{else}}  Nothing to display
+{{end}}{{end}}
+See all statistics on the dashboard:
+{{.Site.URL}}/?period-start={{.Start.Format "2006-01-02"}}&period-end={{.End.Format "2006-01-02"}}
+
+You’re receiving this email because you enabled {{.Period}}ly reports; you can change or turn them off in your settings:
+{{.Site.URL}}/settings#tab-setting
+
 {{template "_email_bottom.gotxt" .}}
 `),
 	"tpl/email_verify.gotxt": []byte(`Hi there,
@@ -17036,15 +18823,18 @@ advice specific to your situation.</p>
 		analytics, and not specific to GoatCounter).</dd>
 
 	<dt id="dnt">How is the <code>Do-Not-Track</code> header handled? <a href="#dnt">§</a></dt>
-	<dd>It’s ignored for several reasons: it’s effectively abandoned with a low
+	<dd>It’s ignored by default for several reasons: it’s effectively abandoned with a low
 		adoption rate, mostly intended for persistent cross-site tracking (which
 		GoatCounter doesn’t do), and I feel there are some fundamental concerns
 		with the approach. See
 		<a href="https://www.arp242.net/dnt.html" target="_blank" rel="noopener">Why GoatCounter ignores Do Not Track</a>
 		for a more in-depth explanation.
 		<br><br>
-		You can still implement it yourself by putting this at the start of the
-		GoatCounter script:
+		You can enable “Honor Do Not Track” in the site settings to not count
+		pageviews from browsers that send the <code>DNT</code> or
+		<code>Sec-GPC</code> (Global Privacy Control) header. You can also
+		implement it yourself by putting this at the start of the GoatCounter
+		script:
 <pre>&lt;script&gt;
 	window.goatcounter = {
 		no_onload: ('doNotTrack' in navigator && navigator.doNotTrack === '1'),
@@ -17232,6 +19022,42 @@ advice specific to your situation.</p>
 <hr>
 
 {{template "_bottom.gohtml" .}}
+`),
+	"tpl/opt_out.gohtml": []byte(`<!DOCTYPE html>
+<html lang="en">
+<head>
+	<meta charset="utf-8">
+	<meta name="robots" content="noindex">
+	<meta name="viewport" content="width=device-width, initial-scale=1">
+	<title>Opt out of GoatCounter for {{.Site.Display}}</title>
+	<style>
+		html, body { margin: 0; padding: 0; }
+		body       { font: 14px/1.4 sans-serif; background-color: #fff; color: #252525; }
+		.opt-out   { padding: .5em; }
+		button     { font: inherit; padding: .2em .6em; }
+	</style>
+</head>
+<body>
+	<div class="opt-out">
+		<form method="post" action="/opt-out">
+		{{if .OptedOut}}
+			<p>Your visits to {{.Site.Display}} are <strong>not</strong> counted
+				in this browser.</p>
+			<input type="hidden" name="opt-out" value="false">
+			<button type="submit">Count my visits again</button>
+		{{else}}
+			<p>Your visits to {{.Site.Display}} are counted anonymously with
+				<a href="https://www.goatcounter.com" target="_blank" rel="noopener">GoatCounter</a>.
+				You can opt out to stop counting them in this browser; this
+				stores a cookie, so you’ll need to opt out again if you delete
+				your cookies or use a different browser.</p>
+			<input type="hidden" name="opt-out" value="true">
+			<button type="submit">Opt out</button>
+		{{end}}
+		</form>
+	</div>
+</body>
+</html>
 `),
 	"tpl/privacy.gohtml": []byte(`{{template "_top.gohtml" .}}
 
@@ -17249,9 +19075,11 @@ advice specific to your situation.</p>
 	<li>A hash of the IP address, User-Agent, and random number.</li>
 </ul>
 
-<p>No personal information (such as IP address) is collected; a hash of the IP
-address, User-Agent, and a random number (“salt”) is kept in the process memory
-for 8 hours at the most to identify a browsing session.</p>
+<p>The IP address isn’t stored with the pageviews; a hash of the IP address,
+User-Agent, and a random number (“salt”) is kept for 8 hours at the most to
+identify a browsing session. The IP address itself is only kept until the
+pageview is processed (usually a few seconds), and in the server logs for a
+limited time to investigate errors and abuse.</p>
 
 <p>The exception to this are requests which are deemed to be coming from a bot,
 in which case the IP address will be stored temporarily for the purpose of
@@ -17277,6 +19105,10 @@ blocking botnets, hosting providers, and other types of abuse.</p>
 		telling you that you’ve completed an operation or that there was an
 		error.</li>
 </ul>
+<p>The IP address and User-Agent of your login sessions are stored so you can
+see and revoke them in the settings; they’re deleted when you log out or revoke
+the session.</p>
+
 <p>Email <a href="mailto:support@goatcounter.com">support@goatcounter.com</a>
 to request all information collected about you, or to request removal of all
 information.</p>
@@ -17627,5 +19459,37 @@ setting everything up.</p>
 </div>
 
 {{template "_bottom.gohtml" .}}
+`),
+	"tpl/widget.gohtml": []byte(`<!DOCTYPE html>
+<html lang="en">
+<head>
+	<meta charset="utf-8">
+	<meta name="robots" content="noindex">
+	<title>GoatCounter statistics for {{.Site.Display}}</title>
+	<style>
+		html, body   { margin: 0; padding: 0; }
+		body         { font: 14px/1.4 sans-serif; background-color: #fff; color: #252525; }
+		body.dark    { background-color: #252525; color: #eee; }
+		.widget      { padding: .5em; }
+		.sparkline   { display: block; width: 100%; height: 3em; color: #9a15a4; }
+		.dark .sparkline { color: #d78ddc; }
+		{{if .Color}}.sparkline, .dark .sparkline { color: #{{.Color}}; }{{end}}
+		.totals      { margin: .3em 0 0 0; }
+		.totals span { white-space: nowrap; }
+		.totals a    { float: right; color: inherit; opacity: .6; font-size: .85em; }
+	</style>
+</head>
+<body class="{{.Theme}}">
+	<div class="widget">
+		{{sparkline .Stats}}
+		<p class="totals">
+			<span><strong>{{nformat .TotalUnique .Site}}</strong> visitors</span> ·
+			<span><strong>{{nformat .Total .Site}}</strong> pageviews</span>
+			<span>in the last {{.Days}} days</span>
+			<a href="{{.Site.URL}}" target="_blank" rel="noopener">GoatCounter</a>
+		</p>
+	</div>
+</body>
+</html>
 `),
 }
@@ -0,0 +1,209 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"context"
+	"sync"
+
+	"github.com/jmoiron/sqlx"
+	"zgo.at/errors"
+	"zgo.at/goatcounter/cfg"
+	"zgo.at/zdb"
+)
+
+// Path is a path on a site; the hits and stats tables refer to it with the
+// path_id column, so per-path settings can be attached to it.
+//
+// The path column is still stored on the hits and stats tables as well, and
+// that's what all queries use for now. The path_id is set for new rows, and
+// filled for existing rows in the background by BackfillPaths().
+type Path struct {
+	ID    int64    `db:"path_id" json:"id"`
+	Site  int64    `db:"site_id" json:"-"`
+	Path  string   `db:"path" json:"path"`
+	Title string   `db:"title" json:"title"`
+	Event zdb.Bool `db:"event" json:"event"`
+}
+
+type pathKey struct {
+	site int64
+	path string
+}
+
+// pathCache caches the path IDs; it's cleared once it reaches pathCacheSize
+// entries.
+var pathCache = struct {
+	sync.Mutex
+	m map[pathKey]Path
+}{m: make(map[pathKey]Path)}
+
+const pathCacheSize = 50000
+
+// GetOrInsert gets the path by site and path, inserting it if it doesn't exist
+// yet. The title is updated if it's set and different.
+//
+// This shouldn't be run in a transaction, as the ID is cached.
+func (p *Path) GetOrInsert(ctx context.Context) error {
+	k := pathKey{p.Site, p.Path}
+	pathCache.Lock()
+	c, ok := pathCache.m[k]
+	pathCache.Unlock()
+	if ok && (p.Title == "" || p.Title == c.Title) {
+		p.ID, p.Title = c.ID, c.Title
+		return nil
+	}
+
+	db := zdb.MustGet(ctx)
+	if !ok {
+		var existing Path
+		get := func() error {
+			return GetPrepared(ctx, &existing, `/* Path.GetOrInsert */
+				select * from paths where site_id=$1 and path=$2`, p.Site, p.Path)
+		}
+		err := get()
+		switch {
+		case zdb.ErrNoRows(err):
+			err = p.insert(ctx)
+			if zdb.ErrUnique(err) { // Inserted by another process.
+				err = get()
+				p.ID = existing.ID
+			}
+			if err != nil {
+				return err
+			}
+		case err != nil:
+			return errors.Wrap(err, "Path.GetOrInsert")
+		default:
+			p.ID = existing.ID
+			if p.Title == "" {
+				p.Title = existing.Title
+			}
+			c = existing
+		}
+	}
+
+	if p.Title != "" && c.ID > 0 && p.Title != c.Title {
+		p.ID = c.ID
+		_, err := db.ExecContext(ctx, `update paths set title=$1 where path_id=$2`, p.Title, p.ID)
+		if err != nil {
+			return errors.Wrap(err, "Path.GetOrInsert")
+		}
+	}
+
+	pathCache.Lock()
+	if len(pathCache.m) >= pathCacheSize {
+		pathCache.m = make(map[pathKey]Path)
+	}
+	pathCache.m[k] = *p
+	pathCache.Unlock()
+	return nil
+}
+
+func (p *Path) insert(ctx context.Context) error {
+	query := `insert into paths (site_id, path, title, event) values ($1, $2, $3, $4)`
+	args := []interface{}{p.Site, p.Path, p.Title, p.Event}
+	if cfg.PgSQL {
+		err := zdb.MustGet(ctx).GetContext(ctx, &p.ID, query+` returning path_id`, args...)
+		return errors.Wrap(err, "Path.insert")
+	}
+
+	res, err := zdb.MustGet(ctx).ExecContext(ctx, query, args...)
+	if err != nil {
+		return errors.Wrap(err, "Path.insert")
+	}
+	p.ID, err = res.LastInsertId()
+	return errors.Wrap(err, "Path.insert")
+}
+
+// PathIDs sets the PathID on all hits that don't have one yet, inserting the
+// paths as needed.
+func PathIDs(ctx context.Context, hits []Hit) error {
+	for i := range hits {
+		if hits[i].PathID != nil {
+			continue
+		}
+		p := Path{Site: hits[i].Site, Path: hits[i].Path, Title: hits[i].Title, Event: hits[i].Event}
+		err := p.GetOrInsert(ctx)
+		if err != nil {
+			return err
+		}
+		hits[i].PathID = &p.ID
+	}
+	return nil
+}
+
+// Number of paths to update with one query in BackfillPaths(); SQLite has a
+// limit of 999 parameters.
+const backfillBatch = 500
+
+// BackfillPaths sets the path_id on at most limit distinct paths in the hits
+// and stats tables which don't have one yet, and returns the number of paths
+// that were done. This is run in the background until there is nothing left.
+//
+// The paths are inserted first, and then the rows are updated with one query
+// for every backfillBatch paths of a site.
+func BackfillPaths(ctx context.Context, limit int) (int, error) {
+	var (
+		done int
+		db   = zdb.MustGet(ctx)
+	)
+	for _, tbl := range []string{"hits", "hit_counts", "hit_stats", "ref_counts"} {
+		if done >= limit {
+			break
+		}
+
+		event := `0`
+		if tbl == "hits" || tbl == "hit_counts" {
+			event = `max(event)`
+		}
+
+		var rows []struct {
+			Site  int64    `db:"site"`
+			Path  string   `db:"path"`
+			Event zdb.Bool `db:"event"`
+		}
+		err := db.SelectContext(ctx, &rows, `/* BackfillPaths */
+			select site, path, `+event+` as event from `+tbl+`
+			where path_id is null group by site, path limit $1`,
+			limit-done)
+		if err != nil {
+			return done, errors.Wrapf(err, "BackfillPaths %s", tbl)
+		}
+
+		bySite := make(map[int64][]string)
+		for _, r := range rows {
+			p := Path{Site: r.Site, Path: r.Path, Event: r.Event}
+			err := p.GetOrInsert(ctx)
+			if err != nil {
+				return done, errors.Wrapf(err, "BackfillPaths %s", tbl)
+			}
+			bySite[r.Site] = append(bySite[r.Site], r.Path)
+		}
+
+		for site, paths := range bySite {
+			for len(paths) > 0 {
+				n := backfillBatch
+				if n > len(paths) {
+					n = len(paths)
+				}
+				query, args, err := sqlx.In(`/* BackfillPaths */
+					update `+tbl+` set path_id=(
+						select path_id from paths where paths.site_id=`+tbl+`.site and paths.path=`+tbl+`.path
+					) where site=? and path_id is null and path in (?)`, site, paths[:n])
+				if err != nil {
+					return done, errors.Wrapf(err, "BackfillPaths %s", tbl)
+				}
+				_, err = db.ExecContext(ctx, db.Rebind(query), args...)
+				if err != nil {
+					return done, errors.Wrapf(err, "BackfillPaths %s", tbl)
+				}
+				done += n
+				paths = paths[n:]
+			}
+		}
+	}
+	return done, nil
+}
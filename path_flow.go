@@ -0,0 +1,68 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"context"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/zdb"
+	"zgo.at/zvalidate"
+)
+
+// PathFlow is a report of the most common pages visitors came from and went to
+// for a path, in the same session.
+type PathFlow struct {
+	Path string `json:"path"`
+
+	// Previous pages; an empty path means the session started on this page.
+	Prev []PathFlowEntry `json:"prev"`
+
+	// Next pages.
+	Next []PathFlowEntry `json:"next"`
+}
+
+// PathFlowEntry is a single page in the PathFlow.
+type PathFlowEntry struct {
+	Path  string `db:"path" json:"path"`
+	Count int    `db:"count" json:"count"`
+}
+
+// Get the previous and next pages for path; at most limit pages are returned
+// for both.
+func (f *PathFlow) Get(ctx context.Context, path string, start, end time.Time, limit int) error {
+	v := zvalidate.New()
+	v.Required("path", path)
+	v.Range("limit", int64(limit), 1, 100)
+	if v.HasErrors() {
+		return v
+	}
+
+	var (
+		db   = zdb.MustGet(ctx)
+		site = MustGetSite(ctx).ID
+		s, e = start.Format("2006-01-02"), end.Format("2006-01-02")
+	)
+
+	f.Path, f.Prev, f.Next = path, []PathFlowEntry{}, []PathFlowEntry{}
+	err := db.SelectContext(ctx, &f.Prev, `/* PathFlow.Get */
+		select prev_path as path, sum(count) as count from path_transitions
+		where site=$1 and day>=$2 and day<=$3 and path=$4
+		group by prev_path
+		order by count desc, path asc
+		limit $5`, site, s, e, path, limit)
+	if err != nil {
+		return errors.Wrap(err, "PathFlow.Get prev")
+	}
+
+	err = db.SelectContext(ctx, &f.Next, `/* PathFlow.Get */
+		select path, sum(count) as count from path_transitions
+		where site=$1 and day>=$2 and day<=$3 and prev_path=$4
+		group by path
+		order by count desc, path asc
+		limit $5`, site, s, e, path, limit)
+	return errors.Wrap(err, "PathFlow.Get next")
+}
@@ -0,0 +1,105 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"regexp"
+	"strings"
+)
+
+// MaxPathGroups is the maximum number of path grouping rules per site.
+const MaxPathGroups = 50
+
+// PathGroup groups all paths matching Pattern as Name in the statistics.
+//
+// The pattern is matched against the entire path, and "*" matches any number
+// of characters (including "/"); e.g. "/blog/*" matches "/blog/a" and
+// "/blog/2020/b", but not "/blog".
+type PathGroup struct {
+	Pattern string
+	Name    string
+}
+
+// PathGroups is a list of path grouping rules; the first matching rule is used.
+//
+// It's stored and displayed as one rule per line in the form of "pattern →
+// name", e.g. "/blog/* → /blog/"; "->" can be used instead of "→".
+//
+// The rules are applied when the statistics are updated and only change the
+// paths in the statistics, and not the stored pageviews. Changing the rules
+// only affects new pageviews unless the statistics are re-indexed. Filtering
+// by facets reads the pageviews directly and shows the paths as they were
+// recorded.
+type PathGroups []PathGroup
+
+func (g PathGroups) String() string {
+	b := make([]string, 0, len(g))
+	for _, gg := range g {
+		b = append(b, gg.Pattern+" → "+gg.Name)
+	}
+	return strings.Join(b, "\n")
+}
+
+// MarshalText converts the data to a human readable representation.
+func (g PathGroups) MarshalText() ([]byte, error) { return []byte(g.String()), nil }
+
+// UnmarshalText parses text in to the Go data structure.
+func (g *PathGroups) UnmarshalText(v []byte) error {
+	*g = PathGroups{}
+	for _, s := range strings.Split(string(v), "\n") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+
+		gg := PathGroup{Pattern: s}
+		for _, sep := range []string{"→", "->"} {
+			if c := strings.Index(s, sep); c > -1 {
+				gg.Pattern, gg.Name = strings.TrimSpace(s[:c]), strings.TrimSpace(s[c+len(sep):])
+				break
+			}
+		}
+		*g = append(*g, gg)
+	}
+	return nil
+}
+
+// Apply the rules to the hits, returning a copy with the grouped paths. Events
+// are never grouped, and the title and PathID are cleared for grouped paths.
+func (g PathGroups) Apply(hits []Hit) []Hit {
+	if len(g) == 0 {
+		return hits
+	}
+
+	res := make([]*regexp.Regexp, len(g))
+	for i, gg := range g {
+		res[i] = globRegexp(gg.Pattern)
+	}
+
+	grouped := make([]Hit, len(hits))
+	copy(grouped, hits)
+	for i := range grouped {
+		if grouped[i].Event {
+			continue
+		}
+		for j, re := range res {
+			if re.MatchString(grouped[i].Path) {
+				grouped[i].Path, grouped[i].Title, grouped[i].PathID = g[j].Name, "", nil
+				break
+			}
+		}
+	}
+	return grouped
+}
+
+// globRegexp converts a pattern where "*" matches anything to a regular
+// expression matching the entire string.
+func globRegexp(pattern string) *regexp.Regexp {
+	parts := strings.Split(pattern, "*")
+	for i := range parts {
+		parts[i] = regexp.QuoteMeta(parts[i])
+	}
+	return regexp.MustCompile("^" + strings.Join(parts, ".*") + "$")
+}
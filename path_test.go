@@ -0,0 +1,113 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter_test
+
+import (
+	"testing"
+	"time"
+
+	"zgo.at/goatcounter"
+	"zgo.at/goatcounter/gctest"
+	"zgo.at/zdb"
+)
+
+func TestPaths(t *testing.T) {
+	ctx, clean := gctest.DB(t)
+	defer clean()
+
+	now := time.Date(2020, 6, 18, 12, 0, 0, 0, time.UTC)
+	gctest.StoreHits(ctx, t,
+		goatcounter.Hit{Path: "/a", Title: "A", CreatedAt: now},
+		goatcounter.Hit{Path: "/a", CreatedAt: now},
+		goatcounter.Hit{Path: "/b", CreatedAt: now})
+
+	db := zdb.MustGet(ctx)
+	var paths []goatcounter.Path
+	err := db.SelectContext(ctx, &paths, `select * from paths order by path`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) != 2 || paths[0].Path != "/a" || paths[0].Title != "A" || paths[1].Path != "/b" {
+		t.Fatalf("wrong paths: %#v", paths)
+	}
+
+	for _, tbl := range []string{"hits", "hit_counts", "hit_stats", "ref_counts"} {
+		var n int
+		err := db.GetContext(ctx, &n, `select count(*) from `+tbl+` where path_id is null`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 0 {
+			t.Errorf("%s: %d rows without path_id", tbl, n)
+		}
+	}
+
+	// Existing rows from before the paths table.
+	for _, q := range []string{
+		`update hits set path_id=null`,
+		`update hit_counts set path_id=null where path='/b'`,
+	} {
+		_, err := db.ExecContext(ctx, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	n, err := goatcounter.BackfillPaths(ctx, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Errorf("backfilled %d paths; want 3", n)
+	}
+
+	var ids []int64
+	err = db.SelectContext(ctx, &ids, `select path_id from hits order by path`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 3 || ids[0] != paths[0].ID || ids[1] != paths[0].ID || ids[2] != paths[1].ID {
+		t.Errorf("wrong path_id: %v", ids)
+	}
+
+	n, err = goatcounter.BackfillPaths(ctx, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Errorf("backfilled %d paths; want 0", n)
+	}
+}
+
+func TestPathsRetry(t *testing.T) {
+	ctx, clean := gctest.DB(t)
+	defer clean()
+
+	db := zdb.MustGet(ctx)
+	_, err := db.ExecContext(ctx, `alter table paths rename to paths_x`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	goatcounter.Memstore.Append(goatcounter.Hit{Site: 1, Path: "/retry", Session: goatcounter.TestSession})
+	hits, err := goatcounter.Memstore.Persist(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hits) != 0 || goatcounter.Memstore.Len() != 1 {
+		t.Fatalf("hit not kept: returned %d, %d in memstore", len(hits), goatcounter.Memstore.Len())
+	}
+
+	_, err = db.ExecContext(ctx, `alter table paths_x rename to paths`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hits, err = goatcounter.Memstore.Persist(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hits) != 1 || hits[0].PathID == nil || goatcounter.Memstore.Len() != 0 {
+		t.Fatalf("not persisted: %v", hits)
+	}
+}
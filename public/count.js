@@ -43,6 +43,13 @@
 		if (rcb) data.r = rcb(data.r)
 		if (tcb) data.t = tcb(data.t)
 		if (pcb) data.p = pcb(data.p)
+
+		// Custom dimensions are sent as d[name]=value.
+		var dim = (vars.dimensions === undefined ? goatcounter.dimensions : vars.dimensions)
+		if (dim)
+			for (var k in dim)
+				if (dim[k] !== null && dim[k] !== undefined)
+					data['d[' + k + ']'] = String(dim[k])
 		return data
 	}
 
@@ -82,6 +89,61 @@
 		return (goatcounter.endpoint || window.counter)  // counter is for compat; don't use.
 	}
 
+	// Engagement pings, to estimate the time on page; enabled with
+	// goatcounter.ping. Only the time the page is visible is counted, and the
+	// value sent is the total number of seconds so far.
+	var ping = {path: null, visible: 0, since: null, sent: 0, timer: null, bound: false}
+
+	var ping_seconds = function() {
+		return Math.round((ping.visible + (ping.since === null ? 0 : Date.now() - ping.since)) / 1000)
+	}
+
+	var send_ping = function(beacon) {
+		var secs = ping_seconds()
+		if (ping.path === null || secs <= ping.sent || secs > 6 * 3600)  // Server rejects >6h.
+			return
+		ping.sent = secs
+
+		var endpoint = get_endpoint()
+		if (!endpoint)
+			return
+		var url = endpoint + urlencode({p: ping.path, ping: secs, rnd: Math.random().toString(36).substr(2, 5)})
+		if (beacon && navigator.sendBeacon)
+			navigator.sendBeacon(url)
+		else
+			(new Image()).src = url
+	}
+
+	var start_ping = function(path) {
+		send_ping(true)  // Previous page in SPAs.
+
+		clearTimeout(ping.timer)
+		ping.path    = path
+		ping.visible = 0
+		ping.sent    = 0
+		ping.since   = document.visibilityState === 'hidden' ? null : Date.now()
+
+		// Ping after 10s, 30s, and then every minute.
+		var n = 0, next = function() {
+			ping.timer = setTimeout(function() { send_ping(false); next() }, [10, 20][n++] * 1000 || 60000)
+		}
+		next()
+
+		if (ping.bound)
+			return
+		ping.bound = true
+		document.addEventListener('visibilitychange', function() {
+			if (document.visibilityState === 'hidden') {
+				ping.visible = ping_seconds() * 1000
+				ping.since   = null
+				send_ping(true)
+			}
+			else if (ping.since === null)
+				ping.since = Date.now()
+		}, false)
+		window.addEventListener('pagehide', function() { send_ping(true) }, false)
+	}
+
 	// Filter some requests that we (probably) don't want to count.
 	goatcounter.filter = function() {
 		if ('visibilityState' in document && (document.visibilityState === 'prerender' || document.visibilityState === 'hidden'))
@@ -91,7 +153,7 @@
 		if (!goatcounter.allow_local && location.hostname.match(/(localhost$|^127\.|^10\.|^172\.(1[6-9]|2[0-9]|3[0-1])\.|^192\.168\.)/))
 			return 'local'
 		if (localStorage && localStorage.getItem('skipgc') === 't')
-			return 'disabled with #toggle-goatcounter'
+			return 'disabled with #toggle-goatcounter or goatcounter.opt_out()'
 		return false
 	}
 
@@ -138,6 +200,12 @@
 		setTimeout(rm, 3000)  // In case the onload isn't triggered.
 		img.addEventListener('load', rm, false)
 		document.body.appendChild(img)
+
+		if (goatcounter.ping) {
+			var data = get_data(vars || {})
+			if (!data.e && data.p !== null)
+				start_ping(data.p)
+		}
 	}
 
 	// Get a query parameter.
@@ -174,6 +242,52 @@
 		})
 	}
 
+	// Count navigations in single-page apps: history.pushState(),
+	// history.replaceState(), the back button, and changes to location.hash.
+	window.goatcounter.bind_spa = function() {
+		if (goatcounter.spa_bound)
+			return
+		goatcounter.spa_bound = true
+
+		var last = location.href
+		var nav = function(hash) {
+			if (location.href === last)
+				return
+			last = location.href
+
+			// The referrer is the same for the entire page load, so don't send
+			// it again.
+			var vars = {referrer: ''}
+			if (hash)
+				vars.path = (location.pathname + location.search + location.hash) || '/'
+			goatcounter.count(vars)
+		}
+
+		if (window.history && history.pushState) {
+			var wrap = function(name) {
+				var orig = history[name]
+				history[name] = function() {
+					var r = orig.apply(this, arguments)
+					nav(false)
+					return r
+				}
+			}
+			wrap('pushState')
+			wrap('replaceState')
+			window.addEventListener('popstate', function() { nav(false) }, false)
+		}
+		window.addEventListener('hashchange', function() { nav(true) }, false)
+	}
+
+	// Stop counting pageviews from this browser, or start again if out is
+	// false; this is stored in localStorage for the site's domain.
+	window.goatcounter.opt_out = function(out) {
+		if (out === false)
+			localStorage.removeItem('skipgc')
+		else
+			localStorage.setItem('skipgc', 't')
+	}
+
 	// Make it easy to skip your own views.
 	if (location.hash === '#toggle-goatcounter')
 		if (localStorage.getItem('skipgc') === 't') {
@@ -190,6 +304,8 @@
 			goatcounter.count()
 			if (!goatcounter.no_events)
 				goatcounter.bind_events()
+			if (goatcounter.spa)
+				goatcounter.bind_spa()
 		}
 
 		if (document.body === null)
@@ -19,7 +19,7 @@
 		;[report_errors, period_select, load_refs, tooltip, paginate_paths,
 			hchart_detail, settings_tabs, billing_subscribe, setup_datepicker,
 			filter_paths, add_ip, fill_tz, draw_chart, bind_scale, tsort,
-			copy_pre, ref_pages,
+			copy_pre, ref_pages, hchart_facets,
 		].forEach(function(f) { f.call() })
 	});
 
@@ -302,6 +302,11 @@
 
 	// Highlight a filter pattern in the path and title.
 	var highlight_filter = function(s) {
+		// Exclusions and facets never match anything that's listed.
+		s = s.split(/\s+/).filter(function(t) {
+			return !(t.length > 1 && t[0] === '-') && t.indexOf('path!=') !== 0 &&
+				!t.match(/^(country|browser|system|ref)!?=/)
+		}).join(' ')
 		if (s === '')
 			return;
 		$('.pages-list .count-list-pages > tbody.pages').find('.rlink, .page-title:not(.no-title)').each(function(_, elem) {
@@ -408,6 +413,7 @@
 					data:    append_period({total: get_total(), offset: rows.find('>div').length}),
 					success: function(data) {
 						rows.append($(data.html).find('>div'))
+						add_facet_links(chart)
 						if (!data.more)
 							btn.css('display', 'none')
 						done()
@@ -420,9 +426,11 @@
 		$('.hchart').on('click', '.load-detail', function(e) {
 			e.preventDefault()
 
+			// Details can have details of their own, such as the cities
+			// for a region.
 			var btn   = $(this),
 				row   = btn.closest('div[data-name]'),
-				chart = btn.closest('.hchart'),
+				chart = btn.closest('[data-detail]'),
 				url   = chart.attr('data-detail'),
 				name  = row.attr('data-name')
 			if (!url || !name)
@@ -446,6 +454,42 @@
 		})
 	}
 
+	// Filter the entire dashboard on a browser, location, etc. by adding it to
+	// the filter.
+	var hchart_facets = function() {
+		$('.hchart[data-facet]').each(function(_, chart) { add_facet_links($(chart)) })
+
+		$('.hcharts').on('click', '.filter-facet a', function(e) {
+			e.preventDefault()
+
+			var facet = $(this).closest('.hchart').attr('data-facet'),
+				name  = $(this).closest('div[data-name]').attr('data-name'),
+				input = $('#filter-paths')
+			if (name === '(unknown)')
+				name = ''
+			if (name === '' || name.match(/\s/))
+				name = '"' + name + '"'
+
+			input.val($.trim(input.val() + ' ' + facet + '=' + name))
+			$('#dash-form').trigger('submit')
+		})
+	}
+
+	// Add a link to filter on every row of a horizontal chart.
+	var add_facet_links = function(chart) {
+		var facet = chart.attr('data-facet')
+		if (!facet)
+			return
+		chart.children('.rows').children('div[data-name]').each(function(_, row) {
+			row = $(row)
+			if (row.find('.filter-facet').length)
+				return
+			if (row.attr('data-name') === '(unknown)' && facet !== 'ref')
+				return
+			row.find('.col-name').append(' <sup class="filter-facet"><a href="#" title="Show only pageviews with this">filter</a></sup>')
+		})
+	}
+
 	// Set up the tabbed navigation in the settings.
 	var settings_tabs = function() {
 		var nav = $('.tab-nav');
@@ -493,6 +537,9 @@
 		$('#dash-main input[type="checkbox"]').on('click', function(e) {
 			$(this).closest('form').trigger('submit')
 		})
+		$('#dash-main select').on('change', function(e) {
+			$(this).closest('form').trigger('submit')
+		})
 
 		$('#dash-select-period').on('click', 'button', function(e) {
 			e.preventDefault();
@@ -633,7 +680,7 @@
 
 		// Translucent hover effect; need a new div because the height isn't 100%
 		var add_cursor = function(t) {
-			if (t.closest('.chart-bar').length === 0 || t.is('#cursor') || t.closest('.chart-left, .chart-right').length > 0)
+			if (t.closest('.chart-bar').length === 0 || t.is('#cursor, .annotation') || t.closest('.chart-left, .chart-right').length > 0)
 				return
 
 			$('#cursor').remove()
@@ -808,6 +855,8 @@
 		data = data || {}
 		data['period-start'] = $('#period-start').val()
 		data['period-end']   = $('#period-end').val()
+		if (data.filter === undefined && $('#filter-paths').val())
+			data.filter = $('#filter-paths').val()
 		return data
 	}
 
@@ -0,0 +1,202 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/goatcounter/cfg"
+	"zgo.at/guru"
+	"zgo.at/zdb"
+	"zgo.at/zvalidate"
+)
+
+// QueryTimeout is the maximum time a query can run.
+var QueryTimeout = 3 * time.Second
+
+// QueryTemplate is a pre-defined read-only query over the stats tables.
+//
+// The SQL can use the named parameters :site, :start, :end (as timestamps,
+// for the hourly tables), :start_day, :end_day (as dates, for the daily
+// tables), :path (a "like" pattern), :limit, and {{day}} for the day of the
+// hour column. The site is always filtered on, so there is no way to access
+// other sites' data.
+type QueryTemplate struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Path        bool   `json:"path"` // Accepts the path parameter.
+	SQL         string `json:"-"`
+}
+
+// QueryTemplates are all the available queries.
+var QueryTemplates = map[string]QueryTemplate{
+	"paths": {
+		Description: "Pageviews per path.",
+		Path:        true,
+		SQL: `select path as name, sum(total) as count, sum(total_unique) as count_unique from hit_counts
+			where site=:site and event=0 and hour>=:start and hour<=:end and lower(path) like :path
+			group by path order by count_unique desc, name asc limit :limit`,
+	},
+	"paths_daily": {
+		Description: "Pageviews per day for the paths.",
+		Path:        true,
+		SQL: `select {{day}} as day, sum(total) as count, sum(total_unique) as count_unique from hit_counts
+			where site=:site and event=0 and hour>=:start and hour<=:end and lower(path) like :path
+			group by day order by day asc limit :limit`,
+	},
+	"events": {
+		Description: "Number of times an event was triggered.",
+		Path:        true,
+		SQL: `select path as name, sum(total) as count, sum(total_unique) as count_unique from hit_counts
+			where site=:site and event=1 and hour>=:start and hour<=:end and lower(path) like :path
+			group by path order by count_unique desc, name asc limit :limit`,
+	},
+	"refs": {
+		Description: "Pageviews per referrer, for the paths.",
+		Path:        true,
+		SQL: `select ref as name, sum(total) as count, sum(total_unique) as count_unique from ref_counts
+			where site=:site and hour>=:start and hour<=:end and lower(path) like :path
+			group by ref order by count_unique desc, name asc limit :limit`,
+	},
+	"browsers": {
+		Description: "Pageviews per browser.",
+		SQL: `select browser as name, sum(count) as count, sum(count_unique) as count_unique from browser_stats
+			where site=:site and day>=:start_day and day<=:end_day
+			group by browser order by count_unique desc, name asc limit :limit`,
+	},
+	"systems": {
+		Description: "Pageviews per operating system.",
+		SQL: `select system as name, sum(count) as count, sum(count_unique) as count_unique from system_stats
+			where site=:site and day>=:start_day and day<=:end_day
+			group by system order by count_unique desc, name asc limit :limit`,
+	},
+	"locations": {
+		Description: "Pageviews per country.",
+		SQL: `select location as name, sum(count) as count, sum(count_unique) as count_unique from location_stats
+			where site=:site and day>=:start_day and day<=:end_day
+			group by location order by count_unique desc, name asc limit :limit`,
+	},
+	"languages": {
+		Description: "Pageviews per language.",
+		SQL: `select language as name, sum(count) as count, sum(count_unique) as count_unique from language_stats
+			where site=:site and day>=:start_day and day<=:end_day
+			group by language order by count_unique desc, name asc limit :limit`,
+	},
+}
+
+func init() {
+	for k, t := range QueryTemplates {
+		t.Name = k
+		QueryTemplates[k] = t
+	}
+}
+
+// ListQueryTemplates gets all QueryTemplates, sorted by name.
+func ListQueryTemplates() []QueryTemplate {
+	l := make([]QueryTemplate, 0, len(QueryTemplates))
+	for _, t := range QueryTemplates {
+		l = append(l, t)
+	}
+	sort.Slice(l, func(i, j int) bool { return l[i].Name < l[j].Name })
+	return l
+}
+
+// QueryParams are the parameters for a QueryTemplate.
+type QueryParams struct {
+	Start string `json:"start"` // YYYY-MM-DD
+	End   string `json:"end"`   // YYYY-MM-DD
+	Path  string `json:"path"`  // Case-insensitive; * is a wildcard.
+	Limit int    `json:"limit"` // Maximum number of rows; default 100, maximum 1000.
+}
+
+// QueryRow is a row in the QueryResult; which fields are set depends on the
+// query.
+type QueryRow struct {
+	Day         string `db:"day" json:"day,omitempty"`
+	Name        string `db:"name" json:"name,omitempty"`
+	Count       int    `db:"count" json:"count"`
+	CountUnique int    `db:"count_unique" json:"count_unique"`
+}
+
+// QueryResult is the result of running a QueryTemplate.
+type QueryResult struct {
+	Query  string      `json:"query"`
+	Params QueryParams `json:"params"`
+	Rows   []QueryRow  `json:"rows"`
+}
+
+var reQueryParam = regexp.MustCompile(`:[a-z_]+`)
+
+// Run the query with the given name.
+func (q *QueryResult) Run(ctx context.Context, name string, params QueryParams) error {
+	tpl, ok := QueryTemplates[name]
+	if !ok {
+		return guru.Errorf(400, "unknown query: %q", name)
+	}
+
+	v := zvalidate.New()
+	v.Required("start", params.Start)
+	v.Required("end", params.End)
+	start := v.Date("start", params.Start, "2006-01-02")
+	end := v.Date("end", params.End, "2006-01-02")
+	if params.Limit == 0 {
+		params.Limit = 100
+	}
+	v.Range("limit", int64(params.Limit), 1, 1000)
+	if params.Path != "" && !tpl.Path {
+		v.Append("path", fmt.Sprintf("not supported for %q", name))
+	}
+	v.Len("path", params.Path, 0, 2048)
+	if v.HasErrors() {
+		return v
+	}
+
+	path := "%"
+	if params.Path != "" {
+		path = strings.ReplaceAll(strings.ToLower(params.Path), "*", "%")
+	}
+	values := map[string]interface{}{
+		":site":      MustGetSite(ctx).ID,
+		":start":     start.Format(zdb.Date),
+		":end":       end.Add(24*time.Hour - time.Second).Format(zdb.Date),
+		":start_day": start.Format("2006-01-02"),
+		":end_day":   end.Format("2006-01-02"),
+		":path":      path,
+		":limit":     params.Limit,
+	}
+
+	// Convert the named parameters to $n.
+	day := `substr(hour, 1, 10)`
+	if cfg.PgSQL {
+		day = `to_char(hour, 'YYYY-MM-DD')`
+	}
+	var (
+		args []interface{}
+		pos  = make(map[string]int)
+	)
+	query := reQueryParam.ReplaceAllStringFunc(strings.ReplaceAll(tpl.SQL, "{{day}}", day), func(p string) string {
+		if _, ok := pos[p]; !ok {
+			args = append(args, values[p])
+			pos[p] = len(args)
+		}
+		return fmt.Sprintf("$%d", pos[p])
+	})
+
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeout)
+	defer cancel()
+
+	q.Query, q.Params, q.Rows = name, params, []QueryRow{}
+	err := zdb.MustGet(ctx).SelectContext(ctx, &q.Rows, "/* QueryResult.Run */\n"+query, args...)
+	if ctx.Err() == context.DeadlineExceeded {
+		return guru.Errorf(400, "query took longer than %s; try a shorter period", QueryTimeout)
+	}
+	return errors.Wrap(err, "QueryResult.Run")
+}
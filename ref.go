@@ -175,7 +175,7 @@ func cleanRefURL(ref string, refURL *url.URL) (string, bool) {
 }
 
 // ListRefsByPath lists all references for a path.
-func (h *Stats) ListRefsByPath(ctx context.Context, path string, start, end time.Time, offset int) error {
+func (h *Stats) ListRefsByPath(ctx context.Context, path string, start, end time.Time, filter string, offset int) error {
 	site := MustGetSite(ctx)
 
 	limit := site.Settings.Limits.Ref
@@ -183,22 +183,28 @@ func (h *Stats) ListRefsByPath(ctx context.Context, path string, start, end time
 		limit = 10
 	}
 
-	err := zdb.MustGet(ctx).SelectContext(ctx, &h.Stats, `/* Stats.ListRefsByPath */
+	table, args, err := countsTable(ctx, "ref_counts", filter, start, end)
+	if err != nil {
+		return errors.Wrap(err, "Stats.ListRefsByPath")
+	}
+
+	db := zdb.MustGet(ctx)
+	err = db.SelectContext(ctx, &h.Stats, db.Rebind(`/* Stats.ListRefsByPath */
 		select
 			coalesce(sum(total), 0) as count,
 			coalesce(sum(total_unique), 0) as count_unique,
 			max(ref_scheme) as ref_scheme,
 			ref as name
-		from ref_counts
+		from `+table+`
 		where
-			site=$1 and
-			lower(path)=lower($2) and
-			hour>=$3 and
-			hour<=$4
+			site=? and
+			lower(path)=lower(?) and
+			hour>=? and
+			hour<=?
 		group by ref
 		order by count_unique desc, ref desc
-		limit $5 offset $6`,
-		site.ID, path, start.Format(zdb.Date), end.Format(zdb.Date), limit+1, offset)
+		limit ? offset ?`),
+		append(args, site.ID, path, start.Format(zdb.Date), end.Format(zdb.Date), limit+1, offset)...)
 
 	if len(h.Stats) > limit {
 		h.More = true
@@ -213,7 +219,7 @@ func (h *Stats) ListRefsByPath(ctx context.Context, path string, start, end time
 //
 // The returned count is the count without LinkDomain, and is different from the
 // total number of hits.
-func (h *Stats) ListTopRefs(ctx context.Context, start, end time.Time, offset int) error {
+func (h *Stats) ListTopRefs(ctx context.Context, start, end time.Time, filter string, offset int) error {
 	site := MustGetSite(ctx)
 
 	limit := site.Settings.Limits.Hchart
@@ -221,21 +227,26 @@ func (h *Stats) ListTopRefs(ctx context.Context, start, end time.Time, offset in
 		limit = 6
 	}
 
+	table, args, err := countsTable(ctx, "ref_counts", filter, start, end)
+	if err != nil {
+		return errors.Wrap(err, "Stats.ListTopRefs")
+	}
+
 	where := ` where site=? and hour>=? and hour<=?`
-	args := []interface{}{site.ID, start.Format(zdb.Date), end.Format(zdb.Date)}
+	args = append(args, site.ID, start.Format(zdb.Date), end.Format(zdb.Date))
 	if site.LinkDomain != "" {
 		where += " and ref not like ? "
 		args = append(args, site.LinkDomain+"%")
 	}
 
 	db := zdb.MustGet(ctx)
-	err := db.SelectContext(ctx, &h.Stats, db.Rebind(`/* Stats.ListTopRefs */
+	err = db.SelectContext(ctx, &h.Stats, db.Rebind(`/* Stats.ListTopRefs */
 		select
 			coalesce(sum(total), 0) as count,
 			coalesce(sum(total_unique), 0) as count_unique,
 			max(ref_scheme) as ref_scheme,
 			ref as name
-		from ref_counts`+
+		from `+table+
 		where+`
 		group by ref
 		order by count_unique desc
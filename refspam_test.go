@@ -0,0 +1,85 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter_test
+
+import (
+	"strings"
+	"testing"
+
+	"zgo.at/goatcounter"
+	"zgo.at/goatcounter/gctest"
+)
+
+func TestRefspam(t *testing.T) {
+	ctx, clean := gctest.DB(t)
+	defer clean()
+
+	hosts, err := goatcounter.ParseRefspam(strings.NewReader("# comment\n\nSPAM.example.com\n  spam.example.net \n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(hosts, " ") != "spam.example.com spam.example.net" {
+		t.Fatalf("wrong hosts: %q", hosts)
+	}
+	_, err = goatcounter.ParseRefspam(strings.NewReader("https://example.com/"))
+	if err == nil {
+		t.Error("no error for URL")
+	}
+
+	if goatcounter.IsRefspam("spam.example.com") {
+		t.Error("spam.example.com before update")
+	}
+	err = goatcounter.SetRefspam(ctx, hosts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer goatcounter.SetRefspam(ctx, nil)
+
+	tests := []struct {
+		host string
+		want bool
+	}{
+		{"localhost", true},
+		{"zvuker.net", true},
+		{"www.zvuker.net", true},
+		{"spam.example.com", true},
+		{"SPAM.example.com", true},
+		{"sub.spam.example.net", true},
+		{"example.com", false},
+		{"notspam.example.com", false},
+	}
+	for _, tt := range tests {
+		if got := goatcounter.IsRefspam(tt.host); got != tt.want {
+			t.Errorf("%s: got %t; want %t", tt.host, got, tt.want)
+		}
+	}
+
+	updated, err := goatcounter.LoadRefspam(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.IsZero() {
+		t.Error("updated is zero")
+	}
+}
+
+func TestSiteSettingsIgnoreRef(t *testing.T) {
+	ss := goatcounter.SiteSettings{IgnoreRefs: []string{"example.com", " Spam.example.net "}}
+	tests := []struct {
+		host string
+		want bool
+	}{
+		{"example.com", true},
+		{"www.example.com", true},
+		{"notexample.com", false},
+		{"spam.example.net", true},
+		{"example.net", false},
+	}
+	for _, tt := range tests {
+		if got := ss.IgnoreRef(tt.host); got != tt.want {
+			t.Errorf("%s: got %t; want %t", tt.host, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/zdb"
+)
+
+// Referrer spam list downloaded with the refspam cron task, in addition to the
+// list in refspam.go.
+var refspamUpdate struct {
+	mu      sync.RWMutex
+	hosts   map[string]struct{}
+	updated time.Time
+}
+
+type storedRefspam struct {
+	Updated time.Time `json:"updated"`
+	Hosts   []string  `json:"hosts"`
+}
+
+// IsRefspam reports if the host or any of its parent domains is in the referrer
+// spam list.
+func IsRefspam(host string) bool {
+	refspamUpdate.mu.RLock()
+	defer refspamUpdate.mu.RUnlock()
+
+	host = strings.ToLower(host)
+	for {
+		if _, ok := refspam[host]; ok {
+			return true
+		}
+		if _, ok := refspamUpdate.hosts[host]; ok {
+			return true
+		}
+		i := strings.IndexByte(host, '.')
+		if i == -1 {
+			return false
+		}
+		host = host[i+1:]
+	}
+}
+
+// ParseRefspam reads a referrer spam list with one domain per line; empty lines
+// and lines starting with "#" are skipped.
+func ParseRefspam(r io.Reader) ([]string, error) {
+	var hosts []string
+	scan := bufio.NewScanner(r)
+	for scan.Scan() {
+		l := strings.ToLower(strings.TrimSpace(scan.Text()))
+		if l == "" || l[0] == '#' {
+			continue
+		}
+		if strings.ContainsAny(l, " \t/") {
+			return nil, errors.Errorf("ParseRefspam: not a domain: %q", l)
+		}
+		hosts = append(hosts, l)
+	}
+	return hosts, errors.Wrap(scan.Err(), "ParseRefspam")
+}
+
+// SetRefspam sets the downloaded referrer spam list, and stores it in the
+// database so it's not lost on restarts.
+func SetRefspam(ctx context.Context, hosts []string) error {
+	stored := storedRefspam{Updated: Now().UTC(), Hosts: hosts}
+	j, err := json.Marshal(stored)
+	if err != nil {
+		return errors.Wrap(err, "SetRefspam")
+	}
+
+	err = zdb.TX(ctx, func(ctx context.Context, db zdb.DB) error {
+		_, err := db.ExecContext(ctx, `delete from store where key='refspam'`)
+		if err != nil {
+			return err
+		}
+		_, err = db.ExecContext(ctx, `insert into store (key, value) values ('refspam', $1)`, string(j))
+		return err
+	})
+	if err != nil {
+		return errors.Wrap(err, "SetRefspam")
+	}
+
+	setRefspam(stored)
+	return nil
+}
+
+// LoadRefspam loads the list stored with SetRefspam() if it's newer than the
+// current one, and returns when it was last updated. The time is zero if
+// there's no list yet.
+func LoadRefspam(ctx context.Context) (time.Time, error) {
+	var s string
+	err := zdb.MustGet(ctx).GetContext(ctx, &s, `select value from store where key='refspam'`)
+	if err != nil {
+		if zdb.ErrNoRows(err) {
+			return time.Time{}, nil
+		}
+		return time.Time{}, errors.Wrap(err, "LoadRefspam")
+	}
+
+	var stored storedRefspam
+	err = json.Unmarshal([]byte(s), &stored)
+	if err != nil {
+		return time.Time{}, errors.Wrap(err, "LoadRefspam")
+	}
+
+	refspamUpdate.mu.RLock()
+	newer := stored.Updated.After(refspamUpdate.updated)
+	refspamUpdate.mu.RUnlock()
+	if newer {
+		setRefspam(stored)
+	}
+	return stored.Updated, nil
+}
+
+func setRefspam(s storedRefspam) {
+	m := make(map[string]struct{}, len(s.Hosts))
+	for _, h := range s.Hosts {
+		m[h] = struct{}{}
+	}
+
+	refspamUpdate.mu.Lock()
+	defer refspamUpdate.mu.Unlock()
+	refspamUpdate.hosts, refspamUpdate.updated = m, s.Updated
+}
@@ -0,0 +1,142 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/goatcounter/cfg"
+	"zgo.at/zdb"
+	"zgo.at/zstd/zint"
+	"zgo.at/zvalidate"
+)
+
+// Retention is a report of visitor cohorts: the visitors first seen in a period
+// and how many of them returned in subsequent periods.
+//
+// This is calculated from the sessions, which are only kept for a few hours
+// (see docs/sessions.markdown), so "returning" visitors are mostly people who
+// were on the site around the period boundary. The first period is the first
+// period we saw the session in the selected time range.
+type Retention struct {
+	Period  string            `json:"period"` // "day" or "week"
+	Cohorts []RetentionCohort `json:"cohorts"`
+}
+
+// RetentionCohort is a single cohort.
+type RetentionCohort struct {
+	Start    time.Time `json:"start"`    // Start of the period.
+	Visitors int       `json:"visitors"` // Number of new sessions.
+
+	// Number of sessions that returned in the subsequent periods:
+	// Returning[0] is the next period, Returning[1] the one after that, etc.
+	Returning []int `json:"returning"`
+}
+
+// Get the retention report for this time range; cohorts start on Monday for
+// weekly cohorts. The days are in the timezone of start, using the UTC offset
+// at start for the entire period.
+func (r *Retention) Get(ctx context.Context, start, end time.Time, period string) error {
+	v := zvalidate.New()
+	v.Include("period", period, []string{"day", "week"})
+	if v.HasErrors() {
+		return v
+	}
+
+	_, off := start.Zone()
+	day := `substr(created_at, 1, 10)`
+	switch {
+	case cfg.PgSQL && off != 0:
+		day = fmt.Sprintf(`to_char(created_at + interval '%d minutes', 'YYYY-MM-DD')`, off/60)
+	case cfg.PgSQL:
+		day = `to_char(created_at, 'YYYY-MM-DD')`
+	case off != 0:
+		day = fmt.Sprintf(`date(created_at, '%+d minutes')`, off/60)
+	}
+
+	var rows []struct {
+		Session zint.Uint128 `db:"session2"`
+		Day     string       `db:"day"`
+	}
+	err := zdb.MustGet(ctx).SelectContext(ctx, &rows, `/* Retention.Get */
+		select session2, `+day+` as day from hits
+		where
+			site=$1 and bot=0 and event=0 and session2 is not null and
+			created_at>=$2 and created_at<=$3
+		group by session2, day`,
+		MustGetSite(ctx).ID, start.UTC().Format(zdb.Date), end.UTC().Format(zdb.Date))
+	if err != nil {
+		return errors.Wrap(err, "Retention.Get")
+	}
+
+	first := retentionPeriod(start, period)
+	n := retentionIndex(first, retentionPeriod(end, period), period) + 1
+
+	r.Period = period
+	r.Cohorts = make([]RetentionCohort, n)
+	for i := range r.Cohorts {
+		s := first.AddDate(0, 0, i)
+		if period == "week" {
+			s = first.AddDate(0, 0, i*7)
+		}
+		r.Cohorts[i] = RetentionCohort{Start: s, Returning: make([]int, n-i-1)}
+	}
+
+	// Group the periods per session.
+	seen := make(map[zint.Uint128]map[int]struct{})
+	for _, row := range rows {
+		d, err := time.ParseInLocation("2006-01-02", row.Day, start.Location())
+		if err != nil {
+			return errors.Wrap(err, "Retention.Get")
+		}
+		i := retentionIndex(first, retentionPeriod(d, period), period)
+		if i < 0 || i >= n {
+			continue
+		}
+		if seen[row.Session] == nil {
+			seen[row.Session] = make(map[int]struct{})
+		}
+		seen[row.Session][i] = struct{}{}
+	}
+
+	for _, periods := range seen {
+		c := n
+		for i := range periods {
+			if i < c {
+				c = i
+			}
+		}
+		r.Cohorts[c].Visitors++
+		for i := range periods {
+			if i > c {
+				r.Cohorts[c].Returning[i-c-1]++
+			}
+		}
+	}
+	return nil
+}
+
+// Get the start of the period t is in.
+func retentionPeriod(t time.Time, period string) time.Time {
+	t = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	if period == "week" {
+		t = t.AddDate(0, 0, -((int(t.Weekday()) + 6) % 7))
+	}
+	return t
+}
+
+// Get the index of the period t, relative to first.
+func retentionIndex(first, t time.Time, period string) int {
+	// Round, as days aren't always 24 hours with DST changes.
+	d := int(math.Round(t.Sub(first).Hours() / 24))
+	if period == "week" {
+		return d / 7
+	}
+	return d
+}
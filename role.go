@@ -0,0 +1,302 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/goatcounter/cfg"
+	"zgo.at/guru"
+	"zgo.at/zdb"
+	"zgo.at/zvalidate"
+)
+
+// Permission for API tokens and users.
+type Permission string
+
+const (
+	PermCount    Permission = "count"    // Record pageviews.
+	PermExport   Permission = "export"   // Export data.
+	PermStats    Permission = "stats"    // Read statistics.
+	PermSites    Permission = "sites"    // Add and remove sites.
+	PermDelete   Permission = "delete"   // Delete the site or purge data.
+	PermSettings Permission = "settings" // Change settings, API tokens, and roles.
+)
+
+// Permissions are all valid permissions.
+var Permissions = []Permission{PermCount, PermExport, PermStats, PermSites, PermDelete, PermSettings}
+
+var permissionLabels = map[Permission]string{
+	PermCount:    "Record pageviews",
+	PermExport:   "Export",
+	PermStats:    "Read statistics",
+	PermSites:    "Manage sites",
+	PermDelete:   "Delete data",
+	PermSettings: "Change settings",
+}
+
+// Label gets a human-readable label.
+func (p Permission) Label() string {
+	if l, ok := permissionLabels[p]; ok {
+		return l
+	}
+	return string(p)
+}
+
+// PermissionSet is a set of permissions.
+type PermissionSet []Permission
+
+// ParsePermissions converts the list of strings to a PermissionSet, ignoring
+// duplicates.
+func ParsePermissions(perms []string) PermissionSet {
+	ps := make(PermissionSet, 0, len(perms))
+	for _, p := range perms {
+		if p != "" && !ps.Has(Permission(p)) {
+			ps = append(ps, Permission(p))
+		}
+	}
+	return ps
+}
+
+func (ps PermissionSet) String() string {
+	s := make([]string, len(ps))
+	for i := range ps {
+		s[i] = string(ps[i])
+	}
+	return strings.Join(s, ", ")
+}
+
+// Has reports if p is in the set.
+func (ps PermissionSet) Has(p Permission) bool {
+	for _, pp := range ps {
+		if pp == p {
+			return true
+		}
+	}
+	return false
+}
+
+// Missing gets all permissions from need that are not in the set.
+func (ps PermissionSet) Missing(need ...Permission) []Permission {
+	var miss []Permission
+	for _, p := range need {
+		if !ps.Has(p) {
+			miss = append(miss, p)
+		}
+	}
+	return miss
+}
+
+// Merge the permissions from o in to a new set.
+func (ps PermissionSet) Merge(o PermissionSet) PermissionSet {
+	n := append(PermissionSet{}, ps...)
+	for _, p := range o {
+		if !n.Has(p) {
+			n = append(n, p)
+		}
+	}
+	return n
+}
+
+// Value implements the SQL Value function to determine what to store in the DB.
+func (ps PermissionSet) Value() (driver.Value, error) {
+	if ps == nil {
+		ps = PermissionSet{}
+	}
+	return json.Marshal([]Permission(ps))
+}
+
+// Scan converts the data returned from the DB into the struct.
+func (ps *PermissionSet) Scan(v interface{}) error {
+	switch vv := v.(type) {
+	case []byte:
+		return ps.UnmarshalJSON(vv)
+	case string:
+		return ps.UnmarshalJSON([]byte(vv))
+	default:
+		panic(fmt.Sprintf("unsupported type: %T", v))
+	}
+}
+
+// UnmarshalJSON reads the permissions as an array; for compatibility the old
+// format of {"count": true, "export": false} is also accepted.
+func (ps *PermissionSet) UnmarshalJSON(d []byte) error {
+	if len(d) > 0 && d[0] == '{' {
+		var old map[string]bool
+		err := json.Unmarshal(d, &old)
+		if err != nil {
+			return err
+		}
+		*ps = PermissionSet{}
+		for _, p := range Permissions {
+			if old[string(p)] {
+				*ps = append(*ps, p)
+			}
+		}
+		return nil
+	}
+
+	var l []Permission
+	err := json.Unmarshal(d, &l)
+	*ps = PermissionSet(l)
+	return err
+}
+
+func (ps PermissionSet) validate(v *zvalidate.Validator, key string) {
+	for _, p := range ps {
+		if _, ok := permissionLabels[p]; !ok {
+			v.Append(key, fmt.Sprintf("unknown permission: %q", p))
+		}
+	}
+}
+
+// check if all the permissions in need are in the set, or the role.
+//
+// Returns a 403 error listing the missing permissions if they're not.
+func (ps PermissionSet) check(ctx context.Context, roleID *int64, need ...Permission) error {
+	miss := ps.Missing(need...)
+	if len(miss) == 0 {
+		return nil
+	}
+
+	if roleID != nil {
+		// Don't filter on the site, as users can access their site's
+		// subsites. The role_id is always validated on assignment.
+		var role Role
+		err := zdb.MustGet(ctx).GetContext(ctx, &role,
+			`/* PermissionSet.check */ select * from roles where role_id=$1`, *roleID)
+		if err != nil {
+			return errors.Wrapf(err, "PermissionSet.check: role %d", *roleID)
+		}
+		miss = ps.Merge(role.Permissions).Missing(need...)
+	}
+	if len(miss) > 0 {
+		return guru.Errorf(http.StatusForbidden, "requires %s permissions", miss)
+	}
+	return nil
+}
+
+// Role is a named set of permissions, which can be assigned to API tokens and
+// users.
+type Role struct {
+	ID     int64 `db:"role_id" json:"id"`
+	SiteID int64 `db:"site_id" json:"-"`
+
+	Name        string        `db:"name" json:"name"`
+	Permissions PermissionSet `db:"permissions" json:"permissions"`
+
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+}
+
+// Defaults sets fields to default values, unless they're already set.
+func (r *Role) Defaults(ctx context.Context) {
+	r.SiteID = MustGetSite(ctx).ID
+	if r.CreatedAt.IsZero() {
+		r.CreatedAt = Now()
+	}
+	r.Name = strings.TrimSpace(r.Name)
+	sort.Slice(r.Permissions, func(i, j int) bool { return r.Permissions[i] < r.Permissions[j] })
+}
+
+// Validate the object.
+func (r *Role) Validate(ctx context.Context) error {
+	v := zvalidate.New()
+	v.Required("site_id", r.SiteID)
+	v.Required("name", r.Name)
+	v.Len("name", r.Name, 0, 50)
+	r.Permissions.validate(&v, "permissions")
+	return v.ErrorOrNil()
+}
+
+// Insert a new row.
+func (r *Role) Insert(ctx context.Context) error {
+	if r.ID > 0 {
+		return errors.New("ID > 0")
+	}
+
+	r.Defaults(ctx)
+	err := r.Validate(ctx)
+	if err != nil {
+		return err
+	}
+
+	query := `insert into roles (site_id, name, permissions, created_at) values ($1, $2, $3, $4)`
+	args := []interface{}{r.SiteID, r.Name, r.Permissions, r.CreatedAt.Format(zdb.Date)}
+
+	if cfg.PgSQL {
+		err := zdb.MustGet(ctx).GetContext(ctx, &r.ID, query+` returning role_id`, args...)
+		return errors.Wrap(err, "Role.Insert")
+	}
+
+	res, err := zdb.MustGet(ctx).ExecContext(ctx, query, args...)
+	if err != nil {
+		return errors.Wrap(err, "Role.Insert")
+	}
+	r.ID, err = res.LastInsertId()
+	return errors.Wrap(err, "Role.Insert")
+}
+
+// ByID gets a role by ID.
+func (r *Role) ByID(ctx context.Context, id int64) error {
+	return errors.Wrapf(zdb.MustGet(ctx).GetContext(ctx, r,
+		`/* Role.ByID */ select * from roles where role_id=$1 and site_id=$2`,
+		id, MustGetSite(ctx).ID), "Role.ByID %d", id)
+}
+
+// ByName gets a role by name.
+func (r *Role) ByName(ctx context.Context, name string) error {
+	return errors.Wrapf(zdb.MustGet(ctx).GetContext(ctx, r,
+		`/* Role.ByName */ select * from roles where name=$1 and site_id=$2`,
+		name, MustGetSite(ctx).ID), "Role.ByName %q", name)
+}
+
+// Delete the role; any tokens or users with this role will lose the
+// permissions.
+func (r *Role) Delete(ctx context.Context) error {
+	return zdb.TX(ctx, func(ctx context.Context, tx zdb.DB) error {
+		site := MustGetSite(ctx).ID
+		for _, q := range []string{
+			`update api_tokens set role_id=null where role_id=$1 and site_id=$2`,
+			`update users set role_id=null where role_id=$1 and site=$2`,
+			`delete from roles where role_id=$1 and site_id=$2`,
+		} {
+			_, err := tx.ExecContext(ctx, `/* Role.Delete */ `+q, r.ID, site)
+			if err != nil {
+				return errors.Wrapf(err, "Role.Delete %d", r.ID)
+			}
+		}
+		return nil
+	})
+}
+
+type Roles []Role
+
+// List all roles for the current site.
+func (r *Roles) List(ctx context.Context) error {
+	return errors.Wrap(zdb.MustGet(ctx).SelectContext(ctx, r,
+		`/* Roles.List */ select * from roles where site_id=$1 order by name asc`,
+		MustGetSite(ctx).ID), "Roles.List")
+}
+
+// Name gets the name of the role with this ID, or "" if it doesn't exist.
+func (r Roles) Name(id *int64) string {
+	if id == nil {
+		return ""
+	}
+	for _, rr := range r {
+		if rr.ID == *id {
+			return rr.Name
+		}
+	}
+	return ""
+}
@@ -0,0 +1,139 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"zgo.at/zdb"
+)
+
+type storedSalt struct {
+	CurSalt     []byte    `json:"cur_salt"`
+	PrevSalt    []byte    `json:"prev_salt"`
+	SaltRotated time.Time `json:"salt_rotated"`
+}
+
+// SetSaltKey makes the Memstore persist the current and previous session salts
+// in the database whenever they're rotated, encrypted with key. This way a
+// restart doesn't start new sessions for every visitor.
+//
+// This must be called before Init(). A nil key restores the default of storing
+// the salts unencrypted with StoreSessions() only.
+func (m *ms) SetSaltKey(key []byte) {
+	m.ephemeralSalt = false
+	if key == nil {
+		m.saltKey, m.saltDB = nil, nil
+		return
+	}
+	k := sha256.Sum256(key)
+	m.saltKey = k[:]
+}
+
+// SetEphemeralSalt makes the Memstore never store the session salts, not even
+// on shutdown with StoreSessions(). Every restart will start new sessions.
+//
+// This must be called before Init().
+func (m *ms) SetEphemeralSalt() {
+	m.saltKey, m.saltDB = nil, nil
+	m.ephemeralSalt = true
+}
+
+// loadSalt loads the salts stored with persistSalt(), or stores the current
+// ones if there aren't any yet.
+func (m *ms) loadSalt(db zdb.DB) error {
+	var s string
+	err := db.GetContext(context.Background(), &s, `select value from store where key='salt'`)
+	if err != nil {
+		if zdb.ErrNoRows(err) {
+			return m.persistSalt(db)
+		}
+		return fmt.Errorf("load from DB store: %w", err)
+	}
+
+	d, err := m.cryptSalt(s, false)
+	if err != nil {
+		// Most likely the key changed; there's nothing we can do except start
+		// over with new salts.
+		return m.persistSalt(db)
+	}
+
+	var stored storedSalt
+	err = json.Unmarshal(d, &stored)
+	if err != nil {
+		return err
+	}
+	if len(stored.CurSalt) > 0 && len(stored.PrevSalt) > 0 {
+		m.curSalt, m.prevSalt, m.saltRotated = stored.CurSalt, stored.PrevSalt, stored.SaltRotated
+	}
+	return nil
+}
+
+// persistSalt stores the current salts, encrypted with the key.
+func (m *ms) persistSalt(db zdb.DB) error {
+	d, err := json.Marshal(storedSalt{
+		CurSalt:     m.curSalt,
+		PrevSalt:    m.prevSalt,
+		SaltRotated: m.saltRotated,
+	})
+	if err != nil {
+		return err
+	}
+	enc, err := m.cryptSalt(string(d), true)
+	if err != nil {
+		return err
+	}
+
+	return zdb.TX(zdb.With(context.Background(), db), func(ctx context.Context, db zdb.DB) error {
+		_, err := db.ExecContext(ctx, `delete from store where key='salt'`)
+		if err != nil {
+			return fmt.Errorf("persistSalt: %w", err)
+		}
+		_, err = db.ExecContext(ctx, `insert into store (key, value) values ('salt', $1)`, string(enc))
+		if err != nil {
+			return fmt.Errorf("persistSalt: %w", err)
+		}
+		return nil
+	})
+}
+
+// cryptSalt encrypts or decrypts d with AES-GCM; the encrypted data is base64
+// encoded with the nonce prepended.
+func (m *ms) cryptSalt(d string, encrypt bool) ([]byte, error) {
+	block, err := aes.NewCipher(m.saltKey)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	if encrypt {
+		nonce := make([]byte, gcm.NonceSize())
+		_, err := rand.Read(nonce)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, []byte(d), nil))), nil
+	}
+
+	b, err := base64.StdEncoding.DecodeString(d)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < gcm.NonceSize() {
+		return nil, fmt.Errorf("cryptSalt: too short")
+	}
+	return gcm.Open(nil, b[:gcm.NonceSize()], b[gcm.NonceSize():], nil)
+}
@@ -0,0 +1,206 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/goatcounter/cfg"
+	"zgo.at/guru"
+	"zgo.at/zdb"
+	"zgo.at/zstd/zstring"
+	"zgo.at/zvalidate"
+)
+
+// SegmentPeriods are the valid relative periods for a Segment; these are
+// always up to and including today.
+var SegmentPeriods = []string{"day", "week", "month", "quarter", "half-year", "year"}
+
+var reSegmentName = regexp.MustCompile(`^[a-z0-9_-]+$`)
+
+// Segment is a saved view of the dashboard: a named combination of period,
+// path filter, and other options.
+//
+// The period is either relative (Period is set) or fixed (PeriodStart and
+// PeriodEnd are set).
+type Segment struct {
+	ID     int64 `db:"segment_id" json:"id"`
+	SiteID int64 `db:"site_id" json:"-"`
+	UserID int64 `db:"user_id" json:"-"`
+
+	Name        string   `db:"name" json:"name"`
+	Period      string   `db:"period" json:"period"`
+	PeriodStart *string  `db:"period_start" json:"period_start"`
+	PeriodEnd   *string  `db:"period_end" json:"period_end"`
+	Filter      string   `db:"filter" json:"filter"`
+	Daily       zdb.Bool `db:"daily" json:"daily"`
+	Compare     string   `db:"compare" json:"compare"`
+
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+}
+
+// Defaults sets fields to default values, unless they're already set.
+func (s *Segment) Defaults(ctx context.Context) {
+	s.SiteID = MustGetSite(ctx).ID
+	if u := GetUser(ctx); u != nil {
+		s.UserID = u.ID
+	}
+	if s.CreatedAt.IsZero() {
+		s.CreatedAt = Now()
+	}
+	s.Name = strings.ToLower(strings.TrimSpace(s.Name))
+	s.Filter = strings.TrimSpace(s.Filter)
+	if s.Period != "" {
+		s.PeriodStart, s.PeriodEnd = nil, nil
+	}
+}
+
+// Validate the object.
+func (s *Segment) Validate(ctx context.Context) error {
+	v := zvalidate.New()
+	v.Required("site_id", s.SiteID)
+	v.Required("user_id", s.UserID)
+	v.Required("name", s.Name)
+	v.Len("name", s.Name, 0, 50)
+	if s.Name != "" && !reSegmentName.MatchString(s.Name) {
+		v.Append("name", "can only contain letters, numbers, '-', and '_'")
+	}
+	v.Len("filter", s.Filter, 0, 500)
+	if _, err := ParseFilter(s.Filter); err != nil {
+		v.Append("filter", "invalid regular expression")
+	}
+	if s.Compare != "" {
+		v.Include("compare", s.Compare, ComparePeriods)
+	}
+
+	if s.Period != "" {
+		v.Include("period", s.Period, SegmentPeriods)
+	} else {
+		if s.PeriodStart == nil || s.PeriodEnd == nil {
+			v.Append("period", "must set either a period or a start and end date")
+		} else {
+			start := v.Date("period_start", *s.PeriodStart, "2006-01-02")
+			end := v.Date("period_end", *s.PeriodEnd, "2006-01-02")
+			if end.Before(start) {
+				v.Append("period_end", "must be after the start date")
+			}
+		}
+	}
+	return v.ErrorOrNil()
+}
+
+// Insert a new row.
+func (s *Segment) Insert(ctx context.Context) error {
+	if s.ID > 0 {
+		return errors.New("ID > 0")
+	}
+
+	s.Defaults(ctx)
+	err := s.Validate(ctx)
+	if err != nil {
+		return err
+	}
+
+	query := `insert into segments (site_id, user_id, name, period, period_start, period_end,
+		filter, daily, compare, created_at) values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`
+	args := []interface{}{s.SiteID, s.UserID, s.Name, s.Period, s.PeriodStart, s.PeriodEnd,
+		s.Filter, s.Daily, s.Compare, s.CreatedAt.Format(zdb.Date)}
+
+	if cfg.PgSQL {
+		err := zdb.MustGet(ctx).GetContext(ctx, &s.ID, query+` returning segment_id`, args...)
+		if zdb.ErrUnique(err) {
+			return guru.Errorf(400, "there is already a view named %q", s.Name)
+		}
+		return errors.Wrap(err, "Segment.Insert")
+	}
+
+	res, err := zdb.MustGet(ctx).ExecContext(ctx, query, args...)
+	if err != nil {
+		if zdb.ErrUnique(err) {
+			return guru.Errorf(400, "there is already a view named %q", s.Name)
+		}
+		return errors.Wrap(err, "Segment.Insert")
+	}
+	s.ID, err = res.LastInsertId()
+	return errors.Wrap(err, "Segment.Insert")
+}
+
+// ByID gets a segment of the current user by ID.
+func (s *Segment) ByID(ctx context.Context, id int64) error {
+	return errors.Wrapf(zdb.MustGet(ctx).GetContext(ctx, s,
+		`/* Segment.ByID */ select * from segments where segment_id=$1 and site_id=$2 and user_id=$3`,
+		id, MustGetSite(ctx).ID, GetUser(ctx).ID), "Segment.ByID %d", id)
+}
+
+// ByName gets a segment of the current user by name.
+func (s *Segment) ByName(ctx context.Context, name string) error {
+	return errors.Wrapf(zdb.MustGet(ctx).GetContext(ctx, s,
+		`/* Segment.ByName */ select * from segments where name=$1 and site_id=$2 and user_id=$3`,
+		strings.ToLower(name), MustGetSite(ctx).ID, GetUser(ctx).ID), "Segment.ByName %q", name)
+}
+
+// Delete the segment.
+func (s *Segment) Delete(ctx context.Context) error {
+	_, err := zdb.MustGet(ctx).ExecContext(ctx,
+		`/* Segment.Delete */ delete from segments where segment_id=$1 and site_id=$2`,
+		s.ID, MustGetSite(ctx).ID)
+	return errors.Wrapf(err, "Segment.Delete %d", s.ID)
+}
+
+// Range gets the start and end of this segment's period in loc.
+//
+// Relative periods end at the end of the day of now; a week is the last 7 days
+// including today.
+func (s Segment) Range(now time.Time, loc *time.Location) (time.Time, time.Time) {
+	if s.Period == "" && s.PeriodStart != nil && s.PeriodEnd != nil {
+		start, _ := time.ParseInLocation("2006-01-02", *s.PeriodStart, loc)
+		end, _ := time.ParseInLocation("2006-01-02 15:04:05", *s.PeriodEnd+" 23:59:59", loc)
+		return start.UTC(), end.UTC()
+	}
+
+	y, m, d := now.In(loc).Date()
+	start := time.Date(y, m, d, 0, 0, 0, 0, loc)
+	end := time.Date(y, m, d, 23, 59, 59, 0, loc)
+	switch s.Period {
+	case "week":
+		start = start.AddDate(0, 0, -6)
+	case "month":
+		start = start.AddDate(0, -1, 0)
+	case "quarter":
+		start = start.AddDate(0, -3, 0)
+	case "half-year":
+		start = start.AddDate(0, -6, 0)
+	case "year":
+		start = start.AddDate(-1, 0, 0)
+	}
+	return start.UTC(), end.UTC()
+}
+
+type Segments []Segment
+
+// List all segments for the current user.
+func (s *Segments) List(ctx context.Context) error {
+	return errors.Wrap(zdb.MustGet(ctx).SelectContext(ctx, s,
+		`/* Segments.List */ select * from segments where site_id=$1 and user_id=$2 order by name asc`,
+		MustGetSite(ctx).ID, GetUser(ctx).ID), "Segments.List")
+}
+
+// Names gets the names of all segments.
+func (s Segments) Names() []string {
+	n := make([]string, 0, len(s))
+	for _, ss := range s {
+		n = append(n, ss.Name)
+	}
+	return n
+}
+
+// Has reports if there is a segment with this name.
+func (s Segments) Has(name string) bool {
+	return zstring.Contains(s.Names(), strings.ToLower(name))
+}
@@ -9,6 +9,7 @@ import (
 	"database/sql"
 	"database/sql/driver"
 	"fmt"
+	"net"
 	"strings"
 	"time"
 
@@ -43,7 +44,8 @@ var reserved = []string{
 }
 
 var statTables = []string{"hit_stats", "system_stats", "browser_stats",
-	"location_stats", "size_stats"}
+	"location_stats", "region_stats", "city_stats", "language_stats",
+	"size_stats", "path_transitions", "bot_stats"}
 
 // Site is a single site which is sending newsletters (i.e. it's a "customer").
 type Site struct {
@@ -63,23 +65,202 @@ type Site struct {
 	State     string     `db:"state"`
 	CreatedAt time.Time  `db:"created_at"`
 	UpdatedAt *time.Time `db:"updated_at"`
+
+	statsTZ *tz.Zone // Site's timezone if Settings.Timezone is the user's.
+}
+
+// WithUserTimezone gets a copy of the site with Settings.Timezone set to the
+// user's timezone, for showing the statistics. StatsTimezone() still returns
+// the site's timezone.
+func (s Site) WithUserTimezone(z *tz.Zone) Site {
+	if s.statsTZ == nil {
+		s.statsTZ = s.Settings.Timezone
+	}
+	s.Settings.Timezone = z
+	return s
+}
+
+// StatsTimezone gets the timezone the statistics per day are stored in; this is
+// the site's timezone, even if WithUserTimezone() was used.
+func (s Site) StatsTimezone() *tz.Zone {
+	if s.statsTZ != nil {
+		return s.statsTZ
+	}
+	return s.Settings.Timezone
 }
 
+// PublicPanels are the dashboard panels that can be hidden from visitors of a
+// public dashboard.
+var PublicPanels = []string{"pages", "referrers", "browsers", "systems", "sizes",
+	"locations", "languages", "entryexit", "engagement", "retention", "live",
+	"dimensions"}
+
 type SiteSettings struct {
-	Public           bool        `json:"public"`
-	TwentyFourHours  bool        `json:"twenty_four_hours"`
-	SundayStartsWeek bool        `json:"sunday_starts_week"`
-	DateFormat       string      `json:"date_format"`
-	NumberFormat     rune        `json:"number_format"`
-	DataRetention    int         `json:"data_retention"`
-	IgnoreIPs        zdb.Strings `json:"ignore_ips"`
-	Timezone         *tz.Zone    `json:"timezone"`
-	Campaigns        zdb.Strings `json:"campaigns"`
+	Public           bool           `json:"public"`
+	PublicHide       zdb.Strings    `json:"public_hide"`
+	AllowCounter     bool           `json:"allow_counter"`
+	TwentyFourHours  bool           `json:"twenty_four_hours"`
+	SundayStartsWeek bool           `json:"sunday_starts_week"`
+	DateFormat       string         `json:"date_format"`
+	NumberFormat     rune           `json:"number_format"`
+	DataRetention    int            `json:"data_retention"`
+	Downsample       int            `json:"downsample"`
+	IgnoreIPs        zdb.Strings    `json:"ignore_ips"`
+	IgnoreRefs       zdb.Strings    `json:"ignore_refs"`
+	DatacenterBots   bool           `json:"datacenter_bots"`
+	DashboardIPs     zdb.Strings    `json:"dashboard_ips"`
+	AnonymizeIP      bool           `json:"anonymize_ip"`
+	HonorDNT         bool           `json:"honor_dnt"`
+	StripUserAgent   bool           `json:"strip_user_agent"`
+	Cities           bool           `json:"cities"`
+	Timezone         *tz.Zone       `json:"timezone"`
+	Campaigns        zdb.Strings    `json:"campaigns"`
+	Dimensions       Dimensions     `json:"dimensions"`
+	PathGroups       PathGroups     `json:"path_groups"`
+	CanonicalPaths   CanonicalPaths `json:"canonical_paths"`
+	BotRules         BotRules       `json:"bot_rules"`
+	SPA              bool           `json:"spa"`
 	Limits           struct {
 		Page   int `json:"page"`
 		Ref    int `json:"ref"`
 		Hchart int `json:"hchart"`
 	} `json:"limits"`
+
+	dashboardNets []*net.IPNet // Parsed DashboardIPs.
+}
+
+// PublicHidden reports if the dashboard panel is hidden from visitors of the
+// public dashboard who aren't logged in.
+func (ss SiteSettings) PublicHidden(panel string) bool {
+	for _, p := range ss.PublicHide {
+		if p == panel {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowDashboard reports if the dashboard can be accessed from this IP address;
+// this is always true if DashboardIPs is empty.
+func (ss SiteSettings) AllowDashboard(ip string) bool {
+	if len(ss.DashboardIPs) == 0 {
+		return true
+	}
+	nets := ss.dashboardNets
+	if nets == nil {
+		nets = ss.parseDashboardIPs()
+	}
+	return MatchIPNet(ip, nets)
+}
+
+// parseDashboardIPs parses DashboardIPs, skipping invalid entries. This is done
+// once when the settings are loaded from the database or validated, rather than
+// on every request.
+func (ss SiteSettings) parseDashboardIPs() []*net.IPNet {
+	nets := make([]*net.IPNet, 0, len(ss.DashboardIPs))
+	for _, s := range ss.DashboardIPs {
+		if n, err := ParseIPNet(s); err == nil {
+			nets = append(nets, n)
+		}
+	}
+	return nets
+}
+
+// IgnoreIP reports if pageviews from this IP address shouldn't be counted, and
+// returns the IgnoreIPs entry that matched.
+func (ss SiteSettings) IgnoreIP(ip string) (string, bool) {
+	for _, s := range ss.IgnoreIPs {
+		if n, err := ParseIPNet(s); err == nil && MatchIPNet(ip, []*net.IPNet{n}) {
+			return strings.TrimSpace(s), true
+		}
+	}
+	return "", false
+}
+
+// IgnoreRef reports if pageviews with a referrer from this host shouldn't be
+// counted; the IgnoreRefs entries also match subdomains.
+func (ss SiteSettings) IgnoreRef(host string) bool {
+	host = strings.ToLower(host)
+	for _, r := range ss.IgnoreRefs {
+		r = strings.ToLower(strings.TrimSpace(r))
+		if r != "" && (host == r || strings.HasSuffix(host, "."+r)) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseIPNet parses an IP address or CIDR range; a single address is converted
+// to a range with just that address. Anything after a "#" is a comment, e.g.
+// "192.0.2.0/24 # office".
+func ParseIPNet(s string) (*net.IPNet, error) {
+	if i := strings.IndexByte(s, '#'); i > -1 {
+		s = s[:i]
+	}
+	s = strings.TrimSpace(s)
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("%q: not a valid IP address or CIDR range", s)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, fmt.Errorf("%q: not a valid IP address or CIDR range", s)
+	}
+	return n, nil
+}
+
+// ipComment reports if an entry in an IP list is just a comment, such as
+// "# office network"; these are skipped.
+func ipComment(s string) bool {
+	i := strings.IndexByte(s, '#')
+	return i > -1 && strings.TrimSpace(s[:i]) == ""
+}
+
+// AnonymizeIP removes the host part of an IP address: the last octet of an IPv4
+// address (/24), and everything after the first 48 bits of an IPv6 address
+// (/48). An invalid address is returned as an empty string.
+func AnonymizeIP(ip string) string {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return ""
+	}
+	if ip4 := addr.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return addr.Mask(net.CIDRMask(48, 128)).String()
+}
+
+// VisitorIP gets the address to use for a visitor's pageviews, which is
+// anonymized if this is enabled for the site or the instance.
+//
+// This is what should be used for everything that's kept after the request,
+// such as the location lookup and session hashing.
+func (s Site) VisitorIP(ip string) string {
+	if cfg.AnonymizeIP || s.Settings.AnonymizeIP {
+		return AnonymizeIP(ip)
+	}
+	return ip
+}
+
+// MatchIPNet reports if the IP address is in any of the ranges.
+func MatchIPNet(ip string, nets []*net.IPNet) bool {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(addr) {
+			return true
+		}
+	}
+	return false
 }
 
 func (ss SiteSettings) String() string { return string(zjson.MustMarshal(ss)) }
@@ -89,14 +270,17 @@ func (ss SiteSettings) Value() (driver.Value, error) { return json.Marshal(ss) }
 
 // Scan converts the data returned from the DB into the struct.
 func (ss *SiteSettings) Scan(v interface{}) error {
+	var err error
 	switch vv := v.(type) {
 	case []byte:
-		return json.Unmarshal(vv, ss)
+		err = json.Unmarshal(vv, ss)
 	case string:
-		return json.Unmarshal([]byte(vv), ss)
+		err = json.Unmarshal([]byte(vv), ss)
 	default:
 		panic(fmt.Sprintf("unsupported type: %T", v))
 	}
+	ss.dashboardNets = ss.parseDashboardIPs()
+	return err
 }
 
 // Defaults sets fields to default values, unless they're already set.
@@ -133,6 +317,84 @@ func (s *Site) Defaults(ctx context.Context) {
 	}
 }
 
+// MaxDimensions is the maximum number of custom dimensions per site.
+const MaxDimensions = 3
+
+// Dimension types.
+const (
+	DimensionString = "string"
+	DimensionBool   = "bool"
+	DimensionNumber = "number"
+)
+
+var DimensionTypes = []string{DimensionString, DimensionBool, DimensionNumber}
+
+// Dimension is a custom dimension: an additional named value sent with the
+// pageview, such as "logged_in" or "tenant".
+type Dimension struct {
+	Name string
+	Type string
+}
+
+// Dimensions is a list of custom dimensions.
+//
+// It's stored and displayed as a comma-separated list of name:type pairs, e.g.
+// "tenant:string, logged_in:bool". The type is optional and defaults to
+// "string".
+type Dimensions []Dimension
+
+func (d Dimensions) String() string {
+	b := make([]string, 0, len(d))
+	for _, dd := range d {
+		b = append(b, dd.Name+":"+dd.Type)
+	}
+	return strings.Join(b, ", ")
+}
+
+// Get a dimension by name.
+func (d Dimensions) Get(name string) (Dimension, bool) {
+	for _, dd := range d {
+		if dd.Name == name {
+			return dd, true
+		}
+	}
+	return Dimension{}, false
+}
+
+// MarshalText converts the data to a human readable representation.
+func (d Dimensions) MarshalText() ([]byte, error) { return []byte(d.String()), nil }
+
+// UnmarshalText parses text in to the Go data structure.
+func (d *Dimensions) UnmarshalText(v []byte) error {
+	*d = Dimensions{}
+	for _, s := range strings.Split(string(v), ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+
+		dd := Dimension{Name: s, Type: DimensionString}
+		if c := strings.IndexRune(s, ':'); c > -1 {
+			dd.Name, dd.Type = strings.TrimSpace(s[:c]), strings.TrimSpace(s[c+1:])
+		}
+		dd.Name = strings.ToLower(dd.Name)
+		*d = append(*d, dd)
+	}
+	return nil
+}
+
+func validDimension(name string) bool {
+	if len(name) == 0 || len(name) > 32 {
+		return false
+	}
+	for _, c := range name {
+		if !(c == '_' || (c >= '0' && c <= '9') || (c >= 'a' && c <= 'z')) {
+			return false
+		}
+	}
+	return true
+}
+
 var noUnderscore = time.Date(2020, 03, 20, 0, 0, 0, 0, time.UTC)
 
 // Validate the object.
@@ -151,15 +413,77 @@ func (s *Site) Validate(ctx context.Context) error {
 
 	v.Range("settings.limits.page", int64(s.Settings.Limits.Page), 1, 25)
 	v.Range("settings.limits.ref", int64(s.Settings.Limits.Ref), 1, 25)
+	for _, p := range s.Settings.PublicHide {
+		v.Include("settings.public_hide", p, PublicPanels)
+	}
 
 	if s.Settings.DataRetention > 0 {
 		v.Range("settings.data_retention", int64(s.Settings.DataRetention), 14, 0)
 	}
+	if s.Settings.Downsample > 0 {
+		v.Range("settings.downsample", int64(s.Settings.Downsample), 14, 0)
+		if s.Settings.DataRetention > 0 && s.Settings.Downsample >= s.Settings.DataRetention {
+			v.Append("settings.downsample", "must be shorter than the data retention")
+		}
+	}
+
+	for _, ip := range s.Settings.IgnoreIPs {
+		if _, err := ParseIPNet(ip); err != nil && !ipComment(ip) {
+			v.Append("settings.ignore_ips", err.Error())
+		}
+	}
+
+	for _, r := range s.Settings.IgnoreRefs {
+		v.Len("settings.ignore_refs", strings.TrimSpace(r), 1, 255)
+		if strings.ContainsAny(r, "/:") {
+			v.Append("settings.ignore_refs", fmt.Sprintf("%q: must be a domain such as example.com", r))
+		}
+	}
+
+	for _, ip := range s.Settings.DashboardIPs {
+		if _, err := ParseIPNet(ip); err != nil && !ipComment(ip) {
+			v.Append("settings.dashboard_ips", err.Error())
+		}
+	}
+	s.Settings.dashboardNets = s.Settings.parseDashboardIPs()
+
+	if len(s.Settings.Dimensions) > MaxDimensions {
+		v.Append("settings.dimensions", fmt.Sprintf("can have at most %d dimensions", MaxDimensions))
+	}
+	seen := make(map[string]struct{}, len(s.Settings.Dimensions))
+	for _, d := range s.Settings.Dimensions {
+		if !validDimension(d.Name) {
+			v.Append("settings.dimensions", fmt.Sprintf(
+				"%q: must be between 1 and 32 characters and can only contain a to z, numbers, and '_'", d.Name))
+		}
+		if _, ok := seen[d.Name]; ok {
+			v.Append("settings.dimensions", fmt.Sprintf("%q: duplicate name", d.Name))
+		}
+		seen[d.Name] = struct{}{}
+		v.Include("settings.dimensions", d.Type, DimensionTypes)
+	}
 
-	if len(s.Settings.IgnoreIPs) > 0 {
-		for _, ip := range s.Settings.IgnoreIPs {
-			v.IP("settings.ignore_ips", ip)
+	if len(s.Settings.PathGroups) > MaxPathGroups {
+		v.Append("settings.path_groups", fmt.Sprintf("can have at most %d rules", MaxPathGroups))
+	}
+	for _, g := range s.Settings.PathGroups {
+		if g.Name == "" {
+			v.Append("settings.path_groups", fmt.Sprintf("%q: needs a name after the →", g.Pattern))
 		}
+		v.Len("settings.path_groups", g.Pattern, 1, 255)
+		v.Len("settings.path_groups", g.Name, 0, 255)
+	}
+
+	if len(s.Settings.BotRules) > MaxBotRules {
+		v.Append("settings.bot_rules", fmt.Sprintf("can have at most %d rules", MaxBotRules))
+	}
+	for i, r := range s.Settings.BotRules {
+		re, err := r.regexp()
+		if err != nil {
+			v.Append("settings.bot_rules", err.Error())
+		}
+		s.Settings.BotRules[i].re = re
+		v.Len("settings.bot_rules", r.Pattern, 1, 255)
 	}
 
 	v.Domain("link_domain", s.LinkDomain)
@@ -277,6 +601,7 @@ func (s *Site) Update(ctx context.Context) error {
 	_, err = zdb.MustGet(ctx).ExecContext(ctx,
 		`update sites set settings=$1, cname=$2, link_domain=$3, updated_at=$4 where id=$5`,
 		s.Settings, s.Cname, s.LinkDomain, s.UpdatedAt.Format(zdb.Date), s.ID)
+	ClearSiteCache()
 	return errors.Wrap(err, "Site.Update")
 }
 
@@ -303,6 +628,7 @@ func (s *Site) UpdateStripe(ctx context.Context, stripeID, plan, amount string)
 	_, err = zdb.MustGet(ctx).ExecContext(ctx,
 		`update sites set stripe=$1, plan=$2, billing_amount=$3, updated_at=$4 where id=$5`,
 		s.Stripe, s.Plan, s.BillingAmount, s.UpdatedAt.Format(zdb.Date), s.ID)
+	ClearSiteCache()
 	return errors.Wrap(err, "Site.UpdateStripe")
 }
 
@@ -315,6 +641,7 @@ func (s *Site) UpdateCnameSetupAt(ctx context.Context) error {
 	_, err := zdb.MustGet(ctx).ExecContext(ctx,
 		`update sites set cname_setup_at=$1 where id=$2`,
 		Now().Format(zdb.Date), s.ID)
+	ClearSiteCache()
 	return errors.Wrap(err, "Site.UpdateCnameSetupAt")
 }
 
@@ -331,6 +658,7 @@ func (s *Site) Delete(ctx context.Context) error {
 	if err != nil {
 		return errors.Wrap(err, "Site.Delete")
 	}
+	ClearSiteCache()
 	s.ID = 0
 	s.UpdatedAt = &t
 	s.State = StateDeleted
@@ -339,18 +667,31 @@ func (s *Site) Delete(ctx context.Context) error {
 
 // ByID gets a site by ID.
 func (s *Site) ByID(ctx context.Context, id int64) error {
-	return errors.Wrapf(zdb.MustGet(ctx).GetContext(ctx, s,
+	return errors.Wrapf(GetPrepared(ctx, s,
 		`/* Site.ByID */ select * from sites where id=$1 and state=$2`,
 		id, StateActive), "Site.ByID %d", id)
 }
 
 // ByHost gets a site by host name.
+//
+// This is done for every request, so the sites are cached for a short while.
 func (s *Site) ByHost(ctx context.Context, host string) error {
+	host = strings.ToLower(host)
+	if c, ok := siteCacheGet(host); ok {
+		*s = c
+		return nil
+	}
+
 	// Custom domain or serve.
 	if cfg.Serve || !strings.HasSuffix(host, cfg.Domain) {
-		return errors.Wrap(zdb.MustGet(ctx).GetContext(ctx, s,
+		err := GetPrepared(ctx, s,
 			`/* Site.ByHost */ select * from sites where lower(cname)=lower($1) and state=$2`,
-			zhttp.RemovePort(host), StateActive), "site.ByHost: from custom domain")
+			zhttp.RemovePort(host), StateActive)
+		if err != nil {
+			return errors.Wrap(err, "site.ByHost: from custom domain")
+		}
+		siteCacheSet(host, *s)
+		return nil
 	}
 
 	// Get from code (e.g. "arp242" in "arp242.goatcounter.com").
@@ -359,9 +700,21 @@ func (s *Site) ByHost(ctx context.Context, host string) error {
 		return errors.Errorf("Site.ByHost: no subdomain in host %q", host)
 	}
 
-	return errors.Wrap(zdb.MustGet(ctx).GetContext(ctx, s,
+	err := GetPrepared(ctx, s,
 		`/* Site.ByHost */ select * from sites where lower(code)=lower($1) and state=$2`,
-		host[:p], StateActive), "site.ByHost: from code")
+		host[:p], StateActive)
+	if err != nil {
+		return errors.Wrap(err, "site.ByHost: from code")
+	}
+	siteCacheSet(host, *s)
+	return nil
+}
+
+// ByCode gets a site by code.
+func (s *Site) ByCode(ctx context.Context, code string) error {
+	return errors.Wrapf(zdb.MustGet(ctx).GetContext(ctx, s,
+		`/* Site.ByCode */ select * from sites where lower(code)=lower($1) and state=$2`,
+		code, StateActive), "Site.ByCode %q", code)
 }
 
 // ListSubs lists all subsites, including the current site and parent.
@@ -481,7 +834,7 @@ func (s Site) PayExternal() string {
 
 func (s Site) DeleteAll(ctx context.Context) error {
 	return zdb.TX(ctx, func(ctx context.Context, tx zdb.DB) error {
-		for _, t := range append(statTables, "hit_counts", "ref_counts", "hits") {
+		for _, t := range append(statTables, "hit_counts", "ref_counts", "hit_rollups", "hits") {
 			_, err := tx.ExecContext(ctx, `delete from `+t+` where site=$1`, s.ID)
 			if err != nil {
 				return errors.Wrap(err, "Site.DeleteAll: delete "+t)
@@ -492,45 +845,96 @@ func (s Site) DeleteAll(ctx context.Context) error {
 	})
 }
 
+// Number of rows DeleteOlderThan() deletes at a time, and how long it pauses
+// between batches in production.
+var (
+	DeleteBatchSize  = 5000
+	deleteBatchPause = 200 * time.Millisecond
+)
+
+// DeleteOlderThan deletes all pageviews and statistics older than days.
+//
+// Rows are deleted in batches of DeleteBatchSize, with a short pause between
+// batches, and every batch is committed on its own. Deleting a year of data in
+// one transaction locks the tables for a long time, creates a lot of WAL on
+// PostgreSQL, and leaves the dead rows for a single (auto)vacuum run; with small
+// batches autovacuum can keep up, and the space is re-used without a VACUUM
+// FULL.
+//
+// All sites are stored in the same tables with their own retention, so this
+// can't drop partitions; DropHitPartitions() does that for the hits table once
+// the data is past the retention of every site.
 func (s Site) DeleteOlderThan(ctx context.Context, days int) error {
+	return s.deleteOlderThan(ctx, days, true)
+}
+
+// DeleteHitsOlderThan deletes the pageviews older than days, but keeps the
+// statistics, which are already aggregated per hour or day. This is the same as
+// DeleteOlderThan() otherwise.
+func (s Site) DeleteHitsOlderThan(ctx context.Context, days int) error {
+	return s.deleteOlderThan(ctx, days, false)
+}
+
+func (s Site) deleteOlderThan(ctx context.Context, days int, stats bool) error {
 	if days < 14 {
 		return errors.Errorf("days must be at least 14: %d", days)
 	}
 
-	return zdb.TX(ctx, func(ctx context.Context, tx zdb.DB) error {
-		ival := interval(days)
-		_, err := tx.ExecContext(ctx,
-			`delete from hits where site=$1 and created_at < `+ival,
-			s.ID)
+	tables := [][2]string{{"hits", "created_at"}, {"hit_counts", "hour"}, {"ref_counts", "hour"}}
+	for _, t := range statTables {
+		tables = append(tables, [2]string{t, "day"})
+	}
+	if !stats {
+		tables = tables[:1]
+	}
+
+	ival := interval(days)
+	for _, t := range tables {
+		err := deleteBatched(ctx, t[0], fmt.Sprintf(`site=%d and %s < %s`, s.ID, t[1], ival))
 		if err != nil {
-			return errors.Wrap(err, "Site.DeleteOlderThan: delete sites")
+			return errors.Wrap(err, "Site.DeleteOlderThan")
 		}
-
-		_, err = tx.ExecContext(ctx,
-			`delete from hit_counts where site=$1 and hour < `+ival,
-			s.ID)
+	}
+	if stats {
+		err := deleteRollupsOlderThan(ctx, s.ID, Now().AddDate(0, 0, -days))
 		if err != nil {
-			return errors.Wrap(err, "Site.DeleteOlderThan: delete sites")
+			return errors.Wrap(err, "Site.DeleteOlderThan")
 		}
+	}
+	return nil
+}
 
-		_, err = tx.ExecContext(ctx,
-			`delete from ref_counts where site=$1 and hour < `+ival,
-			s.ID)
+// deleteBatched deletes all rows from the table matching where in batches of
+// DeleteBatchSize.
+func deleteBatched(ctx context.Context, table, where string) error {
+	query := fmt.Sprintf(`delete from %[1]s where rowid in (select rowid from %[1]s where %[2]s limit %[3]d)`,
+		table, where, DeleteBatchSize)
+	if cfg.PgSQL {
+		query = fmt.Sprintf(`delete from %[1]s where ctid = any(array(select ctid from %[1]s where %[2]s limit %[3]d))`,
+			table, where, DeleteBatchSize)
+	}
+
+	for {
+		res, err := zdb.MustGet(ctx).ExecContext(ctx, query)
 		if err != nil {
-			return errors.Wrap(err, "Site.DeleteOlderThan: delete sites")
+			return errors.Wrapf(err, "delete %s", table)
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return errors.Wrapf(err, "delete %s", table)
+		}
+		if n < int64(DeleteBatchSize) {
+			return nil
 		}
 
-		for _, t := range statTables {
-			_, err := tx.ExecContext(ctx,
-				`delete from `+t+` where site=$1 and day < `+ival,
-				s.ID)
-			if err != nil {
-				return errors.Wrap(err, "Site.DeleteOlderThan: delete "+t)
+		if cfg.Prod {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(deleteBatchPause):
 			}
 		}
-
-		return nil
-	})
+	}
 }
 
 // Admin reports if this site is an admin.
@@ -562,6 +966,13 @@ func (s *Sites) ListSubs(ctx context.Context) error {
 		MustGetSite(ctx).ID, StateActive), "Sites.ListSubs")
 }
 
+// ListWithSubs lists the site with the given ID and all its subsites.
+func (s *Sites) ListWithSubs(ctx context.Context, id int64) error {
+	return errors.Wrap(zdb.MustGet(ctx).SelectContext(ctx, s, `/* Sites.ListWithSubs */
+		select * from sites where (id=$1 or parent=$1) and state=$2 order by id`,
+		id, StateActive), "Sites.ListWithSubs")
+}
+
 // ContainsCNAME reports if there is a site with this CNAME set.
 func (s *Sites) ContainsCNAME(ctx context.Context, cname string) (bool, error) {
 	var ok bool
@@ -9,9 +9,11 @@ import (
 	"fmt"
 	"reflect"
 	"testing"
+	"time"
 
 	. "zgo.at/goatcounter"
 	"zgo.at/goatcounter/gctest"
+	"zgo.at/zdb"
 	"zgo.at/zvalidate"
 )
 
@@ -62,6 +64,34 @@ func TestSiteValidate(t *testing.T) {
 			},
 			map[string][]string{"code": {"already exists"}},
 		},
+		{
+			Site{Code: "hello", State: StateActive, Plan: PlanPersonal, Settings: SiteSettings{
+				PathGroups: PathGroups{{Pattern: "/blog/*", Name: "/blog/"}, {Pattern: "/x/*"}}}},
+			nil,
+			map[string][]string{"settings.path_groups": {`"/x/*": needs a name after the →`}},
+		},
+		{
+			Site{Code: "hello", State: StateActive, Plan: PlanPersonal, Settings: SiteSettings{
+				DashboardIPs: []string{"10.0.0.0/8", "192.0.2.1", "2001:db8::/32", "10.0.0.0/33", "x"}}},
+			nil,
+			map[string][]string{"settings.dashboard_ips": {
+				`"10.0.0.0/33": not a valid IP address or CIDR range`,
+				`"x": not a valid IP address or CIDR range`}},
+		},
+		{
+			Site{Code: "hello", State: StateActive, Plan: PlanPersonal, Settings: SiteSettings{
+				IgnoreIPs: []string{"# office", "192.0.2.1 # home", "10.0.0.0/8", "10.0.0.0/33 # x"}}},
+			nil,
+			map[string][]string{"settings.ignore_ips": {`"10.0.0.0/33": not a valid IP address or CIDR range`}},
+		},
+		{
+			Site{Code: "hello", State: StateActive, Plan: PlanPersonal, Settings: SiteSettings{
+				BotRules: BotRules{{Type: "ua", Pattern: "Headless"}, {Type: "ua", Pattern: "("}, {Type: "x", Pattern: "y"}}}},
+			nil,
+			map[string][]string{"settings.bot_rules": {
+				"error parsing regexp: missing closing ): `(`",
+				`unknown type "x"; must be "ua" or "path"`}},
+		},
 	}
 
 	for i, tt := range tests {
@@ -90,3 +120,165 @@ func TestSiteValidate(t *testing.T) {
 		})
 	}
 }
+
+func TestSiteSettingsIgnoreIP(t *testing.T) {
+	tests := []struct {
+		list []string
+		ip   string
+		want string
+	}{
+		{nil, "192.0.2.1", ""},
+		{[]string{"192.0.2.1"}, "192.0.2.1", "192.0.2.1"},
+		{[]string{"192.0.2.1"}, "192.0.2.2", ""},
+		{[]string{"10.0.0.0/8", " 192.0.2.0/24 # office"}, "192.0.2.42", "192.0.2.0/24 # office"},
+		{[]string{"2001:db8::/32 #home"}, "2001:db8::1", "2001:db8::/32 #home"},
+		{[]string{"# just a comment"}, "192.0.2.1", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s %s", tt.list, tt.ip), func(t *testing.T) {
+			got, ok := SiteSettings{IgnoreIPs: tt.list}.IgnoreIP(tt.ip)
+			if got != tt.want || ok != (tt.want != "") {
+				t.Errorf("got %q %t; want %q", got, ok, tt.want)
+			}
+		})
+	}
+}
+
+func TestSiteSettingsAllowDashboard(t *testing.T) {
+	tests := []struct {
+		list []string
+		ip   string
+		want bool
+	}{
+		{nil, "192.0.2.1", true},
+		{[]string{"192.0.2.1"}, "192.0.2.1", true},
+		{[]string{"192.0.2.1"}, "192.0.2.2", false},
+		{[]string{"10.0.0.0/8", "192.0.2.0/24"}, "192.0.2.42", true},
+		{[]string{"10.0.0.0/8"}, "11.0.0.1", false},
+		{[]string{"2001:db8::/32"}, "2001:db8::1", true},
+		{[]string{"2001:db8::/32"}, "192.0.2.1", false},
+		{[]string{"192.0.2.1"}, "not an ip", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s %s", tt.list, tt.ip), func(t *testing.T) {
+			got := SiteSettings{DashboardIPs: tt.list}.AllowDashboard(tt.ip)
+			if got != tt.want {
+				t.Errorf("got %t; want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAnonymizeIP(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"192.0.2.42", "192.0.2.0"},
+		{"::ffff:192.0.2.42", "192.0.2.0"},
+		{"2001:db8:1234:5678::1", "2001:db8:1234::"},
+		{"not an ip", ""},
+		{"", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got := AnonymizeIP(tt.in)
+			if got != tt.want {
+				t.Errorf("\ngot:  %q\nwant: %q", got, tt.want)
+			}
+		})
+	}
+
+	s := Site{Settings: SiteSettings{AnonymizeIP: true}}
+	if got := s.VisitorIP("192.0.2.42"); got != "192.0.2.0" {
+		t.Errorf("VisitorIP: %q", got)
+	}
+	s.Settings.AnonymizeIP = false
+	if got := s.VisitorIP("192.0.2.42"); got != "192.0.2.42" {
+		t.Errorf("VisitorIP: %q", got)
+	}
+}
+
+func TestSiteByHostCache(t *testing.T) {
+	ctx, clean := gctest.DB(t)
+	defer clean()
+
+	ctx, site := gctest.Site(ctx, t, Site{Code: "cached"})
+	before := GetCacheStats()
+
+	var s1, s2 Site
+	for _, s := range []*Site{&s1, &s2} {
+		err := s.ByHost(ctx, "Cached.example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if s1.ID != site.ID || s2.ID != site.ID {
+		t.Fatalf("wrong site: %d, %d; want %d", s1.ID, s2.ID, site.ID)
+	}
+	if st := GetCacheStats(); st.SiteHits != before.SiteHits+1 || st.SiteMisses != before.SiteMisses+1 {
+		t.Errorf("wrong stats: %+v; before: %+v", st, before)
+	}
+
+	// Changing the site should clear the cache.
+	s1.Settings.Limits.Page = 20
+	err := s1.Update(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s3 Site
+	err = s3.ByHost(ctx, "cached.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s3.Settings.Limits.Page != 20 {
+		t.Errorf("stale site: %d", s3.Settings.Limits.Page)
+	}
+}
+
+func TestSiteDeleteOlderThan(t *testing.T) {
+	ctx, clean := gctest.DB(t)
+	defer clean()
+
+	defer func(n int) { DeleteBatchSize = n }(DeleteBatchSize)
+	DeleteBatchSize = 2
+
+	old := time.Now().UTC().Add(-30 * 24 * time.Hour)
+	gctest.StoreHits(ctx, t,
+		Hit{Path: "/a", CreatedAt: old},
+		Hit{Path: "/a", CreatedAt: old},
+		Hit{Path: "/b", CreatedAt: old},
+		Hit{Path: "/c", CreatedAt: old},
+		Hit{Path: "/d", CreatedAt: old},
+		Hit{Path: "/a", CreatedAt: time.Now().UTC()})
+
+	err := MustGetSite(ctx).DeleteOlderThan(ctx, 14)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	count := func(want map[string]int) {
+		t.Helper()
+		for tbl, w := range want {
+			var got int
+			err := zdb.MustGet(ctx).GetContext(ctx, &got, `select count(*) from `+tbl)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != w {
+				t.Errorf("%s: got %d rows; want %d", tbl, got, w)
+			}
+		}
+	}
+	count(map[string]int{"hits": 1, "hit_counts": 1, "hit_stats": 1})
+
+	// Keep the stats.
+	gctest.StoreHits(ctx, t, Hit{Path: "/a", CreatedAt: old})
+	err = MustGetSite(ctx).DeleteHitsOlderThan(ctx, 14)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count(map[string]int{"hits": 1, "hit_counts": 2, "hit_stats": 2})
+}
@@ -0,0 +1,91 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"context"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/goatcounter/cfg"
+	"zgo.at/zdb"
+)
+
+// statsTailHours is the number of most recent hours for which the statistics
+// are compared with the pageviews.
+const statsTailHours = 2
+
+type hourCount struct {
+	Hour        time.Time `db:"hour"`
+	Total       int       `db:"total"`
+	TotalUnique int       `db:"total_unique"`
+}
+
+// statsTail fills in the hit_counts for the most recent hours from the
+// pageviews if the statistics are behind, which happens if cron.UpdateStats is
+// slow or failing. Without this it looks like there's a dip in the number of
+// pageviews for the current hour.
+//
+// It returns the new counts, and reports if anything was filled in. Only the
+// last statsTailHours hours are looked at, so this should always be fast.
+func statsTail(ctx context.Context, counts []hourCount, start, end time.Time) ([]hourCount, bool, error) {
+	tailStart := Now().UTC().Truncate(time.Hour).Add(-(statsTailHours - 1) * time.Hour)
+	if end.Before(tailStart) {
+		return counts, false, nil
+	}
+	if start.After(tailStart) {
+		tailStart = start
+	}
+
+	hour := `strftime('%Y-%m-%d %H:00:00', created_at)`
+	if cfg.PgSQL {
+		hour = `to_char(created_at, 'YYYY-MM-DD HH24:00:00')`
+	}
+	var raw []struct {
+		Hour        string `db:"hour"`
+		Total       int    `db:"total"`
+		TotalUnique int    `db:"total_unique"`
+	}
+	err := zdb.MustGet(ctx).SelectContext(ctx, &raw, `/* statsTail */
+		select `+hour+` as hour, count(*) as total, sum(first_visit) as total_unique from hits
+		where site=$1 and bot=0 and created_at>=$2 and created_at<=$3
+		group by `+hour,
+		MustGetSite(ctx).ID, tailStart.Format(zdb.Date), end.Format(zdb.Date))
+	if err != nil {
+		return counts, false, errors.Wrap(err, "statsTail")
+	}
+
+	counted := make(map[string]int)
+	for _, c := range counts {
+		counted[c.Hour.UTC().Format(zdb.Date)] += c.Total
+	}
+
+	var (
+		behind  []hourCount
+		replace = make(map[string]struct{})
+	)
+	for _, r := range raw {
+		if r.Total <= counted[r.Hour] {
+			continue
+		}
+		h, err := time.Parse(zdb.Date, r.Hour)
+		if err != nil {
+			return counts, false, errors.Wrap(err, "statsTail")
+		}
+		behind = append(behind, hourCount{Hour: h, Total: r.Total, TotalUnique: r.TotalUnique})
+		replace[r.Hour] = struct{}{}
+	}
+	if len(behind) == 0 {
+		return counts, false, nil
+	}
+
+	filled := make([]hourCount, 0, len(counts)+len(behind))
+	for _, c := range counts {
+		if _, ok := replace[c.Hour.UTC().Format(zdb.Date)]; !ok {
+			filled = append(filled, c)
+		}
+	}
+	return append(filled, behind...), true, nil
+}
@@ -0,0 +1,168 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+// Package statsd sends internal metrics to a StatsD server.
+//
+// Counters are added up in memory and sent with the gauges every FlushInterval,
+// so that counting every pageview doesn't send a UDP packet for every
+// pageview. Everything is a no-op if Setup() isn't called.
+package statsd
+
+import (
+	"bytes"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/zlog"
+)
+
+// FlushInterval is how often the counters and gauges are sent.
+var FlushInterval = 10 * time.Second
+
+// Max. size of a single UDP packet; this is safe for most networks.
+const maxPacket = 1432
+
+var (
+	mu       sync.Mutex
+	conn     net.Conn
+	prefix   string
+	counters map[string]int64
+	gauges   map[string]func() int64
+	stop     chan struct{}
+	done     chan struct{}
+)
+
+// Setup starts sending metrics to the StatsD server at addr; all metric names
+// are prefixed with prefix.
+func Setup(addr, pfx string) error {
+	Stop()
+
+	c, err := net.Dial("udp", addr)
+	if err != nil {
+		return errors.Errorf("statsd.Setup: %w", err)
+	}
+
+	mu.Lock()
+	conn, prefix = c, pfx
+	counters = make(map[string]int64)
+	if gauges == nil {
+		gauges = make(map[string]func() int64)
+	}
+	stop, done = make(chan struct{}), make(chan struct{})
+	mu.Unlock()
+
+	go func() {
+		defer zlog.Recover()
+		defer close(done)
+		t := time.NewTicker(FlushInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				Flush()
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// Stop sending metrics; anything that wasn't sent yet is flushed first.
+func Stop() {
+	mu.Lock()
+	s, d := stop, done
+	mu.Unlock()
+	if s == nil {
+		return
+	}
+	close(s)
+	<-d
+
+	Flush()
+	mu.Lock()
+	conn.Close()
+	conn, stop, done = nil, nil, nil
+	mu.Unlock()
+}
+
+// Count adds n to the counter name.
+func Count(name string, n int64) {
+	mu.Lock()
+	defer mu.Unlock()
+	if conn == nil {
+		return
+	}
+	counters[name] += n
+}
+
+// Timing sends the duration of an operation immediately.
+func Timing(name string, d time.Duration) {
+	mu.Lock()
+	defer mu.Unlock()
+	if conn == nil {
+		return
+	}
+	send([]byte(prefix + name + ":" + strconv.FormatInt(d.Milliseconds(), 10) + "|ms"))
+}
+
+// Gauge registers a function to get the value of the gauge name, which is
+// called on every flush.
+//
+// This can be called before Setup().
+func Gauge(name string, f func() int64) {
+	mu.Lock()
+	defer mu.Unlock()
+	if gauges == nil {
+		gauges = make(map[string]func() int64)
+	}
+	gauges[name] = f
+}
+
+// Flush sends all counters and gauges.
+func Flush() {
+	mu.Lock()
+	defer mu.Unlock()
+	if conn == nil {
+		return
+	}
+
+	lines := make([]string, 0, len(counters)+len(gauges))
+	for k, v := range counters {
+		lines = append(lines, prefix+k+":"+strconv.FormatInt(v, 10)+"|c")
+	}
+	for k, f := range gauges {
+		lines = append(lines, prefix+k+":"+strconv.FormatInt(f(), 10)+"|g")
+	}
+	counters = make(map[string]int64)
+	sort.Strings(lines)
+
+	var buf bytes.Buffer
+	for _, l := range lines {
+		if buf.Len() > 0 && buf.Len()+len(l)+1 > maxPacket {
+			send(buf.Bytes())
+			buf.Reset()
+		}
+		if buf.Len() > 0 {
+			buf.WriteByte('\n')
+		}
+		buf.WriteString(l)
+	}
+	if buf.Len() > 0 {
+		send(buf.Bytes())
+	}
+}
+
+// send a packet; errors are logged but otherwise ignored, as the StatsD server
+// may be down and we don't want to fail because of that.
+func send(b []byte) {
+	_, err := conn.Write(b)
+	if err != nil {
+		zlog.Module("statsd").Error(err)
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package statsd
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatsd(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	read := func() string {
+		buf := make([]byte, maxPacket)
+		pc.SetReadDeadline(time.Now().Add(2 * time.Second))
+		n, _, err := pc.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(buf[:n])
+	}
+
+	// No-op before Setup().
+	Count("x", 1)
+	Flush()
+
+	Gauge("queue", func() int64 { return 42 })
+	err = Setup(pc.LocalAddr().String(), "gc.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Stop()
+
+	Timing("persist", 1500*time.Millisecond)
+	if have := read(); have != "gc.persist:1500|ms" {
+		t.Errorf("timing: %q", have)
+	}
+
+	Count("hits", 1)
+	Count("hits", 2)
+	Count("bots", 1)
+	Flush()
+	want := "gc.bots:1|c\ngc.hits:3|c\ngc.queue:42|g"
+	if have := read(); have != want {
+		t.Errorf("\nwant: %q\nhave: %q", want, have)
+	}
+
+	// Counters are reset after a flush.
+	Flush()
+	if have := read(); strings.Contains(have, "hits") {
+		t.Errorf("not reset: %q", have)
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"sync"
+	"time"
+
+	"zgo.at/zdb"
+)
+
+// StreamHit is a hit as sent to subscribers of HitStream; this doesn't include
+// anything that could identify the visitor, such as the session or
+// User-Agent.
+type StreamHit struct {
+	Path       string        `json:"path"`
+	Title      string        `json:"title"`
+	Ref        string        `json:"ref"`
+	Event      zdb.Bool      `json:"event"`
+	Bot        int           `json:"bot"`
+	Size       zdb.Floats    `json:"size"`
+	Location   string        `json:"location"`
+	FirstVisit zdb.Bool      `json:"first_visit"`
+	Dimensions HitDimensions `json:"dimensions,omitempty"`
+	CreatedAt  time.Time     `json:"created_at"`
+}
+
+// Number of hits to buffer per subscriber; hits are dropped for subscribers
+// who don't keep up.
+const streamBuffer = 256
+
+type hitStream struct {
+	mu   sync.Mutex
+	subs map[int64]map[chan StreamHit]struct{} // siteID → subscribers
+}
+
+// HitStream publishes all hits as they're persisted by the Memstore.
+var HitStream hitStream
+
+// Subscribe to all new hits for this site.
+//
+// The returned function must be called to unsubscribe when done, which will
+// also close the channel.
+func (s *hitStream) Subscribe(siteID int64) (<-chan StreamHit, func()) {
+	ch := make(chan StreamHit, streamBuffer)
+
+	s.mu.Lock()
+	if s.subs == nil {
+		s.subs = make(map[int64]map[chan StreamHit]struct{})
+	}
+	if s.subs[siteID] == nil {
+		s.subs[siteID] = make(map[chan StreamHit]struct{})
+	}
+	s.subs[siteID][ch] = struct{}{}
+	s.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			delete(s.subs[siteID], ch)
+			if len(s.subs[siteID]) == 0 {
+				delete(s.subs, siteID)
+			}
+			close(ch)
+		})
+	}
+}
+
+func (s *hitStream) publish(h Hit) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	subs := s.subs[h.Site]
+	if len(subs) == 0 {
+		return
+	}
+
+	sh := StreamHit{
+		Path:       h.Path,
+		Title:      h.Title,
+		Ref:        h.Ref,
+		Event:      h.Event,
+		Bot:        h.Bot,
+		Size:       h.Size,
+		Location:   h.Location,
+		FirstVisit: h.FirstVisit,
+		Dimensions: h.Dimensions,
+		CreatedAt:  h.CreatedAt,
+	}
+	for ch := range subs {
+		select {
+		case ch <- sh:
+		default:
+		}
+	}
+}
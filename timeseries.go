@@ -0,0 +1,451 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/goatcounter/cfg"
+	"zgo.at/zdb"
+	"zgo.at/zvalidate"
+)
+
+// Valid values for the Timeseries parameters.
+var (
+	TimeseriesMetrics       = []string{"pageviews", "visitors"}
+	TimeseriesGroups        = []string{"path", "ref", "country"}
+	TimeseriesGranularities = []string{"hour", "day", "month"}
+)
+
+// Maximum number of buckets and groups in a Timeseries.
+const (
+	MaxTimeseriesBuckets = 2000
+	MaxTimeseriesGroups  = 100
+)
+
+// Timeseries is a pivoted timeseries: the count per group per time bucket.
+//
+// All times are in UTC, unless Location is set.
+type Timeseries struct {
+	Metric      string             `json:"metric"`
+	Group       string             `json:"group"`
+	Granularity string             `json:"granularity"`
+	Filter      string             `json:"filter,omitempty"`
+	Start       time.Time          `json:"start"`
+	End         time.Time          `json:"end"`
+	Buckets     []string           `json:"buckets"`
+	Series      []TimeseriesSeries `json:"series"`
+	Compare     *TimeseriesCompare `json:"compare,omitempty"`
+	Annotations Annotations        `json:"annotations"`
+
+	// Timezone for the buckets; this uses the UTC offset at the start of the
+	// period for the entire period. This is UTC if nil.
+	Location *time.Location `json:"-"`
+}
+
+// TimeseriesCompare is the period the series are compared with; the previous
+// values are in TimeseriesSeries.Previous.
+type TimeseriesCompare struct {
+	Period  string    `json:"period"`
+	Start   time.Time `json:"start"`
+	End     time.Time `json:"end"`
+	Buckets []string  `json:"buckets"`
+}
+
+// TimeseriesSeries is the data for one group; Values has the same length and
+// order as Timeseries.Buckets, and Previous as TimeseriesCompare.Buckets.
+//
+// Change is the percentage change of Total compared to PreviousTotal, which is
+// nil if there was nothing in the previous period.
+type TimeseriesSeries struct {
+	Name   string `json:"name"`
+	Total  int    `json:"total"`
+	Values []int  `json:"values"`
+
+	Previous      []int    `json:"previous,omitempty"`
+	PreviousTotal int      `json:"previous_total,omitempty"`
+	Change        *float64 `json:"change,omitempty"`
+}
+
+type timeseriesSource struct {
+	table, col, timeCol, timeFmt string
+	count, countUnique           string
+}
+
+var timeseriesSources = map[string]timeseriesSource{
+	"path":    {"hit_counts", "path", "hour", zdb.Date, "total", "total_unique"},
+	"ref":     {"ref_counts", "ref", "hour", zdb.Date, "total", "total_unique"},
+	"country": {"location_stats", "location", "day", "2006-01-02", "count", "count_unique"},
+}
+
+// Go time format, SQLite strftime format, and PostgreSQL to_char format for
+// every granularity.
+var timeseriesFormats = map[string][3]string{
+	"hour":  {"2006-01-02 15:00", "%Y-%m-%d %H:00", "YYYY-MM-DD HH24:00"},
+	"day":   {"2006-01-02", "%Y-%m-%d", "YYYY-MM-DD"},
+	"month": {"2006-01", "%Y-%m", "YYYY-MM"},
+}
+
+// Get the timeseries for the top limit groups in this period.
+//
+// If Filter is set then only pageviews matching it are included; filtering
+// paths is only supported for the path group, but facets work for all groups.
+// See PathFilter for the syntax.
+func (ts *Timeseries) Get(
+	ctx context.Context, metric, group, granularity string, start, end time.Time, limit int,
+) error {
+	start, end = start.UTC(), end.UTC()
+
+	v := zvalidate.New()
+	v.Include("metric", metric, TimeseriesMetrics)
+	v.Include("group", group, TimeseriesGroups)
+	v.Include("granularity", granularity, TimeseriesGranularities)
+	v.Range("limit", int64(limit), 1, MaxTimeseriesGroups)
+	if group == "country" && granularity == "hour" {
+		v.Append("granularity", "hour is not supported for country")
+	}
+	if group == "country" {
+		// location_stats has the days in the site's timezone.
+		loc, siteLoc := ts.Location, MustGetSite(ctx).StatsTimezone().Loc()
+		if loc == nil {
+			loc = time.UTC
+		}
+		if loc.String() != siteLoc.String() {
+			v.Append("tz", fmt.Sprintf("must be the site's timezone (%s) for country", siteLoc))
+		}
+	}
+	if f, err := ParseFilter(ts.Filter); err != nil {
+		v.Sub("filter", "", err)
+	} else if f.HasPath() && group != "path" {
+		v.Append("filter", "filtering paths is only supported for path")
+	}
+	if !end.After(start) {
+		v.Append("end", "must be after start")
+	}
+	if v.HasErrors() {
+		return v
+	}
+
+	ts.Metric, ts.Group, ts.Granularity, ts.Start, ts.End = metric, group, granularity, start, end
+	ts.Buckets = ts.buckets(start, end)
+	if len(ts.Buckets) > MaxTimeseriesBuckets {
+		v.Append("granularity", fmt.Sprintf(
+			"more than %d buckets; use a larger granularity or shorter period", MaxTimeseriesBuckets))
+		return v
+	}
+
+	ts.Annotations = Annotations{}
+	err := ts.Annotations.ListRange(ctx, start, end)
+	if err != nil {
+		return errors.Wrap(err, "Timeseries.Get")
+	}
+
+	src := timeseriesSources[group]
+	count := src.count
+	if metric == "visitors" {
+		count = src.countUnique
+	}
+
+	var (
+		db   = zdb.MustGet(ctx)
+		site = MustGetSite(ctx)
+	)
+
+	filterQuery, filterArgs, err := filterSQL(ctx, ts.Filter, start, end, false)
+	if err != nil {
+		return errors.Wrap(err, "Timeseries.Get")
+	}
+	table, args, err := countsTable(ctx, src.table, ts.Filter, start, end)
+	if err != nil {
+		return errors.Wrap(err, "Timeseries.Get")
+	}
+
+	var top []struct {
+		Name  string `db:"name"`
+		Total int    `db:"total"`
+	}
+	err = db.SelectContext(ctx, &top, db.Rebind(fmt.Sprintf(`/* Timeseries.Get */
+		select %[1]s as name, sum(%[2]s) as total from %[3]s
+		where site=? and %[4]s>=? and %[4]s<=? %[6]s
+		group by %[1]s
+		order by total desc, name asc
+		limit %[5]d`, src.col, count, table, src.timeCol, limit, filterQuery)),
+		append(append(args, site.ID, ts.timeArg(src, start), ts.timeArg(src, end)), filterArgs...)...)
+	if err != nil {
+		return errors.Wrap(err, "Timeseries.Get")
+	}
+
+	ts.Series = make([]TimeseriesSeries, 0, len(top))
+	if len(top) == 0 {
+		return nil
+	}
+	names := make([]string, 0, len(top))
+	for _, t := range top {
+		names = append(names, t.Name)
+		ts.Series = append(ts.Series, TimeseriesSeries{Name: t.Name, Total: t.Total})
+	}
+
+	values, err := ts.values(ctx, start, end, ts.Buckets, names)
+	if err != nil {
+		return errors.Wrap(err, "Timeseries.Get")
+	}
+	for i := range ts.Series {
+		ts.Series[i].Values = values[i]
+	}
+	return nil
+}
+
+// GetTotal gets the timeseries for all pageviews in this period, as a single
+// series named "total".
+func (ts *Timeseries) GetTotal(
+	ctx context.Context, metric, granularity string, start, end time.Time,
+) error {
+	start, end = start.UTC(), end.UTC()
+
+	v := zvalidate.New()
+	v.Include("metric", metric, TimeseriesMetrics)
+	v.Include("granularity", granularity, TimeseriesGranularities)
+	if _, err := ParseFilter(ts.Filter); err != nil {
+		v.Sub("filter", "", err)
+	}
+	if !end.After(start) {
+		v.Append("end", "must be after start")
+	}
+	if v.HasErrors() {
+		return v
+	}
+
+	ts.Metric, ts.Group, ts.Granularity, ts.Start, ts.End = metric, "total", granularity, start, end
+	ts.Buckets = ts.buckets(start, end)
+	if len(ts.Buckets) > MaxTimeseriesBuckets {
+		v.Append("granularity", fmt.Sprintf(
+			"more than %d buckets; use a larger granularity or shorter period", MaxTimeseriesBuckets))
+		return v
+	}
+
+	ts.Annotations = Annotations{}
+	err := ts.Annotations.ListRange(ctx, start, end)
+	if err != nil {
+		return errors.Wrap(err, "Timeseries.GetTotal")
+	}
+
+	src := timeseriesSources["path"]
+	count := src.count
+	if metric == "visitors" {
+		count = src.countUnique
+	}
+	bucket := ts.bucketSQL(src)
+
+	filterQuery, filterArgs, err := filterSQL(ctx, ts.Filter, start, end, false)
+	if err != nil {
+		return errors.Wrap(err, "Timeseries.GetTotal")
+	}
+	table, args, err := countsTable(ctx, src.table, ts.Filter, start, end)
+	if err != nil {
+		return errors.Wrap(err, "Timeseries.GetTotal")
+	}
+
+	var rows []struct {
+		Bucket string `db:"bucket"`
+		Total  int    `db:"total"`
+	}
+	db := zdb.MustGet(ctx)
+	err = db.SelectContext(ctx, &rows, db.Rebind(fmt.Sprintf(`/* Timeseries.GetTotal */
+		select %[1]s as bucket, sum(%[2]s) as total from %[3]s
+		where site=? and %[4]s>=? and %[4]s<=? %[5]s
+		group by bucket`, bucket, count, table, src.timeCol, filterQuery)),
+		append(append(args, MustGetSite(ctx).ID, ts.timeArg(src, start), ts.timeArg(src, end)), filterArgs...)...)
+	if err != nil {
+		return errors.Wrap(err, "Timeseries.GetTotal")
+	}
+
+	bidx := make(map[string]int, len(ts.Buckets))
+	for i, b := range ts.Buckets {
+		bidx[b] = i
+	}
+	total := TimeseriesSeries{Name: "total", Values: make([]int, len(ts.Buckets))}
+	for _, r := range rows {
+		if b, ok := bidx[r.Bucket]; ok {
+			total.Values[b] += r.Total
+			total.Total += r.Total
+		}
+	}
+	ts.Series = []TimeseriesSeries{total}
+	return nil
+}
+
+// CompareWith compares the series with another period, filling in Compare and
+// the Previous, PreviousTotal, and Change fields of every series.
+//
+// This must be called after Get; the comparison is for the same groups, rather
+// than the top groups in the previous period.
+func (ts *Timeseries) CompareWith(ctx context.Context, compare string) error {
+	v := zvalidate.New()
+	v.Include("compare", compare, ComparePeriods)
+	if v.HasErrors() {
+		return v
+	}
+
+	start, end := ComparePeriod(ts.Start, ts.End, compare)
+	ts.Compare = &TimeseriesCompare{
+		Period:  compare,
+		Start:   start,
+		End:     end,
+		Buckets: ts.buckets(start, end),
+	}
+	if len(ts.Series) == 0 {
+		return nil
+	}
+
+	names := make([]string, 0, len(ts.Series))
+	for _, s := range ts.Series {
+		names = append(names, s.Name)
+	}
+	values, err := ts.values(ctx, start, end, ts.Compare.Buckets, names)
+	if err != nil {
+		return errors.Wrap(err, "Timeseries.CompareWith")
+	}
+	for i := range ts.Series {
+		ts.Series[i].Previous = values[i]
+		ts.Series[i].PreviousTotal = 0
+		for _, n := range values[i] {
+			ts.Series[i].PreviousTotal += n
+		}
+		ts.Series[i].Change = Change(ts.Series[i].Total, ts.Series[i].PreviousTotal)
+	}
+	return nil
+}
+
+// Get the count per bucket for every name in this period; the returned slice
+// is in the same order as names.
+func (ts *Timeseries) values(
+	ctx context.Context, start, end time.Time, buckets, names []string,
+) ([][]int, error) {
+	src := timeseriesSources[ts.Group]
+	count := src.count
+	if ts.Metric == "visitors" {
+		count = src.countUnique
+	}
+	bucket := ts.bucketSQL(src)
+
+	table, args, err := countsTable(ctx, src.table, ts.Filter, start, end)
+	if err != nil {
+		return nil, err
+	}
+	args = append(args, MustGetSite(ctx).ID, ts.timeArg(src, start), ts.timeArg(src, end))
+	idx := make(map[string]int, len(names))
+	values := make([][]int, 0, len(names))
+	for i, n := range names {
+		idx[n] = i
+		args = append(args, n)
+		values = append(values, make([]int, len(buckets)))
+	}
+	bidx := make(map[string]int, len(buckets))
+	for i, b := range buckets {
+		bidx[b] = i
+	}
+
+	var rows []struct {
+		Name   string `db:"name"`
+		Bucket string `db:"bucket"`
+		Total  int    `db:"total"`
+	}
+	db := zdb.MustGet(ctx)
+	err = db.SelectContext(ctx, &rows, db.Rebind(fmt.Sprintf(`/* Timeseries.values */
+		select %[1]s as name, %[2]s as bucket, sum(%[3]s) as total from %[4]s
+		where site=? and %[5]s>=? and %[5]s<=? and %[1]s in (?%[6]s)
+		group by %[1]s, bucket`,
+		src.col, bucket, count, table, src.timeCol, strings.Repeat(", ?", len(names)-1))), args...)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range rows {
+		if b, ok := bidx[r.Bucket]; ok {
+			values[idx[r.Name]][b] += r.Total
+		}
+	}
+	return values, nil
+}
+
+// offset gets the UTC offset of ts.Location at t in minutes.
+func (ts Timeseries) offset(t time.Time) int {
+	if ts.Location == nil {
+		return 0
+	}
+	_, off := t.In(ts.Location).Zone()
+	return off / 60
+}
+
+// timeArg formats t for comparing with src.timeCol; the days in the tables
+// with statistics per day are in the site's timezone, which is always
+// ts.Location for these.
+func (ts Timeseries) timeArg(src timeseriesSource, t time.Time) string {
+	if src.timeCol == "day" && ts.Location != nil {
+		t = t.In(ts.Location)
+	}
+	return t.Format(src.timeFmt)
+}
+
+// bucketSQL gets the SQL expression for the bucket of the src.timeCol in
+// ts.Location.
+func (ts Timeseries) bucketSQL(src timeseriesSource) string {
+	var (
+		f   = timeseriesFormats[ts.Granularity]
+		off = ts.offset(ts.Start)
+	)
+	if src.timeCol == "day" { // Already in ts.Location.
+		off = 0
+	}
+	if cfg.PgSQL {
+		col := src.timeCol
+		if off != 0 {
+			col = fmt.Sprintf(`%s + interval '%d minutes'`, col, off)
+		}
+		return fmt.Sprintf(`to_char(%s, '%s')`, col, f[2])
+	}
+	if off != 0 {
+		return fmt.Sprintf(`strftime('%s', %s, '%+d minutes')`, f[1], src.timeCol, off)
+	}
+	return fmt.Sprintf(`strftime('%s', %s)`, f[1], src.timeCol)
+}
+
+// buckets gets the buckets between start and end in ts.Location.
+func (ts Timeseries) buckets(start, end time.Time) []string {
+	loc := time.FixedZone("", ts.offset(ts.Start)*60)
+	return timeseriesBuckets(start.In(loc), end.In(loc), ts.Granularity)
+}
+
+func timeseriesBuckets(start, end time.Time, granularity string) []string {
+	var (
+		t    time.Time
+		next func(time.Time) time.Time
+		loc  = start.Location()
+	)
+	switch granularity {
+	case "hour":
+		t = time.Date(start.Year(), start.Month(), start.Day(), start.Hour(), 0, 0, 0, loc)
+		next = func(t time.Time) time.Time { return t.Add(time.Hour) }
+	case "day":
+		t = time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, loc)
+		next = func(t time.Time) time.Time { return t.AddDate(0, 0, 1) }
+	case "month":
+		t = time.Date(start.Year(), start.Month(), 1, 0, 0, 0, 0, loc)
+		next = func(t time.Time) time.Time { return t.AddDate(0, 1, 0) }
+	}
+
+	f := timeseriesFormats[granularity][0]
+	var buckets []string
+	for ; !t.After(end); t = next(t) {
+		buckets = append(buckets, t.Format(f))
+		if len(buckets) > MaxTimeseriesBuckets {
+			break
+		}
+	}
+	return buckets
+}
@@ -56,6 +56,11 @@ func init() {
 	// Implemented as function for performance.
 	zhttp.FuncMap["bar_chart"] = BarChart
 	zhttp.FuncMap["horizontal_chart"] = HorizontalChart
+	zhttp.FuncMap["sparkline"] = Sparkline
+
+	zhttp.FuncMap["seconds"] = func(s float64) string {
+		return (time.Duration(s) * time.Second).String()
+	}
 
 	// Override defaults to take site settings in to account.
 	zhttp.FuncMap["tformat"] = func(s *Site, t time.Time, fmt string) string {
@@ -121,19 +126,69 @@ func init() {
 	}
 }
 
-func BarChart(ctx context.Context, stats []Stat, max int, daily bool) template.HTML {
+// Sparkline renders the daily pageviews as a SVG line. The line uses
+// currentColor, so it can be styled with the CSS color property.
+func Sparkline(stats []Stat) template.HTML {
+	max := 0
+	for _, s := range stats {
+		if s.Daily > max {
+			max = s.Daily
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString(`<svg class="sparkline" viewBox="0 0 100 30" preserveAspectRatio="none" aria-hidden="true">`)
+	b.WriteString(`<polyline fill="none" stroke="currentColor" stroke-width="1.5" vector-effect="non-scaling-stroke" points="`)
+	for i, s := range stats {
+		x, y := 100.0, 29.0
+		if len(stats) > 1 {
+			x = float64(i) / float64(len(stats)-1) * 100
+		}
+		if max > 0 {
+			y = 29 - float64(s.Daily)/float64(max)*28
+		}
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteString(fmt.Sprintf("%.1f,%.1f", x, y))
+	}
+	b.WriteString(`"/></svg>`)
+	return template.HTML(b.String())
+}
+
+// BarChart renders the bars for the stats; annotations are displayed as a marker
+// at the start of the day.
+func BarChart(ctx context.Context, stats []Stat, max int, daily bool, annotations ...Annotations) template.HTML {
 	site := MustGetSite(ctx)
 	now := Now().In(site.Settings.Timezone.Loc())
 	today := now.Format("2006-01-02")
 
+	var ann map[string]string
+	if len(annotations) > 0 {
+		ann = annotations[0].ByDay()
+	}
+
+	type marker struct {
+		bar  int
+		text string
+	}
 	var (
-		future bool
-		b      strings.Builder
+		future  bool
+		b       strings.Builder
+		nbars   int
+		markers []marker
 	)
+	mark := func(day string) {
+		if t, ok := ann[day]; ok {
+			markers = append(markers, marker{nbars, t})
+		}
+	}
 	switch daily {
 	// Daily view.
 	case true:
 		for _, stat := range stats {
+			mark(stat.Day)
+			nbars++
 			if future {
 				b.WriteString(fmt.Sprintf(`<div title="%s" class="f"></div>`, stat.Day))
 				continue
@@ -160,7 +215,11 @@ func BarChart(ctx context.Context, stats []Stat, max int, daily bool) template.H
 		hour := now.Hour()
 		for i, stat := range stats {
 			for shour, s := range stat.Hourly {
+				if shour == 0 {
+					mark(stat.Day)
+				}
 				if future {
+					nbars++
 					b.WriteString(fmt.Sprintf(`<div title="%s|%[2]d:00|%[2]d:59" class="f"></div>`,
 						stat.Day, shour))
 					continue
@@ -173,6 +232,7 @@ func BarChart(ctx context.Context, stats []Stat, max int, daily bool) template.H
 					future = true
 				}
 
+				nbars++
 				h := math.Round(float64(s) / float64(max) / 0.01)
 				st := ""
 				if h > 0 {
@@ -187,6 +247,11 @@ func BarChart(ctx context.Context, stats []Stat, max int, daily bool) template.H
 		}
 	}
 
+	for _, m := range markers {
+		b.WriteString(fmt.Sprintf(`<span class="annotation" style="left:%.2f%%" title="%s"></span>`,
+			float64(m.bar)/float64(nbars)*100, template.HTMLEscapeString(m.text)))
+	}
+
 	return template.HTML(b.String())
 }
 
@@ -0,0 +1,105 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"context"
+	"database/sql"
+
+	"zgo.at/zdb"
+)
+
+// Span is a single operation in a trace.
+type Span interface {
+	// SetAttribute adds an attribute to the span.
+	SetAttribute(key string, value interface{})
+
+	// End the span; err is recorded on the span if it's not nil.
+	End(err error)
+}
+
+// Tracer creates spans; the default tracer doesn't do anything.
+type Tracer interface {
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+type nopTracer struct{}
+type nopSpan struct{}
+
+func (nopTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	return ctx, nopSpan{}
+}
+func (nopSpan) SetAttribute(string, interface{}) {}
+func (nopSpan) End(error)                        {}
+
+var tracer Tracer = nopTracer{}
+
+// SetTracer sets the tracer for StartSpan(); nil disables tracing.
+//
+// This must be called before anything uses StartSpan().
+func SetTracer(t Tracer) {
+	if t == nil {
+		t = nopTracer{}
+	}
+	tracer = t
+}
+
+// Tracing reports if a tracer is set.
+func Tracing() bool {
+	_, ok := tracer.(nopTracer)
+	return !ok
+}
+
+// StartSpan starts a new span, which must be ended with Span.End().
+func StartSpan(ctx context.Context, name string) (context.Context, Span) {
+	return tracer.Start(ctx, name)
+}
+
+// TraceDB wraps db to create a span for every query.
+//
+// zdb.TX() doesn't start a transaction on the returned value and the statement
+// cache isn't used, so this should only be used for read-only connections.
+func TraceDB(db zdb.DB) zdb.DB {
+	if !Tracing() {
+		return db
+	}
+	if _, ok := db.(traceDB); ok {
+		return db
+	}
+	return traceDB{db}
+}
+
+type traceDB struct{ zdb.DB }
+
+func (db traceDB) span(ctx context.Context, query string) (context.Context, Span) {
+	ctx, span := StartSpan(ctx, "db")
+	span.SetAttribute("db.statement", query)
+	return ctx, span
+}
+
+func (db traceDB) GetContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error {
+	ctx, span := db.span(ctx, query)
+	err := db.DB.GetContext(ctx, dest, query, args...)
+	if err == sql.ErrNoRows {
+		span.End(nil)
+	} else {
+		span.End(err)
+	}
+	return err
+}
+
+func (db traceDB) SelectContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error {
+	ctx, span := db.span(ctx, query)
+	err := db.DB.SelectContext(ctx, dest, query, args...)
+	span.End(err)
+	return err
+}
+
+func (db traceDB) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	ctx, span := db.span(ctx, query)
+	r, err := db.DB.ExecContext(ctx, query, args...)
+	span.End(err)
+	return r, err
+}
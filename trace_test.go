@@ -0,0 +1,79 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter_test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	. "zgo.at/goatcounter"
+	"zgo.at/goatcounter/gctest"
+	"zgo.at/zdb"
+)
+
+type testTracer struct {
+	mu    sync.Mutex
+	spans []string
+}
+
+type testSpan struct {
+	t     *testTracer
+	name  string
+	attrs map[string]interface{}
+}
+
+func (t *testTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	return ctx, &testSpan{t: t, name: name, attrs: make(map[string]interface{})}
+}
+
+func (s *testSpan) SetAttribute(k string, v interface{}) { s.attrs[k] = v }
+func (s *testSpan) End(err error) {
+	s.t.mu.Lock()
+	defer s.t.mu.Unlock()
+	s.t.spans = append(s.t.spans, fmt.Sprintf("%s %v %v", s.name, s.attrs, err))
+}
+
+func TestTrace(t *testing.T) {
+	ctx, clean := gctest.DB(t)
+	defer clean()
+
+	db := zdb.MustGet(ctx)
+	if TraceDB(db) != db {
+		t.Fatal("TraceDB wrapped without a tracer")
+	}
+
+	tr := &testTracer{}
+	SetTracer(tr)
+	defer SetTracer(nil)
+	if !Tracing() {
+		t.Fatal("Tracing() is false")
+	}
+
+	var one int
+	err := TraceDB(db).GetContext(ctx, &one, `select 1`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	Memstore.Append(gen(ctx))
+	_, err = Memstore.Persist(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"db map[db.statement:select 1] <nil>",
+		"Memstore.Persist map[hits:1] <nil>",
+	}
+	if fmt.Sprint(tr.spans) != fmt.Sprint(want) {
+		t.Errorf("\nwant: %q\nhave: %q", want, tr.spans)
+	}
+
+	SetTracer(nil)
+	if Tracing() {
+		t.Fatal("Tracing() is true")
+	}
+}
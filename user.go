@@ -8,14 +8,19 @@ import (
 	"context"
 	"crypto/rand"
 	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
 	"time"
 
 	"golang.org/x/crypto/bcrypt"
 	"zgo.at/errors"
 	"zgo.at/goatcounter/cfg"
 	"zgo.at/guru"
+	"zgo.at/tz"
 	"zgo.at/zdb"
 	"zgo.at/zhttp"
+	"zgo.at/zstd/zjson"
 	"zgo.at/zvalidate"
 )
 
@@ -26,24 +31,96 @@ type User struct {
 	ID   int64 `db:"id" json:"id,readonly"`
 	Site int64 `db:"site" json:"site,readonly"`
 
-	Email         string     `db:"email" json:"email"`
-	EmailVerified zdb.Bool   `db:"email_verified" json:"email_verified,readonly"`
-	Password      []byte     `db:"password" json:"-"`
-	TOTPEnabled   zdb.Bool   `db:"totp_enabled" json:"totp_enabled,readonly"`
-	TOTPSecret    []byte     `db:"totp_secret" json:"-"`
-	Role          string     `db:"role" json:"role,readonly"`
-	LoginAt       *time.Time `db:"login_at" json:"login_at,readonly"`
-	ResetAt       *time.Time `db:"reset_at" json:"reset_at,readonly"`
-	LoginRequest  *string    `db:"login_request" json:"-"`
-	LoginToken    *string    `db:"login_token" json:"-"`
-	CSRFToken     *string    `db:"csrf_token" json:"-"`
-	EmailToken    *string    `db:"email_token" json:"-"`
-	SeenUpdatesAt time.Time  `db:"seen_updates_at" json:"-"`
+	Email         string       `db:"email" json:"email"`
+	EmailVerified zdb.Bool     `db:"email_verified" json:"email_verified,readonly"`
+	Password      []byte       `db:"password" json:"-"`
+	TOTPEnabled   zdb.Bool     `db:"totp_enabled" json:"totp_enabled,readonly"`
+	TOTPSecret    []byte       `db:"totp_secret" json:"-"`
+	Role          string       `db:"role" json:"role,readonly"`
+	RoleID        *int64       `db:"role_id" json:"role_id,readonly"`
+	Owner         zdb.Bool     `db:"owner" json:"owner,readonly"`
+	LoginAt       *time.Time   `db:"login_at" json:"login_at,readonly"`
+	ResetAt       *time.Time   `db:"reset_at" json:"reset_at,readonly"`
+	LoginRequest  *string      `db:"login_request" json:"-"`
+	LoginToken    *string      `db:"login_token" json:"-"`
+	CSRFToken     *string      `db:"csrf_token" json:"-"`
+	EmailToken    *string      `db:"email_token" json:"-"`
+	SeenUpdatesAt time.Time    `db:"seen_updates_at" json:"-"`
+	EmailReports  string       `db:"email_reports" json:"email_reports"`
+	EmailReportAt *time.Time   `db:"email_report_at" json:"-"`
+	Settings      UserSettings `db:"settings" json:"settings"`
+
+	// Session this user was loaded from, if any.
+	Session *UserSession `db:"-" json:"-"`
 
 	CreatedAt time.Time  `db:"created_at" json:"created_at,readonly"`
 	UpdatedAt *time.Time `db:"updated_at" json:"updated_at,readonly"`
 }
 
+// UserSettings are the user's preferences.
+type UserSettings struct {
+	// Sites to include in the email reports; this can be the site the user
+	// belongs to and any of its subsites. Only the user's site is included if
+	// this is empty.
+	EmailReportSites []int64 `json:"email_report_sites"`
+
+	// Sections to include in the email reports; all of EmailReportSections if
+	// this is empty.
+	EmailReportSections []string `json:"email_report_sections"`
+
+	// Timezone to show the dashboard in; the site's timezone is used if this
+	// is nil.
+	Timezone *tz.Zone `json:"timezone"`
+}
+
+func (ss UserSettings) String() string { return string(zjson.MustMarshal(ss)) }
+
+// Value implements the SQL Value function to determine what to store in the DB.
+func (ss UserSettings) Value() (driver.Value, error) { return json.Marshal(ss) }
+
+// Scan converts the data returned from the DB into the struct.
+func (ss *UserSettings) Scan(v interface{}) error {
+	switch vv := v.(type) {
+	case []byte:
+		return json.Unmarshal(vv, ss)
+	case string:
+		return json.Unmarshal([]byte(vv), ss)
+	default:
+		panic(fmt.Sprintf("unsupported type: %T", v))
+	}
+}
+
+// ReportSites gets the IDs of the sites to include in the email reports.
+func (u User) ReportSites() []int64 {
+	if len(u.Settings.EmailReportSites) == 0 {
+		return []int64{u.Site}
+	}
+	return u.Settings.EmailReportSites
+}
+
+// ReportsSite reports if the site is included in the email reports.
+func (u User) ReportsSite(id int64) bool {
+	for _, s := range u.ReportSites() {
+		if s == id {
+			return true
+		}
+	}
+	return false
+}
+
+// ReportsSection reports if the section is included in the email reports.
+func (u User) ReportsSection(section string) bool {
+	if len(u.Settings.EmailReportSections) == 0 {
+		return true
+	}
+	for _, s := range u.Settings.EmailReportSections {
+		if s == section {
+			return true
+		}
+	}
+	return false
+}
+
 // Defaults sets fields to default values, unless they're already set.
 func (u *User) Defaults(ctx context.Context) {
 	if s := GetSite(ctx); s != nil && s.ID > 0 { // Not set in website.
@@ -70,6 +147,31 @@ func (u *User) Validate(ctx context.Context, validatePassword bool) error {
 	v.Required("email", u.Email)
 	v.Len("email", u.Email, 5, 255)
 	v.Email("email", u.Email)
+	if u.EmailReports != "" {
+		v.Include("email_reports", u.EmailReports, EmailReportPeriods)
+	}
+	for _, sec := range u.Settings.EmailReportSections {
+		v.Include("settings.email_report_sections", sec, EmailReportSections)
+	}
+	if len(u.Settings.EmailReportSites) > 0 {
+		var sites Sites
+		err := sites.ListWithSubs(ctx, u.Site)
+		if err != nil {
+			return err
+		}
+		for _, id := range u.Settings.EmailReportSites {
+			found := false
+			for _, s := range sites {
+				if s.ID == id {
+					found = true
+					break
+				}
+			}
+			if !found {
+				v.Append("settings.email_report_sites", fmt.Sprintf("not a site you have access to: %d", id))
+			}
+		}
+	}
 
 	if validatePassword {
 		sp := string(u.Password)
@@ -123,11 +225,11 @@ func (u *User) Insert(ctx context.Context) error {
 	}
 
 	query := `insert into users `
-	args := []interface{}{u.Site, u.Email, u.Password, u.TOTPSecret, u.CreatedAt.Format(zdb.Date)}
+	args := []interface{}{u.Site, u.Email, u.Password, u.TOTPSecret, u.CreatedAt.Format(zdb.Date), u.Owner}
 	if u.EmailVerified {
-		query += ` (site, email, password, totp_secret, created_at, email_verified) values ($1, $2, $3, $4, $5, 1)`
+		query += ` (site, email, password, totp_secret, created_at, owner, email_verified) values ($1, $2, $3, $4, $5, $6, 1)`
 	} else {
-		query += ` (site, email, password, totp_secret, created_at, email_token) values ($1, $2, $3, $4, $5, $6)`
+		query += ` (site, email, password, totp_secret, created_at, owner, email_token) values ($1, $2, $3, $4, $5, $6, $7)`
 		args = append(args, u.EmailToken)
 	}
 
@@ -169,8 +271,8 @@ func (u *User) Update(ctx context.Context, emailChanged bool) error {
 	}
 
 	_, err = zdb.MustGet(ctx).ExecContext(ctx,
-		`update users set email=$1, updated_at=$2, email_verified=$3, email_token=$4 where id=$5`,
-		u.Email, u.UpdatedAt.Format(zdb.Date), u.EmailVerified, u.EmailToken, u.ID)
+		`update users set email=$1, updated_at=$2, email_verified=$3, email_token=$4, email_reports=$5, settings=$6 where id=$7`,
+		u.Email, u.UpdatedAt.Format(zdb.Date), u.EmailVerified, u.EmailToken, u.EmailReports, u.Settings, u.ID)
 	return errors.Wrap(err, "User.Update")
 }
 
@@ -248,26 +350,49 @@ func (u *User) ByResetToken(ctx context.Context, key string) error {
 		key, MustGetSite(ctx).IDOrParent()), "User.ByResetToken")
 }
 
-// ByToken gets a user by login token.
+// ByToken gets a user by session token.
 func (u *User) ByToken(ctx context.Context, token string) error {
 	if token == "" {
 		return sql.ErrNoRows
 	}
 
-	return errors.Wrap(zdb.MustGet(ctx).GetContext(ctx, u,
-		`select * from users where login_token=$1`, token),
-		"User.ByToken")
+	var s UserSession
+	err := s.ByToken(ctx, token)
+	if err != nil {
+		return errors.Wrap(err, "User.ByToken")
+	}
+	err = zdb.MustGet(ctx).GetContext(ctx, u, `select * from users where id=$1`, s.UserID)
+	if err != nil {
+		return errors.Wrap(err, "User.ByToken")
+	}
+	u.Session = &s
+	return nil
 }
 
-// ByTokenAndSite gets a user by login token.
+// ByTokenAndSite gets a user by session token, and marks the session as seen.
 func (u *User) ByTokenAndSite(ctx context.Context, token string) error {
 	if token == "" {
 		return sql.ErrNoRows
 	}
 
+	var s UserSession
+	err := s.ByToken(ctx, token)
+	if err != nil {
+		return errors.Wrap(err, "User.ByTokenAndSite")
+	}
+	err = zdb.MustGet(ctx).GetContext(ctx, u, `select * from users where id=$1 and site=$2`,
+		s.UserID, MustGetSite(ctx).IDOrParent())
+	if err != nil {
+		return errors.Wrap(err, "User.ByTokenAndSite")
+	}
+	u.Session = &s
+	return errors.Wrap(s.Seen(ctx), "User.ByTokenAndSite")
+}
+
+// ByID gets a user by ID.
+func (u *User) ByID(ctx context.Context, id int64) error {
 	return errors.Wrap(zdb.MustGet(ctx).GetContext(ctx, u,
-		`select * from users where login_token=$1 and site=$2`,
-		token, MustGetSite(ctx).IDOrParent()), "User.ByTokenAndSite")
+		`/* User.ByID */ select * from users where id=$1`, id), "User.ByID")
 }
 
 // BySite gets a user by site.
@@ -325,6 +450,9 @@ func (u *User) DisableTOTP(ctx context.Context) error {
 }
 
 // Login a user; create a new key, CSRF token, and reset the request date.
+//
+// The key is used to verify the MFA step; the cookie is set to the token of a
+// new UserSession.
 func (u *User) Login(ctx context.Context) error {
 	u.CSRFToken = zhttp.Secret256P()
 	if u.LoginToken == nil || *u.LoginToken == "" {
@@ -339,7 +467,7 @@ func (u *User) Login(ctx context.Context) error {
 	return errors.Wrap(err, "User.Login")
 }
 
-// Logout a user.
+// Logout a user; this only removes the current session.
 func (u *User) Logout(ctx context.Context) error {
 	u.LoginToken = nil
 	u.LoginRequest = nil
@@ -347,7 +475,58 @@ func (u *User) Logout(ctx context.Context) error {
 	_, err := zdb.MustGet(ctx).ExecContext(ctx,
 		`update users set login_token=null, login_request=null where id=$1 and site=$2`,
 		u.ID, MustGetSite(ctx).IDOrParent())
-	return errors.Wrap(err, "User.Logout")
+	if err != nil {
+		return errors.Wrap(err, "User.Logout")
+	}
+	if u.Session != nil {
+		return errors.Wrap(u.Session.Delete(ctx), "User.Logout")
+	}
+	return nil
+}
+
+// ErrLastSettingsUser is returned by User.UpdateRole if the change would leave
+// the site without anyone who can change the settings.
+var ErrLastSettingsUser = guru.New(400,
+	"can’t remove the settings permission from the last user who has it")
+
+// UpdateRole makes the user a site owner, who can do everything, or sets the
+// role. The role is always nil for owners; users who aren't an owner and don't
+// have a role can't do anything.
+//
+// This returns ErrLastSettingsUser if it would remove PermSettings from the
+// last user who has it.
+func (u *User) UpdateRole(ctx context.Context, owner bool, roleID *int64) error {
+	if owner {
+		roleID = nil
+	}
+	if u.Can(ctx, PermSettings) == nil && (User{Owner: zdb.Bool(owner), RoleID: roleID}).Can(ctx, PermSettings) != nil {
+		var others Users
+		err := zdb.MustGet(ctx).SelectContext(ctx, &others,
+			`/* User.UpdateRole */ select * from users where site=$1 and id != $2`,
+			MustGetSite(ctx).IDOrParent(), u.ID)
+		if err != nil {
+			return errors.Wrap(err, "User.UpdateRole")
+		}
+		last := true
+		for _, o := range others {
+			if o.Can(ctx, PermSettings) == nil {
+				last = false
+				break
+			}
+		}
+		if last {
+			return ErrLastSettingsUser
+		}
+	}
+
+	_, err := zdb.MustGet(ctx).ExecContext(ctx,
+		`update users set owner=$1, role_id=$2 where id=$3 and site=$4`,
+		zdb.Bool(owner), roleID, u.ID, MustGetSite(ctx).IDOrParent())
+	if err != nil {
+		return errors.Wrap(err, "User.UpdateRole")
+	}
+	u.Owner, u.RoleID = zdb.Bool(owner), roleID
+	return nil
 }
 
 // GetToken gets the CSRF token.
@@ -366,11 +545,48 @@ func (u *User) SeenUpdates(ctx context.Context) error {
 	return errors.Wrap(err, "User.SeenUpdatesAt")
 }
 
+// Can reports if this user has all the permissions in need.
+//
+// The site owner can do everything; other users have the permissions of their
+// role.
+func (u User) Can(ctx context.Context, need ...Permission) error {
+	if u.Owner {
+		return nil
+	}
+	return PermissionSet{}.check(ctx, u.RoleID, need...)
+}
+
 type Users []User
 
+// List all users for the current site.
+func (u *Users) List(ctx context.Context) error {
+	return errors.Wrap(zdb.MustGet(ctx).SelectContext(ctx, u,
+		`/* Users.List */ select * from users where site=$1 order by id asc`,
+		MustGetSite(ctx).IDOrParent()), "Users.List")
+}
+
 // ByEmail gets all users with this email address.
 func (u *Users) ByEmail(ctx context.Context, email string) error {
 	return errors.Wrap(zdb.MustGet(ctx).SelectContext(ctx, u,
 		`select * from users where lower(email)=lower($1) order by id asc`, email),
 		"Users.ByEmail")
 }
+
+// ListEmailReports lists all users with a verified email address who have
+// enabled reports.
+func (u *Users) ListEmailReports(ctx context.Context) error {
+	return errors.Wrap(zdb.MustGet(ctx).SelectContext(ctx, u, `/* Users.ListEmailReports */
+		select * from users where email_reports != '' and email_verified=1 order by site, id`),
+		"Users.ListEmailReports")
+}
+
+// EmailReportSent records that an email report was sent at the given time.
+func (u *User) EmailReportSent(ctx context.Context, at time.Time) error {
+	_, err := zdb.MustGet(ctx).ExecContext(ctx, `update users set email_report_at=$1 where id=$2`,
+		at.Format(zdb.Date), u.ID)
+	if err != nil {
+		return errors.Wrap(err, "User.EmailReportSent")
+	}
+	u.EmailReportAt = &at
+	return nil
+}
@@ -0,0 +1,120 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"context"
+	"time"
+
+	"zgo.at/errors"
+	"zgo.at/goatcounter/cfg"
+	"zgo.at/zdb"
+	"zgo.at/zhttp"
+)
+
+// sessionSeenInterval is how often to update UserSession.LastSeenAt; it's not
+// updated on every request to avoid a write for every page load.
+const sessionSeenInterval = 5 * time.Minute
+
+// UserSession is a dashboard login; the token is stored in the "key" cookie.
+//
+// Every login creates a new session, so that signing in on another device
+// doesn't log out the others, and sessions can be revoked individually.
+type UserSession struct {
+	ID     int64  `db:"user_session_id" json:"id"`
+	UserID int64  `db:"user_id" json:"-"`
+	Token  string `db:"token" json:"-"`
+
+	IP        string `db:"ip" json:"ip"`
+	UserAgent string `db:"user_agent" json:"user_agent"`
+
+	CreatedAt  time.Time `db:"created_at" json:"created_at"`
+	LastSeenAt time.Time `db:"last_seen_at" json:"last_seen_at"`
+}
+
+// Insert a new session, generating the token.
+func (s *UserSession) Insert(ctx context.Context) error {
+	if s.ID > 0 {
+		return errors.New("ID > 0")
+	}
+	if s.UserID == 0 {
+		return errors.New("UserID == 0")
+	}
+
+	s.Token = Now().Format("20060102") + "-" + zhttp.Secret256()
+	s.CreatedAt = Now()
+	s.LastSeenAt = s.CreatedAt
+	if len(s.UserAgent) > 512 {
+		s.UserAgent = s.UserAgent[:512]
+	}
+
+	query := `insert into user_sessions (user_id, token, ip, user_agent, created_at, last_seen_at)
+		values ($1, $2, $3, $4, $5, $6)`
+	args := []interface{}{s.UserID, s.Token, s.IP, s.UserAgent,
+		s.CreatedAt.Format(zdb.Date), s.LastSeenAt.Format(zdb.Date)}
+
+	if cfg.PgSQL {
+		err := zdb.MustGet(ctx).GetContext(ctx, &s.ID, query+` returning user_session_id`, args...)
+		return errors.Wrap(err, "UserSession.Insert")
+	}
+
+	res, err := zdb.MustGet(ctx).ExecContext(ctx, query, args...)
+	if err != nil {
+		return errors.Wrap(err, "UserSession.Insert")
+	}
+	s.ID, err = res.LastInsertId()
+	return errors.Wrap(err, "UserSession.Insert")
+}
+
+// ByToken gets a session by the token.
+func (s *UserSession) ByToken(ctx context.Context, token string) error {
+	return errors.Wrap(zdb.MustGet(ctx).GetContext(ctx, s,
+		`/* UserSession.ByToken */ select * from user_sessions where token=$1`, token),
+		"UserSession.ByToken")
+}
+
+// Seen updates LastSeenAt, if it's been more than a few minutes since the last
+// update.
+func (s *UserSession) Seen(ctx context.Context) error {
+	now := Now()
+	if now.Sub(s.LastSeenAt) < sessionSeenInterval {
+		return nil
+	}
+
+	_, err := zdb.MustGet(ctx).ExecContext(ctx,
+		`/* UserSession.Seen */ update user_sessions set last_seen_at=$1 where user_session_id=$2`,
+		now.Format(zdb.Date), s.ID)
+	if err != nil {
+		return errors.Wrapf(err, "UserSession.Seen %d", s.ID)
+	}
+	s.LastSeenAt = now
+	return nil
+}
+
+// Delete the session for this user.
+func (s *UserSession) Delete(ctx context.Context) error {
+	_, err := zdb.MustGet(ctx).ExecContext(ctx,
+		`/* UserSession.Delete */ delete from user_sessions where user_session_id=$1 and user_id=$2`,
+		s.ID, s.UserID)
+	return errors.Wrapf(err, "UserSession.Delete %d", s.ID)
+}
+
+type UserSessions []UserSession
+
+// List all sessions for a user, most recently used first.
+func (s *UserSessions) List(ctx context.Context, userID int64) error {
+	return errors.Wrap(zdb.MustGet(ctx).SelectContext(ctx, s,
+		`/* UserSessions.List */ select * from user_sessions where user_id=$1
+		order by last_seen_at desc, user_session_id desc`, userID),
+		"UserSessions.List")
+}
+
+// DeleteOthers deletes all sessions for a user except keep.
+func (s UserSessions) DeleteOthers(ctx context.Context, userID, keep int64) error {
+	_, err := zdb.MustGet(ctx).ExecContext(ctx,
+		`/* UserSessions.DeleteOthers */ delete from user_sessions where user_id=$1 and user_session_id!=$2`,
+		userID, keep)
+	return errors.Wrap(err, "UserSessions.DeleteOthers")
+}
@@ -0,0 +1,64 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter_test
+
+import (
+	"testing"
+
+	"zgo.at/goatcounter"
+	"zgo.at/goatcounter/gctest"
+	"zgo.at/zdb"
+)
+
+func TestUserSession(t *testing.T) {
+	ctx, clean := gctest.DB(t)
+	defer clean()
+
+	user := goatcounter.GetUser(ctx)
+	sessions := make([]goatcounter.UserSession, 3)
+	for i := range sessions {
+		sessions[i] = goatcounter.UserSession{UserID: user.ID, IP: "127.0.0.1", UserAgent: "test"}
+		err := sessions[i].Insert(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var u goatcounter.User
+	err := u.ByTokenAndSite(ctx, sessions[0].Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.ID != user.ID || u.Session == nil || u.Session.ID != sessions[0].ID {
+		t.Fatalf("wrong user or session: %d %v", u.ID, u.Session)
+	}
+
+	// Logging out only removes the current session.
+	err = u.Logout(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = u.ByTokenAndSite(ctx, sessions[0].Token)
+	if !zdb.ErrNoRows(err) {
+		t.Fatalf("session still valid after logout: %v", err)
+	}
+	err = u.ByTokenAndSite(ctx, sessions[1].Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = goatcounter.UserSessions{}.DeleteOthers(ctx, user.ID, sessions[1].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var list goatcounter.UserSessions
+	err = list.List(ctx, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].ID != sessions[1].ID {
+		t.Errorf("wrong sessions after DeleteOthers: %v", list)
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter_test
+
+import (
+	"testing"
+
+	"zgo.at/errors"
+	"zgo.at/goatcounter"
+	"zgo.at/goatcounter/gctest"
+)
+
+func TestUserUpdateRole(t *testing.T) {
+	ctx, clean := gctest.DB(t)
+	defer clean()
+
+	role := goatcounter.Role{Name: "stats", Permissions: goatcounter.PermissionSet{goatcounter.PermStats}}
+	err := role.Insert(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only user with PermSettings.
+	user := goatcounter.GetUser(ctx)
+	err = user.UpdateRole(ctx, false, &role.ID)
+	if !errors.Is(err, goatcounter.ErrLastSettingsUser) {
+		t.Fatalf("wrong error: %v", err)
+	}
+	if user.RoleID != nil {
+		t.Fatalf("role changed: %v", *user.RoleID)
+	}
+
+	other := goatcounter.User{Email: "other@example.com", Password: []byte("coconuts"), Owner: true}
+	err = other.Insert(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = user.UpdateRole(ctx, false, &role.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The other user is now the last one.
+	err = other.UpdateRole(ctx, false, &role.ID)
+	if !errors.Is(err, goatcounter.ErrLastSettingsUser) {
+		t.Fatalf("wrong error: %v", err)
+	}
+	// Deleting the role doesn't make the user an owner.
+	err = role.Delete(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = user.ByID(ctx, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Owner || user.RoleID != nil {
+		t.Fatalf("owner=%t role_id=%v", user.Owner, user.RoleID)
+	}
+	if user.Can(ctx, goatcounter.PermStats) == nil {
+		t.Error("user without role can read stats")
+	}
+}
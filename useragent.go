@@ -0,0 +1,95 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter
+
+import (
+	"strings"
+
+	"zgo.at/gadget"
+)
+
+// UserAgent is the browser and system of a User-Agent header.
+type UserAgent struct {
+	Browser        string
+	BrowserVersion string
+	System         string
+	SystemVersion  string
+}
+
+// strippedUA is the prefix for the User-Agents stored by StripUserAgent(), as
+// "~browser\tversion\tsystem\tversion".
+//
+// This is only for storage in the hits table: the User-Agent header and the
+// import can't contain tabs (see CleanUserAgent()), so a header can't be
+// mistaken for this, and the CSV export writes it as a readable User-Agent
+// with UserAgent.String().
+const strippedUA = "~"
+
+// isStripped reports if ua was created with StripUserAgent().
+func isStripped(ua string) bool {
+	return strings.HasPrefix(ua, strippedUA) && strings.Count(ua, "\t") == 3
+}
+
+// CleanUserAgent replaces tabs in a User-Agent header with spaces, so it can't
+// be confused with a string created by StripUserAgent().
+func CleanUserAgent(ua string) string {
+	return strings.ReplaceAll(ua, "\t", " ")
+}
+
+// ParseUserAgent gets the browser and system from a User-Agent header, or from
+// a string created with StripUserAgent().
+func ParseUserAgent(ua string) UserAgent {
+	if isStripped(ua) {
+		f := strings.SplitN(ua[len(strippedUA):], "\t", 4)
+		return UserAgent{Browser: f[0], BrowserVersion: f[1], System: f[2], SystemVersion: f[3]}
+	}
+
+	u := gadget.Parse(ua)
+	return UserAgent{
+		Browser:        u.BrowserName,
+		BrowserVersion: u.BrowserVersion,
+		System:         u.OSName,
+		SystemVersion:  u.OSVersion,
+	}
+}
+
+// StripUserAgent reduces a User-Agent header to just the browser and system
+// names and versions, discarding everything else (device model, installed
+// extensions, etc).
+//
+// The result can be parsed with ParseUserAgent().
+func StripUserAgent(ua string) string {
+	if ua == "" || isStripped(ua) {
+		return ua
+	}
+	u := ParseUserAgent(ua)
+	return strippedUA + strings.Join([]string{u.Browser, u.BrowserVersion, u.System, u.SystemVersion}, "\t")
+}
+
+// ReadableUserAgent gets the User-Agent to show to people, such as in the
+// export: a string created by StripUserAgent() is converted with
+// UserAgent.String(), and everything else is returned as-is.
+func ReadableUserAgent(ua string) string {
+	if !isStripped(ua) {
+		return ua
+	}
+	return ParseUserAgent(ua).String()
+}
+
+// String gets the browser and system in a User-Agent like format, e.g.
+// "Firefox/79.0 (Linux)".
+func (u UserAgent) String() string {
+	b, s := u.Browser, u.System
+	if u.BrowserVersion != "" {
+		b += "/" + u.BrowserVersion
+	}
+	if u.SystemVersion != "" {
+		s += " " + u.SystemVersion
+	}
+	if s == "" {
+		return b
+	}
+	return b + " (" + s + ")"
+}
@@ -0,0 +1,89 @@
+// Copyright © 2019 Martin Tournoij – This file is part of GoatCounter and
+// published under the terms of a slightly modified EUPL v1.2 license, which can
+// be found in the LICENSE file or at https://license.goatcounter.com
+
+package goatcounter_test
+
+import (
+	"strings"
+	"testing"
+
+	"zgo.at/goatcounter"
+	"zgo.at/goatcounter/gctest"
+)
+
+func TestStripUserAgent(t *testing.T) {
+	tests := []string{
+		"",
+		"Mozilla/5.0 (X11; Linux x86_64; rv:79.0) Gecko/20100101 Firefox/79.0",
+		"Mozilla/5.0 (iPhone; CPU iPhone OS 13_5 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/13.1.1 Mobile/15E148 Safari/604.1",
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/84.0.4147.105 Safari/537.36",
+		"curl/7.68.0",
+	}
+
+	for _, tt := range tests {
+		t.Run(tt, func(t *testing.T) {
+			s := goatcounter.StripUserAgent(tt)
+			if tt != "" && !strings.HasPrefix(s, "~") {
+				t.Errorf("not stripped: %q", s)
+			}
+			if s2 := goatcounter.StripUserAgent(s); s2 != s {
+				t.Errorf("stripped twice: %q", s2)
+			}
+
+			want, got := goatcounter.ParseUserAgent(tt), goatcounter.ParseUserAgent(s)
+			if got != want {
+				t.Errorf("\ngot:  %#v\nwant: %#v", got, want)
+			}
+		})
+	}
+}
+
+func TestReadableUserAgent(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"", ""},
+		{"curl/7.68.0", "curl/7.68.0"},
+		{"Mozilla/5.0 (X11; Linux x86_64; rv:79.0) Gecko/20100101 Firefox/79.0", "Firefox/79 (Linux)"},
+		{"~not stripped", "~not stripped"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			ua := tt.in
+			if tt.in != tt.want {
+				ua = goatcounter.StripUserAgent(tt.in)
+			}
+			if have := goatcounter.ReadableUserAgent(ua); have != tt.want {
+				t.Errorf("\nhave: %q\nwant: %q", have, tt.want)
+			}
+		})
+	}
+
+	// A header can't be mistaken for a stripped User-Agent.
+	ua := goatcounter.CleanUserAgent("~Firefox\t79\tLinux\t")
+	if u := goatcounter.ParseUserAgent(ua); u.Browser == "Firefox" {
+		t.Errorf("parsed as stripped: %#v", u)
+	}
+}
+
+func TestHitStripUserAgent(t *testing.T) {
+	ctx, clean := gctest.DB(t)
+	defer clean()
+
+	ua := "Mozilla/5.0 (X11; Linux x86_64; rv:79.0) Gecko/20100101 Firefox/79.0"
+	site := goatcounter.MustGetSite(ctx)
+	for _, strip := range []bool{false, true} {
+		site.Settings.StripUserAgent = strip
+		h := goatcounter.Hit{Path: "/a", Browser: ua}
+		h.Defaults(ctx)
+
+		if want := strip; (h.Browser != ua) != want {
+			t.Errorf("strip=%t: %q", strip, h.Browser)
+		}
+		if u := goatcounter.ParseUserAgent(h.Browser); u.Browser != "Firefox" || u.System != "Linux" {
+			t.Errorf("strip=%t: %#v", strip, u)
+		}
+	}
+}